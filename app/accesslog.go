@@ -0,0 +1,214 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Formats of the access log
+const (
+	AccessLogText = "text"
+	AccessLogJSON = "json"
+)
+
+// AccessLog writes a record of every request to File, or to stdout without a file. The
+// records are lines of the combined log format with the received bytes and the duration
+// appended, or JSON objects with the Format json. Once the file exceeds MaxSize, it's rotated
+// to File.1 and so on, keeping Backups rotated files, 1 by default.
+type AccessLog struct {
+	File    string
+	Format  string
+	MaxSize ByteSize
+	Backups int
+}
+
+// accessRecord is the record of a request in the access log.
+type accessRecord struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Protocol  string    `json:"protocol"`
+	User      string    `json:"user"`
+	Status    int       `json:"status"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Duration  float64   `json:"durationMs"`
+	Address   string    `json:"address"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// AccessLogger writes the access log. A nil AccessLogger logs nothing.
+type AccessLogger struct {
+	settings *AccessLog
+
+	mu   sync.Mutex
+	out  io.Writer
+	file *os.File
+	size int64
+}
+
+// NewAccessLogger opens the access log, if one is configured.
+func NewAccessLogger(cfg *Config) (*AccessLogger, error) {
+	settings := cfg.AccessLog
+	if settings == nil {
+		return nil, nil
+	}
+	if settings.Format != "" && settings.Format != AccessLogText && settings.Format != AccessLogJSON {
+		return nil, fmt.Errorf("unknown format %s of the access log", settings.Format)
+	}
+	if settings.Backups < 0 {
+		return nil, fmt.Errorf("invalid number %d of backups of the access log", settings.Backups)
+	}
+	if settings.File == "" && settings.MaxSize > 0 {
+		return nil, fmt.Errorf("the access log requires a file to be rotated")
+	}
+
+	l := &AccessLogger{settings: settings, out: os.Stdout}
+	if settings.File == "" {
+		return l, nil
+	}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen closes the file of the access log and opens the file at its path again, after a log
+// rotation moved it away. The current file is kept on errors.
+func (l *AccessLogger) Reopen() error {
+	if l == nil || l.settings.File == "" {
+		return nil
+	}
+	file, err := os.OpenFile(l.settings.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.mu.Lock()
+	previous := l.file
+	l.file, l.out, l.size = file, file, fi.Size()
+	l.mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// Close closes the file of the access log.
+func (l *AccessLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// record writes the record of a processed request.
+func (l *AccessLogger) record(tr *requestTrace, w *traceWriter, req *http.Request, address string, bytesIn *int64, started time.Time) {
+	if l == nil {
+		return
+	}
+	tr.mu.Lock()
+	user := tr.user
+	tr.mu.Unlock()
+	status := w.status
+	if status == 0 {
+		// the handler returned without a response
+		status = http.StatusOK
+	}
+
+	r := accessRecord{
+		Time:      started,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Protocol:  req.Proto,
+		User:      user,
+		Status:    status,
+		BytesIn:   atomic.LoadInt64(bytesIn),
+		BytesOut:  atomic.LoadInt64(&w.written),
+		Duration:  float64(time.Since(started).Microseconds()) / 1000,
+		Address:   address,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+	var line []byte
+	if l.settings.Format == AccessLogJSON {
+		line, _ = json.Marshal(r)
+		line = append(line, '\n')
+	} else {
+		line = []byte(r.text())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.settings.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > int64(l.settings.MaxSize) {
+		if err := l.rotateLocked(); err != nil {
+			log.WithField("path", l.settings.File).WithError(err).Error("Error rotating the access log")
+		}
+	}
+	n, err := l.out.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		log.WithError(err).Error("Error writing the access log")
+	}
+}
+
+// text returns the record as line of the combined log format with the received bytes and the
+// duration in milliseconds appended.
+func (r *accessRecord) text() string {
+	user := r.User
+	if user == "" {
+		user = "-"
+	}
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return strconv.Quote(s)
+	}
+	request := strings.Join([]string{r.Method, r.Path, r.Protocol}, " ")
+	return fmt.Sprintf("%s - %s [%s] %s %d %d %s %s %d %.3f\n", r.Address, user, r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(request), r.Status, r.BytesOut, quote(r.Referer), quote(r.UserAgent), r.BytesIn, r.Duration)
+}
+
+// rotateLocked moves the file to File.1, the former rotated files one number up, and opens a
+// new file. l.mu must be held.
+func (l *AccessLogger) rotateLocked() error {
+	backups := l.settings.Backups
+	if backups == 0 {
+		backups = 1
+	}
+	name := l.settings.File
+	os.Remove(name + "." + strconv.Itoa(backups))
+	for i := backups - 1; i >= 1; i-- {
+		os.Rename(name+"."+strconv.Itoa(i), name+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(name, name+".1"); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file, l.out, l.size = file, file, 0
+	return nil
+}
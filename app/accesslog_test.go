@@ -0,0 +1,163 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "access.log")
+	cfg := &Config{
+		Dir:       filepath.Join(tmpDir, "data"),
+		Users:     map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}},
+		AccessLog: &AccessLog{File: file, Format: AccessLogJSON},
+	}
+	a := newQuotaApp(t, cfg)
+	accessLog, err := NewAccessLogger(cfg)
+	if err != nil {
+		t.Fatalf("NewAccessLogger() error = %v", err)
+	}
+	defer accessLog.Close()
+	a.AccessLog = accessLog
+
+	requests := []struct {
+		method, target, body string
+		auth                 bool
+	}{
+		{"GET", "/a.txt", "", false},
+		{"PUT", "/a.txt", "hello", true},
+		{"GET", "/a.txt", "", true},
+	}
+	for _, r := range requests {
+		req := httptest.NewRequest(r.method, r.target, strings.NewReader(r.body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "test")
+		if r.auth {
+			req.SetBasicAuth("alice", "password")
+		}
+		handle(context.Background(), httptest.NewRecorder(), req, a)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []accessRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r accessRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid record %s: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	want := []accessRecord{
+		{Method: "GET", Path: "/a.txt", User: "", Status: http.StatusUnauthorized, BytesOut: int64(len("401 Unauthorized"))},
+		{Method: "PUT", Path: "/a.txt", User: "alice", Status: http.StatusCreated, BytesIn: 5, BytesOut: int64(len("Created"))},
+		{Method: "GET", Path: "/a.txt", User: "alice", Status: http.StatusOK, BytesOut: 5},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("access log has %d records, want %d", len(records), len(want))
+	}
+	for i, r := range records {
+		w := want[i]
+		if r.Method != w.Method || r.Path != w.Path || r.User != w.User || r.Status != w.Status || r.BytesIn != w.BytesIn ||
+			r.BytesOut != w.BytesOut || r.Address != "192.0.2.1" || r.UserAgent != "test" || r.Protocol != "HTTP/1.1" || r.Time.IsZero() {
+			t.Errorf("record %d = %+v, want %+v", i, r, w)
+		}
+	}
+}
+
+func TestAccessLogText(t *testing.T) {
+	r := accessRecord{
+		Time:      time.Date(2024, 3, 1, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		Method:    "PUT",
+		Path:      "/docs/a b.txt",
+		Protocol:  "HTTP/1.1",
+		User:      "alice",
+		Status:    201,
+		BytesIn:   2048,
+		BytesOut:  7,
+		Duration:  12.5,
+		Address:   "192.0.2.1",
+		UserAgent: `client "1.0"`,
+	}
+	want := `192.0.2.1 - alice [01/Mar/2024:13:55:36 -0700] "PUT /docs/a b.txt HTTP/1.1" 201 7 "-" "client \"1.0\"" 2048 12.500` + "\n"
+	if got := r.text(); got != want {
+		t.Errorf("text() = %s, want %s", got, want)
+	}
+	r.User = ""
+	if got := r.text(); !strings.HasPrefix(got, "192.0.2.1 - - [") {
+		t.Errorf("text() of anonymous request = %s, want - as user", got)
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "access.log")
+	ioutil.WriteFile(file, []byte(strings.Repeat("x", 150)+"\n"), 0600)
+	l, err := NewAccessLogger(&Config{AccessLog: &AccessLog{File: file, MaxSize: 200, Backups: 2}})
+	if err != nil {
+		t.Fatalf("NewAccessLogger() error = %v", err)
+	}
+	defer l.Close()
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/"+strconv.Itoa(i), nil)
+		l.record(&requestTrace{}, &traceWriter{status: http.StatusOK}, req, "192.0.2.1", new(int64), time.Now())
+	}
+
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		if fi, err := os.Stat(name); err != nil || fi.Size() > 200 {
+			t.Errorf("Stat(%s) = %v, want a file of at most 200 bytes", name, err)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Stat(%s.3) error = %v, want only 2 backups", file, err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(data), `"GET /3 HTTP/1.1"`) {
+		t.Errorf("access log = %s, want the last record", data)
+	}
+}
+
+func TestNewAccessLogger(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     *AccessLog
+		wantErr bool
+	}{
+		{"disabled", nil, false},
+		{"stdout", &AccessLog{Format: AccessLogText}, false},
+		{"unknown format", &AccessLog{Format: "xml"}, true},
+		{"rotation of stdout", &AccessLog{MaxSize: 1024}, true},
+		{"negative backups", &AccessLog{Backups: -1}, true},
+		{"missing directory", &AccessLog{File: "/nonexistent/dave/access.log"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewAccessLogger(&Config{AccessLog: tt.log})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAccessLogger() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			l.Close()
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+	"sync"
+)
+
+// defaultACMEHTTPPort is the port of the listener answering the HTTP-01 challenges, which the
+// CAs connect to.
+const defaultACMEHTTPPort = "80"
+
+// ACME obtains the certificates of Hosts from an ACME CA, Let's Encrypt unless DirectoryURL
+// is set, and renews them before they expire, instead of reading certificate files. The
+// account key and the certificates are kept in CacheDir, so they survive restarts. The CA
+// validates the hosts by the HTTP-01 challenge on HTTPAddress and HTTPPort, port 80 of all
+// addresses by default, or by the TLS-ALPN-01 challenge of a TLS listener on port 443.
+// Configuring it accepts the terms of service of the CA.
+type ACME struct {
+	Hosts        []string
+	Email        string
+	CacheDir     string
+	DirectoryURL string
+	HTTPAddress  string
+	HTTPPort     string
+
+	once    sync.Once
+	manager *autocert.Manager
+}
+
+// check verifies the settings of ACME in the TLS section, which mustn't reference
+// certificate files as well.
+func (a *ACME) check(t *TLS) error {
+	if len(a.Hosts) == 0 {
+		return errors.New("ACME requires the hosts to obtain certificates for")
+	}
+	if a.CacheDir == "" {
+		return errors.New("ACME requires a cacheDir to keep the certificates in")
+	}
+	if t.CertFile != "" || t.KeyFile != "" || len(t.Certificates) > 0 {
+		return errors.New("TLS with ACME must not reference certificate files")
+	}
+	return nil
+}
+
+// getManager returns the manager of the certificates, which is shared by all listeners of
+// the section.
+func (a *ACME) getManager() *autocert.Manager {
+	a.once.Do(func() {
+		a.manager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(a.CacheDir),
+			HostPolicy: autocert.HostWhitelist(a.Hosts...),
+			Email:      a.Email,
+		}
+		if a.DirectoryURL != "" {
+			a.manager.Client = &acme.Client{DirectoryURL: a.DirectoryURL}
+		}
+	})
+	return a.manager
+}
+
+// ChallengeListener returns the listener answering the HTTP-01 challenges.
+func (a *ACME) ChallengeListener() *Listener {
+	port := a.HTTPPort
+	if port == "" {
+		port = defaultACMEHTTPPort
+	}
+	return &Listener{Address: a.HTTPAddress, Port: port}
+}
+
+// ChallengeHandler returns the handler answering the HTTP-01 challenges. Other requests are
+// redirected to HTTPS. It has to be created before the first TLS connection, otherwise only
+// the TLS-ALPN-01 challenge is used.
+func (a *ACME) ChallengeHandler() http.Handler {
+	return a.getManager().HTTPHandler(nil)
+}
+
+// ACMEs returns the ACME sections of the listeners, each once.
+func (cfg *Config) ACMEs() []*ACME {
+	var sections []*ACME
+	seen := map[*ACME]bool{}
+	for _, l := range cfg.EffectiveListeners() {
+		if l.TLS != nil && l.TLS.ACME != nil && !seen[l.TLS.ACME] {
+			seen[l.TLS.ACME] = true
+			sections = append(sections, l.TLS.ACME)
+		}
+	}
+	return sections
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckACME(t *testing.T) {
+	tests := []struct {
+		name    string
+		tls     *TLS
+		wantErr bool
+	}{
+		{"valid", &TLS{ACME: &ACME{Hosts: []string{"dav.example.com"}, CacheDir: "acme"}}, false},
+		{"without hosts", &TLS{ACME: &ACME{CacheDir: "acme"}}, true},
+		{"without cache", &TLS{ACME: &ACME{Hosts: []string{"dav.example.com"}}}, true},
+		{"with files", &TLS{CertFile: "cert.pem", KeyFile: "key.pem", ACME: &ACME{Hosts: []string{"dav.example.com"}, CacheDir: "acme"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{TLS: tt.tls}
+			if err := cfg.checkTLSFiles(); (err != nil) != tt.wantErr {
+				t.Errorf("checkTLSFiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestACME(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer os.RemoveAll(tmpDir)
+
+	acme := &ACME{Hosts: []string{"dav.example.com"}, CacheDir: tmpDir}
+	tls := &TLS{ACME: acme}
+	cfg := &Config{Listeners: []*Listener{{Port: "443", TLS: tls}, {Port: "8443", TLS: tls}, {Port: "8080"}}}
+	if sections := cfg.ACMEs(); len(sections) != 1 || sections[0] != acme {
+		t.Errorf("ACMEs() = %v, want the shared section once", sections)
+	}
+	if l := acme.ChallengeListener(); l.Addr() != ":80" {
+		t.Errorf("ChallengeListener() = %s, want port 80 of all addresses", l.Addr())
+	}
+
+	w := httptest.NewRecorder()
+	acme.ChallengeHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://dav.example.com/docs?a=1", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://dav.example.com/docs?a=1" {
+		t.Errorf("GET = %d %s, want a redirect to HTTPS", w.Code, w.Header().Get("Location"))
+	}
+
+	tlsConfig, err := tls.config()
+	if err != nil {
+		t.Fatalf("config() error = %v", err)
+	}
+	alpn := false
+	for _, proto := range tlsConfig.NextProtos {
+		alpn = alpn || proto == "acme-tls/1"
+	}
+	if tlsConfig.GetCertificate == nil || !alpn {
+		t.Errorf("config() = %+v, want the certificates and the TLS-ALPN-01 challenge of the ACME manager", tlsConfig)
+	}
+}
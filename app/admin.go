@@ -0,0 +1,719 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// adminAPIPrefix is the path prefix of the current version of the admin API.
+const adminAPIPrefix = "/api/v1/"
+
+// Admin configures the administration API, which is served on its own listener with its
+// own set of credentials.
+type Admin struct {
+	Address string
+	Port    string
+	TLS     *TLS
+	Users   map[string]*UserInfo
+}
+
+// userResource is the representation of a user within the admin API. The password is only
+// accepted as input, either in plain text or as hash, and never returned.
+type userResource struct {
+	Name         string  `json:"name"`
+	Password     string  `json:"password,omitempty"`
+	PasswordHash string  `json:"passwordHash,omitempty"`
+	Subdir       *string `json:"subdir,omitempty"`
+	Permissions
+	Groups []string          `json:"groups,omitempty"`
+	Rules  []*PermissionRule `json:"rules,omitempty"`
+}
+
+// NewAdminHandler creates the http handler of the admin API.
+func NewAdminHandler(a *App) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminAPIPrefix+"users", a.handleAdminUsers)
+	mux.HandleFunc(adminAPIPrefix+"users/", a.handleAdminUser)
+	mux.HandleFunc(adminAPIPrefix+"sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.Tracker.Sessions())
+	})
+	mux.HandleFunc(adminAPIPrefix+"transfers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.Tracker.Transfers())
+	})
+	mux.HandleFunc(adminAPIPrefix+"locks", func(w http.ResponseWriter, r *http.Request) {
+		var locks []LockInfo
+		if a.Locks != nil {
+			locks = a.Locks.Locks()
+		}
+		writeJSON(w, http.StatusOK, locks)
+	})
+	mux.HandleFunc(adminAPIPrefix+"quotas", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.Quotas.Usage())
+	})
+	mux.HandleFunc(adminAPIPrefix+"usage", a.handleAdminUsage)
+	mux.HandleFunc(adminAPIPrefix+"bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.Bandwidth.Usage())
+	})
+	mux.HandleFunc(adminAPIPrefix+"retention/", a.handleAdminRetention)
+	mux.HandleFunc(adminAPIPrefix+"deletions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, a.Config.DeletionApproval.requests(time.Now()))
+	})
+	mux.HandleFunc(adminAPIPrefix+"deletions/", a.handleAdminDeletion)
+	mux.HandleFunc(adminAPIPrefix+"readonly", a.handleAdminReadOnly)
+	mux.HandleFunc(adminAPIPrefix+"maintenance", a.handleAdminMaintenance)
+	mux.HandleFunc(adminAPIPrefix+"settings", a.handleAdminSettings)
+	mux.HandleFunc(adminAPIPrefix+"upgrade", a.handleAdminUpgrade)
+	mux.HandleFunc(adminAPIPrefix+"integrity", a.handleAdminIntegrity)
+	mux.HandleFunc(adminAPIPrefix+"replication", a.handleAdminReplication)
+	mux.HandleFunc(adminAPIPrefix+"snapshots", a.handleAdminSnapshots)
+	mux.HandleFunc(adminAPIPrefix+"snapshots/", a.handleAdminSnapshot)
+	mux.HandleFunc(adminAPIPrefix+"trash", a.handleAdminTrash)
+	mux.HandleFunc(adminAPIPrefix+"trash/", a.handleAdminTrashItem)
+	a.registerDebugHandlers(mux)
+	mux.Handle("/metrics", a.Metrics)
+	mux.HandleFunc("/status", a.handleAdminStatus)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !a.Config.Admin.authenticate(username, password) {
+			if ok {
+				log.WithField("user", username).WithField("address", a.Config.clientIP(r)).Warn("Admin failed to login")
+			}
+			writeUnauthorized(w, a.Config.Realm+" admin")
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (adm *Admin) authenticate(username, password string) bool {
+	if adm == nil || username == "" || password == "" {
+		return false
+	}
+
+	user := adm.Users[username]
+	if user == nil {
+		return false
+	}
+
+	return ComparePassword(user.Password, []byte(password)) == nil
+}
+
+func (a *App) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users := []userResource{}
+		for _, name := range a.Config.UserNames() {
+			if user := a.Config.User(name); user != nil {
+				users = append(users, userResource{Name: name, Subdir: user.Subdir, Permissions: user.Permissions, Groups: user.Groups, Rules: user.Rules})
+			}
+		}
+		writeJSON(w, http.StatusOK, users)
+	case http.MethodPost:
+		var res userResource
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		res.Name = strings.ToLower(res.Name)
+		if res.Name == "" {
+			writeJSONError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		if a.Config.User(res.Name) != nil {
+			writeJSONError(w, http.StatusConflict, "user already exists")
+			return
+		}
+		a.saveUser(w, &res, http.StatusCreated)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *App) handleAdminUser(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"users/"))
+	if name == "" || strings.Contains(name, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	user := a.Config.User(name)
+	switch r.Method {
+	case http.MethodGet:
+		if user == nil {
+			writeJSONError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, userResource{Name: name, Subdir: user.Subdir, Permissions: user.Permissions, Groups: user.Groups, Rules: user.Rules})
+	case http.MethodPut:
+		var res userResource
+		var fields map[string]json.RawMessage
+		body, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &fields)
+		}
+		if err == nil {
+			err = json.Unmarshal(body, &res)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		res.Name = name
+		status := http.StatusOK
+		if user == nil {
+			status = http.StatusCreated
+		} else {
+			keepOmitted(&res, user, fields)
+		}
+		a.saveUser(w, &res, status)
+	case http.MethodDelete:
+		if !a.Config.RemoveUser(name) {
+			writeJSONError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		log.WithField("user", name).Info("Removed User via admin API")
+		if err := a.persistUsers(); err != nil {
+			log.WithError(err).Error("Error persisting users")
+			writeJSONError(w, http.StatusInternalServerError, "user removed, but not persisted")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminUsage exports the usage of the users within the date range of the from and to
+// parameters as JSON or, with format=csv, as CSV.
+func (a *App) handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	from, to, err := ParseUsageRange(query.Get("from"), query.Get("to"), time.Now())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	report := UsageReport(a.Usage.Records(), from, to)
+
+	switch query.Get("format") {
+	case "", "json":
+		writeJSON(w, http.StatusOK, report)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=usage-"+from+"-"+to+".csv")
+		if err := WriteUsageCSV(w, report); err != nil {
+			log.WithError(err).Error("Error writing csv response")
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, "format must be json or csv")
+	}
+}
+
+// handleAdminReadOnly reports the emergency read-only mode and switches it with a PUT.
+func (a *App) handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var res struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil || res.Enabled == nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		username, _, _ := r.BasicAuth()
+		log.WithField("admin", username).WithField("enabled", *res.Enabled).Info("Set read-only mode via admin API")
+		a.Config.SetReadOnly(*res.Enabled)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": a.Config.ReadOnly()})
+}
+
+// handleAdminUpgrade starts the binary anew with a POST, which takes over the listeners. The
+// server completes its requests in progress and exits afterwards.
+func (a *App) handleAdminUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	username, _, _ := r.BasicAuth()
+	log.WithField("admin", username).Info("Upgrading via admin API")
+	pid, err := a.Upgrader.Upgrade()
+	switch {
+	case err == errUpgradeInProgress:
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.WithError(err).Error("Error upgrading")
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"pid": pid})
+}
+
+// handleAdminIntegrity reports the integrity verification with its mismatches. A POST starts
+// a verification in the background, a DELETE of a path accepts its current content.
+func (a *App) handleAdminIntegrity(w http.ResponseWriter, r *http.Request) {
+	if a.Integrity == nil || a.Integrity.settings == nil {
+		writeJSONError(w, http.StatusNotFound, "integrity verification is not configured")
+		return
+	}
+
+	username, _, _ := r.BasicAuth()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		a.Integrity.mu.Lock()
+		running := a.Integrity.running != nil
+		a.Integrity.mu.Unlock()
+		if running {
+			writeJSONError(w, http.StatusConflict, errIntegrityRunning.Error())
+			return
+		}
+		log.WithField("admin", username).Info("Verifying integrity via admin API")
+		go a.Integrity.run(time.Now())
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+		return
+	case http.MethodDelete:
+		name := r.URL.Query().Get("path")
+		if name == "" {
+			writeJSONError(w, http.StatusBadRequest, "path is required")
+			return
+		}
+		if err := a.Integrity.accept(path.Clean("/" + name)); err == errIntegrityNoMismatch {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			log.WithError(err).Error("Error saving the checksums")
+			writeJSONError(w, http.StatusInternalServerError, "checksum accepted, but not persisted")
+			return
+		}
+		log.WithFields(log.Fields{"path": name, "admin": username}).Warn("Accepted content of file via admin API")
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Integrity.status())
+}
+
+// handleAdminReplication reports the replication to the secondary backend. A POST starts a
+// reconciliation in the background.
+func (a *App) handleAdminReplication(w http.ResponseWriter, r *http.Request) {
+	if a.Replica == nil {
+		writeJSONError(w, http.StatusNotFound, "replication is not configured")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.Replica.status())
+	case http.MethodPost:
+		if a.Replica.status().Running != nil {
+			writeJSONError(w, http.StatusConflict, errReplicationRunning.Error())
+			return
+		}
+		username, _, _ := r.BasicAuth()
+		log.WithField("admin", username).Info("Reconciling the replication via admin API")
+		go a.Replica.reconcile(time.Now())
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminSnapshots lists the snapshots of the content store and creates one with a POST.
+func (a *App) handleAdminSnapshots(w http.ResponseWriter, r *http.Request) {
+	if a.Content == nil {
+		writeJSONError(w, http.StatusNotFound, "content store is not configured")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.Content.Snapshots())
+	case http.MethodPost:
+		var res struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if res.Name == "" {
+			res.Name = time.Now().UTC().Format("20060102-150405")
+		}
+		info, err := a.Content.CreateSnapshot(res.Name)
+		switch {
+		case err == errSnapshotName:
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		case err == errSnapshotExists:
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			log.WithError(err).Error("Error creating snapshot")
+			writeJSONError(w, http.StatusInternalServerError, "error creating snapshot")
+			return
+		}
+		username, _, _ := r.BasicAuth()
+		log.WithFields(log.Fields{"snapshot": info.Name, "admin": username}).Info("Created snapshot via admin API")
+		writeJSON(w, http.StatusCreated, info)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminSnapshot removes a snapshot of the content store.
+func (a *App) handleAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if a.Content == nil {
+		writeJSONError(w, http.StatusNotFound, "content store is not configured")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"snapshots/")
+	if err := a.Content.RemoveSnapshot(name); err == errNoSuchSnapshot {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		log.WithError(err).Error("Error removing snapshot")
+		writeJSONError(w, http.StatusInternalServerError, "error removing snapshot")
+		return
+	}
+	username, _, _ := r.BasicAuth()
+	log.WithFields(log.Fields{"snapshot": name, "admin": username}).Info("Removed snapshot via admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminTrash lists the items of the trash with a GET and purges them with a DELETE,
+// both optionally only the ones of the user parameter.
+func (a *App) handleAdminTrash(w http.ResponseWriter, r *http.Request) {
+	if a.Trash == nil {
+		writeJSONError(w, http.StatusNotFound, "trash is not configured")
+		return
+	}
+
+	var user *string
+	if values, ok := r.URL.Query()["user"]; ok {
+		user = &values[0]
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.Trash.list(user))
+	case http.MethodDelete:
+		purged, err := a.Trash.purgeAll(user)
+		if err != nil {
+			log.WithError(err).Error("Error purging trash")
+			writeJSONError(w, http.StatusInternalServerError, "error purging trash")
+			return
+		}
+		username, _, _ := r.BasicAuth()
+		fields := log.Fields{"purged": purged, "admin": username}
+		if user != nil {
+			fields["user"] = *user
+		}
+		log.WithFields(fields).Warn("Purged trash via admin API")
+		writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminTrashItem restores an item of the trash with a POST, to its original path or the
+// path of the body relative to the base directory, and purges it with a DELETE.
+func (a *App) handleAdminTrashItem(w http.ResponseWriter, r *http.Request) {
+	if a.Trash == nil {
+		writeJSONError(w, http.StatusNotFound, "trash is not configured")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"trash/")
+	username, _, _ := r.BasicAuth()
+	switch r.Method {
+	case http.MethodPost:
+		var res struct {
+			Path string `json:"path"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+		}
+		if a.Config.ReadOnly() {
+			writeJSONError(w, http.StatusServiceUnavailable, "read-only mode is enabled")
+			return
+		}
+		item, err := a.Trash.restore(r.Context(), id, res.Path)
+		switch {
+		case err == errNoSuchTrashItem:
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		case err == errRestoreExists:
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		case err == os.ErrInvalid:
+			writeJSONError(w, http.StatusBadRequest, "invalid path")
+			return
+		case errors.Is(err, errQuotaExceeded):
+			writeJSONError(w, http.StatusInsufficientStorage, err.Error())
+			return
+		case err != nil:
+			log.WithField("id", id).WithError(err).Error("Error restoring item of the trash")
+			writeJSONError(w, http.StatusInternalServerError, "error restoring item of the trash")
+			return
+		}
+		log.WithFields(log.Fields{"id": id, "path": item.Origin, "admin": username}).Info("Restored item of the trash via admin API")
+		writeJSON(w, http.StatusOK, item)
+	case http.MethodDelete:
+		if err := a.Trash.purge(id); err == errNoSuchTrashItem {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			log.WithField("id", id).WithError(err).Error("Error purging item of the trash")
+			writeJSONError(w, http.StatusInternalServerError, "error purging item of the trash")
+			return
+		}
+		log.WithFields(log.Fields{"id": id, "admin": username}).Info("Purged item of the trash via admin API")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminMaintenance reports the maintenance mode with the number of transfers still in
+// progress and switches it with a PUT.
+func (a *App) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var res struct {
+			Enabled    *bool  `json:"enabled"`
+			RetryAfter string `json:"retryAfter"`
+			Message    string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil || res.Enabled == nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		var retryAfter time.Duration
+		if res.RetryAfter != "" {
+			var err error
+			if retryAfter, err = time.ParseDuration(res.RetryAfter); err != nil || retryAfter <= 0 {
+				writeJSONError(w, http.StatusBadRequest, "retryAfter must be a positive duration")
+				return
+			}
+		}
+		username, _, _ := r.BasicAuth()
+		log.WithField("admin", username).WithField("enabled", *res.Enabled).Info("Set maintenance mode via admin API")
+		a.Config.SetMaintenance(*res.Enabled, retryAfter, res.Message)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	status := map[string]interface{}{"enabled": false, "transfers": len(a.Tracker.Transfers())}
+	if m := a.Config.maintenanceMode(); m != nil {
+		status["enabled"] = true
+		status["retryAfter"] = m.RetryAfter.String()
+		status["message"] = m.Message
+		status["since"] = m.Since
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleAdminRetention deletes a file or directory, given relative to the base directory,
+// regardless of the retention of its files.
+func (a *App) handleAdminRetention(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"retention"))
+	if name == "/" {
+		writeJSONError(w, http.StatusBadRequest, "path is required")
+		return
+	}
+
+	ctx := withRetentionOverride(r.Context())
+	fs := Dir{Config: a.Config, Quotas: a.Quotas, Sync: a.Sync, Props: a.Props, Trash: a.Trash, Replica: a.Replica, Versions: a.Versions}
+	if _, err := fs.Stat(ctx, name); err != nil {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if err := fs.RemoveAll(ctx, name); errors.Is(err, errAppendOnly) {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		log.WithField("path", name).WithError(err).Error("Error deleting retained files")
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	username, _, _ := r.BasicAuth()
+	log.WithField("path", name).WithField("admin", username).Warn("Deleted files regardless of their retention via admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminDeletion approves a pending deletion with a POST, which deletes the path, or
+// dismisses it with a DELETE, which keeps the path.
+func (a *App) handleAdminDeletion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, adminAPIPrefix+"deletions/")
+	req := a.Config.DeletionApproval.take(id, time.Now())
+	if req == nil {
+		writeJSONError(w, http.StatusNotFound, "deletion request not found")
+		return
+	}
+	username, _, _ := r.BasicAuth()
+	if r.Method == http.MethodDelete {
+		log.WithFields(log.Fields{"id": id, "path": req.Path, "admin": username}).Info("Dismissed deletion request via admin API")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ctx := withDeletionApproved(r.Context())
+	fs := Dir{Config: a.Config, Quotas: a.Quotas, Sync: a.Sync, Props: a.Props, Trash: a.Trash, Replica: a.Replica, Versions: a.Versions}
+	if _, err := fs.Stat(ctx, req.Path); err != nil {
+		writeJSONError(w, http.StatusNotFound, "path not found")
+		return
+	}
+	if err := fs.RemoveAll(ctx, req.Path); errors.Is(err, errAppendOnly) || errors.Is(err, errRetained) {
+		writeJSONError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		log.WithField("path", req.Path).WithError(err).Error("Error deleting approved path")
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.WithFields(log.Fields{"id": id, "path": req.Path, "user": req.User, "admin": username}).Warn("Approved deletion via admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keepOmitted takes the settings of the existing user, which aren't among the fields of
+// the request, so an update only changes what it sends. A field set to null is cleared.
+func keepOmitted(res *userResource, user *UserInfo, fields map[string]json.RawMessage) {
+	omitted := func(key string) bool {
+		_, ok := fields[key]
+		return !ok
+	}
+	if omitted("password") && omitted("passwordHash") {
+		res.PasswordHash = user.Password
+	}
+	if omitted("subdir") {
+		res.Subdir = user.Subdir
+	}
+	if omitted("template") {
+		res.Template = user.Template
+	}
+	if omitted("read") {
+		res.Read = user.Read
+	}
+	if omitted("write") {
+		res.Write = user.Write
+	}
+	if omitted("delete") {
+		res.Delete = user.Delete
+	}
+	if omitted("list") {
+		res.List = user.List
+	}
+	if omitted("groups") {
+		res.Groups = user.Groups
+	}
+	if omitted("rules") {
+		res.Rules = user.Rules
+	}
+}
+
+// saveUser validates the given user resource, stores it in the configuration and persists it.
+// The settings of an existing user, which aren't part of the resource, like the quotas, the
+// limits and the networks, are kept.
+func (a *App) saveUser(w http.ResponseWriter, res *userResource, status int) {
+	user := &UserInfo{}
+	if existing := a.Config.User(res.Name); existing != nil {
+		copied := *existing
+		user = &copied
+	}
+	user.Password, user.Subdir, user.Permissions, user.Groups, user.Rules = res.PasswordHash, res.Subdir, res.Permissions, res.Groups, res.Rules
+	if res.Password != "" {
+		user.Password = GenHash([]byte(res.Password))
+	}
+	if user.Password == "" {
+		writeJSONError(w, http.StatusBadRequest, "password or passwordHash is required")
+		return
+	}
+	if !ValidHash(user.Password) {
+		writeJSONError(w, http.StatusBadRequest, "passwordHash is not a valid bcrypt or argon2id hash")
+		return
+	}
+	if user.Subdir != nil && strings.Contains(*user.Subdir, "..") {
+		writeJSONError(w, http.StatusBadRequest, "subdir must not contain '..'")
+		return
+	}
+	if err := a.Config.checkUserPermissions(res.Name, user); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	a.Config.SetUser(res.Name, user)
+	a.Config.ensureUserDirs()
+	log.WithField("user", res.Name).Info("Saved User via admin API")
+
+	if err := a.persistUsers(); err != nil {
+		log.WithError(err).Error("Error persisting users")
+		writeJSONError(w, http.StatusInternalServerError, "user saved, but not persisted")
+		return
+	}
+
+	writeJSON(w, status, userResource{Name: res.Name, Subdir: user.Subdir, Permissions: user.Permissions, Groups: user.Groups, Rules: user.Rules})
+}
+
+// persistUsers shares the current users with the other nodes and writes them back to the
+// configuration file, if there is one.
+func (a *App) persistUsers() error {
+	if err := a.Coordinator.syncUsers(); err != nil {
+		return err
+	}
+
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return nil
+	}
+
+	return SaveUsers(path, a.Config.UsersCopy())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Error writing json response")
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,186 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAdminHandler(t *testing.T) {
+	viper.Reset()
+
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	a := &App{
+		Config: &Config{
+			Dir: tmpDir,
+			Users: map[string]*UserInfo{
+				"foo": {Password: GenHash([]byte("password"))},
+			},
+			Admin: &Admin{Users: map[string]*UserInfo{
+				"root": {Password: GenHash([]byte("secret"))},
+			}},
+		},
+		Tracker: NewTracker(),
+	}
+	handler := NewAdminHandler(a)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		username   string
+		password   string
+		statusCode int
+	}{
+		{"no credentials", "GET", "/api/v1/users", "", "", "", 401},
+		{"webdav user", "GET", "/api/v1/users", "", "foo", "password", 401},
+		{"list users", "GET", "/api/v1/users", "", "root", "secret", 200},
+		{"get user", "GET", "/api/v1/users/foo", "", "root", "secret", 200},
+		{"get missing user", "GET", "/api/v1/users/bar", "", "root", "secret", 404},
+		{"create user", "POST", "/api/v1/users", `{"name":"Bar","password":"pw","subdir":"/bar"}`, "root", "secret", 201},
+		{"create existing user", "POST", "/api/v1/users", `{"name":"bar","password":"pw"}`, "root", "secret", 409},
+		{"create without password", "POST", "/api/v1/users", `{"name":"baz"}`, "root", "secret", 400},
+		{"create with invalid hash", "POST", "/api/v1/users", `{"name":"baz","passwordHash":"x"}`, "root", "secret", 400},
+		{"create with escaping subdir", "POST", "/api/v1/users", `{"name":"baz","password":"pw","subdir":"../etc"}`, "root", "secret", 400},
+		{"update user", "PUT", "/api/v1/users/bar", `{"subdir":"/other"}`, "root", "secret", 200},
+		{"delete user", "DELETE", "/api/v1/users/bar", "", "root", "secret", 204},
+		{"delete missing user", "DELETE", "/api/v1/users/bar", "", "root", "secret", 404},
+		{"sessions", "GET", "/api/v1/sessions", "", "root", "secret", 200},
+		{"transfers", "GET", "/api/v1/transfers", "", "root", "secret", 200},
+		{"locks", "GET", "/api/v1/locks", "", "root", "secret", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.username != "" {
+				r.SetBasicAuth(tt.username, tt.password)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.statusCode {
+				t.Errorf("AdminHandler %s %s = %v, want %v. body = %s", tt.method, tt.path, w.Code, tt.statusCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestAdminHandlerUpdateKeepsPassword(t *testing.T) {
+	viper.Reset()
+
+	hash := GenHash([]byte("password"))
+	a := &App{Config: &Config{
+		Dir:   os.TempDir(),
+		Users: map[string]*UserInfo{"foo": {Password: hash}},
+		Admin: &Admin{Users: map[string]*UserInfo{"root": {Password: GenHash([]byte("secret"))}}},
+	}}
+
+	r := httptest.NewRequest("PUT", "/api/v1/users/foo", strings.NewReader(`{}`))
+	r.SetBasicAuth("root", "secret")
+	w := httptest.NewRecorder()
+	NewAdminHandler(a).ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("AdminHandler PUT = %v, want %v", w.Code, http.StatusOK)
+	}
+	var res userResource
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil || res.Name != "foo" || res.PasswordHash != "" {
+		t.Errorf("AdminHandler PUT response = %+v, error = %v", res, err)
+	}
+	if got := a.Config.User("foo").Password; got != hash {
+		t.Errorf("AdminHandler PUT password = %v, want %v", got, hash)
+	}
+}
+
+func TestAdminHandlerUpdateKeepsSettings(t *testing.T) {
+	viper.Reset()
+
+	user := &UserInfo{
+		Password:        GenHash([]byte("password")),
+		Quota:           1000,
+		SoftQuota:       800,
+		FileLimit:       10,
+		BandwidthCap:    100,
+		SSHKeys:         []string{"ssh-ed25519 AAAA foo"},
+		S3AccessKey:     "access",
+		S3SecretKey:     "secret",
+		WriteLimit:      &WriteLimit{Requests: 5},
+		UploadLimit:     &UploadLimit{MaxSize: 100},
+		AllowedNetworks: []string{"10.0.1.0/24"},
+		DeniedNetworks:  []string{"10.0.1.7"},
+		Tailscale:       "foo@example.com",
+		Encrypted:       []string{"/private"},
+		Trace:           true,
+		Groups:          []string{"staff"},
+	}
+	a := &App{Config: &Config{
+		Dir:    os.TempDir(),
+		Users:  map[string]*UserInfo{"foo": user},
+		Groups: map[string]*Permissions{"staff": {Template: TemplateReadOnly}},
+		Admin:  &Admin{Users: map[string]*UserInfo{"root": {Password: GenHash([]byte("secret"))}}},
+	}}
+
+	subdir := "/other"
+	r := httptest.NewRequest("PUT", "/api/v1/users/foo", strings.NewReader(`{"subdir":"/other"}`))
+	r.SetBasicAuth("root", "secret")
+	w := httptest.NewRecorder()
+	NewAdminHandler(a).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("AdminHandler PUT = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	want := *user
+	want.Subdir = &subdir
+	if got := a.Config.User("foo"); !reflect.DeepEqual(*got, want) {
+		t.Errorf("AdminHandler PUT user = %+v, want %+v", *got, want)
+	}
+}
+
+func TestAdminHandlerUpdateClearsNullFields(t *testing.T) {
+	viper.Reset()
+
+	subdir := "/foo"
+	read := true
+	user := &UserInfo{
+		Password:    GenHash([]byte("password")),
+		Subdir:      &subdir,
+		Permissions: Permissions{Read: &read},
+		Groups:      []string{"staff"},
+		Rules:       []*PermissionRule{{Path: "/archive/**"}},
+	}
+	a := &App{Config: &Config{
+		Dir:    os.TempDir(),
+		Users:  map[string]*UserInfo{"foo": user},
+		Groups: map[string]*Permissions{"staff": {Template: TemplateReadOnly}},
+		Admin:  &Admin{Users: map[string]*UserInfo{"root": {Password: GenHash([]byte("secret"))}}},
+	}}
+
+	r := httptest.NewRequest("PUT", "/api/v1/users/foo", strings.NewReader(`{"subdir":null,"groups":null}`))
+	r.SetBasicAuth("root", "secret")
+	w := httptest.NewRecorder()
+	NewAdminHandler(a).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("AdminHandler PUT = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	want := *user
+	want.Subdir = nil
+	want.Groups = nil
+	if got := a.Config.User("foo"); !reflect.DeepEqual(*got, want) {
+		t.Errorf("AdminHandler PUT user = %+v, want %+v", *got, want)
+	}
+}
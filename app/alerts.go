@@ -0,0 +1,274 @@
+package app
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/smtp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the alerts
+const (
+	defaultAlertInterval   = time.Minute
+	defaultAuthAlertWindow = 5 * time.Minute
+)
+
+// Events of the alerts
+const (
+	alertEventQuota        = "alert.quota"
+	alertEventDiskFree     = "alert.diskFree"
+	alertEventAuthFailures = "alert.authFailures"
+	alertEventHoneypot     = "alert.honeypot"
+	alertEventIntegrity    = "alert.integrity"
+)
+
+// Alerts notifies operators via webhook or email before problems reach the users: when a quota
+// is used to Quota percent of its limit, when the free space of the file system of dir drops
+// below DiskFree and when AuthFailures logins fail within AuthWindow. The quotas and the free
+// space are checked every Interval. Each alert fires once until its condition is resolved.
+type Alerts struct {
+	Webhook      string
+	Email        *AlertEmail
+	Quota        int
+	DiskFree     ByteSize
+	AuthFailures int
+	AuthWindow   time.Duration
+	Interval     time.Duration
+}
+
+// AlertEmail configures the mail server alerts are sent by. Without Username, no
+// authentication is used.
+type AlertEmail struct {
+	Host     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+type alertEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message"`
+	Scope    string    `json:"scope,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Used     int64     `json:"used,omitempty"`
+	Limit    int64     `json:"limit,omitempty"`
+	Free     int64     `json:"free,omitempty"`
+	Failures int       `json:"failures,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Path     string    `json:"path,omitempty"`
+}
+
+// Alerter checks the conditions of the alerts and sends their notifications. A nil Alerter is
+// valid and alerts nothing.
+type Alerter struct {
+	settings *Alerts
+	dir      string
+	quotas   *Quotas
+
+	mu       sync.Mutex
+	active   map[string]bool
+	failures []time.Time
+	sent     int64
+}
+
+// NewAlerter creates an alerter for the quotas and the base directory of the configuration.
+// It returns nil, if no alerts are configured.
+func NewAlerter(cfg *Config, quotas *Quotas) (*Alerter, error) {
+	if cfg.Alerts == nil {
+		return nil, nil
+	}
+	if err := cfg.Alerts.validate(); err != nil {
+		return nil, err
+	}
+
+	return &Alerter{settings: cfg.Alerts, dir: cfg.Dir, quotas: quotas, active: map[string]bool{}}, nil
+}
+
+func (al *Alerts) validate() error {
+	if al.Webhook == "" && al.Email == nil {
+		return fmt.Errorf("alerts require a webhook or an email")
+	}
+	if al.Email != nil && (al.Email.Host == "" || al.Email.From == "" || len(al.Email.To) == 0) {
+		return fmt.Errorf("alert emails require a host, a sender and recipients")
+	}
+	if al.Quota < 0 || al.Quota > 100 {
+		return fmt.Errorf("invalid quota alert threshold %d%%, expected 1 to 100", al.Quota)
+	}
+	return nil
+}
+
+func (al *Alerts) interval() time.Duration {
+	if al.Interval <= 0 {
+		return defaultAlertInterval
+	}
+	return al.Interval
+}
+
+func (al *Alerts) authWindow() time.Duration {
+	if al.AuthWindow <= 0 {
+		return defaultAuthAlertWindow
+	}
+	return al.AuthWindow
+}
+
+// Start checks the quotas and the free space periodically.
+func (a *Alerter) Start() {
+	if a == nil || (a.settings.Quota <= 0 && a.settings.DiskFree <= 0) {
+		return
+	}
+
+	go func() {
+		a.check(time.Now())
+		ticker := time.NewTicker(a.settings.interval())
+		defer ticker.Stop()
+		for now := range ticker.C {
+			a.check(now)
+		}
+	}()
+}
+
+// check fires the alerts of the quotas and the free space, whose conditions are met.
+func (a *Alerter) check(now time.Time) {
+	if pct := int64(a.settings.Quota); pct > 0 {
+		for _, u := range a.quotas.Usage() {
+			if u.Limit <= 0 {
+				continue
+			}
+			a.update("quota:"+u.User+":"+u.Scope, u.Used*100 >= u.Limit*pct, func() alertEvent {
+				message := fmt.Sprintf("Quota %s is %d%% used", u.Scope, u.Used*100/u.Limit)
+				if u.User != "" {
+					message = fmt.Sprintf("Quota %s of user %s is %d%% used", u.Scope, u.User, u.Used*100/u.Limit)
+				}
+				return alertEvent{Event: alertEventQuota, Time: now, Message: message, Scope: u.Scope, User: u.User, Used: u.Used, Limit: u.Limit}
+			})
+		}
+	}
+
+	if a.settings.DiskFree > 0 {
+		free, _, err := DiskUsage(a.dir)
+		if err != nil {
+			log.WithField("path", a.dir).WithError(err).Warn("Error determining free disk space")
+			return
+		}
+		a.update("diskFree", int64(free) < int64(a.settings.DiskFree), func() alertEvent {
+			return alertEvent{
+				Event:   alertEventDiskFree,
+				Time:    now,
+				Message: fmt.Sprintf("Only %s of disk space is left below %s", ByteSize(free), a.dir),
+				Free:    int64(free),
+				Limit:   int64(a.settings.DiskFree),
+			}
+		})
+	}
+}
+
+// authFailed counts a failed login and fires the alert, if the failures spike.
+func (a *Alerter) authFailed(now time.Time) {
+	if a == nil || a.settings.AuthFailures <= 0 {
+		return
+	}
+
+	// only the last failures are kept, a spike is when all of them are within the window
+	a.mu.Lock()
+	a.failures = append(a.failures, now)
+	if len(a.failures) > a.settings.AuthFailures {
+		a.failures = a.failures[len(a.failures)-a.settings.AuthFailures:]
+	}
+	spike := len(a.failures) == a.settings.AuthFailures && now.Sub(a.failures[0]) <= a.settings.authWindow()
+	a.mu.Unlock()
+
+	a.update("authFailures", spike, func() alertEvent {
+		return alertEvent{
+			Event:    alertEventAuthFailures,
+			Time:     now,
+			Message:  fmt.Sprintf("%d logins failed within %s", a.settings.AuthFailures, a.settings.authWindow()),
+			Failures: a.settings.AuthFailures,
+		}
+	})
+}
+
+// honeypotTripped fires the alert of a trip of the honeypot, which is deduplicated by the
+// tripwire.
+func (a *Alerter) honeypotTripped(event alertEvent) {
+	if a == nil {
+		return
+	}
+	a.notify(event)
+}
+
+// integrityFailed fires the alert of a file, whose content differs from its checksum. Each
+// mismatch is reported once by the integrity verification.
+func (a *Alerter) integrityFailed(event alertEvent) {
+	if a == nil {
+		return
+	}
+	a.notify(event)
+}
+
+// update fires the alert of key once its condition is met. The alert is rearmed, when the
+// condition isn't met anymore.
+func (a *Alerter) update(key string, met bool, event func() alertEvent) {
+	a.mu.Lock()
+	fire := met && !a.active[key]
+	resolved := !met && a.active[key]
+	a.active[key] = met
+	a.mu.Unlock()
+
+	if resolved {
+		log.WithField("alert", key).Info("Alert resolved")
+	}
+	if fire {
+		a.notify(event())
+	}
+}
+
+// notify logs the alert and sends it to the webhook and the email recipients.
+func (a *Alerter) notify(event alertEvent) {
+	atomic.AddInt64(&a.sent, 1)
+	log.WithField("event", event.Event).Warn(event.Message)
+	if a.settings.Webhook != "" {
+		postWebhook(a.settings.Webhook, event)
+	}
+	if a.settings.Email != nil {
+		go a.sendEmail(event)
+	}
+}
+
+func (a *Alerter) sendEmail(event alertEvent) {
+	e := a.settings.Email
+	var auth smtp.Auth
+	if e.Username != "" {
+		auth = smtp.PlainAuth("", e.Username, e.Password, strings.Split(e.Host, ":")[0])
+	}
+	if err := smtp.SendMail(e.Host, auth, e.From, e.To, alertMail(e, event)); err != nil {
+		log.WithField("host", e.Host).WithError(err).Warn("Error sending alert email")
+	}
+}
+
+// alertMail formats the alert as a plain text mail.
+func alertMail(e *AlertEmail, event alertEvent) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&b, "Subject: [dave] %s\r\n", event.Message)
+	fmt.Fprintf(&b, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n\r\nEvent: %s\r\nTime: %s\r\n", event.Message, event.Event, event.Time.Format(time.RFC3339))
+	return []byte(b.String())
+}
+
+// RegisterMetrics exposes the number of alerts sent.
+func (a *Alerter) RegisterMetrics(m *Metrics) {
+	if a == nil {
+		return
+	}
+
+	m.Counter("dave_alerts_total", "Alerts sent to the operators.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&a.sent))}}
+	})
+}
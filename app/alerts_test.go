@@ -0,0 +1,148 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alertReceiver returns a webhook receiver, which passes the received events to the channel.
+func alertReceiver(t *testing.T) (*httptest.Server, chan alertEvent) {
+	events := make(chan alertEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e alertEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver, events
+}
+
+func expectAlert(t *testing.T, events chan alertEvent, want string) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Event != want {
+			t.Errorf("received event %v, want %v", e.Event, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("no %v event received", want)
+	}
+}
+
+func expectNoAlert(t *testing.T, events chan alertEvent) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Errorf("received unexpected event %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQuotaAndDiskAlerts(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a"), make([]byte, 70), 0600)
+
+	receiver, events := alertReceiver(t)
+	cfg := &Config{Dir: tmpDir, Quota: &Quota{Limit: 100}, Alerts: &Alerts{Webhook: receiver.URL, Quota: 80}}
+	quotas, err := NewQuotas(cfg)
+	if err != nil {
+		t.Fatalf("NewQuotas() error = %v", err)
+	}
+	alerter, err := NewAlerter(cfg, quotas)
+	if err != nil {
+		t.Fatalf("NewAlerter() error = %v", err)
+	}
+
+	alerter.check(time.Now())
+	expectNoAlert(t, events)
+
+	quotas.add(filepath.Join(tmpDir, "b"), 10, 1, 0)
+	alerter.check(time.Now())
+	expectAlert(t, events, alertEventQuota)
+
+	// fires once until resolved
+	alerter.check(time.Now())
+	expectNoAlert(t, events)
+	quotas.add(filepath.Join(tmpDir, "b"), -10, -1, 0)
+	alerter.check(time.Now())
+	quotas.add(filepath.Join(tmpDir, "b"), 10, 1, 0)
+	alerter.check(time.Now())
+	expectAlert(t, events, alertEventQuota)
+
+	// no file system has that much space left
+	cfg.Alerts.DiskFree = 1 << 62
+	alerter.check(time.Now())
+	expectAlert(t, events, alertEventDiskFree)
+}
+
+func TestAuthFailureAlert(t *testing.T) {
+	receiver, events := alertReceiver(t)
+	alerter, err := NewAlerter(&Config{Alerts: &Alerts{Webhook: receiver.URL, AuthFailures: 3, AuthWindow: time.Minute}}, nil)
+	if err != nil {
+		t.Fatalf("NewAlerter() error = %v", err)
+	}
+	start := time.Now()
+
+	// spread over more than the window
+	for i := 0; i < 3; i++ {
+		alerter.authFailed(start.Add(time.Duration(i) * time.Minute))
+	}
+	expectNoAlert(t, events)
+
+	alerter.authFailed(start.Add(2*time.Minute + time.Second))
+	alerter.authFailed(start.Add(2*time.Minute + 2*time.Second))
+	expectAlert(t, events, alertEventAuthFailures)
+	alerter.authFailed(start.Add(2*time.Minute + 3*time.Second))
+	expectNoAlert(t, events)
+
+	var nilAlerter *Alerter
+	nilAlerter.authFailed(start)
+}
+
+func TestAlertsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		alerts  Alerts
+		wantErr bool
+	}{
+		{"webhook", Alerts{Webhook: "http://127.0.0.1/", Quota: 90}, false},
+		{"email", Alerts{Email: &AlertEmail{Host: "mail:25", From: "dave@example.com", To: []string{"ops@example.com"}}}, false},
+		{"without receiver", Alerts{Quota: 90}, true},
+		{"email without recipients", Alerts{Email: &AlertEmail{Host: "mail:25", From: "dave@example.com"}}, true},
+		{"invalid threshold", Alerts{Webhook: "http://127.0.0.1/", Quota: 120}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.alerts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Alerts.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAlertMail(t *testing.T) {
+	e := &AlertEmail{From: "dave@example.com", To: []string{"a@example.com", "b@example.com"}}
+	event := alertEvent{Event: alertEventDiskFree, Time: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), Message: "Only 1GB of disk space is left below /data"}
+	mail := string(alertMail(e, event))
+
+	for _, want := range []string{
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: [dave] Only 1GB of disk space is left below /data\r\n",
+		"\r\n\r\nOnly 1GB of disk space is left below /data\r\n",
+		"Event: alert.diskFree\r\n",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("alertMail() = %q, want it to contain %q", mail, want)
+		}
+	}
+}
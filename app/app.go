@@ -1,10 +1,64 @@
 // Package app provides all app related stuff like config parsing, serving, etc.
 package app
 
-import "golang.org/x/net/webdav"
+import (
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"time"
+)
 
 // App holds configuration information and the webdav handler.
 type App struct {
 	Config  *Config
 	Handler *webdav.Handler
+	Tracker *Tracker
+	Locks   *LockSystem
+	Quotas  *Quotas
+	Metrics *Metrics
+
+	WriteLimiter *WriteLimiter
+	Usage        *UsageRecorder
+	Bandwidth    *BandwidthLimiter
+	Alerts       *Alerter
+	Sync         *SyncLog
+	Shares       *ShareStore
+	Tripwire     *Tripwire
+	Policy       *PolicyScript
+	Images       *ImageCache
+	Coordinator  *Coordinator
+	Upgrader     *Upgrader
+	Resources    *ResourceMonitor
+	Integrity    *IntegrityChecker
+	Content      *ContentFS
+	Search       *SearchIndex
+	Props        *PropertyStore
+	Trash        *TrashBin
+	Replica      *Replicator
+	Versions     *VersionStore
+	AccessLog    *AccessLogger
+	LoginLimiter *LoginLimiter
+}
+
+// LogStats writes the runtime statistics to the log: the open connections, the in-flight
+// transfers and the samples of all metrics, e.g. the cache sizes and quota counters.
+func (a *App) LogStats() {
+	transfers := a.Tracker.Transfers()
+	log.WithFields(log.Fields{
+		"connections": a.Tracker.Connections(),
+		"transfers":   len(transfers),
+		"sessions":    len(a.Tracker.Sessions()),
+	}).Info("Runtime statistics")
+	for _, tr := range transfers {
+		log.WithFields(log.Fields{
+			"id":       tr.ID,
+			"user":     tr.User,
+			"address":  tr.Address,
+			"method":   tr.Method,
+			"path":     tr.Path,
+			"duration": time.Since(tr.Started).Round(time.Second).String(),
+			"bytesIn":  tr.BytesIn,
+			"bytesOut": tr.BytesOut,
+		}).Info("Active transfer")
+	}
+	a.Metrics.Log()
 }
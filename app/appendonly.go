@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+var errAppendOnly = errors.New("files of append-only directories can't be modified or deleted")
+
+// AppendOnly protects the files beneath the directories, which are given relative to the base
+// directory, like audit logs or evidence drops. New files and directories can be added, but
+// existing ones can never be overwritten, moved or deleted. Clients creating an empty file
+// before uploading its content may write it once.
+type AppendOnly struct {
+	Directories []string
+}
+
+// directories returns the physical paths of the append-only directories.
+func (a *AppendOnly) directories(root string) []string {
+	if a == nil {
+		return nil
+	}
+	dirs := make([]string, 0, len(a.Directories))
+	for _, dir := range a.Directories {
+		dirs = append(dirs, filepath.Join(root, filepath.FromSlash(path.Clean("/"+filepath.ToSlash(dir)))))
+	}
+	return dirs
+}
+
+// protects returns whether the physical path is an append-only directory or beneath one.
+func (a *AppendOnly) protects(root, name string) bool {
+	for _, dir := range a.directories(root) {
+		if withinDir(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// affects returns whether removing or replacing the physical path would touch an append-only
+// directory, as it's within one or contains one.
+func (a *AppendOnly) affects(root, name string) bool {
+	for _, dir := range a.directories(root) {
+		if withinDir(name, dir) || withinDir(dir, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAppendOnlyWrite returns the flag to open the physical path with, which can only be
+// written if it doesn't exist yet or is empty. New files are created exclusively, so a
+// concurrent upload isn't overwritten.
+func (d Dir) checkAppendOnlyWrite(ctx context.Context, name string, flag int) (int, error) {
+	if flag&writeFlags == 0 || !d.Config.AppendOnly.protects(d.Config.Dir, name) {
+		return flag, nil
+	}
+	fi, err := d.Config.storage().Stat(name)
+	switch {
+	case err == nil && (fi.IsDir() || fi.Size() > 0):
+		return flag, d.rejectAppendOnly(ctx, name)
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		flag |= os.O_EXCL
+	}
+	return flag, nil
+}
+
+// checkAppendOnlyChange returns errAppendOnly, if removing or replacing the existing physical
+// path would touch an append-only directory.
+func (d Dir) checkAppendOnlyChange(ctx context.Context, name string) error {
+	if !d.Config.AppendOnly.affects(d.Config.Dir, name) {
+		return nil
+	}
+	if _, err := d.Config.storage().Lstat(name); err != nil {
+		return nil
+	}
+	return d.rejectAppendOnly(ctx, name)
+}
+
+func (d Dir) rejectAppendOnly(ctx context.Context, name string) error {
+	log.WithFields(log.Fields{"path": name, "user": d.resolveUser(ctx)}).Warn("Rejected modification of append-only directory")
+	traceStep(ctx, "%s is protected by an append-only directory", name)
+	rejectionFromContext(ctx).reject(http.StatusForbidden)
+	return errAppendOnly
+}
@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendOnly(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "audit", "evidence", "2024"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "audit", "evidence", "a.log"), []byte("a"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "audit", "evidence", "empty.log"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "plain.txt"), []byte("plain"), 0600)
+
+	cfg := &Config{Dir: tmpDir, AppendOnly: &AppendOnly{Directories: []string{"/audit/evidence"}}}
+	a := newQuotaApp(t, cfg)
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header []string
+		want   int
+	}{
+		{"new file", "PUT", "/audit/evidence/b.log", "b", nil, http.StatusCreated},
+		{"new directory", "MKCOL", "/audit/evidence/2025", "", nil, http.StatusCreated},
+		{"file in subdirectory", "PUT", "/audit/evidence/2024/c.log", "c", nil, http.StatusCreated},
+		{"overwrite", "PUT", "/audit/evidence/a.log", "changed", nil, http.StatusForbidden},
+		{"empty file", "PUT", "/audit/evidence/empty.log", "content", nil, http.StatusCreated},
+		{"empty file again", "PUT", "/audit/evidence/empty.log", "changed", nil, http.StatusForbidden},
+		{"delete", "DELETE", "/audit/evidence/a.log", "", nil, http.StatusForbidden},
+		{"delete directory", "DELETE", "/audit/evidence/2024", "", nil, http.StatusForbidden},
+		{"delete parent", "DELETE", "/audit", "", nil, http.StatusForbidden},
+		{"move out", "MOVE", "/audit/evidence/a.log", "", []string{"Destination", "/a.log"}, http.StatusForbidden},
+		{"move onto", "MOVE", "/plain.txt", "", []string{"Destination", "/audit/evidence/a.log", "Overwrite", "T"}, http.StatusForbidden},
+		{"copy onto", "COPY", "/plain.txt", "", []string{"Destination", "/audit/evidence/a.log", "Overwrite", "T"}, http.StatusForbidden},
+		{"copy out", "COPY", "/audit/evidence/a.log", "", []string{"Destination", "/copy.log"}, http.StatusCreated},
+		{"move in", "MOVE", "/plain.txt", "", []string{"Destination", "/audit/evidence/plain.txt"}, http.StatusCreated},
+		{"unprotected", "PUT", "/copy.log", "changed", nil, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(tt.method, tt.target, tt.body, tt.header...); w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+
+	for name, want := range map[string]string{"a.log": "a", "empty.log": "content", "plain.txt": "plain"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "audit", "evidence", name)); string(data) != want {
+			t.Errorf("%s = %q, want %q", name, data, want)
+		}
+	}
+}
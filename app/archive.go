@@ -0,0 +1,186 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+)
+
+// archiveFormats are the content types of the formats collections can be downloaded in.
+var archiveFormats = map[string]string{
+	"zip":    "application/zip",
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+}
+
+// archiveWriter adds the files of a collection to an archive.
+type archiveWriter interface {
+	add(name string, fi os.FileInfo, content io.Reader) error
+	Close() error
+}
+
+// serveArchive answers a GET of a collection with a format parameter by an archive of the
+// files below it. The archive is streamed while the files are read, so it's never buffered as
+// a whole. It returns whether the request has been handled.
+func (a *App) serveArchive(w http.ResponseWriter, r *http.Request) bool {
+	format := r.URL.Query().Get("format")
+	if r.Method != http.MethodGet || format == "" {
+		return false
+	}
+	ctx := r.Context()
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	name := path.Clean("/" + p)
+	fi, err := a.Handler.FileSystem.Stat(ctx, name)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	contentType, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	base := path.Base(name)
+	if name == "/" {
+		base = "files"
+	}
+	traceStep(ctx, "streaming %s as %s archive", name, format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", base+"."+format))
+
+	var aw archiveWriter
+	switch format {
+	case "zip":
+		aw = &zipArchive{zip.NewWriter(w)}
+	case "tar":
+		aw = &tarArchive{tw: tar.NewWriter(w)}
+	case "tar.gz":
+		gw := gzip.NewWriter(w)
+		aw = &tarArchive{tw: tar.NewWriter(gw), gw: gw}
+	}
+	// the status has been sent with the first bytes, so errors can only truncate the archive
+	if err := a.archiveDir(ctx, aw, name, base, fi); err != nil {
+		log.WithField("path", name).WithError(err).Warn("Error streaming archive")
+		return true
+	}
+	if err := aw.Close(); err != nil {
+		log.WithField("path", name).WithError(err).Warn("Error streaming archive")
+	}
+	return true
+}
+
+// archiveDir adds the directory and the files below it to the archive. Entries, which are
+// neither files nor directories, like symlinks, and files the user can't read are skipped.
+func (a *App) archiveDir(ctx context.Context, aw archiveWriter, name, archived string, fi os.FileInfo) error {
+	if err := aw.add(archived+"/", fi, nil); err != nil {
+		return err
+	}
+
+	dir, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	children, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return nil
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+
+	for _, child := range children {
+		childName := path.Join(name, child.Name())
+		childArchived := archived + "/" + child.Name()
+		switch {
+		case child.IsDir():
+			if err := a.archiveDir(ctx, aw, childName, childArchived, child); err != nil {
+				return err
+			}
+		case child.Mode().IsRegular():
+			f, err := a.Handler.FileSystem.OpenFile(ctx, childName, os.O_RDONLY, 0)
+			if err != nil {
+				continue
+			}
+			// the size of a file, which is read through a filter like the encryption, is the
+			// one of its content
+			if fi, err := f.Stat(); err == nil {
+				child = fi
+			}
+			err = aw.add(childArchived, child, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tarArchive writes a tarball, which is compressed, if gw is set. The headers keep the
+// permissions and the owners of the files.
+type tarArchive struct {
+	tw *tar.Writer
+	gw *gzip.Writer
+}
+
+func (t *tarArchive) add(name string, fi os.FileInfo, content io.Reader) error {
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if content == nil {
+		return nil
+	}
+	_, err = io.CopyN(t.tw, content, hdr.Size)
+	return err
+}
+
+func (t *tarArchive) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gw != nil {
+		return t.gw.Close()
+	}
+	return nil
+}
+
+// zipArchive writes a zip file with deflated files.
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (z *zipArchive) add(name string, fi os.FileInfo, content io.Reader) error {
+	hdr, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if content != nil {
+		hdr.Method = zip.Deflate
+	}
+	f, err := z.zw.CreateHeader(hdr)
+	if err != nil || content == nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	return err
+}
+
+func (z *zipArchive) Close() error {
+	return z.zw.Close()
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "project", "bin"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "project", "README"), []byte("readme"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "project", "bin", "run.sh"), []byte("#!/bin/sh"), 0600)
+	os.Chmod(filepath.Join(tmpDir, "project", "bin", "run.sh"), 0750)
+
+	a := newQuotaApp(t, &Config{Dir: tmpDir})
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, httptest.NewRequest("GET", target, nil), a)
+		return w
+	}
+
+	w := get("/project?format=tar.gz")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/gzip" || w.Header().Get("Content-Disposition") != `attachment; filename="project.tar.gz"` {
+		t.Fatalf("tar.gz: status = %v, headers = %v", w.Code, w.Header())
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	tr := tar.NewReader(gr)
+	entries := map[string]*tar.Header{}
+	contents := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading the tarball: %v", err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		entries[hdr.Name], contents[hdr.Name] = hdr, string(b)
+	}
+	if len(entries) != 4 || entries["project/"] == nil || entries["project/bin/"] == nil || contents["project/README"] != "readme" {
+		t.Fatalf("entries of the tarball = %v", contents)
+	}
+	if hdr := entries["project/bin/run.sh"]; hdr == nil || hdr.FileInfo().Mode().Perm() != 0750 || contents[hdr.Name] != "#!/bin/sh" {
+		t.Errorf("executable of the tarball = %+v", hdr)
+	}
+
+	w = get("/project?format=zip")
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	if len(zr.File) != 4 || zr.File[1].Name != "project/README" {
+		t.Errorf("entries of the zip = %v", zr.File)
+	}
+
+	if w := get("/project?format=rar"); w.Code != 400 {
+		t.Errorf("unknown format status = %v, want 400", w.Code)
+	}
+	if w := get("/project/README?format=tar.gz"); w.Code != 200 || w.Body.String() != "readme" {
+		t.Errorf("file with a format status = %v, body = %q", w.Code, w.Body)
+	}
+}
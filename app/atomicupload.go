@@ -0,0 +1,258 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultOrphanAge is the age of staged uploads, which are removed on startup, unless
+// OrphanAge is set.
+const defaultOrphanAge = time.Hour
+
+// stagingPrefix is the prefix of the hidden files uploads are staged in.
+const stagingPrefix = ".dave-upload-"
+
+var errUploadIncomplete = errors.New("upload is incomplete")
+
+// AtomicUploads stages the content of files written as a whole in a hidden file next to
+// them, which replaces the file only once the upload completed. Readers and sync clients
+// never see partial files, and failed or rejected uploads leave the file untouched. Staged
+// files are hidden from listings. On startup, staged files older than OrphanAge, 1h by
+// default, are left over by interrupted uploads and removed.
+type AtomicUploads struct {
+	OrphanAge time.Duration
+}
+
+// orphanAge returns the age of staged files, which are removed on startup.
+func (a *AtomicUploads) orphanAge() time.Duration {
+	if a.OrphanAge > 0 {
+		return a.OrphanAge
+	}
+	return defaultOrphanAge
+}
+
+// stages returns whether files opened with flag are staged. Files appended to or modified in
+// place are written directly.
+func (a *AtomicUploads) stages(flag int) bool {
+	return a != nil && flag&os.O_TRUNC != 0 && flag&os.O_APPEND == 0
+}
+
+// uploadBody is the body of a PUT, which remembers whether reading it failed, so the staged
+// file isn't put into place, if the client aborted the upload.
+type uploadBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+func uploadBodyFromContext(ctx context.Context) *uploadBody {
+	body, _ := ctx.Value(uploadBodyKey).(*uploadBody)
+	return body
+}
+
+// withAtomicUploads replaces the body of a PUT by one remembering read errors, if uploads
+// are staged.
+func (c *Config) withAtomicUploads(ctx context.Context, req *http.Request) context.Context {
+	if c.AtomicUploads == nil || req.Method != http.MethodPut || req.Body == nil {
+		return ctx
+	}
+	body := &uploadBody{ReadCloser: req.Body}
+	req.Body = body
+	return context.WithValue(ctx, uploadBodyKey, body)
+}
+
+// openStagedFile opens a hidden file next to name with open, which replaces name when it's
+// closed. The usage of a replaced file is released up front, so the quotas are checked like
+// for a file written directly. With keepVersion, the replaced content is kept as version.
+// Directories and existing files opened exclusively are opened directly, so they fail as
+// usual.
+func (d Dir) openStagedFile(ctx context.Context, name string, flag int, keepVersion bool, open func(string, int) (webdav.File, error)) (webdav.File, error) {
+	fi, statErr := d.Config.storage().Stat(name)
+	if statErr == nil && (fi.IsDir() || flag&os.O_EXCL != 0) {
+		return open(name, flag)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	temp := filepath.Join(filepath.Dir(name), stagingPrefix+hex.EncodeToString(suffix))
+	revert := func() {}
+	if statErr == nil {
+		revert = d.Quotas.remove(ctx, name)
+	}
+	f, err := open(temp, flag|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		revert()
+		return nil, err
+	}
+	if statErr == nil {
+		// the replacement keeps the permissions of the file
+		if err := d.Config.storage().Chmod(temp, fi.Mode().Perm()); err != nil {
+			f.Close()
+			d.discardStaged(ctx, temp, revert)
+			return nil, err
+		}
+	}
+	traceStep(ctx, "staging upload of %s in %s", name, filepath.Base(temp))
+	return &stagedFile{File: f, ctx: ctx, dir: d, name: name, temp: temp, revert: revert, keepVersion: keepVersion}, nil
+}
+
+// discardStaged removes a staged file and restores the usage of the file it would have
+// replaced.
+func (d Dir) discardStaged(ctx context.Context, temp string, revert func()) {
+	d.Quotas.remove(ctx, temp)
+	if err := d.Config.storage().Remove(temp); err != nil && !os.IsNotExist(err) {
+		log.WithField("path", temp).WithError(err).Error("Error removing staged upload")
+	}
+	revert()
+}
+
+// stagedFile is a staged upload, which replaces the file on Close, if it completed.
+type stagedFile struct {
+	webdav.File
+	ctx         context.Context
+	dir         Dir
+	name        string
+	temp        string
+	revert      func()
+	keepVersion bool
+	failed      bool
+}
+
+func (f *stagedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+	return n, err
+}
+
+// Stat reports the info of the staged content with the name of the file.
+func (f *stagedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return scanFileInfo{FileInfo: fi, name: filepath.Base(f.name)}, nil
+}
+
+// Close puts the staged content into place, unless writing it failed, reading the body of the
+// upload failed or the upload has been rejected.
+func (f *stagedFile) Close() error {
+	err := f.File.Close()
+	if err == nil && f.failed {
+		err = errUploadIncomplete
+	}
+	if body := uploadBodyFromContext(f.ctx); err == nil && body != nil && body.err != nil {
+		err = errUploadIncomplete
+	}
+	if state := rejectionFromContext(f.ctx); err == nil && state != nil && state.status != 0 {
+		err = errUploadIncomplete
+	}
+	restoreVersion := func() {}
+	if err == nil && f.keepVersion {
+		restoreVersion, err = f.dir.Versions.keep(f.ctx, f.name)
+	}
+	if err == nil {
+		if err = f.dir.Config.storage().Rename(f.temp, f.name); err != nil {
+			restoreVersion()
+		}
+	}
+	if err != nil {
+		traceStep(f.ctx, "discarded staged upload of %s: %s", f.name, err)
+		log.WithField("path", f.name).WithError(err).Warn("Discarded incomplete upload")
+		f.dir.discardStaged(f.ctx, f.temp, f.revert)
+		return err
+	}
+	quotaFromContext(f.ctx).touch(f.name)
+	return nil
+}
+
+// openStagingDir hides the staged uploads from the listing of a directory.
+func (d Dir) openStagingDir(f webdav.File, flag int) webdav.File {
+	if d.Config.AtomicUploads == nil || flag&writeFlags != 0 {
+		return f
+	}
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		return f
+	}
+	return &stagingDir{File: f}
+}
+
+// stagingDir is a directory, whose staged uploads are hidden.
+type stagingDir struct {
+	webdav.File
+}
+
+func (d *stagingDir) Readdir(count int) ([]os.FileInfo, error) {
+	children, err := d.File.Readdir(count)
+	infos := children[:0]
+	for _, child := range children {
+		if !strings.HasPrefix(child.Name(), stagingPrefix) {
+			infos = append(infos, child)
+		}
+	}
+	return infos, err
+}
+
+// RemoveOrphanedUploads removes the staged files of the base directories, which are older
+// than the orphan age and have been left over by interrupted uploads.
+func (cfg *Config) RemoveOrphanedUploads() {
+	if cfg.AtomicUploads == nil {
+		return
+	}
+	dirs := []string{cfg.Dir}
+	if cfg.SharedFolder != nil {
+		dirs = append(dirs, cfg.SharedFolder.Dir)
+	}
+	for _, e := range cfg.Exports {
+		if e != nil {
+			dirs = append(dirs, e.Dir)
+		}
+	}
+	removed := 0
+	cutoff := time.Now().Add(-cfg.AtomicUploads.orphanAge())
+	for _, dir := range dirs {
+		err := cfg.storage().Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), stagingPrefix) || info.ModTime().After(cutoff) {
+				return nil
+			}
+			if err := cfg.storage().Remove(p); err != nil {
+				log.WithField("path", p).WithError(err).Error("Error removing orphaned upload")
+				return nil
+			}
+			removed++
+			return nil
+		})
+		if err != nil {
+			log.WithField("dir", dir).WithError(err).Error("Error looking for orphaned uploads")
+		}
+	}
+	if removed > 0 {
+		log.WithField("files", removed).Info("Removed orphaned uploads")
+	}
+}
@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// stagedFiles returns the names of the staged uploads in dir.
+func stagedFiles(dir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, stagingPrefix+"*"))
+	return matches
+}
+
+func TestAtomicUploads(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "file.txt"), []byte("old"), 0640)
+
+	cfg := &Config{
+		Dir:           tmpDir,
+		Quota:         &Quota{Limit: 1000},
+		AtomicUploads: &AtomicUploads{},
+		Users:         map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}},
+	}
+	a := newQuotaApp(t, cfg)
+	do := func(method, target string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		req.SetBasicAuth("alice", "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	// the file keeps its content, while the upload is in progress
+	body, upload := io.Pipe()
+	done := make(chan int)
+	go func() {
+		done <- do("PUT", "/file.txt", body).Code
+	}()
+	upload.Write([]byte("new "))
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "file.txt")); string(b) != "old" {
+		t.Errorf("content during the upload = %q, want old", b)
+	}
+	if staged := stagedFiles(tmpDir); len(staged) != 1 {
+		t.Errorf("staged uploads during the upload = %v", staged)
+	}
+	if w := do("PROPFIND", "/", nil, "Depth", "1"); strings.Contains(w.Body.String(), stagingPrefix) {
+		t.Errorf("listing shows the staged upload: %s", w.Body)
+	}
+	upload.Write([]byte("content"))
+	upload.Close()
+	if code := <-done; code != http.StatusNoContent && code != http.StatusCreated {
+		t.Errorf("PUT status = %v", code)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "file.txt")); string(b) != "new content" {
+		t.Errorf("content after the upload = %q, want new content", b)
+	}
+	if fi, err := os.Stat(filepath.Join(tmpDir, "file.txt")); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0640 {
+		t.Errorf("mode of the replaced file = %v, want 0640", fi.Mode().Perm())
+	}
+	if used := quotaUsed(a); used != int64(len("new content")) {
+		t.Errorf("quota used = %d, want %d", used, len("new content"))
+	}
+
+	// an aborted upload leaves the file untouched
+	aborted := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection reset")))
+	do("PUT", "/file.txt", aborted)
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "file.txt")); string(b) != "new content" {
+		t.Errorf("content after the aborted upload = %q, want new content", b)
+	}
+	if staged := stagedFiles(tmpDir); len(staged) != 0 {
+		t.Errorf("staged uploads after the aborted upload = %v", staged)
+	}
+	if used := quotaUsed(a); used != int64(len("new content")) {
+		t.Errorf("quota used after the aborted upload = %d, want %d", used, len("new content"))
+	}
+
+	if w := do("PUT", "/created.txt", strings.NewReader("created")); w.Code != http.StatusCreated {
+		t.Errorf("PUT of a new file status = %v", w.Code)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "created.txt")); string(b) != "created" {
+		t.Errorf("content of the new file = %q, want created", b)
+	}
+}
+
+func TestRemoveOrphanedUploads(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "sub"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	orphan := filepath.Join(tmpDir, "sub", stagingPrefix+"orphan")
+	recent := filepath.Join(tmpDir, stagingPrefix+"recent")
+	kept := filepath.Join(tmpDir, "sub", "file.txt")
+	for _, name := range []string{orphan, recent, kept} {
+		ioutil.WriteFile(name, []byte("content"), 0600)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(orphan, old, old)
+	os.Chtimes(kept, old, old)
+
+	cfg := &Config{Dir: tmpDir, AtomicUploads: &AtomicUploads{}}
+	cfg.RemoveOrphanedUploads()
+
+	tests := []struct {
+		name   string
+		exists bool
+	}{
+		{orphan, false},
+		{recent, true},
+		{kept, true},
+	}
+	for _, tt := range tests {
+		if _, err := os.Stat(tt.name); (err == nil) != tt.exists {
+			t.Errorf("%s exists = %v, want %v", filepath.Base(tt.name), err == nil, tt.exists)
+		}
+	}
+}
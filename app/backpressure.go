@@ -0,0 +1,215 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the backpressure
+const (
+	defaultMaxOpenFiles        = 90
+	defaultBackpressureRetry   = 30 * time.Second
+	defaultBackpressureSamples = 2 * time.Second
+)
+
+// Reasons requests are shed for
+const (
+	shedOpenFiles = "openFiles"
+	shedDiskFree  = "diskFree"
+)
+
+// Backpressure sheds load, before the process runs out of file descriptors or the file system
+// of the base directory runs full, rather than failing requests halfway with 500 Internal
+// Server Error. Once the open files exceed MaxOpenFiles percent of their limit, 90 by
+// default, new requests are answered with 503 Service Unavailable and a Retry-After of
+// RetryAfter, 30s by default. With less than MinDiskFree bytes free, only requests creating
+// or uploading files are rejected. The resources are sampled every Interval, 2s by default.
+type Backpressure struct {
+	MaxOpenFiles int
+	MinDiskFree  ByteSize
+	RetryAfter   time.Duration
+	Interval     time.Duration
+}
+
+// ResourceMonitor samples the open files and the free disk space and sheds the requests,
+// which would exhaust them. A nil ResourceMonitor is valid and sheds nothing.
+type ResourceMonitor struct {
+	settings *Backpressure
+	dir      string
+
+	// the samples of the resources, the limit is 0 while it's unknown
+	openFiles, fileLimit, diskFree int64
+	// filesExhausted and diskExhausted are set while requests are shed
+	filesExhausted, diskExhausted int32
+
+	shedFiles, shedDisk int64
+}
+
+// NewResourceMonitor creates the monitor of the resources of the configuration. It returns
+// nil, if no backpressure is configured.
+func NewResourceMonitor(cfg *Config) (*ResourceMonitor, error) {
+	b := cfg.Backpressure
+	if b == nil {
+		return nil, nil
+	}
+	if b.MaxOpenFiles < 0 || b.MaxOpenFiles > 100 {
+		return nil, fmt.Errorf("invalid open files threshold %d%%, expected 1 to 100", b.MaxOpenFiles)
+	}
+	if b.MinDiskFree < 0 {
+		return nil, fmt.Errorf("minimum free disk space of the backpressure must not be negative")
+	}
+
+	m := &ResourceMonitor{settings: b, dir: cfg.Dir}
+	m.sample()
+	return m, nil
+}
+
+func (b *Backpressure) maxOpenFiles() int64 {
+	if b.MaxOpenFiles == 0 {
+		return defaultMaxOpenFiles
+	}
+	return int64(b.MaxOpenFiles)
+}
+
+func (b *Backpressure) retryAfter() time.Duration {
+	if b.RetryAfter <= 0 {
+		return defaultBackpressureRetry
+	}
+	return b.RetryAfter
+}
+
+func (b *Backpressure) interval() time.Duration {
+	if b.Interval <= 0 {
+		return defaultBackpressureSamples
+	}
+	return b.Interval
+}
+
+// Start samples the resources periodically.
+func (m *ResourceMonitor) Start() {
+	if m == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.settings.interval())
+		defer ticker.Stop()
+		for range ticker.C {
+			m.sample()
+		}
+	}()
+}
+
+// sample determines the open files and the free disk space and whether requests are shed.
+// Resources, which can't be determined, don't shed requests.
+func (m *ResourceMonitor) sample() {
+	open, limit, err := openFiles()
+	if err != nil {
+		open, limit = 0, 0
+	}
+	atomic.StoreInt64(&m.openFiles, open)
+	atomic.StoreInt64(&m.fileLimit, limit)
+	m.update(&m.filesExhausted, limit > 0 && open*100 >= limit*m.settings.maxOpenFiles(), log.Fields{"open": open, "limit": limit},
+		"Open files are about to exceed their limit, new requests are rejected", "Open files dropped below their limit")
+
+	if m.settings.MinDiskFree <= 0 {
+		return
+	}
+	free, _, err := DiskUsage(m.dir)
+	if err != nil {
+		return
+	}
+	atomic.StoreInt64(&m.diskFree, int64(free))
+	m.update(&m.diskExhausted, int64(free) < int64(m.settings.MinDiskFree), log.Fields{"free": ByteSize(free).String()},
+		"Disk is about to run full, uploads are rejected", "Disk has enough free space again")
+}
+
+// update switches the shedding of a resource and logs the change.
+func (m *ResourceMonitor) update(flag *int32, exhausted bool, fields log.Fields, exhaustedMsg, recoveredMsg string) {
+	var value int32
+	if exhausted {
+		value = 1
+	}
+	if atomic.SwapInt32(flag, value) == value {
+		return
+	}
+	if exhausted {
+		log.WithFields(fields).Warn(exhaustedMsg)
+	} else {
+		log.WithFields(fields).Info(recoveredMsg)
+	}
+}
+
+// consumesSpace returns whether a request with the method uploads or creates resources.
+func consumesSpace(method string) bool {
+	switch method {
+	case http.MethodPut, http.MethodPost, http.MethodPatch, "MKCOL", "COPY":
+		return true
+	}
+	return false
+}
+
+// shedReason returns why a request with the method has to be shed, or an empty string.
+func (m *ResourceMonitor) shedReason(method string) string {
+	if m == nil {
+		return ""
+	}
+
+	if atomic.LoadInt32(&m.filesExhausted) != 0 {
+		atomic.AddInt64(&m.shedFiles, 1)
+		return shedOpenFiles
+	}
+	if method != "" && consumesSpace(method) && atomic.LoadInt32(&m.diskExhausted) != 0 {
+		atomic.AddInt64(&m.shedDisk, 1)
+		return shedDiskFree
+	}
+	return ""
+}
+
+// shed answers the request with 503 Service Unavailable, if it would exhaust a resource, and
+// returns whether it did.
+func (m *ResourceMonitor) shed(ctx context.Context, w http.ResponseWriter, req *http.Request) bool {
+	reason := m.shedReason(req.Method)
+	if reason == "" {
+		return false
+	}
+
+	traceStep(ctx, "shed request, %s exhausted", reason)
+	m.setRetryAfter(w.Header())
+	http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+	return true
+}
+
+// setRetryAfter sets the Retry-After header of a shed request.
+func (m *ResourceMonitor) setRetryAfter(h http.Header) {
+	h.Set("Retry-After", strconv.Itoa(int(m.settings.retryAfter().Round(time.Second)/time.Second)))
+}
+
+// RegisterMetrics exposes the sampled resources and the shed requests.
+func (m *ResourceMonitor) RegisterMetrics(metrics *Metrics) {
+	if m == nil {
+		return
+	}
+
+	gauge := func(value *int64) func() []Sample {
+		return func() []Sample {
+			return []Sample{{Value: float64(atomic.LoadInt64(value))}}
+		}
+	}
+	metrics.Gauge("dave_open_files", "Files and sockets open by the process.", gauge(&m.openFiles))
+	metrics.Gauge("dave_open_files_limit", "Maximum files and sockets the process may open.", gauge(&m.fileLimit))
+	if m.settings.MinDiskFree > 0 {
+		metrics.Gauge("dave_disk_free_bytes", "Bytes available on the file system of the base directory.", gauge(&m.diskFree))
+	}
+	metrics.Counter("dave_shed_requests_total", "Requests rejected with 503 before they exhausted a resource.", func() []Sample {
+		return []Sample{
+			{Labels: map[string]string{"reason": shedOpenFiles}, Value: float64(atomic.LoadInt64(&m.shedFiles))},
+			{Labels: map[string]string{"reason": shedDiskFree}, Value: float64(atomic.LoadInt64(&m.shedDisk))},
+		}
+	})
+}
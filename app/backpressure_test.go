@@ -0,0 +1,85 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackpressure(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+
+	// no file system has an exabyte free, so uploads are shed right away
+	cfg := &Config{Dir: tmpDir, Backpressure: &Backpressure{MinDiskFree: 1 << 60, RetryAfter: time.Minute}}
+	m, err := NewResourceMonitor(cfg)
+	if err != nil {
+		t.Fatalf("NewResourceMonitor() error = %v", err)
+	}
+	if limit := atomic.LoadInt64(&m.fileLimit); limit > 0 && atomic.LoadInt64(&m.openFiles) <= 0 {
+		t.Errorf("open files = %v with a limit of %v", m.openFiles, limit)
+	}
+	a := newQuotaApp(t, cfg)
+	a.Resources = m
+
+	tests := []struct {
+		name           string
+		filesExhausted bool
+		method         string
+		want           int
+	}{
+		{"download with little disk space", false, "GET", http.StatusOK},
+		{"upload with little disk space", false, "PUT", http.StatusServiceUnavailable},
+		{"new collection with little disk space", false, "MKCOL", http.StatusServiceUnavailable},
+		{"download with too many open files", true, "GET", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var flag int32
+			if tt.filesExhausted {
+				flag = 1
+			}
+			atomic.StoreInt32(&m.filesExhausted, flag)
+
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, httptest.NewRequest(tt.method, "/a.txt", strings.NewReader("b")), a)
+			if w.Code != tt.want {
+				t.Fatalf("status = %v, want %v", w.Code, tt.want)
+			}
+			wantRetryAfter := ""
+			if tt.want == http.StatusServiceUnavailable {
+				wantRetryAfter = "60"
+			}
+			if got := w.Header().Get("Retry-After"); got != wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, wantRetryAfter)
+			}
+		})
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "a.txt")); string(b) != "a" {
+		t.Errorf("content after the shed upload = %q, want a", b)
+	}
+
+	metrics := NewMetrics()
+	m.RegisterMetrics(metrics)
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{`dave_shed_requests_total{reason="diskFree"} 2`, `dave_shed_requests_total{reason="openFiles"} 1`, "dave_disk_free_bytes "} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, w.Body)
+		}
+	}
+
+	if _, err := NewResourceMonitor(&Config{Dir: tmpDir, Backpressure: &Backpressure{MaxOpenFiles: 120}}); err == nil {
+		t.Error("NewResourceMonitor() with a threshold above 100% error = nil")
+	}
+}
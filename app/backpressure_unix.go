@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package app
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// openFiles returns the number of files and sockets open by the process and their limit.
+func openFiles() (open int64, limit int64, err error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, err
+	}
+
+	dir := "/dev/fd"
+	if runtime.GOOS == "linux" {
+		dir = "/proc/self/fd"
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	// an unlimited process is reported without a limit
+	if rlimit.Cur > math.MaxInt64 {
+		rlimit.Cur = 0
+	}
+	// the directory itself is open while it's read
+	return int64(len(names)) - 1, int64(rlimit.Cur), nil
+}
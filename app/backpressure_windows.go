@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package app
+
+import "errors"
+
+// openFiles fails, since Windows doesn't limit the handles of a process like file descriptors.
+func openFiles() (int64, int64, error) {
+	return 0, 0, errors.New("open files aren't limited on Windows")
+}
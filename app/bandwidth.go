@@ -0,0 +1,444 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions taken once a user exceeded the bandwidth cap
+const (
+	bandwidthBlock    = "block"
+	bandwidthThrottle = "throttle"
+)
+
+// Bandwidth caps the bytes each user transfers within a period of a month, for a fair use of
+// a shared connection. The period starts on ResetDay, the first day of the month by default.
+// Users exceeding the cap are blocked or throttled to Rate bytes per second until the period
+// ends. The totals are kept in File, if it's set, so they survive restarts.
+type Bandwidth struct {
+	Cap      ByteSize
+	Action   string
+	Rate     ByteSize
+	ResetDay int
+	File     string
+}
+
+// bandwidthCap returns the cap of the user, which overrides the global one.
+func (cfg *Config) bandwidthCap(username string) int64 {
+	if user := cfg.User(username); user != nil && user.BandwidthCap > 0 {
+		return int64(user.BandwidthCap)
+	}
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	return int64(cfg.Bandwidth.Cap)
+}
+
+// bandwidthRate returns the rate users exceeding their cap are throttled to.
+func (cfg *Config) bandwidthRate() int64 {
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	return int64(cfg.Bandwidth.Rate)
+}
+
+// bandwidthPeriod returns the start and the end of the period containing now.
+func bandwidthPeriod(now time.Time, resetDay int) (time.Time, time.Time) {
+	if resetDay <= 0 {
+		resetDay = 1
+	}
+	start := time.Date(now.Year(), now.Month(), resetDay, 0, 0, 0, 0, now.Location())
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
+
+// BandwidthUsage is the transfer total of a user within the current period.
+type BandwidthUsage struct {
+	User    string    `json:"user"`
+	Period  string    `json:"period"`
+	Resets  time.Time `json:"resets"`
+	Used    int64     `json:"used"`
+	Cap     int64     `json:"cap,omitempty"`
+	Limited bool      `json:"limited"`
+}
+
+// BandwidthLimiter accounts the bytes transferred by each user within the current period and
+// enforces the bandwidth caps. A nil BandwidthLimiter is valid and limits nothing.
+type BandwidthLimiter struct {
+	config *Config
+	path   string
+
+	mu        sync.Mutex
+	period    string
+	totals    map[string]int64
+	throttles map[string]*throttle
+	warned    map[string]bool
+	dirty     bool
+	blocked   int64
+}
+
+// bandwidthState is the content of the bandwidth file.
+type bandwidthState struct {
+	Period string           `json:"period"`
+	Totals map[string]int64 `json:"totals"`
+}
+
+// NewBandwidthLimiter creates a limiter, which continues the totals of the bandwidth file. It
+// returns nil, if no bandwidth caps are configured.
+func NewBandwidthLimiter(cfg *Config) (*BandwidthLimiter, error) {
+	if cfg.Bandwidth == nil {
+		return nil, nil
+	}
+	if err := cfg.Bandwidth.validate(); err != nil {
+		return nil, err
+	}
+
+	b := &BandwidthLimiter{
+		config:    cfg,
+		path:      cfg.Bandwidth.File,
+		totals:    map[string]int64{},
+		throttles: map[string]*throttle{},
+		warned:    map[string]bool{},
+	}
+	if b.path != "" {
+		data, err := ioutil.ReadFile(b.path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var state bandwidthState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return nil, fmt.Errorf("invalid bandwidth file %s: %s", b.path, err)
+			}
+			b.period = state.Period
+			for user, total := range state.Totals {
+				b.totals[user] = total
+			}
+		}
+	}
+	b.mu.Lock()
+	b.rollLocked(time.Now())
+	b.mu.Unlock()
+	return b, nil
+}
+
+func (bw *Bandwidth) validate() error {
+	switch bw.Action {
+	case "", bandwidthBlock:
+	case bandwidthThrottle:
+		if bw.Rate <= 0 {
+			return fmt.Errorf("throttling the bandwidth requires a rate")
+		}
+	default:
+		return fmt.Errorf("invalid bandwidth action %q, expected %s or %s", bw.Action, bandwidthBlock, bandwidthThrottle)
+	}
+	if bw.ResetDay < 0 || bw.ResetDay > 28 {
+		return fmt.Errorf("invalid bandwidth reset day %d, expected 1 to 28", bw.ResetDay)
+	}
+	return nil
+}
+
+// Start flushes the totals to the bandwidth file periodically.
+func (b *BandwidthLimiter) Start() {
+	if b == nil || b.path == "" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := b.flush(); err != nil {
+				log.WithField("path", b.path).WithError(err).Error("Error writing bandwidth file")
+			}
+		}
+	}()
+}
+
+// rollLocked resets the totals once a new period started.
+func (b *BandwidthLimiter) rollLocked(now time.Time) {
+	start, _ := bandwidthPeriod(now, b.config.Bandwidth.ResetDay)
+	period := start.Format(usageDateLayout)
+	if b.period == period {
+		return
+	}
+	if b.period != "" {
+		log.WithField("period", period).Info("Reset bandwidth totals for new period")
+	}
+	b.period = period
+	b.totals = map[string]int64{}
+	b.warned = map[string]bool{}
+	b.dirty = true
+}
+
+// limited returns whether the user exceeded the cap within the current period and whether
+// it's the first time this is noticed.
+func (b *BandwidthLimiter) limited(username string, now time.Time) (bool, bool) {
+	limit := b.config.bandwidthCap(username)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(now)
+	if limit <= 0 || b.totals[username] < limit {
+		return false, false
+	}
+	first := !b.warned[username]
+	b.warned[username] = true
+	return true, first
+}
+
+// record adds the bytes of a finished transfer to the total of its user.
+func (b *BandwidthLimiter) record(tr *Transfer) {
+	if b == nil || tr == nil || tr.User == "" {
+		return
+	}
+
+	in, out := tr.bytes()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollLocked(time.Now())
+	b.totals[tr.User] += in + out
+	b.dirty = true
+}
+
+// throttle returns the throttle shared by all requests of the user.
+func (b *BandwidthLimiter) throttle(username string) *throttle {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.throttles[username]
+	if t == nil {
+		t = &throttle{}
+		b.throttles[username] = t
+	}
+	return t
+}
+
+// Usage returns the totals of all users within the current period ordered by their names.
+func (b *BandwidthLimiter) Usage() []BandwidthUsage {
+	if b == nil {
+		return nil
+	}
+
+	now := time.Now()
+	start, end := bandwidthPeriod(now, b.config.Bandwidth.ResetDay)
+	users := map[string]bool{}
+	for _, username := range b.config.UserNames() {
+		users[username] = true
+	}
+
+	b.mu.Lock()
+	b.rollLocked(now)
+	totals := make(map[string]int64, len(b.totals))
+	for username, total := range b.totals {
+		totals[username] = total
+		users[username] = true
+	}
+	b.mu.Unlock()
+
+	usage := make([]BandwidthUsage, 0, len(users))
+	for username := range users {
+		limit := b.config.bandwidthCap(username)
+		usage = append(usage, BandwidthUsage{
+			User:    username,
+			Period:  start.Format(usageDateLayout),
+			Resets:  end,
+			Used:    totals[username],
+			Cap:     limit,
+			Limited: limit > 0 && totals[username] >= limit,
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].User < usage[j].User })
+	return usage
+}
+
+// flush writes the totals to the bandwidth file, if they have changed.
+func (b *BandwidthLimiter) flush() error {
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return nil
+	}
+	state := bandwidthState{Period: b.period, Totals: make(map[string]int64, len(b.totals))}
+	for username, total := range b.totals {
+		state.Totals[username] = total
+	}
+	b.dirty = false
+	b.mu.Unlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// RegisterMetrics exposes the transfer totals and caps of the users and the number of
+// blocked requests.
+func (b *BandwidthLimiter) RegisterMetrics(m *Metrics) {
+	if b == nil {
+		return
+	}
+
+	collect := func(value func(u BandwidthUsage) int64) func() []Sample {
+		return func() []Sample {
+			var samples []Sample
+			for _, u := range b.Usage() {
+				samples = append(samples, Sample{Labels: map[string]string{"user": u.User}, Value: float64(value(u))})
+			}
+			return samples
+		}
+	}
+	m.Gauge("dave_bandwidth_used_bytes", "Bytes transferred by the user within the current period.",
+		collect(func(u BandwidthUsage) int64 { return u.Used }))
+	m.Gauge("dave_bandwidth_cap_bytes", "Bytes the user may transfer within a period.",
+		collect(func(u BandwidthUsage) int64 { return u.Cap }))
+	m.Counter("dave_bandwidth_blocked_total", "Requests blocked by the bandwidth cap.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&b.blocked))}}
+	})
+}
+
+// limitBandwidth enforces the bandwidth cap of the user. It returns the throttle shared by
+// the transfers of the user, if they're throttled, or the time until the period ends, if
+// they're blocked. Both are zero for users within their cap. Only the first time a user
+// exceeds the cap within a period is logged.
+func (a *App) limitBandwidth(ctx context.Context, username string) (*throttle, time.Duration) {
+	b := a.Bandwidth
+	if b == nil || username == "" {
+		return nil, 0
+	}
+
+	now := time.Now()
+	limited, first := b.limited(username, now)
+	if !limited {
+		return nil, 0
+	}
+
+	bw := a.Config.Bandwidth
+	if first {
+		log.WithField("user", username).WithField("action", bw.Action).Warn("Bandwidth cap exceeded")
+	}
+	if bw.Action == bandwidthThrottle {
+		traceStep(ctx, "bandwidth cap exceeded, throttled to %s/s", ByteSize(a.Config.bandwidthRate()))
+		return b.throttle(username), 0
+	}
+
+	_, end := bandwidthPeriod(now, bw.ResetDay)
+	traceStep(ctx, "bandwidth cap exceeded, blocked until %s", end.Format(time.RFC3339))
+	atomic.AddInt64(&b.blocked, 1)
+	return nil, end.Sub(now)
+}
+
+// throttleHTTP returns the ResponseWriter throttling the response and replaces the body of
+// the request by one throttling it, if the throttle is set.
+func (a *App) throttleHTTP(w http.ResponseWriter, req *http.Request, t *throttle) http.ResponseWriter {
+	if t == nil {
+		return w
+	}
+	rate := a.Config.bandwidthRate()
+	if req.Body != nil {
+		req.Body = &throttledReader{ReadCloser: req.Body, throttle: t, rate: rate}
+	}
+	return &throttledWriter{ResponseWriter: w, throttle: t, rate: rate}
+}
+
+// retryAfter returns the value of a Retry-After header waiting for the duration.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
+
+// checkBandwidth enforces the bandwidth cap of the user. Blocked requests are answered with
+// 429 Too Many Requests until the period ends; otherwise the returned ResponseWriter has to be
+// used for the response, which is throttled if required.
+func (a *App) checkBandwidth(ctx context.Context, w http.ResponseWriter, req *http.Request, username string) (http.ResponseWriter, bool) {
+	t, blocked := a.limitBandwidth(ctx, username)
+	if blocked <= 0 {
+		return a.throttleHTTP(w, req, t), true
+	}
+
+	w.Header().Set("Retry-After", retryAfter(blocked))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, err := w.Write([]byte(fmt.Sprintf("%d %s", http.StatusTooManyRequests, "Too Many Requests")))
+	if err != nil {
+		log.WithError(err).Error("Error sending too many requests response")
+	}
+	return w, false
+}
+
+// throttle delays transfers, so all transfers sharing it don't exceed a rate together.
+type throttle struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until n bytes may be transferred at rate bytes per second.
+func (t *throttle) wait(n int, rate int64) {
+	if n <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	throttle *throttle
+	rate     int64
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.rate {
+		p = p[:r.rate]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.throttle.wait(n, r.rate)
+	return n, err
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	throttle *throttle
+	rate     int64
+}
+
+// Write writes p in chunks of at most one second of the rate.
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if int64(len(chunk)) > w.rate {
+			chunk = chunk[:w.rate]
+		}
+		w.throttle.wait(len(chunk), w.rate)
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,167 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestBandwidthPeriod(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		resetDay  int
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{"default reset day", day(2026, 3, 15).Add(time.Hour), 0, day(2026, 3, 1), day(2026, 4, 1)},
+		{"after reset day", day(2026, 3, 20), 15, day(2026, 3, 15), day(2026, 4, 15)},
+		{"on reset day", day(2026, 3, 15), 15, day(2026, 3, 15), day(2026, 4, 15)},
+		{"before reset day", day(2026, 3, 14), 15, day(2026, 2, 15), day(2026, 3, 15)},
+		{"across years", day(2026, 1, 2), 10, day(2025, 12, 10), day(2026, 1, 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := bandwidthPeriod(tt.now, tt.resetDay)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("bandwidthPeriod() = %v, %v, want %v, %v", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestHandleBandwidthCap(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	file := filepath.Join(tmpDir, "bandwidth.json")
+
+	cfg := &Config{
+		Bandwidth: &Bandwidth{Cap: 100, File: file},
+		Users: map[string]*UserInfo{
+			"foo": {Password: GenHash([]byte("password"))},
+			"bar": {Password: GenHash([]byte("password")), BandwidthCap: 1000},
+		},
+	}
+	b, err := NewBandwidthLimiter(cfg)
+	if err != nil {
+		t.Fatalf("NewBandwidthLimiter() error = %v", err)
+	}
+	a := &App{
+		Config: cfg,
+		Handler: &webdav.Handler{
+			FileSystem: webdav.NewMemFS(),
+			LockSystem: webdav.NewMemLS(),
+		},
+		Tracker:   NewTracker(),
+		Bandwidth: b,
+	}
+
+	tests := []struct {
+		name string
+		user string
+		size int
+		path string
+		want int
+	}{
+		{"within cap", "foo", 150, "/a", 201},
+		{"exceeding cap", "foo", 0, "/b", 429},
+		{"user cap", "bar", 150, "/c", 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", tt.path, strings.NewReader(strings.Repeat("x", tt.size)))
+			req.SetBasicAuth(tt.user, "password")
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+			if retry := w.Header().Get("Retry-After"); (tt.want == 429) != (retry != "") {
+				t.Errorf("handle() Retry-After = %q", retry)
+			}
+		})
+	}
+
+	// the totals survive a restart
+	if err := b.flush(); err != nil {
+		t.Fatalf("BandwidthLimiter.flush() error = %v", err)
+	}
+	restarted, err := NewBandwidthLimiter(cfg)
+	if err != nil {
+		t.Fatalf("NewBandwidthLimiter() error = %v", err)
+	}
+	usage := restarted.Usage()
+	if len(usage) != 2 || usage[0].Limited || !usage[1].Limited || usage[1].Used < 150 {
+		t.Errorf("BandwidthLimiter.Usage() = %v, want bar within and foo exceeding the cap", usage)
+	}
+}
+
+func TestBandwidthThrottle(t *testing.T) {
+	cfg := &Config{
+		Bandwidth: &Bandwidth{Cap: 1, Action: bandwidthThrottle, Rate: 4000},
+		Users: map[string]*UserInfo{
+			"foo": {Password: GenHash([]byte("password"))},
+		},
+	}
+	b, err := NewBandwidthLimiter(cfg)
+	if err != nil {
+		t.Fatalf("NewBandwidthLimiter() error = %v", err)
+	}
+	b.totals["foo"] = 1
+	a := &App{
+		Config: cfg,
+		Handler: &webdav.Handler{
+			FileSystem: webdav.NewMemFS(),
+			LockSystem: webdav.NewMemLS(),
+		},
+		Tracker:   NewTracker(),
+		Bandwidth: b,
+	}
+
+	start := time.Now()
+	req := httptest.NewRequest("PUT", "/a", strings.NewReader(strings.Repeat("x", 2000)))
+	req.SetBasicAuth("foo", "password")
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+
+	if w.Code != 201 {
+		t.Errorf("handle() status = %v, want 201", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("handle() took %v, want the upload to be throttled", elapsed)
+	}
+}
+
+func TestBandwidthValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		bandwidth Bandwidth
+		wantErr   bool
+	}{
+		{"block by default", Bandwidth{Cap: 100}, false},
+		{"throttle", Bandwidth{Cap: 100, Action: "throttle", Rate: 1000}, false},
+		{"throttle without rate", Bandwidth{Cap: 100, Action: "throttle"}, true},
+		{"unknown action", Bandwidth{Cap: 100, Action: "drop"}, true},
+		{"invalid reset day", Bandwidth{Cap: 100, ResetDay: 31}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.bandwidth.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Bandwidth.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package app
+
+import (
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Browse serves browsers an HTML listing of a directory instead of the WebDAV response to a
+// GET. Upload adds a form for uploading files to the listings of the directories the user is
+// allowed to write.
+type Browse struct {
+	Upload bool
+}
+
+// browseEntry is a member of a listed directory.
+type browseEntry struct {
+	Name     string
+	Href     string
+	Size     string
+	Modified string
+
+	dir     bool
+	size    int64
+	modTime time.Time
+}
+
+// browseLink is a link of the breadcrumbs or of a column header of a listing.
+type browseLink struct {
+	Name string
+	Href string
+}
+
+var browsePage = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html lang="{{.M.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Path}}</title>
+</head>
+<body>
+<h1>{{range .Crumbs}}<a href="{{.Href}}">{{.Name}}</a>{{end}}</h1>
+{{if .Entries}}<table>
+<thead><tr>{{range .Columns}}<th><a href="{{.Href}}">{{.Name}}</a></th>{{end}}</tr></thead>
+<tbody>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.Modified}}</td></tr>
+{{end}}</tbody>
+</table>
+{{else}}<p>{{.M.T "listing.empty"}}</p>
+{{end}}{{if .Upload}}<form method="post" enctype="multipart/form-data">
+<input type="file" name="file" multiple>
+<button type="submit">{{.M.T "browse.upload"}}</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// serveBrowse answers a GET of a directory by a browser with the listing of the directory and
+// a POST of the upload form by storing the files in the directory. It returns whether the
+// request has been handled.
+func (a *App) serveBrowse(w http.ResponseWriter, r *http.Request) bool {
+	browse := a.Config.Browse
+	if browse == nil {
+		return false
+	}
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			return false
+		}
+	case r.Method == http.MethodPost && browse.Upload:
+	default:
+		return false
+	}
+	ctx := r.Context()
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	name := path.Clean(p)
+	fi, err := a.Handler.FileSystem.Stat(ctx, name)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+
+	// the members are linked relative to the directory
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return true
+	}
+	if r.Method == http.MethodPost {
+		a.browseUpload(w, r, name)
+		return true
+	}
+	a.browseList(w, r, name)
+	return true
+}
+
+// browseList writes the listing of the directory, sorted by the column given by the sort
+// parameter, name, size or date, and the order parameter, asc or desc. Directories are
+// listed first.
+func (a *App) browseList(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+	f, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		a.Config.writeError(w, r, http.StatusNotFound)
+		return
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		a.Config.writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]*browseEntry, 0, len(children))
+	for _, child := range children {
+		entry := &browseEntry{
+			Name:     child.Name(),
+			Href:     url.PathEscape(child.Name()),
+			Modified: child.ModTime().UTC().Format("2006-01-02 15:04"),
+			dir:      child.IsDir(),
+			size:     child.Size(),
+			modTime:  child.ModTime(),
+		}
+		if entry.dir {
+			entry.Name += "/"
+			entry.Href += "/"
+		} else {
+			entry.Size = ByteSize(child.Size()).String()
+		}
+		entries = append(entries, entry)
+	}
+	column, desc := r.URL.Query().Get("sort"), r.URL.Query().Get("order") == "desc"
+	sortBrowseEntries(entries, column, desc)
+
+	m := a.Config.I18n.messages(r)
+	var columns []browseLink
+	for _, c := range []string{"name", "size", "date"} {
+		order := "asc"
+		if (c == column || c == "name" && column == "") && !desc {
+			order = "desc"
+		}
+		columns = append(columns, browseLink{Name: m.T("browse." + c), Href: "?sort=" + c + "&order=" + order})
+	}
+
+	// the breadcrumbs link the directory and its parents
+	href := strings.TrimSuffix(a.Config.Prefix, "/") + "/"
+	crumbs := []browseLink{{Name: "/", Href: href}}
+	for _, segment := range strings.Split(strings.Trim(name, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		href += url.PathEscape(segment) + "/"
+		crumbs = append(crumbs, browseLink{Name: segment + "/", Href: href})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := map[string]interface{}{
+		"Path":    name,
+		"Crumbs":  crumbs,
+		"Columns": columns,
+		"Entries": entries,
+		"Upload":  a.Config.Browse.Upload && !a.Config.ReadOnly() && a.Config.permitted(ctx, name, func(a access) bool { return a.write }),
+		"M":       m,
+	}
+	if err := browsePage.Execute(w, data); err != nil {
+		log.WithError(err).Error("Error writing directory listing")
+	}
+}
+
+// sortBrowseEntries sorts the directories before the files, each by the column.
+func sortBrowseEntries(entries []*browseEntry, column string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.dir != b.dir {
+			return a.dir
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch {
+		case column == "size" && a.size != b.size:
+			return a.size < b.size
+		case column == "date" && !a.modTime.Equal(b.modTime):
+			return a.modTime.Before(b.modTime)
+		}
+		return a.Name < b.Name
+	})
+}
+
+// browseUpload stores the files of the upload form in the directory and redirects to its
+// listing. The files are written like by a PUT, so the same checks and upload limits apply.
+func (a *App) browseUpload(w http.ResponseWriter, r *http.Request, name string) {
+	// a form of another site mustn't upload with the credentials the browser keeps
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			a.Config.writeError(w, r, http.StatusForbidden)
+			return
+		}
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		a.Config.writeError(w, r, http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			a.Config.writeError(w, r, http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+		filename := part.FileName()
+		if filename == "." || filename == ".." || strings.Contains(filename, "/") {
+			a.Config.writeError(w, r, http.StatusBadRequest)
+			return
+		}
+		if status := a.storeUpload(r, path.Join(name, filename), part); status != 0 {
+			a.Config.writeError(w, r, status)
+			return
+		}
+	}
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+// storeUpload writes a file of the upload form. Like the WebDAV handler, it holds a
+// temporary lock of the file, so files locked by WebDAV clients aren't overwritten. It
+// returns the status of the failure or 0.
+func (a *App) storeUpload(r *http.Request, name string, part io.Reader) int {
+	ctx := r.Context()
+	now := time.Now()
+	token, err := a.Handler.LockSystem.Create(now, webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: true})
+	if err != nil {
+		return http.StatusLocked
+	}
+	defer a.Handler.LockSystem.Unlock(now, token)
+
+	f, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err == nil {
+		_, err = io.Copy(f, part)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		return 0
+	}
+	if state := rejectionFromContext(ctx); state != nil && state.status != 0 {
+		return state.status
+	}
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errPermissionDenied) || os.IsPermission(err):
+		return deniedStatus(ctx)
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	}
+	log.WithField("path", name).WithError(err).Error("Error storing uploaded file")
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrowse(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "docs", "zeta"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "docs", "a.txt"), make([]byte, 2048), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "docs", "b <c>.txt"), []byte("b"), 0600)
+
+	readOnly := false
+	tests := []struct {
+		name       string
+		browse     *Browse
+		user       *UserInfo
+		accept     string
+		target     string
+		want       int
+		wantBody   []string
+		wantAbsent []string
+	}{
+		{"listing", &Browse{}, &UserInfo{}, "text/html", "/docs/", http.StatusOK,
+			[]string{`<a href="/">/</a><a href="/docs/">docs/</a>`, `<a href="zeta/">zeta/</a>`, "<td>2KB</td>", "b &lt;c&gt;.txt", `href="b%20%3Cc%3E.txt"`},
+			[]string{"<form"}},
+		{"sorted", &Browse{}, &UserInfo{}, "text/html", "/docs/?sort=size&order=desc", http.StatusOK,
+			[]string{`zeta/</a></td><td></td>`, `<a href="?sort=size&amp;order=asc">Size</a>`}, nil},
+		{"upload form", &Browse{Upload: true}, &UserInfo{}, "text/html", "/docs/", http.StatusOK, []string{`<form method="post"`}, nil},
+		{"upload without permission", &Browse{Upload: true}, &UserInfo{Permissions: Permissions{Write: &readOnly}}, "text/html", "/docs/", http.StatusOK,
+			nil, []string{"<form"}},
+		{"redirect", &Browse{}, &UserInfo{}, "text/html", "/docs", http.StatusMovedPermanently, nil, nil},
+		{"file", &Browse{}, &UserInfo{}, "text/html", "/docs/a.txt", http.StatusOK, nil, []string{"<table>"}},
+		{"client", &Browse{}, &UserInfo{}, "*/*", "/docs/", http.StatusMethodNotAllowed, nil, nil},
+		{"disabled", nil, &UserInfo{}, "text/html", "/docs/", http.StatusMethodNotAllowed, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.user.Password = GenHash([]byte("password"))
+			cfg := &Config{Dir: tmpDir, Browse: tt.browse, Users: map[string]*UserInfo{"alice": tt.user}}
+			a := newQuotaApp(t, cfg)
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.SetBasicAuth("alice", "password")
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			body := w.Body.String()
+			if w.Code != tt.want {
+				t.Fatalf("GET %s = %d %s, want %d", tt.target, w.Code, body, tt.want)
+			}
+			for _, s := range tt.wantBody {
+				if !strings.Contains(body, s) {
+					t.Errorf("GET %s = %s, want it to contain %s", tt.target, body, s)
+				}
+			}
+			for _, s := range tt.wantAbsent {
+				if strings.Contains(body, s) {
+					t.Errorf("GET %s = %s, want it not to contain %s", tt.target, body, s)
+				}
+			}
+		})
+	}
+}
+
+func TestSortBrowseEntries(t *testing.T) {
+	now := time.Now()
+	entries := []*browseEntry{
+		{Name: "b", size: 1, modTime: now},
+		{Name: "d/", dir: true, modTime: now},
+		{Name: "a", size: 3, modTime: now.Add(-time.Hour)},
+		{Name: "c/", dir: true, modTime: now.Add(-time.Hour)},
+	}
+	tests := []struct {
+		column string
+		desc   bool
+		want   string
+	}{
+		{"", false, "c/ d/ a b"},
+		{"name", true, "d/ c/ b a"},
+		{"size", false, "c/ d/ b a"},
+		{"date", false, "c/ d/ a b"},
+		{"date", true, "d/ c/ b a"},
+	}
+	for _, tt := range tests {
+		sortBrowseEntries(entries, tt.column, tt.desc)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("sortBrowseEntries(%s, %v) = %s, want %s", tt.column, tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestBrowseUpload(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name     string
+		upload   bool
+		origin   string
+		filename string
+		want     int
+	}{
+		{"upload", true, "", "a.txt", http.StatusSeeOther},
+		{"same origin", true, "http://example.com", "b.txt", http.StatusSeeOther},
+		{"other origin", true, "https://evil.example", "c.txt", http.StatusForbidden},
+		{"parent", true, "", "..", http.StatusBadRequest},
+		{"disabled", false, "", "d.txt", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Dir:    tmpDir,
+				Browse: &Browse{Upload: tt.upload},
+				Users:  map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}},
+			}
+			a := newQuotaApp(t, cfg)
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			fw, _ := mw.CreateFormFile("file", tt.filename)
+			fw.Write([]byte("content"))
+			mw.Close()
+			req := httptest.NewRequest("POST", "/", &body)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.SetBasicAuth("alice", "password")
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Fatalf("POST = %d %s, want %d", w.Code, w.Body.String(), tt.want)
+			}
+			data, err := ioutil.ReadFile(filepath.Join(tmpDir, tt.filename))
+			if stored := err == nil && string(data) == "content"; stored != (tt.want == http.StatusSeeOther) {
+				t.Errorf("stored file = %v, want %v", stored, tt.want == http.StatusSeeOther)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultChecksumMaxSize is the size of the largest files hashed when their checksums are
+// requested, unless MaxSize is set.
+const defaultChecksumMaxSize ByteSize = 100 << 20
+
+// ownCloudNamespace is the namespace of the properties of ownCloud and Nextcloud clients.
+const ownCloudNamespace = "http://owncloud.org/ns"
+
+var checksumsName = xml.Name{Space: ownCloudNamespace, Local: "checksums"}
+
+var (
+	errChecksumMismatch = errors.New("content doesn't match the checksum of the upload")
+	errChecksumPartial  = errors.New("uploads with a checksum can only be written as a whole")
+)
+
+// Checksums serves the MD5 and SHA-256 checksums of the files as the oc:checksums property,
+// like ownCloud does, so sync clients can detect corruption and skip unchanged files. The
+// checksums are computed when files are written or first requested and kept with the ones of
+// the integrity verification, in its file, as long as the size and the modification time of a
+// file stay the same. Files larger than MaxSize, 100M by default, are only hashed when they're
+// written. Uploads with an OC-Checksum or Content-MD5 header are verified before they're
+// written and rejected with 400 Bad Request, if their content doesn't match.
+type Checksums struct {
+	MaxSize ByteSize
+}
+
+// property returns the oc:checksums property of the checksums.
+func (c *checksumEntry) property() webdav.Property {
+	inner := fmt.Sprintf(`<checksum xmlns="%s">MD5:%s SHA256:%s</checksum>`, ownCloudNamespace, c.MD5, c.SHA256)
+	return webdav.Property{XMLName: checksumsName, InnerXML: []byte(inner)}
+}
+
+// maxSize returns the size of the largest files hashed when their checksums are requested.
+func (c *IntegrityChecker) maxSize() ByteSize {
+	if c.properties.MaxSize > 0 {
+		return c.properties.MaxSize
+	}
+	return defaultChecksumMaxSize
+}
+
+// openChecksumFile adds the checksums property to a file of the physical path opened for
+// reading.
+func (c *IntegrityChecker) openChecksumFile(f webdav.File, name string, flag int) webdav.File {
+	if c == nil || c.properties == nil || flag&writeFlags != 0 {
+		return f
+	}
+	return &checksumFile{File: f, cache: c, name: name}
+}
+
+// openHashingFile hashes a file of the physical path, which is written from its start, so its
+// checksums are known once it's closed.
+func (c *IntegrityChecker) openHashingFile(f webdav.File, name string, flag int) webdav.File {
+	if c == nil || c.properties == nil || flag&os.O_TRUNC == 0 && flag&os.O_EXCL == 0 {
+		return f
+	}
+	return &hashingFile{File: f, cache: c, name: name, md5: md5.New(), sha256: sha256.New()}
+}
+
+// checksumFile adds the oc:checksums property to the dead properties of a file.
+type checksumFile struct {
+	webdav.File
+	cache *IntegrityChecker
+	name  string
+}
+
+// DeadProps returns the checksums and the dead properties of the file. Checksums, which
+// aren't cached yet, are computed, unless the file is larger than the maximum size.
+func (f *checksumFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		inner, err := holder.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range inner {
+			props[name] = p
+		}
+	}
+	fi, err := f.cache.files.Stat(f.name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return props, nil
+	}
+	sums := f.cache.lookup(f.name, fi)
+	if sums == nil {
+		if fi.Size() > int64(f.cache.maxSize()) {
+			return props, nil
+		}
+		if sums, err = f.hash(fi); err != nil {
+			log.WithField("path", f.name).WithError(err).Warn("Error computing checksums")
+			return props, nil
+		}
+	}
+	props[checksumsName] = sums.property()
+	return props, nil
+}
+
+// hash computes the checksums of the content of the file and restores the position.
+func (f *checksumFile) hash(fi os.FileInfo) (*checksumEntry, error) {
+	pos, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	md5Sum, sha256Sum := md5.New(), sha256.New()
+	_, err = io.Copy(io.MultiWriter(md5Sum, sha256Sum), f.File)
+	if _, seekErr := f.File.Seek(pos, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.cache.record(f.name, fi, md5Sum.Sum(nil), sha256Sum.Sum(nil)), nil
+}
+
+// Patch changes the dead properties of the file, if it has any, and rejects all changes
+// otherwise.
+func (f *checksumFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// hashingFile computes the checksums of a file written as a whole from its start. Seeking
+// elsewhere leaves the checksums to be computed when they're requested.
+type hashingFile struct {
+	webdav.File
+	cache       *IntegrityChecker
+	name        string
+	md5, sha256 hash.Hash
+	written     int64
+	invalid     bool
+}
+
+func (f *hashingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if !f.invalid {
+		f.md5.Write(p[:n])
+		f.sha256.Write(p[:n])
+		f.written += int64(n)
+	}
+	return n, err
+}
+
+func (f *hashingFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err != nil || pos != f.written {
+		f.invalid = true
+	}
+	return pos, err
+}
+
+func (f *hashingFile) Close() error {
+	err := f.File.Close()
+	if err != nil || f.invalid {
+		return err
+	}
+	if fi, statErr := f.cache.files.Stat(f.name); statErr == nil && fi.Mode().IsRegular() && fi.Size() == f.written {
+		f.cache.record(f.name, fi, f.md5.Sum(nil), f.sha256.Sum(nil))
+	}
+	return nil
+}
+
+// uploadChecksums are the checksums an upload has to match.
+type uploadChecksums struct {
+	md5    []byte
+	sha256 []byte
+	header string
+}
+
+// withChecksums adds the checksums of the OC-Checksum and Content-MD5 headers of a PUT to the
+// context, so the upload is verified before it's written. OC-Checksum is verified for MD5
+// and SHA256, other algorithms are ignored. Values, which can't be decoded, never match.
+func (cfg *Config) withChecksums(ctx context.Context, req *http.Request) context.Context {
+	if cfg.Checksums == nil || req.Method != http.MethodPut {
+		return ctx
+	}
+	expected := &uploadChecksums{}
+	if value := req.Header.Get("Content-MD5"); value != "" {
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(sum) != md5.Size {
+			sum = []byte{}
+		}
+		expected.md5, expected.header = sum, "Content-MD5"
+	}
+	for _, field := range strings.Fields(req.Header.Get("OC-Checksum")) {
+		i := strings.Index(field, ":")
+		if i < 0 {
+			continue
+		}
+		sum, err := hex.DecodeString(field[i+1:])
+		if err != nil {
+			sum = []byte{}
+		}
+		switch strings.ToUpper(field[:i]) {
+		case "MD5":
+			expected.md5, expected.header = sum, "OC-Checksum"
+		case "SHA256":
+			expected.sha256, expected.header = sum, "OC-Checksum"
+		}
+	}
+	if expected.md5 == nil && expected.sha256 == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, checksumKey, expected)
+}
+
+func checksumsFromContext(ctx context.Context) *uploadChecksums {
+	expected, _ := ctx.Value(checksumKey).(*uploadChecksums)
+	return expected
+}
+
+// openVerifiedFile returns a file collecting the content of an upload. The file is only
+// opened by open once the content matched the checksums.
+func (u *uploadChecksums) openVerifiedFile(ctx context.Context, files storage, name, user string, flag int, open func() (webdav.File, error)) (webdav.File, error) {
+	if dir, err := checkWholeWrite(files, name, flag, errChecksumPartial); err != nil {
+		return nil, err
+	} else if dir {
+		return open()
+	}
+
+	spool, err := ioutil.TempFile("", "dave-checksum-")
+	if err != nil {
+		return nil, err
+	}
+	return &verifiedFile{File: spool, spool: spool.Name(), ctx: ctx, expected: u, name: name, user: user, open: open, md5: md5.New(), sha256: sha256.New()}, nil
+}
+
+// verifiedFile collects the content of an upload in the spool file until it's closed. The
+// spool is only reachable by the methods of webdav.File, so all of the content is hashed.
+type verifiedFile struct {
+	webdav.File
+	spool       string
+	ctx         context.Context
+	expected    *uploadChecksums
+	name        string
+	user        string
+	open        func() (webdav.File, error)
+	md5, sha256 hash.Hash
+}
+
+func (f *verifiedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.md5.Write(p[:n])
+	f.sha256.Write(p[:n])
+	return n, err
+}
+
+// Seek only reports the position, seeking elsewhere would break the checksums.
+func (f *verifiedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if (whence == io.SeekCurrent && offset == 0) || (whence == io.SeekStart && offset == pos) {
+		return pos, nil
+	}
+	return 0, errChecksumPartial
+}
+
+// Stat reports the info of the collected content with the name of the file.
+func (f *verifiedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return scanFileInfo{FileInfo: fi, name: filepath.Base(f.name)}, nil
+}
+
+// Close compares the collected content with the checksums and writes it to the file, if it
+// matches.
+func (f *verifiedFile) Close() error {
+	defer os.Remove(f.spool)
+	defer f.File.Close()
+
+	if (f.expected.md5 != nil && !bytes.Equal(f.expected.md5, f.md5.Sum(nil))) ||
+		(f.expected.sha256 != nil && !bytes.Equal(f.expected.sha256, f.sha256.Sum(nil))) {
+		log.WithFields(log.Fields{"path": f.name, "user": f.user, "header": f.expected.header}).Warn("Rejected upload: content doesn't match the checksum")
+		traceStep(f.ctx, "upload of %s rejected, its content doesn't match the %s header", f.name, f.expected.header)
+		rejectionFromContext(f.ctx).reject(http.StatusBadRequest)
+		return errChecksumMismatch
+	}
+
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	file, err := f.open()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, f.File); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
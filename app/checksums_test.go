@@ -0,0 +1,135 @@
+package app
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func newChecksumApp(t *testing.T, cfg *Config) *App {
+	checksums, err := NewIntegrityChecker(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewIntegrityChecker() error = %v", err)
+	}
+	return &App{
+		Config: cfg,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg, Checksums: checksums},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+}
+
+func TestChecksumVerification(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	content := "hello world"
+	md5Sum := md5.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+	a := newChecksumApp(t, &Config{Dir: tmpDir, Checksums: &Checksums{}})
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"no checksum", "", "", http.StatusCreated},
+		{"matching Content-MD5", "Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]), http.StatusCreated},
+		{"mismatching Content-MD5", "Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size)), http.StatusBadRequest},
+		{"invalid Content-MD5", "Content-MD5", "not base64", http.StatusBadRequest},
+		{"matching SHA256", "OC-Checksum", "SHA256:" + hex.EncodeToString(sha256Sum[:]), http.StatusCreated},
+		{"matching MD5", "OC-Checksum", "MD5:" + hex.EncodeToString(md5Sum[:]), http.StatusCreated},
+		{"mismatching SHA256", "OC-Checksum", "SHA256:" + strings.Repeat("0", 64), http.StatusBadRequest},
+		{"invalid hex", "OC-Checksum", "MD5:xyz", http.StatusBadRequest},
+		{"unknown algorithm", "OC-Checksum", "ADLER32:1a0b045d", http.StatusCreated},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "file" + strconv.Itoa(i) + ".txt"
+			req := httptest.NewRequest("PUT", "/"+name, strings.NewReader(content))
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Fatalf("PUT status = %d, want %d", w.Code, tt.want)
+			}
+			_, err := os.Stat(filepath.Join(tmpDir, name))
+			if exists := err == nil; exists != (tt.want == http.StatusCreated) {
+				t.Errorf("file exists = %v after status %d", exists, w.Code)
+			}
+		})
+	}
+}
+
+func TestChecksumProperty(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "existing.txt"), []byte("existing"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "large.txt"), make([]byte, 100), 0600)
+
+	a := newChecksumApp(t, &Config{Dir: tmpDir, Integrity: &Integrity{File: filepath.Join(tmpDir, "checksums.json")}, Checksums: &Checksums{MaxSize: 50}})
+	put := httptest.NewRequest("PUT", "/uploaded.txt", strings.NewReader("uploaded"))
+	handle(context.Background(), httptest.NewRecorder(), put, a)
+
+	propfind := func(name string) string {
+		body := `<?xml version="1.0"?><d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:prop><oc:checksums/></d:prop></d:propfind>`
+		req := httptest.NewRequest("PROPFIND", "/"+name, strings.NewReader(body))
+		req.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w.Body.String()
+	}
+	for _, name := range []string{"existing.txt", "uploaded.txt"} {
+		md5Sum := md5.Sum([]byte(strings.TrimSuffix(name, ".txt")))
+		sha256Sum := sha256.Sum256([]byte(strings.TrimSuffix(name, ".txt")))
+		want := "MD5:" + hex.EncodeToString(md5Sum[:]) + " SHA256:" + hex.EncodeToString(sha256Sum[:])
+		if got := propfind(name); !strings.Contains(got, want) {
+			t.Errorf("PROPFIND %s = %s, want checksums %s", name, got, want)
+		}
+	}
+	if got := propfind("large.txt"); strings.Contains(got, "MD5:") {
+		t.Errorf("PROPFIND of a file larger than the maximum size = %s, want no checksums", got)
+	}
+
+	// the verification takes the checksums of the served files
+	cache := a.Handler.FileSystem.(Dir).Checksums
+	if r, err := cache.run(time.Now()); err != nil || r.Verified != 2 || r.Hashed != 1 || r.Mismatches != 0 {
+		t.Fatalf("run() = %+v, %v, want 2 verified and 1 hashed file", r, err)
+	}
+	if err := cache.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	restored, err := NewIntegrityChecker(a.Config, nil)
+	if err != nil {
+		t.Fatalf("NewIntegrityChecker() error = %v", err)
+	}
+	name := filepath.Join(tmpDir, "uploaded.txt")
+	fi, _ := os.Stat(name)
+	if restored.lookup(name, fi) == nil {
+		t.Errorf("restored cache has no checksums of %s", name)
+	}
+	ioutil.WriteFile(name, []byte("changed content"), 0600)
+	fi, _ = os.Stat(name)
+	if restored.lookup(name, fi) != nil {
+		t.Errorf("restored cache has checksums of the changed %s", name)
+	}
+}
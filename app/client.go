@@ -0,0 +1,297 @@
+package app
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Remote holds the connection details of a WebDAV server which is used by the client commands.
+type Remote struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// RemoteFile describes a single resource of a remote WebDAV server.
+type RemoteFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	ETag    string
+}
+
+// Client is a minimal WebDAV client which speaks to any WebDAV compliant server.
+type Client struct {
+	base     *url.URL
+	username string
+	password string
+	HTTP     *http.Client
+}
+
+// NewClient creates a new WebDAV client for the given base URL.
+func NewClient(rawURL, username, password string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported url scheme: %s", u.Scheme)
+	}
+	if u.User != nil {
+		if username == "" {
+			username = u.User.Username()
+		}
+		if pw, ok := u.User.Password(); ok && password == "" {
+			password = pw
+		}
+		u.User = nil
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	return &Client{
+		base:     u,
+		username: username,
+		password: password,
+		HTTP:     http.DefaultClient,
+	}, nil
+}
+
+// Stat returns information about the remote resource at the given path.
+func (c *Client) Stat(name string) (*RemoteFile, error) {
+	files, err := c.propfind(name, "0")
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no properties returned for %s", name)
+	}
+
+	return files[0], nil
+}
+
+// ReadDir returns the direct members of the remote collection at the given path.
+func (c *Client) ReadDir(name string) ([]*RemoteFile, error) {
+	files, err := c.propfind(name, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	self := path.Clean("/" + name)
+	var members []*RemoteFile
+	for _, f := range files {
+		if f.Path != self {
+			members = append(members, f)
+		}
+	}
+
+	return members, nil
+}
+
+// Open returns a reader for the content of the remote file. The caller must close it.
+func (c *Client) Open(name string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Upload stores the content of r at the given remote path.
+func (c *Client) Upload(name string, r io.Reader, size int64) error {
+	req, err := c.newRequest("PUT", name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Mkdir creates a remote collection.
+func (c *Client) Mkdir(name string) error {
+	resp, err := c.do("MKCOL", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Remove deletes a remote file or collection.
+func (c *Client) Remove(name string) error {
+	resp, err := c.do("DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Move renames the remote resource, an existing destination is overwritten.
+func (c *Client) Move(name, destination string) error {
+	resp, err := c.do("MOVE", name, nil, map[string]string{
+		"Destination": c.resolve(destination).String(),
+		"Overwrite":   "T",
+	})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// RemoteError is returned if the server responds with an unexpected status code.
+type RemoteError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// IsNotFound returns whether the given error reports a missing remote resource.
+func IsNotFound(err error) bool {
+	re, ok := err.(*RemoteError)
+	return ok && re.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) propfind(name, depth string) ([]*RemoteFile, error) {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/>
+</D:prop></D:propfind>`
+
+	resp, err := c.do("PROPFIND", name, strings.NewReader(body), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("error parsing PROPFIND response: %s", err)
+	}
+
+	var files []*RemoteFile
+	for _, r := range ms.Responses {
+		f, err := c.parseResponse(r)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+func (c *Client) parseResponse(r msResponse) (*RemoteFile, error) {
+	href, err := url.Parse(r.Href)
+	if err != nil {
+		return nil, err
+	}
+	p := strings.TrimPrefix(href.Path, c.base.Path)
+
+	f := &RemoteFile{Path: path.Clean("/" + p)}
+	for _, ps := range r.Propstat {
+		if !strings.Contains(ps.Status, " 200 ") {
+			continue
+		}
+		f.IsDir = ps.Prop.ResourceType.Collection != nil
+		f.ETag = ps.Prop.ETag
+		if ps.Prop.ContentLength != "" {
+			f.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+		}
+		if ps.Prop.LastModified != "" {
+			f.ModTime, _ = http.ParseTime(ps.Prop.LastModified)
+		}
+	}
+
+	return f, nil
+}
+
+func (c *Client) do(method, name string, body io.Reader, header map[string]string) (*http.Response, error) {
+	req, err := c.newRequest(method, name, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	return c.send(req)
+}
+
+// resolve returns the URL of the remote path.
+func (c *Client) resolve(name string) *url.URL {
+	u := *c.base
+	if p := path.Clean("/" + name); p != "/" || u.Path == "" {
+		u.Path += p
+	}
+	return &u
+}
+
+func (c *Client) newRequest(method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.resolve(name).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	return req, nil
+}
+
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		// drain the body to allow connection reuse
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, &RemoteError{Method: req.Method, Path: req.URL.Path, StatusCode: resp.StatusCode}
+	}
+
+	return resp, nil
+}
+
+type multistatus struct {
+	XMLName   xml.Name     `xml:"DAV: multistatus"`
+	Responses []msResponse `xml:"response"`
+}
+
+type msResponse struct {
+	Href     string       `xml:"href"`
+	Propstat []msPropstat `xml:"propstat"`
+}
+
+type msPropstat struct {
+	Status string `xml:"status"`
+	Prop   msProp `xml:"prop"`
+}
+
+type msProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"collection"`
+	} `xml:"resourcetype"`
+	ContentLength string `xml:"getcontentlength"`
+	LastModified  string `xml:"getlastmodified"`
+	ETag          string `xml:"getetag"`
+}
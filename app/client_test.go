@@ -0,0 +1,89 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(&webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer srv.Close()
+
+	c, err := NewClient(srv.URL+"/dav/", "", "")
+	if err != nil {
+		t.Fatalf("NewClient() error = %v", err)
+	}
+
+	if err := c.Mkdir("/a"); err != nil {
+		t.Fatalf("Client.Mkdir() error = %v", err)
+	}
+	content := "hello dave"
+	if err := c.Upload("/a/b.txt", strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Client.Upload() error = %v", err)
+	}
+
+	fi, err := c.Stat("/a/b.txt")
+	if err != nil {
+		t.Fatalf("Client.Stat() error = %v", err)
+	}
+	if fi.Path != "/a/b.txt" || fi.IsDir || fi.Size != int64(len(content)) {
+		t.Errorf("Client.Stat() = %+v", fi)
+	}
+
+	members, err := c.ReadDir("/a")
+	if err != nil {
+		t.Fatalf("Client.ReadDir() error = %v", err)
+	}
+	if len(members) != 1 || members[0].Path != "/a/b.txt" {
+		t.Errorf("Client.ReadDir() = %+v, want exactly /a/b.txt", members)
+	}
+
+	rc, err := c.Open("/a/b.txt")
+	if err != nil {
+		t.Fatalf("Client.Open() error = %v", err)
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(got) != content {
+		t.Errorf("Client.Open() = %s, want %s", got, content)
+	}
+
+	if err := c.Remove("/a"); err != nil {
+		t.Fatalf("Client.Remove() error = %v", err)
+	}
+	if _, err := c.Stat("/a"); !IsNotFound(err) {
+		t.Errorf("Client.Stat() after remove error = %v, want not found", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	tests := []struct {
+		url      string
+		username string
+		wantErr  bool
+	}{
+		{"http://localhost:8000", "", false},
+		{"https://user:pw@localhost:8000/dav", "user", false},
+		{"ftp://localhost", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			c, err := NewClient(tt.url, "", "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewClient() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && c.username != tt.username {
+				t.Errorf("NewClient() username = %v, want %v", c.username, tt.username)
+			}
+		})
+	}
+}
@@ -6,21 +6,106 @@ import (
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"os"
-	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 )
 
 // Config represents the configuration of the server application.
 type Config struct {
-	Address string
-	Port    string
-	Prefix  string
-	Dir     string
-	TLS     *TLS
-	Log     Logging
-	Realm   string
-	Users   map[string]*UserInfo
-	Cors    Cors
+	Address             string
+	Port                string
+	Prefix              string
+	Dir                 string
+	Quota               *Quota
+	WriteLimit          *WriteLimit
+	UploadLimit         *UploadLimit
+	Usage               *Usage
+	Bandwidth           *Bandwidth
+	Alerts              *Alerts
+	FTP                 *FTP
+	SFTP                *SFTP
+	S3                  *S3
+	Nextcloud           *Nextcloud
+	Sync                *Sync
+	Shares              *Shares
+	Browse              *Browse
+	SignedURLs          *SignedURLs
+	Encryption          *Encryption
+	ICAP                *ICAP
+	ContentCheck        *ContentCheck
+	AppendOnly          *AppendOnly
+	Retention           *Retention
+	DeletionApproval    *DeletionApproval
+	Expiry              *Expiry
+	Honeypot            *Honeypot
+	WOPI                *WOPI
+	OnlyOffice          *OnlyOffice
+	TLS                 *TLS
+	HTTP3               bool
+	Listeners           []*Listener
+	Log                 Logging
+	Realm               string
+	Users               map[string]*UserInfo
+	PermissionTemplates map[string]*Permissions
+	Groups              map[string]*Permissions
+	Cors                Cors
+	Remotes             map[string]*Remote
+	Tailscale           *Tailscale
+	LDAP                *LDAP
+	OIDC                *OIDC
+	Guest               *Guest
+	AccessLog           *AccessLog
+	LoginLimit          *LoginLimit
+	Networks            *Networks
+	Admin               *Admin
+	CreateDirs          bool
+	DryRun              bool
+	Maintenance         *Maintenance
+	Shutdown            *Shutdown
+	I18n                *I18n
+	ErrorPages          *ErrorPages
+	Plugins             []*Plugin
+	Policy              *Policy
+	UploadRoutes        []*UploadRoute
+	Duplicates          *Duplicates
+	Images              *Images
+	EventLog            *EventLog
+	ConfigBackups       *ConfigBackups
+	Coordination        *Coordination
+	LockStore           *LockStore
+	Backpressure        *Backpressure
+	Integrity           *Integrity
+	ContentStore        *ContentStore
+	ObjectStore         *ReplicationS3
+	Search              *Search
+	Properties          *Properties
+	Feeds               *Feeds
+	SharedFolder        *SharedFolder
+	Exports             []*Export
+	Trash               *Trash
+	Versions            *Versions
+	Replication         *Replication
+	Webhooks            *Webhooks
+	Checksums           *Checksums
+	AtomicUploads       *AtomicUploads
+	Strict              bool
+
+	// usersMu guards Users against concurrent modifications by reloads and the admin API
+	usersMu sync.RWMutex
+	// settingsMu guards the settings, which reloads and the admin API change while requests
+	// read them: WriteLimit, UploadLimit, Networks, the cap and rate of Bandwidth, DryRun and Log
+	settingsMu sync.RWMutex
+	// reloaded are called after the configuration file has been reloaded
+	reloaded []func()
+	// files is the storage of the files, which is set up on first use
+	filesOnce sync.Once
+	files     storage
+	// readOnly is set while the emergency read-only mode is enabled
+	readOnly int32
+	// maintenance is the state of the maintenance mode, nil while it's disabled
+	maintenanceMu sync.RWMutex
+	maintenance   *maintenanceState
 }
 
 // Logging allows definition for logging each CRUD method.
@@ -30,24 +115,90 @@ type Logging struct {
 	Read   bool
 	Update bool
 	Delete bool
+	Trace  bool
+
+	// File is the file the log is written to instead of stderr.
+	File string
+	// Signals makes SIGUSR1 reopen the log file and SIGUSR2 write the runtime statistics to
+	// the log, instead of switching the read-only mode.
+	Signals bool
 }
 
-// TLS allows specification of a certificate and private key file.
+// TLS allows specification of a certificate and private key file. Additional certificates are
+// selected by the host name the client asks for via SNI. With ACME, the certificates are
+// obtained automatically instead. With a client CA, clients have to authenticate with a
+// certificate, which is optionally checked for revocation.
 type TLS struct {
+	CertFile     string
+	KeyFile      string
+	Certificates []*KeyPair
+	ACME         *ACME
+	ClientCAFile string
+	CRLFiles     []string
+	OCSP         bool
+}
+
+// KeyPair is an additional certificate and private key file.
+type KeyPair struct {
 	CertFile string
 	KeyFile  string
 }
 
+// KeyPairs returns the default and all additional certificates.
+func (t *TLS) KeyPairs() []*KeyPair {
+	return append([]*KeyPair{{CertFile: t.CertFile, KeyFile: t.KeyFile}}, t.Certificates...)
+}
+
 // UserInfo allows storing of a password and user directory.
 type UserInfo struct {
-	Password string
-	Subdir   *string
-}
+	Password string  `json:"password"`
+	Subdir   *string `json:"subdir,omitempty" yaml:",omitempty"`
+	Trace    bool    `json:"trace,omitempty" yaml:",omitempty"`
+
+	// Quota limits the bytes stored within the subdir of the user. Beyond SoftQuota, writes
+	// are only warned about until the grace period of the quotas ends.
+	Quota     ByteSize `json:"quota,omitempty" yaml:",omitempty"`
+	SoftQuota ByteSize `json:"softQuota,omitempty" yaml:"softQuota,omitempty"`
+
+	// FileLimit limits the number of files and directories within the subdir of the user.
+	FileLimit int64 `json:"fileLimit,omitempty" yaml:"fileLimit,omitempty"`
+
+	// BandwidthCap overrides the global bandwidth cap for the user.
+	BandwidthCap ByteSize `json:"bandwidthCap,omitempty" yaml:"bandwidthCap,omitempty"`
 
-// Cors contains settings related to Cross-Origin Resource Sharing (CORS)
-type Cors struct {
-	Origin      string
-	Credentials bool
+	// SSHKeys are the authorized_keys lines of the public keys the user logs in with via SFTP.
+	SSHKeys []string `json:"sshKeys,omitempty" yaml:"sshKeys,omitempty"`
+
+	// S3AccessKey and S3SecretKey are the credentials of the user for the S3 gateway. The
+	// signatures of S3 require the secret key in plain text.
+	S3AccessKey string `json:"s3AccessKey,omitempty" yaml:"s3AccessKey,omitempty"`
+	S3SecretKey string `json:"s3SecretKey,omitempty" yaml:"s3SecretKey,omitempty"`
+
+	// WriteLimit overrides the global write limit for the user.
+	WriteLimit *WriteLimit `json:"writeLimit,omitempty" yaml:"writeLimit,omitempty"`
+
+	// UploadLimit overrides the global upload limit for the user.
+	UploadLimit *UploadLimit `json:"uploadLimit,omitempty" yaml:"uploadLimit,omitempty"`
+
+	// AllowedNetworks and DeniedNetworks restrict the addresses the user connects from in
+	// addition to the networks of the configuration.
+	AllowedNetworks []string `json:"allowedNetworks,omitempty" yaml:"allowedNetworks,omitempty"`
+	DeniedNetworks  []string `json:"deniedNetworks,omitempty" yaml:"deniedNetworks,omitempty"`
+
+	// Tailscale is the login name of the Tailscale user, who is authenticated as this user on
+	// Tailscale listeners.
+	Tailscale string `json:"tailscale,omitempty" yaml:",omitempty"`
+
+	// Encrypted are the folders of the user, whose files are encrypted with a passphrase of
+	// the user.
+	Encrypted []string `json:"encrypted,omitempty" yaml:",omitempty"`
+
+	// Permissions restrict the operations of the user, either by a template or single
+	// permissions overriding the ones of the template and the Groups of the user.
+	Permissions `yaml:",inline" mapstructure:",squash"`
+	Groups      []string `json:"groups,omitempty" yaml:",omitempty"`
+	// Rules override the permissions for single paths of the user.
+	Rules []*PermissionRule `json:"rules,omitempty" yaml:",omitempty"`
 }
 
 // ParseConfig parses the application configuration an sets defaults.
@@ -55,63 +206,318 @@ func ParseConfig(path string) *Config {
 	var cfg = &Config{}
 
 	setDefaults()
-	if path != "" {
-		viper.SetConfigFile(path)
-	} else {
-		viper.SetConfigName("config")
-		viper.AddConfigPath("./config")
-		viper.AddConfigPath("$HOME/.swd")
-		viper.AddConfigPath("$HOME/.dave")
-		viper.AddConfigPath(".")
-	}
+	setConfigPaths(viper.GetViper(), path)
 
 	err := viper.ReadInConfig()
 	if err != nil {
 		log.Fatal(fmt.Errorf("Fatal error config file: %s", err))
 	}
 
-	err = viper.Unmarshal(&cfg)
+	err = unmarshalConfig(viper.GetViper(), cfg, false)
 	if err != nil {
 		log.Fatal(fmt.Errorf("Fatal error parsing config file: %s", err))
 	}
 
-	if cfg.TLS != nil {
-		if _, err := os.Stat(cfg.TLS.KeyFile); err != nil {
-			log.Fatal(fmt.Errorf("TLS keyFile doesn't exist: %s", err))
-		}
-		if _, err := os.Stat(cfg.TLS.CertFile); err != nil {
-			log.Fatal(fmt.Errorf("TLS certFile doesn't exist: %s", err))
-		}
+	cfg.setSectionDefaults()
+
+	if err := cfg.checkTLSFiles(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.checkUploadRoutes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.checkDuplicates(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.checkPermissions(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.checkLDAP(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.checkObjectStore(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.checkNetworks(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.checkOIDC(); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.HTTP3 && !cfg.hasTLSListener() {
+		log.Fatal(errors.New("HTTP/3 requires a TLS configuration"))
 	}
 
+	cfg.backupConfig(viper.ConfigFileUsed())
 	viper.WatchConfig()
 	viper.OnConfigChange(cfg.handleConfigUpdate)
 
-	cfg.ensureUserDirs()
+	if err := cfg.checkDirs(); err != nil {
+		log.Fatal(err)
+	}
 
 	return cfg
 }
 
+// ReadConfig reads the configuration at path or at the default locations like ParseConfig,
+// but without watching it for changes or touching the file system otherwise. This is meant
+// for tools which inspect or modify the configuration. It returns the parsed configuration
+// and the path of the file which has been read.
+func ReadConfig(path string) (*Config, string, error) {
+	return readConfig(path, false)
+}
+
+// ReadConfigStrict reads the configuration like ReadConfig, but fails on unknown keys even
+// if strict parsing is not enabled in the configuration itself.
+func ReadConfigStrict(path string) (*Config, string, error) {
+	return readConfig(path, true)
+}
+
+func readConfig(path string, strict bool) (*Config, string, error) {
+	v := viper.New()
+	applyDefaults(v)
+	setConfigPaths(v, path)
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, v.ConfigFileUsed(), err
+	}
+
+	cfg := &Config{}
+	if err := unmarshalConfig(v, cfg, strict); err != nil {
+		return nil, v.ConfigFileUsed(), err
+	}
+	cfg.setSectionDefaults()
+
+	return cfg, v.ConfigFileUsed(), nil
+}
+
+// unmarshalConfig decodes the configuration read by v into cfg. Unknown keys are rejected,
+// if strict is set or strict parsing is enabled via the configuration. Otherwise they are
+// silently ignored, which lets typos in permission settings go unnoticed.
+func unmarshalConfig(v *viper.Viper, cfg *Config, strict bool) error {
+	if strict || v.GetBool("Strict") {
+		return v.UnmarshalExact(cfg, viper.DecodeHook(decodeHook))
+	}
+	return v.Unmarshal(cfg, viper.DecodeHook(decodeHook))
+}
+
+// setConfigPaths configures the given file or the default locations of the configuration.
+func setConfigPaths(v *viper.Viper, path string) {
+	if path != "" {
+		v.SetConfigFile(path)
+	} else {
+		v.SetConfigName("config")
+		v.AddConfigPath("./config")
+		v.AddConfigPath("$HOME/.swd")
+		v.AddConfigPath("$HOME/.dave")
+		v.AddConfigPath(".")
+	}
+}
+
 // setDefaults adds some default values for the configuration
 func setDefaults() {
-	viper.SetDefault("Address", "127.0.0.1")
-	viper.SetDefault("Port", "8000")
-	viper.SetDefault("Prefix", "")
-	viper.SetDefault("Dir", "/tmp")
-	viper.SetDefault("Users", nil)
-	viper.SetDefault("TLS", nil)
-	viper.SetDefault("Realm", "dave")
-	viper.SetDefault("Log.Error", true)
-	viper.SetDefault("Log.Create", false)
-	viper.SetDefault("Log.Read", false)
-	viper.SetDefault("Log.Update", false)
-	viper.SetDefault("Log.Delete", false)
-	viper.SetDefault("Cors.Credentials", false)
-}
-
-// AuthenticationNeeded returns whether users are defined and authentication is required
+	applyDefaults(viper.GetViper())
+}
+
+func applyDefaults(v *viper.Viper) {
+	v.SetDefault("Address", "127.0.0.1")
+	v.SetDefault("Port", "8000")
+	v.SetDefault("Prefix", "")
+	v.SetDefault("Dir", "/tmp")
+	v.SetDefault("CreateDirs", true)
+	v.SetDefault("Users", nil)
+	v.SetDefault("TLS", nil)
+	v.SetDefault("Realm", "dave")
+	v.SetDefault("Log.Error", true)
+	v.SetDefault("Log.Create", false)
+	v.SetDefault("Log.Read", false)
+	v.SetDefault("Log.Update", false)
+	v.SetDefault("Log.Delete", false)
+	v.SetDefault("Cors.Credentials", false)
+}
+
+// setSectionDefaults sets defaults of optional sections. These can't be viper defaults,
+// because those would always create the section.
+func (cfg *Config) setSectionDefaults() {
+	for _, l := range cfg.Listeners {
+		if l.Port == "" {
+			l.Port = cfg.Port
+		}
+		if l.Tailscale && cfg.Tailscale == nil {
+			cfg.Tailscale = &Tailscale{}
+		}
+	}
+	if cfg.FTP != nil {
+		if cfg.FTP.Address == "" {
+			cfg.FTP.Address = cfg.Address
+		}
+		if cfg.FTP.Port == "" {
+			cfg.FTP.Port = defaultFTPPort
+		}
+	}
+	if cfg.SFTP != nil {
+		if cfg.SFTP.Address == "" {
+			cfg.SFTP.Address = cfg.Address
+		}
+		if cfg.SFTP.Port == "" {
+			cfg.SFTP.Port = defaultSFTPPort
+		}
+	}
+	if cfg.S3 != nil {
+		if cfg.S3.Address == "" {
+			cfg.S3.Address = cfg.Address
+		}
+		if cfg.S3.Port == "" {
+			cfg.S3.Port = defaultS3Port
+		}
+	}
+	if cfg.EventLog != nil && cfg.EventLog.Source == "" {
+		cfg.EventLog.Source = defaultEventLogSource
+	}
+	if cfg.Duplicates != nil && cfg.Duplicates.Action == "" {
+		cfg.Duplicates.Action = DuplicateFlag
+	}
+	if cfg.Images != nil {
+		if cfg.Images.CacheSize == 0 {
+			cfg.Images.CacheSize = defaultImageCacheSize
+		}
+		if cfg.Images.MaxSize == 0 {
+			cfg.Images.MaxSize = defaultImageMaxSize
+		}
+		if cfg.Images.MaxPixels == 0 {
+			cfg.Images.MaxPixels = defaultImageMaxPixels
+		}
+		if cfg.Images.Quality == 0 {
+			cfg.Images.Quality = defaultImageQuality
+		}
+	}
+	if cfg.Nextcloud != nil && cfg.Nextcloud.Version == "" {
+		cfg.Nextcloud.Version = defaultNextcloudVersion
+	}
+	if cfg.Admin != nil {
+		if cfg.Admin.Address == "" {
+			cfg.Admin.Address = "127.0.0.1"
+		}
+		if cfg.Admin.Port == "" {
+			cfg.Admin.Port = "8001"
+		}
+	}
+}
+
+// AuthenticationNeeded returns whether users are defined and authentication is required.
+// Restricted guests require it for everything beyond their permissions.
 func (cfg *Config) AuthenticationNeeded() bool {
-	return cfg.Users != nil && len(cfg.Users) != 0
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	return (cfg.Users != nil && len(cfg.Users) != 0) || cfg.LDAP != nil || cfg.OIDC != nil || cfg.Guest != nil
+}
+
+// User returns the user with the given name or nil, if there is none.
+func (cfg *Config) User(name string) *UserInfo {
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	if user := cfg.Users[name]; user != nil {
+		return user
+	}
+	return cfg.LDAP.user(name)
+}
+
+// SetUser adds or replaces the user with the given name.
+func (cfg *Config) SetUser(name string, user *UserInfo) {
+	cfg.usersMu.Lock()
+	defer cfg.usersMu.Unlock()
+	if cfg.Users == nil {
+		cfg.Users = map[string]*UserInfo{}
+	}
+	cfg.Users[name] = user
+}
+
+// updateUser replaces the user with the given name by a copy changed by update, so readers of
+// the previous one aren't affected. It returns whether the user exists.
+func (cfg *Config) updateUser(name string, update func(user *UserInfo)) bool {
+	cfg.usersMu.Lock()
+	defer cfg.usersMu.Unlock()
+	user := cfg.Users[name]
+	if user == nil {
+		return false
+	}
+	updated := *user
+	update(&updated)
+	cfg.Users[name] = &updated
+	return true
+}
+
+// RemoveUser removes the user with the given name and returns whether it existed.
+func (cfg *Config) RemoveUser(name string) bool {
+	cfg.usersMu.Lock()
+	defer cfg.usersMu.Unlock()
+	_, ok := cfg.Users[name]
+	delete(cfg.Users, name)
+	return ok
+}
+
+// replaceUsers replaces all users, e.g. by the users of the coordination store.
+func (cfg *Config) replaceUsers(users map[string]*UserInfo) {
+	cfg.usersMu.Lock()
+	defer cfg.usersMu.Unlock()
+	for username := range cfg.Users {
+		if users[username] == nil {
+			log.WithField("user", username).Info("Removed User from configuration")
+		}
+	}
+	for username, user := range users {
+		switch previous := cfg.Users[username]; {
+		case previous == nil:
+			log.WithField("user", username).Info("Added User to configuration")
+		case !reflect.DeepEqual(previous, user):
+			log.WithField("user", username).Info("Updated user")
+		}
+	}
+	cfg.Users = users
+}
+
+// UserNames returns the sorted names of all configured users.
+func (cfg *Config) UserNames() []string {
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	names := make([]string, 0, len(cfg.Users))
+	for name := range cfg.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UsersCopy returns a snapshot of the configured users.
+func (cfg *Config) UsersCopy() map[string]*UserInfo {
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	users := make(map[string]*UserInfo, len(cfg.Users))
+	for name, user := range cfg.Users {
+		users[name] = user
+	}
+	return users
+}
+
+// Logging returns the logging settings, which reloads and the admin API may change.
+func (cfg *Config) Logging() Logging {
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	return cfg.Log
+}
+
+// dryRun returns whether the dry run mode is enabled.
+func (cfg *Config) dryRun() bool {
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	return cfg.DryRun
+}
+
+// networks returns the networks clients may connect from.
+func (cfg *Config) networks() *Networks {
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	return cfg.Networks
 }
 
 func (cfg *Config) handleConfigUpdate(e fsnotify.Event) {
@@ -128,19 +534,62 @@ func (cfg *Config) handleConfigUpdate(e fsnotify.Event) {
 
 	log.WithField("path", e.Name).Info("Config file changed")
 
-	file, err := os.Open(e.Name)
+	// a file, which can't be read completely, would remove all users and with them the
+	// authentication, so the previous configuration is kept then
+	v := viper.New()
+	v.SetConfigFile(e.Name)
+	if err = v.ReadInConfig(); err == nil && len(v.AllKeys()) == 0 {
+		err = errors.New("configuration file is empty")
+	}
 	if err != nil {
-		log.WithField("path", e.Name).Warn("Error reloading config")
+		log.WithField("path", e.Name).WithError(err).Error("Error reading changed configuration, keeping the previous one")
+		return
 	}
+	applyDefaults(v)
 
 	var updatedCfg = &Config{}
-	viper.ReadConfig(file)
-	viper.Unmarshal(&updatedCfg)
+	strict := cfg.Strict || v.GetBool("Strict")
+	if err := unmarshalConfig(v, updatedCfg, strict); err != nil {
+		log.WithError(err).Error("Rejected invalid configuration, keeping the previous one")
+		return
+	}
+	if err := updatedCfg.checkPermissions(); err != nil {
+		log.WithError(err).Error("Rejected invalid permissions, keeping the previous configuration")
+		return
+	}
+	if err := updatedCfg.checkNetworks(); err != nil {
+		log.WithError(err).Error("Rejected invalid networks, keeping the previous configuration")
+		return
+	}
 
 	updateConfig(cfg, updatedCfg)
+	cfg.backupConfig(e.Name)
+	cfg.settingsMu.RLock()
+	reloaded := cfg.reloaded
+	cfg.settingsMu.RUnlock()
+	for _, f := range reloaded {
+		f()
+	}
+}
+
+// OnReload registers f to be called after the configuration file has been reloaded, so
+// components applying parts of the configuration on their own can update them.
+func (cfg *Config) OnReload(f func()) {
+	cfg.settingsMu.Lock()
+	defer cfg.settingsMu.Unlock()
+	cfg.reloaded = append(cfg.reloaded, f)
+}
+
+// Reload reloads the configuration file like a change of it does.
+func (cfg *Config) Reload() {
+	cfg.handleConfigUpdate(fsnotify.Event{Name: viper.ConfigFileUsed(), Op: fsnotify.Write})
 }
 
 func updateConfig(cfg *Config, updatedCfg *Config) {
+	cfg.usersMu.Lock()
+	if cfg.Users == nil {
+		cfg.Users = map[string]*UserInfo{}
+	}
 	for username := range cfg.Users {
 		if updatedCfg.Users[username] == nil {
 			log.WithField("user", username).Info("Removed User from configuration")
@@ -152,17 +601,112 @@ func updateConfig(cfg *Config, updatedCfg *Config) {
 			log.WithField("user", username).Info("Added User to configuration")
 			cfg.Users[username] = v
 		} else {
-			if cfg.Users[username].Password != v.Password {
+			// like updateUser, the user is replaced by an updated copy, so requests in progress
+			// keep a consistent one
+			updated := *cfg.Users[username]
+			if updated.Password != v.Password {
 				log.WithField("user", username).Info("Updated password of user")
-				cfg.Users[username].Password = v.Password
+				updated.Password = v.Password
 			}
-			if cfg.Users[username].Subdir != v.Subdir {
+			if !reflect.DeepEqual(updated.Subdir, v.Subdir) {
 				log.WithField("user", username).Info("Updated subdir of user")
-				cfg.Users[username].Subdir = v.Subdir
+				updated.Subdir = v.Subdir
+			}
+			if updated.Quota != v.Quota || updated.SoftQuota != v.SoftQuota || updated.FileLimit != v.FileLimit {
+				log.WithField("user", username).Info("Updated quota of user")
+				updated.Quota = v.Quota
+				updated.SoftQuota = v.SoftQuota
+				updated.FileLimit = v.FileLimit
+			}
+			if updated.Tailscale != v.Tailscale {
+				log.WithField("user", username).Info("Updated Tailscale identity of user")
+				updated.Tailscale = v.Tailscale
+			}
+			if !reflect.DeepEqual(updated.WriteLimit, v.WriteLimit) {
+				log.WithField("user", username).Info("Updated write limit of user")
+				updated.WriteLimit = v.WriteLimit
+			}
+			if !reflect.DeepEqual(updated.UploadLimit, v.UploadLimit) {
+				log.WithField("user", username).Info("Updated upload limit of user")
+				updated.UploadLimit = v.UploadLimit
+			}
+			if updated.BandwidthCap != v.BandwidthCap {
+				log.WithField("user", username).Info("Updated bandwidth cap of user")
+				updated.BandwidthCap = v.BandwidthCap
+			}
+			if !reflect.DeepEqual(updated.AllowedNetworks, v.AllowedNetworks) || !reflect.DeepEqual(updated.DeniedNetworks, v.DeniedNetworks) {
+				log.WithField("user", username).Info("Updated networks of user")
+				updated.AllowedNetworks = v.AllowedNetworks
+				updated.DeniedNetworks = v.DeniedNetworks
+			}
+			if !reflect.DeepEqual(updated.SSHKeys, v.SSHKeys) {
+				log.WithField("user", username).Info("Updated SSH keys of user")
+				updated.SSHKeys = v.SSHKeys
+			}
+			if updated.S3AccessKey != v.S3AccessKey || updated.S3SecretKey != v.S3SecretKey {
+				log.WithField("user", username).Info("Updated S3 credentials of user")
+				updated.S3AccessKey = v.S3AccessKey
+				updated.S3SecretKey = v.S3SecretKey
+			}
+			if !reflect.DeepEqual(updated.Encrypted, v.Encrypted) {
+				log.WithField("user", username).Info("Updated encrypted folders of user")
+				updated.Encrypted = v.Encrypted
+			}
+			if !reflect.DeepEqual(updated.Permissions, v.Permissions) {
+				log.WithField("user", username).Info("Updated permissions of user")
+				updated.Permissions = v.Permissions
 			}
+			if !reflect.DeepEqual(updated.Groups, v.Groups) {
+				log.WithField("user", username).Info("Updated groups of user")
+				updated.Groups = v.Groups
+			}
+			if !reflect.DeepEqual(updated.Rules, v.Rules) {
+				log.WithField("user", username).Info("Updated permission rules of user")
+				updated.Rules = v.Rules
+			}
+			if updated.Trace != v.Trace {
+				log.WithField("user", username).WithField("enabled", v.Trace).Info("Set tracing of user")
+				updated.Trace = v.Trace
+			}
+			cfg.Users[username] = &updated
 		}
 	}
+	if !reflect.DeepEqual(cfg.PermissionTemplates, updatedCfg.PermissionTemplates) {
+		log.Info("Updated permission templates")
+		cfg.PermissionTemplates = updatedCfg.PermissionTemplates
+	}
+	if !reflect.DeepEqual(cfg.Groups, updatedCfg.Groups) {
+		log.Info("Updated groups")
+		cfg.Groups = updatedCfg.Groups
+	}
+	if !reflect.DeepEqual(cfg.Guest, updatedCfg.Guest) {
+		log.WithField("enabled", updatedCfg.Guest != nil).Info("Updated guest access")
+		cfg.Guest = updatedCfg.Guest
+	}
+	cfg.usersMu.Unlock()
 	cfg.ensureUserDirs()
+	cfg.settingsMu.Lock()
+	defer cfg.settingsMu.Unlock()
+	if !reflect.DeepEqual(cfg.WriteLimit, updatedCfg.WriteLimit) {
+		cfg.WriteLimit = updatedCfg.WriteLimit
+		log.Info("Updated write limit")
+	}
+	if !reflect.DeepEqual(cfg.UploadLimit, updatedCfg.UploadLimit) {
+		cfg.UploadLimit = updatedCfg.UploadLimit
+		log.Info("Updated upload limit")
+	}
+	if !reflect.DeepEqual(cfg.Networks, updatedCfg.Networks) {
+		cfg.Networks = updatedCfg.Networks
+		log.Info("Updated networks")
+	}
+	if cfg.Bandwidth != nil && updatedCfg.Bandwidth != nil && cfg.Bandwidth.Cap != updatedCfg.Bandwidth.Cap {
+		cfg.Bandwidth.Cap = updatedCfg.Bandwidth.Cap
+		log.WithField("cap", cfg.Bandwidth.Cap.String()).Info("Updated bandwidth cap")
+	}
+	if cfg.DryRun != updatedCfg.DryRun {
+		cfg.DryRun = updatedCfg.DryRun
+		log.WithField("enabled", cfg.DryRun).Info("Set dry run mode")
+	}
 	if cfg.Log.Create != updatedCfg.Log.Create {
 		cfg.Log.Create = updatedCfg.Log.Create
 		log.WithField("enabled", cfg.Log.Create).Info("Set logging for create operations")
@@ -179,25 +723,8 @@ func updateConfig(cfg *Config, updatedCfg *Config) {
 		cfg.Log.Delete = updatedCfg.Log.Delete
 		log.WithField("enabled", cfg.Log.Delete).Info("Set logging for delete operations")
 	}
-}
-
-func (cfg *Config) ensureUserDirs() {
-	if _, err := os.Stat(cfg.Dir); os.IsNotExist(err) {
-		mkdirErr := os.Mkdir(cfg.Dir, os.ModePerm)
-		if mkdirErr != nil {
-			log.WithField("path", cfg.Dir).WithField("error", err).Warn("Can't create base dir")
-			return
-		}
-		log.WithField("path", cfg.Dir).Info("Created base dir")
-	}
-
-	for _, user := range cfg.Users {
-		if user.Subdir != nil {
-			path := filepath.Join(cfg.Dir, *user.Subdir)
-			if _, err := os.Stat(path); os.IsNotExist(err) {
-				os.Mkdir(path, os.ModePerm)
-				log.WithField("path", path).Info("Created user dir")
-			}
-		}
+	if cfg.Log.Trace != updatedCfg.Log.Trace {
+		cfg.Log.Trace = updatedCfg.Log.Trace
+		log.WithField("enabled", cfg.Log.Trace).Info("Set tracing of requests")
 	}
 }
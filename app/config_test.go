@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
@@ -48,7 +49,7 @@ prefix: /oh-de-lally
 tls:
   keyFile: ` + tmpDir + `/robin.pem
   certFile: ` + tmpDir + `/tuck.pem
-dir: /sherwood/forest
+dir: ` + tmpDir + `/sherwood/forest
 realm: uk
 users:
   lj:
@@ -72,6 +73,8 @@ log:
 	}
 	var cfg = &Config{}
 	viper.Unmarshal(&cfg)
+	// the missing dirs are created by default
+	cfg.CreateDirs = true
 
 	// let viper read from the tmp directory fist
 	viper.AddConfigPath(tmpDir)
@@ -104,6 +107,7 @@ func TestSetDefaults(t *testing.T) {
 		{"Port", "8000"},
 		{"Prefix", ""},
 		{"Dir", "/tmp"},
+		{"CreateDirs", true},
 		{"TLS", nil},
 		{"Realm", "dave"},
 		{"Log.Error", true},
@@ -124,3 +128,149 @@ func TestSetDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfigStrict(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name          string
+		content       string
+		wantErr       bool
+		wantStrictErr bool
+	}{
+		{"valid", "dir: /tmp\nusers:\n  foo:\n    password: x\n", false, false},
+		{"unknown key", "dir: /tmp\nlogg:\n  read: true\n", false, true},
+		{"unknown user key", "users:\n  foo:\n    password: x\n    wirte: false\n", false, true},
+		{"strict in config", "strict: true\nusers:\n  foo:\n    wirte: false\n", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, "config.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("ReadConfig() pre condition failed. error = %v", err)
+			}
+
+			if _, _, err := ReadConfig(path); (err != nil) != tt.wantErr {
+				t.Errorf("ReadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, _, err := ReadConfigStrict(path); (err != nil) != tt.wantStrictErr {
+				t.Errorf("ReadConfigStrict() error = %v, wantErr %v", err, tt.wantStrictErr)
+			}
+		})
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	write := false
+	subdir, sameSubdir := "alice", "alice"
+	cfg := &Config{Dir: tmpDir, Users: map[string]*UserInfo{
+		"alice": {Password: "a", Subdir: &subdir, Quota: 100},
+		"bob":   {Password: "b"},
+	}}
+	alice := cfg.User("alice")
+	updateConfig(cfg, &Config{
+		Dir: tmpDir,
+		Users: map[string]*UserInfo{
+			"alice": {Password: "changed", Subdir: &sameSubdir, Quota: 200, SoftQuota: 150, FileLimit: 10, Permissions: Permissions{Write: &write}},
+			"carol": {Password: "c"},
+		},
+		Log: Logging{Read: true},
+	})
+
+	if alice.Password != "a" || alice.Write != nil {
+		t.Errorf("previous user = %+v, want it unchanged for the requests in progress", alice)
+	}
+	if user := cfg.User("alice"); user == nil || user.Password != "changed" || user.Write == nil || *user.Write {
+		t.Errorf("User(alice) = %+v, want the updated user", user)
+	}
+	if user := cfg.User("alice"); user == nil || user.Subdir != &subdir || user.Quota != 200 || user.SoftQuota != 150 || user.FileLimit != 10 {
+		t.Errorf("User(alice) = %+v, want the updated quota and the subdir kept", user)
+	}
+	if cfg.User("bob") != nil || cfg.User("carol") == nil {
+		t.Errorf("users = %v, want bob removed and carol added", cfg.UserNames())
+	}
+	if !cfg.Logging().Read {
+		t.Error("Log.Read = false, want the updated logging")
+	}
+}
+
+func TestUpdateConfigConcurrently(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{Dir: tmpDir, Users: map[string]*UserInfo{"alice": {Password: "a"}}}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			updateConfig(cfg, &Config{
+				Dir:         tmpDir,
+				Users:       map[string]*UserInfo{"alice": {Password: "a"}},
+				WriteLimit:  &WriteLimit{Requests: i + 1},
+				UploadLimit: &UploadLimit{},
+				Networks:    &Networks{},
+				DryRun:      i%2 == 0,
+				Log:         Logging{Read: i%2 == 0, Trace: i%2 == 1},
+			})
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if l := cfg.writeLimit("alice"); l == nil || l.Requests != 100 {
+				t.Errorf("writeLimit() = %+v, want the last update", l)
+			}
+			return
+		default:
+			cfg.writeLimit("alice")
+			cfg.uploadLimit("alice")
+			cfg.networks()
+			cfg.dryRun()
+			cfg.Logging()
+		}
+	}
+}
+
+func TestHandleConfigUpdate(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "config.yaml")
+	cfg := &Config{Dir: tmpDir, Users: map[string]*UserInfo{"alice": {Password: "a"}}}
+	tests := []struct {
+		name      string
+		content   string
+		wantUsers []string
+	}{
+		{"invalid yaml", "dir: " + tmpDir + "\nusers:\n  bob:\n   password: [b\n", []string{"alice"}},
+		{"empty", "", []string{"alice"}},
+		{"invalid value", "dir: " + tmpDir + "\nport: [1]\nusers:\n  bob:\n    password: b\n", []string{"alice"}},
+		{"valid", "dir: " + tmpDir + "\nusers:\n  bob:\n    password: b\n", []string{"bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg.handleConfigUpdate(fsnotify.Event{Name: path, Op: fsnotify.Write})
+			if got := cfg.UserNames(); !reflect.DeepEqual(got, tt.wantUsers) {
+				t.Errorf("users = %v, want %v", got, tt.wantUsers)
+			}
+			if !cfg.AuthenticationNeeded() {
+				t.Error("AuthenticationNeeded() = false, want true")
+			}
+		})
+	}
+	cfg.handleConfigUpdate(fsnotify.Event{Name: filepath.Join(tmpDir, "missing.yaml"), Op: fsnotify.Write})
+	if got := cfg.UserNames(); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Errorf("users after a missing file = %v, want [bob]", got)
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultConfigBackups is the number of backups of the configuration file kept by default.
+const defaultConfigBackups = 10
+
+// configBackupTime is the format of the times in the names of the backups, which sort like
+// the times.
+const configBackupTime = "20060102T150405.000Z"
+
+// ConfigBackups keeps timestamped copies of the configuration file, whenever it's loaded or
+// written by the admin API, so a bad change can be rolled back. The last Keep copies are
+// kept, 10 by default.
+type ConfigBackups struct {
+	Keep int
+}
+
+// ConfigBackup is a backup of the configuration file.
+type ConfigBackup struct {
+	Name string
+	Path string
+	Time time.Time
+}
+
+// configBackupDir returns the directory of the backups of the configuration file, which is
+// next to it, so it's found even if the configuration can't be parsed.
+func configBackupDir(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".backups")
+}
+
+// keep returns the number of backups to keep.
+func (b *ConfigBackups) keep() int {
+	if b == nil || b.Keep <= 0 {
+		return defaultConfigBackups
+	}
+	return b.Keep
+}
+
+// backupConfig keeps a copy of the configuration file at path, which is loaded or about to
+// be replaced.
+func (cfg *Config) backupConfig(path string) {
+	if path == "" {
+		return
+	}
+	if err := BackupConfig(path, cfg.ConfigBackups.keep()); err != nil {
+		log.WithField("path", path).WithError(err).Warn("Error backing up configuration")
+	}
+}
+
+// BackupConfig copies the configuration file at path to its backups, unless it's the same as
+// the latest backup, and removes the backups beyond keep. A keep of zero removes none.
+func BackupConfig(path string, keep int) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	backups, err := ListConfigBackups(path)
+	if err != nil {
+		return err
+	}
+	if n := len(backups); n > 0 {
+		if latest, err := ioutil.ReadFile(backups[n-1].Path); err == nil && bytes.Equal(latest, content) {
+			return nil
+		}
+	}
+
+	dir := configBackupDir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format(configBackupTime) + filepath.Ext(path)
+	if err := writeFileAtomic(filepath.Join(dir, name), content); err != nil {
+		return err
+	}
+	backups = append(backups, ConfigBackup{Name: name, Path: filepath.Join(dir, name)})
+	for keep > 0 && len(backups) > keep {
+		os.Remove(backups[0].Path)
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// ListConfigBackups returns the backups of the configuration file at path, the oldest first.
+func ListConfigBackups(path string) ([]ConfigBackup, error) {
+	dir := configBackupDir(path)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var backups []ConfigBackup
+	for _, e := range entries {
+		t, err := time.Parse(configBackupTime, strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())))
+		if err != nil || e.IsDir() {
+			continue
+		}
+		backups = append(backups, ConfigBackup{Name: e.Name(), Path: filepath.Join(dir, e.Name()), Time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	return backups, nil
+}
+
+// RollbackConfig replaces the configuration file at path by the backup of the name or, if the
+// name is empty, by the latest backup differing from the file. The replaced file is backed up
+// as well, so the rollback can be reverted. It returns the restored backup.
+func RollbackConfig(path, name string) (*ConfigBackup, error) {
+	backups, err := ListConfigBackups(path)
+	if err != nil {
+		return nil, err
+	}
+	current, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var backup *ConfigBackup
+	var content []byte
+	for i := len(backups) - 1; i >= 0 && backup == nil; i-- {
+		if name != "" && backups[i].Name != name {
+			continue
+		}
+		c, err := ioutil.ReadFile(backups[i].Path)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" || !bytes.Equal(c, current) {
+			backup, content = &backups[i], c
+		}
+	}
+	switch {
+	case backup == nil && name != "":
+		return nil, fmt.Errorf("backup %s not found", name)
+	case backup == nil:
+		return nil, errors.New("no backup differs from the configuration")
+	}
+
+	if current != nil {
+		if err := BackupConfig(path, 0); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeFileAtomic(path, content); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConfigBackups(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "config.yaml")
+
+	for _, content := range []string{"port: 1\n", "port: 1\n", "port: 2\n", "port: 3\n", "port: 4\n"} {
+		ioutil.WriteFile(path, []byte(content), 0600)
+		if err := BackupConfig(path, 3); err != nil {
+			t.Fatalf("BackupConfig() error = %v", err)
+		}
+		// the names of the backups are the times in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+	backups, err := ListConfigBackups(path)
+	if err != nil || len(backups) != 3 {
+		t.Fatalf("ListConfigBackups() = %v, %v, want the last 3", backups, err)
+	}
+	if content, _ := ioutil.ReadFile(backups[0].Path); string(content) != "port: 2\n" {
+		t.Errorf("oldest backup = %q, want port 2", content)
+	}
+
+	// the latest backup is the current configuration
+	restored, err := RollbackConfig(path, "")
+	if content, _ := ioutil.ReadFile(path); err != nil || restored.Name != backups[1].Name || string(content) != "port: 3\n" {
+		t.Errorf("RollbackConfig() = %v, %v with content %q, want port 3", restored, err, content)
+	}
+	if _, err := RollbackConfig(path, backups[0].Name); err != nil {
+		t.Errorf("RollbackConfig() of %s error = %v", backups[0].Name, err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "port: 2\n" {
+		t.Errorf("configuration after the rollback to %s = %q, want port 2", backups[0].Name, content)
+	}
+	if _, err := RollbackConfig(path, "20000101T000000.000Z.yaml"); err == nil {
+		t.Errorf("RollbackConfig() of a missing backup succeeded")
+	}
+
+	// the replaced configuration of port 3 has been backed up by the rollback
+	backups, _ = ListConfigBackups(path)
+	if content, _ := ioutil.ReadFile(backups[len(backups)-1].Path); len(backups) != 4 || string(content) != "port: 3\n" {
+		t.Errorf("backups after the rollbacks = %v, latest %q", backups, content)
+	}
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connShutdownPoll is the interval Shutdown checks whether the connections completed
+const connShutdownPoll = 100 * time.Millisecond
+
+// connServer tracks the listener and the connections of a server, which serves them itself,
+// so it's shut down by the upgrades and at the end like an http.Server. Connections waiting
+// for the next request are idle and closed right away, busy ones once they're idle.
+type connServer struct {
+	mu       sync.Mutex
+	listener net.Listener
+	// conns are the open connections, true while they're idle
+	conns   map[net.Conn]bool
+	closing bool
+}
+
+// serve accepts the connections of the listener and handles each of them. It returns
+// http.ErrServerClosed after Shutdown or Close, like an http.Server.
+func (s *connServer) serve(ln net.Listener, handle func(net.Conn)) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		ln.Close()
+		return http.ErrServerClosed
+	}
+	s.listener = ln
+	if s.conns == nil {
+		s.conns = map[net.Conn]bool{}
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			if err == nil {
+				conn.Close()
+			}
+			return http.ErrServerClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.conns[conn] = false
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+			}()
+			handle(conn)
+		}()
+	}
+}
+
+// idle marks the connection as idle or busy. It closes an idle connection and returns false,
+// once the server is shut down.
+func (s *connServer) idle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if idle && s.closing {
+		conn.Close()
+		return false
+	}
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = idle
+	}
+	return true
+}
+
+// Shutdown stops accepting connections, closes the idle ones and waits until the busy ones
+// completed or the context is done.
+func (s *connServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(connShutdownPoll)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		open := len(s.conns)
+		s.mu.Unlock()
+		if open == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops accepting connections and closes all of them right away.
+func (s *connServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closing = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,835 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	daveplugin "github.com/micromata/dave/plugin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotsDir is the directory, the snapshots are presented in.
+const snapshotsDir = "/.snapshots"
+
+var (
+	validSnapshotName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+	errSnapshotExists   = errors.New("snapshot already exists")
+	errNoSuchSnapshot   = errors.New("snapshot doesn't exist")
+	errSnapshotName     = errors.New("snapshot names consist of letters, digits, '.', '_' and '-'")
+	errContentDirectory = errors.New("is a directory")
+)
+
+// ContentStore stores the contents of the files by their SHA-256 in the objects directory of
+// Dir, the base directory by default, and the tree of the files in an index, which maps their
+// paths to the hashes. Files with the same content are stored once, regardless of their users.
+// Snapshots copy the index only and are presented read-only in the .snapshots directory.
+type ContentStore struct {
+	Dir string
+}
+
+// contentNode is a file or a directory of the index.
+type contentNode struct {
+	Dir      bool                    `json:"dir,omitempty"`
+	Hash     string                  `json:"hash,omitempty"`
+	Size     int64                   `json:"size,omitempty"`
+	ModTime  time.Time               `json:"modTime"`
+	Children map[string]*contentNode `json:"children,omitempty"`
+}
+
+// contentSnapshot is a copy of the index at the time it's been created.
+type contentSnapshot struct {
+	Name    string       `json:"name"`
+	Created time.Time    `json:"created"`
+	Root    *contentNode `json:"root"`
+}
+
+// SnapshotInfo describes a snapshot for the admin API.
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Files   int64     `json:"files"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// contentObject is a stored content with the number of files referencing it.
+type contentObject struct {
+	size int64
+	refs int
+}
+
+// ContentFS is the file system of the content store.
+type ContentFS struct {
+	virtualFS
+	dir string
+
+	mu        sync.RWMutex
+	root      *contentNode
+	snapshots map[string]*contentSnapshot
+	objects   map[string]*contentObject
+}
+
+// NewContentFS opens the content store of the configuration. Objects, which aren't referenced
+// due to an interruption, are removed. It returns nil, if no content store is configured.
+func NewContentFS(cfg *Config) (*ContentFS, error) {
+	if cfg.ContentStore == nil {
+		return nil, nil
+	}
+	dir := cfg.ContentStore.Dir
+	if dir == "" {
+		dir = cfg.Dir
+	}
+	for _, sub := range []string{"objects", "snapshots", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := &ContentFS{
+		virtualFS: virtualFS{cfg: cfg},
+		dir:       dir,
+		root:      &contentNode{Dir: true, ModTime: time.Now()},
+		snapshots: map[string]*contentSnapshot{},
+		objects:   map[string]*contentObject{},
+	}
+	if err := readJSONFile(filepath.Join(dir, "index.json"), &fs.root); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		s := &contentSnapshot{}
+		if err := readJSONFile(filepath.Join(dir, "snapshots", e.Name()), s); err != nil {
+			return nil, err
+		}
+		fs.snapshots[s.Name] = s
+		fs.reference(s.Root, 1)
+	}
+	fs.reference(fs.root, 1)
+	fs.removeOrphans()
+	return fs, nil
+}
+
+// readJSONFile decodes the file into v, a missing file leaves v as it is.
+func readJSONFile(name string, v interface{}) error {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid file %s of the content store: %s", name, err)
+	}
+	return nil
+}
+
+// removeOrphans removes the uploads in progress and the objects without references, which are
+// left by an interruption before the index has been written.
+func (fs *ContentFS) removeOrphans() {
+	os.RemoveAll(filepath.Join(fs.dir, "tmp"))
+	os.MkdirAll(filepath.Join(fs.dir, "tmp"), 0700)
+	filepath.Walk(filepath.Join(fs.dir, "objects"), func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && fs.objects[fi.Name()] == nil {
+			log.WithField("object", fi.Name()).Info("Removing unreferenced object of the content store")
+			os.Remove(p)
+		}
+		return nil
+	})
+}
+
+// objectPath returns the path of the object of a hash.
+func (fs *ContentFS) objectPath(hash string) string {
+	return filepath.Join(fs.dir, "objects", hash[:2], hash)
+}
+
+// reference adds delta to the references of the objects of the files below the node. Objects
+// without references are removed.
+func (fs *ContentFS) reference(n *contentNode, delta int) {
+	if n == nil {
+		return
+	}
+	if n.Dir {
+		for _, child := range n.Children {
+			fs.reference(child, delta)
+		}
+		return
+	}
+
+	o := fs.objects[n.Hash]
+	if o == nil {
+		o = &contentObject{size: n.Size}
+		fs.objects[n.Hash] = o
+	}
+	o.refs += delta
+	if o.refs <= 0 {
+		delete(fs.objects, n.Hash)
+		if err := os.Remove(fs.objectPath(n.Hash)); err != nil && !os.IsNotExist(err) {
+			log.WithField("object", n.Hash).WithError(err).Warn("Error removing object of the content store")
+		}
+	}
+}
+
+// saveIndex writes the index. fs.mu must be held.
+func (fs *ContentFS) saveIndex() error {
+	data, err := json.Marshal(fs.root)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(fs.dir, "index.json"), data)
+}
+
+// locate returns the snapshot and the path within it of a name of the user, the snapshot is
+// empty for the current tree. Names within the subdir of the user are located within the same
+// subdir of the snapshots.
+func (fs *ContentFS) locate(ctx context.Context, name string) (string, string) {
+	name = path.Clean("/" + name)
+	if name != snapshotsDir && !strings.HasPrefix(name, snapshotsDir+"/") {
+		p := fs.resolve(ctx, name)
+		fs.ensureSubdir(fs.resolve(ctx, "/"))
+		return "", p
+	}
+
+	rest := strings.TrimPrefix(name, snapshotsDir+"/")
+	if name == snapshotsDir {
+		return snapshotsDir, ""
+	}
+	snapshot := rest
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		snapshot, rest = rest[:i], rest[i:]
+	} else {
+		rest = "/"
+	}
+	return snapshot, fs.resolve(ctx, rest)
+}
+
+// ensureSubdir creates the subdir of a user in the index, if it's missing.
+func (fs *ContentFS) ensureSubdir(p string) {
+	fs.mu.RLock()
+	exists := lookupContent(fs.root, p) != nil
+	fs.mu.RUnlock()
+	if exists {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	n := fs.root
+	for _, elem := range splitContentPath(p) {
+		child := n.Children[elem]
+		if child == nil {
+			child = &contentNode{Dir: true, ModTime: time.Now()}
+			if n.Children == nil {
+				n.Children = map[string]*contentNode{}
+			}
+			n.Children[elem] = child
+		}
+		if !child.Dir {
+			return
+		}
+		n = child
+	}
+	if err := fs.saveIndex(); err != nil {
+		log.WithError(err).Error("Error saving the index of the content store")
+	}
+}
+
+func splitContentPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// lookupContent returns the node of the path below root, or nil.
+func lookupContent(root *contentNode, p string) *contentNode {
+	n := root
+	for _, elem := range splitContentPath(p) {
+		if n == nil || !n.Dir {
+			return nil
+		}
+		n = n.Children[elem]
+	}
+	return n
+}
+
+// parentContent returns the directory of the path below root and the name within it. The
+// directory is nil, if it doesn't exist.
+func parentContent(root *contentNode, p string) (*contentNode, string) {
+	dir, base := path.Split(path.Clean("/" + p))
+	parent := lookupContent(root, dir)
+	if parent == nil || !parent.Dir {
+		return nil, base
+	}
+	return parent, base
+}
+
+// tree returns the root of the snapshot or the current tree. fs.mu must be held.
+func (fs *ContentFS) tree(snapshot string) *contentNode {
+	if snapshot == "" {
+		return fs.root
+	}
+	if s := fs.snapshots[snapshot]; s != nil {
+		return s.Root
+	}
+	return nil
+}
+
+func (fs *ContentFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	snapshot, p := fs.locate(ctx, name)
+	if snapshot != "" {
+		return os.ErrPermission
+	}
+	if err := fs.check(ctx, daveplugin.OpMkdir, true, p, ""); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	parent, base := parentContent(fs.root, p)
+	switch {
+	case parent == nil:
+		fs.mu.Unlock()
+		return os.ErrNotExist
+	case base == "" || parent.Children[base] != nil:
+		fs.mu.Unlock()
+		return os.ErrExist
+	}
+	now := time.Now()
+	if parent.Children == nil {
+		parent.Children = map[string]*contentNode{}
+	}
+	parent.Children[base] = &contentNode{Dir: true, ModTime: now}
+	parent.ModTime = now
+	err := fs.saveIndex()
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	fs.event(ctx, daveplugin.EventMkdir, p, "")
+	return nil
+}
+
+func (fs *ContentFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = path.Clean("/" + name)
+	snapshot, p := fs.locate(ctx, name)
+	write := flag&writeFlags != 0
+	if write && snapshot != "" {
+		return nil, os.ErrPermission
+	}
+	op := daveplugin.OpRead
+	if write {
+		op = daveplugin.OpWrite
+	}
+	if err := fs.check(ctx, op, write, p, ""); err != nil {
+		return nil, err
+	}
+
+	if snapshot == snapshotsDir {
+		return &contentDir{info: fs.snapshotsInfo(), children: fs.snapshotInfos()}, nil
+	}
+	fs.mu.RLock()
+	n := lookupContent(fs.tree(snapshot), p)
+	if n != nil && n.Dir {
+		info := contentInfo(path.Base(name), n)
+		children := contentChildren(n)
+		fs.mu.RUnlock()
+		if write {
+			return nil, errContentDirectory
+		}
+		if name == "/" && len(fs.snapshotNames()) > 0 {
+			children = append(children, fs.snapshotsInfo())
+		}
+		return &contentDir{info: info, children: children}, nil
+	}
+	var existing *contentNode
+	if n != nil {
+		copied := *n
+		existing = &copied
+	}
+	parent, _ := parentContent(fs.tree(snapshot), p)
+	fs.mu.RUnlock()
+
+	if !write {
+		if existing == nil {
+			return nil, os.ErrNotExist
+		}
+		f, err := os.Open(fs.objectPath(existing.Hash))
+		if err != nil {
+			return nil, err
+		}
+		return &contentReader{File: f, info: contentInfo(path.Base(name), existing)}, nil
+	}
+
+	switch {
+	case parent == nil || (existing == nil && flag&os.O_CREATE == 0):
+		return nil, os.ErrNotExist
+	case existing != nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(fs.dir, "tmp"), "upload-")
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && flag&os.O_TRUNC == 0 {
+		err = copyObject(tmp, fs.objectPath(existing.Hash))
+		if err == nil && flag&os.O_APPEND == 0 {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return &contentWriter{File: tmp, fs: fs, ctx: ctx, name: p, base: path.Base(name)}, nil
+}
+
+// copyObject copies the content of an object to the file.
+func copyObject(f *os.File, object string) error {
+	src, err := os.Open(object)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(f, src)
+	return err
+}
+
+// commit stores the content of the uploaded file as an object, unless there already is one
+// with the same content, and references it from the path.
+func (fs *ContentFS) commit(p, tmp string) error {
+	hash, err := hashFile(localStorage{}, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.objects[hash] == nil {
+		object := fs.objectPath(hash)
+		if err := os.MkdirAll(filepath.Dir(object), 0700); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, object); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	} else {
+		os.Remove(tmp)
+	}
+
+	parent, base := parentContent(fs.root, p)
+	if parent == nil || base == "" || (parent.Children[base] != nil && parent.Children[base].Dir) {
+		// the parent has been removed meanwhile, the object is removed unless other files
+		// reference it
+		fs.reference(&contentNode{Hash: hash, Size: fi.Size()}, 0)
+		return os.ErrNotExist
+	}
+	now := time.Now()
+	n := &contentNode{Hash: hash, Size: fi.Size(), ModTime: now}
+	fs.reference(n, 1)
+	if old := parent.Children[base]; old != nil {
+		fs.reference(old, -1)
+	}
+	if parent.Children == nil {
+		parent.Children = map[string]*contentNode{}
+	}
+	parent.Children[base] = n
+	parent.ModTime = now
+	return fs.saveIndex()
+}
+
+func (fs *ContentFS) RemoveAll(ctx context.Context, name string) error {
+	snapshot, p := fs.locate(ctx, name)
+	if snapshot != "" {
+		return os.ErrPermission
+	}
+	if path.Clean("/"+name) == "/" {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	if err := fs.check(ctx, daveplugin.OpDelete, true, p, ""); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	parent, base := parentContent(fs.root, p)
+	if parent == nil || parent.Children[base] == nil {
+		fs.mu.Unlock()
+		return nil
+	}
+	fs.reference(parent.Children[base], -1)
+	delete(parent.Children, base)
+	parent.ModTime = time.Now()
+	err := fs.saveIndex()
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	fs.event(ctx, daveplugin.EventDelete, p, "")
+	return nil
+}
+
+func (fs *ContentFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldSnapshot, oldPath := fs.locate(ctx, oldName)
+	newSnapshot, newPath := fs.locate(ctx, newName)
+	if oldSnapshot != "" || newSnapshot != "" {
+		return os.ErrPermission
+	}
+	if path.Clean("/"+oldName) == "/" || path.Clean("/"+newName) == "/" ||
+		newPath == oldPath || strings.HasPrefix(newPath, oldPath+"/") {
+		// Prohibit renaming from or to the virtual root directory.
+		return os.ErrInvalid
+	}
+	if err := fs.check(ctx, daveplugin.OpRename, true, oldPath, newPath); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	oldParent, oldBase := parentContent(fs.root, oldPath)
+	newParent, newBase := parentContent(fs.root, newPath)
+	switch {
+	case oldParent == nil || oldParent.Children[oldBase] == nil || newParent == nil:
+		fs.mu.Unlock()
+		return os.ErrNotExist
+	case newParent.Children[newBase] != nil && newParent.Children[newBase].Dir:
+		fs.mu.Unlock()
+		return os.ErrExist
+	}
+	if old := newParent.Children[newBase]; old != nil {
+		fs.reference(old, -1)
+	}
+	now := time.Now()
+	if newParent.Children == nil {
+		newParent.Children = map[string]*contentNode{}
+	}
+	newParent.Children[newBase] = oldParent.Children[oldBase]
+	delete(oldParent.Children, oldBase)
+	oldParent.ModTime, newParent.ModTime = now, now
+	err := fs.saveIndex()
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	fs.event(ctx, daveplugin.EventRename, oldPath, newPath)
+	return nil
+}
+
+func (fs *ContentFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	snapshot, p := fs.locate(ctx, name)
+	if snapshot == snapshotsDir {
+		return fs.snapshotsInfo(), nil
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	n := lookupContent(fs.tree(snapshot), p)
+	if n == nil {
+		return nil, os.ErrNotExist
+	}
+	return contentInfo(path.Base(path.Clean("/"+name)), n), nil
+}
+
+// CreateSnapshot copies the index to a snapshot with the name.
+func (fs *ContentFS) CreateSnapshot(name string) (*SnapshotInfo, error) {
+	if !validSnapshotName.MatchString(name) {
+		return nil, errSnapshotName
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.snapshots[name] != nil {
+		return nil, errSnapshotExists
+	}
+	s := &contentSnapshot{Name: name, Created: time.Now(), Root: cloneContent(fs.root)}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(fs.dir, "snapshots", name+".json"), data); err != nil {
+		return nil, err
+	}
+	fs.snapshots[name] = s
+	fs.reference(s.Root, 1)
+	info := s.info()
+	return &info, nil
+}
+
+// RemoveSnapshot removes the snapshot with the name and the objects only it references.
+func (fs *ContentFS) RemoveSnapshot(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	s := fs.snapshots[name]
+	if s == nil {
+		return errNoSuchSnapshot
+	}
+	if err := os.Remove(filepath.Join(fs.dir, "snapshots", name+".json")); err != nil {
+		return err
+	}
+	delete(fs.snapshots, name)
+	fs.reference(s.Root, -1)
+	return nil
+}
+
+// Snapshots returns the snapshots ordered by their creation.
+func (fs *ContentFS) Snapshots() []SnapshotInfo {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	infos := []SnapshotInfo{}
+	for _, s := range fs.snapshots {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Created.Before(infos[j].Created) })
+	return infos
+}
+
+func (s *contentSnapshot) info() SnapshotInfo {
+	files, bytes := contentUsage(s.Root)
+	return SnapshotInfo{Name: s.Name, Created: s.Created, Files: files, Bytes: bytes}
+}
+
+func (fs *ContentFS) snapshotNames() []string {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	names := make([]string, 0, len(fs.snapshots))
+	for name := range fs.snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// snapshotsInfo returns the info of the directory of the snapshots, which is modified, when
+// the last snapshot has been created.
+func (fs *ContentFS) snapshotsInfo() os.FileInfo {
+	n := &contentNode{Dir: true}
+	for _, s := range fs.Snapshots() {
+		n.ModTime = s.Created
+	}
+	return contentInfo(path.Base(snapshotsDir), n)
+}
+
+// snapshotInfos returns the infos of the snapshots as directories.
+func (fs *ContentFS) snapshotInfos() []os.FileInfo {
+	infos := []os.FileInfo{}
+	for _, s := range fs.Snapshots() {
+		infos = append(infos, contentInfo(s.Name, &contentNode{Dir: true, ModTime: s.Created}))
+	}
+	return infos
+}
+
+func cloneContent(n *contentNode) *contentNode {
+	c := *n
+	if n.Children != nil {
+		c.Children = make(map[string]*contentNode, len(n.Children))
+		for name, child := range n.Children {
+			c.Children[name] = cloneContent(child)
+		}
+	}
+	return &c
+}
+
+// contentUsage returns the number of files and their bytes below the node.
+func contentUsage(n *contentNode) (files int64, bytes int64) {
+	if !n.Dir {
+		return 1, n.Size
+	}
+	for _, child := range n.Children {
+		f, b := contentUsage(child)
+		files += f
+		bytes += b
+	}
+	return files, bytes
+}
+
+// contentChildren returns the infos of the children of a directory ordered by name.
+func contentChildren(n *contentNode) []os.FileInfo {
+	children := make([]os.FileInfo, 0, len(n.Children))
+	for name, child := range n.Children {
+		children = append(children, contentInfo(name, child))
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	return children
+}
+
+// RegisterMetrics exposes the stored objects and the bytes of the files referencing them.
+func (fs *ContentFS) RegisterMetrics(m *Metrics) {
+	if fs == nil {
+		return
+	}
+
+	m.Gauge("dave_content_objects", "Contents stored by the content store.", func() []Sample {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		return []Sample{{Value: float64(len(fs.objects))}}
+	})
+	m.Gauge("dave_content_stored_bytes", "Bytes of the contents stored by the content store.", func() []Sample {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		var bytes int64
+		for _, o := range fs.objects {
+			bytes += o.size
+		}
+		return []Sample{{Value: float64(bytes)}}
+	})
+	m.Gauge("dave_content_file_bytes", "Bytes of the files of the current tree of the content store.", func() []Sample {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		_, bytes := contentUsage(fs.root)
+		return []Sample{{Value: float64(bytes)}}
+	})
+}
+
+// contentFileInfo is the os.FileInfo of a node. The ETag of a file is the hash of its content.
+type contentFileInfo struct {
+	name string
+	node contentNode
+}
+
+func contentInfo(name string, n *contentNode) contentFileInfo {
+	info := contentFileInfo{name: name, node: *n}
+	info.node.Children = nil
+	return info
+}
+
+func (fi contentFileInfo) Name() string       { return fi.name }
+func (fi contentFileInfo) Size() int64        { return fi.node.Size }
+func (fi contentFileInfo) ModTime() time.Time { return fi.node.ModTime }
+func (fi contentFileInfo) IsDir() bool        { return fi.node.Dir }
+func (fi contentFileInfo) Sys() interface{}   { return nil }
+
+func (fi contentFileInfo) Mode() os.FileMode {
+	if fi.node.Dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag implements webdav.ETager.
+func (fi contentFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.node.Dir {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.node.Hash + `"`, nil
+}
+
+// contentReader reads the object of a file.
+type contentReader struct {
+	*os.File
+	info os.FileInfo
+}
+
+func (f *contentReader) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *contentReader) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *contentReader) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// contentWriter writes a file to a temporary file, which is stored as an object when it's
+// closed.
+type contentWriter struct {
+	*os.File
+	fs   *ContentFS
+	ctx  context.Context
+	name string
+	base string
+}
+
+func (f *contentWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("not a directory")
+}
+
+func (f *contentWriter) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return contentInfo(f.base, &contentNode{Size: fi.Size(), ModTime: fi.ModTime()}), nil
+}
+
+func (f *contentWriter) Close() error {
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	if err := f.fs.commit(f.name, f.File.Name()); err != nil {
+		return err
+	}
+	f.fs.event(f.ctx, daveplugin.EventWrite, f.name, "")
+	return nil
+}
+
+// contentDir lists the children of a directory.
+type contentDir struct {
+	info     os.FileInfo
+	children []os.FileInfo
+	pos      int
+}
+
+func (d *contentDir) Read(p []byte) (int, error) {
+	return 0, errContentDirectory
+}
+
+func (d *contentDir) Write(p []byte) (int, error) {
+	return 0, errContentDirectory
+}
+
+func (d *contentDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, errContentDirectory
+}
+
+func (d *contentDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.children[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.children)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.pos += count
+	return rest[:count], nil
+}
+
+func (d *contentDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *contentDir) Close() error {
+	return nil
+}
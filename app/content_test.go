@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestContentFS(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	alice, bob := "/alice", "/bob"
+	cfg := &Config{
+		Dir:          tmpDir,
+		ContentStore: &ContentStore{},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &alice},
+			"bob":   {Password: GenHash([]byte("password")), Subdir: &bob},
+		},
+	}
+	fs, err := NewContentFS(cfg)
+	if err != nil {
+		t.Fatalf("NewContentFS() error = %v", err)
+	}
+	a := &App{Config: cfg, Handler: &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}, Content: fs}
+	do := func(user, method, p, body string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, p, strings.NewReader(body))
+		req.SetBasicAuth(user, "password")
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+	objects := func() int {
+		n := 0
+		filepath.Walk(filepath.Join(tmpDir, "objects"), func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+
+	steps := []struct {
+		name       string
+		user       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		statusCode int
+		contains   string
+	}{
+		{"upload", "alice", "PUT", "/a.txt", "same content", nil, 201, ""},
+		{"upload of another user", "bob", "PUT", "/b.txt", "same content", nil, 201, ""},
+		{"new directory", "alice", "MKCOL", "/docs", "", nil, 201, ""},
+		{"upload into the directory", "alice", "PUT", "/docs/c.txt", "other content", nil, 201, ""},
+		{"download", "bob", "GET", "/b.txt", "", nil, 200, "same content"},
+		{"other user", "bob", "GET", "/a.txt", "", nil, 404, ""},
+		{"listing", "alice", "PROPFIND", "/", "", []string{"Depth", "1"}, 207, "/docs/"},
+		{"copy", "alice", "COPY", "/a.txt", "", []string{"Destination", "/docs/d.txt"}, 201, ""},
+		{"move", "alice", "MOVE", "/docs/c.txt", "", []string{"Destination", "/e.txt"}, 201, ""},
+		{"moved file", "alice", "GET", "/e.txt", "", nil, 200, "other content"},
+		{"missing parent", "alice", "PUT", "/missing/f.txt", "x", nil, 409, ""},
+	}
+	for _, tt := range steps {
+		if w := do(tt.user, tt.method, tt.path, tt.body, tt.headers...); w.Code != tt.statusCode || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Fatalf("%s: status = %v, want %v, body = %s", tt.name, w.Code, tt.statusCode, w.Body)
+		}
+	}
+	if n := objects(); n != 2 {
+		t.Errorf("objects of three files with two contents = %v, want 2", n)
+	}
+	sum := sha256.Sum256([]byte("same content"))
+	if w := do("alice", "GET", "/a.txt", ""); w.Header().Get("ETag") != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("ETag = %q, want the hash of the content", w.Header().Get("ETag"))
+	}
+
+	// the snapshot keeps the content of the overwritten file
+	if _, err := fs.CreateSnapshot("before"); err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+	if _, err := fs.CreateSnapshot("before"); err != errSnapshotExists {
+		t.Errorf("second CreateSnapshot() error = %v, want %v", err, errSnapshotExists)
+	}
+	if _, err := fs.CreateSnapshot("../x"); err != errSnapshotName {
+		t.Errorf("CreateSnapshot() of an invalid name error = %v, want %v", err, errSnapshotName)
+	}
+	do("alice", "PUT", "/e.txt", "changed content")
+	do("alice", "DELETE", "/docs", "")
+	if w := do("alice", "GET", "/.snapshots/before/e.txt", ""); w.Code != 200 || w.Body.String() != "other content" {
+		t.Errorf("file of the snapshot: status = %v, body = %q", w.Code, w.Body)
+	}
+	if w := do("alice", "GET", "/.snapshots/before/docs/d.txt", ""); w.Code != 200 || w.Body.String() != "same content" {
+		t.Errorf("removed file of the snapshot: status = %v, body = %q", w.Code, w.Body)
+	}
+	if w := do("alice", "PROPFIND", "/.snapshots/", "", "Depth", "1"); w.Code != 207 || !strings.Contains(w.Body.String(), "/.snapshots/before/") {
+		t.Errorf("listing of the snapshots: status = %v, body = %s", w.Code, w.Body)
+	}
+	if w := do("alice", "PUT", "/.snapshots/before/e.txt", "x"); w.Code < 400 {
+		t.Errorf("upload into the snapshot status = %v", w.Code)
+	}
+	if w := do("bob", "GET", "/.snapshots/before/a.txt", ""); w.Code != 404 {
+		t.Errorf("file of another user in the snapshot status = %v, want 404", w.Code)
+	}
+	if n := objects(); n != 3 {
+		t.Errorf("objects with the snapshot = %v, want 3", n)
+	}
+
+	// the index is kept across restarts
+	fs, err = NewContentFS(cfg)
+	if err != nil {
+		t.Fatalf("NewContentFS() of the saved index error = %v", err)
+	}
+	a.Handler.FileSystem, a.Content = fs, fs
+	if w := do("alice", "GET", "/e.txt", ""); w.Body.String() != "changed content" {
+		t.Errorf("file after a restart = %q", w.Body)
+	}
+	if s := fs.Snapshots(); len(s) != 1 || s[0].Name != "before" || s[0].Files != 4 {
+		t.Errorf("Snapshots() after a restart = %+v", s)
+	}
+
+	// removing the snapshot removes the contents only it references
+	if err := fs.RemoveSnapshot("before"); err != nil {
+		t.Fatalf("RemoveSnapshot() error = %v", err)
+	}
+	if n := objects(); n != 2 {
+		t.Errorf("objects after removing the snapshot = %v, want 2", n)
+	}
+	if err := fs.RemoveSnapshot("before"); err != errNoSuchSnapshot {
+		t.Errorf("second RemoveSnapshot() error = %v, want %v", err, errNoSuchSnapshot)
+	}
+
+	cfg.Admin = &Admin{Users: map[string]*UserInfo{"root": {Password: GenHash([]byte("secret"))}}}
+	a.Tracker = NewTracker()
+	admin := NewAdminHandler(a)
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{"create", "POST", "/api/v1/snapshots", `{"name":"daily"}`, 201},
+		{"create again", "POST", "/api/v1/snapshots", `{"name":"daily"}`, 409},
+		{"invalid name", "POST", "/api/v1/snapshots", `{"name":"a/b"}`, 400},
+		{"list", "GET", "/api/v1/snapshots", "", 200},
+		{"remove", "DELETE", "/api/v1/snapshots/daily", "", 204},
+		{"remove again", "DELETE", "/api/v1/snapshots/daily", "", 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.SetBasicAuth("root", "secret")
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v. body = %s", w.Code, tt.statusCode, w.Body)
+			}
+		})
+	}
+}
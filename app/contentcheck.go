@@ -0,0 +1,289 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sniffLen is the number of bytes the type of a content is determined by.
+const sniffLen = 512
+
+var (
+	errContentMismatch = errors.New("content doesn't match the type of the file")
+	errContentPartial  = errors.New("checked files can only be written as a whole")
+)
+
+// ContentCheck verifies that uploads to the directories really are of the type their name
+// claims, like libmagic does. The type is determined by the leading bytes of the content, so
+// a program renamed to photo.jpg is rejected with 415 Unsupported Media Type.
+type ContentCheck struct {
+	Directories []*ContentCheckDir
+}
+
+// ContentCheckDir enables the check beneath a directory, which is given relative to the base
+// directory. If Types are given, only contents of these types are accepted, a type may end
+// with a wildcard like image/*.
+type ContentCheckDir struct {
+	Path  string
+	Types []string
+}
+
+// magicTypes are the types of the extensions, whose contents are recognized by their leading
+// bytes. Contents of other extensions are only checked for being programs.
+var magicTypes = map[string]string{
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".png":   "image/png",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".bmp":   "image/bmp",
+	".ico":   "image/x-icon",
+	".pdf":   "application/pdf",
+	".ps":    "application/postscript",
+	".zip":   "application/zip",
+	".docx":  "application/zip",
+	".xlsx":  "application/zip",
+	".pptx":  "application/zip",
+	".odt":   "application/zip",
+	".ods":   "application/zip",
+	".odp":   "application/zip",
+	".epub":  "application/zip",
+	".jar":   "application/zip",
+	".gz":    "application/x-gzip",
+	".tgz":   "application/x-gzip",
+	".rar":   "application/x-rar-compressed",
+	".wasm":  "application/wasm",
+	".ogg":   "application/ogg",
+	".wav":   "audio/wave",
+	".mid":   "audio/midi",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+	".avi":   "video/avi",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+// Types of programs, which are only accepted with the extensions of programs or without an
+// extension.
+const (
+	typeWindowsProgram = "application/vnd.microsoft.portable-executable"
+	typeELFProgram     = "application/x-elf"
+	typeMachOProgram   = "application/x-mach-binary"
+)
+
+var programExtensions = map[string]bool{
+	".exe": true, ".dll": true, ".sys": true, ".scr": true, ".com": true, ".efi": true,
+	".so": true, ".o": true, ".bin": true, ".elf": true, ".dylib": true, ".bundle": true,
+}
+
+// sniffType returns the type of a content determined by its leading bytes.
+func sniffType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return typeWindowsProgram
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return typeELFProgram
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return typeMachOProgram
+	}
+	t, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return t
+}
+
+// matchesType returns whether the type matches one of the patterns.
+func matchesType(t string, patterns []string) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == t || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// directory returns the check of the innermost configured directory containing the file, or
+// nil if the file isn't checked.
+func (c *ContentCheck) directory(root, name string) *ContentCheckDir {
+	if c == nil {
+		return nil
+	}
+	var found *ContentCheckDir
+	var length int
+	for _, d := range c.Directories {
+		if d == nil {
+			continue
+		}
+		dir := filepath.Join(root, filepath.FromSlash(path.Clean("/"+filepath.ToSlash(d.Path))))
+		if withinDir(name, dir) && (found == nil || len(dir) > length) {
+			found, length = d, len(dir)
+		}
+	}
+	return found
+}
+
+// check returns errContentMismatch, if the content starting with head doesn't match the name
+// of the file or isn't of the allowed types. Empty contents are accepted, as clients create
+// files before uploading their content.
+func (d *ContentCheckDir) check(name string, head []byte) error {
+	if len(head) == 0 {
+		return nil
+	}
+	t := sniffType(head)
+	ext := strings.ToLower(filepath.Ext(name))
+	switch t {
+	case typeWindowsProgram, typeELFProgram, typeMachOProgram:
+		if ext != "" && !programExtensions[ext] {
+			return fmt.Errorf("%w: %s is a program", errContentMismatch, filepath.Base(name))
+		}
+	}
+	if want, ok := magicTypes[ext]; ok && t != want {
+		return fmt.Errorf("%w: %s is %s", errContentMismatch, filepath.Base(name), t)
+	}
+	if len(d.Types) > 0 && !matchesType(t, d.Types) {
+		return fmt.Errorf("%w: %s of %s isn't allowed", errContentMismatch, t, filepath.Base(name))
+	}
+	return nil
+}
+
+// openCheckedFile returns a file collecting the leading bytes of the written content. The
+// file is only opened by open once they passed the check.
+func (d *ContentCheckDir) openCheckedFile(ctx context.Context, files storage, name, user string, flag int, open func() (webdav.File, error)) (webdav.File, error) {
+	if dir, err := checkWholeWrite(files, name, flag, errContentPartial); err != nil {
+		return nil, err
+	} else if dir {
+		return open()
+	}
+	return &checkedFile{ctx: ctx, check: d.check, name: name, user: user, status: http.StatusUnsupportedMediaType, open: open}, nil
+}
+
+// checkedFile holds back the content until the leading bytes are known. The file is opened
+// once they passed the check, which rejects the request with the status otherwise, and have
+// been written or the file is used otherwise.
+type checkedFile struct {
+	ctx    context.Context
+	check  func(name string, head []byte) error
+	name   string
+	user   string
+	status int
+	open   func() (webdav.File, error)
+	head   []byte
+	file   webdav.File
+	err    error
+}
+
+// flush checks the collected bytes, opens the file and writes them to it.
+func (f *checkedFile) flush() error {
+	if f.file != nil || f.err != nil {
+		return f.err
+	}
+	if f.err = f.check(f.name, f.head); f.err != nil {
+		log.WithFields(log.Fields{"path": f.name, "user": f.user}).WithError(f.err).Warn("Rejected upload")
+		traceStep(f.ctx, "upload of %s rejected: %s", f.name, f.err)
+		rejectionFromContext(f.ctx).reject(f.status)
+		return f.err
+	}
+	if f.file, f.err = f.open(); f.err != nil {
+		return f.err
+	}
+	if len(f.head) > 0 {
+		_, f.err = f.file.Write(f.head)
+	}
+	f.head = nil
+	return f.err
+}
+
+func (f *checkedFile) Write(p []byte) (int, error) {
+	if f.file != nil || f.err != nil {
+		if f.err != nil {
+			return 0, f.err
+		}
+		return f.file.Write(p)
+	}
+	f.head = append(f.head, p...)
+	if len(f.head) >= sniffLen {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *checkedFile) Read(p []byte) (int, error) {
+	if err := f.flush(); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+// Seek only reports the position until the file has been opened, seeking elsewhere would
+// write the leading bytes later on.
+func (f *checkedFile) Seek(offset int64, whence int) (int64, error) {
+	if f.file != nil || f.err != nil {
+		if f.err != nil {
+			return 0, f.err
+		}
+		return f.file.Seek(offset, whence)
+	}
+	if size := int64(len(f.head)); (whence == io.SeekCurrent && offset == 0) || (whence == io.SeekStart && offset == size) {
+		return size, nil
+	}
+	return 0, errContentPartial
+}
+
+func (f *checkedFile) Readdir(count int) ([]os.FileInfo, error) {
+	if err := f.flush(); err != nil {
+		return nil, err
+	}
+	return f.file.Readdir(count)
+}
+
+// Stat reports the bytes held back until the file has been opened.
+func (f *checkedFile) Stat() (os.FileInfo, error) {
+	if f.file == nil && f.err == nil {
+		return checkedFileInfo{f}, nil
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.file.Stat()
+}
+
+func (f *checkedFile) Close() error {
+	err := f.flush()
+	if f.file == nil {
+		return err
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type checkedFileInfo struct {
+	f *checkedFile
+}
+
+func (fi checkedFileInfo) Name() string       { return filepath.Base(fi.f.name) }
+func (fi checkedFileInfo) Size() int64        { return int64(len(fi.f.head)) }
+func (fi checkedFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi checkedFileInfo) ModTime() time.Time { return time.Now() }
+func (fi checkedFileInfo) IsDir() bool        { return false }
+func (fi checkedFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,71 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentCheck(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	for _, dir := range []string{"photos", "docs", "other"} {
+		os.MkdirAll(filepath.Join(tmpDir, dir), 0700)
+	}
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "docs", "old.jpg"), []byte("\xff\xd8\xffold"), 0600)
+
+	cfg := &Config{Dir: tmpDir, ContentCheck: &ContentCheck{Directories: []*ContentCheckDir{
+		{Path: "/docs"},
+		{Path: "photos", Types: []string{"image/*"}},
+	}}}
+	a := newQuotaApp(t, cfg)
+	jpeg := "\xff\xd8\xff" + strings.Repeat("x", 1000)
+	program := "MZ\x90\x00" + strings.Repeat("\x00", 1000)
+
+	tests := []struct {
+		name     string
+		target   string
+		body     string
+		want     int
+		wantFile string
+	}{
+		{"photo", "/photos/a.jpg", jpeg, http.StatusCreated, jpeg},
+		{"program as photo", "/photos/evil.jpg", program, http.StatusUnsupportedMediaType, ""},
+		{"photo of other type", "/photos/a.png", jpeg, http.StatusUnsupportedMediaType, ""},
+		{"text in photos", "/photos/notes.txt", "some notes", http.StatusUnsupportedMediaType, ""},
+		{"program", "/docs/tool.exe", program, http.StatusCreated, program},
+		{"program without extension", "/docs/tool", program, http.StatusCreated, program},
+		{"program as text", "/docs/readme.txt", program, http.StatusUnsupportedMediaType, ""},
+		{"pdf", "/docs/report.pdf", "%PDF-1.4 content", http.StatusCreated, "%PDF-1.4 content"},
+		{"unknown extension", "/docs/data.xyz", "anything", http.StatusCreated, "anything"},
+		{"empty", "/docs/empty.jpg", "", http.StatusCreated, ""},
+		{"overwrite", "/docs/old.jpg", program, http.StatusUnsupportedMediaType, "\xff\xd8\xffold"},
+		{"unchecked", "/other/evil.jpg", program, http.StatusCreated, program},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", tt.target, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Errorf("PUT status = %v, want %v", w.Code, tt.want)
+			}
+			data, _ := ioutil.ReadFile(filepath.Join(tmpDir, tt.target))
+			if string(data) != tt.wantFile {
+				t.Errorf("file = %d bytes, want %d bytes", len(data), len(tt.wantFile))
+			}
+		})
+	}
+
+	d := Dir{Config: cfg}
+	if _, err := d.OpenFile(context.Background(), "/docs/old.jpg", os.O_WRONLY, 0600); err != errContentPartial {
+		t.Errorf("OpenFile() to modify a file error = %v, want %v", err, errContentPartial)
+	}
+}
@@ -0,0 +1,375 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the coordination
+const (
+	defaultCoordinationPrefix   = "dave/"
+	defaultCoordinationInterval = 5 * time.Second
+	coordinationTimeout         = 10 * time.Second
+	// coordinationAttempts limits the attempts of an update, which conflicts with updates
+	// of other nodes
+	coordinationAttempts = 20
+)
+
+// Keys of the coordination store, beneath the prefix
+const (
+	coordinationUsersKey = "users"
+	coordinationLocksKey = "locks"
+	coordinationQuotaKey = "quota:"
+)
+
+// errCoordinationConflict is returned by updates, which kept conflicting with other nodes.
+var errCoordinationConflict = errors.New("coordination store kept changing during the update")
+
+// Coordination lets several nodes sharing the same storage, e.g. via NFS, behave as one
+// service. The WebDAV locks, the users and the quota counters are kept in etcd or Consul,
+// whose HTTP API is reached at the Endpoints. The users and the quota counters are
+// synchronized every Interval, 5s by default. Locks of an infinite duration are released,
+// once their node missed six intervals. Node names the node in the store, the host name by
+// default.
+type Coordination struct {
+	Backend   string
+	Endpoints []string
+	Prefix    string
+	Node      string
+	Interval  time.Duration
+
+	// Token is the ACL token of Consul
+	Token string
+	// Username and Password authenticate with etcd
+	Username string
+	Password string
+}
+
+// Coordinator keeps the shared state of the nodes in the coordination store. A nil
+// Coordinator is valid and coordinates nothing.
+type Coordinator struct {
+	kv       kvStore
+	prefix   string
+	node     string
+	interval time.Duration
+	cfg      *Config
+	quotas   *Quotas
+
+	// usersMu serializes the synchronizations of the users, knownUsers are the users of the
+	// store as of the last one
+	usersMu    sync.Mutex
+	knownUsers map[string]json.RawMessage
+
+	updates, conflicts, failures int64
+}
+
+// NewCoordinator connects to the coordination store of the configuration and synchronizes
+// the users, so the users of the store are in effect before the quotas of the users are
+// determined. It returns nil, if no coordination is configured.
+func NewCoordinator(cfg *Config) (*Coordinator, error) {
+	co := cfg.Coordination
+	if co == nil {
+		return nil, nil
+	}
+	if len(co.Endpoints) == 0 {
+		return nil, fmt.Errorf("coordination requires endpoints")
+	}
+
+	c := &Coordinator{
+		prefix:   co.Prefix,
+		node:     co.Node,
+		interval: co.Interval,
+		cfg:      cfg,
+	}
+	eps := &endpoints{urls: co.Endpoints}
+	switch co.Backend {
+	case "etcd":
+		c.kv = &etcdStore{endpoints: eps, username: co.Username, password: co.Password}
+	case "consul":
+		c.kv = &consulStore{endpoints: eps, token: co.Token}
+	default:
+		return nil, fmt.Errorf("unknown coordination backend %q, expected etcd or consul", co.Backend)
+	}
+	if c.prefix == "" {
+		c.prefix = defaultCoordinationPrefix
+	}
+	if c.interval <= 0 {
+		c.interval = defaultCoordinationInterval
+	}
+	if c.node == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("error determining the node of the coordination: %w", err)
+		}
+		c.node = host
+	}
+
+	if err := c.syncUsers(); err != nil {
+		return nil, fmt.Errorf("error synchronizing users with the coordination store: %w", err)
+	}
+	log.WithFields(log.Fields{"backend": co.Backend, "node": c.node}).Info("Coordinating with other nodes")
+	return c, nil
+}
+
+// update changes the value of the key by change, which gets the current value or nil, if
+// the key is missing. Updates of other nodes in between are retried with their value. A nil
+// result of change leaves the value as it is, an error of change aborts the update.
+func (c *Coordinator) update(key string, change func(value []byte) ([]byte, error)) error {
+	atomic.AddInt64(&c.updates, 1)
+	for attempt := 0; attempt < coordinationAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), coordinationTimeout)
+		value, version, err := c.kv.get(ctx, c.prefix+key)
+		if err != nil {
+			cancel()
+			atomic.AddInt64(&c.failures, 1)
+			return err
+		}
+		updated, err := change(value)
+		if err != nil || updated == nil {
+			cancel()
+			return err
+		}
+		ok, err := c.kv.put(ctx, c.prefix+key, updated, version)
+		cancel()
+		if err != nil {
+			atomic.AddInt64(&c.failures, 1)
+			return err
+		}
+		if ok {
+			return nil
+		}
+		atomic.AddInt64(&c.conflicts, 1)
+	}
+	return errCoordinationConflict
+}
+
+// read returns the value of the key or nil, if it's missing.
+func (c *Coordinator) read(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), coordinationTimeout)
+	defer cancel()
+	value, _, err := c.kv.get(ctx, c.prefix+key)
+	if err != nil {
+		atomic.AddInt64(&c.failures, 1)
+	}
+	return value, err
+}
+
+// Start synchronizes the users and the counters of the quotas periodically and keeps the
+// node alive within the store.
+func (c *Coordinator) Start(quotas *Quotas) {
+	if c == nil {
+		return
+	}
+
+	c.quotas = quotas
+	go func() {
+		c.synchronize(time.Now())
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			c.synchronize(now)
+		}
+	}()
+}
+
+// synchronize exchanges the state of this node with the store.
+func (c *Coordinator) synchronize(now time.Time) {
+	if err := c.heartbeat(now); err != nil {
+		log.WithError(err).Warn("Error sending heartbeat to the coordination store")
+	}
+	if err := c.syncUsers(); err != nil {
+		log.WithError(err).Warn("Error synchronizing users with the coordination store")
+	}
+	if err := c.syncQuotas(now); err != nil {
+		log.WithError(err).Warn("Error synchronizing quotas with the coordination store")
+	}
+}
+
+// syncUsers merges the users of this node, which changed since the last synchronization,
+// into the users of the store and takes over the result, so changes of the admin API and of
+// the configuration file of any node reach all of them. The first synchronization seeds an
+// empty store with the users of this node or takes over the users of the store.
+func (c *Coordinator) syncUsers() error {
+	if c == nil {
+		return nil
+	}
+
+	c.usersMu.Lock()
+	defer c.usersMu.Unlock()
+
+	local := map[string]json.RawMessage{}
+	for name, user := range c.cfg.UsersCopy() {
+		encoded, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		local[name] = encoded
+	}
+
+	var merged map[string]json.RawMessage
+	err := c.update(coordinationUsersKey, func(value []byte) ([]byte, error) {
+		stored := map[string]json.RawMessage{}
+		if value != nil {
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return nil, fmt.Errorf("invalid users in the coordination store: %w", err)
+			}
+		}
+		known := c.knownUsers
+		if known == nil && value != nil {
+			known = local
+		}
+
+		merged = map[string]json.RawMessage{}
+		for name, user := range stored {
+			merged[name] = user
+		}
+		changed := value == nil
+		for name, user := range local {
+			if string(known[name]) != string(user) && string(merged[name]) != string(user) {
+				merged[name], changed = user, true
+			}
+		}
+		for name := range known {
+			if _, ok := local[name]; !ok {
+				if _, ok := merged[name]; ok {
+					delete(merged, name)
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			return nil, nil
+		}
+		return json.Marshal(merged)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.knownUsers = merged
+	if equalUsers(local, merged) {
+		return nil
+	}
+	users := make(map[string]*UserInfo, len(merged))
+	for name, encoded := range merged {
+		user := &UserInfo{}
+		if err := json.Unmarshal(encoded, user); err != nil {
+			return fmt.Errorf("invalid user %s in the coordination store: %w", name, err)
+		}
+		users[name] = user
+	}
+	c.cfg.replaceUsers(users)
+	c.cfg.ensureUserDirs()
+	return nil
+}
+
+func equalUsers(a, b map[string]json.RawMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, user := range a {
+		if other, ok := b[name]; !ok || string(other) != string(user) {
+			return false
+		}
+	}
+	return true
+}
+
+// quotaCounters are the counters of a quota within the coordination store.
+type quotaCounters struct {
+	Used  int64 `json:"used"`
+	Files int64 `json:"files"`
+	Dirs  int64 `json:"dirs"`
+}
+
+func (q quotaCounters) add(other quotaCounters) quotaCounters {
+	return quotaCounters{Used: q.Used + other.Used, Files: q.Files + other.Files, Dirs: q.Dirs + other.Dirs}
+}
+
+func (q quotaCounters) sub(other quotaCounters) quotaCounters {
+	return quotaCounters{Used: q.Used - other.Used, Files: q.Files - other.Files, Dirs: q.Dirs - other.Dirs}
+}
+
+// syncQuotas adds the changes of the quota counters of this node since the last
+// synchronization to the counters of the store and takes over the changes of the other
+// nodes. Counters determined by walking the directories replace the counters of the store.
+func (c *Coordinator) syncQuotas(now time.Time) error {
+	q := c.quotas
+	if q == nil {
+		return nil
+	}
+
+	var errs []error
+	for i := range q.scopes {
+		q.mu.Lock()
+		s := q.scopes[i]
+		local := quotaCounters{Used: s.used, Files: s.files, Dirs: s.dirs}
+		synced, reset := s.synced, s.reset
+		q.mu.Unlock()
+
+		delta := local.sub(synced)
+		var result quotaCounters
+		err := c.update(coordinationQuotaKey+s.user+s.name, func(value []byte) ([]byte, error) {
+			var stored quotaCounters
+			if value != nil {
+				if err := json.Unmarshal(value, &stored); err != nil {
+					return nil, fmt.Errorf("invalid quota counters in the coordination store: %w", err)
+				}
+			}
+			result = stored.add(delta)
+			if reset || value == nil {
+				result = local
+			}
+			if value != nil && result == stored {
+				return nil, nil
+			}
+			return json.Marshal(result)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("scope %s: %w", s.name, err))
+			continue
+		}
+
+		// the changes of the other nodes, which are added to the changes of this node
+		// meanwhile
+		remote := result.sub(synced).sub(delta)
+		q.mu.Lock()
+		s.used += remote.Used
+		s.files += remote.Files
+		s.dirs += remote.Dirs
+		s.synced = result
+		if reset {
+			s.reset = false
+		}
+		if remote != (quotaCounters{}) {
+			s.changes++
+			q.updateSoft(s, now)
+		}
+		q.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// RegisterMetrics exposes the updates of the coordination store, their conflicts with other
+// nodes and the failed requests.
+func (c *Coordinator) RegisterMetrics(m *Metrics) {
+	if c == nil {
+		return
+	}
+
+	counter := func(value *int64) func() []Sample {
+		return func() []Sample {
+			return []Sample{{Value: float64(atomic.LoadInt64(value))}}
+		}
+	}
+	m.Counter("dave_coordination_updates_total", "Updates of the coordination store.", counter(&c.updates))
+	m.Counter("dave_coordination_conflicts_total", "Updates of the coordination store retried after a conflict with another node.", counter(&c.conflicts))
+	m.Counter("dave_coordination_failures_total", "Requests to the coordination store which failed.", counter(&c.failures))
+}
@@ -0,0 +1,251 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coordinationNodeTimeout is the number of intervals without a heartbeat, after which a node
+// is considered gone and its infinite locks are released.
+const coordinationNodeTimeout = 6
+
+// sharedLocks are the WebDAV locks of all nodes and the last heartbeats of the nodes.
+type sharedLocks struct {
+	Nodes map[string]time.Time   `json:"nodes"`
+	Locks map[string]*sharedLock `json:"locks"`
+}
+
+// sharedLock is a WebDAV lock within the coordination store. Expires is zero for locks of
+// an infinite duration, which are bound to the node.
+type sharedLock struct {
+	Root      string        `json:"root"`
+	Owner     string        `json:"owner,omitempty"`
+	ZeroDepth bool          `json:"zeroDepth,omitempty"`
+	Duration  time.Duration `json:"duration"`
+	Expires   time.Time     `json:"expires"`
+	Node      string        `json:"node"`
+}
+
+func (l *sharedLock) details() webdav.LockDetails {
+	return webdav.LockDetails{Root: l.Root, Duration: l.Duration, OwnerXML: l.Owner, ZeroDepth: l.ZeroDepth}
+}
+
+// covers returns whether the lock applies to the resource of the name.
+func (l *sharedLock) covers(name string) bool {
+	return name == l.Root || (!l.ZeroDepth && withinLockRoot(name, l.Root))
+}
+
+// withinLockRoot returns whether the slash separated name is root or located beneath it.
+func withinLockRoot(name, root string) bool {
+	return name == root || root == "/" || strings.HasPrefix(name, root+"/")
+}
+
+func decodeSharedLocks(value []byte) (*sharedLocks, error) {
+	s := &sharedLocks{}
+	if value != nil {
+		if err := json.Unmarshal(value, s); err != nil {
+			return nil, fmt.Errorf("invalid locks in the coordination store: %w", err)
+		}
+	}
+	if s.Nodes == nil {
+		s.Nodes = map[string]time.Time{}
+	}
+	if s.Locks == nil {
+		s.Locks = map[string]*sharedLock{}
+	}
+	return s, nil
+}
+
+// prune removes the expired locks and the nodes, which missed their heartbeats, with their
+// infinite locks.
+func (s *sharedLocks) prune(now time.Time, timeout time.Duration) {
+	for node, seen := range s.Nodes {
+		if now.Sub(seen) > timeout {
+			delete(s.Nodes, node)
+		}
+	}
+	for token, l := range s.Locks {
+		if l.Expires.IsZero() {
+			if _, ok := s.Nodes[l.Node]; !ok {
+				delete(s.Locks, token)
+			}
+		} else if !now.Before(l.Expires) {
+			delete(s.Locks, token)
+		}
+	}
+}
+
+// updateLocks changes the locks of the store by change, after the outdated locks have been
+// pruned, and renews the heartbeat of the node.
+func (c *Coordinator) updateLocks(now time.Time, change func(s *sharedLocks) error) error {
+	return c.update(coordinationLocksKey, func(value []byte) ([]byte, error) {
+		s, err := decodeSharedLocks(value)
+		if err != nil {
+			return nil, err
+		}
+		s.prune(now, coordinationNodeTimeout*c.interval)
+		if err := change(s); err != nil {
+			return nil, err
+		}
+		s.Nodes[c.node] = now
+		return json.Marshal(s)
+	})
+}
+
+// heartbeat tells the other nodes, that the node is still alive.
+func (c *Coordinator) heartbeat(now time.Time) error {
+	return c.updateLocks(now, func(s *sharedLocks) error { return nil })
+}
+
+// LockSystem returns a WebDAV lock system, whose locks are shared with the other nodes.
+func (c *Coordinator) LockSystem() webdav.LockSystem {
+	return &sharedLockSystem{c: c, held: map[string]bool{}}
+}
+
+// sharedLockSystem keeps the WebDAV locks within the coordination store, so a lock taken via
+// one node is respected by all of them. Like the lock system of the webdav package, a lock
+// confirmed for a request is held by it, until the request releases it. This only applies
+// to the requests of this node.
+type sharedLockSystem struct {
+	c *Coordinator
+
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func (ls *sharedLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	value, err := ls.c.read(coordinationLocksKey)
+	if err != nil {
+		return nil, err
+	}
+	s, err := decodeSharedLocks(value)
+	if err != nil {
+		return nil, err
+	}
+	s.prune(now, coordinationNodeTimeout*ls.c.interval)
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var tokens []string
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+		token := ls.lookup(s, path.Clean("/"+name), conditions...)
+		if token == "" {
+			return nil, webdav.ErrConfirmationFailed
+		}
+		if len(tokens) == 0 || tokens[0] != token {
+			tokens = append(tokens, token)
+		}
+	}
+	for _, token := range tokens {
+		ls.held[token] = true
+	}
+	return func() {
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+		for _, token := range tokens {
+			delete(ls.held, token)
+		}
+	}, nil
+}
+
+// lookup returns the token of the conditions, whose lock covers the name and isn't held.
+// ls.mu must be held.
+func (ls *sharedLockSystem) lookup(s *sharedLocks, name string, conditions ...webdav.Condition) string {
+	for _, c := range conditions {
+		if l := s.Locks[c.Token]; l != nil && !ls.held[c.Token] && l.covers(name) {
+			return c.Token
+		}
+	}
+	return ""
+}
+
+func (ls *sharedLockSystem) isHeld(token string) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.held[token]
+}
+
+func (ls *sharedLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = path.Clean("/" + details.Root)
+	token, err := newSharedLockToken()
+	if err != nil {
+		return "", err
+	}
+	lock := &sharedLock{
+		Root:      details.Root,
+		Owner:     details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+		Duration:  details.Duration,
+		Expires:   expiry(now, details.Duration),
+		Node:      ls.c.node,
+	}
+
+	err = ls.c.updateLocks(now, func(s *sharedLocks) error {
+		for _, l := range s.Locks {
+			if l.Root == lock.Root || (!l.ZeroDepth && withinLockRoot(lock.Root, l.Root)) ||
+				(!lock.ZeroDepth && withinLockRoot(l.Root, lock.Root)) {
+				return webdav.ErrLocked
+			}
+		}
+		s.Locks[token] = lock
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (ls *sharedLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	if ls.isHeld(token) {
+		return webdav.LockDetails{}, webdav.ErrLocked
+	}
+
+	var details webdav.LockDetails
+	err := ls.c.updateLocks(now, func(s *sharedLocks) error {
+		l := s.Locks[token]
+		if l == nil {
+			return webdav.ErrNoSuchLock
+		}
+		l.Duration, l.Expires = duration, expiry(now, duration)
+		if l.Expires.IsZero() {
+			l.Node = ls.c.node
+		}
+		details = l.details()
+		return nil
+	})
+	return details, err
+}
+
+func (ls *sharedLockSystem) Unlock(now time.Time, token string) error {
+	if ls.isHeld(token) {
+		return webdav.ErrLocked
+	}
+
+	return ls.c.updateLocks(now, func(s *sharedLocks) error {
+		if s.Locks[token] == nil {
+			return webdav.ErrNoSuchLock
+		}
+		delete(s.Locks, token)
+		return nil
+	})
+}
+
+// newSharedLockToken returns a random token, which is unique across the nodes.
+func newSharedLockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "opaquelocktoken:" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,243 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// kvStore is a key value store with versioned keys, the common ground of etcd and Consul.
+type kvStore interface {
+	// get returns the value and the version of the key. A missing key has a nil value and
+	// the version 0.
+	get(ctx context.Context, key string) ([]byte, int64, error)
+	// put stores the value, if the key still has the version, and returns whether it did. The
+	// version 0 requires the key to be missing.
+	put(ctx context.Context, key string, value []byte, version int64) (bool, error)
+}
+
+var coordinationClient = &http.Client{Timeout: coordinationTimeout}
+
+// endpoints are the base URLs of the nodes of the store. Requests go to the last endpoint,
+// which has been reachable, and fail over to the others.
+type endpoints struct {
+	urls []string
+
+	mu      sync.Mutex
+	current int
+}
+
+// do sends the request to the endpoints, until one of them responds.
+func (e *endpoints) do(ctx context.Context, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	e.mu.Lock()
+	current := e.current
+	e.mu.Unlock()
+
+	var err error
+	for i := range e.urls {
+		n := (current + i) % len(e.urls)
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, strings.TrimSuffix(e.urls[n], "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		var res *http.Response
+		if res, err = coordinationClient.Do(req); err == nil {
+			e.mu.Lock()
+			e.current = n
+			e.mu.Unlock()
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// readResponse reads the body of a response with a status of 200 into v, if v isn't nil.
+func readResponse(res *http.Response, v interface{}) error {
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("coordination store responded %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// consulStore stores the keys in the KV store of Consul, whose modify index is the version.
+type consulStore struct {
+	endpoints *endpoints
+	token     string
+}
+
+func (s *consulStore) request(ctx context.Context, method, key, query string, body []byte) (*http.Response, error) {
+	header := http.Header{}
+	if s.token != "" {
+		header.Set("X-Consul-Token", s.token)
+	}
+	path := (&url.URL{Path: "/v1/kv/" + key}).EscapedPath()
+	if query != "" {
+		path += "?" + query
+	}
+	return s.endpoints.do(ctx, method, path, body, header)
+}
+
+func (s *consulStore) get(ctx context.Context, key string) ([]byte, int64, error) {
+	res, err := s.request(ctx, http.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, 0, nil
+	}
+	var entries []struct {
+		ModifyIndex int64
+		Value       []byte
+	}
+	if err := readResponse(res, &entries); err != nil {
+		return nil, 0, err
+	}
+	if len(entries) == 0 {
+		return nil, 0, nil
+	}
+	value := entries[0].Value
+	if value == nil {
+		value = []byte{}
+	}
+	return value, entries[0].ModifyIndex, nil
+}
+
+func (s *consulStore) put(ctx context.Context, key string, value []byte, version int64) (bool, error) {
+	res, err := s.request(ctx, http.MethodPut, key, "cas="+strconv.FormatInt(version, 10), value)
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	err = readResponse(res, &ok)
+	return ok, err
+}
+
+// etcdStore stores the keys in etcd via the JSON gateway of its v3 API, whose modification
+// revision is the version. With a username, it authenticates with the password first.
+type etcdStore struct {
+	endpoints *endpoints
+	username  string
+	password  string
+
+	mu    sync.Mutex
+	token string
+}
+
+// etcdKV is a key value of the v3 API, whose revisions are encoded as strings.
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+func (s *etcdStore) call(ctx context.Context, path string, req, res interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		header := http.Header{"Content-Type": {"application/json"}}
+		if s.username != "" {
+			token, err := s.authenticate(ctx)
+			if err != nil {
+				return err
+			}
+			header.Set("Authorization", token)
+		}
+		r, err := s.endpoints.do(ctx, http.MethodPost, path, body, header)
+		if err != nil {
+			return err
+		}
+		// the token expired, authenticate again
+		if r.StatusCode == http.StatusUnauthorized && s.username != "" && attempt == 0 {
+			r.Body.Close()
+			s.mu.Lock()
+			s.token = ""
+			s.mu.Unlock()
+			continue
+		}
+		return readResponse(r, res)
+	}
+}
+
+// authenticate returns the token of the user, which is requested once.
+func (s *etcdStore) authenticate(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" {
+		return s.token, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"name": s.username, "password": s.password})
+	r, err := s.endpoints.do(ctx, http.MethodPost, "/v3/auth/authenticate", body, http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := readResponse(r, &res); err != nil {
+		return "", fmt.Errorf("error authenticating with etcd: %w", err)
+	}
+	s.token = res.Token
+	return s.token, nil
+}
+
+func (s *etcdStore) get(ctx context.Context, key string) ([]byte, int64, error) {
+	var res struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	if err := s.call(ctx, "/v3/kv/range", map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))}, &res); err != nil {
+		return nil, 0, err
+	}
+	if len(res.KVs) == 0 {
+		return nil, 0, nil
+	}
+	value := res.KVs[0].Value
+	if value == nil {
+		value = []byte{}
+	}
+	return value, res.KVs[0].ModRevision, nil
+}
+
+func (s *etcdStore) put(ctx context.Context, key string, value []byte, version int64) (bool, error) {
+	encodedKey := base64.StdEncoding.EncodeToString([]byte(key))
+	// a missing key compares equal to the modification revision 0
+	req := map[string]interface{}{
+		"compare": []map[string]string{{
+			"key":          encodedKey,
+			"target":       "MOD",
+			"result":       "EQUAL",
+			"mod_revision": strconv.FormatInt(version, 10),
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]string{"key": encodedKey, "value": base64.StdEncoding.EncodeToString(value)},
+		}},
+	}
+	var res struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	err := s.call(ctx, "/v3/kv/txn", req, &res)
+	return res.Succeeded, err
+}
@@ -0,0 +1,279 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// fakeKV is the state of a fake coordination store.
+type fakeKV struct {
+	mu       sync.Mutex
+	revision int64
+	values   map[string][]byte
+	versions map[string]int64
+}
+
+// cas stores the value, if the key has the version.
+func (kv *fakeKV) cas(key string, value []byte, version int64) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.versions[key] != version {
+		return false
+	}
+	kv.revision++
+	kv.values[key], kv.versions[key] = value, kv.revision
+	return true
+}
+
+func (kv *fakeKV) get(key string) ([]byte, int64, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	value, ok := kv.values[key]
+	return value, kv.versions[key], ok
+}
+
+// newFakeStore serves the parts of the HTTP API of Consul or etcd used by the coordinator.
+func newFakeStore(t *testing.T, backend string) *httptest.Server {
+	kv := &fakeKV{values: map[string][]byte{}, versions: map[string]int64{}}
+	if backend == "consul" {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+			switch r.Method {
+			case http.MethodGet:
+				value, version, ok := kv.get(key)
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				json.NewEncoder(w).Encode([]map[string]interface{}{{"Key": key, "ModifyIndex": version, "Value": value}})
+			case http.MethodPut:
+				version, _ := strconv.ParseInt(r.URL.Query().Get("cas"), 10, 64)
+				value, _ := ioutil.ReadAll(r.Body)
+				json.NewEncoder(w).Encode(kv.cas(key, value, version))
+			}
+		}))
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			var req struct{ Key []byte }
+			json.NewDecoder(r.Body).Decode(&req)
+			res := map[string]interface{}{}
+			if value, version, ok := kv.get(string(req.Key)); ok {
+				res["kvs"] = []map[string]string{{
+					"key":          base64.StdEncoding.EncodeToString(req.Key),
+					"value":        base64.StdEncoding.EncodeToString(value),
+					"mod_revision": strconv.FormatInt(version, 10),
+				}}
+			}
+			json.NewEncoder(w).Encode(res)
+		case "/v3/kv/txn":
+			var req struct {
+				Compare []struct {
+					Key         []byte
+					ModRevision int64 `json:"mod_revision,string"`
+				}
+				Success []struct {
+					RequestPut struct{ Key, Value []byte } `json:"request_put"`
+				}
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			put := req.Success[0].RequestPut
+			if string(req.Compare[0].Key) != string(put.Key) {
+				t.Errorf("compared %s, but put %s", req.Compare[0].Key, put.Key)
+			}
+			ok := kv.cas(string(put.Key), put.Value, req.Compare[0].ModRevision)
+			res := map[string]interface{}{}
+			if ok {
+				res["succeeded"] = true
+			}
+			json.NewEncoder(w).Encode(res)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// newTestCoordinator creates a coordinator of the node for the configuration.
+func newTestCoordinator(t *testing.T, backend, endpoint, node string, cfg *Config) *Coordinator {
+	cfg.Coordination = &Coordination{Backend: backend, Endpoints: []string{endpoint}, Node: node}
+	c, err := NewCoordinator(cfg)
+	if err != nil {
+		t.Fatalf("NewCoordinator() error = %v", err)
+	}
+	return c
+}
+
+func TestCoordinationStores(t *testing.T) {
+	for _, backend := range []string{"consul", "etcd"} {
+		t.Run(backend, func(t *testing.T) {
+			srv := newFakeStore(t, backend)
+			defer srv.Close()
+			// the first endpoint isn't reachable
+			c, err := NewCoordinator(&Config{Coordination: &Coordination{Backend: backend, Endpoints: []string{"http://127.0.0.1:1", srv.URL}}})
+			if err != nil {
+				t.Fatalf("NewCoordinator() error = %v", err)
+			}
+
+			ctx := context.Background()
+			if value, version, err := c.kv.get(ctx, "dave/key"); err != nil || value != nil || version != 0 {
+				t.Fatalf("get() of a missing key = %q, %v, %v", value, version, err)
+			}
+			if ok, err := c.kv.put(ctx, "dave/key", []byte("one"), 0); !ok || err != nil {
+				t.Fatalf("put() of a missing key = %v, %v", ok, err)
+			}
+			if ok, _ := c.kv.put(ctx, "dave/key", []byte("two"), 0); ok {
+				t.Errorf("put() of an existing key as missing succeeded")
+			}
+			value, version, err := c.kv.get(ctx, "dave/key")
+			if err != nil || string(value) != "one" || version == 0 {
+				t.Fatalf("get() = %q, %v, %v", value, version, err)
+			}
+			if ok, err := c.kv.put(ctx, "dave/key", []byte("two"), version); !ok || err != nil {
+				t.Errorf("put() of the current version = %v, %v", ok, err)
+			}
+			if ok, _ := c.kv.put(ctx, "dave/key", []byte("three"), version); ok {
+				t.Errorf("put() of an outdated version succeeded")
+			}
+		})
+	}
+}
+
+func TestSharedLockSystem(t *testing.T) {
+	srv := newFakeStore(t, "consul")
+	defer srv.Close()
+	a := newTestCoordinator(t, "consul", srv.URL, "a", &Config{}).LockSystem()
+	b := newTestCoordinator(t, "consul", srv.URL, "b", &Config{}).LockSystem()
+	now := time.Now()
+
+	token, err := a.Create(now, webdav.LockDetails{Root: "/dir", Duration: -1})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := b.Create(now, webdav.LockDetails{Root: "/dir/file", Duration: time.Minute, ZeroDepth: true}); err != webdav.ErrLocked {
+		t.Errorf("Create() beneath the lock of another node error = %v, want %v", err, webdav.ErrLocked)
+	}
+	if _, err := b.Create(now, webdav.LockDetails{Root: "/other", Duration: time.Minute, ZeroDepth: true}); err != nil {
+		t.Errorf("Create() of an unlocked resource error = %v", err)
+	}
+	if _, err := b.Confirm(now, "/dir/file", ""); err != webdav.ErrConfirmationFailed {
+		t.Errorf("Confirm() without the token error = %v, want %v", err, webdav.ErrConfirmationFailed)
+	}
+	release, err := b.Confirm(now, "/dir/file", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm() with the token error = %v", err)
+	}
+	if err := b.Unlock(now, token); err != webdav.ErrLocked {
+		t.Errorf("Unlock() of a held lock error = %v, want %v", err, webdav.ErrLocked)
+	}
+	release()
+	if _, err := b.Refresh(now, token, time.Minute); err != nil {
+		t.Errorf("Refresh() via another node error = %v", err)
+	}
+	if err := b.Unlock(now, token); err != nil {
+		t.Errorf("Unlock() via another node error = %v", err)
+	}
+	if err := a.Unlock(now, token); err != webdav.ErrNoSuchLock {
+		t.Errorf("Unlock() of a released lock error = %v, want %v", err, webdav.ErrNoSuchLock)
+	}
+
+	// infinite locks are released with their node
+	if _, err := a.Create(now, webdav.LockDetails{Root: "/infinite", Duration: -1}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	later := now.Add(coordinationNodeTimeout*defaultCoordinationInterval + time.Second)
+	if _, err := b.Create(later, webdav.LockDetails{Root: "/infinite", Duration: time.Minute}); err != nil {
+		t.Errorf("Create() on the lock of a gone node error = %v", err)
+	}
+}
+
+func TestCoordinatorUsers(t *testing.T) {
+	srv := newFakeStore(t, "etcd")
+	defer srv.Close()
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	hash := GenHash([]byte("password"))
+
+	cfgA := &Config{Dir: tmpDir, Users: map[string]*UserInfo{"alice": {Password: hash}, "bob": {Password: hash}}}
+	a := newTestCoordinator(t, "etcd", srv.URL, "a", cfgA)
+	// the store has been seeded, so the users of b are replaced
+	cfgB := &Config{Dir: tmpDir, Users: map[string]*UserInfo{"carol": {Password: hash}}}
+	b := newTestCoordinator(t, "etcd", srv.URL, "b", cfgB)
+	if names := strings.Join(cfgB.UserNames(), ","); names != "alice,bob" {
+		t.Fatalf("users of the joined node = %s, want alice,bob", names)
+	}
+
+	// concurrent changes of both nodes are merged
+	cfgA.updateUser("alice", func(user *UserInfo) { user.Trace = true })
+	cfgB.RemoveUser("bob")
+	cfgB.SetUser("dave", &UserInfo{Password: hash})
+	for _, c := range []*Coordinator{a, b, a} {
+		if err := c.syncUsers(); err != nil {
+			t.Fatalf("syncUsers() error = %v", err)
+		}
+	}
+	for _, cfg := range []*Config{cfgA, cfgB} {
+		if names := strings.Join(cfg.UserNames(), ","); names != "alice,dave" || !cfg.User("alice").Trace {
+			t.Errorf("users = %s, alice = %+v, want alice,dave with tracing", names, cfg.User("alice"))
+		}
+	}
+}
+
+func TestCoordinatorQuotas(t *testing.T) {
+	srv := newFakeStore(t, "consul")
+	defer srv.Close()
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "file"), make([]byte, 100), 0600)
+
+	nodes := make([]*Coordinator, 2)
+	quotas := make([]*Quotas, 2)
+	for i, node := range []string{"a", "b"} {
+		cfg := &Config{Dir: tmpDir, Quota: &Quota{Limit: 1000}}
+		nodes[i] = newTestCoordinator(t, "consul", srv.URL, node, cfg)
+		q, err := NewQuotas(cfg)
+		if err != nil {
+			t.Fatalf("NewQuotas() error = %v", err)
+		}
+		quotas[i], nodes[i].quotas = q, q
+	}
+	now := time.Now()
+	for _, c := range nodes {
+		if err := c.syncQuotas(now); err != nil {
+			t.Fatalf("syncQuotas() error = %v", err)
+		}
+	}
+
+	// both nodes write concurrently
+	quotas[0].add(filepath.Join(tmpDir, "a"), 300, 1, 0)
+	quotas[1].add(filepath.Join(tmpDir, "b"), 200, 1, 0)
+	for _, c := range []*Coordinator{nodes[0], nodes[1], nodes[0]} {
+		if err := c.syncQuotas(now); err != nil {
+			t.Fatalf("syncQuotas() error = %v", err)
+		}
+	}
+	for i, q := range quotas {
+		if u := q.Usage()[0]; u.Used != 600 || u.Files != 3 {
+			t.Errorf("usage of node %d = %v bytes, %v files, want 600 bytes, 3 files", i, u.Used, u.Files)
+		}
+	}
+	if err := quotas[1].check(filepath.Join(tmpDir, "c"), 500); err != errQuotaExceeded {
+		t.Errorf("check() beyond the shared usage error = %v, want %v", err, errQuotaExceeded)
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCorsMethods are the methods allowed by a preflight unless Methods is set: the ones of
+// HTTP and WebDAV the handler serves.
+var defaultCorsMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS",
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "SEARCH",
+}
+
+// defaultCorsHeaders are the request headers allowed by a preflight unless Headers is set,
+// including the ones WebDAV clients send.
+var defaultCorsHeaders = []string{
+	"Authorization", "Content-Type", "Range", "If-Match", "If-None-Match", "If-Modified-Since",
+	"Depth", "Destination", "Overwrite", "If", "Lock-Token", "Timeout",
+}
+
+// defaultCorsExposedHeaders are the response headers scripts may read unless ExposedHeaders
+// is set, besides the ones browsers always expose.
+var defaultCorsExposedHeaders = []string{
+	"DAV", "ETag", "Lock-Token", "Location", "Content-Range", "Content-Length", "Accept-Ranges",
+}
+
+// Cors contains settings related to Cross-Origin Resource Sharing (CORS). Origin and Origins
+// are the origins allowed to access the server, '*' allows every origin. Methods, Headers and
+// ExposedHeaders replace the defaults of the methods and request headers a preflight allows
+// and of the response headers scripts may read. MaxAge is how long browsers may cache a
+// preflight.
+type Cors struct {
+	Origin         string
+	Origins        []string
+	Credentials    bool
+	Methods        []string
+	Headers        []string
+	ExposedHeaders []string
+	MaxAge         time.Duration
+}
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for the origin of a request
+// and whether the origin is allowed at all. Browsers refuse the wildcard for requests with
+// credentials, so the origin is repeated then.
+func (c *Cors) allowedOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	allowed := c.Origins
+	if c.Origin != "" {
+		allowed = append([]string{c.Origin}, allowed...)
+	}
+	for _, o := range allowed {
+		switch {
+		case o == "*" && !c.Credentials:
+			return "*", true
+		case o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin):
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// WriteHeaders adds the CORS headers to the response of a request of an allowed origin. It
+// returns whether the origin is allowed.
+func (c *Cors) WriteHeaders(w http.ResponseWriter, r *http.Request) bool {
+	if c.Origin == "" && len(c.Origins) == 0 {
+		return false
+	}
+	h := w.Header()
+	if !strings.Contains(strings.Join(h.Values("Vary"), ","), "Origin") {
+		h.Add("Vary", "Origin")
+	}
+	origin, ok := c.allowedOrigin(r.Header.Get("Origin"))
+	if !ok {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if c.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Expose-Headers", strings.Join(orDefault(c.ExposedHeaders, defaultCorsExposedHeaders), ", "))
+	return true
+}
+
+// preflight answers the preflight of a CORS request of an allowed origin, before the
+// authentication, since browsers don't send credentials with it. It returns whether the request
+// has been handled.
+func (c *Cors) preflight(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	if !c.WriteHeaders(w, r) {
+		return false
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Methods", strings.Join(orDefault(c.Methods, defaultCorsMethods), ", "))
+	h.Set("Access-Control-Allow-Headers", strings.Join(orDefault(c.Headers, defaultCorsHeaders), ", "))
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// orDefault returns the configured values or the defaults, if there are none.
+func orDefault(values, defaults []string) []string {
+	if len(values) == 0 {
+		return defaults
+	}
+	return values
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCorsAllowedOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		cors   Cors
+		origin string
+		want   string
+		wantOk bool
+	}{
+		{"disabled", Cors{}, "https://app.example.com", "", false},
+		{"wildcard", Cors{Origin: "*"}, "https://app.example.com", "*", true},
+		{"wildcard with credentials", Cors{Origin: "*", Credentials: true}, "https://app.example.com", "https://app.example.com", true},
+		{"listed", Cors{Origins: []string{"https://other.example.com", "https://App.example.com/"}}, "https://app.example.com", "https://app.example.com", true},
+		{"not listed", Cors{Origin: "https://other.example.com"}, "https://app.example.com", "", false},
+		{"without origin", Cors{Origin: "*"}, "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.cors.allowedOrigin(tt.origin)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("allowedOrigin(%s) = %s, %v, want %s, %v", tt.origin, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name        string
+		cors        Cors
+		origin      string
+		method      string
+		want        int
+		wantMethods string
+		wantHeaders string
+		wantMaxAge  string
+	}{
+		{"defaults", Cors{Origin: "https://app.example.com"}, "https://app.example.com", "PROPFIND", http.StatusNoContent,
+			"GET, HEAD, POST, PUT, DELETE, OPTIONS, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK, SEARCH",
+			"Authorization, Content-Type, Range, If-Match, If-None-Match, If-Modified-Since, Depth, Destination, Overwrite, If, Lock-Token, Timeout", ""},
+		{"configured", Cors{Origins: []string{"https://app.example.com"}, Methods: []string{"GET", "PROPFIND"}, Headers: []string{"Authorization", "Depth"}, MaxAge: time.Hour},
+			"https://app.example.com", "PROPFIND", http.StatusNoContent, "GET, PROPFIND", "Authorization, Depth", "3600"},
+		{"other origin", Cors{Origin: "https://app.example.com"}, "https://evil.example", "PROPFIND", http.StatusUnauthorized, "", "", ""},
+		{"no preflight", Cors{Origin: "https://app.example.com"}, "https://app.example.com", "", http.StatusUnauthorized, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Dir:   tmpDir,
+				Cors:  tt.cors,
+				Users: map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}},
+			}
+			a := newQuotaApp(t, cfg)
+			req := httptest.NewRequest("OPTIONS", "/", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.method != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.method)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Fatalf("OPTIONS = %d, want %d", w.Code, tt.want)
+			}
+			h := w.Header()
+			if h.Get("Access-Control-Allow-Methods") != tt.wantMethods || h.Get("Access-Control-Allow-Headers") != tt.wantHeaders ||
+				h.Get("Access-Control-Max-Age") != tt.wantMaxAge {
+				t.Errorf("OPTIONS headers = %v, want methods %q, headers %q, max age %q", h, tt.wantMethods, tt.wantHeaders, tt.wantMaxAge)
+			}
+			if allowed := h.Get("Access-Control-Allow-Origin") == tt.origin; allowed != (tt.want == http.StatusNoContent) {
+				t.Errorf("Access-Control-Allow-Origin = %q for origin %s", h.Get("Access-Control-Allow-Origin"), tt.origin)
+			}
+		})
+	}
+}
+
+func TestCorsWriteHeaders(t *testing.T) {
+	c := &Cors{Origin: "*", Credentials: true, ExposedHeaders: []string{"DAV", "ETag"}}
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+	if !c.WriteHeaders(w, req) || !c.WriteHeaders(w, req) {
+		t.Fatal("WriteHeaders() = false, want the origin to be allowed")
+	}
+	h := w.Header()
+	if h.Get("Access-Control-Allow-Origin") != "https://app.example.com" || h.Get("Access-Control-Allow-Credentials") != "true" ||
+		h.Get("Access-Control-Expose-Headers") != "DAV, ETag" || len(h.Values("Vary")) != 1 {
+		t.Errorf("WriteHeaders() headers = %v", h)
+	}
+}
@@ -0,0 +1,112 @@
+package app
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// maxRecentPauses limits the pauses of the garbage collector reported by the runtime stats.
+const maxRecentPauses = 10
+
+// runtimeStats describes the goroutines, the memory and the garbage collector of the process.
+type runtimeStats struct {
+	Goroutines int         `json:"goroutines"`
+	CPUs       int         `json:"cpus"`
+	GOMAXPROCS int         `json:"gomaxprocs"`
+	Memory     memoryStats `json:"memory"`
+	GC         gcStats     `json:"gc"`
+}
+
+// memoryStats are the memory of the process in bytes.
+type memoryStats struct {
+	Sys          uint64 `json:"sys"`
+	Alloc        uint64 `json:"alloc"`
+	TotalAlloc   uint64 `json:"totalAlloc"`
+	HeapInuse    uint64 `json:"heapInuse"`
+	HeapIdle     uint64 `json:"heapIdle"`
+	HeapReleased uint64 `json:"heapReleased"`
+	HeapObjects  uint64 `json:"heapObjects"`
+	StackInuse   uint64 `json:"stackInuse"`
+}
+
+type gcStats struct {
+	Runs         int64      `json:"runs"`
+	Last         *time.Time `json:"last,omitempty"`
+	NextHeap     uint64     `json:"nextHeap"`
+	PauseTotal   string     `json:"pauseTotal"`
+	RecentPauses []string   `json:"recentPauses"`
+	CPUFraction  float64    `json:"cpuFraction"`
+}
+
+// registerDebugHandlers serves the profiles of net/http/pprof and the runtime stats on the
+// admin API, so they're only reachable with the credentials of an admin. Importing pprof
+// registers them with the default mux as well, which no listener serves.
+func (a *App) registerDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc(adminAPIPrefix+"runtime", a.handleAdminRuntime)
+}
+
+// handleAdminRuntime reports the runtime stats. A POST collects the garbage and returns as
+// much memory to the operating system as possible before.
+func (a *App) handleAdminRuntime(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		username, _, _ := r.BasicAuth()
+		log.WithField("admin", username).Info("Freeing memory via admin API")
+		debug.FreeOSMemory()
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, readRuntimeStats())
+}
+
+func readRuntimeStats() runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	s := runtimeStats{
+		Goroutines: runtime.NumGoroutine(),
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Memory: memoryStats{
+			Sys:          m.Sys,
+			Alloc:        m.Alloc,
+			TotalAlloc:   m.TotalAlloc,
+			HeapInuse:    m.HeapInuse,
+			HeapIdle:     m.HeapIdle,
+			HeapReleased: m.HeapReleased,
+			HeapObjects:  m.HeapObjects,
+			StackInuse:   m.StackInuse,
+		},
+		GC: gcStats{
+			Runs:         gc.NumGC,
+			NextHeap:     m.NextGC,
+			PauseTotal:   gc.PauseTotal.String(),
+			RecentPauses: []string{},
+			CPUFraction:  m.GCCPUFraction,
+		},
+	}
+	if !gc.LastGC.IsZero() {
+		s.GC.Last = &gc.LastGC
+	}
+	// the pauses are ordered from the most recent one
+	for i, pause := range gc.Pause {
+		if i == maxRecentPauses {
+			break
+		}
+		s.GC.RecentPauses = append(s.GC.RecentPauses, pause.String())
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminDebug(t *testing.T) {
+	handler := NewAdminHandler(&App{
+		Config: &Config{Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}}},
+		Tracker: NewTracker(),
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		admin      bool
+		statusCode int
+		contains   string
+	}{
+		{"profiles without credentials", "GET", "/debug/pprof/", false, 401, ""},
+		{"profiles", "GET", "/debug/pprof/", true, 200, "goroutine"},
+		{"goroutine dump", "GET", "/debug/pprof/goroutine?debug=2", true, 200, "goroutine "},
+		{"heap profile", "GET", "/debug/pprof/heap?debug=1", true, 200, "heap profile"},
+		{"runtime without credentials", "GET", "/api/v1/runtime", false, 401, ""},
+		{"runtime", "GET", "/api/v1/runtime", true, 200, `"goroutines"`},
+		{"free memory", "POST", "/api/v1/runtime", true, 200, `"gc"`},
+		{"delete runtime", "DELETE", "/api/v1/runtime", true, 405, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.admin {
+				r.SetBasicAuth("root", "secret")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v. body = %s", w.Code, tt.statusCode, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("body doesn't contain %q: %.200s", tt.contains, w.Body)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/runtime", nil)
+	r.SetBasicAuth("root", "secret")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var stats runtimeStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("decoding the runtime stats: %v", err)
+	}
+	if stats.Goroutines == 0 || stats.GC.Runs == 0 || stats.GC.Last == nil || len(stats.GC.RecentPauses) == 0 || stats.Memory.Sys == 0 {
+		t.Errorf("runtime stats after collecting the garbage = %+v", stats)
+	}
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultDeletionExpiry is the time a deletion waits for its approval by default.
+const defaultDeletionExpiry = 7 * 24 * time.Hour
+
+var errDeletionPending = errors.New("deletion is pending approval")
+
+// DeletionApproval protects the directories, which are given relative to the base directory,
+// by a second step. Deleting a file or directory beneath them only requests its deletion,
+// the content stays in place until an admin approves the request via the admin API. Requests
+// which haven't been approved within Expiry are dropped. The requests are only kept in
+// memory, so a restart drops them as well.
+type DeletionApproval struct {
+	Directories []string
+	Expiry      time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*DeletionRequest
+}
+
+// DeletionRequest is a deletion waiting for its approval. The path is relative to the base
+// directory.
+type DeletionRequest struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	User      string    `json:"user,omitempty"`
+	Requested time.Time `json:"requested"`
+	Expires   time.Time `json:"expires"`
+}
+
+// protects returns whether removing the physical path needs an approval, as it's within or
+// contains a protected directory.
+func (da *DeletionApproval) protects(root, name string) bool {
+	if da == nil {
+		return false
+	}
+	for _, dir := range da.Directories {
+		dir = filepath.Join(root, filepath.FromSlash(path.Clean("/"+filepath.ToSlash(dir))))
+		if withinDir(name, dir) || withinDir(dir, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire drops the requests, which expired at the time. The lock has to be held.
+func (da *DeletionApproval) expire(now time.Time) {
+	for id, req := range da.pending {
+		if !now.Before(req.Expires) {
+			log.WithFields(log.Fields{"id": id, "path": req.Path, "user": req.User}).Info("Deletion request expired")
+			delete(da.pending, id)
+		}
+	}
+}
+
+// request records the deletion of a path by the user. A path, whose deletion is already
+// pending, isn't requested again.
+func (da *DeletionApproval) request(p, user string, now time.Time) (*DeletionRequest, error) {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	da.expire(now)
+	for _, req := range da.pending {
+		if req.Path == p {
+			return req, nil
+		}
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	expiry := da.Expiry
+	if expiry <= 0 {
+		expiry = defaultDeletionExpiry
+	}
+	req := &DeletionRequest{ID: hex.EncodeToString(id), Path: p, User: user, Requested: now, Expires: now.Add(expiry)}
+	if da.pending == nil {
+		da.pending = map[string]*DeletionRequest{}
+	}
+	da.pending[req.ID] = req
+	return req, nil
+}
+
+// requests returns the pending requests sorted by the time they were requested.
+func (da *DeletionApproval) requests(now time.Time) []*DeletionRequest {
+	if da == nil {
+		return []*DeletionRequest{}
+	}
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	da.expire(now)
+	requests := []*DeletionRequest{}
+	for _, req := range da.pending {
+		requests = append(requests, req)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Requested.Before(requests[j].Requested) })
+	return requests
+}
+
+// take removes the pending request with the id and returns it, or nil if there is none.
+func (da *DeletionApproval) take(id string, now time.Time) *DeletionRequest {
+	if da == nil {
+		return nil
+	}
+	da.mu.Lock()
+	defer da.mu.Unlock()
+	da.expire(now)
+	req := da.pending[id]
+	delete(da.pending, id)
+	return req
+}
+
+// withDeletionApproved lets the file operations of the context delete protected paths.
+func withDeletionApproved(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deletionApprovedKey, true)
+}
+
+// requestDeletion returns errDeletionPending after requesting the deletion of the physical
+// path, if the deletion needs an approval.
+func (d Dir) requestDeletion(ctx context.Context, name string) error {
+	da := d.Config.DeletionApproval
+	if !da.protects(d.Config.Dir, name) || ctx.Value(deletionApprovedKey) != nil {
+		return nil
+	}
+	if _, err := d.Config.storage().Lstat(name); err != nil {
+		return nil
+	}
+	state := rejectionFromContext(ctx)
+	if state != nil && state.method != http.MethodDelete {
+		// replacing a protected path, e.g. by a move, can't wait for the approval
+		traceStep(ctx, "%s can only be deleted with approval", name)
+		state.reject(http.StatusForbidden)
+		return errDeletionPending
+	}
+	rel, err := filepath.Rel(filepath.Clean(d.Config.Dir), name)
+	if err != nil {
+		return err
+	}
+	user := d.resolveUser(ctx)
+	req, err := da.request(path.Clean("/"+filepath.ToSlash(rel)), user, time.Now())
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"id": req.ID, "path": req.Path, "user": user}).Warn("Requested deletion, waiting for approval")
+	traceStep(ctx, "deletion of %s is pending approval %s", name, req.ID)
+	state.reject(http.StatusAccepted)
+	return errDeletionPending
+}
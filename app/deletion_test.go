@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeletionApproval(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice", "contracts", "2024"), 0700)
+	defer os.RemoveAll(tmpDir)
+	for _, name := range []string{"contracts/a.pdf", "contracts/b.pdf", "contracts/2024/c.pdf", "notes.txt"} {
+		ioutil.WriteFile(filepath.Join(tmpDir, "alice", name), []byte("content"), 0600)
+	}
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:              tmpDir,
+		Realm:            "dave",
+		DeletionApproval: &DeletionApproval{Directories: []string{"/alice/contracts"}, Expiry: time.Hour},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+		Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}},
+	}
+	a := newQuotaApp(t, cfg)
+	do := func(method, target string, header ...string) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth("alice", "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w.Code
+	}
+	admin := NewAdminHandler(a)
+	doAdmin := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth("root", "secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(tmpDir, "alice", name))
+		return err == nil
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header []string
+		want   int
+	}{
+		{"delete", "DELETE", "/contracts/a.pdf", nil, http.StatusAccepted},
+		{"delete again", "DELETE", "/contracts/a.pdf", nil, http.StatusAccepted},
+		{"delete directory", "DELETE", "/contracts/2024", nil, http.StatusAccepted},
+		{"delete missing", "DELETE", "/contracts/missing.pdf", nil, http.StatusNotFound},
+		{"move onto", "MOVE", "/notes.txt", []string{"Destination", "/contracts/b.pdf", "Overwrite", "T"}, http.StatusForbidden},
+		{"unprotected", "DELETE", "/notes.txt", nil, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := do(tt.method, tt.target, tt.header...); got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !exists("contracts/a.pdf") || !exists("contracts/2024/c.pdf") || !exists("contracts/b.pdf") {
+		t.Fatal("pending deletions removed the content")
+	}
+
+	var requests []*DeletionRequest
+	json.Unmarshal(doAdmin("GET", "/api/v1/deletions").Body.Bytes(), &requests)
+	if len(requests) != 2 || requests[0].Path != "/alice/contracts/a.pdf" || requests[0].User != "alice" {
+		t.Fatalf("deletion requests = %+v, want the requests of a.pdf and 2024", requests)
+	}
+	if w := doAdmin("POST", "/api/v1/deletions/"+requests[0].ID); w.Code != http.StatusNoContent {
+		t.Errorf("approval status = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if exists("contracts/a.pdf") {
+		t.Error("approved deletion kept the file")
+	}
+	if w := doAdmin("DELETE", "/api/v1/deletions/"+requests[1].ID); w.Code != http.StatusNoContent {
+		t.Errorf("dismissal status = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if !exists("contracts/2024/c.pdf") {
+		t.Error("dismissed deletion removed the directory")
+	}
+	if w := doAdmin("POST", "/api/v1/deletions/"+requests[0].ID); w.Code != http.StatusNotFound {
+		t.Errorf("second approval status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	do("DELETE", "/contracts/b.pdf")
+	if requests := cfg.DeletionApproval.requests(time.Now().Add(2 * time.Hour)); len(requests) != 0 {
+		t.Errorf("requests after the expiry = %+v, want none", requests)
+	}
+	if w := doAdmin("GET", "/api/v1/deletions"); !strings.HasPrefix(w.Body.String(), "[]") {
+		t.Errorf("deletion requests after the expiry = %s, want none", w.Body.String())
+	}
+}
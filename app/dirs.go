@@ -0,0 +1,109 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkDirs verifies, that the base dir exists and is writable, that the shared folder is a
+// directory and that the subdirs of the users and the guests are directories within the base
+// dir. Missing dirs are created, if CreateDirs is set. The problems of all users are returned
+// at once.
+func (cfg *Config) checkDirs() error {
+	base := cfg.Dir
+	if base == "" {
+		base = "."
+	}
+	if err := cfg.checkDir(base, "base dir"); err != nil {
+		return err
+	}
+	if err := cfg.SharedFolder.validate(); err != nil {
+		return err
+	}
+	if err := cfg.validateExports(); err != nil {
+		return err
+	}
+	if cfg.ContentStore != nil {
+		// the subdirs are directories of the index of the content store
+		return nil
+	}
+
+	users := cfg.UsersCopy()
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		user := users[name]
+		if user.Subdir == nil {
+			continue
+		}
+		path := filepath.Join(base, *user.Subdir)
+		if rel, err := filepath.Rel(base, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			errs = append(errs, fmt.Errorf("subdir %s of user %s is outside of the base dir %s", *user.Subdir, name, base))
+			continue
+		}
+		if err := cfg.checkDir(path, "subdir of user "+name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if g := cfg.Guest; g != nil && g.Subdir != nil {
+		path := filepath.Join(base, *g.Subdir)
+		if rel, err := filepath.Rel(base, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			errs = append(errs, fmt.Errorf("subdir %s of the guests is outside of the base dir %s", *g.Subdir, base))
+		} else if err := cfg.checkDir(path, "subdir of the guests"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkDir verifies, that path is a writable directory, and creates it, if it's missing and
+// CreateDirs is set. The writability isn't checked in dry run mode, which doesn't write, and
+// within the object store, which has no permissions.
+func (cfg *Config) checkDir(path, desc string) error {
+	files := cfg.storage()
+	fi, err := files.Stat(path)
+	if os.IsNotExist(err) && cfg.CreateDirs {
+		if err := files.MkdirAll(path, os.ModePerm); err != nil {
+			return fmt.Errorf("can't create %s %s: %w", desc, path, err)
+		}
+		log.WithField("path", path).Infof("Created %s", desc)
+		fi, err = files.Stat(path)
+	}
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s %s doesn't exist", desc, path)
+	} else if err != nil {
+		return fmt.Errorf("can't access %s %s: %w", desc, path, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s %s is not a directory", desc, path)
+	}
+	if _, local := files.(localStorage); !local || cfg.dryRun() {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(path, ".dave-check-")
+	if err != nil {
+		return fmt.Errorf("%s %s isn't writable: %w", desc, path, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// ensureUserDirs checks the dirs after the users changed at runtime. Unlike at startup, the
+// problems are only logged, since the server keeps serving the other users.
+func (cfg *Config) ensureUserDirs() {
+	if err := cfg.checkDirs(); err != nil {
+		log.WithError(err).Warn("Invalid user dirs")
+	}
+}
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDirs(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "base", "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "base", "file"), nil, 0600)
+
+	subdir := func(s string) map[string]*UserInfo {
+		return map[string]*UserInfo{"bob": {Subdir: &s}}
+	}
+	tests := []struct {
+		name       string
+		dir        string
+		createDirs bool
+		users      map[string]*UserInfo
+		wantErr    string
+		created    string
+	}{
+		{"existing dirs", "base", false, subdir("alice"), "", ""},
+		{"missing base dir", "missing", false, nil, "base dir " + filepath.Join(tmpDir, "missing") + " doesn't exist", ""},
+		{"created base dir", "new/base", true, nil, "", "new/base"},
+		{"base dir is a file", "base/file", true, nil, "is not a directory", ""},
+		{"missing subdir", "base", false, subdir("bob"), "subdir of user bob", ""},
+		{"created subdir", "base", true, subdir("/bob/files"), "", "base/bob/files"},
+		{"subdir is a file", "base", true, subdir("file"), "is not a directory", ""},
+		{"subdir outside of the base dir", "base", true, subdir("../outside"), "outside of the base dir", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Dir: filepath.Join(tmpDir, tt.dir), CreateDirs: tt.createDirs, Users: tt.users}
+			err := cfg.checkDirs()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("checkDirs() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("checkDirs() error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.created != "" {
+				if fi, err := os.Stat(filepath.Join(tmpDir, tt.created)); err != nil || !fi.IsDir() {
+					t.Errorf("%s hasn't been created", tt.created)
+				}
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "outside")); !os.IsNotExist(err) {
+		t.Error("subdir outside of the base dir has been created")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(tmpDir, "base", "alice")); len(files) != 0 {
+		t.Errorf("files left by the check: %v", files)
+	}
+
+	// root may write to any directory
+	if os.Geteuid() > 0 {
+		readOnly := filepath.Join(tmpDir, "readonly")
+		os.Mkdir(readOnly, 0500)
+		cfg := &Config{Dir: readOnly}
+		if err := cfg.checkDirs(); err == nil || !strings.Contains(err.Error(), "isn't writable") {
+			t.Errorf("checkDirs() of a read-only dir error = %v", err)
+		}
+		cfg.DryRun = true
+		if err := cfg.checkDirs(); err != nil {
+			t.Errorf("checkDirs() of a read-only dir in dry run mode error = %v", err)
+		}
+	}
+}
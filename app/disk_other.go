@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package app
+
+import "errors"
+
+// DiskUsage isn't supported on this platform and always returns an error.
+func DiskUsage(path string) (free uint64, total uint64, err error) {
+	return 0, 0, errors.New("disk usage is not supported on this platform")
+}
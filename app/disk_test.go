@@ -0,0 +1,20 @@
+package app
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	free, total, err := DiskUsage(os.TempDir())
+	if err != nil {
+		t.Fatalf("DiskUsage() error = %v", err)
+	}
+	if total == 0 || free > total {
+		t.Errorf("DiskUsage() free = %v, total = %v", free, total)
+	}
+
+	if _, _, err := DiskUsage("/does/not/exist/at/all"); err == nil {
+		t.Errorf("DiskUsage() of missing path succeeded")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build windows
+// +build windows
+
+package app
+
+import "golang.org/x/sys/windows"
+
+// DiskUsage returns the available and the total number of bytes of the file system
+// the given path is located on.
+func DiskUsage(path string) (free uint64, total uint64, err error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, &total, &totalFree); err != nil {
+		return 0, 0, err
+	}
+
+	return free, total, nil
+}
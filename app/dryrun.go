@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// writeFlags are the flags of os.OpenFile which indicate a modifying access.
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_CREATE | os.O_TRUNC | os.O_APPEND
+
+// logDryRun logs a write operation which has been authorized, but not executed because
+// the dry run mode is enabled. These are logged independent of the log settings, because
+// they are the purpose of the dry run mode.
+func (d Dir) logDryRun(ctx context.Context, msg string, fields log.Fields) {
+	fields["user"] = d.resolveUser(ctx)
+	fields["dryRun"] = true
+	log.WithFields(fields).Info(msg)
+}
+
+// dryRunFile is returned by Dir.OpenFile in dry run mode, if a file is opened for writing.
+// It accepts and discards all written content.
+type dryRunFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f *dryRunFile) Close() error {
+	return nil
+}
+
+func (f *dryRunFile) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *dryRunFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *dryRunFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, nil
+}
+
+func (f *dryRunFile) Stat() (os.FileInfo, error) {
+	return dryRunFileInfo{f}, nil
+}
+
+func (f *dryRunFile) Write(p []byte) (int, error) {
+	f.size += int64(len(p))
+	return len(p), nil
+}
+
+type dryRunFileInfo struct {
+	f *dryRunFile
+}
+
+func (fi dryRunFileInfo) Name() string       { return filepath.Base(fi.f.name) }
+func (fi dryRunFileInfo) Size() int64        { return fi.f.size }
+func (fi dryRunFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi dryRunFileInfo) ModTime() time.Time { return fi.f.modTime }
+func (fi dryRunFileInfo) IsDir() bool        { return false }
+func (fi dryRunFileInfo) Sys() interface{}   { return nil }
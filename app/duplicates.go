@@ -0,0 +1,275 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	daveplugin "github.com/micromata/dave/plugin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Actions on duplicate uploads
+const (
+	DuplicateFlag = "flag"
+	DuplicateSkip = "skip"
+)
+
+// Duplicates detects uploads beneath the directories, whose content the user already stored
+// beneath the same directory. The directories are given as seen by the users, so they apply
+// to the subdir of every user. Duplicates are flagged by the X-Duplicate-Of header of the
+// response and the Webhook, with the Action skip the second copy isn't kept either.
+type Duplicates struct {
+	Directories []string
+	Action      string
+	Webhook     string
+
+	mu      sync.Mutex
+	indexes map[string]*duplicateIndex
+}
+
+// duplicateIndex maps the hashes of the contents of the files beneath a physical directory to
+// the files. It's built by hashing all files once, when it's used first.
+type duplicateIndex struct {
+	dir   string
+	store storage
+	once  sync.Once
+
+	mu    sync.Mutex
+	files map[string][]duplicateEntry
+}
+
+// duplicateEntry is a file of the index, which is only reported as long as it's unchanged.
+type duplicateEntry struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// duplicateEvent is the payload of the webhook of the duplicates.
+type duplicateEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	User        string    `json:"user,omitempty"`
+	Path        string    `json:"path"`
+	DuplicateOf string    `json:"duplicateOf"`
+	Hash        string    `json:"hash"`
+	Action      string    `json:"action"`
+}
+
+// checkDuplicates returns an error, if the action on duplicates is unknown.
+func (cfg *Config) checkDuplicates() error {
+	if d := cfg.Duplicates; d != nil && d.Action != DuplicateFlag && d.Action != DuplicateSkip {
+		return fmt.Errorf("unknown action %q on duplicate uploads", d.Action)
+	}
+	return nil
+}
+
+// withDuplicates passes the header of the response to the file operations of the request, so
+// duplicate uploads are flagged in it.
+func (d *Duplicates) withDuplicates(ctx context.Context, w http.ResponseWriter) context.Context {
+	if d == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, duplicateKey, w.Header())
+}
+
+// index returns the index of the physical directory within the storage.
+func (d *Duplicates) index(files storage, dir string) *duplicateIndex {
+	d.mu.Lock()
+	if d.indexes == nil {
+		d.indexes = map[string]*duplicateIndex{}
+	}
+	idx := d.indexes[dir]
+	if idx == nil {
+		idx = &duplicateIndex{dir: dir, store: files, files: map[string][]duplicateEntry{}}
+		d.indexes[dir] = idx
+	}
+	d.mu.Unlock()
+
+	idx.once.Do(idx.build)
+	return idx
+}
+
+// build hashes the files beneath the directory.
+func (i *duplicateIndex) build() {
+	started := time.Now()
+	i.store.Walk(i.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+			return nil
+		}
+		f, err := i.store.OpenFile(p, os.O_RDONLY, 0)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err == nil {
+			i.add(hex.EncodeToString(h.Sum(nil)), p, fi)
+		}
+		return nil
+	})
+	log.WithField("path", i.dir).WithField("duration", time.Since(started).String()).Info("Indexed contents for duplicate detection")
+}
+
+// add adds the file with the hash to the index, replacing its previous entry.
+func (i *duplicateIndex) add(sum, name string, fi os.FileInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entry := duplicateEntry{name: name, size: fi.Size(), modTime: fi.ModTime()}
+	for j, e := range i.files[sum] {
+		if e.name == name {
+			i.files[sum][j] = entry
+			return
+		}
+	}
+	i.files[sum] = append(i.files[sum], entry)
+}
+
+// find returns another file with the hash, which hasn't changed since it has been indexed.
+// Changed files are dropped from the index.
+func (i *duplicateIndex) find(sum, name string) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	var found string
+	entries := i.files[sum][:0]
+	for _, e := range i.files[sum] {
+		if fi, err := i.store.Stat(e.name); err != nil || fi.Size() != e.size || !fi.ModTime().Equal(e.modTime) {
+			if e.name != name {
+				continue
+			}
+		} else if found == "" && e.name != name {
+			found = e.name
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		delete(i.files, sum)
+	} else {
+		i.files[sum] = entries
+	}
+	return found
+}
+
+// duplicateScope returns the physical path and the path as seen by the user of the innermost
+// duplicate directory containing the physical file.
+func (d Dir) duplicateScope(ctx context.Context, name string) (string, string) {
+	var dir, virtual string
+	for _, v := range d.Config.Duplicates.Directories {
+		v = path.Clean("/" + v)
+		p := d.resolve(ctx, v)
+		if p != "" && p != name && withinDir(name, p) && len(p) > len(dir) {
+			dir, virtual = p, v
+		}
+	}
+	return dir, virtual
+}
+
+// openDuplicateFile returns a file hashing the content written to the physical file, if it's
+// written as a whole beneath a duplicate directory.
+func (d Dir) openDuplicateFile(ctx context.Context, f webdav.File, name string, flag int) webdav.File {
+	if d.Config.Duplicates == nil || flag&os.O_TRUNC == 0 || flag&os.O_APPEND != 0 {
+		return f
+	}
+	dir, virtual := d.duplicateScope(ctx, name)
+	if dir == "" {
+		return f
+	}
+	return &duplicateFile{File: f, ctx: ctx, fs: d, name: name, dir: dir, virtual: virtual, hash: sha256.New()}
+}
+
+// duplicateFile hashes the content written to a file and checks it for being a duplicate,
+// when it's closed. Seeking elsewhere than to the end of the written content stops hashing.
+type duplicateFile struct {
+	webdav.File
+	ctx     context.Context
+	fs      Dir
+	name    string
+	dir     string
+	virtual string
+	hash    hash.Hash
+	written int64
+}
+
+func (f *duplicateFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if f.hash != nil {
+		f.hash.Write(p[:n])
+		f.written += int64(n)
+	}
+	return n, err
+}
+
+func (f *duplicateFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err != nil || pos != f.written {
+		f.hash = nil
+	}
+	return pos, err
+}
+
+func (f *duplicateFile) Close() error {
+	err := f.File.Close()
+	if err != nil || f.hash == nil || f.written == 0 {
+		return err
+	}
+	fi, statErr := f.fs.Config.storage().Stat(f.name)
+	if statErr != nil || fi.Size() != f.written {
+		return err
+	}
+
+	sum := hex.EncodeToString(f.hash.Sum(nil))
+	idx := f.fs.Config.Duplicates.index(f.fs.Config.storage(), f.dir)
+	original := idx.find(sum, f.name)
+	if original == "" {
+		idx.add(sum, f.name, fi)
+		return nil
+	}
+	f.fs.duplicate(f.ctx, f.name, f.virtualPath(f.name), f.virtualPath(original), sum)
+	return nil
+}
+
+// virtualPath returns the path as seen by the user of the physical file.
+func (f *duplicateFile) virtualPath(name string) string {
+	rel, _ := filepath.Rel(f.dir, name)
+	return path.Join(f.virtual, filepath.ToSlash(rel))
+}
+
+// duplicate flags the upload of the physical file, whose content is the one of the original,
+// and removes it with the action skip.
+func (d Dir) duplicate(ctx context.Context, name, virtual, original, sum string) {
+	settings := d.Config.Duplicates
+	user := d.resolveUser(ctx)
+	traceStep(ctx, "upload of %s is a duplicate of %s", virtual, original)
+	log.WithFields(fingerprintFields(ctx, log.Fields{"path": virtual, "duplicateOf": original, "user": user, "action": settings.Action})).Info("Detected duplicate upload")
+	if header, ok := ctx.Value(duplicateKey).(http.Header); ok {
+		header.Set("X-Duplicate-Of", original)
+	}
+	if settings.Webhook != "" {
+		postWebhook(settings.Webhook, &duplicateEvent{
+			Event: "duplicate", Time: time.Now(), User: user, Path: virtual, DuplicateOf: original, Hash: sum, Action: settings.Action,
+		})
+	}
+	if settings.Action != DuplicateSkip {
+		return
+	}
+
+	revert := d.Quotas.remove(ctx, name)
+	if err := d.Config.storage().Remove(name); err != nil {
+		revert()
+		log.WithField("path", name).WithError(err).Error("Error removing duplicate upload")
+		return
+	}
+	d.Sync.record(name, false)
+	d.Replica.changed(name, false)
+	d.publish(ctx, daveplugin.EventDelete, name, "")
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicates(t *testing.T) {
+	events := make(chan duplicateEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event duplicateEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer receiver.Close()
+
+	for _, action := range []string{DuplicateFlag, DuplicateSkip} {
+		t.Run(action, func(t *testing.T) {
+			tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+			os.MkdirAll(filepath.Join(tmpDir, "alice", "photos"), 0700)
+			os.MkdirAll(filepath.Join(tmpDir, "alice", "other"), 0700)
+			os.MkdirAll(filepath.Join(tmpDir, "bob", "photos"), 0700)
+			defer os.RemoveAll(tmpDir)
+			ioutil.WriteFile(filepath.Join(tmpDir, "alice", "photos", "old.jpg"), []byte("old photo"), 0600)
+
+			alice, bob := "/alice", "/bob"
+			cfg := &Config{
+				Dir:   tmpDir,
+				Realm: "dave",
+				Users: map[string]*UserInfo{
+					"alice": {Password: GenHash([]byte("password")), Subdir: &alice},
+					"bob":   {Password: GenHash([]byte("password")), Subdir: &bob},
+				},
+				Duplicates: &Duplicates{Directories: []string{"/photos"}, Action: action, Webhook: receiver.URL},
+			}
+			a := newQuotaApp(t, cfg)
+
+			tests := []struct {
+				name    string
+				user    string
+				target  string
+				content string
+				want    string
+			}{
+				{"new content", "alice", "/photos/a.jpg", "photo", ""},
+				{"content of an upload", "alice", "/photos/sub/b.jpg", "photo", "/photos/a.jpg"},
+				{"content of an existing file", "alice", "/photos/new.jpg", "old photo", "/photos/old.jpg"},
+				{"same file again", "alice", "/photos/a.jpg", "photo", ""},
+				{"outside the directory", "alice", "/other/c.jpg", "photo", ""},
+				{"content of another user", "bob", "/photos/a.jpg", "photo", ""},
+			}
+			for _, tt := range tests {
+				if tt.name == "content of an upload" {
+					os.MkdirAll(filepath.Join(tmpDir, "alice", "photos", "sub"), 0700)
+				}
+				req := httptest.NewRequest("PUT", tt.target, strings.NewReader(tt.content))
+				req.SetBasicAuth(tt.user, "password")
+				w := httptest.NewRecorder()
+				handle(context.Background(), w, req, a)
+				if w.Code != http.StatusCreated || w.Header().Get("X-Duplicate-Of") != tt.want {
+					t.Errorf("%s: response = %v with duplicate of %q, want %v with %q", tt.name, w.Code, w.Header().Get("X-Duplicate-Of"), http.StatusCreated, tt.want)
+				}
+				_, err := os.Stat(filepath.Join(tmpDir, tt.user, filepath.FromSlash(tt.target)))
+				if stored := err == nil; stored != (tt.want == "" || action == DuplicateFlag) {
+					t.Errorf("%s: stored = %v with action %s", tt.name, stored, action)
+				}
+				if tt.want == "" {
+					continue
+				}
+				select {
+				case event := <-events:
+					if event.Event != "duplicate" || event.User != tt.user || event.Path != tt.target || event.DuplicateOf != tt.want || event.Action != action {
+						t.Errorf("%s: event = %+v", tt.name, event)
+					}
+				case <-time.After(5 * time.Second):
+					t.Errorf("%s: no webhook event", tt.name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,637 @@
+package app
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the encrypted folders
+const (
+	defaultEncryptionIdleTimeout = 30 * time.Minute
+	encryptionPrefix             = "/.encryption/"
+	encryptionMinPassphrase      = 8
+
+	// encryptionHeaderName is the file within an encrypted folder, which holds the salt of the
+	// key and a value to verify the passphrase.
+	encryptionHeaderName = ".dave-encrypted"
+
+	// The files are sealed in chunks, so they can be read at any offset. Each file starts with
+	// the magic and a random nonce prefix, which is completed by the index of the chunk.
+	encryptedMagic      = "DAVEENC1"
+	encryptedNonceSize  = 8
+	encryptedHeaderSize = len(encryptedMagic) + encryptedNonceSize
+	encryptedChunkSize  = 64 * 1024
+	encryptedTagSize    = 16
+	encryptedSealedSize = encryptedChunkSize + encryptedTagSize
+)
+
+var (
+	errFolderLocked    = errors.New("encrypted folder is locked")
+	errNotEncrypted    = errors.New("file of encrypted folder isn't encrypted")
+	errEncryptedWrite  = errors.New("files of encrypted folders can only be written as a whole")
+	errEncryptedMove   = errors.New("files can't be moved into or out of encrypted folders")
+	errWrongPassphrase = errors.New("wrong passphrase")
+	errShortPassphrase = fmt.Errorf("the passphrase needs at least %d characters", encryptionMinPassphrase)
+)
+
+// Encryption enables the encrypted folders of the users, which are listed by the Encrypted
+// entry of a user. The files within these folders are encrypted with a key derived from a
+// passphrase of the user, which differs from the password. The passphrase is never stored,
+// the folder is unlocked with it below /.encryption/ and the key is only kept in memory until
+// the folder is locked again or hasn't been used for IdleTimeout.
+type Encryption struct {
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*folderKey
+}
+
+// folderKey is the key of an unlocked folder.
+type folderKey struct {
+	key  []byte
+	used time.Time
+}
+
+// encryptionHeader is the content of the header file of an encrypted folder.
+type encryptionHeader struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Check   []byte `json:"check"`
+}
+
+// encryptedFolder is the encrypted folder containing a physical path. The key is nil, while
+// the folder is locked.
+type encryptedFolder struct {
+	dir string
+	key []byte
+}
+
+// encryptedFolder returns the encrypted folder of the user, which contains the physical path
+// or is the path itself. It returns nil for paths outside of encrypted folders.
+func (d Dir) encryptedFolder(ctx context.Context, name string) *encryptedFolder {
+	enc := d.Config.Encryption
+	user := d.resolveUser(ctx)
+	if enc == nil || user == "" {
+		return nil
+	}
+	userInfo := d.Config.User(user)
+	if userInfo == nil {
+		return nil
+	}
+	for _, folder := range userInfo.Encrypted {
+		dir := d.resolve(ctx, folder)
+		if dir != "" && withinDir(name, dir) {
+			return &encryptedFolder{dir: dir, key: enc.key(user, dir, time.Now())}
+		}
+	}
+	return nil
+}
+
+// access checks, whether the physical path within the folder can be accessed. The header
+// file is hidden and the members of locked folders can't be accessed.
+func (f *encryptedFolder) access(name string) error {
+	if f == nil || name == f.dir {
+		return nil
+	}
+	if name == filepath.Join(f.dir, encryptionHeaderName) {
+		return os.ErrNotExist
+	}
+	if f.key == nil {
+		return errFolderLocked
+	}
+	return nil
+}
+
+// checkEncryptedRename allows renames within the same unlocked folder only, so no plain
+// files end up within an encrypted folder and no encrypted ones outside of it. The folders
+// themselves can't be renamed.
+func (d Dir) checkEncryptedRename(ctx context.Context, oldName, newName string) error {
+	oldFolder, newFolder := d.encryptedFolder(ctx, oldName), d.encryptedFolder(ctx, newName)
+	if oldFolder == nil && newFolder == nil {
+		return nil
+	}
+	if oldFolder == nil || newFolder == nil || oldFolder.dir != newFolder.dir ||
+		oldName == oldFolder.dir || newName == newFolder.dir {
+		return errEncryptedMove
+	}
+	if err := oldFolder.access(oldName); err != nil {
+		return err
+	}
+	return newFolder.access(newName)
+}
+
+// key returns the key of an unlocked folder and renews its idle timeout.
+func (enc *Encryption) key(user, dir string, now time.Time) []byte {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	id := user + "\x00" + dir
+	k := enc.keys[id]
+	if k == nil {
+		return nil
+	}
+	timeout := enc.IdleTimeout
+	if timeout <= 0 {
+		timeout = defaultEncryptionIdleTimeout
+	}
+	if now.Sub(k.used) > timeout {
+		delete(enc.keys, id)
+		return nil
+	}
+	k.used = now
+	return k.key
+}
+
+// unlock derives the key of the folder from the passphrase and keeps it. A folder without
+// header is initialized with the passphrase.
+func (enc *Encryption) unlock(user, dir, passphrase string) error {
+	headerPath := filepath.Join(dir, encryptionHeaderName)
+	var header encryptionHeader
+	data, err := ioutil.ReadFile(headerPath)
+	if os.IsNotExist(err) {
+		if len(passphrase) < encryptionMinPassphrase {
+			return errShortPassphrase
+		}
+		return enc.initialize(user, dir, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &header); err != nil || header.Version != 1 {
+		return fmt.Errorf("invalid header of encrypted folder %s", dir)
+	}
+
+	key := deriveFolderKey(passphrase, header.Salt)
+	aead, err := newFolderAEAD(key)
+	if err != nil {
+		return err
+	}
+	if len(header.Check) < aead.NonceSize() {
+		return fmt.Errorf("invalid header of encrypted folder %s", dir)
+	}
+	if _, err := aead.Open(nil, header.Check[:aead.NonceSize()], header.Check[aead.NonceSize():], nil); err != nil {
+		return errWrongPassphrase
+	}
+	enc.store(user, dir, key)
+	return nil
+}
+
+func (enc *Encryption) initialize(user, dir, passphrase string) error {
+	header := encryptionHeader{Version: 1, Salt: make([]byte, argon2SaltLen)}
+	if _, err := rand.Read(header.Salt); err != nil {
+		return err
+	}
+	key := deriveFolderKey(passphrase, header.Salt)
+	aead, err := newFolderAEAD(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	header.Check = aead.Seal(nonce, nonce, []byte(encryptedMagic), nil)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(header)
+	if err := writeFileAtomic(filepath.Join(dir, encryptionHeaderName), data); err != nil {
+		return err
+	}
+	enc.store(user, dir, key)
+	log.WithField("user", user).WithField("path", dir).Info("Initialized encrypted folder")
+	return nil
+}
+
+func (enc *Encryption) store(user, dir string, key []byte) {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	if enc.keys == nil {
+		enc.keys = map[string]*folderKey{}
+	}
+	enc.keys[user+"\x00"+dir] = &folderKey{key: key, used: time.Now()}
+}
+
+// lock forgets the key of the folder.
+func (enc *Encryption) lock(user, dir string) {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+	delete(enc.keys, user+"\x00"+dir)
+}
+
+func deriveFolderKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, 3, argon2Memory, argon2Threads, argon2KeyLen)
+}
+
+func newFolderAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// plainSize returns the size of the content of an encrypted file of the given size.
+func plainSize(size int64) int64 {
+	n := size - int64(encryptedHeaderSize)
+	if n < encryptedTagSize {
+		return 0
+	}
+	full, rem := n/encryptedSealedSize, n%encryptedSealedSize
+	if rem == 0 {
+		return full * encryptedChunkSize
+	}
+	return full*encryptedChunkSize + rem - encryptedTagSize
+}
+
+// chunkNonce returns the nonce of a chunk of a file.
+func chunkNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedNonceSize:], uint32(index))
+	return nonce
+}
+
+// chunkAAD marks the last chunk, so truncated files are detected.
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// openFile opens a file within the folder. Directories list the sizes of the
+// content of their files, files are decrypted while read and encrypted while written.
+func (f *encryptedFolder) openFile(name string, flag int, open func() (webdav.File, error)) (webdav.File, error) {
+	if flag&writeFlags != 0 && name != f.dir {
+		// the chunks can't be changed in place, so files are only written from the start
+		if fi, err := os.Stat(name); err == nil && !fi.IsDir() && fi.Size() > 0 && flag&os.O_TRUNC == 0 {
+			return nil, errEncryptedWrite
+		}
+		file, err := open()
+		if err != nil {
+			return nil, err
+		}
+		return newEncryptedWriter(file, f.key)
+	}
+
+	file, err := open()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &encryptedDir{File: file, root: name == f.dir, locked: f.key == nil}, nil
+	}
+	return newEncryptedReader(file, fi, f.key)
+}
+
+// encryptedFileInfo reports the size of the content of an encrypted file.
+type encryptedFileInfo struct {
+	os.FileInfo
+}
+
+func (fi encryptedFileInfo) Size() int64 {
+	return plainSize(fi.FileInfo.Size())
+}
+
+// encryptedInfo returns the info of a member of an encrypted folder.
+func encryptedInfo(fi os.FileInfo) os.FileInfo {
+	if !fi.Mode().IsRegular() {
+		return fi
+	}
+	return encryptedFileInfo{fi}
+}
+
+// encryptedDir is a directory of an encrypted folder. The root of a locked folder appears
+// empty, so it can still be listed within its parent.
+type encryptedDir struct {
+	webdav.File
+	root   bool
+	locked bool
+}
+
+func (d *encryptedDir) Readdir(count int) ([]os.FileInfo, error) {
+	if d.locked {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	children, err := d.File.Readdir(count)
+	infos := make([]os.FileInfo, 0, len(children))
+	for _, child := range children {
+		if d.root && child.Name() == encryptionHeaderName {
+			continue
+		}
+		infos = append(infos, encryptedInfo(child))
+	}
+	return infos, err
+}
+
+// encryptedReader decrypts an encrypted file chunk by chunk.
+type encryptedReader struct {
+	webdav.File
+	aead   cipher.AEAD
+	fi     os.FileInfo
+	prefix []byte
+	size   int64
+	chunks int64
+	pos    int64
+
+	index int64
+	chunk []byte
+}
+
+func newEncryptedReader(file webdav.File, fi os.FileInfo, key []byte) (webdav.File, error) {
+	r := &encryptedReader{File: file, fi: fi, index: -1}
+	if fi.Size() == 0 {
+		// empty files don't reveal anything, e.g. when created outside of dave
+		return r, nil
+	}
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		file.Close()
+		return nil, errNotEncrypted
+	}
+	aead, err := newFolderAEAD(key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.aead, r.prefix = aead, header[len(encryptedMagic):]
+	r.size = plainSize(fi.Size())
+	sealed := fi.Size() - int64(encryptedHeaderSize)
+	r.chunks = (sealed + encryptedSealedSize - 1) / encryptedSealedSize
+	return r, nil
+}
+
+// load decrypts the chunk with the index.
+func (r *encryptedReader) load(index int64) error {
+	if r.index == index {
+		return nil
+	}
+	if _, err := r.File.Seek(int64(encryptedHeaderSize)+index*encryptedSealedSize, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, encryptedSealedSize)
+	n, err := io.ReadFull(r.File, sealed)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// the file is shorter than its size, the chunk is rejected by its tag
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	chunk, err := r.aead.Open(sealed[:0], chunkNonce(r.prefix, index), sealed[:n], chunkAAD(index == r.chunks-1))
+	if err != nil {
+		return fmt.Errorf("corrupted chunk %d of encrypted file %s", index, r.fi.Name())
+	}
+	r.index, r.chunk = index, chunk
+	return nil
+}
+
+func (r *encryptedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / encryptedChunkSize
+	if err := r.load(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.chunk[r.pos-index*encryptedChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *encryptedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *encryptedReader) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (r *encryptedReader) Stat() (os.FileInfo, error) {
+	return encryptedInfo(r.fi), nil
+}
+
+// encryptedWriter encrypts the content of a file chunk by chunk. A full chunk is only sealed
+// once more content follows, as the last chunk is sealed as such when the file is closed.
+type encryptedWriter struct {
+	webdav.File
+	aead   cipher.AEAD
+	prefix []byte
+	index  int64
+	buf    []byte
+	size   int64
+	err    error
+}
+
+func newEncryptedWriter(file webdav.File, key []byte) (webdav.File, error) {
+	aead, err := newFolderAEAD(key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedMagic)
+	if _, err := rand.Read(header[len(encryptedMagic):]); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &encryptedWriter{
+		File:   file,
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		buf:    make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (w *encryptedWriter) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.index), w.buf, chunkAAD(final))
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.File.Write(sealed)
+	return err
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == encryptedChunkSize {
+			if w.err = w.seal(false); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):encryptedChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+	}
+	return written, nil
+}
+
+func (w *encryptedWriter) Read(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// Seek only supports the current position, which is reported by the uploads of FTP and SFTP.
+func (w *encryptedWriter) Seek(offset int64, whence int) (int64, error) {
+	if (whence == io.SeekCurrent && offset == 0) || (whence == io.SeekStart && offset == w.size) {
+		return w.size, nil
+	}
+	return 0, errEncryptedWrite
+}
+
+func (w *encryptedWriter) Stat() (os.FileInfo, error) {
+	fi, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return writtenFileInfo{fi, w.size}, nil
+}
+
+func (w *encryptedWriter) Close() error {
+	err := w.err
+	if err == nil {
+		err = w.seal(true)
+	}
+	if closeErr := w.File.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writtenFileInfo reports the size of the content written so far.
+type writtenFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi writtenFileInfo) Size() int64 {
+	return fi.size
+}
+
+// serveEncryption serves the endpoints to unlock and lock the encrypted folders of the user
+// and lists the folders with their state. It returns whether the request has been handled.
+func (a *App) serveEncryption(w http.ResponseWriter, r *http.Request) bool {
+	enc := a.Config.Encryption
+	if enc == nil {
+		return false
+	}
+	p, ok := a.relativePath(r)
+	if !ok || (p != strings.TrimSuffix(encryptionPrefix, "/") && !strings.HasPrefix(p, encryptionPrefix)) {
+		return false
+	}
+
+	ctx := r.Context()
+	d := Dir{Config: a.Config}
+	user := d.resolveUser(ctx)
+	userInfo := a.Config.User(user)
+	if userInfo == nil {
+		http.NotFound(w, r)
+		return true
+	}
+
+	action := strings.Trim(strings.TrimPrefix(p, strings.TrimSuffix(encryptionPrefix, "/")), "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		folders := []map[string]interface{}{}
+		for _, folder := range userInfo.Encrypted {
+			dir := d.resolve(ctx, folder)
+			_, err := os.Stat(filepath.Join(dir, encryptionHeaderName))
+			folders = append(folders, map[string]interface{}{
+				"path":        path.Clean("/" + folder),
+				"initialized": err == nil,
+				"locked":      enc.key(user, dir, time.Now()) == nil,
+			})
+		}
+		writeJSON(w, http.StatusOK, folders)
+		return true
+	case (action == "unlock" || action == "lock") && r.Method == http.MethodPost:
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	name := path.Clean("/" + r.FormValue("path"))
+	var dir string
+	for _, folder := range userInfo.Encrypted {
+		if path.Clean("/"+folder) == name {
+			dir = d.resolve(ctx, folder)
+		}
+	}
+	if dir == "" {
+		writeJSONError(w, http.StatusNotFound, "not an encrypted folder")
+		return true
+	}
+
+	if action == "lock" {
+		enc.lock(user, dir)
+		traceStep(ctx, "locked encrypted folder %s", dir)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"path": name, "locked": true})
+		return true
+	}
+	passphrase := r.FormValue("passphrase")
+	if err := enc.unlock(user, dir, passphrase); err != nil {
+		switch err {
+		case errWrongPassphrase:
+			log.WithField("user", user).WithField("address", a.Config.clientIP(r)).Warn("Wrong passphrase of encrypted folder")
+			writeJSONError(w, http.StatusForbidden, err.Error())
+			return true
+		case errShortPassphrase:
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return true
+		}
+		log.WithField("path", dir).WithError(err).Error("Error unlocking encrypted folder")
+		writeJSONError(w, http.StatusInternalServerError, "error unlocking folder")
+		return true
+	}
+	traceStep(ctx, "unlocked encrypted folder %s", dir)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"path": name, "locked": false})
+	return true
+}
@@ -0,0 +1,184 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedFile(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	key := bytes.Repeat([]byte{7}, 32)
+
+	tests := []struct {
+		name   string
+		size   int
+		offset int64
+	}{
+		{"empty", 0, 0},
+		{"single byte", 1, 0},
+		{"below chunk", encryptedChunkSize - 1, 100},
+		{"chunk", encryptedChunkSize, encryptedChunkSize - 1},
+		{"above chunk", encryptedChunkSize + 1, encryptedChunkSize},
+		{"chunks", 3*encryptedChunkSize + 5, encryptedChunkSize + 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := make([]byte, tt.size)
+			for i := range content {
+				content[i] = byte(i % 251)
+			}
+			name := filepath.Join(tmpDir, tt.name)
+			f, _ := os.Create(name)
+			w, err := newEncryptedWriter(f, key)
+			if err != nil {
+				t.Fatalf("newEncryptedWriter() error = %v", err)
+			}
+			w.Write(content[:tt.size/2])
+			w.Write(content[tt.size/2:])
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			fi, _ := os.Stat(name)
+			if got := plainSize(fi.Size()); got != int64(tt.size) {
+				t.Errorf("plainSize(%v) = %v, want %v", fi.Size(), got, tt.size)
+			}
+			f, _ = os.Open(name)
+			r, err := newEncryptedReader(f, fi, key)
+			if err != nil {
+				t.Fatalf("newEncryptedReader() error = %v", err)
+			}
+			defer r.Close()
+			r.Seek(tt.offset, io.SeekStart)
+			got, err := ioutil.ReadAll(r)
+			if err != nil || !bytes.Equal(got, content[tt.offset:]) {
+				t.Errorf("read from %v = %v bytes, %v, want %v bytes", tt.offset, len(got), err, tt.size-int(tt.offset))
+			}
+		})
+	}
+
+	// the first chunk of a truncated file isn't accepted as last one
+	name := filepath.Join(tmpDir, "chunks")
+	os.Truncate(name, int64(encryptedHeaderSize+encryptedSealedSize))
+	fi, _ := os.Stat(name)
+	f, _ := os.Open(name)
+	r, _ := newEncryptedReader(f, fi, key)
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("read of truncated file error = nil, want an error")
+	}
+}
+
+func TestEncryptedFolder(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "alice"
+	cfg := &Config{
+		Dir:        tmpDir,
+		Realm:      "dave",
+		Encryption: &Encryption{},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, Encrypted: []string{"/vault"}},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("alice", "password")
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+	unlock := func(passphrase string) int {
+		form := url.Values{"path": {"vault"}, "passphrase": {passphrase}}
+		return do("POST", "/.encryption/unlock", form.Encode(), "Content-Type", "application/x-www-form-urlencoded").Code
+	}
+	const content = "the secret content"
+
+	if w := do("PUT", "/vault/a.txt", content); w.Code < 400 {
+		t.Errorf("PUT to uninitialized folder status = %v, want an error", w.Code)
+	}
+	if code := unlock("short"); code != http.StatusBadRequest {
+		t.Errorf("unlock with short passphrase status = %v, want %v", code, http.StatusBadRequest)
+	}
+	if code := unlock("correct horse"); code != http.StatusOK {
+		t.Fatalf("unlock status = %v, want %v", code, http.StatusOK)
+	}
+	if w := do("PUT", "/vault/a.txt", content); w.Code != http.StatusCreated {
+		t.Fatalf("PUT to unlocked folder status = %v, want %v", w.Code, http.StatusCreated)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "alice", "vault", "a.txt"))
+	if !strings.HasPrefix(string(data), encryptedMagic) || strings.Contains(string(data), "secret") {
+		t.Errorf("stored file = %q, want only ciphertext", data)
+	}
+	do("PUT", "/plain.txt", "plain")
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   []string
+		want     int
+		wantBody string
+	}{
+		{"read", "GET", "/vault/a.txt", nil, http.StatusOK, content},
+		{"range", "GET", "/vault/a.txt", []string{"Range", "bytes=4-9"}, http.StatusPartialContent, "secret"},
+		{"listing", "PROPFIND", "/vault/", []string{"Depth", "1"}, http.StatusMultiStatus, "<D:getcontentlength>18</D:getcontentlength>"},
+		{"header", "GET", "/vault/" + encryptionHeaderName, nil, http.StatusNotFound, ""},
+		{"copy", "COPY", "/vault/a.txt", []string{"Destination", "/vault/b.txt"}, http.StatusCreated, ""},
+		{"move out", "MOVE", "/vault/a.txt", []string{"Destination", "/a.txt"}, http.StatusForbidden, ""},
+		{"move in", "MOVE", "/plain.txt", []string{"Destination", "/vault/plain.txt"}, http.StatusForbidden, ""},
+		{"move within", "MOVE", "/vault/b.txt", []string{"Destination", "/vault/c.txt"}, http.StatusCreated, ""},
+		{"copy out", "COPY", "/vault/c.txt", []string{"Destination", "/c.txt"}, http.StatusCreated, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.method, tt.target, "", tt.header...)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+	if w := do("GET", "/c.txt", ""); w.Body.String() != content {
+		t.Errorf("copy out of folder = %q, want the decrypted content", w.Body.String())
+	}
+
+	do("POST", "/.encryption/lock", "path=/vault", "Content-Type", "application/x-www-form-urlencoded")
+	if w := do("GET", "/vault/a.txt", ""); w.Code == http.StatusOK {
+		t.Errorf("GET of locked folder status = %v, want an error", w.Code)
+	}
+	if w := do("PROPFIND", "/vault/", "", "Depth", "1"); strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("listing of locked folder = %s, want no members", w.Body.String())
+	}
+	if w := do("GET", "/.encryption/", ""); !strings.Contains(w.Body.String(), `"locked":true`) {
+		t.Errorf("folders = %s, want the locked folder", w.Body.String())
+	}
+	if code := unlock("wrong horse"); code != http.StatusForbidden {
+		t.Errorf("unlock with wrong passphrase status = %v, want %v", code, http.StatusForbidden)
+	}
+	unlock("correct horse")
+	if w := do("GET", "/vault/a.txt", ""); w.Body.String() != content {
+		t.Errorf("GET after unlock = %q, want the content", w.Body.String())
+	}
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	log "github.com/sirupsen/logrus"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// defaultErrorStatuses are the statuses covered by the error pages by default.
+var defaultErrorStatuses = []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusInsufficientStorage}
+
+// ErrorPages replaces the bare status text of the error responses of Statuses, by default 401,
+// 403, 404 and 507, by pages including the Contact of the support. Browsers get HTML, clients
+// asking for JSON get JSON and all other clients XML. The built-in pages are replaced by the
+// templates <status>.html, <status>.json and <status>.xml in Templates, or by error.html,
+// error.json and error.xml for all statuses.
+type ErrorPages struct {
+	Statuses  []int
+	Contact   string
+	Templates string
+
+	once      sync.Once
+	templates map[string]pageTemplate
+}
+
+// pageTemplate is a parsed HTML or text template.
+type pageTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// errorPageData is the data the error pages are executed with.
+type errorPageData struct {
+	Status  int
+	Title   string
+	Text    string
+	Contact string
+	Support string
+	Lang    string
+	Path    string
+}
+
+// xmlErrorPage is the built-in XML error page.
+type xmlErrorPage struct {
+	XMLName xml.Name `xml:"error"`
+	Status  int      `xml:"status"`
+	Title   string   `xml:"title"`
+	Message string   `xml:"message,omitempty"`
+	Contact string   `xml:"contact,omitempty"`
+}
+
+// errorTemplateFuncs quote values for the JSON and XML templates.
+var errorTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"xml": func(s string) (string, error) {
+		var b strings.Builder
+		err := xml.EscapeText(&b, []byte(s))
+		return b.String(), err
+	},
+}
+
+// newErrorPageData returns the data of the error page of the status in the language of the
+// request.
+func newErrorPageData(r *http.Request, i *I18n, status int, contact string) *errorPageData {
+	m := i.messages(r)
+	id := "error." + strconv.Itoa(status)
+	d := &errorPageData{Status: status, Title: m.T(id), Text: m.T(id + ".text"), Contact: contact, Lang: m.Lang, Path: r.URL.Path}
+	if d.Title == id {
+		d.Title, d.Text = http.StatusText(status), ""
+	}
+	if contact != "" {
+		d.Support = m.T("error.contact", contact)
+	}
+	return d
+}
+
+// covers returns whether the responses of the status are replaced. A nil ErrorPages covers
+// none.
+func (p *ErrorPages) covers(status int) bool {
+	if p == nil {
+		return false
+	}
+	statuses := p.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultErrorStatuses
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// template returns the template of the status and format, or nil if there is none. The
+// templates are loaded once, a broken one is logged and skipped.
+func (p *ErrorPages) template(status int, format string) pageTemplate {
+	p.once.Do(func() {
+		p.templates = map[string]pageTemplate{}
+		if p.Templates == "" {
+			return
+		}
+		for _, format := range []string{"html", "json", "xml"} {
+			files, err := filepath.Glob(filepath.Join(p.Templates, "*."+format))
+			if err != nil {
+				log.WithError(err).WithField("path", p.Templates).Error("Error reading error page templates")
+				return
+			}
+			for _, file := range files {
+				var t pageTemplate
+				if format == "html" {
+					t, err = htmltemplate.ParseFiles(file)
+				} else {
+					t, err = template.New(filepath.Base(file)).Funcs(errorTemplateFuncs).ParseFiles(file)
+				}
+				if err != nil {
+					log.WithError(err).WithField("path", file).Error("Error parsing error page template")
+					continue
+				}
+				p.templates[filepath.Base(file)] = t
+			}
+		}
+	})
+
+	if t, ok := p.templates[strconv.Itoa(status)+"."+format]; ok {
+		return t
+	}
+	if t, ok := p.templates["error."+format]; ok {
+		return t
+	}
+	return nil
+}
+
+// write answers a request by the error page of the status in the format accepted by the
+// client.
+func (p *ErrorPages) write(w http.ResponseWriter, r *http.Request, i *I18n, status int) {
+	format, contentType := "xml", "application/xml; charset=utf-8"
+	if accept := r.Header.Get("Accept"); strings.Contains(accept, "text/html") {
+		format, contentType = "html", "text/html; charset=utf-8"
+	} else if strings.Contains(accept, "json") {
+		format, contentType = "json", "application/json"
+	}
+	data := newErrorPageData(r, i, status, p.Contact)
+
+	if t := p.template(status, format); t != nil {
+		var buf bytes.Buffer
+		err := t.Execute(&buf, data)
+		if err == nil {
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(status)
+			w.Write(buf.Bytes())
+			return
+		}
+		log.WithError(err).WithField("status", status).Error("Error executing error page template, using the built-in page")
+	}
+
+	switch format {
+	case "html":
+		writeErrorPage(w, errorPage, contentType, data)
+	case "json":
+		writeJSON(w, status, map[string]interface{}{"status": status, "error": data.Title, "message": data.Text, "contact": data.Contact})
+	default:
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		io.WriteString(w, xml.Header)
+		page := xmlErrorPage{Status: status, Title: data.Title, Message: data.Text, Contact: data.Contact}
+		if err := xml.NewEncoder(w).Encode(page); err != nil {
+			log.WithError(err).Error("Error writing error page")
+		}
+	}
+}
+
+// writeErrorPage answers a request by the built-in HTML error page.
+func writeErrorPage(w http.ResponseWriter, t pageTemplate, contentType string, data *errorPageData) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(data.Status)
+	if err := t.Execute(w, data); err != nil {
+		log.WithError(err).Error("Error writing error page")
+	}
+}
+
+// withErrorPages replaces the bare error responses of a request by the error pages.
+func (cfg *Config) withErrorPages(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	if cfg.ErrorPages == nil {
+		return w
+	}
+	return &errorPageWriter{ResponseWriter: w, cfg: cfg, req: req}
+}
+
+// errorPageWriter replaces the error responses of the statuses covered by the error pages,
+// which are sent as plain text or without a content type.
+type errorPageWriter struct {
+	http.ResponseWriter
+	cfg       *Config
+	req       *http.Request
+	rewritten bool
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+	if w.rewritten {
+		return
+	}
+	contentType := w.Header().Get("Content-Type")
+	if !w.cfg.ErrorPages.covers(status) ||
+		(contentType != "" && !strings.HasPrefix(contentType, "text/plain")) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.rewritten = true
+	w.cfg.ErrorPages.write(w.ResponseWriter, w.req, w.cfg.I18n, status)
+}
+
+func (w *errorPageWriter) Write(p []byte) (int, error) {
+	if w.rewritten {
+		// the body of the replaced response is dropped
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorPages(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	templates := filepath.Join(tmpDir, "templates")
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	os.MkdirAll(templates, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(templates, "404.html"), []byte(`<p>Lost {{.Path}}? Ask {{.Contact}}.</p>`), 0600)
+	ioutil.WriteFile(filepath.Join(templates, "error.json"), []byte(`{"code":{{.Status}},"contact":{{json .Contact}}}`), 0600)
+	ioutil.WriteFile(filepath.Join(templates, "403.xml"), []byte(`{{.Broken`), 0600)
+
+	cfg := &Config{
+		Dir:        filepath.Join(tmpDir, "data"),
+		Realm:      "dave",
+		ErrorPages: &ErrorPages{Contact: "help@example.com", Templates: templates},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password"))},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+
+	tests := []struct {
+		name     string
+		target   string
+		auth     bool
+		accept   string
+		language string
+		want     int
+		wantType string
+		wantBody string
+	}{
+		{"custom html", "/missing<b>.txt", true, "text/html", "", http.StatusNotFound, "text/html", "<p>Lost /missing&lt;b&gt;.txt? Ask help@example.com.</p>"},
+		{"custom json for all", "/missing.txt", true, "application/json", "", http.StatusNotFound, "application/json", `{"code":404,"contact":"help@example.com"}`},
+		{"built-in xml", "/missing.txt", true, "", "", http.StatusNotFound, "application/xml", "<contact>help@example.com</contact>"},
+		{"built-in html", "/", false, "text/html", "de", http.StatusUnauthorized, "text/html", "wenden Sie sich bitte an help@example.com"},
+		{"json of login", "/", false, "application/json", "", http.StatusUnauthorized, "application/json", `"code":401`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.URL.Path = tt.target
+			if tt.auth {
+				req.SetBasicAuth("alice", "password")
+			}
+			req.Header.Set("Accept", tt.accept)
+			req.Header.Set("Accept-Language", tt.language)
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("content type = %q, want %q", got, tt.wantType)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	cfg.ErrorPages.write(w, httptest.NewRequest("GET", "/", nil), nil, http.StatusForbidden)
+	if !strings.Contains(w.Body.String(), "<status>403</status>") {
+		t.Errorf("page of broken template = %q, want the built-in page", w.Body.String())
+	}
+	if cfg.ErrorPages.covers(http.StatusInternalServerError) {
+		t.Error("error pages cover 500 without configuring it")
+	}
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultEventLogSource is the source of the events of the server by default.
+const defaultEventLogSource = "dave"
+
+// IDs of the events, so operational events and the audit events of admins can be told apart
+const (
+	eventIDOperational = 1
+	eventIDAudit       = 2
+)
+
+// EventLog writes the log entries of at least Level, info by default, to the Windows Event Log
+// as events of Source. Audit events, the changes of admins via the admin API, are always
+// written. The source is registered on the first start, which needs to run as administrator.
+type EventLog struct {
+	Source string
+	Level  string
+
+	close func() error
+}
+
+// level returns the minimum level of the entries written to the event log.
+func (e *EventLog) level() (log.Level, error) {
+	if e.Level == "" {
+		return log.InfoLevel, nil
+	}
+	return log.ParseLevel(e.Level)
+}
+
+// eventID returns the ID of the event of the log entry.
+func eventID(entry *log.Entry) uint32 {
+	if _, ok := entry.Data["admin"]; ok {
+		return eventIDAudit
+	}
+	return eventIDOperational
+}
+
+// StopEventLog closes the event log.
+func (cfg *Config) StopEventLog() {
+	if e := cfg.EventLog; e != nil && e.close != nil {
+		e.close()
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package app
+
+import (
+	"errors"
+)
+
+// StartEventLog fails, if the event log is configured, as it only exists on Windows.
+func (cfg *Config) StartEventLog() error {
+	if cfg.EventLog == nil {
+		return nil
+	}
+	return errors.New("the event log is only supported on Windows")
+}
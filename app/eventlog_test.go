@@ -0,0 +1,36 @@
+package app
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestEventLogLevel(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    log.Level
+		wantErr bool
+	}{
+		{"", log.InfoLevel, false},
+		{"warning", log.WarnLevel, false},
+		{"debug", log.DebugLevel, false},
+		{"loud", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := (&EventLog{Level: tt.level}).level()
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("level() of %q = %v, %v, want %v", tt.level, got, err, tt.want)
+		}
+	}
+}
+
+func TestEventID(t *testing.T) {
+	entry := log.WithField("user", "alice")
+	if id := eventID(entry); id != eventIDOperational {
+		t.Errorf("eventID() of an operational entry = %v, want %v", id, eventIDOperational)
+	}
+	if id := eventID(entry.WithField("admin", "root")); id != eventIDAudit {
+		t.Errorf("eventID() of an admin entry = %v, want %v", id, eventIDAudit)
+	}
+}
@@ -0,0 +1,85 @@
+//go:build windows
+// +build windows
+
+package app
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventSourceKey is the registry key of the sources of the application event log.
+const eventSourceKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+
+// StartEventLog registers the source of the event log, if it isn't yet, and writes the log
+// entries to it.
+func (cfg *Config) StartEventLog() error {
+	e := cfg.EventLog
+	if e == nil {
+		return nil
+	}
+	level, err := e.level()
+	if err != nil {
+		return fmt.Errorf("level of the event log: %w", err)
+	}
+	if err := registerEventSource(e.Source); err != nil {
+		return err
+	}
+	l, err := eventlog.Open(e.Source)
+	if err != nil {
+		return fmt.Errorf("error opening the event log: %w", err)
+	}
+	e.close = l.Close
+	log.AddHook(&eventLogHook{log: l, level: level})
+	log.WithField("source", e.Source).Info("Writing to the event log")
+	return nil
+}
+
+// registerEventSource registers the source with the message file of EventCreate, which
+// formats any message.
+func registerEventSource(source string) error {
+	if key, err := registry.OpenKey(registry.LOCAL_MACHINE, eventSourceKey+source, registry.QUERY_VALUE); err == nil {
+		key.Close()
+		return nil
+	}
+	if err := eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		return fmt.Errorf("error registering the event source %s, start the server once as administrator: %w", source, err)
+	}
+	log.WithField("source", source).Info("Registered event source")
+	return nil
+}
+
+// eventLogHook writes the log entries to the event log.
+type eventLogHook struct {
+	log   *eventlog.Log
+	level log.Level
+}
+
+func (h *eventLogHook) Levels() []log.Level {
+	// audit events are written down to the info level
+	if h.level < log.InfoLevel {
+		return log.AllLevels[:log.InfoLevel+1]
+	}
+	return log.AllLevels[:h.level+1]
+}
+
+func (h *eventLogHook) Fire(entry *log.Entry) error {
+	id := eventID(entry)
+	if entry.Level > h.level && id != eventIDAudit {
+		return nil
+	}
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return h.log.Error(id, msg)
+	case log.WarnLevel:
+		return h.log.Warning(id, msg)
+	default:
+		return h.log.Info(id, msg)
+	}
+}
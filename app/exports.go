@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Export exports Dir as the collection Path, like /projects, within the root of every user,
+// even of users with a subdir, so several base directories are served by one instance. Users
+// restricts the export to the listed users with their permissions; a user without a template
+// has full access, unless single permissions are restricted. The permission rules of the
+// users still apply to the paths of the export. Without Users all users have their usual
+// access. Exports with users are hidden from the users not listed and from the guests.
+type Export struct {
+	Path  string
+	Dir   string
+	Users map[string]*Permissions
+}
+
+// name returns the name of the export within the root of the users.
+func (e *Export) name() string {
+	return strings.Trim(e.Path, "/")
+}
+
+// restricted returns whether only the listed users may access the export.
+func (e *Export) restricted() bool {
+	return len(e.Users) > 0
+}
+
+// validateExports checks, that the paths of the exports are single, distinct path elements not
+// used by the shared folder and that their dirs are directories.
+func (cfg *Config) validateExports() error {
+	names := map[string]bool{}
+	if cfg.SharedFolder != nil {
+		names[cfg.SharedFolder.name()] = true
+	}
+	for _, e := range cfg.Exports {
+		if e == nil {
+			continue
+		}
+		name := e.name()
+		if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return fmt.Errorf("invalid path %q of an export, use a single path element like /projects", e.Path)
+		}
+		if names[name] {
+			return fmt.Errorf("path %s of an export is used twice", e.Path)
+		}
+		names[name] = true
+		fi, err := os.Stat(e.Dir)
+		if err != nil {
+			return fmt.Errorf("can't access dir of export %s: %w", e.Path, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("dir %s of export %s is not a directory", e.Dir, e.Path)
+		}
+	}
+	return nil
+}
+
+// exportAt returns the export of the path as seen by the users, if there is one.
+func (cfg *Config) exportAt(name string) *Export {
+	clean := path.Clean("/" + name)
+	for _, e := range cfg.Exports {
+		if e == nil {
+			continue
+		}
+		prefix := "/" + e.name()
+		if clean == prefix || strings.HasPrefix(clean, prefix+"/") {
+			return e
+		}
+	}
+	return nil
+}
+
+// exportOf returns the export containing the physical path, if there is one.
+func (cfg *Config) exportOf(name string) *Export {
+	for _, e := range cfg.Exports {
+		if e != nil && withinDir(name, filepath.Clean(e.Dir)) {
+			return e
+		}
+	}
+	return nil
+}
+
+// isExportRoot returns whether the physical path is the dir of an export.
+func (cfg *Config) isExportRoot(name string) bool {
+	e := cfg.exportOf(name)
+	return e != nil && filepath.Clean(e.Dir) == name
+}
+
+// resolveExport returns the physical path of a name within an export, ok is false for names
+// outside of the exports. Names within exports hidden from the user resolve to "".
+func (cfg *Config) resolveExport(ctx context.Context, name string) (string, bool) {
+	e := cfg.exportAt(name)
+	if e == nil {
+		return "", false
+	}
+	if !e.visible(ctx) {
+		return "", true
+	}
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/"+e.name())
+	return filepath.Join(e.Dir, filepath.FromSlash(rel)), true
+}
+
+// exportPath returns the path of a physical path within an export as seen by the users, ok is
+// false for physical paths outside of the exports.
+func (cfg *Config) exportPath(name string) (string, bool) {
+	e := cfg.exportOf(name)
+	if e == nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(filepath.Clean(e.Dir), name)
+	if err != nil {
+		return "", false
+	}
+	return path.Join("/"+e.name(), filepath.ToSlash(rel)), true
+}
+
+// exportAccess returns the access of the user to a restricted export. cfg.usersMu must be held.
+func (cfg *Config) exportAccess(e *Export, username string) access {
+	p, ok := e.Users[username]
+	switch {
+	case !ok:
+		return access{}
+	case p == nil:
+		return fullAccess
+	case p.Template == "":
+		return p.overlay(fullAccess)
+	}
+	return cfg.resolvePermissions(p)
+}
+
+// visible returns whether the user of the request may see the export. Restricted exports are
+// hidden from the users not listed and from the guests.
+func (e *Export) visible(ctx context.Context) bool {
+	if !e.restricted() {
+		return true
+	}
+	if isGuest(ctx) {
+		return false
+	}
+	authInfo := AuthFromContext(ctx)
+	if authInfo == nil || !authInfo.Authenticated {
+		return false
+	}
+	_, listed := e.Users[authInfo.Username]
+	return listed
+}
+
+// visibleExports returns the exports listed in the root of the request's user.
+func (cfg *Config) visibleExports(ctx context.Context) []*Export {
+	var exports []*Export
+	for _, e := range cfg.Exports {
+		if e != nil && e.visible(ctx) {
+			exports = append(exports, e)
+		}
+	}
+	return exports
+}
+
+// statExport returns the info of the export of the path, ok is false unless the path is the one
+// of an export.
+func (cfg *Config) statExport(ctx context.Context, name string) (fi os.FileInfo, ok bool, err error) {
+	e := cfg.exportAt(name)
+	if e == nil || path.Clean("/"+name) != "/"+e.name() {
+		return nil, false, nil
+	}
+	if !e.visible(ctx) {
+		return nil, true, os.ErrNotExist
+	}
+	fi, err = os.Stat(e.Dir)
+	if err != nil {
+		return nil, true, err
+	}
+	return sharedFileInfo{FileInfo: fi, name: e.name()}, true, nil
+}
+
+// openExportRoot wraps the root directory of a user, so its listing contains the exports the
+// user may access, and the dir of an export itself, so it has its name within the root.
+func (d Dir) openExportRoot(ctx context.Context, f webdav.File, name string, flag int) webdav.File {
+	if len(d.Config.Exports) == 0 || flag&writeFlags != 0 {
+		return f
+	}
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return &exportRoot{File: f, all: d.Config.Exports, exports: d.Config.visibleExports(ctx)}
+	}
+	if e := d.Config.exportAt(clean); e != nil && clean == "/"+e.name() {
+		return &sharedDir{File: f, name: e.name()}
+	}
+	return f
+}
+
+// exportRoot is a root directory listing the visible exports in addition to its members. Members
+// of the names of any export are hidden, as the exports take their place.
+type exportRoot struct {
+	webdav.File
+	all     []*Export
+	exports []*Export
+	listed  bool
+}
+
+func (r *exportRoot) Readdir(count int) ([]os.FileInfo, error) {
+	children, err := r.File.Readdir(count)
+	if err != nil && err != io.EOF {
+		return children, err
+	}
+	names := map[string]bool{}
+	for _, e := range r.all {
+		if e != nil {
+			names[e.name()] = true
+		}
+	}
+	members := children[:0]
+	for _, child := range children {
+		if !names[child.Name()] {
+			members = append(members, child)
+		}
+	}
+	if !r.listed {
+		r.listed = true
+		for _, e := range r.exports {
+			if fi, statErr := os.Stat(e.Dir); statErr == nil {
+				members = append(members, sharedFileInfo{FileInfo: fi, name: e.name()})
+				if err == io.EOF {
+					err = nil
+				}
+			}
+		}
+	}
+	return members, err
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExports(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "srv", "public"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "projects", "apollo"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "projects", "apollo", "plan.txt"), []byte("plan"), 0600)
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:   filepath.Join(tmpDir, "data"),
+		Realm: "dave",
+		Exports: []*Export{
+			{Path: "/public", Dir: filepath.Join(tmpDir, "srv", "public")},
+			{Path: "/projects", Dir: filepath.Join(tmpDir, "projects"), Users: map[string]*Permissions{
+				"alice": {Template: TemplateReadOnly},
+				"carol": nil,
+			}},
+		},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+			"bob":   {Password: GenHash([]byte("password"))},
+			"carol": {Password: GenHash([]byte("password"))},
+		},
+	}
+	if err := cfg.checkDirs(); err != nil {
+		t.Fatalf("checkDirs() error = %v", err)
+	}
+	if err := cfg.checkPermissions(); err != nil {
+		t.Fatalf("checkPermissions() error = %v", err)
+	}
+	a := newQuotaApp(t, cfg)
+	do := func(user, method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth(user, "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	if w := do("alice", "PUT", "/public/hello.txt", "hello"); w.Code != http.StatusCreated {
+		t.Errorf("PUT into the public export status = %v", w.Code)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "srv", "public", "hello.txt")); string(b) != "hello" {
+		t.Errorf("uploaded file of the public export = %q, want hello", b)
+	}
+	if w := do("bob", "GET", "/public/hello.txt", ""); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("GET of the public export by another user = %v %q", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		user, method, target string
+		want                 int
+	}{
+		{"alice", "GET", "/projects/apollo/plan.txt", http.StatusOK},
+		{"alice", "PUT", "/projects/apollo/plan.txt", http.StatusForbidden},
+		{"carol", "PUT", "/projects/apollo/notes.txt", http.StatusCreated},
+		{"bob", "GET", "/projects/apollo/plan.txt", http.StatusNotFound},
+		{"bob", "PUT", "/projects/apollo/plan.txt", http.StatusConflict},
+		{"carol", "DELETE", "/projects", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if w := do(tt.user, tt.method, tt.target, "changed"); w.Code != tt.want {
+			t.Errorf("%s %s by %s status = %v, want %v", tt.method, tt.target, tt.user, w.Code, tt.want)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "projects", "apollo", "plan.txt")); string(b) != "plan" {
+		t.Errorf("file of the restricted export has been changed to %q", b)
+	}
+
+	w := do("alice", "PROPFIND", "/", "", "Depth", "1")
+	if body := w.Body.String(); w.Code != http.StatusMultiStatus || !strings.Contains(body, "<D:href>/public/</D:href>") ||
+		!strings.Contains(body, "<D:href>/projects/</D:href>") {
+		t.Errorf("PROPFIND of the root of a listed user = %v %s", w.Code, body)
+	}
+	w = do("bob", "PROPFIND", "/", "", "Depth", "1")
+	if body := w.Body.String(); w.Code != http.StatusMultiStatus || !strings.Contains(body, "<D:href>/public/</D:href>") ||
+		strings.Contains(body, "/projects/") {
+		t.Errorf("PROPFIND of the root of a user not listed = %v %s", w.Code, body)
+	}
+	if w := do("carol", "PROPFIND", "/projects", "", "Depth", "0"); !strings.Contains(w.Body.String(), "<D:displayname>projects</D:displayname>") {
+		t.Errorf("PROPFIND of the export = %v %s", w.Code, w.Body)
+	}
+}
+
+func TestValidateExports(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "file"), nil, 0600)
+
+	tests := []struct {
+		name    string
+		exports []*Export
+		wantErr bool
+	}{
+		{"valid", []*Export{{Path: "/a", Dir: tmpDir}, {Path: "b/", Dir: tmpDir}}, false},
+		{"nested path", []*Export{{Path: "/a/b", Dir: tmpDir}}, true},
+		{"root path", []*Export{{Path: "/", Dir: tmpDir}}, true},
+		{"duplicate path", []*Export{{Path: "/a", Dir: tmpDir}, {Path: "/a/", Dir: tmpDir}}, true},
+		{"name of the shared folder", []*Export{{Path: "/_shared", Dir: tmpDir}}, true},
+		{"missing dir", []*Export{{Path: "/a", Dir: filepath.Join(tmpDir, "missing")}}, true},
+		{"file", []*Export{{Path: "/a", Dir: filepath.Join(tmpDir, "file")}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Exports: tt.exports, SharedFolder: &SharedFolder{Dir: tmpDir}}
+			if err := cfg.validateExports(); (err != nil) != tt.wantErr {
+				t.Errorf("validateExports() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
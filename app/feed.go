@@ -0,0 +1,227 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Defaults of the feeds
+const (
+	defaultFeedMaxEntries = 50
+	defaultFeedMaxAge     = 7 * 24 * time.Hour
+	jsonFeedVersion       = "https://jsonfeed.org/version/1.1"
+)
+
+// Feeds enables the feeds of the recently added and modified files of a collection, which
+// are requested with the feed parameter atom or json. A feed lists the latest MaxEntries, 50
+// by default, of the files modified within MaxAge, 7 days by default, which the user is able
+// to read.
+type Feeds struct {
+	MaxEntries int
+	MaxAge     time.Duration
+}
+
+// feedEntry is a recently modified file. The name is the one seen by the user.
+type feedEntry struct {
+	name string
+	fi   os.FileInfo
+}
+
+// atomFeed is a feed of RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// jsonFeed is a feed of JSON Feed 1.1.
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	Title        string `json:"title"`
+	ContentText  string `json:"content_text"`
+	DateModified string `json:"date_modified"`
+}
+
+// serveFeed answers a GET of a collection with the feed parameter by the feed of the files
+// below it, which have been modified recently. It returns whether the request has been
+// handled.
+func (a *App) serveFeed(w http.ResponseWriter, r *http.Request) bool {
+	feeds := a.Config.Feeds
+	format := r.URL.Query().Get("feed")
+	if feeds == nil || r.Method != http.MethodGet || format == "" {
+		return false
+	}
+	ctx := r.Context()
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	name := path.Clean(p)
+	if fi, err := a.Handler.FileSystem.Stat(ctx, name); err != nil || !fi.IsDir() {
+		return false
+	}
+	if format != "atom" && format != "json" {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	maxAge := feeds.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultFeedMaxAge
+	}
+	maxEntries := feeds.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultFeedMaxEntries
+	}
+	var entries []feedEntry
+	a.collectFeedEntries(ctx, name, time.Now().Add(-maxAge), &entries)
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].fi.ModTime().Equal(entries[j].fi.ModTime()) {
+			return entries[i].fi.ModTime().After(entries[j].fi.ModTime())
+		}
+		return entries[i].name < entries[j].name
+	})
+	if len(entries) > maxEntries {
+		entries = entries[:maxEntries]
+	}
+	traceStep(ctx, "serving %s feed of %d files modified below %s", format, len(entries), name)
+
+	var updated time.Time
+	if len(entries) > 0 {
+		updated = entries[0].fi.ModTime()
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !updated.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	title := name
+	if user := a.feedUser(ctx); user != "" {
+		title = fmt.Sprintf("%s (%s)", name, user)
+	}
+	base := a.baseURL(r)
+	home := base + (&url.URL{Path: name}).EscapedPath()
+	self := home + "?feed=" + format
+	if format == "json" {
+		feed := jsonFeed{Version: jsonFeedVersion, Title: title, HomePageURL: home, FeedURL: self, Items: []jsonFeedItem{}}
+		for _, e := range entries {
+			link := base + (&url.URL{Path: e.name}).EscapedPath()
+			feed.Items = append(feed.Items, jsonFeedItem{
+				ID:           feedEntryID(link, e.fi),
+				URL:          link,
+				Title:        path.Base(e.name),
+				ContentText:  feedSummary(e),
+				DateModified: e.fi.ModTime().UTC().Format(time.RFC3339),
+			})
+		}
+		w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(feed); err != nil {
+			log.WithField("path", name).WithError(err).Error("Error writing feed")
+		}
+		return true
+	}
+
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed := atomFeed{
+		Title:   title,
+		ID:      home,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Href: self, Rel: "self"}, {Href: home}},
+	}
+	for _, e := range entries {
+		link := base + (&url.URL{Path: e.name}).EscapedPath()
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   path.Base(e.name),
+			ID:      feedEntryID(link, e.fi),
+			Updated: e.fi.ModTime().UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: link},
+			Summary: feedSummary(e),
+		})
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		log.WithField("path", name).WithError(err).Error("Error writing feed")
+	}
+	return true
+}
+
+// collectFeedEntries adds the files below the directory, which have been modified since the
+// time, to the entries. Directories the user can't read are skipped.
+func (a *App) collectFeedEntries(ctx context.Context, name string, since time.Time, entries *[]feedEntry) {
+	dir, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	children, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return
+	}
+	for _, child := range children {
+		childName := path.Join(name, child.Name())
+		switch {
+		case child.IsDir():
+			a.collectFeedEntries(ctx, childName, since, entries)
+		case child.Mode().IsRegular() && child.ModTime().After(since):
+			*entries = append(*entries, feedEntry{name: childName, fi: child})
+		}
+	}
+}
+
+// feedUser returns the name of the authenticated user.
+func (a *App) feedUser(ctx context.Context) string {
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		return authInfo.Username
+	}
+	return ""
+}
+
+// feedEntryID identifies the modification of a file, so each one is a new entry of the feed.
+func feedEntryID(link string, fi os.FileInfo) string {
+	return fmt.Sprintf("%s#%d", link, fi.ModTime().UnixNano())
+}
+
+// feedSummary describes the modified file.
+func feedSummary(e feedEntry) string {
+	return fmt.Sprintf("%s, %s, modified %s", e.name, ByteSize(e.fi.Size()), e.fi.ModTime().UTC().Format(time.RFC1123))
+}
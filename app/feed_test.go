@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFeed(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice", "docs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "bob"), 0700)
+	defer os.RemoveAll(tmpDir)
+	now := time.Now()
+	files := map[string]time.Time{
+		"alice/docs/new report.txt": now.Add(-time.Hour),
+		"alice/latest.txt":          now.Add(-time.Minute),
+		"alice/old.txt":             now.Add(-30 * 24 * time.Hour),
+		"bob/other.txt":             now,
+	}
+	for name, modTime := range files {
+		p := filepath.Join(tmpDir, filepath.FromSlash(name))
+		ioutil.WriteFile(p, []byte(name), 0600)
+		os.Chtimes(p, modTime, modTime)
+	}
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:   tmpDir,
+		Realm: "dave",
+		Feeds: &Feeds{},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://dav.example.com"+target, nil)
+		req.SetBasicAuth("alice", "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	w := get("/?feed=atom")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/atom+xml; charset=utf-8" {
+		t.Fatalf("Atom feed status = %v, headers = %v", w.Code, w.Header())
+	}
+	var atom atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &atom); err != nil {
+		t.Fatalf("invalid Atom feed: %v", err)
+	}
+	if len(atom.Entries) != 2 || atom.Entries[0].Link.Href != "http://dav.example.com/latest.txt" ||
+		atom.Entries[1].Link.Href != "http://dav.example.com/docs/new%20report.txt" || atom.Title != "/ (alice)" {
+		t.Errorf("Atom feed = %+v", atom)
+	}
+
+	w = get("/docs?feed=json")
+	var feed jsonFeed
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil || w.Header().Get("Content-Type") != "application/feed+json; charset=utf-8" {
+		t.Fatalf("invalid JSON feed: %v, headers = %v", err, w.Header())
+	}
+	if feed.Version != jsonFeedVersion || len(feed.Items) != 1 || feed.Items[0].Title != "new report.txt" ||
+		feed.FeedURL != "http://dav.example.com/docs?feed=json" {
+		t.Errorf("JSON feed = %+v", feed)
+	}
+
+	if w := get("/?feed=atom", "If-Modified-Since", w.Header().Get("Last-Modified")); w.Code != http.StatusOK {
+		t.Errorf("feed modified since the last entry of another feed status = %v, want %v", w.Code, http.StatusOK)
+	}
+	last := get("/?feed=atom").Header().Get("Last-Modified")
+	if w := get("/?feed=atom", "If-Modified-Since", last); w.Code != http.StatusNotModified {
+		t.Errorf("unmodified feed status = %v, want %v", w.Code, http.StatusNotModified)
+	}
+	if w := get("/?feed=rss"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown feed format status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,380 @@
+package app
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxClientHelloSize limits the bytes recorded for the ClientHello of a connection.
+const maxClientHelloSize = 64 * 1024
+
+// TLS extensions used by the fingerprints
+const (
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extPointFormats        = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// fingerprintListener records the ClientHello of the accepted connections of a TLS listener,
+// so the clients can be identified by their JA3 and JA4 fingerprints.
+type fingerprintListener struct {
+	net.Listener
+}
+
+func (l *fingerprintListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprintConn{Conn: c}, nil
+}
+
+// fingerprintConn records the bytes read until the ClientHello is complete.
+type fingerprintConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	hello    []byte
+	done     bool
+	computed bool
+	ja3, ja4 string
+}
+
+func (c *fingerprintConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	if !c.done && n > 0 {
+		c.hello = append(c.hello, p[:n]...)
+		_, complete := clientHello(c.hello)
+		c.done = complete || len(c.hello) > maxClientHelloSize
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// fingerprints returns the JA3 and JA4 fingerprints of the client, which are empty until the
+// ClientHello has been received or if it couldn't be parsed.
+func (c *fingerprintConn) fingerprints() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.done || c.computed {
+		return c.ja3, c.ja4
+	}
+	c.computed = true
+	if msg, complete := clientHello(c.hello); complete {
+		if h, ok := parseClientHello(msg); ok {
+			c.ja3, c.ja4 = h.ja3(), h.ja4()
+		}
+	}
+	c.hello = nil
+	return c.ja3, c.ja4
+}
+
+// clientHello returns the handshake message of the ClientHello from the TLS records starting
+// the connection. It returns whether no more bytes are needed, which is also the case if the
+// connection doesn't start with a handshake record.
+func clientHello(data []byte) ([]byte, bool) {
+	var msg []byte
+	for len(data) >= 5 {
+		if data[0] != 0x16 {
+			return nil, true
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+length {
+			break
+		}
+		msg = append(msg, data[5:5+length]...)
+		data = data[5+length:]
+		if len(msg) >= 4 {
+			size := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if len(msg) >= size {
+				return msg[:size], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// helloFields are the fields of a ClientHello the fingerprints are made of.
+type helloFields struct {
+	version             uint16
+	ciphers             []uint16
+	extensions          []uint16
+	groups              []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	versions            []uint16
+	alpn                []string
+	sni                 bool
+}
+
+// parseClientHello parses the handshake message of a ClientHello.
+func parseClientHello(msg []byte) (*helloFields, bool) {
+	r := helloReader(msg)
+	if t, ok := r.uint8(); !ok || t != 1 {
+		return nil, false
+	}
+	r.skip(3)
+	h := &helloFields{}
+	var ok bool
+	if h.version, ok = r.uint16(); !ok || !r.skip(32) {
+		return nil, false
+	}
+	sessionID, _ := r.uint8()
+	if !r.skip(int(sessionID)) {
+		return nil, false
+	}
+	ciphers, ok := r.vector16()
+	if !ok {
+		return nil, false
+	}
+	h.ciphers = ciphers.uint16s()
+	compression, _ := r.uint8()
+	if !r.skip(int(compression)) {
+		return nil, false
+	}
+
+	extensions, _ := r.vector16()
+	for len(extensions) >= 4 {
+		t, _ := extensions.uint16()
+		data, ok := extensions.vector16()
+		if !ok {
+			return nil, false
+		}
+		h.extensions = append(h.extensions, t)
+		switch t {
+		case extServerName:
+			h.sni = true
+		case extSupportedGroups:
+			list, _ := data.vector16()
+			h.groups = list.uint16s()
+		case extPointFormats:
+			list, _ := data.vector8()
+			h.pointFormats = list
+		case extSignatureAlgorithms:
+			list, _ := data.vector16()
+			h.signatureAlgorithms = list.uint16s()
+		case extSupportedVersions:
+			list, _ := data.vector8()
+			h.versions = helloReader(list).uint16s()
+		case extALPN:
+			list, _ := data.vector16()
+			for len(list) > 0 {
+				proto, ok := list.vector8()
+				if !ok {
+					break
+				}
+				h.alpn = append(h.alpn, string(proto))
+			}
+		}
+	}
+	return h, true
+}
+
+// isGREASE returns whether the value is one of the reserved values of RFC 8701, which clients
+// send randomly and which are ignored by the fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var out []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinValues(values []uint16, sep string, format func(uint16) string) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = format(v)
+	}
+	return strings.Join(parts, sep)
+}
+
+// ja3 returns the MD5 of the JA3 string of the ClientHello.
+func (h *helloFields) ja3() string {
+	decimal := func(v uint16) string { return strconv.Itoa(int(v)) }
+	formats := make([]uint16, len(h.pointFormats))
+	for i, f := range h.pointFormats {
+		formats[i] = uint16(f)
+	}
+	s := strings.Join([]string{
+		decimal(h.version),
+		joinValues(withoutGREASE(h.ciphers), "-", decimal),
+		joinValues(withoutGREASE(h.extensions), "-", decimal),
+		joinValues(withoutGREASE(h.groups), "-", decimal),
+		joinValues(formats, "-", decimal),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello.
+func (h *helloFields) ja4() string {
+	version := h.version
+	if versions := withoutGREASE(h.versions); len(versions) > 0 {
+		version = versions[0]
+		for _, v := range versions {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	names := map[uint16]string{0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3", 0x0002: "s2"}
+	v, ok := names[version]
+	if !ok {
+		v = "00"
+	}
+	sni := "i"
+	if h.sni {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.alpn) > 0 && h.alpn[0] != "" {
+		first, last := h.alpn[0][0], h.alpn[0][len(h.alpn[0])-1]
+		if isAlphanumeric(first) && isAlphanumeric(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			alpn = hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+		}
+	}
+	ciphers := withoutGREASE(h.ciphers)
+	extensions := withoutGREASE(h.extensions)
+	a := fmt.Sprintf("t%s%s%02d%02d%s", v, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	hexValue := func(v uint16) string { return fmt.Sprintf("%04x", v) }
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	var sorted []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	c := joinValues(sorted, ",", hexValue)
+	if algorithms := withoutGREASE(h.signatureAlgorithms); len(algorithms) > 0 {
+		c += "_" + joinValues(algorithms, ",", hexValue)
+	}
+	return a + "_" + truncatedHash(joinValues(ciphers, ",", hexValue), len(ciphers)) + "_" + truncatedHash(c, len(sorted))
+}
+
+func isAlphanumeric(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// truncatedHash returns the first 12 hex digits of the SHA256 of s, or zeros if there are no
+// values.
+func truncatedHash(s string, values int) string {
+	if values == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// helloReader reads the fields of a ClientHello.
+type helloReader []byte
+
+func (r *helloReader) skip(n int) bool {
+	if n < 0 || len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *helloReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) vector8() (helloReader, bool) {
+	n, ok := r.uint8()
+	if !ok || len(*r) < int(n) {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *helloReader) vector16() (helloReader, bool) {
+	n, ok := r.uint16()
+	if !ok || len(*r) < int(n) {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r helloReader) uint16s() []uint16 {
+	var values []uint16
+	for len(r) >= 2 {
+		v, _ := r.uint16()
+		values = append(values, v)
+	}
+	return values
+}
+
+// fingerprintConnOf returns the recording connection beneath the connection of a request.
+func fingerprintConnOf(c net.Conn) *fingerprintConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	fc, _ := c.(*fingerprintConn)
+	return fc
+}
+
+// withFingerprint passes the connection of the request, whose ClientHello has been recorded,
+// to the context of its handling.
+func withFingerprint(ctx context.Context, req *http.Request) context.Context {
+	if fc, ok := req.Context().Value(fingerprintKey).(*fingerprintConn); ok {
+		return context.WithValue(ctx, fingerprintKey, fc)
+	}
+	return ctx
+}
+
+// fingerprintFields adds the TLS fingerprints of the client of the context to the fields of
+// a log entry.
+func fingerprintFields(ctx context.Context, fields log.Fields) log.Fields {
+	if fc, ok := ctx.Value(fingerprintKey).(*fingerprintConn); ok {
+		if ja3, ja4 := fc.fingerprints(); ja3 != "" {
+			fields["ja3"] = ja3
+			fields["ja4"] = ja4
+		}
+	}
+	return fields
+}
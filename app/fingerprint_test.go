@@ -0,0 +1,151 @@
+package app
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testClientHello builds the TLS records of a ClientHello with the ciphers and extensions,
+// split into records of at most recordSize bytes.
+func testClientHello(ciphers []uint16, extensions [][]byte, recordSize int) []byte {
+	u16 := func(v int) []byte { return []byte{byte(v >> 8), byte(v)} }
+	body := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+	body = append(body, 0)
+	body = append(body, u16(2*len(ciphers))...)
+	for _, c := range ciphers {
+		body = append(body, u16(int(c))...)
+	}
+	body = append(body, 1, 0)
+	var exts []byte
+	for _, e := range extensions {
+		exts = append(exts, e...)
+	}
+	body = append(body, u16(len(exts))...)
+	body = append(body, exts...)
+	msg := append([]byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+
+	var records []byte
+	for len(msg) > 0 {
+		n := recordSize
+		if n > len(msg) {
+			n = len(msg)
+		}
+		records = append(records, 0x16, 0x03, 0x01)
+		records = append(records, u16(n)...)
+		records = append(records, msg[:n]...)
+		msg = msg[n:]
+	}
+	return records
+}
+
+func testExtension(t uint16, data ...byte) []byte {
+	e := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(e, t)
+	binary.BigEndian.PutUint16(e[2:], uint16(len(data)))
+	return append(e, data...)
+}
+
+func TestClientHelloFingerprints(t *testing.T) {
+	records := testClientHello([]uint16{0x0a0a, 0x1301, 0xc02b}, [][]byte{
+		testExtension(0x2a2a),
+		testExtension(extServerName, 0, 12, 0, 0, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't'),
+		testExtension(extALPN, 0, 3, 2, 'h', '2'),
+		testExtension(extSupportedGroups, 0, 4, 0, 0x1d, 0, 0x17),
+		testExtension(extPointFormats, 1, 0),
+		testExtension(extSignatureAlgorithms, 0, 4, 0x04, 0x03, 0x08, 0x04),
+		testExtension(extSupportedVersions, 4, 0x03, 0x04, 0x03, 0x03),
+	}, 50)
+
+	if _, complete := clientHello(records[:len(records)-1]); complete {
+		t.Error("clientHello() of a truncated ClientHello complete = true, want false")
+	}
+	msg, complete := clientHello(records)
+	if !complete {
+		t.Fatal("clientHello() complete = false, want true")
+	}
+	h, ok := parseClientHello(msg)
+	if !ok {
+		t.Fatal("parseClientHello() ok = false, want true")
+	}
+
+	ja3 := md5.Sum([]byte("771,4865-49195,0-16-10-11-13-43,29-23,0"))
+	if got, want := h.ja3(), hex.EncodeToString(ja3[:]); got != want {
+		t.Errorf("ja3() = %v, want %v", got, want)
+	}
+	sha12 := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+	if got, want := h.ja4(), "t13d0206h2_"+sha12("1301,c02b")+"_"+sha12("000a,000b,000d,002b_0403,0804"); got != want {
+		t.Errorf("ja4() = %v, want %v", got, want)
+	}
+
+	if _, complete := clientHello([]byte("GET / HTTP/1.1\r\n")); !complete {
+		t.Error("clientHello() of plain HTTP complete = false, want true")
+	}
+}
+
+func TestFingerprintListener(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ca := newTestCA(t)
+	kp := ca.writeKeyPair(t, tmpDir, "localhost")
+	cert, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+	if err != nil {
+		t.Fatalf("error loading test certificate. error = %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening. error = %v", err)
+	}
+	defer ln.Close()
+	tlsLn := tls.NewListener(&fingerprintListener{Listener: ln}, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+
+	accepted := make(chan *fingerprintConn, 1)
+	go func() {
+		c, err := tlsLn.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		defer c.Close()
+		if err := c.(*tls.Conn).Handshake(); err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- fingerprintConnOf(c)
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost", RootCAs: roots, NextProtos: []string{"h2"}})
+	if err != nil {
+		t.Fatalf("error connecting. error = %v", err)
+	}
+	defer client.Close()
+
+	fc := <-accepted
+	if fc == nil {
+		t.Fatal("fingerprintConnOf() of the accepted connection = nil")
+	}
+	ja3, ja4 := fc.fingerprints()
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(ja3) {
+		t.Errorf("ja3 = %v, want an MD5", ja3)
+	}
+	if !regexp.MustCompile(`^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(ja4) {
+		t.Errorf("ja4 = %v, want a TLS 1.3 fingerprint with SNI and h2", ja4)
+	}
+}
@@ -2,12 +2,14 @@ package app
 
 import (
 	"context"
+	daveplugin "github.com/micromata/dave/plugin"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/webdav"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // This file is an extension of golang.org/x/net/webdav/file.go.
@@ -15,7 +17,15 @@ import (
 // Dir is specialization of webdav.Dir with respect of an authenticated
 // user to allow configuration access.
 type Dir struct {
-	Config *Config
+	Config    *Config
+	Quotas    *Quotas
+	Sync      *SyncLog
+	Props     *PropertyStore
+	Trash     *TrashBin
+	Replica   *Replicator
+	Versions  *VersionStore
+	Webhooks  *WebhookDispatcher
+	Checksums *IntegrityChecker
 }
 
 func (d Dir) resolveUser(ctx context.Context) string {
@@ -36,89 +46,363 @@ func (d Dir) resolve(ctx context.Context, name string) string {
 		strings.Contains(name, "\x00") {
 		return ""
 	}
+	if resolved, ok := d.Config.SharedFolder.resolve(name); ok {
+		traceStep(ctx, "resolved %s within the shared folder to %s", name, resolved)
+		return resolved
+	}
+	if resolved, ok := d.Config.resolveExport(ctx, name); ok {
+		traceStep(ctx, "resolved %s within an export to %s", name, resolved)
+		return resolved
+	}
+	if resolved, ok := d.Versions.resolve(d.userSubdir(ctx), name); ok {
+		traceStep(ctx, "resolved %s within the versions to %s", name, resolved)
+		return resolved
+	}
 	dir := string(d.Config.Dir)
 	if dir == "" {
 		dir = "."
 	}
 
+	if subdir := d.Config.guestSubdir(ctx); subdir != nil {
+		resolved := filepath.Join(dir, *subdir, filepath.FromSlash(path.Clean("/"+name)))
+		traceStep(ctx, "resolved %s within subdir of the guests to %s", name, resolved)
+		return resolved
+	}
+
 	// Second barrier after basic auth process
 	authInfo := AuthFromContext(ctx)
 	if authInfo != nil && authInfo.Authenticated {
-		userInfo := d.Config.Users[authInfo.Username]
+		userInfo := d.Config.User(authInfo.Username)
 		if userInfo != nil && userInfo.Subdir != nil {
-			return filepath.Join(dir, *userInfo.Subdir, filepath.FromSlash(path.Clean("/"+name)))
+			resolved := filepath.Join(dir, *userInfo.Subdir, filepath.FromSlash(path.Clean("/"+name)))
+			traceStep(ctx, "resolved %s within subdir of user %s to %s", name, authInfo.Username, resolved)
+			return resolved
 		}
 	}
 
-	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+	resolved := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+	traceStep(ctx, "resolved %s to %s", name, resolved)
+	return resolved
 }
 
-// Mkdir resolves the physical file and delegates this to an os.Mkdir execution
+// userSubdir returns the subdir of the authenticated user or the guest, if there is one.
+func (d Dir) userSubdir(ctx context.Context) string {
+	if subdir := d.Config.guestSubdir(ctx); subdir != nil {
+		return *subdir
+	}
+	if user := d.Config.User(d.resolveUser(ctx)); user != nil && user.Subdir != nil {
+		return *user.Subdir
+	}
+	return ""
+}
+
+// Mkdir resolves the physical file and delegates this to the storage of the files
 func (d Dir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 	if name = d.resolve(ctx, name); name == "" {
 		return os.ErrNotExist
 	}
-	err := os.Mkdir(name, perm)
+	if err := d.checkReadOnly(ctx, name); err != nil {
+		return err
+	}
+	if err := d.checkShared(ctx, name); err != nil {
+		return err
+	}
+	if err := d.checkVersions(ctx, name); err != nil {
+		return err
+	}
+	if err := d.checkPermission(ctx, name, "write", func(a access) bool { return a.write }); err != nil {
+		return err
+	}
+	if err := d.authorize(ctx, daveplugin.OpMkdir, name, ""); err != nil {
+		return err
+	}
+	if err := d.encryptedFolder(ctx, name).access(name); err != nil {
+		return err
+	}
+	if d.Config.dryRun() {
+		traceStep(ctx, "dry run, skipped creating directory")
+		d.logDryRun(ctx, "Would create directory", log.Fields{"path": name})
+		return nil
+	}
+	revert, err := d.Quotas.mkdir(ctx, name)
+	if err != nil {
+		return err
+	}
+	err = d.Config.storage().Mkdir(name, perm)
 	if err != nil {
+		revert()
 		return err
 	}
+	d.Sync.record(name, false)
+	d.Replica.changed(name, false)
+	d.publish(ctx, daveplugin.EventMkdir, name, "")
+	d.notify(ctx, &webhookEvent{Operation: webhookCreate, Path: name, Directory: true})
 
-	if d.Config.Log.Create {
-		log.WithFields(log.Fields{
+	if d.Config.Logging().Create {
+		log.WithFields(fingerprintFields(ctx, log.Fields{
 			"path": name,
 			"user": d.resolveUser(ctx),
-		}).Info("Created directory")
+		})).Info("Created directory")
 	}
 
 	return err
 }
 
-// OpenFile resolves the physical file and delegates this to an os.OpenFile execution
+// OpenFile resolves the physical file and delegates this to the storage of the files
 func (d Dir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&os.O_CREATE != 0 && len(d.Config.UploadRoutes) > 0 {
+		if routed := d.routeUpload(ctx, name, time.Now()); routed != path.Clean("/"+name) {
+			if err := d.mkdirParents(ctx, routed); err != nil {
+				return nil, err
+			}
+			name = routed
+		}
+	}
+	target := name
 	if name = d.resolve(ctx, name); name == "" {
 		return nil, os.ErrNotExist
 	}
-	f, err := os.OpenFile(name, flag, perm)
+	op := daveplugin.OpRead
+	if flag&writeFlags != 0 {
+		if err := d.checkReadOnly(ctx, name); err != nil {
+			return nil, err
+		}
+		if err := d.checkShared(ctx, name); err != nil {
+			return nil, err
+		}
+		if err := d.checkVersions(ctx, name); err != nil {
+			return nil, err
+		}
+		op = daveplugin.OpWrite
+	}
+	if err := d.checkOpenPermission(ctx, name, flag); err != nil {
+		return nil, err
+	}
+	if err := d.authorize(ctx, op, name, ""); err != nil {
+		return nil, err
+	}
+	folder := d.encryptedFolder(ctx, name)
+	if err := folder.access(name); err != nil {
+		return nil, err
+	}
+	if flag == os.O_RDWR && d.Props != nil {
+		// PROPPATCH opens the file like this to change its dead properties. The content isn't
+		// written, so the file is only opened for reading.
+		var dryRun func()
+		if d.Config.dryRun() {
+			dryRun = func() { d.logDryRun(ctx, "Would change properties", log.Fields{"path": name}) }
+		}
+		f, err := d.Config.storage().OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return d.Props.openPropFile(f, name, dryRun), nil
+	}
+	flag, err := d.checkAppendOnlyWrite(ctx, name, flag)
+	if err != nil {
+		return nil, err
+	}
+	if flag&writeFlags != 0 {
+		if err := d.checkRetention(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	if d.Config.dryRun() && flag&writeFlags != 0 {
+		d.logDryRun(ctx, "Would write file", log.Fields{"path": name})
+		return &dryRunFile{name: name, modTime: time.Now()}, nil
+	}
+	openPlain := func(name string, flag int) (webdav.File, error) {
+		if d.Quotas != nil && flag&writeFlags != 0 {
+			return d.Quotas.openQuotaFile(ctx, name, flag, perm)
+		}
+		return d.Config.storage().OpenFile(name, flag, perm)
+	}
+	open := func() (webdav.File, error) {
+		return openPlain(name, flag)
+	}
+	keepVersion := folder == nil && d.Versions.keeps(name, flag)
+	staged := d.Config.AtomicUploads.stages(flag)
+	if staged {
+		// the previous content is kept as version once the staged upload replaces it
+		open = func() (webdav.File, error) {
+			return d.openStagedFile(ctx, name, flag, keepVersion, openPlain)
+		}
+	}
+	if folder != nil {
+		plain := open
+		open = func() (webdav.File, error) {
+			return folder.openFile(name, flag, plain)
+		}
+	} else if d.Checksums != nil && flag&writeFlags != 0 {
+		unhashed := open
+		open = func() (webdav.File, error) {
+			f, err := unhashed()
+			if err != nil {
+				return nil, err
+			}
+			return d.Checksums.openHashingFile(f, name, flag), nil
+		}
+	}
+	if check := d.Config.ContentCheck.directory(d.Config.Dir, name); check != nil && flag&writeFlags != 0 {
+		unchecked := open
+		open = func() (webdav.File, error) {
+			return check.openCheckedFile(ctx, d.Config.storage(), name, d.resolveUser(ctx), flag, unchecked)
+		}
+	}
+	if limit := d.Config.uploadLimit(d.resolveUser(ctx)); limit != nil && flag&writeFlags != 0 {
+		unlimited := open
+		open = func() (webdav.File, error) {
+			return limit.openLimitedFile(ctx, d.Config.storage(), name, d.resolveUser(ctx), flag, unlimited)
+		}
+	}
+	if expected := checksumsFromContext(ctx); expected != nil && flag&writeFlags != 0 {
+		unverified := open
+		open = func() (webdav.File, error) {
+			return expected.openVerifiedFile(ctx, d.Config.storage(), name, d.resolveUser(ctx), flag, unverified)
+		}
+	}
+	restoreVersion := func() {}
+	if keepVersion && !staged {
+		revert := d.Quotas.remove(ctx, name)
+		restore, err := d.Versions.keep(ctx, name)
+		if err != nil {
+			revert()
+			return nil, err
+		}
+		restoreVersion = func() {
+			restore()
+			revert()
+		}
+	}
+	operation := webhookUpdate
+	if d.Webhooks != nil && flag&writeFlags != 0 {
+		if _, err := d.Config.storage().Stat(name); os.IsNotExist(err) {
+			operation = webhookCreate
+		}
+	}
+	var f webdav.File
+	if d.Config.ICAP != nil && flag&writeFlags != 0 {
+		f, err = d.Config.ICAP.openScanFile(ctx, d.Config.storage(), name, target, d.resolveUser(ctx), flag, open)
+	} else {
+		f, err = open()
+	}
 	if err != nil {
+		restoreVersion()
 		return nil, err
 	}
 
-	if d.Config.Log.Read {
-		log.WithFields(log.Fields{
+	if d.Config.Logging().Read {
+		log.WithFields(fingerprintFields(ctx, log.Fields{
 			"path": name,
 			"user": d.resolveUser(ctx),
-		}).Info("Opened file")
+		})).Info("Opened file")
 	}
 
-	return f, nil
+	if (len(d.Config.Plugins) > 0 || d.Webhooks != nil) && flag&writeFlags != 0 {
+		f = &eventFile{File: f, close: func(err error) {
+			d.publish(ctx, daveplugin.EventWrite, name, "")
+			if fi, statErr := d.Config.storage().Stat(name); err == nil && statErr == nil && !fi.IsDir() {
+				size := fi.Size()
+				d.notify(ctx, &webhookEvent{Operation: operation, Path: name, Size: &size})
+			}
+		}}
+	}
+	if folder == nil {
+		f = d.openDuplicateFile(ctx, f, name, flag)
+	}
+	f = d.openSharedRoot(f, target, flag)
+	f = d.openExportRoot(ctx, f, target, flag)
+	f = d.openVersionsRoot(f, target)
+	f = d.openPermissionDir(ctx, f, name, flag)
+	f = d.openStagingDir(f, flag)
+	f = d.Props.openPropFile(f, name, nil)
+	if folder == nil {
+		f = d.Checksums.openChecksumFile(f, name, flag)
+	}
+	f = d.Replica.openReplicaFile(f, name, flag)
+	f = d.Quotas.openQuotaDir(f, name, flag)
+	return d.Sync.openSyncFile(f, name, flag), nil
 }
 
-// RemoveAll resolves the physical file and delegates this to an os.RemoveAll execution
+// RemoveAll resolves the physical file and delegates this to the storage of the files
 func (d Dir) RemoveAll(ctx context.Context, name string) error {
+	requested := name
 	if name = d.resolve(ctx, name); name == "" {
 		return os.ErrNotExist
 	}
-	if name == filepath.Clean(string(d.Config.Dir)) {
-		// Prohibit removing the virtual root directory.
+	if name == filepath.Clean(string(d.Config.Dir)) || d.Config.isExportRoot(name) {
+		// Prohibit removing the virtual root directory and the exports.
 		return os.ErrInvalid
 	}
+	if err := d.checkReadOnly(ctx, name); err != nil {
+		return err
+	}
+	if err := d.checkShared(ctx, name); err != nil {
+		return err
+	}
+	if err := d.checkVersions(ctx, name); err != nil {
+		return err
+	}
+	if err := d.checkPermission(ctx, name, "delete", func(a access) bool { return a.delete }); err != nil {
+		return err
+	}
+	if err := d.authorize(ctx, daveplugin.OpDelete, name, ""); err != nil {
+		return err
+	}
+	if folder := d.encryptedFolder(ctx, name); folder != nil {
+		if err := folder.access(name); err != nil {
+			return err
+		}
+		if folder.key == nil {
+			return errFolderLocked
+		}
+	}
+	if err := d.checkAppendOnlyChange(ctx, name); err != nil {
+		return err
+	}
+	if err := d.checkRetention(ctx, name); err != nil {
+		return err
+	}
+	if err := d.requestDeletion(ctx, name); err != nil {
+		return err
+	}
+	if d.Config.dryRun() {
+		d.logDryRun(ctx, "Would delete file or directory", log.Fields{"path": name})
+		return nil
+	}
 
-	err := os.RemoveAll(name)
+	revert := d.Quotas.remove(ctx, name)
+	var err error
+	exported := d.Config.exportOf(name) != nil
+	switch {
+	case d.Trash != nil && !exported:
+		err = d.Trash.trash(ctx, d.resolveUser(ctx), requested, name)
+	case d.Versions != nil && !exported && d.encryptedFolder(ctx, name) == nil:
+		err = d.Versions.remove(ctx, name)
+	default:
+		err = d.Config.storage().RemoveAll(name)
+	}
 	if err != nil {
+		revert()
 		return err
 	}
+	d.Sync.record(name, false)
+	d.Replica.changed(name, false)
+	d.Props.remove(name)
+	d.publish(ctx, daveplugin.EventDelete, name, "")
+	d.notify(ctx, &webhookEvent{Operation: webhookDelete, Path: name})
 
-	if d.Config.Log.Delete {
-		log.WithFields(log.Fields{
+	if d.Config.Logging().Delete {
+		log.WithFields(fingerprintFields(ctx, log.Fields{
 			"path": name,
 			"user": d.resolveUser(ctx),
-		}).Info("Deleted file or directory")
+		})).Info("Deleted file or directory")
 	}
 
 	return nil
 }
 
-// Rename resolves the physical file and delegates this to an os.Rename execution
+// Rename resolves the physical file and delegates this to the storage of the files
 func (d Dir) Rename(ctx context.Context, oldName, newName string) error {
 	if oldName = d.resolve(ctx, oldName); oldName == "" {
 		return os.ErrNotExist
@@ -126,31 +410,112 @@ func (d Dir) Rename(ctx context.Context, oldName, newName string) error {
 	if newName = d.resolve(ctx, newName); newName == "" {
 		return os.ErrNotExist
 	}
-	if root := filepath.Clean(string(d.Config.Dir)); root == oldName || root == newName {
-		// Prohibit renaming from or to the virtual root directory.
+	if root := filepath.Clean(string(d.Config.Dir)); root == oldName || root == newName ||
+		d.Config.isExportRoot(oldName) || d.Config.isExportRoot(newName) {
+		// Prohibit renaming from or to the virtual root directory and the exports.
 		return os.ErrInvalid
 	}
+	if err := d.checkReadOnly(ctx, oldName); err != nil {
+		return err
+	}
+	if err := d.checkShared(ctx, oldName); err != nil {
+		return err
+	}
+	if err := d.checkShared(ctx, newName); err != nil {
+		return err
+	}
+	if err := d.checkVersions(ctx, oldName); err != nil {
+		return err
+	}
+	if err := d.checkVersions(ctx, newName); err != nil {
+		return err
+	}
+	if err := d.checkPermission(ctx, oldName, "move", func(a access) bool { return a.delete }); err != nil {
+		return err
+	}
+	if err := d.checkPermission(ctx, newName, "write", func(a access) bool { return a.write }); err != nil {
+		return err
+	}
+	if err := d.Config.uploadLimit(d.resolveUser(ctx)).checkRename(ctx, newName, d.resolveUser(ctx)); err != nil {
+		return err
+	}
+	if err := d.authorize(ctx, daveplugin.OpRename, oldName, newName); err != nil {
+		return err
+	}
+	if err := d.checkEncryptedRename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	if err := d.checkAppendOnlyChange(ctx, oldName); err != nil {
+		return err
+	}
+	if err := d.checkAppendOnlyChange(ctx, newName); err != nil {
+		return err
+	}
+	if err := d.checkRetention(ctx, oldName); err != nil {
+		return err
+	}
+	if err := d.checkRetention(ctx, newName); err != nil {
+		return err
+	}
+	if d.Config.dryRun() {
+		d.logDryRun(ctx, "Would rename file or directory", log.Fields{"oldPath": oldName, "newPath": newName})
+		return nil
+	}
 
-	err := os.Rename(oldName, newName)
+	revert, err := d.Quotas.move(ctx, oldName, newName)
+	if err != nil {
+		return err
+	}
+	err = d.Config.storage().Rename(oldName, newName)
 	if err != nil {
+		revert()
 		return err
 	}
+	d.Sync.record(oldName, false)
+	d.Sync.record(newName, true)
+	d.Replica.changed(oldName, false)
+	d.Replica.changed(newName, true)
+	d.Props.move(oldName, newName)
+	d.publish(ctx, daveplugin.EventRename, oldName, newName)
+	d.notify(ctx, &webhookEvent{Operation: webhookRename, Path: oldName, Destination: newName})
 
-	if d.Config.Log.Update {
-		log.WithFields(log.Fields{
+	if d.Config.Logging().Update {
+		log.WithFields(fingerprintFields(ctx, log.Fields{
 			"oldPath": oldName,
 			"newPath": newName,
 			"user":    d.resolveUser(ctx),
-		}).Info("Renamed file or directory")
+		})).Info("Renamed file or directory")
 	}
 
 	return nil
 }
 
-// Stat resolves the physical file and delegates this to an os.Stat execution
+// Stat resolves the physical file and delegates this to the storage of the files
 func (d Dir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if fi, ok, err := d.Config.statExport(ctx, name); ok {
+		return fi, err
+	}
+	if shared := d.Config.SharedFolder; shared != nil && path.Clean("/"+name) == "/"+shared.name() {
+		fi, err := os.Stat(shared.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return sharedFileInfo{FileInfo: fi, name: shared.name()}, nil
+	}
+	versionsRoot := d.Versions != nil && path.Clean("/"+name) == "/"+d.Versions.settings.name()
 	if name = d.resolve(ctx, name); name == "" {
 		return nil, os.ErrNotExist
 	}
-	return os.Stat(name)
+	folder := d.encryptedFolder(ctx, name)
+	if err := folder.access(name); err != nil {
+		return nil, err
+	}
+	fi, err := d.Config.storage().Stat(name)
+	if err == nil && versionsRoot {
+		return sharedFileInfo{FileInfo: fi, name: d.Versions.settings.name()}, nil
+	}
+	if err != nil || folder == nil {
+		return fi, err
+	}
+	return encryptedInfo(fi), nil
 }
@@ -487,3 +487,56 @@ func createTestConfig(dir string) *Config {
 	}
 	return config
 }
+
+func TestDirDryRun(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	configTmp := createTestConfig(tmpDir)
+	configTmp.DryRun = true
+
+	ctx := context.Background()
+	admin := context.WithValue(ctx, authInfoKey, &AuthInfo{Username: "admin", Authenticated: true})
+	d := Dir{Config: configTmp}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "existing"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Dir dry run pre condition failed. error = %v", err)
+	}
+
+	if err := d.Mkdir(admin, "a", 0700); err != nil {
+		t.Errorf("Dir.Mkdir() error = %v", err)
+	}
+	f, err := d.OpenFile(admin, "b", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("Dir.OpenFile() error = %v", err)
+	}
+	if n, err := f.Write([]byte("discarded")); n != 9 || err != nil {
+		t.Errorf("dryRunFile.Write() = %v, %v", n, err)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 9 || fi.Name() != "b" {
+		t.Errorf("dryRunFile.Stat() = %v, %v", fi.Name(), fi.Size())
+	}
+	f.Close()
+	if err := d.RemoveAll(admin, "existing"); err != nil {
+		t.Errorf("Dir.RemoveAll() error = %v", err)
+	}
+	if err := d.Rename(admin, "existing", "renamed"); err != nil {
+		t.Errorf("Dir.Rename() error = %v", err)
+	}
+
+	for _, name := range []string{"a", "b", "renamed"} {
+		if _, err := os.Stat(filepath.Join(tmpDir, name)); !os.IsNotExist(err) {
+			t.Errorf("Dir dry run created %v. error = %v", name, err)
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(tmpDir, "existing")); err != nil || string(content) != "content" {
+		t.Errorf("Dir dry run modified existing file. content = %s, error = %v", content, err)
+	}
+
+	// reading is still possible
+	r, err := d.OpenFile(admin, "existing", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Dir.OpenFile() read error = %v", err)
+	}
+	r.Close()
+}
@@ -0,0 +1,803 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings of the FTP frontend
+const (
+	defaultFTPPort = "2121"
+	ftpIdleTimeout = 5 * time.Minute
+	ftpDataTimeout = 30 * time.Second
+)
+
+// FTP configures a frontend for legacy devices like scanners and cameras, which only speak
+// FTP. It serves the same directory to the same users as WebDAV, including their subdirs and
+// quotas. With TLS, clients can secure their connections by AUTH TLS (explicit FTPS), which
+// RequireTLS enforces before the login. Passive data connections use a port of PassivePorts,
+// like 50000-50100, and are announced with PublicAddress if the server is behind NAT.
+type FTP struct {
+	Address       string
+	Port          string
+	TLS           *TLS
+	RequireTLS    bool
+	PassivePorts  string
+	PublicAddress string
+}
+
+// Listener returns the listener of the control connections.
+func (f *FTP) Listener() *Listener {
+	return &Listener{Address: f.Address, Port: f.Port, TLS: f.TLS}
+}
+
+// FTPServer serves the file system of the WebDAV handler via FTP. Control connections are
+// idle while they wait for the next command, so Shutdown closes them then.
+type FTPServer struct {
+	connServer
+	app       *App
+	fs        webdav.FileSystem
+	settings  *FTP
+	tlsConfig *tls.Config
+	minPort   int
+	maxPort   int
+}
+
+// NewFTPServer creates an FTP frontend for the users of the app and the file system.
+func NewFTPServer(a *App, fs webdav.FileSystem) (*FTPServer, error) {
+	settings := a.Config.FTP
+	s := &FTPServer{app: a, fs: fs, settings: settings}
+	var err error
+	if s.minPort, s.maxPort, err = parsePortRange(settings.PassivePorts); err != nil {
+		return nil, err
+	}
+	if s.tlsConfig, err = settings.Listener().TLSConfig(); err != nil {
+		return nil, err
+	}
+	if settings.RequireTLS && s.tlsConfig == nil {
+		return nil, errors.New("FTP requires TLS, but no TLS configuration is given")
+	}
+	return s, nil
+}
+
+// parsePortRange parses a range of ports like 50000-50100. An empty range lets the system
+// choose the ports.
+func parsePortRange(ports string) (int, int, error) {
+	if ports == "" {
+		return 0, 0, nil
+	}
+
+	from, to := ports, ports
+	if i := strings.Index(ports, "-"); i >= 0 {
+		from, to = ports[:i], ports[i+1:]
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(from))
+	max, err2 := strconv.Atoi(strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || min <= 0 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid passive port range %q", ports)
+	}
+	return min, max, nil
+}
+
+// Serve accepts control connections until the listener fails. It returns
+// http.ErrServerClosed after Shutdown or Close.
+func (s *FTPServer) Serve(ln net.Listener) error {
+	return s.serve(ln, s.serveConn)
+}
+
+// ftpSession is the state of a single control connection.
+type ftpSession struct {
+	server  *FTPServer
+	conn    net.Conn
+	text    *textproto.Conn
+	ctx     context.Context
+	user    string
+	authed  bool
+	secure  bool
+	protect bool
+	cwd     string
+	rename  string
+	passive net.Listener
+	active  string
+}
+
+func (s *FTPServer) serveConn(conn net.Conn) {
+	session := &ftpSession{server: s, conn: conn, text: textproto.NewConn(conn), ctx: context.Background(), cwd: "/"}
+	defer func() {
+		session.closePassive()
+		session.text.Close()
+	}()
+
+	log.WithField("address", session.remoteIP()).Debug("FTP client connected")
+	if s.app.Tripwire.isBanned(session.remoteIP(), time.Now()) {
+		session.reply(421, "Service not available")
+		return
+	}
+	if m := s.app.Config.maintenanceMode(); m != nil {
+		session.reply(421, m.Message)
+		return
+	}
+	if s.app.Resources.shedReason("") != "" {
+		session.reply(421, "Service not available, too many open files")
+		return
+	}
+	session.reply(220, "dave FTP server ready")
+	for {
+		if !s.idle(conn, true) {
+			return
+		}
+		session.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		line, err := session.text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.idle(conn, false)
+
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		if !session.handle(strings.ToUpper(cmd), arg) {
+			return
+		}
+	}
+}
+
+func (s *ftpSession) reply(code int, msg string) {
+	s.text.PrintfLine("%d %s", code, msg)
+}
+
+func (s *ftpSession) replyError(err error) {
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		s.reply(552, "Quota exceeded")
+	case errors.Is(err, errScanRejected):
+		s.reply(550, "Rejected by content scan")
+	case errors.Is(err, errContentMismatch):
+		s.reply(550, "Content doesn't match the file type")
+	case errors.Is(err, errUploadTooLarge):
+		s.reply(552, "File exceeds the maximum size")
+	case errors.Is(err, errUploadNotAllowed), errors.Is(err, errUploadPartial):
+		s.reply(550, "File type isn't allowed")
+	case errors.Is(err, errAppendOnly):
+		s.reply(550, "Append-only directory")
+	case errors.Is(err, errRetained):
+		s.reply(550, "File is retained")
+	case errors.Is(err, errReadOnly):
+		s.reply(550, "Server is read-only")
+	case errors.Is(err, errPluginDenied):
+		s.reply(550, "Permission denied")
+	case errors.Is(err, errDeletionPending):
+		s.reply(450, "Deletion pending approval")
+	case errors.Is(err, errBandwidthExceeded):
+		s.reply(450, "Bandwidth cap exceeded")
+	case os.IsNotExist(err):
+		s.reply(550, "No such file or directory")
+	case os.IsExist(err):
+		s.reply(550, "File exists")
+	case os.IsPermission(err):
+		s.reply(550, "Permission denied")
+	default:
+		s.reply(451, "Requested action aborted: local error in processing")
+	}
+}
+
+// username returns the name of the logged in user, which is empty without authentication.
+func (s *ftpSession) username() string {
+	if authInfo := AuthFromContext(s.ctx); authInfo != nil && authInfo.Authenticated {
+		return authInfo.Username
+	}
+	return ""
+}
+
+func (s *ftpSession) remoteIP() string {
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	return host
+}
+
+// path resolves the argument of a command against the working directory.
+func (s *ftpSession) path(arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = s.cwd + "/" + arg
+	}
+	return path.Clean(arg)
+}
+
+// handle executes a command and returns whether the session continues.
+func (s *ftpSession) handle(cmd, arg string) bool {
+	switch cmd {
+	case "QUIT":
+		s.reply(221, "Goodbye")
+		return false
+	case "NOOP":
+		s.reply(200, "OK")
+	case "SYST":
+		s.reply(215, "UNIX Type: L8")
+	case "FEAT":
+		s.text.PrintfLine("211-Features:")
+		if s.server.tlsConfig != nil {
+			s.text.PrintfLine(" AUTH TLS\r\n PBSZ\r\n PROT")
+		}
+		s.text.PrintfLine(" EPSV\r\n PASV\r\n SIZE\r\n MDTM\r\n UTF8")
+		s.reply(211, "End")
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			s.reply(200, "UTF8 enabled")
+		} else {
+			s.reply(501, "Option not supported")
+		}
+	case "AUTH":
+		s.auth(arg)
+	case "PBSZ":
+		s.reply(200, "PBSZ=0")
+	case "PROT":
+		s.prot(arg)
+	case "USER":
+		s.login(arg)
+	case "PASS":
+		s.pass(arg)
+	default:
+		if !s.authed {
+			s.reply(530, "Not logged in")
+			return true
+		}
+		s.handleFile(cmd, arg)
+	}
+	return true
+}
+
+// handleFile executes the commands, which require a login.
+func (s *ftpSession) handleFile(cmd, arg string) {
+	switch cmd {
+	case "MKD", "XMKD", "RMD", "XRMD", "DELE", "RNTO":
+		if ok, _ := s.server.app.allowWrite(s.ctx, s.username(), s.remoteIP()); !ok {
+			s.rename = ""
+			s.reply(450, "Write limit exceeded, try again later")
+			return
+		}
+	}
+
+	switch cmd {
+	case "PWD", "XPWD":
+		s.reply(257, `"`+strings.ReplaceAll(s.cwd, `"`, `""`)+`" is the current directory`)
+	case "CWD", "XCWD":
+		s.chdir(s.path(arg))
+	case "CDUP", "XCUP":
+		s.chdir(path.Dir(s.cwd))
+	case "TYPE":
+		// all transfers are binary, which is what the devices expect anyway
+		s.reply(200, "Type set to "+arg)
+	case "MODE":
+		s.expect(arg, "S")
+	case "STRU":
+		s.expect(arg, "F")
+	case "PASV":
+		s.pasv(false)
+	case "EPSV":
+		s.pasv(true)
+	case "PORT":
+		s.port(arg)
+	case "EPRT":
+		s.eprt(arg)
+	case "LIST", "NLST":
+		s.list(cmd == "NLST", arg)
+	case "RETR":
+		s.retrieve(s.path(arg))
+	case "STOR":
+		s.store(cmd, s.path(arg), os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	case "APPE":
+		s.store(cmd, s.path(arg), os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	case "SIZE":
+		if fi, err := s.server.fs.Stat(s.ctx, s.path(arg)); err != nil {
+			s.replyError(err)
+		} else {
+			s.reply(213, strconv.FormatInt(fi.Size(), 10))
+		}
+	case "MDTM":
+		if fi, err := s.server.fs.Stat(s.ctx, s.path(arg)); err != nil {
+			s.replyError(err)
+		} else {
+			s.reply(213, fi.ModTime().UTC().Format("20060102150405"))
+		}
+	case "MKD", "XMKD":
+		name := s.path(arg)
+		if err := s.server.fs.Mkdir(s.ctx, name, 0700); err != nil {
+			s.replyError(err)
+		} else {
+			s.reply(257, `"`+strings.ReplaceAll(name, `"`, `""`)+`" created`)
+		}
+	case "RMD", "XRMD":
+		s.rmdir(s.path(arg))
+	case "DELE":
+		s.delete(s.path(arg))
+	case "RNFR":
+		name := s.path(arg)
+		if _, err := s.server.fs.Stat(s.ctx, name); err != nil {
+			s.replyError(err)
+			return
+		}
+		s.rename = name
+		s.reply(350, "Ready for RNTO")
+	case "RNTO":
+		if s.rename == "" {
+			s.reply(503, "RNFR required first")
+			return
+		}
+		err := s.server.fs.Rename(s.ctx, s.rename, s.path(arg))
+		s.rename = ""
+		if err != nil {
+			s.replyError(err)
+		} else {
+			s.reply(250, "Renamed")
+		}
+	default:
+		s.reply(502, "Command not implemented")
+	}
+}
+
+func (s *ftpSession) expect(arg, supported string) {
+	if strings.EqualFold(arg, supported) {
+		s.reply(200, "OK")
+	} else {
+		s.reply(504, "Only "+supported+" is supported")
+	}
+}
+
+// auth upgrades the control connection to TLS.
+func (s *ftpSession) auth(arg string) {
+	if s.server.tlsConfig == nil {
+		s.reply(502, "TLS is not configured")
+		return
+	}
+	if !strings.EqualFold(arg, "TLS") && !strings.EqualFold(arg, "SSL") {
+		s.reply(504, "Only TLS is supported")
+		return
+	}
+
+	s.reply(234, "AUTH TLS successful")
+	conn := tls.Server(s.conn, s.server.tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		log.WithField("address", s.remoteIP()).WithError(err).Warn("FTP TLS handshake failed")
+		return
+	}
+	s.conn, s.text, s.secure = conn, textproto.NewConn(conn), true
+}
+
+// prot sets whether data connections are secured by TLS.
+func (s *ftpSession) prot(arg string) {
+	switch strings.ToUpper(arg) {
+	case "C":
+		if s.server.settings.RequireTLS {
+			s.reply(534, "Data connections have to be protected")
+			return
+		}
+		s.protect = false
+	case "P":
+		if !s.secure {
+			s.reply(503, "AUTH TLS required first")
+			return
+		}
+		s.protect = true
+	default:
+		s.reply(504, "Protection level not supported")
+		return
+	}
+	s.reply(200, "Protection level set to "+strings.ToUpper(arg))
+}
+
+func (s *ftpSession) login(username string) {
+	if s.server.settings.RequireTLS && !s.secure {
+		s.reply(530, "AUTH TLS required")
+		return
+	}
+	s.user, s.authed = username, false
+	s.reply(331, "Password required")
+}
+
+func (s *ftpSession) pass(password string) {
+	if s.user == "" {
+		s.reply(503, "USER required first")
+		return
+	}
+
+	a := s.server.app
+	if a.Tripwire.isDecoy(s.user) {
+		a.Tripwire.trip(s.remoteIP(), s.user, "", time.Now())
+		s.reply(530, "Login incorrect")
+		return
+	}
+	if ip := net.ParseIP(s.remoteIP()); !a.Config.allowsAddress(ip, s.user) {
+		refuseAddress("FTP", s.user, ip)
+		s.reply(530, "Login not allowed from this address")
+		return
+	}
+	if _, locked := a.LoginLimiter.locked(s.user, s.remoteIP(), time.Now()); locked {
+		s.reply(530, "Too many failed logins, try again later")
+		return
+	}
+	authInfo, err := authenticate(a.Config, s.user, password)
+	if err != nil {
+		log.WithField("user", s.user).WithField("address", s.remoteIP()).WithError(err).Warn("User failed to login via FTP")
+	}
+	if a.Config.AuthenticationNeeded() && !authInfo.Authenticated {
+		a.Alerts.authFailed(time.Now())
+		a.LoginLimiter.failed(s.user, s.remoteIP(), time.Now())
+		s.reply(530, "Login incorrect")
+		return
+	}
+	a.LoginLimiter.succeeded(s.user)
+
+	s.ctx = context.WithValue(context.Background(), authInfoKey, authInfo)
+	s.authed = true
+	s.reply(230, "Logged in")
+}
+
+func (s *ftpSession) chdir(name string) {
+	fi, err := s.server.fs.Stat(s.ctx, name)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if !fi.IsDir() {
+		s.reply(550, "Not a directory")
+		return
+	}
+	s.cwd = name
+	s.reply(250, "Directory changed to "+name)
+}
+
+func (s *ftpSession) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+// pasv opens a listener for the next data connection.
+func (s *ftpSession) pasv(extended bool) {
+	s.closePassive()
+	s.active = ""
+
+	host, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+	announced := host
+	if s.server.settings.PublicAddress != "" {
+		announced = s.server.settings.PublicAddress
+	}
+	ip := net.ParseIP(announced).To4()
+	if !extended && ip == nil {
+		s.reply(425, "Use EPSV for IPv6")
+		return
+	}
+
+	ln, err := s.server.listenPassive(host)
+	if err != nil {
+		log.WithError(err).Error("Error opening FTP data port")
+		s.reply(425, "Can't open data connection")
+		return
+	}
+	s.passive = ln
+	port := ln.Addr().(*net.TCPAddr).Port
+	if extended {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+	} else {
+		s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+	}
+}
+
+// listenPassive opens a listener on a free port of the passive port range.
+func (s *FTPServer) listenPassive(host string) (net.Listener, error) {
+	if s.minPort == 0 {
+		return net.Listen("tcp", net.JoinHostPort(host, "0"))
+	}
+
+	count := s.maxPort - s.minPort + 1
+	start := rand.Intn(count)
+	var err error
+	for i := 0; i < count; i++ {
+		port := s.minPort + (start+i)%count
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, err
+}
+
+// port sets the address of an active data connection. Only the address of the client is
+// accepted, so the server can't be abused to connect to other hosts.
+func (s *ftpSession) port(arg string) {
+	parts := strings.Split(arg, ",")
+	if len(parts) != 6 {
+		s.reply(501, "Syntax error in parameters")
+		return
+	}
+	var n [6]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || v < 0 || v > 255 {
+			s.reply(501, "Syntax error in parameters")
+			return
+		}
+		n[i] = v
+	}
+	ip := net.IPv4(byte(n[0]), byte(n[1]), byte(n[2]), byte(n[3]))
+	s.setActive(ip, n[4]<<8|n[5])
+}
+
+func (s *ftpSession) eprt(arg string) {
+	parts := strings.Split(arg, "|")
+	if len(parts) != 5 {
+		s.reply(501, "Syntax error in parameters")
+		return
+	}
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.Atoi(parts[3])
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		s.reply(501, "Syntax error in parameters")
+		return
+	}
+	s.setActive(ip, port)
+}
+
+func (s *ftpSession) setActive(ip net.IP, port int) {
+	if !ip.Equal(net.ParseIP(s.remoteIP())) {
+		s.reply(500, "Data connections are only accepted to the client address")
+		return
+	}
+	s.closePassive()
+	s.active = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	s.reply(200, "Command okay")
+}
+
+// openData establishes the data connection prepared by PASV, EPSV, PORT or EPRT.
+func (s *ftpSession) openData() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case s.passive != nil:
+		ln := s.passive
+		s.passive = nil
+		defer ln.Close()
+		if tcp, ok := ln.(*net.TCPListener); ok {
+			tcp.SetDeadline(time.Now().Add(ftpDataTimeout))
+		}
+		if conn, err = ln.Accept(); err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if host != s.remoteIP() {
+			conn.Close()
+			return nil, fmt.Errorf("data connection from %s doesn't match the client %s", host, s.remoteIP())
+		}
+	case s.active != "":
+		addr := s.active
+		s.active = ""
+		if conn, err = net.DialTimeout("tcp", addr, ftpDataTimeout); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("no data connection prepared")
+	}
+
+	if s.protect {
+		tlsConn := tls.Server(conn, s.server.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// transfer opens the data connection, runs fn on it and replies with its outcome.
+func (s *ftpSession) transfer(fn func(conn net.Conn) error) {
+	if s.passive == nil && s.active == "" {
+		s.reply(425, "Use PASV or PORT first")
+		return
+	}
+
+	s.reply(150, "Opening data connection")
+	conn, err := s.openData()
+	if err != nil {
+		log.WithField("address", s.remoteIP()).WithError(err).Warn("Error opening FTP data connection")
+		s.reply(425, "Can't open data connection")
+		return
+	}
+	err = fn(conn)
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(226, "Transfer complete")
+}
+
+func (s *ftpSession) list(namesOnly bool, arg string) {
+	// options like -la are sent by many clients, but aren't meaningful here
+	var args []string
+	for _, a := range strings.Fields(arg) {
+		if !strings.HasPrefix(a, "-") {
+			args = append(args, a)
+		}
+	}
+	name := s.cwd
+	if len(args) > 0 {
+		name = s.path(strings.Join(args, " "))
+	}
+
+	fi, err := s.server.fs.Stat(s.ctx, name)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	entries := []os.FileInfo{fi}
+	if fi.IsDir() {
+		f, err := s.server.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+		if err != nil {
+			s.replyError(err)
+			return
+		}
+		entries, err = f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			s.replyError(err)
+			return
+		}
+	}
+
+	s.transfer(func(conn net.Conn) error {
+		now := time.Now()
+		for _, e := range entries {
+			var line string
+			if namesOnly {
+				line = e.Name()
+			} else {
+				line = ftpListLine(e, now)
+			}
+			if _, err := io.WriteString(conn, line+"\r\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ftpListLine formats an entry like ls -l, which is what clients parse.
+func ftpListLine(fi os.FileInfo, now time.Time) string {
+	modTime := fi.ModTime()
+	stamp := modTime.Format("Jan _2 15:04")
+	if modTime.Before(now.AddDate(0, -6, 0)) || modTime.After(now.Add(time.Hour)) {
+		stamp = modTime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 dave dave %12d %s %s", fi.Mode().String(), fi.Size(), stamp, fi.Name())
+}
+
+func (s *ftpSession) retrieve(name string) {
+	f, err := s.server.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.IsDir() {
+		s.reply(550, "Not a file")
+		return
+	}
+	st, err := s.server.app.beginStream(s.ctx, "RETR", name, s.remoteIP(), s.username())
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	defer st.end()
+
+	s.transfer(func(conn net.Conn) error {
+		_, err := io.Copy(st.writer(conn), f)
+		return err
+	})
+}
+
+func (s *ftpSession) store(cmd, name string, flag int) {
+	if s.passive == nil && s.active == "" {
+		s.reply(425, "Use PASV or PORT first")
+		return
+	}
+	reject := func(code int, msg string) {
+		s.closePassive()
+		s.active = ""
+		s.reply(code, msg)
+	}
+	if s.server.app.Resources.shedReason(http.MethodPut) != "" {
+		reject(452, "Insufficient storage space")
+		return
+	}
+	if ok, _ := s.server.app.allowWrite(s.ctx, s.username(), s.remoteIP()); !ok {
+		reject(450, "Write limit exceeded, try again later")
+		return
+	}
+	st, err := s.server.app.beginStream(s.ctx, cmd, name, s.remoteIP(), s.username())
+	if err != nil {
+		s.closePassive()
+		s.active = ""
+		s.replyError(err)
+		return
+	}
+	defer st.end()
+	f, err := s.server.fs.OpenFile(s.ctx, name, flag, 0600)
+	if err != nil {
+		s.closePassive()
+		s.active = ""
+		s.replyError(err)
+		return
+	}
+
+	// the file is closed before the reply, which reports an exceeded quota
+	closed := false
+	s.transfer(func(conn net.Conn) error {
+		_, err := io.Copy(f, st.reader(conn))
+		closed = true
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	})
+	if !closed {
+		f.Close()
+	}
+}
+
+func (s *ftpSession) delete(name string) {
+	fi, err := s.server.fs.Stat(s.ctx, name)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	if fi.IsDir() {
+		s.reply(550, "Is a directory")
+		return
+	}
+	if err := s.server.fs.RemoveAll(s.ctx, name); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(250, "Deleted")
+}
+
+func (s *ftpSession) rmdir(name string) {
+	f, err := s.server.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		s.replyError(err)
+		return
+	}
+	entries, err := f.Readdir(1)
+	f.Close()
+	if err != nil && err != io.EOF {
+		s.reply(550, "Not a directory")
+		return
+	}
+	if len(entries) > 0 {
+		s.reply(550, "Directory not empty")
+		return
+	}
+	if err := s.server.fs.RemoveAll(s.ctx, name); err != nil {
+		s.replyError(err)
+		return
+	}
+	s.reply(250, "Directory removed")
+}
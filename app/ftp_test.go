@@ -0,0 +1,384 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ftpClient is a minimal FTP client for the tests.
+type ftpClient struct {
+	t    *testing.T
+	text *textproto.Conn
+}
+
+func startFTP(t *testing.T, cfg *Config) *ftpClient {
+	return startFTPApp(t, &App{Config: cfg})
+}
+
+// startFTPApp serves FTP for the app, whose quotas are created from its config.
+func startFTPApp(t *testing.T, a *App) *ftpClient {
+	cfg := a.Config
+	quotas, err := NewQuotas(cfg)
+	if err != nil {
+		t.Fatalf("NewQuotas() error = %v", err)
+	}
+	if cfg.FTP == nil {
+		cfg.FTP = &FTP{}
+	}
+	a.Quotas = quotas
+	server, err := NewFTPServer(a, Dir{Config: cfg, Quotas: quotas})
+	if err != nil {
+		t.Fatalf("NewFTPServer() error = %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go server.Serve(ln)
+
+	text, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { text.Close() })
+	c := &ftpClient{t: t, text: text}
+	c.expect(220)
+	return c
+}
+
+// cmd sends a command and returns the code and message of the reply.
+func (c *ftpClient) cmd(format string, args ...interface{}) (int, string) {
+	c.t.Helper()
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		c.t.Fatalf("sending %s: %v", format, err)
+	}
+	return c.read()
+}
+
+func (c *ftpClient) read() (int, string) {
+	c.t.Helper()
+	code, msg, err := c.text.ReadResponse(0)
+	if err != nil && code == 0 {
+		c.t.Fatalf("reading reply: %v", err)
+	}
+	return code, msg
+}
+
+func (c *ftpClient) expect(want int) {
+	c.t.Helper()
+	if code, msg := c.read(); code != want {
+		c.t.Errorf("reply = %d %s, want %d", code, msg, want)
+	}
+}
+
+var epsvPort = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// data runs a command using a passive data connection and returns the received data and
+// the final reply.
+func (c *ftpClient) data(upload string, format string, args ...interface{}) (string, int) {
+	c.t.Helper()
+	code, msg := c.cmd("EPSV")
+	m := epsvPort.FindStringSubmatch(msg)
+	if code != 229 || m == nil {
+		c.t.Fatalf("EPSV = %d %s", code, msg)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+m[1])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if code, msg := c.cmd(format, args...); code != 150 {
+		return msg, code
+	}
+	if upload != "" {
+		conn.Write([]byte(upload))
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, _ := ioutil.ReadAll(conn)
+	code, _ = c.read()
+	return string(received), code
+}
+
+func TestFTPSession(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "alice"
+	c := startFTP(t, &Config{
+		Dir: tmpDir,
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	})
+
+	if code, _ := c.cmd("PWD"); code != 530 {
+		t.Errorf("PWD before login = %d, want 530", code)
+	}
+	c.cmd("USER alice")
+	if code, _ := c.cmd("PASS wrong"); code != 530 {
+		t.Errorf("PASS with wrong password = %d, want 530", code)
+	}
+	c.cmd("USER alice")
+	if code, _ := c.cmd("PASS password"); code != 230 {
+		t.Fatalf("PASS = %d, want 230", code)
+	}
+
+	tests := []struct {
+		name string
+		cmd  string
+		want int
+	}{
+		{"create directory", "MKD scans", 257},
+		{"change directory", "CWD scans", 250},
+		{"current directory", "PWD", 257},
+		{"missing directory", "CWD missing", 550},
+		{"binary type", "TYPE I", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, msg := c.cmd("%s", tt.cmd); code != tt.want {
+				t.Errorf("%s = %d %s, want %d", tt.cmd, code, msg, tt.want)
+			}
+		})
+	}
+
+	if _, code := c.data("scanned page", "STOR page.pdf"); code != 226 {
+		t.Errorf("STOR = %d, want 226", code)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(tmpDir, "alice", "scans", "page.pdf")); err != nil || string(data) != "scanned page" {
+		t.Errorf("stored file = %q, %v, want it within the subdir of alice", data, err)
+	}
+	if code, msg := c.cmd("SIZE /scans/page.pdf"); code != 213 || msg != "12" {
+		t.Errorf("SIZE = %d %s, want 213 12", code, msg)
+	}
+	if data, code := c.data("", "RETR page.pdf"); code != 226 || data != "scanned page" {
+		t.Errorf("RETR = %d %q, want 226 and the content", code, data)
+	}
+	if data, code := c.data("", "NLST"); code != 226 || data != "page.pdf\r\n" {
+		t.Errorf("NLST = %d %q, want 226 page.pdf", code, data)
+	}
+	if data, code := c.data("", "LIST -la"); code != 226 || !strings.HasPrefix(data, "-rw-------") || !strings.HasSuffix(data, " page.pdf\r\n") {
+		t.Errorf("LIST = %d %q, want an ls -l line", code, data)
+	}
+
+	c.cmd("RNFR page.pdf")
+	if code, _ := c.cmd("RNTO /page.pdf"); code != 250 {
+		t.Errorf("RNTO = %d, want 250", code)
+	}
+	c.cmd("CDUP")
+	if code, _ := c.cmd("RMD scans"); code != 250 {
+		t.Errorf("RMD = %d, want 250", code)
+	}
+	if code, _ := c.cmd("DELE page.pdf"); code != 250 {
+		t.Errorf("DELE = %d, want 250", code)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "alice", "page.pdf")); !os.IsNotExist(err) {
+		t.Errorf("deleted file exists, error = %v", err)
+	}
+	if code, _ := c.cmd("QUIT"); code != 221 {
+		t.Errorf("QUIT = %d, want 221", code)
+	}
+}
+
+func TestFTPQuota(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	c := startFTP(t, &Config{Dir: tmpDir, Quota: &Quota{Limit: 10}})
+	c.cmd("USER anonymous")
+	c.cmd("PASS anonymous")
+
+	if _, code := c.data("0123456789abc", "STOR big"); code != 552 {
+		t.Errorf("STOR exceeding the quota = %d, want 552", code)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "big")); !os.IsNotExist(err) {
+		t.Errorf("upload exceeding the quota exists, error = %v", err)
+	}
+	if _, code := c.data("0123", "STOR small"); code != 226 {
+		t.Errorf("STOR within the quota = %d, want 226", code)
+	}
+}
+
+func TestFTPUploadLimit(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	c := startFTP(t, &Config{Dir: tmpDir, UploadLimit: &UploadLimit{MaxSize: 10, DeniedExtensions: []string{"exe"}, DeniedTypes: []string{"application/x-elf"}}})
+	c.cmd("USER anonymous")
+	c.cmd("PASS anonymous")
+
+	if _, code := c.data("0123456789abc", "STOR big.txt"); code != 552 {
+		t.Errorf("STOR exceeding the maximum size = %d, want 552", code)
+	}
+	if _, code := c.data("data", "STOR setup.exe"); code != 550 {
+		t.Errorf("STOR of a denied extension = %d, want 550", code)
+	}
+	if _, code := c.data("\x7fELF\x02\x01\x01", "STOR program.txt"); code != 550 {
+		t.Errorf("STOR of a denied type = %d, want 550", code)
+	}
+	for _, name := range []string{"setup.exe", "program.txt"} {
+		if _, err := os.Stat(filepath.Join(tmpDir, name)); !os.IsNotExist(err) {
+			t.Errorf("rejected upload %s exists, error = %v", name, err)
+		}
+	}
+	if _, code := c.data("0123", "STOR small.txt"); code != 226 {
+		t.Errorf("STOR within the limit = %d, want 226", code)
+	}
+	c.cmd("RNFR small.txt")
+	if code, _ := c.cmd("RNTO small.exe"); code != 550 {
+		t.Errorf("RNTO to a denied extension = %d, want 550", code)
+	}
+}
+
+func TestFTPLimits(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{
+		Dir:        tmpDir,
+		WriteLimit: &WriteLimit{Requests: 2, Window: time.Minute},
+		Bandwidth:  &Bandwidth{Cap: 10},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password"))},
+		},
+	}
+	bandwidth, err := NewBandwidthLimiter(cfg)
+	if err != nil {
+		t.Fatalf("NewBandwidthLimiter() error = %v", err)
+	}
+	a := &App{Config: cfg, Tracker: NewTracker(), WriteLimiter: NewWriteLimiter(), Bandwidth: bandwidth}
+	c := startFTPApp(t, a)
+	c.cmd("USER alice")
+	c.cmd("PASS password")
+
+	if _, code := c.data("0123456789ab", "STOR a"); code != 226 {
+		t.Errorf("STOR within the limits = %d, want 226", code)
+	}
+	if _, code := c.data("", "RETR a"); code != 450 {
+		t.Errorf("RETR exceeding the bandwidth cap = %d, want 450", code)
+	}
+	if code, _ := c.cmd("MKD d"); code != 257 {
+		t.Errorf("MKD within the write limit = %d, want 257", code)
+	}
+	if code, _ := c.cmd("DELE a"); code != 450 {
+		t.Errorf("DELE exceeding the write limit = %d, want 450", code)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "a")); err != nil {
+		t.Errorf("file deleted despite the write limit, error = %v", err)
+	}
+
+	if usage := bandwidth.Usage(); len(usage) != 1 || usage[0].Used != 12 {
+		t.Errorf("bandwidth usage = %+v, want 12 bytes of alice", usage)
+	}
+	if sessions := a.Tracker.Sessions(); len(sessions) != 1 || sessions[0].User != "alice" || sessions[0].Requests != 1 {
+		t.Errorf("sessions = %+v, want one transfer of alice", sessions)
+	}
+	if transfers := a.Tracker.Transfers(); len(transfers) != 0 {
+		t.Errorf("active transfers = %+v, want none", transfers)
+	}
+}
+
+func TestFTPNetworks(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	c := startFTP(t, &Config{
+		Dir: tmpDir,
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), AllowedNetworks: []string{"10.0.1.0/24"}},
+			"bob":   {Password: GenHash([]byte("password"))},
+		},
+	})
+	c.cmd("USER alice")
+	if code, _ := c.cmd("PASS password"); code != 530 {
+		t.Errorf("PASS from outside the networks of the user = %d, want 530", code)
+	}
+	c.cmd("USER bob")
+	if code, _ := c.cmd("PASS password"); code != 230 {
+		t.Errorf("PASS of an unrestricted user = %d, want 230", code)
+	}
+}
+
+func TestFTPShutdown(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{Dir: tmpDir, FTP: &FTP{}}
+	server, err := NewFTPServer(&App{Config: cfg}, Dir{Config: cfg})
+	if err != nil {
+		t.Fatalf("NewFTPServer() error = %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+
+	text, err := textproto.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer text.Close()
+	c := &ftpClient{t: t, text: text}
+	c.expect(220)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown() error = %v", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Errorf("Serve() error = %v, want %v", err, http.ErrServerClosed)
+	}
+	if _, _, err := text.ReadResponse(0); err == nil {
+		t.Errorf("idle connection still open after the shutdown")
+	}
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("connection accepted after the shutdown")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		ports   string
+		wantMin int
+		wantMax int
+		wantErr bool
+	}{
+		{"", 0, 0, false},
+		{"50000-50100", 50000, 50100, false},
+		{"50000", 50000, 50000, false},
+		{"50100-50000", 0, 0, true},
+		{"0-10", 0, 0, true},
+		{"a-b", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ports, func(t *testing.T) {
+			min, max, err := parsePortRange(tt.ports)
+			if min != tt.wantMin || max != tt.wantMax || (err != nil) != tt.wantErr {
+				t.Errorf("parsePortRange() = %v, %v, %v, want %v, %v, error %v", min, max, err, tt.wantMin, tt.wantMax, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package app
+
+import (
+	"errors"
+)
+
+// FUSEMount is a mounted share, mounts are only supported on Linux.
+type FUSEMount struct{}
+
+// Mount fails, mounts are only supported on Linux.
+func Mount(client *Client, mountpoint string, opts MountOptions) (*FUSEMount, error) {
+	return nil, errors.New("mounting is only supported on Linux")
+}
+
+// Unmount does nothing.
+func (m *FUSEMount) Unmount() error {
+	return nil
+}
+
+// Serve does nothing.
+func (m *FUSEMount) Serve() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	daveplugin "github.com/micromata/dave/plugin"
+	"net/http"
+)
+
+// Guest grants requests without credentials access next to the users, e.g. to publish a
+// read-only share. Guests are jailed within Subdir, if it's set. The Permissions of the guests
+// are the ones of their template, readonly by default, overridden by the set permissions.
+type Guest struct {
+	Permissions `yaml:",inline" mapstructure:",squash"`
+	Subdir      *string `json:"subdir,omitempty" yaml:",omitempty"`
+}
+
+// isGuest reports, whether the request is served as guest.
+func isGuest(ctx context.Context) bool {
+	guest, _ := ctx.Value(guestKey).(bool)
+	return guest
+}
+
+// guestAccess returns the permissions of the guests.
+func (cfg *Config) guestAccess() access {
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	g := cfg.Guest
+	if g == nil {
+		return access{}
+	}
+	template := g.Template
+	if template == "" {
+		template = TemplateReadOnly
+	}
+	a, _ := cfg.template(template)
+	return g.Permissions.overlay(a)
+}
+
+// guestSubdir returns the subdir of a request served as guest, if there is one.
+func (cfg *Config) guestSubdir(ctx context.Context) *string {
+	if g := cfg.Guest; g != nil && isGuest(ctx) {
+		return g.Subdir
+	}
+	return nil
+}
+
+// deniedStatus returns the status of a request denied by the permissions. Guests are asked
+// to log in instead, so clients offer the login of a user.
+func deniedStatus(ctx context.Context) int {
+	if isGuest(ctx) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+// guestPermits reports, whether the permissions allow the operation of the plugin API. Reads
+// include opening directories, renames require writing and deleting.
+func guestPermits(a access, op string) bool {
+	switch op {
+	case daveplugin.OpRead:
+		return a.read || a.list
+	case daveplugin.OpWrite, daveplugin.OpMkdir:
+		return a.write
+	case daveplugin.OpDelete:
+		return a.delete
+	case daveplugin.OpRename:
+		return a.write && a.delete
+	}
+	return false
+}
+
+// serveGuest serves a request without credentials as guest. Guests reach the WebDAV handler
+// and the listings of the directories only, the other endpoints act on behalf of a user.
+func (a *App) serveGuest(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	ctx = context.WithValue(ctx, guestKey, true)
+	ctx = context.WithValue(ctx, authInfoKey, &AuthInfo{Username: "", Authenticated: false})
+	w = &guestWriter{ResponseWriter: w, ctx: ctx, cfg: a.Config}
+	if !a.checkWriteLimit(ctx, w, req, "") || !a.checkUploadLimit(ctx, w, req, "") {
+		return
+	}
+	transfer, w := a.Tracker.Begin(w, req, a.Config.clientIP(req), "")
+	defer a.Tracker.End(transfer)
+	defer a.Usage.record(transfer)
+	req, ok := a.applyPolicy(w, req.WithContext(ctx))
+	if !ok || a.serveBrowse(w, req) {
+		return
+	}
+	a.davHandler(a.Handler).ServeHTTP(w, req)
+}
+
+// guestWriter adds the challenges of the authentication to responses denying a guest.
+type guestWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+	cfg *Config
+}
+
+func (w *guestWriter) WriteHeader(status int) {
+	if s := rejectionFromContext(w.ctx); status == http.StatusUnauthorized || (status >= 400 && s != nil && s.status == http.StatusUnauthorized) {
+		if w.cfg.OIDC != nil {
+			w.Header().Add("WWW-Authenticate", "Bearer realm="+w.cfg.Realm)
+		}
+		w.Header().Add("WWW-Authenticate", "Basic realm="+w.cfg.Realm)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
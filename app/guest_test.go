@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGuest(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "public"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "public", "a.txt"), []byte("a"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "private.txt"), []byte("private"), 0600)
+
+	public := "/public"
+	write := true
+	tests := []struct {
+		name   string
+		guest  *Guest
+		users  bool
+		method string
+		target string
+		auth   bool
+		want   int
+	}{
+		{"read", &Guest{Subdir: &public}, true, "GET", "/a.txt", false, http.StatusOK},
+		{"jailed", &Guest{Subdir: &public}, true, "GET", "/private.txt", false, http.StatusNotFound},
+		{"write", &Guest{Subdir: &public}, true, "PUT", "/b.txt", false, http.StatusUnauthorized},
+		{"delete", &Guest{Subdir: &public}, true, "DELETE", "/a.txt", false, http.StatusUnauthorized},
+		{"mkcol", &Guest{Subdir: &public}, true, "MKCOL", "/c", false, http.StatusUnauthorized},
+		{"user", &Guest{Subdir: &public}, true, "PUT", "/b.txt", true, http.StatusCreated},
+		{"dropbox read", &Guest{Permissions: Permissions{Template: TemplateDropbox}, Subdir: &public}, true, "GET", "/a.txt", false, http.StatusUnauthorized},
+		{"dropbox write", &Guest{Permissions: Permissions{Template: TemplateDropbox}, Subdir: &public}, true, "PUT", "/d.txt", false, http.StatusCreated},
+		{"write permission", &Guest{Permissions: Permissions{Write: &write}}, true, "PUT", "/e.txt", false, http.StatusCreated},
+		{"without users", &Guest{}, false, "PUT", "/f.txt", false, http.StatusUnauthorized},
+		{"without guests", nil, true, "GET", "/public/a.txt", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Dir: tmpDir, Realm: "dave", Guest: tt.guest}
+			if tt.users {
+				cfg.Users = map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}}
+			}
+			a := newQuotaApp(t, cfg)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader("b"))
+			if tt.method == "MKCOL" {
+				req = httptest.NewRequest(tt.method, tt.target, nil)
+			}
+			if tt.auth {
+				req.SetBasicAuth("alice", "password")
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Fatalf("%s %s = %d, want %d", tt.method, tt.target, w.Code, tt.want)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Basic realm=dave" {
+				t.Errorf("WWW-Authenticate = %q, want the basic auth challenge", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "b.txt")); err != nil {
+		t.Errorf("upload of the user = %v, want it outside of the subdir of the guests", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "public", "d.txt")); err != nil {
+		t.Errorf("upload of the guest = %v, want it within the subdir of the guests", err)
+	}
+
+	cfg := &Config{Dir: tmpDir, Guest: &Guest{Subdir: &public}, Users: map[string]*UserInfo{"alice": {}}}
+	a := newQuotaApp(t, cfg)
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	req.Header.Set("Depth", "1")
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	if body := w.Body.String(); w.Code != http.StatusMultiStatus || !strings.Contains(body, "a.txt") || strings.Contains(body, "private.txt") {
+		t.Errorf("PROPFIND = %d %s, want the subdir of the guests", w.Code, body)
+	}
+}
+
+func TestCheckGuestPermissions(t *testing.T) {
+	cfg := &Config{Guest: &Guest{Permissions: Permissions{Template: "unknown"}}}
+	if err := cfg.checkPermissions(); err == nil {
+		t.Error("checkPermissions() with unknown template of the guests = nil, want error")
+	}
+	cfg.PermissionTemplates = map[string]*Permissions{"unknown": {}}
+	if err := cfg.checkPermissions(); err != nil {
+		t.Errorf("checkPermissions() error = %v", err)
+	}
+}
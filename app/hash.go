@@ -0,0 +1,127 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// Supported password hashing algorithms
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+)
+
+// Parameters of argon2id hashes which aren't configurable via the cost
+const (
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// DefaultCost returns the default cost for the given hashing algorithm. For bcrypt the cost
+// is the logarithmic work factor, for argon2id the number of iterations.
+func DefaultCost(algorithm string) int {
+	if algorithm == HashArgon2id {
+		return 3
+	}
+
+	return 10
+}
+
+// GenHashWith generates a password hash with the given algorithm and cost.
+func GenHashWith(algorithm string, password []byte, cost int) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		pw, err := bcrypt.GenerateFromPassword(password, cost)
+		return string(pw), err
+	case HashArgon2id:
+		if cost < 1 {
+			return "", fmt.Errorf("invalid argon2id cost %d", cost)
+		}
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey(password, salt, uint32(cost), argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, cost,
+			argon2Threads, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("unsupported hashing algorithm %s", algorithm)
+	}
+}
+
+// ComparePassword compares a password hash, either bcrypt or argon2id, with the plain text
+// password. It returns nil on success.
+func ComparePassword(hash string, password []byte) error {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), password)
+	}
+
+	p, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey(password, p.salt, p.time, p.memory, p.threads, uint32(len(p.key)))
+	if subtle.ConstantTimeCompare(key, p.key) != 1 {
+		return errors.New("Password doesn't match")
+	}
+
+	return nil
+}
+
+// ValidHash returns whether the given string is a supported password hash.
+func ValidHash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, err := parseArgon2id(hash)
+		return err == nil
+	}
+
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != HashArgon2id {
+		return nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errors.New("unsupported argon2id version")
+	}
+
+	p := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return nil, errors.Wrap(err, "invalid argon2id parameters")
+	}
+	if p.time < 1 || p.threads < 1 {
+		// argon2 panics without iterations or threads
+		return nil, errors.New("invalid argon2id parameters")
+	}
+
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errors.Wrap(err, "invalid argon2id salt")
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return nil, errors.New("invalid argon2id key")
+	}
+
+	return p, nil
+}
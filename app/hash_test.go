@@ -0,0 +1,68 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenHashWith(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		cost      int
+		prefix    string
+		wantErr   bool
+	}{
+		{HashBcrypt, 4, "$2a$04$", false},
+		{HashArgon2id, 1, "$argon2id$v=19$m=65536,t=1,p=4$", false},
+		{HashArgon2id, 0, "", true},
+		{"md5", 1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			got, err := GenHashWith(tt.algorithm, []byte("password"), tt.cost)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GenHashWith() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !strings.HasPrefix(got, tt.prefix) {
+				t.Errorf("GenHashWith() = %v, want prefix %v", got, tt.prefix)
+			}
+			if !ValidHash(got) {
+				t.Errorf("ValidHash(%v) = false, want true", got)
+			}
+			if err := ComparePassword(got, []byte("password")); err != nil {
+				t.Errorf("ComparePassword() error = %v", err)
+			}
+			if err := ComparePassword(got, []byte("wrong")); err == nil {
+				t.Errorf("ComparePassword() with wrong password succeeded")
+			}
+		})
+	}
+}
+
+func TestValidHash(t *testing.T) {
+	tests := []struct {
+		hash string
+		want bool
+	}{
+		{"$2a$10$yITzSSNJZAdDZs8iVBQzkuZCzZ49PyjTiPIrmBUKUpB0pwX7eySvW", true},
+		{"$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5", true},
+		{"$argon2id$v=18$m=65536,t=3,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5", false},
+		{"$argon2id$v=19$m=65536$c2FsdA$a2V5", false},
+		{"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$", false},
+		{"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHRzYWx0c2FsdA$a2V5", false},
+		{"$argon2id$v=19$m=65536,t=3,p=0$c2FsdHNhbHRzYWx0c2FsdA$a2V5", false},
+		{"plain", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			if got := ValidHash(tt.hash); got != tt.want {
+				t.Errorf("ValidHash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings of the honeypot
+const (
+	// honeypotRealert is the time a trip of the same address isn't alerted again.
+	honeypotRealert    = time.Hour
+	maxHoneypotEntries = 4096
+)
+
+// Honeypot defines decoy users and canary paths, which no legitimate client ever uses. A login
+// as one of the Users, whatever the password, and a request of one of the Paths or of a file
+// beneath them alerts immediately via the alerts section. If Ban is set, the address of the
+// client is refused for that long afterwards.
+type Honeypot struct {
+	Users []string
+	Paths []string
+	Ban   time.Duration
+}
+
+// Tripwire watches for the decoy users and canary paths of the honeypot and bans the
+// addresses tripping them. A nil Tripwire is valid and traps nothing.
+type Tripwire struct {
+	settings *Honeypot
+	alerts   *Alerter
+
+	mu      sync.Mutex
+	bans    map[string]time.Time
+	alerted map[string]time.Time
+	trips   int64
+}
+
+// NewTripwire creates the tripwire of the honeypot of the configuration, which alerts via
+// alerts. It returns nil, if no honeypot is configured.
+func NewTripwire(cfg *Config, alerts *Alerter) (*Tripwire, error) {
+	if cfg.Honeypot == nil {
+		return nil, nil
+	}
+	for _, user := range cfg.Honeypot.Users {
+		if cfg.User(user) != nil {
+			return nil, fmt.Errorf("decoy user %s of the honeypot is a configured user", user)
+		}
+	}
+	if alerts == nil {
+		log.Warn("Honeypot trips are only logged, as no alerts are configured")
+	}
+
+	return &Tripwire{settings: cfg.Honeypot, alerts: alerts, bans: map[string]time.Time{}, alerted: map[string]time.Time{}}, nil
+}
+
+// isDecoy returns whether the user is a decoy user.
+func (t *Tripwire) isDecoy(user string) bool {
+	if t == nil || user == "" {
+		return false
+	}
+	for _, decoy := range t.settings.Users {
+		if user == decoy {
+			return true
+		}
+	}
+	return false
+}
+
+// isCanary returns whether the path, relative to the prefix, is a canary path or beneath one.
+func (t *Tripwire) isCanary(p string) bool {
+	if t == nil {
+		return false
+	}
+	p = path.Clean("/" + p)
+	for _, canary := range t.settings.Paths {
+		canary = path.Clean("/" + canary)
+		if p == canary || strings.HasPrefix(p, strings.TrimSuffix(canary, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isBanned returns whether the address is banned at the time.
+func (t *Tripwire) isBanned(address string, now time.Time) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.bans[address]
+	if ok && !now.Before(until) {
+		delete(t.bans, address)
+		return false
+	}
+	return ok
+}
+
+// trip handles the use of a decoy user or a canary path by the address. The user is the one
+// claimed by the client, p the path used.
+func (t *Tripwire) trip(address, user, p string, now time.Time) {
+	if t == nil {
+		return
+	}
+	atomic.AddInt64(&t.trips, 1)
+	log.WithFields(log.Fields{"address": address, "user": user, "path": p}).Warn("Honeypot tripped")
+
+	t.mu.Lock()
+	if t.settings.Ban > 0 {
+		t.bans[address] = now.Add(t.settings.Ban)
+		if len(t.bans) > maxHoneypotEntries {
+			for a, until := range t.bans {
+				if !now.Before(until) {
+					delete(t.bans, a)
+				}
+			}
+		}
+	}
+	last, alerted := t.alerted[address]
+	alerted = alerted && now.Sub(last) < honeypotRealert
+	if !alerted {
+		t.alerted[address] = now
+		if len(t.alerted) > maxHoneypotEntries {
+			for a, at := range t.alerted {
+				if now.Sub(at) >= honeypotRealert {
+					delete(t.alerted, a)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+	if alerted {
+		return
+	}
+
+	message := fmt.Sprintf("Decoy user %s has been used by %s", user, address)
+	if p != "" {
+		message = fmt.Sprintf("Canary path %s has been requested by %s", p, address)
+	}
+	if t.settings.Ban > 0 {
+		message += fmt.Sprintf(", banned for %s", t.settings.Ban)
+	}
+	t.alerts.honeypotTripped(alertEvent{Event: alertEventHoneypot, Time: now, Message: message, User: user, Address: address, Path: p})
+}
+
+// RegisterMetrics exposes the number of trips.
+func (t *Tripwire) RegisterMetrics(m *Metrics) {
+	if t == nil {
+		return
+	}
+
+	m.Counter("dave_honeypot_trips_total", "Uses of decoy users and canary paths.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&t.trips))}}
+	})
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHoneypot(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+
+	receiver, events := alertReceiver(t)
+	cfg := &Config{
+		Dir:      tmpDir,
+		Realm:    "dave",
+		Alerts:   &Alerts{Webhook: receiver.URL},
+		Honeypot: &Honeypot{Users: []string{"backup"}, Paths: []string{"/.env", "/secret/"}, Ban: time.Hour},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password"))},
+		},
+	}
+	alerts, _ := NewAlerter(cfg, nil)
+	tripwire, err := NewTripwire(cfg, alerts)
+	if err != nil {
+		t.Fatalf("NewTripwire() error = %v", err)
+	}
+	a := newQuotaApp(t, cfg)
+	a.Tripwire = tripwire
+	do := func(address, target, user string) int {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = address + ":1234"
+		req.SetBasicAuth(user, "password")
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w.Code
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		target  string
+		user    string
+		want    int
+		tripped bool
+	}{
+		{"regular", "192.0.2.1", "/a.txt", "alice", http.StatusOK, false},
+		{"decoy user", "192.0.2.1", "/", "backup", http.StatusUnauthorized, true},
+		{"banned", "192.0.2.1", "/", "alice", http.StatusForbidden, false},
+		{"canary", "192.0.2.2", "/.env", "alice", http.StatusNotFound, true},
+		{"banned by canary", "192.0.2.2", "/", "alice", http.StatusForbidden, false},
+		{"beneath canary without login", "192.0.2.3", "/secret/keys.txt", "", http.StatusUnauthorized, true},
+		{"similar path", "192.0.2.4", "/secretary", "alice", http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := do(tt.address, tt.target, tt.user); got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+			if tt.tripped {
+				expectAlert(t, events, alertEventHoneypot)
+			}
+		})
+	}
+	expectNoAlert(t, events)
+
+	if tripwire.isBanned("192.0.2.1", time.Now().Add(2*time.Hour)) {
+		t.Error("isBanned() after the ban = true, want false")
+	}
+	cfg.Honeypot.Users = []string{"alice"}
+	if _, err := NewTripwire(cfg, alerts); err == nil {
+		t.Error("NewTripwire() with a configured decoy user error = nil, want an error")
+	}
+}
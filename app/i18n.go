@@ -0,0 +1,293 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultLanguage is the language of the pages, if the browser accepts none of the catalogs.
+const defaultLanguage = "en"
+
+// I18n configures the languages of the pages shown to browsers, like the listings of public
+// links and the error pages. The language is negotiated with the Accept-Language header
+// among the built-in catalogs and the ones in Catalogs, a directory of <language>.json files
+// mapping message ids to translations. They add languages or override built-in messages.
+// Default is used, if the browser accepts none of the languages.
+type I18n struct {
+	Default  string
+	Catalogs string
+
+	once     sync.Once
+	catalogs map[string]map[string]string
+}
+
+// builtinCatalogs are the messages shipped with dave.
+var builtinCatalogs = map[string]map[string]string{
+	"en": {
+		"listing.empty":  "This folder is empty.",
+		"browse.name":    "Name",
+		"browse.size":    "Size",
+		"browse.date":    "Modified",
+		"browse.upload":  "Upload",
+		"nextcloud.done": "%s is logged in. You can close this window and return to the client.",
+		"error.400":      "Bad Request",
+		"error.400.text": "The request is invalid.",
+		"error.401":      "Unauthorized",
+		"error.401.text": "Please log in to access this page.",
+		"error.403":      "Forbidden",
+		"error.403.text": "You aren't allowed to access this page, or the link has expired.",
+		"error.404":      "Not Found",
+		"error.404.text": "The file or folder doesn't exist.",
+		"error.405":      "Method Not Allowed",
+		"error.405.text": "This action isn't supported here.",
+		"error.500":      "Internal Server Error",
+		"error.500.text": "Something went wrong. Please try again later.",
+		"error.503":      "Service Unavailable",
+		"error.503.text": "The server is unavailable. Please try again later.",
+		"error.507":      "Insufficient Storage",
+		"error.507.text": "There is not enough storage left.",
+		"error.contact":  "If the problem persists, please contact %s.",
+	},
+	"de": {
+		"listing.empty":  "Dieser Ordner ist leer.",
+		"browse.name":    "Name",
+		"browse.size":    "Größe",
+		"browse.date":    "Geändert",
+		"browse.upload":  "Hochladen",
+		"nextcloud.done": "%s ist angemeldet. Sie können dieses Fenster schließen und zum Client zurückkehren.",
+		"error.400":      "Ungültige Anfrage",
+		"error.400.text": "Die Anfrage ist ungültig.",
+		"error.401":      "Nicht angemeldet",
+		"error.401.text": "Bitte melden Sie sich an, um diese Seite aufzurufen.",
+		"error.403":      "Zugriff verweigert",
+		"error.403.text": "Sie dürfen diese Seite nicht aufrufen oder der Link ist abgelaufen.",
+		"error.404":      "Nicht gefunden",
+		"error.404.text": "Die Datei oder der Ordner existiert nicht.",
+		"error.405":      "Nicht erlaubt",
+		"error.405.text": "Diese Aktion wird hier nicht unterstützt.",
+		"error.500":      "Interner Serverfehler",
+		"error.500.text": "Etwas ist schiefgelaufen. Bitte versuchen Sie es später erneut.",
+		"error.503":      "Nicht verfügbar",
+		"error.503.text": "Der Server ist nicht verfügbar. Bitte versuchen Sie es später erneut.",
+		"error.507":      "Speicher voll",
+		"error.507.text": "Es ist nicht genug Speicherplatz vorhanden.",
+		"error.contact":  "Wenn das Problem weiterhin besteht, wenden Sie sich bitte an %s.",
+	},
+	"fr": {
+		"listing.empty":  "Ce dossier est vide.",
+		"browse.name":    "Nom",
+		"browse.size":    "Taille",
+		"browse.date":    "Modifié",
+		"browse.upload":  "Envoyer",
+		"nextcloud.done": "%s est connecté. Vous pouvez fermer cette fenêtre et revenir au client.",
+		"error.400":      "Requête invalide",
+		"error.400.text": "La requête est invalide.",
+		"error.401":      "Non authentifié",
+		"error.401.text": "Veuillez vous connecter pour accéder à cette page.",
+		"error.403":      "Accès refusé",
+		"error.403.text": "Vous n'êtes pas autorisé à accéder à cette page, ou le lien a expiré.",
+		"error.404":      "Introuvable",
+		"error.404.text": "Le fichier ou le dossier n'existe pas.",
+		"error.405":      "Méthode non autorisée",
+		"error.405.text": "Cette action n'est pas prise en charge ici.",
+		"error.500":      "Erreur interne du serveur",
+		"error.500.text": "Une erreur s'est produite. Veuillez réessayer plus tard.",
+		"error.503":      "Service indisponible",
+		"error.503.text": "Le serveur est indisponible. Veuillez réessayer plus tard.",
+		"error.507":      "Espace insuffisant",
+		"error.507.text": "L'espace de stockage restant est insuffisant.",
+		"error.contact":  "Si le problème persiste, veuillez contacter %s.",
+	},
+	"es": {
+		"listing.empty":  "Esta carpeta está vacía.",
+		"browse.name":    "Nombre",
+		"browse.size":    "Tamaño",
+		"browse.date":    "Modificado",
+		"browse.upload":  "Subir",
+		"nextcloud.done": "%s ha iniciado sesión. Puede cerrar esta ventana y volver al cliente.",
+		"error.400":      "Solicitud incorrecta",
+		"error.400.text": "La solicitud no es válida.",
+		"error.401":      "No autorizado",
+		"error.401.text": "Inicie sesión para acceder a esta página.",
+		"error.403":      "Prohibido",
+		"error.403.text": "No tiene permiso para acceder a esta página o el enlace ha caducado.",
+		"error.404":      "No encontrado",
+		"error.404.text": "El archivo o la carpeta no existe.",
+		"error.405":      "Método no permitido",
+		"error.405.text": "Esta acción no está disponible aquí.",
+		"error.500":      "Error interno del servidor",
+		"error.500.text": "Algo salió mal. Inténtelo de nuevo más tarde.",
+		"error.503":      "Servicio no disponible",
+		"error.503.text": "El servidor no está disponible. Inténtelo de nuevo más tarde.",
+		"error.507":      "Almacenamiento insuficiente",
+		"error.507.text": "No queda suficiente espacio de almacenamiento.",
+		"error.contact":  "Si el problema persiste, póngase en contacto con %s.",
+	},
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Text}}<p>{{.Text}}</p>
+{{end}}{{if .Support}}<p>{{.Support}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+// messages are the messages of the language negotiated with a browser.
+type messages struct {
+	Lang     string
+	catalogs []map[string]string
+}
+
+// T returns the translation of the message id formatted with the arguments. Messages missing
+// in the language are taken from the default language or English.
+func (m *messages) T(id string, args ...interface{}) string {
+	for _, catalog := range m.catalogs {
+		if msg, ok := catalog[id]; ok {
+			if len(args) == 0 {
+				return msg
+			}
+			return fmt.Sprintf(msg, args...)
+		}
+	}
+	return id
+}
+
+// languages returns the catalogs by language. The custom catalogs are loaded once, a broken
+// one is logged and skipped. A nil I18n has the built-in catalogs.
+func (i *I18n) languages() map[string]map[string]string {
+	if i == nil || i.Catalogs == "" {
+		return builtinCatalogs
+	}
+	i.once.Do(func() {
+		i.catalogs = map[string]map[string]string{}
+		for lang, catalog := range builtinCatalogs {
+			i.catalogs[lang] = catalog
+		}
+		files, err := filepath.Glob(filepath.Join(i.Catalogs, "*.json"))
+		if err != nil {
+			log.WithError(err).WithField("path", i.Catalogs).Error("Error reading message catalogs")
+			return
+		}
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			var catalog map[string]string
+			if err == nil {
+				err = json.Unmarshal(data, &catalog)
+			}
+			if err != nil {
+				log.WithError(err).WithField("path", file).Error("Error reading message catalog")
+				continue
+			}
+			lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+			merged := map[string]string{}
+			for id, msg := range i.catalogs[lang] {
+				merged[id] = msg
+			}
+			for id, msg := range catalog {
+				merged[id] = msg
+			}
+			i.catalogs[lang] = merged
+		}
+	})
+	return i.catalogs
+}
+
+// defaultLanguage returns the language used, if the browser accepts none of the catalogs.
+func (i *I18n) defaultLanguage() string {
+	if i == nil || i.Default == "" {
+		return defaultLanguage
+	}
+	return strings.ToLower(i.Default)
+}
+
+// messages returns the messages of the language preferred by the Accept-Language header of
+// the request.
+func (i *I18n) messages(r *http.Request) *messages {
+	catalogs := i.languages()
+	def := i.defaultLanguage()
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"), catalogs)
+	if lang == "" {
+		lang = def
+	}
+	m := &messages{Lang: lang}
+	for _, l := range []string{lang, def, defaultLanguage} {
+		if catalog, ok := catalogs[l]; ok {
+			m.catalogs = append(m.catalogs, catalog)
+		}
+	}
+	return m
+}
+
+// negotiateLanguage returns the language of the catalogs preferred by the Accept-Language
+// header, or the empty string if none is accepted. A region like de-AT matches the catalog of
+// the region or of the language.
+func negotiateLanguage(header string, catalogs map[string]map[string]string) string {
+	type accepted struct {
+		tag string
+		q   float64
+	}
+	var tags []accepted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, accepted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	for _, t := range tags {
+		if _, ok := catalogs[t.tag]; ok {
+			return t.tag
+		}
+		if i := strings.Index(t.tag, "-"); i > 0 {
+			if _, ok := catalogs[t.tag[:i]]; ok {
+				return t.tag[:i]
+			}
+		}
+	}
+	return ""
+}
+
+// writeError answers a request by the error status. Browsers get a page in their language,
+// other clients the status as plain text, unless the status is covered by the error pages.
+func (cfg *Config) writeError(w http.ResponseWriter, r *http.Request, status int) {
+	if cfg.ErrorPages.covers(status) {
+		cfg.ErrorPages.write(w, r, cfg.I18n, status)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+		return
+	}
+
+	writeErrorPage(w, errorPage, "text/html; charset=utf-8", newErrorPageData(r, cfg.I18n, status, ""))
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"empty", "", ""},
+		{"exact", "de", "de"},
+		{"region", "fr-CH, en;q=0.8", "fr"},
+		{"quality", "en;q=0.5, es;q=0.9", "es"},
+		{"unknown first", "pt-BR, de;q=0.7", "de"},
+		{"excluded", "de;q=0, fr;q=0.1", "fr"},
+		{"wildcard", "*", ""},
+		{"none", "pt, ja", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiateLanguage(tt.header, builtinCatalogs); got != tt.want {
+				t.Errorf("negotiateLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessages(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "nl.json"), []byte(`{"error.404": "Niet gevonden"}`), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "de.json"), []byte(`{"error.404": "Nicht da"}`), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "broken.json"), []byte(`{`), 0600)
+
+	i := &I18n{Default: "de", Catalogs: tmpDir}
+	tests := []struct {
+		name     string
+		header   string
+		id       string
+		wantLang string
+		want     string
+	}{
+		{"custom language", "nl", "error.404", "nl", "Niet gevonden"},
+		{"missing in custom language", "nl", "error.403", "nl", "Zugriff verweigert"},
+		{"overridden", "de-DE", "error.404", "de", "Nicht da"},
+		{"kept", "de-DE", "error.403", "de", "Zugriff verweigert"},
+		{"default", "ja", "error.405", "de", "Nicht erlaubt"},
+		{"unknown id", "en", "missing", "en", "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept-Language", tt.header)
+			m := i.messages(r)
+			if m.Lang != tt.wantLang {
+				t.Errorf("language = %q, want %q", m.Lang, tt.wantLang)
+			}
+			if got := m.T(tt.id); got != tt.want {
+				t.Errorf("T(%q) = %q, want %q", tt.id, got, tt.want)
+			}
+		})
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if got := (*I18n)(nil).messages(r).T("nextcloud.done", "alice"); !strings.HasPrefix(got, "alice is logged in") {
+		t.Errorf("formatted message = %q", got)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	cfg := &Config{}
+	tests := []struct {
+		name     string
+		accept   string
+		language string
+		status   int
+		wantType string
+		wantBody string
+	}{
+		{"plain text", "*/*", "de", http.StatusNotFound, "text/plain", "404 Not Found"},
+		{"browser", "text/html,*/*;q=0.8", "de", http.StatusNotFound, "text/html", "Die Datei oder der Ordner existiert nicht."},
+		{"english", "text/html", "", http.StatusForbidden, "text/html", "<h1>Forbidden</h1>"},
+		{"without message", "text/html", "fr", http.StatusTeapot, "text/html", "<h1>I&#39;m a teapot</h1>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set("Accept-Language", tt.language)
+			w := httptest.NewRecorder()
+			cfg.writeError(w, r, tt.status)
+			if w.Code != tt.status {
+				t.Errorf("status = %v, want %v", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("content type = %q, want %q", got, tt.wantType)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings of the ICAP scans
+const (
+	defaultICAPPort    = "1344"
+	defaultICAPTimeout = time.Minute
+)
+
+var (
+	errScanRejected = errors.New("content rejected by the ICAP server")
+	errScanFailed   = errors.New("content couldn't be scanned")
+	errScanPartial  = errors.New("scanned files can only be written as a whole")
+)
+
+// ICAP sends the content of uploads to an ICAP server of RFC 3507, like the virus scanners
+// and DLP appliances used with Squid, before it's written. Uploads are kept in a temporary
+// file until the server answered, so blocked content never reaches the directory and the
+// previous content of an overwritten file is kept. Method is REQMOD (default) or RESPMOD.
+// Without FailOpen, uploads are rejected as well if the server can't be asked.
+type ICAP struct {
+	URL      string
+	Method   string
+	Timeout  time.Duration
+	FailOpen bool
+}
+
+// openScanFile returns a file collecting the written content in a temporary file. The file
+// is only opened by open once the content passed the scan on Close. Files can't be modified
+// in place, as only complete contents can be scanned.
+func (c *ICAP) openScanFile(ctx context.Context, files storage, name, target, user string, flag int, open func() (webdav.File, error)) (webdav.File, error) {
+	if dir, err := checkWholeWrite(files, name, flag, errScanPartial); err != nil {
+		return nil, err
+	} else if dir {
+		return open()
+	}
+
+	spool, err := ioutil.TempFile("", "dave-scan-")
+	if err != nil {
+		return nil, err
+	}
+	return &scanFile{File: spool, ctx: ctx, icap: c, name: name, target: target, user: user, open: open}, nil
+}
+
+// scanFile collects the content of an upload until it's closed.
+type scanFile struct {
+	*os.File
+	ctx    context.Context
+	icap   *ICAP
+	name   string
+	target string
+	user   string
+	open   func() (webdav.File, error)
+}
+
+// Stat reports the info of the collected content with the name of the file.
+func (f *scanFile) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return scanFileInfo{FileInfo: fi, name: filepath.Base(f.name)}, nil
+}
+
+// Close scans the collected content and writes it to the file, if it passed.
+func (f *scanFile) Close() error {
+	defer os.Remove(f.File.Name())
+	defer f.File.Close()
+
+	fi, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fields := log.Fields{"path": f.name, "user": f.user}
+	err = f.icap.scan(f.ctx, f.File, fi.Size(), f.target)
+	switch {
+	case errors.Is(err, errScanRejected):
+		log.WithFields(fields).WithError(err).Warn("Rejected upload")
+		traceStep(f.ctx, "upload of %s rejected by the ICAP server", f.target)
+		rejectionFromContext(f.ctx).reject(http.StatusForbidden)
+		return err
+	case err != nil && !f.icap.FailOpen:
+		log.WithFields(fields).WithError(err).Error("Error scanning upload")
+		rejectionFromContext(f.ctx).reject(http.StatusServiceUnavailable)
+		return fmt.Errorf("%w: %v", errScanFailed, err)
+	case err != nil:
+		log.WithFields(fields).WithError(err).Warn("Accepted upload without scan")
+	}
+
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	file, err := f.open()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, f.File); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+type scanFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi scanFileInfo) Name() string { return fi.name }
+
+// scan sends the content to the ICAP server. It returns nil, if the server answered with 204
+// No Content, and errScanRejected with the reason reported by the server, if the server
+// answered with a modified message.
+func (c *ICAP) scan(ctx context.Context, content io.Reader, size int64, target string) error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultICAPPort)
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = defaultICAPTimeout
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	href := (&url.URL{Path: target}).EscapedPath()
+	method := strings.ToUpper(c.Method)
+	var encapsulated, message string
+	switch method {
+	case "", "REQMOD":
+		method = "REQMOD"
+		message = fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: dave\r\nContent-Length: %d\r\n\r\n", href, size)
+		encapsulated = fmt.Sprintf("req-hdr=0, req-body=%d", len(message))
+	case "RESPMOD":
+		req := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: dave\r\n\r\n", href)
+		res := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n", size)
+		message = req + res
+		encapsulated = fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(req), len(message))
+	default:
+		return fmt.Errorf("unknown ICAP method %s", c.Method)
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\nEncapsulated: %s\r\n\r\n%s", method, c.URL, u.Host, encapsulated, message)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := content.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	r := textproto.NewReader(bufio.NewReader(conn))
+	line, err := r.ReadLine()
+	if err != nil {
+		return err
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return err
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "ICAP/") {
+		return fmt.Errorf("malformed ICAP response %q", line)
+	}
+	switch status, _ := strconv.Atoi(fields[1]); status {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusOK:
+		for _, name := range []string{"X-Infection-Found", "X-Violations-Found", "X-Virus-Id", "X-Blocked-Reason"} {
+			if reason := header.Get(name); reason != "" {
+				return fmt.Errorf("%w: %s", errScanRejected, reason)
+			}
+		}
+		return errScanRejected
+	default:
+		return fmt.Errorf("ICAP server answered %q", line)
+	}
+}
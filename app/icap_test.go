@@ -0,0 +1,109 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveICAP answers ICAP requests like a virus scanner, which blocks contents containing
+// EICAR. It returns the URL of the service.
+func serveICAP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := textproto.NewReader(bufio.NewReader(conn))
+			r.ReadLine()
+			header, _ := r.ReadMIMEHeader()
+			// each encapsulated HTTP header ends with an empty line
+			for i := strings.Count(header.Get("Encapsulated"), "-hdr"); i > 0; i-- {
+				for line, err := r.ReadLine(); err == nil && line != ""; line, err = r.ReadLine() {
+				}
+			}
+			body, _ := ioutil.ReadAll(httputil.NewChunkedReader(r.R))
+			if strings.Contains(string(body), "EICAR") {
+				conn.Write([]byte("ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=EICAR;\r\nEncapsulated: null-body=0\r\n\r\n"))
+			} else {
+				conn.Write([]byte("ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n"))
+			}
+			conn.Close()
+		}
+	}()
+	return "icap://" + l.Addr().String() + "/avscan"
+}
+
+func TestICAP(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "old.txt"), []byte("old"), 0600)
+
+	cfg := &Config{Dir: tmpDir, ICAP: &ICAP{URL: serveICAP(t)}}
+	a := newQuotaApp(t, cfg)
+	put := func(target, body string) int {
+		req := httptest.NewRequest("PUT", target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w.Code
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		want     int
+		wantFile string
+	}{
+		{"clean", "REQMOD", "/clean.txt", "clean", http.StatusCreated, "clean"},
+		{"infected", "REQMOD", "/infected.txt", "X5O EICAR test", http.StatusForbidden, ""},
+		{"infected overwrite", "REQMOD", "/old.txt", "X5O EICAR test", http.StatusForbidden, "old"},
+		{"respmod", "RESPMOD", "/respmod.txt", "X5O EICAR test", http.StatusForbidden, ""},
+		{"missing parent", "REQMOD", "/missing/a.txt", "clean", http.StatusConflict, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.ICAP.Method = tt.method
+			if got := put(tt.target, tt.body); got != tt.want {
+				t.Errorf("PUT status = %v, want %v", got, tt.want)
+			}
+			data, _ := ioutil.ReadFile(filepath.Join(tmpDir, tt.target))
+			if string(data) != tt.wantFile {
+				t.Errorf("file = %q, want %q", data, tt.wantFile)
+			}
+		})
+	}
+
+	cfg.ICAP = &ICAP{URL: "icap://127.0.0.1:1/avscan", Timeout: time.Second}
+	if got := put("/unscanned.txt", "clean"); got != http.StatusServiceUnavailable {
+		t.Errorf("PUT without server status = %v, want %v", got, http.StatusServiceUnavailable)
+	}
+	cfg.ICAP.FailOpen = true
+	if got := put("/unscanned.txt", "clean"); got != http.StatusCreated {
+		t.Errorf("PUT without server failing open status = %v, want %v", got, http.StatusCreated)
+	}
+
+	d := Dir{Config: cfg}
+	if _, err := d.OpenFile(context.Background(), "/old.txt", os.O_WRONLY, 0600); err != errScanPartial {
+		t.Errorf("OpenFile() to modify a file error = %v, want %v", err, errScanPartial)
+	}
+}
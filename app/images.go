@@ -0,0 +1,347 @@
+package app
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Defaults of the image transformations
+const (
+	defaultImageCacheSize = 64 << 20
+	defaultImageMaxSize   = 4096
+	defaultImageMaxPixels = 50000000
+	defaultImageQuality   = 85
+)
+
+// imageFormats maps the extensions of the transformed images to their formats.
+var imageFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".webp": "webp",
+}
+
+// imageContentTypes are the content types of the formats of transformed images.
+var imageContentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+var (
+	errImageParams   = errors.New("invalid image parameters")
+	errImageTooLarge = errors.New("image too large")
+)
+
+// Images transforms image files on GET requests with the query parameters w and h, which
+// resize the image to fit into their width and height, format, which converts it to jpeg,
+// png, gif or webp, and q, the quality of JPEG images. Transformed images are kept in a cache
+// of CacheSize bytes. Widths and heights are limited to MaxSize, images with more than
+// MaxPixels pixels aren't transformed. Quality is the JPEG quality by default.
+type Images struct {
+	CacheSize ByteSize
+	MaxSize   int
+	MaxPixels int
+	Quality   int
+}
+
+// imageParams are the transformation of an image requested by the query parameters.
+type imageParams struct {
+	width, height int
+	format        string
+	quality       int
+}
+
+func (p imageParams) String() string {
+	return fmt.Sprintf("%dx%d.%s@%d", p.width, p.height, p.format, p.quality)
+}
+
+// ImageCache transforms images and caches the results up to the size of the cache, evicting
+// the least recently used. A nil ImageCache is valid and doesn't transform images.
+type ImageCache struct {
+	settings *Images
+	// slots limits the number of images transformed at once
+	slots chan struct{}
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+
+	hits, misses int64
+}
+
+// cachedImage is a transformed image of the cache.
+type cachedImage struct {
+	key         string
+	data        []byte
+	contentType string
+	etag        string
+}
+
+// NewImageCache creates the cache of the image transformations of the configuration. It
+// returns nil, if images aren't transformed.
+func NewImageCache(cfg *Config) (*ImageCache, error) {
+	if cfg.Images == nil {
+		return nil, nil
+	}
+	if q := cfg.Images.Quality; q < 1 || q > 100 {
+		return nil, fmt.Errorf("image quality %d isn't within 1 and 100", q)
+	}
+	return &ImageCache{
+		settings: cfg.Images,
+		slots:    make(chan struct{}, runtime.NumCPU()),
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}, nil
+}
+
+// params returns the transformation requested by the query for an image of the format.
+func (c *ImageCache) params(query url.Values, format string) (imageParams, error) {
+	p := imageParams{format: format, quality: c.settings.Quality}
+	for _, dim := range []struct {
+		name  string
+		value *int
+	}{{"w", &p.width}, {"h", &p.height}} {
+		if v := query.Get(dim.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > c.settings.MaxSize {
+				return p, errImageParams
+			}
+			*dim.value = n
+		}
+	}
+	if f := strings.ToLower(query.Get("format")); f != "" {
+		if f == "jpg" {
+			f = "jpeg"
+		}
+		if imageContentTypes[f] == "" {
+			return p, errImageParams
+		}
+		p.format = f
+	}
+	if v := query.Get("q"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 1 || q > 100 {
+			return p, errImageParams
+		}
+		p.quality = q
+	}
+	if p.format != "jpeg" {
+		// the quality only applies to JPEG images, so it doesn't split the cache otherwise
+		p.quality = 0
+	}
+	return p, nil
+}
+
+// serveImage answers a GET of an image file with transformation parameters by the transformed
+// image. It returns whether the request has been handled.
+func (a *App) serveImage(w http.ResponseWriter, r *http.Request) bool {
+	c := a.Images
+	if c == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	format := imageFormats[strings.ToLower(path.Ext(r.URL.Path))]
+	query := r.URL.Query()
+	if format == "" || !(query.Has("w") || query.Has("h") || query.Has("format") || query.Has("q")) {
+		return false
+	}
+	params, err := c.params(query, format)
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	ctx := r.Context()
+	p, ok := a.relativePath(r)
+	if !ok {
+		http.NotFound(w, r)
+		return true
+	}
+	name := path.Clean(p)
+	f, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if os.IsPermission(err) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return true
+	} else if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	var user string
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		user = authInfo.Username
+	}
+	key := strings.Join([]string{user, name, strconv.FormatInt(fi.ModTime().UnixNano(), 10), strconv.FormatInt(fi.Size(), 10), params.String()}, "\x00")
+	img, err := c.get(key, f, params)
+	switch {
+	case errors.Is(err, errImageTooLarge):
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	case err != nil:
+		log.WithField("path", name).WithError(err).Debug("Error transforming image")
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return true
+	}
+	traceStep(ctx, "transformed image %s to %s", name, params)
+	w.Header().Set("Content-Type", img.contentType)
+	w.Header().Set("ETag", img.etag)
+	http.ServeContent(w, r, name, fi.ModTime(), bytes.NewReader(img.data))
+	return true
+}
+
+// get returns the cached image of the key or transforms the source and caches the result.
+func (c *ImageCache) get(key string, src io.ReadSeeker, params imageParams) (*cachedImage, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return e.Value.(*cachedImage), nil
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	c.slots <- struct{}{}
+	data, err := c.transform(src, params)
+	<-c.slots
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(key))
+	img := &cachedImage{key: key, data: data, contentType: imageContentTypes[params.format], etag: `"` + hex.EncodeToString(sum[:16]) + `"`}
+	c.add(img)
+	return img, nil
+}
+
+// add caches the image, evicting the least recently used images beyond the size of the
+// cache. Images larger than the cache aren't cached.
+func (c *ImageCache) add(img *cachedImage) {
+	size := int64(len(img.data))
+	if size > int64(c.settings.CacheSize) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[img.key]; ok {
+		return
+	}
+	c.entries[img.key] = c.lru.PushFront(img)
+	c.size += size
+	for c.size > int64(c.settings.CacheSize) {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedImage)
+		delete(c.entries, oldest.key)
+		c.size -= int64(len(oldest.data))
+	}
+}
+
+// transform decodes the source, scales it to fit into the requested size without enlarging
+// it and encodes it in the requested format.
+func (c *ImageCache) transform(src io.ReadSeeker, params imageParams) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(c.settings.MaxPixels) {
+		return nil, errImageTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	width, height := fitImage(b.Dx(), b.Dy(), params.width, params.height)
+	if width != b.Dx() || height != b.Dy() {
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, draw.Src, nil)
+		img = scaled
+	}
+
+	var buf bytes.Buffer
+	switch params.format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: params.quality})
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "webp":
+		err = encodeWebP(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+// fitImage returns the size of an image of the width and height scaled down to fit into the
+// maximum width and height, keeping its aspect ratio. A maximum of zero doesn't limit.
+func fitImage(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight && float64(maxHeight)/float64(height) < scale {
+		scale = float64(maxHeight) / float64(height)
+	}
+	if scale == 1 {
+		return width, height
+	}
+	w, h := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// RegisterMetrics registers the hits and misses of the cache and its size.
+func (c *ImageCache) RegisterMetrics(m *Metrics) {
+	if c == nil {
+		return
+	}
+
+	m.Counter("dave_image_cache_hits_total", "Transformed images served from the cache.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&c.hits))}}
+	})
+	m.Counter("dave_image_cache_misses_total", "Images transformed for requests.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&c.misses))}}
+	})
+	m.Gauge("dave_image_cache_bytes", "Size of the transformed images in the cache.", func() []Sample {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return []Sample{{Value: float64(c.size)}}
+	})
+}
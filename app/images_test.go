@@ -0,0 +1,203 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+)
+
+func TestServeImage(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			src.Set(x, y, color.NRGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+	ioutil.WriteFile(filepath.Join(tmpDir, "photo.png"), buf.Bytes(), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "broken.png"), []byte("no image"), 0600)
+
+	cfg := &Config{
+		Dir:    tmpDir,
+		Realm:  "dave",
+		Users:  map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}},
+		Images: &Images{MaxSize: 1000},
+	}
+	cfg.setSectionDefaults()
+	a := newQuotaApp(t, cfg)
+	images, err := NewImageCache(cfg)
+	if err != nil {
+		t.Fatalf("NewImageCache() error = %v", err)
+	}
+	a.Images = images
+
+	tests := []struct {
+		name        string
+		target      string
+		status      int
+		contentType string
+		width       int
+		height      int
+	}{
+		{"resized", "/photo.png?w=100", http.StatusOK, "image/png", 100, 50},
+		{"resized by height", "/photo.png?w=300&h=50&format=jpg&q=70", http.StatusOK, "image/jpeg", 100, 50},
+		{"converted to webp", "/photo.png?w=80&format=webp", http.StatusOK, "image/webp", 80, 40},
+		{"converted to gif", "/photo.png?format=gif", http.StatusOK, "image/gif", 400, 200},
+		{"not enlarged", "/photo.png?w=800", http.StatusOK, "image/png", 400, 200},
+		{"no parameters", "/photo.png", http.StatusOK, "image/png", 400, 200},
+		{"no width", "/photo.png?w=0", http.StatusBadRequest, "", 0, 0},
+		{"width beyond the maximum", "/photo.png?w=1001", http.StatusBadRequest, "", 0, 0},
+		{"unknown format", "/photo.png?format=bmp", http.StatusBadRequest, "", 0, 0},
+		{"invalid quality", "/photo.png?q=101", http.StatusBadRequest, "", 0, 0},
+		{"no image", "/broken.png?w=100", http.StatusUnsupportedMediaType, "", 0, 0},
+		{"missing", "/missing.png?w=100", http.StatusNotFound, "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.SetBasicAuth("alice", "password")
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.status {
+				t.Fatalf("status = %v, want %v", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.contentType)
+			}
+			var got image.Image
+			var err error
+			if tt.contentType == "image/webp" {
+				got, err = webp.Decode(w.Body)
+			} else {
+				got, _, err = image.Decode(w.Body)
+			}
+			if err != nil {
+				t.Fatalf("decoding the image: %v", err)
+			}
+			if b := got.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Errorf("size = %vx%v, want %vx%v", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/photo.png?w=100", nil)
+	req.SetBasicAuth("alice", "password")
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	etag := w.Header().Get("ETag")
+	req = httptest.NewRequest("GET", "/photo.png?w=100", nil)
+	req.SetBasicAuth("alice", "password")
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	if etag == "" || w.Code != http.StatusNotModified {
+		t.Errorf("conditional request with ETag %q = %v, want %v", etag, w.Code, http.StatusNotModified)
+	}
+	if images.hits != 2 {
+		t.Errorf("cache hits = %v, want 2", images.hits)
+	}
+
+	cfg.Images.MaxPixels = 1000
+	req = httptest.NewRequest("GET", "/photo.png?w=10", nil)
+	req.SetBasicAuth("alice", "password")
+	w = httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("image beyond the maximum pixels = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestImageCacheEviction(t *testing.T) {
+	c, _ := NewImageCache(&Config{Images: &Images{CacheSize: 10, Quality: defaultImageQuality}})
+	c.add(&cachedImage{key: "a", data: make([]byte, 4)})
+	c.add(&cachedImage{key: "b", data: make([]byte, 4)})
+	c.add(&cachedImage{key: "too large", data: make([]byte, 11)})
+	// a is used, so b is evicted
+	c.get("a", nil, imageParams{})
+	c.add(&cachedImage{key: "c", data: make([]byte, 4)})
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true, "too large": false} {
+		if _, ok := c.entries[key]; ok != cached {
+			t.Errorf("%s cached = %v, want %v", key, ok, cached)
+		}
+	}
+	if c.size != 8 {
+		t.Errorf("size = %v, want 8", c.size)
+	}
+}
+
+func TestFitImage(t *testing.T) {
+	tests := []struct {
+		width, height, maxWidth, maxHeight int
+		wantWidth, wantHeight              int
+	}{
+		{400, 200, 100, 0, 100, 50},
+		{400, 200, 0, 100, 200, 100},
+		{400, 200, 100, 100, 100, 50},
+		{200, 400, 100, 100, 50, 100},
+		{400, 200, 800, 800, 400, 200},
+		{1000, 1, 10, 0, 10, 1},
+	}
+	for _, tt := range tests {
+		if w, h := fitImage(tt.width, tt.height, tt.maxWidth, tt.maxHeight); w != tt.wantWidth || h != tt.wantHeight {
+			t.Errorf("fitImage(%v, %v, %v, %v) = %v, %v, want %v, %v", tt.width, tt.height, tt.maxWidth, tt.maxHeight, w, h, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	tests := []struct {
+		name  string
+		color func(x, y int) color.NRGBA
+	}{
+		{"single color", func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 255} }},
+		{"gradient", func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255} }},
+		{"noise with alpha", func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256))}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, 97, 31))
+			for y := 0; y < 31; y++ {
+				for x := 0; x < 97; x++ {
+					img.SetNRGBA(x, y, tt.color(x, y))
+				}
+			}
+			var buf bytes.Buffer
+			if err := encodeWebP(&buf, img); err != nil {
+				t.Fatalf("encodeWebP() error = %v", err)
+			}
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("decoding the image: %v", err)
+			}
+			for y := 0; y < 31; y++ {
+				for x := 0; x < 97; x++ {
+					if c := color.NRGBAModel.Convert(got.At(x, y)); c != img.At(x, y) {
+						t.Fatalf("pixel %v,%v = %v, want %v", x, y, c, img.At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,525 @@
+package app
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultIntegrityInterval is the time between the verifications of the stored files by default.
+const defaultIntegrityInterval = 24 * time.Hour
+
+var (
+	errIntegrityRunning    = errors.New("verification is already running")
+	errIntegrityNoMismatch = errors.New("no mismatch of the file")
+)
+
+// Integrity verifies the files below dir against their checksums every Interval, 24h by
+// default, to detect bit rot and tampering, which bypassed the server. The checksums are kept
+// in File. A file, whose size or modification time changed, is taken as updated and hashed
+// again, a file, whose content changed nonetheless, is reported as a mismatch via the admin
+// API, the metrics and the alerts. Rate limits the bytes hashed per second, by default the
+// files are hashed as fast as the disks allow.
+type Integrity struct {
+	File     string
+	Interval time.Duration
+	Rate     ByteSize
+}
+
+// checksumEntry is the checksum of a file with the size and the modification time it had. MD5
+// is only known, if checksums are served.
+type checksumEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	SHA256   string    `json:"sha256"`
+	MD5      string    `json:"md5,omitempty"`
+	Verified time.Time `json:"verified"`
+}
+
+// IntegrityMismatch is a file, whose content differs from its checksum.
+type IntegrityMismatch struct {
+	Path     string    `json:"path"`
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Detected time.Time `json:"detected"`
+}
+
+// IntegrityRun is the result of a verification, Finished is nil while it's running. Verified
+// counts the files compared with their checksums, Hashed the new and updated files.
+type IntegrityRun struct {
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	Verified   int64      `json:"verified"`
+	Hashed     int64      `json:"hashed"`
+	Bytes      int64      `json:"bytes"`
+	Mismatches int64      `json:"mismatches"`
+	Errors     int64      `json:"errors"`
+}
+
+// IntegrityStatus is the state of the verification reported by the admin API.
+type IntegrityStatus struct {
+	Files      int                  `json:"files"`
+	Running    *IntegrityRun        `json:"running,omitempty"`
+	LastRun    *IntegrityRun        `json:"lastRun,omitempty"`
+	Mismatches []*IntegrityMismatch `json:"mismatches"`
+}
+
+// integrityState is the content of the checksum file.
+type integrityState struct {
+	Checksums  map[string]*checksumEntry `json:"checksums"`
+	Mismatches []*IntegrityMismatch      `json:"mismatches"`
+	LastRun    *IntegrityRun             `json:"lastRun,omitempty"`
+}
+
+// IntegrityChecker keeps the checksums of the stored files. It verifies the files in the
+// background, if the integrity verification is configured, and serves their checksums, if
+// checksums are configured. Without the verification, the checksums are only kept in memory.
+// A nil IntegrityChecker is valid and does neither.
+type IntegrityChecker struct {
+	settings   *Integrity
+	properties *Checksums
+	dir        string
+	files      storage
+	alerts     *Alerter
+
+	mu         sync.Mutex
+	checksums  map[string]*checksumEntry
+	mismatches map[string]*IntegrityMismatch
+	running    *IntegrityRun
+	last       *IntegrityRun
+	dirty      bool
+
+	verifiedBytes int64
+}
+
+// NewIntegrityChecker creates the verification of the configuration with the checksums of its
+// file, which alerts on mismatches. It returns nil, if neither the integrity verification nor
+// checksums are configured.
+func NewIntegrityChecker(cfg *Config, alerts *Alerter) (*IntegrityChecker, error) {
+	if cfg.Integrity == nil && cfg.Checksums == nil {
+		return nil, nil
+	}
+	c := &IntegrityChecker{
+		settings:   cfg.Integrity,
+		properties: cfg.Checksums,
+		dir:        cfg.Dir,
+		files:      cfg.storage(),
+		alerts:     alerts,
+		checksums:  map[string]*checksumEntry{},
+		mismatches: map[string]*IntegrityMismatch{},
+	}
+	if cfg.Integrity == nil {
+		return c, nil
+	}
+	if cfg.Integrity.File == "" {
+		return nil, fmt.Errorf("integrity verification requires a checksum file")
+	}
+	if cfg.Integrity.Rate < 0 {
+		return nil, fmt.Errorf("rate of the integrity verification must not be negative")
+	}
+
+	data, err := ioutil.ReadFile(cfg.Integrity.File)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state integrityState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid checksum file %s: %s", cfg.Integrity.File, err)
+	}
+	if state.Checksums != nil {
+		c.checksums = state.Checksums
+	}
+	for _, m := range state.Mismatches {
+		c.mismatches[m.Path] = m
+	}
+	c.last = state.LastRun
+	return c, nil
+}
+
+// Start verifies the files every interval and writes the checksums of the written and the
+// requested files every minute. The first verification is due an interval after the last one,
+// right away if there was none.
+func (c *IntegrityChecker) Start() {
+	if c == nil {
+		return
+	}
+
+	if c.properties != nil {
+		go func() {
+			ticker := time.NewTicker(usageFlushInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := c.flush(); err != nil {
+					log.WithField("path", c.settings.File).WithError(err).Error("Error saving the checksums")
+				}
+			}
+		}()
+	}
+	if c.settings == nil {
+		return
+	}
+
+	interval := c.settings.Interval
+	if interval <= 0 {
+		interval = defaultIntegrityInterval
+	}
+	go func() {
+		for {
+			c.mu.Lock()
+			next := time.Now()
+			if c.last != nil {
+				next = c.last.Started.Add(interval)
+			}
+			c.mu.Unlock()
+			time.Sleep(time.Until(next))
+			if _, err := c.run(time.Now()); err == errIntegrityRunning {
+				// started via the admin API, the next one is due an interval after it
+				time.Sleep(time.Minute)
+			}
+		}
+	}()
+}
+
+// run verifies all files below the base directory and returns the result. Checksums of
+// removed files are forgotten.
+func (c *IntegrityChecker) run(now time.Time) (*IntegrityRun, error) {
+	c.mu.Lock()
+	if c.running != nil {
+		c.mu.Unlock()
+		return nil, errIntegrityRunning
+	}
+	r := &IntegrityRun{Started: now}
+	c.running = r
+	c.mu.Unlock()
+	log.Info("Verifying the integrity of the stored files")
+
+	file, _ := filepath.Abs(c.settings.File)
+	seen := map[string]bool{}
+	c.files.Walk(c.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			c.mu.Lock()
+			r.Errors++
+			c.mu.Unlock()
+			log.WithField("path", p).WithError(err).Debug("Error walking the files to verify")
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if abs, _ := filepath.Abs(p); abs == file {
+			return nil
+		}
+		name := c.name(p)
+		seen[name] = true
+		c.verify(r, name, p, fi)
+		return nil
+	})
+
+	c.mu.Lock()
+	for name := range c.checksums {
+		if !seen[name] {
+			delete(c.checksums, name)
+			delete(c.mismatches, name)
+		}
+	}
+	finished := time.Now()
+	r.Finished = &finished
+	c.running = nil
+	c.last = r
+	err := c.save()
+	result := *r
+	c.mu.Unlock()
+
+	if err != nil {
+		log.WithError(err).Error("Error saving the checksums")
+	}
+	log.WithFields(log.Fields{"verified": result.Verified, "hashed": result.Hashed, "mismatches": result.Mismatches,
+		"errors": result.Errors, "duration": finished.Sub(now).Round(time.Second).String()}).Info("Verified the integrity of the stored files")
+	return &result, nil
+}
+
+// verify hashes the file and compares it with its checksum. Files, which change while they're
+// hashed, are skipped until the next run.
+func (c *IntegrityChecker) verify(r *IntegrityRun, name, p string, fi os.FileInfo) {
+	started := time.Now()
+	sum, md5Sum, err := c.hash(p)
+	if err == nil {
+		c.throttle(fi.Size(), time.Since(started))
+	}
+	after, statErr := c.files.Lstat(p)
+	if err == nil && (statErr != nil || after.Size() != fi.Size() || !after.ModTime().Equal(fi.ModTime())) {
+		return
+	}
+
+	c.mu.Lock()
+	if err != nil {
+		r.Errors++
+		c.mu.Unlock()
+		log.WithField("path", name).WithError(err).Warn("Error hashing file to verify")
+		return
+	}
+	r.Bytes += fi.Size()
+	atomic.AddInt64(&c.verifiedBytes, fi.Size())
+
+	var mismatch *IntegrityMismatch
+	e := c.checksums[name]
+	switch {
+	case e == nil || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()):
+		c.checksums[name] = &checksumEntry{Size: fi.Size(), ModTime: fi.ModTime(), SHA256: sum, MD5: md5Sum, Verified: r.Started}
+		delete(c.mismatches, name)
+		r.Hashed++
+	case e.SHA256 == sum:
+		e.Verified = r.Started
+		if e.MD5 == "" {
+			e.MD5 = md5Sum
+		}
+		delete(c.mismatches, name)
+		r.Verified++
+	default:
+		r.Verified++
+		r.Mismatches++
+		if c.mismatches[name] == nil || c.mismatches[name].Actual != sum {
+			mismatch = &IntegrityMismatch{Path: name, Expected: e.SHA256, Actual: sum, Size: fi.Size(), ModTime: fi.ModTime(), Detected: time.Now()}
+			c.mismatches[name] = mismatch
+		}
+	}
+	c.mu.Unlock()
+
+	if mismatch != nil {
+		c.alerts.integrityFailed(alertEvent{
+			Event:   alertEventIntegrity,
+			Time:    mismatch.Detected,
+			Message: fmt.Sprintf("Content of %s differs from its checksum", name),
+			Path:    name,
+		})
+	}
+}
+
+// hash returns the hex encoded SHA-256 of the content of the physical file and its MD5, if
+// checksums are served.
+func (c *IntegrityChecker) hash(p string) (string, string, error) {
+	if c.properties == nil {
+		sum, err := hashFile(c.files, p)
+		return sum, "", err
+	}
+	f, err := c.files.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	sha256Sum, md5Sum := sha256.New(), md5.New()
+	if _, err := io.Copy(io.MultiWriter(sha256Sum, md5Sum), f); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(sha256Sum.Sum(nil)), hex.EncodeToString(md5Sum.Sum(nil)), nil
+}
+
+// throttle waits until hashing size bytes took as long as the rate allows.
+func (c *IntegrityChecker) throttle(size int64, took time.Duration) {
+	if c.settings.Rate <= 0 {
+		return
+	}
+	if wait := time.Duration(float64(size)/float64(c.settings.Rate)*float64(time.Second)) - took; wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// accept takes the current content of a mismatched file as its checksum, e.g. after it has
+// been restored from a backup or the change has been confirmed.
+func (c *IntegrityChecker) accept(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m := c.mismatches[name]
+	if m == nil {
+		return errIntegrityNoMismatch
+	}
+	if e := c.checksums[name]; e != nil {
+		e.SHA256, e.MD5 = m.Actual, ""
+	}
+	delete(c.mismatches, name)
+	return c.save()
+}
+
+// status returns the state of the verification with the mismatches ordered by path.
+func (c *IntegrityChecker) status() IntegrityStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := IntegrityStatus{Files: len(c.checksums), Mismatches: c.sortedMismatches()}
+	if c.running != nil {
+		running := *c.running
+		s.Running = &running
+	}
+	if c.last != nil {
+		last := *c.last
+		s.LastRun = &last
+	}
+	return s
+}
+
+// sortedMismatches returns the mismatches ordered by path. c.mu must be held.
+func (c *IntegrityChecker) sortedMismatches() []*IntegrityMismatch {
+	mismatches := make([]*IntegrityMismatch, 0, len(c.mismatches))
+	for _, m := range c.mismatches {
+		mismatches = append(mismatches, m)
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Path < mismatches[j].Path })
+	return mismatches
+}
+
+// name returns the name of the physical file below the base directory, by which its checksum
+// is kept.
+func (c *IntegrityChecker) name(p string) string {
+	rel, _ := filepath.Rel(c.dir, p)
+	return path.Join("/", filepath.ToSlash(rel))
+}
+
+// lookup returns the checksums of the physical file, if it didn't change since they were
+// computed and its content doesn't mismatch them.
+func (c *IntegrityChecker) lookup(p string, fi os.FileInfo) *checksumEntry {
+	name := c.name(p)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.checksums[name]; e != nil && e.MD5 != "" && c.mismatches[name] == nil &&
+		e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) {
+		return e
+	}
+	return nil
+}
+
+// record keeps the checksums of the physical file, which has the size and the modification
+// time of the info, and returns them. The checksum of a file, whose size and modification time
+// are the same, but whose content differs, is kept, so the verification still reports it.
+func (c *IntegrityChecker) record(p string, fi os.FileInfo, md5Sum, sha256Sum []byte) *checksumEntry {
+	name := c.name(p)
+	e := &checksumEntry{Size: fi.Size(), ModTime: fi.ModTime(), SHA256: hex.EncodeToString(sha256Sum), MD5: hex.EncodeToString(md5Sum)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.checksums[name]; old != nil && old.Size == e.Size && old.ModTime.Equal(e.ModTime) {
+		if old.SHA256 != e.SHA256 {
+			return e
+		}
+		old.MD5 = e.MD5
+	} else {
+		c.checksums[name] = e
+		delete(c.mismatches, name)
+	}
+	c.dirty = true
+	return c.checksums[name]
+}
+
+// flush forgets the checksums of removed files and writes the checksums to the file, if they
+// changed since the last verification.
+func (c *IntegrityChecker) flush() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	names := make([]string, 0, len(c.checksums))
+	for name := range c.checksums {
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+
+	var removed []string
+	for _, name := range names {
+		if _, err := c.files.Stat(filepath.Join(c.dir, filepath.FromSlash(name))); os.IsNotExist(err) {
+			removed = append(removed, name)
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range removed {
+		delete(c.checksums, name)
+		delete(c.mismatches, name)
+	}
+	return c.save()
+}
+
+// save writes the checksums to the file, if the files are verified. c.mu must be held.
+func (c *IntegrityChecker) save() error {
+	c.dirty = false
+	if c.settings == nil {
+		return nil
+	}
+	data, err := json.Marshal(integrityState{Checksums: c.checksums, Mismatches: c.sortedMismatches(), LastRun: c.last})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.settings.File, data)
+}
+
+// hashFile returns the hex encoded SHA-256 of the content of the file of the storage.
+func hashFile(files storage, p string) (string, error) {
+	f, err := files.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RegisterMetrics exposes the checksummed files, the hashed bytes and the mismatches.
+func (c *IntegrityChecker) RegisterMetrics(m *Metrics) {
+	if c == nil {
+		return
+	}
+
+	if c.properties != nil {
+		m.Gauge("dave_checksums_cached", "Files whose checksums are cached.", func() []Sample {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return []Sample{{Value: float64(len(c.checksums))}}
+		})
+	}
+	if c.settings == nil {
+		return
+	}
+
+	m.Gauge("dave_integrity_files", "Files with a checksum of the integrity verification.", func() []Sample {
+		return []Sample{{Value: float64(c.status().Files)}}
+	})
+	m.Gauge("dave_integrity_mismatches", "Files whose content differs from their checksum.", func() []Sample {
+		return []Sample{{Value: float64(len(c.status().Mismatches))}}
+	})
+	m.Counter("dave_integrity_verified_bytes_total", "Bytes hashed by the integrity verification.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&c.verifiedBytes))}}
+	})
+	m.Gauge("dave_integrity_last_run_timestamp_seconds", "Time the last integrity verification finished.", func() []Sample {
+		last := c.status().LastRun
+		if last == nil || last.Finished == nil {
+			return nil
+		}
+		return []Sample{{Value: float64(last.Finished.Unix())}}
+	})
+}
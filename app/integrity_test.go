@@ -0,0 +1,121 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIntegrity(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	dir := filepath.Join(tmpDir, "data")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("bbb"), 0600)
+
+	receiver, events := alertReceiver(t)
+	cfg := &Config{
+		Dir:       dir,
+		Integrity: &Integrity{File: filepath.Join(tmpDir, "checksums.json")},
+		Alerts:    &Alerts{Webhook: receiver.URL},
+		Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}},
+	}
+	alerter, err := NewAlerter(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewAlerter() error = %v", err)
+	}
+	c, err := NewIntegrityChecker(cfg, alerter)
+	if err != nil {
+		t.Fatalf("NewIntegrityChecker() error = %v", err)
+	}
+	run := func(name string, want IntegrityRun) {
+		t.Helper()
+		r, err := c.run(time.Now())
+		if err != nil {
+			t.Fatalf("%s: run() error = %v", name, err)
+		}
+		if r.Verified != want.Verified || r.Hashed != want.Hashed || r.Mismatches != want.Mismatches || r.Errors != 0 || r.Finished == nil {
+			t.Errorf("%s: run() = %+v, want %+v", name, r, want)
+		}
+	}
+
+	run("first run", IntegrityRun{Hashed: 2})
+	run("unchanged files", IntegrityRun{Verified: 2})
+
+	// the content changes, but the size and the modification time don't
+	b := filepath.Join(dir, "sub", "b.txt")
+	fi, _ := os.Stat(b)
+	ioutil.WriteFile(b, []byte("bab"), 0600)
+	os.Chtimes(b, fi.ModTime(), fi.ModTime())
+	run("corrupted file", IntegrityRun{Verified: 2, Mismatches: 1})
+	expectAlert(t, events, alertEventIntegrity)
+	run("still corrupted file", IntegrityRun{Verified: 2, Mismatches: 1})
+	expectNoAlert(t, events)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("aa"), 0600)
+	run("updated file", IntegrityRun{Verified: 1, Hashed: 1, Mismatches: 1})
+
+	// the mismatch is kept across restarts
+	c, err = NewIntegrityChecker(cfg, alerter)
+	if err != nil {
+		t.Fatalf("NewIntegrityChecker() of the saved checksums error = %v", err)
+	}
+	if s := c.status(); s.Files != 2 || len(s.Mismatches) != 1 || s.Mismatches[0].Path != "/sub/b.txt" || s.LastRun == nil {
+		t.Fatalf("status() after a restart = %+v", s)
+	}
+
+	handler := NewAdminHandler(&App{Config: cfg, Tracker: NewTracker(), Integrity: c})
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		statusCode int
+		mismatches int
+	}{
+		{"status", "GET", "/api/v1/integrity", 200, 1},
+		{"accept without path", "DELETE", "/api/v1/integrity", 400, -1},
+		{"accept", "DELETE", "/api/v1/integrity?path=/sub/b.txt", 200, 0},
+		{"accept again", "DELETE", "/api/v1/integrity?path=/sub/b.txt", 404, -1},
+		{"update", "PUT", "/api/v1/integrity", 405, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.SetBasicAuth("root", "secret")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v. body = %s", w.Code, tt.statusCode, w.Body)
+			}
+			if tt.mismatches < 0 {
+				return
+			}
+			var s IntegrityStatus
+			if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+				t.Fatalf("decoding the status: %v", err)
+			}
+			if len(s.Mismatches) != tt.mismatches {
+				t.Errorf("mismatches = %v, want %v", s.Mismatches, tt.mismatches)
+			}
+		})
+	}
+	run("accepted file", IntegrityRun{Verified: 2})
+
+	os.Remove(b)
+	run("removed file", IntegrityRun{Verified: 1})
+	if s := c.status(); s.Files != 1 {
+		t.Errorf("files after the removal = %v, want 1", s.Files)
+	}
+
+	if _, err := NewIntegrityChecker(&Config{Dir: dir, Integrity: &Integrity{}}, nil); err == nil {
+		t.Error("NewIntegrityChecker() without a checksum file error = nil")
+	}
+}
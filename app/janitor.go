@@ -0,0 +1,179 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultJanitorInterval is the time between the purges of the expiry directories by default.
+const defaultJanitorInterval = time.Hour
+
+// Expiry deletes the files beneath the directories, which haven't been modified for the TTL
+// of their directory, like the files of drop folders. The janitor looks for them every
+// Interval.
+type Expiry struct {
+	Interval    time.Duration
+	Directories []*ExpiryDir
+}
+
+// ExpiryDir expires the files beneath a directory, which is given relative to the base
+// directory, after the TTL. If Trash is set, the files are moved there instead of deleted.
+type ExpiryDir struct {
+	Path  string
+	TTL   time.Duration
+	Trash string
+}
+
+// Janitor purges the expired files of the expiry directories in the background. A nil
+// Janitor is valid and purges nothing.
+type Janitor struct {
+	config *Config
+	fs     Dir
+	purged int64
+}
+
+// NewJanitor creates the janitor of the expiry of the configuration, which deletes the files
+// with the quotas and the sync journal. It returns nil, if no expiry is configured.
+func NewJanitor(cfg *Config, quotas *Quotas, syncLog *SyncLog) (*Janitor, error) {
+	if cfg.Expiry == nil {
+		return nil, nil
+	}
+	for _, d := range cfg.Expiry.Directories {
+		dir := path.Clean("/" + filepath.ToSlash(d.Path))
+		switch {
+		case dir == "/":
+			return nil, fmt.Errorf("the base directory can't expire")
+		case d.TTL <= 0:
+			return nil, fmt.Errorf("TTL of the expiry directory %s isn't positive", d.Path)
+		case d.Trash != "" && withinDir(path.Clean("/"+filepath.ToSlash(d.Trash)), dir):
+			return nil, fmt.Errorf("trash %s of the expiry directory %s is within it", d.Trash, d.Path)
+		case cfg.AppendOnly.affects(cfg.Dir, filepath.Join(cfg.Dir, filepath.FromSlash(dir))):
+			return nil, fmt.Errorf("expiry directory %s is append-only", d.Path)
+		}
+	}
+	return &Janitor{config: cfg, fs: Dir{Config: cfg, Quotas: quotas, Sync: syncLog}}, nil
+}
+
+// Start purges the expired files right away and then every interval.
+func (j *Janitor) Start() {
+	if j == nil {
+		return
+	}
+
+	interval := j.config.Expiry.Interval
+	if interval <= 0 {
+		interval = defaultJanitorInterval
+	}
+	go func() {
+		j.purge(time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			j.purge(now)
+		}
+	}()
+}
+
+// purge deletes or trashes the files of all expiry directories, which are expired at the
+// time, and returns their number. Nothing is purged in the read-only mode.
+func (j *Janitor) purge(now time.Time) int {
+	if j.config.ReadOnly() {
+		return 0
+	}
+	// the expiry is configured by the admin, so it doesn't wait for the approval of deletions
+	ctx := withDeletionApproved(context.Background())
+	purged := 0
+	for _, d := range j.config.Expiry.Directories {
+		purged += j.purgeDir(ctx, d, now)
+	}
+	atomic.AddInt64(&j.purged, int64(purged))
+	return purged
+}
+
+// purgeDir purges the expired files of the directory. Its subdirectories are removed once
+// they've been empty for the TTL, so drop folders don't fill up with empty directories.
+func (j *Janitor) purgeDir(ctx context.Context, d *ExpiryDir, now time.Time) int {
+	dir := path.Clean("/" + filepath.ToSlash(d.Path))
+	root := j.fs.resolve(ctx, dir)
+	store := j.config.storage()
+	var files, dirs []string
+	store.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		name := path.Join(dir, filepath.ToSlash(rel))
+		switch {
+		case fi.IsDir():
+			dirs = append(dirs, name)
+		case now.Sub(fi.ModTime()) >= d.TTL && !now.Before(j.config.Retention.retainedUntil(j.config.Dir, p, fi)):
+			files = append(files, name)
+		}
+		return nil
+	})
+
+	purged := 0
+	for _, name := range files {
+		if j.expire(ctx, d, dir, name, now) {
+			purged++
+		}
+	}
+	// innermost directories first, so their parents may be empty afterwards
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := j.fs.resolve(ctx, dirs[i])
+		fi, err := store.Stat(p)
+		if err != nil || now.Sub(fi.ModTime()) < d.TTL {
+			continue
+		}
+		if entries, err := store.ReadDir(p); err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := j.fs.RemoveAll(ctx, dirs[i]); err != nil {
+			log.WithField("path", dirs[i]).WithError(err).Warn("Error removing empty expiry directory")
+			continue
+		}
+		purged++
+	}
+	return purged
+}
+
+// expire deletes the file of the expiry directory dir or moves it to the trash. Trashed files
+// are touched, so an expiry of the trash counts from the time they've been moved there.
+func (j *Janitor) expire(ctx context.Context, d *ExpiryDir, dir, name string, now time.Time) bool {
+	var err error
+	if d.Trash == "" {
+		err = j.fs.RemoveAll(ctx, name)
+	} else {
+		trashed := path.Join(path.Clean("/"+filepath.ToSlash(d.Trash)), strings.TrimPrefix(name, dir))
+		if err = j.fs.mkdirParents(ctx, trashed); err == nil {
+			err = j.fs.Rename(ctx, name, trashed)
+		}
+		if err == nil && !j.config.dryRun() {
+			j.config.storage().Chtimes(j.fs.resolve(ctx, trashed), now, now)
+		}
+	}
+	if err != nil {
+		log.WithField("path", name).WithError(err).Warn("Error expiring file")
+		return false
+	}
+	log.WithFields(log.Fields{"path": name, "trash": d.Trash}).Info("Expired file")
+	return true
+}
+
+// RegisterMetrics registers the number of files purged by the janitor.
+func (j *Janitor) RegisterMetrics(m *Metrics) {
+	if j == nil {
+		return
+	}
+
+	m.Counter("dave_expired_files_total", "Files and directories deleted or trashed after their TTL.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&j.purged))}}
+	})
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJanitor(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	defer os.RemoveAll(tmpDir)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	files := map[string]time.Time{
+		"drop/old.txt":            old,
+		"drop/new.txt":            now,
+		"drop/sub/old.txt":        old,
+		"drop/invoices/old.pdf":   old,
+		"scans/2024/old.pdf":      old,
+		"scans/2024/new.pdf":      now,
+		"elsewhere/untouched.txt": old,
+	}
+	for name, modTime := range files {
+		p := filepath.Join(tmpDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0700)
+		ioutil.WriteFile(p, []byte("content"), 0600)
+		os.Chtimes(p, modTime, modTime)
+	}
+	os.MkdirAll(filepath.Join(tmpDir, "drop", "empty"), 0700)
+	os.Chtimes(filepath.Join(tmpDir, "drop", "empty"), old, old)
+
+	cfg := &Config{
+		Dir: tmpDir,
+		Expiry: &Expiry{Directories: []*ExpiryDir{
+			{Path: "/drop", TTL: 24 * time.Hour},
+			{Path: "/scans", TTL: 24 * time.Hour, Trash: "/trash"},
+		}},
+		Retention: &Retention{Directories: []*RetentionDir{{Path: "/drop/invoices", Period: 87600 * time.Hour}}},
+	}
+	j, err := NewJanitor(cfg, nil, nil)
+	if err != nil {
+		t.Fatalf("NewJanitor() error = %v", err)
+	}
+
+	cfg.SetReadOnly(true)
+	if n := j.purge(now); n != 0 {
+		t.Errorf("purge() in read-only mode = %v, want 0", n)
+	}
+	cfg.SetReadOnly(false)
+	// old.txt of drop/sub is removed, but drop/sub is only empty since now
+	if n := j.purge(now); n != 4 {
+		t.Errorf("purge() = %v, want 4", n)
+	}
+
+	tests := []struct {
+		name   string
+		exists bool
+	}{
+		{"drop/old.txt", false},
+		{"drop/new.txt", true},
+		{"drop/sub/old.txt", false},
+		{"drop/sub", true},
+		{"drop/empty", false},
+		{"drop/invoices/old.pdf", true},
+		{"scans/2024/old.pdf", false},
+		{"scans/2024/new.pdf", true},
+		{"trash/2024/old.pdf", true},
+		{"elsewhere/untouched.txt", true},
+	}
+	for _, tt := range tests {
+		if _, err := os.Stat(filepath.Join(tmpDir, filepath.FromSlash(tt.name))); (err == nil) != tt.exists {
+			t.Errorf("%s exists = %v, want %v", tt.name, err == nil, tt.exists)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(tmpDir, "trash", "2024", "old.pdf")); err == nil && fi.ModTime().Before(now.Add(-time.Second)) {
+		t.Errorf("modification time of the trashed file = %v, want the time of the purge", fi.ModTime())
+	}
+}
+
+func TestNewJanitor(t *testing.T) {
+	tests := []struct {
+		name  string
+		dir   *ExpiryDir
+		valid bool
+	}{
+		{"valid", &ExpiryDir{Path: "/drop", TTL: time.Hour, Trash: "/trash"}, true},
+		{"base directory", &ExpiryDir{Path: "/", TTL: time.Hour}, false},
+		{"no TTL", &ExpiryDir{Path: "/drop"}, false},
+		{"trash within the directory", &ExpiryDir{Path: "/drop", TTL: time.Hour, Trash: "/drop/trash"}, false},
+		{"append-only", &ExpiryDir{Path: "/audit/drop", TTL: time.Hour}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Dir:        "/srv/dave",
+				Expiry:     &Expiry{Directories: []*ExpiryDir{tt.dir}},
+				AppendOnly: &AppendOnly{Directories: []string{"/audit"}},
+			}
+			if _, err := NewJanitor(cfg, nil, nil); (err == nil) != tt.valid {
+				t.Errorf("NewJanitor() error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+	if j, err := NewJanitor(&Config{}, nil, nil); j != nil || err != nil {
+		t.Errorf("NewJanitor() without expiry = %v, %v, want nil", j, err)
+	}
+}
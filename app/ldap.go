@@ -0,0 +1,263 @@
+package app
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the LDAP authentication
+const (
+	defaultLDAPUserFilter  = "(uid=%s)"
+	defaultLDAPGroupFilter = "(member=%s)"
+	defaultLDAPCacheTTL    = 5 * time.Minute
+	defaultLDAPTimeout     = 10 * time.Second
+)
+
+// LDAP authenticates users by binding against the LDAP or Active Directory server at URL,
+// ldap:// or ldaps://, optionally upgraded by StartTLS. The user is searched below BaseDN by
+// UserFilter, (uid=%s) by default, as BindDN or anonymously, and bound with the password then.
+// The groups of the user are searched by GroupFilter, (member=%s) with the DN of the user by
+// default. Users, which aren't configured, get the configured groups and the subdir mapped to
+// their LDAP groups by Groups, or a subdir named after them. Logins are cached for CacheTTL, 5m
+// by default.
+type LDAP struct {
+	URL          string
+	StartTLS     bool
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string
+	GroupFilter  string
+	Groups       map[string]*LDAPGroup
+	CacheTTL     time.Duration
+	Timeout      time.Duration
+
+	mu    sync.Mutex
+	users map[string]*ldapUser
+}
+
+// LDAPGroup maps the members of an LDAP group, given by its DN or its CN, to the permissions
+// of the configured group Group and the subdir Subdir.
+type LDAPGroup struct {
+	Group  string
+	Subdir *string
+}
+
+// ldapUser is a cached login of a user.
+type ldapUser struct {
+	info     *UserInfo
+	password [sha256.Size]byte
+	expires  time.Time
+}
+
+// checkLDAP verifies the URL and the filters of the LDAP authentication, and that the groups
+// it maps to exist.
+func (cfg *Config) checkLDAP() error {
+	l := cfg.LDAP
+	if l == nil {
+		return nil
+	}
+	if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("LDAP requires an ldap:// or ldaps:// URL")
+	}
+	if l.BaseDN == "" {
+		return fmt.Errorf("LDAP requires a base DN")
+	}
+	for _, filter := range []string{l.userFilter(), l.groupFilter()} {
+		if _, err := compileLDAPFilter(strings.ReplaceAll(filter, "%s", "x")); err != nil {
+			return fmt.Errorf("invalid LDAP filter %s: %s", filter, err)
+		}
+	}
+	names := make([]string, 0, len(l.Groups))
+	for name := range l.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := l.Groups[name]
+		if g == nil || g.Group == "" {
+			continue
+		}
+		if _, ok := cfg.Groups[g.Group]; !ok {
+			return fmt.Errorf("LDAP group %s references unknown group %s", name, g.Group)
+		}
+	}
+	return nil
+}
+
+func (l *LDAP) userFilter() string {
+	if l.UserFilter == "" {
+		return defaultLDAPUserFilter
+	}
+	return l.UserFilter
+}
+
+func (l *LDAP) groupFilter() string {
+	if l.GroupFilter == "" {
+		return defaultLDAPGroupFilter
+	}
+	return l.GroupFilter
+}
+
+// user returns the user, which logged in via LDAP without being configured, or nil.
+func (l *LDAP) user(name string) *UserInfo {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if u := l.users[name]; u != nil {
+		return u.info
+	}
+	return nil
+}
+
+// ldapAuthenticate returns whether the LDAP server accepts the password of the user. Users,
+// which aren't configured, are remembered with the groups and the subdir of their LDAP groups,
+// or a subdir named after them, which has to exist or is created.
+func (cfg *Config) ldapAuthenticate(username, password string) bool {
+	l := cfg.LDAP
+	if l == nil {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	now := time.Now()
+	l.mu.Lock()
+	cached := l.users[username]
+	l.mu.Unlock()
+	if cached != nil && cached.password == sum && now.Before(cached.expires) {
+		return true
+	}
+
+	groups, err := l.authenticate(username, password)
+	if errors.Is(err, errLDAPInvalidCredentials) {
+		return false
+	} else if err != nil {
+		log.WithField("user", username).WithError(err).Error("Error authenticating user by LDAP")
+		return false
+	}
+
+	info := l.userInfo(groups)
+	cfg.usersMu.RLock()
+	configured := cfg.Users[username] != nil
+	cfg.usersMu.RUnlock()
+	if !configured && info.Subdir == nil {
+		// users without a mapped subdir are jailed within one of their own
+		if username == "." || username == ".." || strings.ContainsAny(username, `/\`) {
+			log.WithField("user", username).Error("Error authenticating user by LDAP: the name isn't valid as subdir")
+			return false
+		}
+		subdir := "/" + username
+		info.Subdir = &subdir
+	}
+	if !configured && cfg.ContentStore == nil {
+		base := cfg.Dir
+		if base == "" {
+			base = "."
+		}
+		if err := cfg.checkDir(filepath.Join(base, *info.Subdir), "subdir of user "+username); err != nil {
+			log.WithField("user", username).WithError(err).Error("Error authenticating user by LDAP")
+			return false
+		}
+	}
+	ttl := l.CacheTTL
+	if ttl == 0 {
+		ttl = defaultLDAPCacheTTL
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.users == nil {
+		l.users = map[string]*ldapUser{}
+	}
+	l.users[username] = &ldapUser{info: info, password: sum, expires: now.Add(ttl)}
+	log.WithField("user", username).WithField("groups", info.Groups).Debug("Authenticated user by LDAP")
+	return true
+}
+
+// authenticate searches the user, binds with the password and returns the groups of the user
+// by their DN and CN.
+func (l *LDAP) authenticate(username, password string) ([]*ldapEntry, error) {
+	if password == "" {
+		// an empty password would be an unauthenticated bind, which servers accept
+		return nil, errLDAPInvalidCredentials
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = defaultLDAPTimeout
+	}
+	c, err := dialLDAP(l.URL, l.StartTLS, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+
+	if l.BindDN != "" {
+		if err := c.bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, fmt.Errorf("bind as %s: %w", l.BindDN, err)
+		}
+	}
+	users, err := c.search(l.BaseDN, strings.ReplaceAll(l.userFilter(), "%s", ldapEscape(username)), "1.1")
+	if err != nil {
+		return nil, err
+	}
+	if len(users) != 1 {
+		return nil, errLDAPInvalidCredentials
+	}
+	if err := c.bind(users[0].dn, password); err != nil {
+		return nil, err
+	}
+	return c.search(l.BaseDN, strings.ReplaceAll(l.groupFilter(), "%s", ldapEscape(users[0].dn)), "cn")
+}
+
+// userInfo returns the user with the configured groups and the first subdir mapped to the
+// LDAP groups. The mappings are applied in the order of their names.
+func (l *LDAP) userInfo(groups []*ldapEntry) *UserInfo {
+	names := make([]string, 0, len(l.Groups))
+	for name := range l.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	info := &UserInfo{}
+	added := map[string]bool{}
+	for _, name := range names {
+		mapping := l.Groups[name]
+		if mapping == nil || !ldapMember(groups, name) {
+			continue
+		}
+		if mapping.Group != "" && !added[mapping.Group] {
+			added[mapping.Group] = true
+			info.Groups = append(info.Groups, mapping.Group)
+		}
+		if mapping.Subdir != nil && info.Subdir == nil {
+			subdir := *mapping.Subdir
+			info.Subdir = &subdir
+		}
+	}
+	return info
+}
+
+// ldapMember returns whether one of the groups has the DN or the CN.
+func ldapMember(groups []*ldapEntry, name string) bool {
+	for _, g := range groups {
+		if strings.EqualFold(g.dn, name) {
+			return true
+		}
+		for _, cn := range g.attributes["cn"] {
+			if strings.EqualFold(cn, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
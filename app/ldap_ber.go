@@ -0,0 +1,511 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tags of the LDAP messages and the result codes of RFC 4511
+const (
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+	// ldapMaxMessage limits the size of the messages of the server
+	ldapMaxMessage = 16 << 20
+)
+
+var errLDAPInvalidCredentials = errors.New("invalid LDAP credentials")
+
+// berPacket is an element of the basic encoding rules, which LDAP messages are made of.
+// Primitive elements have a value, constructed ones children.
+type berPacket struct {
+	tag      byte
+	value    []byte
+	children []*berPacket
+}
+
+func berPrimitive(tag byte, value []byte) *berPacket {
+	return &berPacket{tag: tag, value: value}
+}
+
+func berConstructed(tag byte, children ...*berPacket) *berPacket {
+	return &berPacket{tag: tag, children: children}
+}
+
+func berString(s string) *berPacket {
+	return berPrimitive(0x04, []byte(s))
+}
+
+// berInt encodes n as INTEGER or ENUMERATED, depending on the tag.
+func berInt(tag byte, n int64) *berPacket {
+	var value []byte
+	for {
+		value = append([]byte{byte(n)}, value...)
+		if (n < 0x80 && n >= -0x80) || len(value) == 8 {
+			return berPrimitive(tag, value)
+		}
+		n >>= 8
+	}
+}
+
+func berBool(b bool) *berPacket {
+	if b {
+		return berPrimitive(0x01, []byte{0xff})
+	}
+	return berPrimitive(0x01, []byte{0})
+}
+
+func (p *berPacket) constructed() bool {
+	return p.tag&0x20 != 0
+}
+
+// int decodes the value of an INTEGER or ENUMERATED.
+func (p *berPacket) int() int64 {
+	var n int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+// child returns the child at the index, or an empty element if there is none.
+func (p *berPacket) child(i int) *berPacket {
+	if i < len(p.children) {
+		return p.children[i]
+	}
+	return &berPacket{}
+}
+
+// bytes returns the encoding of the element with a definite length.
+func (p *berPacket) bytes() []byte {
+	content := p.value
+	if p.constructed() {
+		content = nil
+		for _, c := range p.children {
+			content = append(content, c.bytes()...)
+		}
+	}
+	var length []byte
+	if n := len(content); n < 0x80 {
+		length = []byte{byte(n)}
+	} else {
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		length = append([]byte{0x80 | byte(len(length))}, length...)
+	}
+	return append(append([]byte{p.tag}, length...), content...)
+}
+
+// readBER reads an element with a definite length and its children.
+func readBER(r interface {
+	io.Reader
+	io.ByteReader
+}) (*berPacket, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if tag&0x1f == 0x1f {
+		return nil, errors.New("unsupported BER tag")
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n := int(b)
+	if b&0x80 != 0 {
+		k := int(b & 0x7f)
+		if k == 0 || k > 4 {
+			return nil, errors.New("unsupported BER length")
+		}
+		n = 0
+		for i := 0; i < k; i++ {
+			if b, err = r.ReadByte(); err != nil {
+				return nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > ldapMaxMessage {
+		return nil, errors.New("LDAP message too large")
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+
+	p := &berPacket{tag: tag}
+	if !p.constructed() {
+		p.value = content
+		return p, nil
+	}
+	cr := bytes.NewReader(content)
+	for cr.Len() > 0 {
+		child, err := readBER(cr)
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, child)
+	}
+	return p, nil
+}
+
+// compileLDAPFilter encodes a filter in the string representation of RFC 4515, e.g.
+// (&(objectClass=person)(uid=alice)).
+func compileLDAPFilter(s string) (*berPacket, error) {
+	p, rest, err := parseLDAPFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after LDAP filter", rest)
+	}
+	return p, nil
+}
+
+func parseLDAPFilter(s string) (*berPacket, string, error) {
+	if !strings.HasPrefix(s, "(") || len(s) < 2 {
+		return nil, "", fmt.Errorf("LDAP filter %q must be enclosed in parentheses", s)
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var children []*berPacket
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := parseLDAPFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			children, s = append(children, child), rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("unterminated LDAP filter")
+		}
+		return berConstructed(tag, children...), s[1:], nil
+	case '!':
+		child, rest, err := parseLDAPFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("unterminated LDAP filter")
+		}
+		return berConstructed(0xa2, child), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("unterminated LDAP filter")
+	}
+	p, err := parseLDAPItem(s[:end])
+	return p, s[end+1:], err
+}
+
+// parseLDAPItem encodes a comparison like uid=alice, cn=a*b or age>=21.
+func parseLDAPItem(item string) (*berPacket, error) {
+	i := strings.IndexByte(item, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid LDAP filter item %q", item)
+	}
+	attr, value := item[:i], item[i+1:]
+	tag := byte(0xa3)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag = 0xa5
+	case '<':
+		tag = 0xa6
+	case '~':
+		tag = 0xa8
+	}
+	if tag != 0xa3 {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" || strings.ContainsAny(attr, "()*\\") {
+		return nil, fmt.Errorf("invalid LDAP filter item %q", item)
+	}
+
+	if tag == 0xa3 && value == "*" {
+		return berPrimitive(0x87, []byte(attr)), nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs []*berPacket
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := ldapUnescape(part)
+			if err != nil {
+				return nil, err
+			}
+			subTag := byte(0x81)
+			if i == 0 {
+				subTag = 0x80
+			} else if i == len(parts)-1 {
+				subTag = 0x82
+			}
+			subs = append(subs, berPrimitive(subTag, []byte(v)))
+		}
+		return berConstructed(0xa4, berString(attr), berConstructed(0x30, subs...)), nil
+	}
+	v, err := ldapUnescape(value)
+	if err != nil {
+		return nil, err
+	}
+	return berConstructed(tag, berString(attr), berString(v)), nil
+}
+
+// ldapUnescape decodes the \XX escapes of a value of a filter.
+func ldapUnescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("invalid escape in LDAP filter value %q", s)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in LDAP filter value %q", s)
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// ldapEscape escapes the special characters of a value, which is inserted into a filter.
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapEntry is a result of a search with the values of its attributes by their lower case
+// names.
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// ldapConn is a connection to an LDAP server.
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int64
+}
+
+// dialLDAP connects to the server of the URL, ldap:// or ldaps://, and upgrades the connection
+// with StartTLS if requested. All operations on the connection have to finish within the
+// timeout.
+func dialLDAP(rawURL string, startTLS bool, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host, port := u.Hostname(), u.Port()
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host})
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s of LDAP URL", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if !startTLS {
+		return c, nil
+	}
+
+	if err := c.startTLS(host); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startTLS upgrades the connection to TLS by the extended operation of RFC 4511.
+func (c *ldapConn) startTLS(host string) error {
+	op, err := c.request(berConstructed(ldapExtendedRequest, berPrimitive(0x80, []byte(ldapStartTLSOID))), ldapExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := ldapResult(op); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// send sends the operation with the next message ID and returns it.
+func (c *ldapConn) send(op *berPacket) (int64, error) {
+	c.id++
+	msg := berConstructed(0x30, berInt(0x02, c.id), op)
+	_, err := c.conn.Write(msg.bytes())
+	return c.id, err
+}
+
+// receive returns the operation of the next message with the ID.
+func (c *ldapConn) receive(id int64) (*berPacket, error) {
+	for {
+		msg, err := readBER(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != 0x30 || len(msg.children) < 2 {
+			return nil, errors.New("malformed LDAP message")
+		}
+		if msg.children[0].int() == id {
+			return msg.children[1], nil
+		}
+	}
+}
+
+// request sends the operation and returns the response, which must have the tag.
+func (c *ldapConn) request(op *berPacket, tag byte) (*berPacket, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if resp.tag != tag {
+		return nil, fmt.Errorf("unexpected LDAP response 0x%x", resp.tag)
+	}
+	return resp, nil
+}
+
+// ldapResult returns the error of an LDAPResult, whose code isn't success.
+func ldapResult(op *berPacket) error {
+	switch code := op.child(0).int(); code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return errLDAPInvalidCredentials
+	default:
+		return fmt.Errorf("LDAP error %d: %s", code, op.child(2).value)
+	}
+}
+
+// bind authenticates the connection with the DN and the password.
+func (c *ldapConn) bind(dn, password string) error {
+	op, err := c.request(berConstructed(ldapBindRequest, berInt(0x02, 3), berString(dn), berPrimitive(0x80, []byte(password))), ldapBindResponse)
+	if err != nil {
+		return err
+	}
+	return ldapResult(op)
+}
+
+// search returns the entries below the base DN matching the filter with the attributes.
+func (c *ldapConn) search(baseDN, filter string, attributes ...string) ([]*ldapEntry, error) {
+	f, err := compileLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrs := berConstructed(0x30)
+	for _, a := range attributes {
+		attrs.children = append(attrs.children, berString(a))
+	}
+	id, err := c.send(berConstructed(ldapSearchRequest,
+		berString(baseDN),
+		berInt(0x0a, 2), // whole subtree
+		berInt(0x0a, 0), // never dereference aliases
+		berInt(0x02, 0),
+		berInt(0x02, 0),
+		berBool(false),
+		f,
+		attrs))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			e := &ldapEntry{dn: string(op.child(0).value), attributes: map[string][]string{}}
+			for _, attr := range op.child(1).children {
+				name := strings.ToLower(string(attr.child(0).value))
+				for _, v := range attr.child(1).children {
+					e.attributes[name] = append(e.attributes[name], string(v.value))
+				}
+			}
+			entries = append(entries, e)
+		case ldapSearchReference:
+			// referrals to other servers aren't followed
+		case ldapSearchDone:
+			return entries, ldapResult(op)
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response 0x%x", op.tag)
+		}
+	}
+}
+
+// close unbinds and closes the connection.
+func (c *ldapConn) close() {
+	c.send(berPrimitive(ldapUnbindRequest, nil))
+	c.conn.Close()
+}
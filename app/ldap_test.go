@@ -0,0 +1,201 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompileLDAPFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    string
+		wantErr bool
+	}{
+		{"(uid=alice)", "a30c04037569640405616c696365", false},
+		{"(cn=*)", "8702636e", false},
+		{"(cn=a\\2a*)", "a40a0402636e30048002612a", false},
+		{"(cn=*x*y)", "a40c0402636e3006810178820179", false},
+		{"(!(uid>=b))", "a20aa5080403756964040162", false},
+		{"(&(objectClass=person)(|(uid=a)(mail=a@*)))", "a031a315040b6f626a656374436c6173730406706572736f6ea118a3080403756964040161a40c04046d61696c300480026140", false},
+		{"uid=alice", "", true},
+		{"(uid=alice", "", true},
+		{"(=alice)", "", true},
+		{"(uid=a\\x)", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			p, err := compileLDAPFilter(tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileLDAPFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			want, _ := hex.DecodeString(tt.want)
+			if got := p.bytes(); !bytes.Equal(got, want) {
+				t.Errorf("compileLDAPFilter() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+// startLDAP serves a directory with the service account cn=dave, the user alice in the group
+// editors and the user bob without groups. It returns the URL and counts the binds.
+func startLDAP(t *testing.T) (string, *int64) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	passwords := map[string]string{
+		"cn=dave,dc=example,dc=com":             "secret",
+		"uid=alice,ou=people,dc=example,dc=com": "password",
+		"uid=bob,ou=people,dc=example,dc=com":   "password",
+		"uid=admin,ou=people,dc=example,dc=com": "directory",
+	}
+	var binds int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				reply := func(id int64, op *berPacket) {
+					conn.Write(berConstructed(0x30, berInt(0x02, id), op).bytes())
+				}
+				result := func(tag byte, code int64) *berPacket {
+					return berConstructed(tag, berInt(0x0a, code), berString(""), berString(""))
+				}
+				for {
+					msg, err := readBER(r)
+					if err != nil {
+						return
+					}
+					id, op := msg.child(0).int(), msg.child(1)
+					switch op.tag {
+					case ldapBindRequest:
+						atomic.AddInt64(&binds, 1)
+						code := int64(ldapInvalidCredentials)
+						if want, ok := passwords[string(op.child(1).value)]; ok && want == string(op.child(2).value) {
+							code = ldapSuccess
+						}
+						reply(id, result(ldapBindResponse, code))
+					case ldapSearchRequest:
+						filter := op.child(6)
+						attr, value := string(filter.child(0).value), string(filter.child(1).value)
+						switch {
+						case attr == "uid" && (value == "alice" || value == "bob" || value == "admin"):
+							reply(id, berConstructed(ldapSearchEntry, berString("uid="+value+",ou=people,dc=example,dc=com"), berConstructed(0x30)))
+						case attr == "member" && value == "uid=alice,ou=people,dc=example,dc=com":
+							reply(id, berConstructed(ldapSearchEntry, berString("cn=editors,ou=groups,dc=example,dc=com"), berConstructed(0x30,
+								berConstructed(0x30, berString("cn"), berConstructed(0x31, berString("editors"))))))
+						}
+						reply(id, result(ldapSearchDone, ldapSuccess))
+					case ldapUnbindRequest:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "ldap://" + l.Addr().String(), &binds
+}
+
+func TestLDAPAuthentication(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	url, binds := startLDAP(t)
+	subdir := "/editors"
+	cfg := &Config{
+		Dir:        tmpDir,
+		CreateDirs: true,
+		Groups:     map[string]*Permissions{"writers": {Template: TemplateReadOnly}},
+		Users:      map[string]*UserInfo{"admin": {Password: GenHash([]byte("admin"))}},
+		LDAP: &LDAP{
+			URL:          url,
+			BindDN:       "cn=dave,dc=example,dc=com",
+			BindPassword: "secret",
+			BaseDN:       "dc=example,dc=com",
+			Groups:       map[string]*LDAPGroup{"editors": {Group: "writers", Subdir: &subdir}},
+		},
+	}
+	if err := cfg.checkLDAP(); err != nil {
+		t.Fatalf("checkLDAP() error = %v", err)
+	}
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"admin", "admin", true},
+		{"admin", "directory", false},
+		{"alice", "password", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"bob", "password", true},
+		{"carol", "password", false},
+		{"*", "password", false},
+	}
+	for _, tt := range tests {
+		if info, err := authenticate(cfg, tt.user, tt.password); info.Authenticated != tt.want {
+			t.Errorf("authenticate(%s, %s) = %+v, %v, want %v", tt.user, tt.password, info, err, tt.want)
+		}
+	}
+
+	alice := cfg.User("alice")
+	if alice == nil || alice.Subdir == nil || *alice.Subdir != subdir || len(alice.Groups) != 1 || alice.Groups[0] != "writers" {
+		t.Fatalf("User(alice) = %+v, want the subdir and the group of editors", alice)
+	}
+	if fi, err := os.Stat(filepath.Join(tmpDir, "editors")); err != nil || !fi.IsDir() {
+		t.Errorf("subdir of alice wasn't created: %v", err)
+	}
+	if got := cfg.access("alice", "/"); got != (access{read: true, list: true}) {
+		t.Errorf("access() of alice = %+v, want read-only", got)
+	}
+	if bob := cfg.User("bob"); bob == nil || bob.Subdir == nil || *bob.Subdir != "/bob" {
+		t.Errorf("User(bob) = %+v, want the subdir named after the user", bob)
+	}
+	if fi, err := os.Stat(filepath.Join(tmpDir, "bob")); err != nil || !fi.IsDir() {
+		t.Errorf("subdir of bob wasn't created: %v", err)
+	}
+
+	n := atomic.LoadInt64(binds)
+	if info, _ := authenticate(cfg, "alice", "password"); !info.Authenticated || atomic.LoadInt64(binds) != n {
+		t.Errorf("cached login = %+v with %d binds, want no bind", info, atomic.LoadInt64(binds)-n)
+	}
+}
+
+func TestCheckLDAP(t *testing.T) {
+	tests := []struct {
+		name    string
+		ldap    *LDAP
+		wantErr bool
+	}{
+		{"disabled", nil, false},
+		{"invalid URL", &LDAP{URL: "http://ldap.example.com", BaseDN: "dc=example"}, true},
+		{"missing base DN", &LDAP{URL: "ldap://ldap.example.com"}, true},
+		{"invalid filter", &LDAP{URL: "ldap://ldap.example.com", BaseDN: "dc=example", UserFilter: "uid=%s"}, true},
+		{"unknown group", &LDAP{URL: "ldap://ldap.example.com", BaseDN: "dc=example", Groups: map[string]*LDAPGroup{"a": {Group: "x"}}}, true},
+		{"valid", &LDAP{URL: "ldaps://ldap.example.com", BaseDN: "dc=example", UserFilter: "(sAMAccountName=%s)"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&Config{LDAP: tt.ldap}).checkLDAP(); (err != nil) != tt.wantErr {
+				t.Errorf("checkLDAP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
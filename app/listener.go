@@ -0,0 +1,234 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Listener describes an address the server is listening on.
+type Listener struct {
+	Network string
+	Address string
+	Port    string
+	TLS     *TLS
+
+	// ProxyProtocol requires a PROXY protocol header on each connection, which carries the
+	// address of the client connected to a load balancer in TCP passthrough mode.
+	ProxyProtocol bool
+
+	// Tailscale listens on the tailnet with the embedded Tailscale node and authenticates
+	// users by their Tailscale identity.
+	Tailscale bool
+
+	// Interface restricts the listener to an address of the named network interface.
+	Interface string
+}
+
+// Addr returns the host and port of the listener.
+func (l *Listener) Addr() string {
+	return net.JoinHostPort(l.Address, l.Port)
+}
+
+// String describes the listener for messages.
+func (l *Listener) String() string {
+	if l.Interface != "" {
+		return l.Addr() + " on " + l.Interface
+	}
+	return l.Addr()
+}
+
+// Security returns a short description of the transport security for the log.
+func (l *Listener) Security() string {
+	if l.TLS != nil {
+		return "TLS"
+	}
+	return "none"
+}
+
+// Listen opens the TCP socket of the listener. The network defaults to tcp, which accepts
+// both address families for wildcard addresses, while tcp4 and tcp6 restrict it to one of them.
+func (l *Listener) Listen() (net.Listener, error) {
+	network, err := l.network()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := l.listenAddr(network)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(ln), nil
+}
+
+// wrap adds the PROXY protocol and the recording of the TLS ClientHello to the socket.
+func (l *Listener) wrap(ln net.Listener) net.Listener {
+	if l.ProxyProtocol {
+		ln = &proxyListener{ln}
+	}
+	if l.TLS != nil {
+		ln = &fingerprintListener{ln}
+	}
+	return ln
+}
+
+// ListenPacket opens the UDP socket of the listener for HTTP/3 with the same address family
+// as the TCP socket.
+func (l *Listener) ListenPacket() (net.PacketConn, error) {
+	network, err := l.network()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := l.listenAddr(network)
+	if err != nil {
+		return nil, err
+	}
+	return listenPacket("udp"+strings.TrimPrefix(network, "tcp"), addr)
+}
+
+// listenAddr returns the address to bind to. With an interface, the address has to belong to
+// it or is chosen from its addresses. IPv6 link-local addresses are scoped to the interface.
+func (l *Listener) listenAddr(network string) (string, error) {
+	if l.Interface == "" {
+		return l.Addr(), nil
+	}
+
+	iface, err := net.InterfaceByName(l.Interface)
+	if err != nil {
+		return "", fmt.Errorf("interface %s of listener not found: %s", l.Interface, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	host, err := interfaceAddr(addrs, network, l.Address, iface.Name)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, l.Port), nil
+}
+
+// interfaceAddr selects the address of an interface to bind to. If address is empty, the
+// first IPv4 address is preferred over global and link-local IPv6 addresses, as far as the
+// network permits them.
+func interfaceAddr(addrs []net.Addr, network, address, zone string) (string, error) {
+	var candidates []net.IP
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok {
+			candidates = append(candidates, ipNet.IP)
+		}
+	}
+
+	scoped := func(ip net.IP) string {
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			return ip.String() + "%" + zone
+		}
+		return ip.String()
+	}
+
+	if address != "" {
+		want := net.ParseIP(strings.SplitN(address, "%", 2)[0])
+		for _, ip := range candidates {
+			if ip.Equal(want) {
+				return scoped(ip), nil
+			}
+		}
+		return "", fmt.Errorf("address %s doesn't belong to interface %s", address, zone)
+	}
+
+	rank := func(ip net.IP) int {
+		switch {
+		case ip.To4() != nil:
+			if network == "tcp6" {
+				return 0
+			}
+			return 3
+		case network == "tcp4":
+			return 0
+		case ip.IsLinkLocalUnicast():
+			return 1
+		default:
+			return 2
+		}
+	}
+	var best net.IP
+	for _, ip := range candidates {
+		if rank(ip) > 0 && (best == nil || rank(ip) > rank(best)) {
+			best = ip
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("interface %s has no address for network %s", zone, network)
+	}
+	return scoped(best), nil
+}
+
+func (l *Listener) network() (string, error) {
+	switch l.Network {
+	case "":
+		return "tcp", nil
+	case "tcp", "tcp4", "tcp6":
+		return l.Network, nil
+	}
+	return "", fmt.Errorf("unsupported network %s of listener %s", l.Network, l.Addr())
+}
+
+// TLSConfig returns the TLS configuration of the listener, or nil if it serves plain HTTP.
+func (l *Listener) TLSConfig() (*tls.Config, error) {
+	if l.TLS == nil {
+		return nil, nil
+	}
+	return l.TLS.config()
+}
+
+// EffectiveListeners returns the configured listeners. If there are none, the server listens
+// on the single address, port and TLS settings of the top level.
+func (cfg *Config) EffectiveListeners() []*Listener {
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	return []*Listener{{Address: cfg.Address, Port: cfg.Port, TLS: cfg.TLS}}
+}
+
+// checkTLSFiles verifies that the key and certificate files of all listeners exist, or that
+// their certificates are obtained by ACME.
+func (cfg *Config) checkTLSFiles() error {
+	for _, l := range cfg.EffectiveListeners() {
+		if l.TLS == nil {
+			continue
+		}
+		if l.TLS.ACME != nil {
+			if err := l.TLS.ACME.check(l.TLS); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, kp := range l.TLS.KeyPairs() {
+			if _, err := os.Stat(kp.KeyFile); err != nil {
+				return fmt.Errorf("TLS keyFile doesn't exist: %s", err)
+			}
+			if _, err := os.Stat(kp.CertFile); err != nil {
+				return fmt.Errorf("TLS certFile doesn't exist: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// hasTLSListener returns whether at least one listener serves HTTPS.
+func (cfg *Config) hasTLSListener() bool {
+	for _, l := range cfg.EffectiveListeners() {
+		if l.TLS != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package app
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestEffectiveListeners(t *testing.T) {
+	tls := &TLS{CertFile: "cert.pem", KeyFile: "key.pem"}
+
+	tests := []struct {
+		name string
+		cfg  *Config
+		want []*Listener
+	}{
+		{
+			"top level",
+			&Config{Address: "127.0.0.1", Port: "8000", TLS: tls},
+			[]*Listener{{Address: "127.0.0.1", Port: "8000", TLS: tls}},
+		},
+		{
+			"listeners",
+			&Config{Address: "127.0.0.1", Port: "8000", Listeners: []*Listener{{Address: "::1"}, {Address: "10.0.0.5", Port: "8443", TLS: tls}}},
+			[]*Listener{{Address: "::1", Port: "8000"}, {Address: "10.0.0.5", Port: "8443", TLS: tls}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.setSectionDefaults()
+			if got := tt.cfg.EffectiveListeners(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EffectiveListeners() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenerListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		l       *Listener
+		wantErr bool
+	}{
+		{"default network", &Listener{Address: "127.0.0.1", Port: "0"}, false},
+		{"ipv4", &Listener{Network: "tcp4", Address: "127.0.0.1", Port: "0"}, false},
+		{"ipv4 only with ipv6 address", &Listener{Network: "tcp4", Address: "::1", Port: "0"}, true},
+		{"unsupported network", &Listener{Network: "unix", Address: "127.0.0.1", Port: "0"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := tt.l.Listen()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Listen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ln != nil {
+				ln.Close()
+			}
+		})
+	}
+}
+
+func TestInterfaceAddr(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: net.CIDRMask(24, 32)},
+	}
+	linkLocalOnly := addrs[:1]
+
+	tests := []struct {
+		name    string
+		addrs   []net.Addr
+		network string
+		address string
+		want    string
+		wantErr bool
+	}{
+		{"prefer ipv4", addrs, "tcp", "", "10.0.0.5", false},
+		{"ipv6 only", addrs, "tcp6", "", "2001:db8::1", false},
+		{"link-local with zone", linkLocalOnly, "tcp6", "", "fe80::1%eth1", false},
+		{"no ipv4", linkLocalOnly, "tcp4", "", "", true},
+		{"given address", addrs, "tcp", "2001:db8::1", "2001:db8::1", false},
+		{"given link-local address", addrs, "tcp", "fe80::1", "fe80::1%eth1", false},
+		{"foreign address", addrs, "tcp", "10.0.0.6", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := interfaceAddr(tt.addrs, tt.network, tt.address, "eth1")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("interfaceAddr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("interfaceAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenerListenInterface(t *testing.T) {
+	ifaces, _ := net.Interfaces()
+	var loopback string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+
+	ln, err := (&Listener{Network: "tcp4", Interface: loopback, Port: "0"}).Listen()
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("Listen() address = %v, want loopback", ip)
+	}
+
+	if _, err := (&Listener{Interface: "nonexistent0", Port: "0"}).Listen(); err == nil {
+		t.Errorf("Listen() error = %v, want error for unknown interface", err)
+	}
+}
@@ -0,0 +1,234 @@
+package app
+
+import (
+	"golang.org/x/net/webdav"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LockInfo describes an active WebDAV lock.
+type LockInfo struct {
+	Token     string    `json:"token"`
+	Root      string    `json:"root"`
+	Owner     string    `json:"owner,omitempty"`
+	ZeroDepth bool      `json:"zeroDepth"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitempty"`
+
+	// temporary is set for the locks the handler takes for a single write without a lock
+	// of the client, which aren't counted as acquisitions
+	temporary bool
+}
+
+// LockSystem wraps a webdav.LockSystem and keeps track of the active locks, so they can be
+// inspected at runtime. It counts the acquisitions, refreshes and conflicts of locks and the
+// time released locks have been held. Conflicts are reported with 423 Locked, both to LOCK
+// requests and to writes.
+type LockSystem struct {
+	webdav.LockSystem
+
+	mu    sync.Mutex
+	locks map[string]*LockInfo
+
+	acquired, refreshed, conflicts, released int64
+	// held is the total time the released locks have been held
+	held time.Duration
+}
+
+// NewLockSystem wraps the given lock system. The locks restored by a lock store are recorded
+// as created now.
+func NewLockSystem(ls webdav.LockSystem) *LockSystem {
+	l := &LockSystem{
+		LockSystem: ls,
+		locks:      map[string]*LockInfo{},
+	}
+	if store, ok := ls.(*fileLockSystem); ok {
+		for _, info := range store.activeLocks(time.Now()) {
+			info := info
+			l.locks[info.Token] = &info
+		}
+	}
+	return l
+}
+
+// Create delegates to the wrapped lock system and records the created lock.
+func (l *LockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	token, err := l.LockSystem.Create(now, details)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err == webdav.ErrLocked {
+		l.conflicts++
+	}
+	if err != nil {
+		return token, err
+	}
+
+	l.prune(now)
+	temporary := details.Duration < 0 && details.ZeroDepth && details.OwnerXML == ""
+	if !temporary {
+		l.acquired++
+	}
+	l.locks[token] = &LockInfo{
+		Token:     token,
+		Root:      details.Root,
+		Owner:     details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+		Created:   now,
+		Expires:   expiry(now, details.Duration),
+		temporary: temporary,
+	}
+	return token, nil
+}
+
+// Refresh delegates to the wrapped lock system and updates the expiry of the recorded lock.
+func (l *LockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	details, err := l.LockSystem.Refresh(now, token, duration)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info := l.locks[token]
+	if err == webdav.ErrNoSuchLock && info != nil {
+		l.release(token, info.Expires)
+	} else if err == nil && info != nil {
+		l.refreshed++
+		info.Expires = expiry(now, duration)
+	}
+
+	return details, err
+}
+
+// Unlock delegates to the wrapped lock system and forgets the recorded lock.
+func (l *LockSystem) Unlock(now time.Time, token string) error {
+	err := l.LockSystem.Unlock(now, token)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if info := l.locks[token]; info != nil {
+		switch {
+		case err == nil:
+			l.release(token, now)
+		case err == webdav.ErrNoSuchLock:
+			l.release(token, info.Expires)
+		}
+	}
+
+	return err
+}
+
+// release forgets the recorded lock, which has been held until the time. Infinite locks,
+// which are gone, count as held until now.
+func (l *LockSystem) release(token string, until time.Time) {
+	info := l.locks[token]
+	if until.IsZero() {
+		until = time.Now()
+	}
+	delete(l.locks, token)
+	if info.temporary {
+		return
+	}
+	l.released++
+	if until.After(info.Created) {
+		l.held += until.Sub(info.Created)
+	}
+}
+
+// prune forgets the recorded locks, which are expired at the time.
+func (l *LockSystem) prune(now time.Time) {
+	for token, info := range l.locks {
+		if !info.Expires.IsZero() && info.Expires.Before(now) {
+			l.release(token, info.Expires)
+		}
+	}
+}
+
+// Locks returns all locks which aren't expired yet, ordered by their root.
+func (l *LockSystem) Locks() []LockInfo {
+	now := time.Now()
+
+	l.mu.Lock()
+	l.prune(now)
+	locks := make([]LockInfo, 0, len(l.locks))
+	for _, info := range l.locks {
+		locks = append(locks, *info)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Root < locks[j].Root })
+	return locks
+}
+
+// flush releases the locks, which don't outlive the process, once the requests completed on
+// shutdown: the temporary locks of interrupted requests and, unless they're kept by the lock
+// store or the coordination store, the locks of the clients. The locks of the lock store are
+// written to its file. It returns the number of released locks of the clients.
+func (l *LockSystem) flush() int {
+	store, persisted := l.LockSystem.(*fileLockSystem)
+	_, shared := l.LockSystem.(*sharedLockSystem)
+
+	now := time.Now()
+	l.mu.Lock()
+	var tokens []string
+	released := 0
+	for token, info := range l.locks {
+		if info.temporary || !persisted && !shared {
+			tokens = append(tokens, token)
+		}
+		if !info.temporary && !persisted && !shared {
+			released++
+		}
+	}
+	l.mu.Unlock()
+
+	for _, token := range tokens {
+		l.Unlock(now, token)
+	}
+	if persisted {
+		store.flush(now)
+	}
+	return released
+}
+
+// expiry returns the point in time a lock with the given duration expires. A zero time
+// is returned for infinite locks.
+func expiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+
+	return now.Add(duration)
+}
+
+// RegisterMetrics registers the active locks, their acquisitions, refreshes and conflicts and
+// the time released locks have been held, whose average is the rate of the held seconds by the
+// rate of the releases.
+func (l *LockSystem) RegisterMetrics(m *Metrics) {
+	if l == nil {
+		return
+	}
+
+	counter := func(value *int64) func() []Sample {
+		return func() []Sample {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return []Sample{{Value: float64(*value)}}
+		}
+	}
+	m.Gauge("dave_locks_active", "WebDAV locks currently held.", func() []Sample {
+		active := 0
+		for _, info := range l.Locks() {
+			if !info.temporary {
+				active++
+			}
+		}
+		return []Sample{{Value: float64(active)}}
+	})
+	m.Counter("dave_lock_acquisitions_total", "WebDAV locks acquired.", counter(&l.acquired))
+	m.Counter("dave_lock_refreshes_total", "WebDAV locks refreshed.", counter(&l.refreshed))
+	m.Counter("dave_lock_conflicts_total", "Requests refused with 423 Locked by a lock of someone else.", counter(&l.conflicts))
+	m.Counter("dave_lock_releases_total", "WebDAV locks released by an unlock or their expiry.", counter(&l.released))
+	m.Counter("dave_lock_held_seconds_total", "Time the released WebDAV locks have been held.", func() []Sample {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return []Sample{{Value: l.held.Seconds()}}
+	})
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestLockSystem(t *testing.T) {
+	ls := NewLockSystem(webdav.NewMemLS())
+	now := time.Now()
+
+	infinite, err := ls.Create(now, webdav.LockDetails{Root: "/a", Duration: -1, OwnerXML: "<owner>foo</owner>"})
+	if err != nil {
+		t.Fatalf("LockSystem.Create() error = %v", err)
+	}
+	short, err := ls.Create(now, webdav.LockDetails{Root: "/b", Duration: time.Hour, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("LockSystem.Create() error = %v", err)
+	}
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/a/c", Duration: time.Hour}); err != webdav.ErrLocked {
+		t.Errorf("LockSystem.Create() error = %v, want %v", err, webdav.ErrLocked)
+	}
+
+	locks := ls.Locks()
+	if len(locks) != 2 || locks[0].Token != infinite || locks[1].Token != short {
+		t.Fatalf("LockSystem.Locks() = %+v, want locks for /a and /b", locks)
+	}
+	if !locks[0].Expires.IsZero() || locks[0].Owner != "<owner>foo</owner>" {
+		t.Errorf("LockSystem.Locks() infinite lock = %+v", locks[0])
+	}
+
+	if _, err := ls.Refresh(now, short, 2*time.Hour); err != nil {
+		t.Fatalf("LockSystem.Refresh() error = %v", err)
+	}
+	if got := ls.Locks()[1].Expires; !got.Equal(now.Add(2 * time.Hour)) {
+		t.Errorf("LockSystem.Refresh() expires = %v, want %v", got, now.Add(2*time.Hour))
+	}
+
+	if err := ls.Unlock(now, infinite); err != nil {
+		t.Fatalf("LockSystem.Unlock() error = %v", err)
+	}
+	if locks := ls.Locks(); len(locks) != 1 || locks[0].Token != short {
+		t.Errorf("LockSystem.Locks() after unlock = %+v", locks)
+	}
+}
+
+func TestLockSystemCounters(t *testing.T) {
+	ls := NewLockSystem(webdav.NewMemLS())
+	now := time.Now()
+
+	spreadsheet, err := ls.Create(now, webdav.LockDetails{Root: "/team.xlsx", Duration: time.Hour})
+	if err != nil {
+		t.Fatalf("LockSystem.Create() error = %v", err)
+	}
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/team.xlsx", Duration: time.Hour}); err != webdav.ErrLocked {
+		t.Errorf("LockSystem.Create() error = %v, want %v", err, webdav.ErrLocked)
+	}
+	// the temporary lock of a write without a lock of the client
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/team.xlsx", Duration: -1, ZeroDepth: true}); err != webdav.ErrLocked {
+		t.Errorf("LockSystem.Create() error = %v, want %v", err, webdav.ErrLocked)
+	}
+	if _, err := ls.Refresh(now, spreadsheet, time.Hour); err != nil {
+		t.Fatalf("LockSystem.Refresh() error = %v", err)
+	}
+	if err := ls.Unlock(now.Add(30*time.Minute), spreadsheet); err != nil {
+		t.Fatalf("LockSystem.Unlock() error = %v", err)
+	}
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/other", Duration: 10 * time.Minute}); err != nil {
+		t.Fatalf("LockSystem.Create() error = %v", err)
+	}
+	temporary, err := ls.Create(now, webdav.LockDetails{Root: "/free.txt", Duration: -1, ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("LockSystem.Create() error = %v", err)
+	}
+	ls.Unlock(now.Add(time.Minute), temporary)
+	// the expired lock is released, when the locks are listed
+	ls.prune(now.Add(time.Hour))
+
+	if ls.acquired != 2 || ls.refreshed != 1 || ls.conflicts != 2 || ls.released != 2 {
+		t.Errorf("acquired, refreshed, conflicts, released = %v, %v, %v, %v, want 2, 1, 2, 2", ls.acquired, ls.refreshed, ls.conflicts, ls.released)
+	}
+	if ls.held != 40*time.Minute {
+		t.Errorf("held = %v, want %v", ls.held, 40*time.Minute)
+	}
+}
@@ -0,0 +1,262 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// LockStore keeps the WebDAV locks in File, so the locks of the clients survive restarts of
+// the server. The locks are restored on startup, unless they expired in the meantime. The
+// short locks the handler takes for single writes are kept in memory only.
+type LockStore struct {
+	File string
+}
+
+// lockStoreState is the content of the lock file.
+type lockStoreState struct {
+	Locks map[string]*sharedLock `json:"locks"`
+}
+
+// fileLockSystem is a WebDAV lock system, whose locks are written to the lock file on every
+// change. Like the lock system of the webdav package, a lock confirmed for a request is held
+// by it, until the request releases it.
+type fileLockSystem struct {
+	path string
+
+	mu    sync.Mutex
+	locks map[string]*sharedLock
+	// temporary are the tokens of the locks, which aren't written to the file
+	temporary map[string]bool
+	held      map[string]bool
+}
+
+// NewLockStore restores the locks of the lock file of the configuration. It returns nil, if no
+// lock store is configured.
+func NewLockStore(cfg *Config) (webdav.LockSystem, error) {
+	if cfg.LockStore == nil {
+		return nil, nil
+	}
+	if cfg.LockStore.File == "" {
+		return nil, errors.New("lockStore requires the file to keep the locks in")
+	}
+	if cfg.Coordination != nil {
+		return nil, errors.New("lockStore can't be combined with coordination, which keeps the locks in its store")
+	}
+
+	ls := &fileLockSystem{
+		path:      cfg.LockStore.File,
+		locks:     map[string]*sharedLock{},
+		temporary: map[string]bool{},
+		held:      map[string]bool{},
+	}
+	data, err := ioutil.ReadFile(ls.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var state lockStoreState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("invalid lock file %s: %s", ls.path, err)
+		}
+		for token, l := range state.Locks {
+			if l != nil {
+				ls.locks[token] = l
+			}
+		}
+	}
+	if ls.prune(time.Now()) {
+		ls.save()
+	}
+	log.WithField("locks", len(ls.locks)).WithField("file", ls.path).Info("Restored WebDAV locks")
+	return ls, nil
+}
+
+// prune removes the expired locks and returns whether any lock of the file expired. ls.mu must
+// be held.
+func (ls *fileLockSystem) prune(now time.Time) bool {
+	changed := false
+	for token, l := range ls.locks {
+		if !l.Expires.IsZero() && !now.Before(l.Expires) {
+			delete(ls.locks, token)
+			changed = changed || !ls.temporary[token]
+			delete(ls.temporary, token)
+		}
+	}
+	return changed
+}
+
+// save writes the locks to the lock file. ls.mu must be held. A failure is only logged, the
+// locks stay in effect until the next restart.
+func (ls *fileLockSystem) save() {
+	state := lockStoreState{Locks: make(map[string]*sharedLock, len(ls.locks))}
+	for token, l := range ls.locks {
+		if !ls.temporary[token] {
+			state.Locks[token] = l
+		}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		tmp := ls.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, ls.path)
+		}
+	}
+	if err != nil {
+		log.WithField("file", ls.path).WithError(err).Error("Error writing the WebDAV locks")
+	}
+}
+
+// flush writes the locks, which aren't expired, to the lock file.
+func (ls *fileLockSystem) flush(now time.Time) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.prune(now)
+	ls.save()
+}
+
+// activeLocks returns the restored locks, which aren't expired yet.
+func (ls *fileLockSystem) activeLocks(now time.Time) []LockInfo {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var locks []LockInfo
+	for token, l := range ls.locks {
+		if !ls.temporary[token] && (l.Expires.IsZero() || now.Before(l.Expires)) {
+			locks = append(locks, LockInfo{Token: token, Root: l.Root, Owner: l.Owner, ZeroDepth: l.ZeroDepth, Created: now, Expires: l.Expires})
+		}
+	}
+	return locks
+}
+
+func (ls *fileLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.prune(now) {
+		ls.save()
+	}
+
+	var tokens []string
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+		token := ls.lookup(path.Clean("/"+name), conditions...)
+		if token == "" {
+			return nil, webdav.ErrConfirmationFailed
+		}
+		if len(tokens) == 0 || tokens[0] != token {
+			tokens = append(tokens, token)
+		}
+	}
+	for _, token := range tokens {
+		ls.held[token] = true
+	}
+	return func() {
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+		for _, token := range tokens {
+			delete(ls.held, token)
+		}
+	}, nil
+}
+
+// lookup returns the token of the conditions, whose lock covers the name and isn't held.
+// ls.mu must be held.
+func (ls *fileLockSystem) lookup(name string, conditions ...webdav.Condition) string {
+	for _, c := range conditions {
+		if l := ls.locks[c.Token]; l != nil && !ls.held[c.Token] && l.covers(name) {
+			return c.Token
+		}
+	}
+	return ""
+}
+
+func (ls *fileLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	details.Root = path.Clean("/" + details.Root)
+	token, err := newSharedLockToken()
+	if err != nil {
+		return "", err
+	}
+	lock := &sharedLock{
+		Root:      details.Root,
+		Owner:     details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+		Duration:  details.Duration,
+		Expires:   expiry(now, details.Duration),
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	changed := ls.prune(now)
+	for _, l := range ls.locks {
+		if l.Root == lock.Root || (!l.ZeroDepth && withinLockRoot(lock.Root, l.Root)) ||
+			(!lock.ZeroDepth && withinLockRoot(l.Root, lock.Root)) {
+			if changed {
+				ls.save()
+			}
+			return "", webdav.ErrLocked
+		}
+	}
+	ls.locks[token] = lock
+	if details.Duration < 0 && details.ZeroDepth && details.OwnerXML == "" {
+		ls.temporary[token] = true
+	} else {
+		changed = true
+	}
+	if changed {
+		ls.save()
+	}
+	return token, nil
+}
+
+func (ls *fileLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.held[token] {
+		return webdav.LockDetails{}, webdav.ErrLocked
+	}
+	changed := ls.prune(now)
+	l := ls.locks[token]
+	if l == nil {
+		if changed {
+			ls.save()
+		}
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	l.Duration, l.Expires = duration, expiry(now, duration)
+	if !ls.temporary[token] {
+		ls.save()
+	}
+	return l.details(), nil
+}
+
+func (ls *fileLockSystem) Unlock(now time.Time, token string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.held[token] {
+		return webdav.ErrLocked
+	}
+	changed := ls.prune(now)
+	if ls.locks[token] == nil {
+		if changed {
+			ls.save()
+		}
+		return webdav.ErrNoSuchLock
+	}
+	delete(ls.locks, token)
+	if !ls.temporary[token] {
+		changed = true
+	}
+	delete(ls.temporary, token)
+	if changed {
+		ls.save()
+	}
+	return nil
+}
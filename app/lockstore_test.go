@@ -0,0 +1,96 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestLockStore(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{LockStore: &LockStore{File: filepath.Join(tmpDir, "locks.json")}}
+	ls, err := NewLockStore(cfg)
+	if err != nil {
+		t.Fatalf("NewLockStore() error = %v", err)
+	}
+	now := time.Now()
+	token, err := ls.Create(now, webdav.LockDetails{Root: "/doc.docx", Duration: time.Hour, OwnerXML: "<D:href>alice</D:href>", ZeroDepth: true})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := ls.Create(now.Add(-time.Minute), webdav.LockDetails{Root: "/short.txt", Duration: time.Second, ZeroDepth: true}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := ls.Create(now, webdav.LockDetails{Root: "/upload.txt", Duration: -1, ZeroDepth: true}); err != nil {
+		t.Fatalf("Create() of a temporary lock error = %v", err)
+	}
+
+	// a restart restores the locks of the clients, which aren't expired yet
+	restored, err := NewLockStore(cfg)
+	if err != nil {
+		t.Fatalf("NewLockStore() error = %v", err)
+	}
+	now = time.Now()
+	if _, err := restored.Create(now, webdav.LockDetails{Root: "/doc.docx", Duration: time.Minute, ZeroDepth: true}); err != webdav.ErrLocked {
+		t.Errorf("Create() on a restored lock error = %v, want %v", err, webdav.ErrLocked)
+	}
+	for _, root := range []string{"/short.txt", "/upload.txt"} {
+		if _, err := restored.Create(now, webdav.LockDetails{Root: root, Duration: time.Minute, ZeroDepth: true}); err != nil {
+			t.Errorf("Create() on %s error = %v, want the expired and temporary locks to be gone", root, err)
+		}
+	}
+	release, err := restored.Confirm(now, "/doc.docx", "", webdav.Condition{Token: token})
+	if err != nil {
+		t.Fatalf("Confirm() with the restored token error = %v", err)
+	}
+	if err := restored.Unlock(now, token); err != webdav.ErrLocked {
+		t.Errorf("Unlock() of a held lock error = %v, want %v", err, webdav.ErrLocked)
+	}
+	release()
+	if locks := NewLockSystem(restored).Locks(); len(locks) != 3 || locks[0].Root != "/doc.docx" || locks[0].Owner != "<D:href>alice</D:href>" {
+		t.Errorf("Locks() = %+v, want the restored locks", locks)
+	}
+
+	// refreshes and unlocks are persisted as well
+	if _, err := restored.Refresh(now, token, time.Second); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	if err := restored.Unlock(now, token); err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	again, err := NewLockStore(cfg)
+	if err != nil {
+		t.Fatalf("NewLockStore() error = %v", err)
+	}
+	if _, err := again.Create(now, webdav.LockDetails{Root: "/doc.docx", Duration: time.Minute, ZeroDepth: true}); err != nil {
+		t.Errorf("Create() on an unlocked resource error = %v", err)
+	}
+}
+
+func TestNewLockStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Config
+		wantNil bool
+		wantErr bool
+	}{
+		{"disabled", &Config{}, true, false},
+		{"without file", &Config{LockStore: &LockStore{}}, true, true},
+		{"with coordination", &Config{LockStore: &LockStore{File: "locks.json"}, Coordination: &Coordination{}}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls, err := NewLockStore(tt.cfg)
+			if (err != nil) != tt.wantErr || (ls == nil) != tt.wantNil {
+				t.Errorf("NewLockStore() = %v, %v, want nil %v, error %v", ls, err, tt.wantNil, tt.wantErr)
+			}
+		})
+	}
+}
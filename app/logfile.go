@@ -0,0 +1,54 @@
+package app
+
+import (
+	"os"
+	"sync"
+)
+
+// LogFile is the file the log is written to. It can be reopened, after a log rotation moved
+// it away, so the log continues in a new file at the same path.
+type LogFile struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenLogFile opens the log file at path for appending, it's created if it doesn't exist.
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Write(p)
+}
+
+// Reopen closes the log file and opens the file at its path again. The current file is kept
+// on errors.
+func (l *LogFile) Reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	previous := l.file
+	l.file = file
+	l.mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// Close closes the log file.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLogFileReopen(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "dave.log")
+
+	l, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatalf("OpenLogFile() error = %v", err)
+	}
+	defer l.Close()
+	l.Write([]byte("first\n"))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("rotated\n"))
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+	l.Write([]byte("second\n"))
+
+	if data, _ := ioutil.ReadFile(path + ".1"); string(data) != "first\nrotated\n" {
+		t.Errorf("rotated log file = %q", data)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "second\n" {
+		t.Errorf("reopened log file = %q", data)
+	}
+}
+
+func TestLogStats(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	metrics := NewMetrics()
+	metrics.Gauge("dave_test_bytes", "Bytes of the test.", func() []Sample {
+		return []Sample{{Labels: map[string]string{"user": "alice"}, Value: 1024}}
+	})
+	a := &App{Tracker: NewTracker(), Metrics: metrics}
+	tr, _ := a.Tracker.Begin(httptest.NewRecorder(), httptest.NewRequest("PUT", "/big.iso", nil), "192.0.2.1", "alice")
+	defer a.Tracker.End(tr)
+
+	a.LogStats()
+	entries := hook.AllEntries()
+	if len(entries) != 3 {
+		t.Fatalf("LogStats() logged %d entries, want 3", len(entries))
+	}
+	if entries[0].Data["transfers"] != 1 {
+		t.Errorf("statistics = %v", entries[0].Data)
+	}
+	if entries[1].Message != "Active transfer" || entries[1].Data["path"] != "/big.iso" || entries[1].Data["user"] != "alice" {
+		t.Errorf("transfer = %s %v", entries[1].Message, entries[1].Data)
+	}
+	if entries[2].Data["metric"] != "dave_test_bytes" || entries[2].Data["value"] != 1024.0 || entries[2].Data["user"] != "alice" {
+		t.Errorf("metric = %v", entries[2].Data)
+	}
+}
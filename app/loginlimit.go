@@ -0,0 +1,225 @@
+package app
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the login limit
+const (
+	defaultLoginWindow     = 15 * time.Minute
+	defaultLoginLockout    = time.Minute
+	defaultLoginMaxLockout = time.Hour
+	maxLoginEntries        = 4096
+)
+
+// LoginLimit locks out the logins of a user after UserFailures failed logins and the logins
+// from a client address after AddressFailures failed logins within Window, 15m by default. A
+// limit of 0 doesn't limit the logins. The first lockout lasts Lockout, 1m by default, every
+// further one twice as long as the previous one up to MaxLockout, 1h by default.
+type LoginLimit struct {
+	UserFailures    int
+	AddressFailures int
+	Window          time.Duration
+	Lockout         time.Duration
+	MaxLockout      time.Duration
+}
+
+// loginFailures are the recent failed logins of a user or an address.
+type loginFailures struct {
+	failures []time.Time
+	lockouts int
+	until    time.Time
+}
+
+// LoginLimiter counts the failed logins and locks out the users and addresses exceeding the
+// limit. Locked out logins are rejected without checking the password. A nil LoginLimiter is
+// valid and limits nothing.
+type LoginLimiter struct {
+	settings LoginLimit
+
+	mu       sync.Mutex
+	entries  map[string]*loginFailures
+	lockouts int64
+}
+
+// NewLoginLimiter creates the limiter of the login limit of the configuration. It returns nil,
+// if no login limit is configured.
+func NewLoginLimiter(cfg *Config) (*LoginLimiter, error) {
+	if cfg.LoginLimit == nil {
+		return nil, nil
+	}
+	settings := *cfg.LoginLimit
+	if settings.UserFailures < 0 || settings.AddressFailures < 0 {
+		return nil, fmt.Errorf("the failures of the login limit must not be negative")
+	}
+	if settings.UserFailures == 0 && settings.AddressFailures == 0 {
+		return nil, fmt.Errorf("the login limit requires userFailures or addressFailures")
+	}
+	if settings.Window == 0 {
+		settings.Window = defaultLoginWindow
+	}
+	if settings.Lockout == 0 {
+		settings.Lockout = defaultLoginLockout
+	}
+	if settings.MaxLockout == 0 {
+		settings.MaxLockout = defaultLoginMaxLockout
+	}
+	if settings.MaxLockout < settings.Lockout {
+		settings.MaxLockout = settings.Lockout
+	}
+	return &LoginLimiter{settings: settings, entries: map[string]*loginFailures{}}, nil
+}
+
+// keys returns the keys of the user and the address, which are limited.
+func (l *LoginLimiter) keys(user, address string) []string {
+	var keys []string
+	if l.settings.UserFailures > 0 && user != "" {
+		keys = append(keys, "user/"+user)
+	}
+	if l.settings.AddressFailures > 0 && address != "" {
+		keys = append(keys, "address/"+address)
+	}
+	return keys
+}
+
+// locked returns how long the logins of the user from the address are still locked out.
+func (l *LoginLimiter) locked(user, address string, now time.Time) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range l.keys(user, address) {
+		if e := l.entries[key]; e != nil && now.Before(e.until) && e.until.Sub(now) > wait {
+			wait = e.until.Sub(now)
+		}
+	}
+	return wait, wait > 0
+}
+
+// failed counts a failed login of the user from the address and locks them out, once they
+// exceed their limit. The user is empty for failed bearer tokens.
+func (l *LoginLimiter) failed(user, address string, now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range l.keys(user, address) {
+		limit, isUser := l.settings.AddressFailures, key == "user/"+user
+		if isUser {
+			limit = l.settings.UserFailures
+		}
+		e := l.entries[key]
+		if e == nil {
+			if len(l.entries) >= maxLoginEntries {
+				l.pruneLocked(now)
+			}
+			if len(l.entries) >= maxLoginEntries {
+				// made up users and addresses can't exhaust the memory
+				l.evictLocked(now)
+			}
+			e = &loginFailures{}
+			l.entries[key] = e
+		}
+		e.failures = recentLoginFailures(e.failures, now.Add(-l.settings.Window))
+		if len(e.failures) == 0 && now.After(e.until.Add(l.settings.Window)) {
+			// the lockouts start over after a quiet window
+			e.lockouts = 0
+		}
+		e.failures = append(e.failures, now)
+		if len(e.failures) < limit {
+			continue
+		}
+
+		lockout := l.settings.Lockout
+		for i := 0; i < e.lockouts && lockout < l.settings.MaxLockout; i++ {
+			lockout *= 2
+		}
+		if lockout > l.settings.MaxLockout {
+			lockout = l.settings.MaxLockout
+		}
+		e.lockouts++
+		e.failures = nil
+		e.until = now.Add(lockout)
+		atomic.AddInt64(&l.lockouts, 1)
+		fields := log.Fields{"address": address, "failures": limit, "lockout": lockout.String()}
+		if isUser {
+			fields["user"] = user
+		}
+		log.WithFields(fields).Warn("Locked out logins after failed attempts")
+	}
+}
+
+// succeeded resets the failed logins of the user. The failures of the address are kept, so a
+// valid account doesn't allow guessing the passwords of others.
+func (l *LoginLimiter) succeeded(user string) {
+	if l == nil || l.settings.UserFailures == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, "user/"+user)
+}
+
+func recentLoginFailures(failures []time.Time, since time.Time) []time.Time {
+	for i, at := range failures {
+		if at.After(since) {
+			return failures[i:]
+		}
+	}
+	return nil
+}
+
+// pruneLocked removes the entries without recent failures and lockouts. l.mu must be held.
+func (l *LoginLimiter) pruneLocked(now time.Time) {
+	since := now.Add(-l.settings.Window)
+	for key, e := range l.entries {
+		if len(recentLoginFailures(e.failures, since)) == 0 && now.After(e.until.Add(l.settings.Window)) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// evictLocked removes the entry, which is the least useful to keep. Entries, which aren't
+// locked out, are removed before locked out ones, the ones with the oldest failures first,
+// locked out ones in the order their lockouts end. l.mu must be held.
+func (l *LoginLimiter) evictLocked(now time.Time) {
+	var oldest string
+	var oldestAt time.Time
+	oldestLocked := true
+	for key, e := range l.entries {
+		locked, at := now.Before(e.until), e.until
+		if !locked && len(e.failures) > 0 {
+			at = e.failures[len(e.failures)-1]
+		}
+		if oldest == "" || (oldestLocked && !locked) || (locked == oldestLocked && at.Before(oldestAt)) {
+			oldest, oldestAt, oldestLocked = key, at, locked
+		}
+	}
+	delete(l.entries, oldest)
+}
+
+// writeLockedOut answers a locked out login with the time the client has to wait.
+func writeLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+	http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+}
+
+// RegisterMetrics exposes the number of lockouts.
+func (l *LoginLimiter) RegisterMetrics(m *Metrics) {
+	if l == nil {
+		return
+	}
+
+	m.Counter("dave_login_lockouts_total", "Lockouts of users and addresses after failed logins.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&l.lockouts))}}
+	})
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginLimiter(t *testing.T) {
+	l, err := NewLoginLimiter(&Config{LoginLimit: &LoginLimit{
+		UserFailures:    3,
+		AddressFailures: 5,
+		Window:          10 * time.Minute,
+		Lockout:         time.Minute,
+		MaxLockout:      3 * time.Minute,
+	}})
+	if err != nil {
+		t.Fatalf("NewLoginLimiter() error = %v", err)
+	}
+	now := time.Now()
+	fail := func(user, address string, n int) {
+		for i := 0; i < n; i++ {
+			l.failed(user, address, now)
+		}
+	}
+	wantLocked := func(user, address string, want time.Duration) {
+		t.Helper()
+		wait, locked := l.locked(user, address, now)
+		if locked != (want > 0) || wait != want {
+			t.Errorf("locked(%s, %s) = %s, %v, want %s", user, address, wait, locked, want)
+		}
+	}
+
+	fail("alice", "192.0.2.1", 2)
+	wantLocked("alice", "192.0.2.1", 0)
+	fail("alice", "192.0.2.1", 1)
+	wantLocked("alice", "192.0.2.2", time.Minute)
+	wantLocked("bob", "192.0.2.1", 0)
+
+	// every further lockout lasts twice as long up to the maximum
+	now = now.Add(time.Minute)
+	wantLocked("alice", "192.0.2.2", 0)
+	fail("alice", "192.0.2.2", 3)
+	wantLocked("alice", "192.0.2.2", 2*time.Minute)
+	now = now.Add(2 * time.Minute)
+	fail("alice", "192.0.2.3", 3)
+	wantLocked("alice", "192.0.2.3", 3*time.Minute)
+
+	// a success resets the failures of the user, but not of the address
+	now = now.Add(3 * time.Minute)
+	fail("alice", "192.0.2.4", 2)
+	l.succeeded("alice")
+	fail("alice", "192.0.2.4", 2)
+	wantLocked("alice", "192.0.2.5", 0)
+	fail("carol", "192.0.2.4", 1)
+	wantLocked("dave", "192.0.2.4", time.Minute)
+
+	// failures outside of the window don't count and the lockouts start over
+	now = now.Add(time.Hour)
+	fail("alice", "192.0.2.6", 2)
+	now = now.Add(11 * time.Minute)
+	fail("alice", "192.0.2.6", 2)
+	wantLocked("alice", "192.0.2.6", 0)
+	fail("alice", "192.0.2.6", 1)
+	wantLocked("alice", "192.0.2.6", time.Minute)
+
+	var nilLimiter *LoginLimiter
+	nilLimiter.failed("alice", "192.0.2.1", now)
+	if _, locked := nilLimiter.locked("alice", "192.0.2.1", now); locked {
+		t.Error("nil limiter locked out a login")
+	}
+}
+
+func TestLoginLimiterFull(t *testing.T) {
+	l, err := NewLoginLimiter(&Config{LoginLimit: &LoginLimit{UserFailures: 2, AddressFailures: 2}})
+	if err != nil {
+		t.Fatalf("NewLoginLimiter() error = %v", err)
+	}
+	now := time.Now()
+	l.failed("alice", "192.0.2.1", now)
+	l.failed("alice", "192.0.2.1", now)
+
+	// made up users and addresses fill the map
+	for i := 0; i < 2*maxLoginEntries; i++ {
+		l.failed("user"+strconv.Itoa(i), "10."+strconv.Itoa(i/65536)+"."+strconv.Itoa(i/256%256)+"."+strconv.Itoa(i%256), now.Add(time.Second))
+	}
+	if len(l.entries) > maxLoginEntries {
+		t.Errorf("entries = %d, want at most %d", len(l.entries), maxLoginEntries)
+	}
+	if _, locked := l.locked("alice", "", now); !locked {
+		t.Error("lockout of a user has been evicted")
+	}
+	if _, locked := l.locked("", "192.0.2.1", now); !locked {
+		t.Error("lockout of an address has been evicted")
+	}
+
+	// new users are still limited
+	later := now.Add(2 * time.Second)
+	l.failed("bob", "192.0.2.9", later)
+	l.failed("bob", "192.0.2.10", later)
+	if _, locked := l.locked("bob", "", later); !locked {
+		t.Error("new user isn't locked out with a full map")
+	}
+}
+
+func TestLoginLimitHandler(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{
+		Dir:        tmpDir,
+		Users:      map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}},
+		LoginLimit: &LoginLimit{UserFailures: 2},
+	}
+	a := newQuotaApp(t, cfg)
+	limiter, err := NewLoginLimiter(cfg)
+	if err != nil {
+		t.Fatalf("NewLoginLimiter() error = %v", err)
+	}
+	a.LoginLimiter = limiter
+
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"wrong", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"password", http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.SetBasicAuth("alice", tt.password)
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		if w.Code != tt.want {
+			t.Fatalf("request %d = %d, want %d", i, w.Code, tt.want)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want 60", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestNewLoginLimiter(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   *LoginLimit
+		wantNil bool
+		wantErr bool
+	}{
+		{"disabled", nil, true, false},
+		{"without limits", &LoginLimit{}, true, true},
+		{"negative", &LoginLimit{UserFailures: -1}, true, true},
+		{"address only", &LoginLimit{AddressFailures: 20}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLoginLimiter(&Config{LoginLimit: tt.limit})
+			if (err != nil) != tt.wantErr || (l == nil) != tt.wantNil {
+				t.Errorf("NewLoginLimiter() = %v, %v, want nil %v, error %v", l, err, tt.wantNil, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Defaults of the maintenance mode
+const (
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+	defaultMaintenanceMessage    = "The server is down for maintenance, please retry later."
+)
+
+// Maintenance configures the defaults of the maintenance mode, which is switched on and off
+// via the admin API. While it's enabled, new requests of all frontends are answered with
+// 503 Service Unavailable and a Retry-After of RetryAfter, the message is sent as body.
+// Transfers in progress are finished. The admin API isn't affected. With Enabled, the
+// server starts in maintenance mode.
+type Maintenance struct {
+	Enabled    bool
+	RetryAfter time.Duration
+	Message    string
+}
+
+// maintenanceState is the state of the enabled maintenance mode.
+type maintenanceState struct {
+	RetryAfter time.Duration
+	Message    string
+	Since      time.Time
+}
+
+// SetMaintenance enables the maintenance mode with the retry after and the message, which
+// default to the ones of the configuration, or disables it.
+func (cfg *Config) SetMaintenance(enabled bool, retryAfter time.Duration, message string) {
+	var state *maintenanceState
+	if enabled {
+		if retryAfter <= 0 && cfg.Maintenance != nil {
+			retryAfter = cfg.Maintenance.RetryAfter
+		}
+		if retryAfter <= 0 {
+			retryAfter = defaultMaintenanceRetryAfter
+		}
+		if message == "" && cfg.Maintenance != nil {
+			message = cfg.Maintenance.Message
+		}
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+		state = &maintenanceState{RetryAfter: retryAfter, Message: message, Since: time.Now()}
+		log.WithField("retryAfter", retryAfter.String()).Warn("Enabled maintenance mode, new requests are rejected")
+	} else if cfg.maintenanceMode() != nil {
+		log.Warn("Disabled maintenance mode")
+	}
+
+	cfg.maintenanceMu.Lock()
+	cfg.maintenance = state
+	cfg.maintenanceMu.Unlock()
+}
+
+// maintenanceMode returns the state of the maintenance mode, or nil if it's disabled.
+func (cfg *Config) maintenanceMode() *maintenanceState {
+	cfg.maintenanceMu.RLock()
+	defer cfg.maintenanceMu.RUnlock()
+	return cfg.maintenance
+}
+
+// retryAfter returns the value of the Retry-After header in seconds.
+func (m *maintenanceState) retryAfter() string {
+	return strconv.Itoa(int(m.RetryAfter.Round(time.Second) / time.Second))
+}
+
+// writeUnavailable answers a request by 503 Service Unavailable.
+func (m *maintenanceState) writeUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", m.retryAfter())
+	http.Error(w, m.Message, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+
+	cfg := &Config{
+		Dir:         tmpDir,
+		Maintenance: &Maintenance{RetryAfter: 10 * time.Minute, Message: "Storage migration"},
+		Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}},
+	}
+	a := newQuotaApp(t, cfg)
+	a.Tracker = NewTracker()
+	admin := NewAdminHandler(a)
+	setMaintenance := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/v1/maintenance", strings.NewReader(body))
+		req.SetBasicAuth("root", "secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, httptest.NewRequest("GET", "/a.txt", nil), a)
+		return w
+	}
+
+	tests := []struct {
+		name           string
+		body           string
+		want           int
+		wantRetryAfter string
+		wantBody       string
+	}{
+		{"defaults of the configuration", `{"enabled":true}`, http.StatusServiceUnavailable, "600", "Storage migration"},
+		{"custom", `{"enabled":true,"retryAfter":"90s","message":"Back soon"}`, http.StatusServiceUnavailable, "90", "Back soon"},
+		{"disabled", `{"enabled":false}`, http.StatusOK, "", "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := setMaintenance(tt.body); w.Code != http.StatusOK {
+				t.Fatalf("switching maintenance mode status = %v, want %v", w.Code, http.StatusOK)
+			}
+			w := get()
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	for _, body := range []string{`{}`, `{"enabled":true,"retryAfter":"soon"}`} {
+		if w := setMaintenance(body); w.Code != http.StatusBadRequest {
+			t.Errorf("switching with %s status = %v, want %v", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if cfg.maintenanceMode() != nil {
+		t.Error("maintenance mode enabled by an invalid request")
+	}
+}
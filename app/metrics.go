@@ -0,0 +1,126 @@
+package app
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics is a registry of metrics, which are exposed in the text format of Prometheus. The
+// values are collected when the metrics are scraped. A nil Metrics is valid and collects
+// nothing.
+type Metrics struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	collect func() []Sample
+}
+
+// Sample is a value of a metric with its labels.
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// NewMetrics creates an empty registry.
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Gauge registers a metric, whose values can go up and down.
+func (m *Metrics) Gauge(name, help string, collect func() []Sample) {
+	m.register(name, help, "gauge", collect)
+}
+
+// Counter registers a metric, whose values only increase.
+func (m *Metrics) Counter(name, help string, collect func() []Sample) {
+	m.register(name, help, "counter", collect)
+}
+
+func (m *Metrics) register(name, help, kind string, collect func() []Sample) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.metrics = append(m.metrics, &metric{name: name, help: help, kind: kind, collect: collect})
+}
+
+// ServeHTTP writes all metrics in the text format of Prometheus.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	metrics := append([]*metric{}, m.metrics...)
+	m.mu.Unlock()
+
+	var b strings.Builder
+	for _, mt := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", mt.name, mt.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", mt.name, mt.kind)
+		for _, s := range mt.collect() {
+			b.WriteString(mt.name)
+			b.WriteString(formatLabels(s.Labels))
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	}
+	w.Write([]byte(b.String()))
+}
+
+// Log writes the samples of all metrics to the log, one entry per sample.
+func (m *Metrics) Log() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	metrics := append([]*metric{}, m.metrics...)
+	m.mu.Unlock()
+
+	for _, mt := range metrics {
+		for _, s := range mt.collect() {
+			fields := log.Fields{"metric": mt.name, "value": s.Value}
+			for name, value := range s.Labels {
+				fields[name] = value
+			}
+			log.WithFields(fields).Info("Metric")
+		}
+	}
+}
+
+// labelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats the labels sorted by their names, so the output is stable.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+`="`+labelEscaper.Replace(labels[name])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
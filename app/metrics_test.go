@@ -0,0 +1,39 @@
+package app
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.Gauge("dave_test_bytes", "Bytes of the test.", func() []Sample {
+		return []Sample{
+			{Labels: map[string]string{"scope": "/", "a": `"x"`}, Value: 1024},
+			{Value: 1.5},
+		}
+	})
+	m.Counter("dave_test_total", "Requests of the test.", func() []Sample { return nil })
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP dave_test_bytes Bytes of the test.
+# TYPE dave_test_bytes gauge
+dave_test_bytes{a="\"x\"",scope="/"} 1024
+dave_test_bytes 1.5
+# HELP dave_test_total Requests of the test.
+# TYPE dave_test_total counter
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("Metrics.ServeHTTP() = %q, want %q", got, want)
+	}
+
+	var nilMetrics *Metrics
+	nilMetrics.Gauge("dave_nil", "", nil)
+	w = httptest.NewRecorder()
+	nilMetrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Body.Len() != 0 {
+		t.Errorf("Metrics.ServeHTTP() of nil registry = %q, want empty", w.Body.String())
+	}
+}
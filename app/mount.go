@@ -0,0 +1,24 @@
+package app
+
+import (
+	"time"
+)
+
+// Default of the cache TTL of mounts
+const defaultMountCacheTTL = time.Second
+
+// MountOptions configure the mount of a remote share.
+type MountOptions struct {
+	// Root is the path of the remote directory, which is mounted.
+	Root string
+
+	// CacheDir holds the content of the files read or written. A file is only downloaded
+	// again, if its ETag changed.
+	CacheDir string
+
+	// CacheTTL is how long listings and attributes are cached before the server is asked
+	// again.
+	CacheTTL time.Duration
+
+	ReadOnly bool
+}
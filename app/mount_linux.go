@@ -0,0 +1,567 @@
+//go:build linux
+// +build linux
+
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Settings of mounts
+const mountRootID = 1
+
+// mountFS maps the operations of the kernel on inodes and file handles to requests of the
+// WebDAV client. Listings of directories are cached for the TTL and answer the lookups of
+// their members. Opened files are backed by a local copy in the cache directory, which is
+// uploaded when a modified file is flushed.
+type mountFS struct {
+	client *Client
+	opts   MountOptions
+	uid    uint32
+	gid    uint32
+
+	mu         sync.Mutex
+	nodes      map[uint64]*mountNode
+	ids        map[string]uint64
+	nextID     uint64
+	dirs       map[string]*mountDir
+	files      map[string]*mountFile
+	handles    map[uint64]*mountHandle
+	nextHandle uint64
+
+	// fetchMu serializes downloads into the cache
+	fetchMu sync.Mutex
+}
+
+type mountNode struct {
+	path    string
+	lookups uint64
+}
+
+type mountDir struct {
+	members map[string]*RemoteFile
+	fetched time.Time
+}
+
+// mountFile is the local copy of an opened file, which is shared by its handles.
+type mountFile struct {
+	path  string
+	local string
+	refs  int
+	dirty bool
+}
+
+type mountHandle struct {
+	file *mountFile
+	f    *os.File
+}
+
+// mountAttr are the attributes of a file reported to the kernel.
+type mountAttr struct {
+	ino     uint64
+	size    uint64
+	modTime time.Time
+	dir     bool
+}
+
+func newMountFS(client *Client, opts MountOptions) *mountFS {
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = defaultMountCacheTTL
+	}
+	return &mountFS{
+		client:  client,
+		opts:    opts,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		nodes:   map[uint64]*mountNode{mountRootID: {path: "/", lookups: 1}},
+		ids:     map[string]uint64{"/": mountRootID},
+		nextID:  mountRootID,
+		dirs:    map[string]*mountDir{},
+		files:   map[string]*mountFile{},
+		handles: map[uint64]*mountHandle{},
+	}
+}
+
+// remote returns the path on the server of a path within the mount.
+func (m *mountFS) remote(p string) string {
+	return path.Join("/", m.opts.Root, p)
+}
+
+// nodePath returns the path of an inode.
+func (m *mountFS) nodePath(id uint64) (string, syscall.Errno) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.nodes[id]
+	if n == nil {
+		return "", syscall.ESTALE
+	}
+	return n.path, 0
+}
+
+// lookupNode returns the inode of the path and counts the lookup of the kernel.
+func (m *mountFS) lookupNode(p string) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.ids[p]
+	if !ok {
+		m.nextID++
+		id = m.nextID
+		m.ids[p] = id
+		m.nodes[id] = &mountNode{path: p}
+	}
+	m.nodes[id].lookups++
+	return id
+}
+
+// forget releases lookups of the kernel, an inode without lookups is removed.
+func (m *mountFS) forget(id, lookups uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.nodes[id]
+	if n == nil || id == mountRootID {
+		return
+	}
+	if n.lookups <= lookups {
+		delete(m.nodes, id)
+		delete(m.ids, n.path)
+		return
+	}
+	n.lookups -= lookups
+}
+
+// listDir returns the members of a directory, which are cached for the TTL.
+func (m *mountFS) listDir(p string) (map[string]*RemoteFile, syscall.Errno) {
+	m.mu.Lock()
+	d := m.dirs[p]
+	m.mu.Unlock()
+	if d != nil && time.Since(d.fetched) < m.opts.CacheTTL {
+		return d.members, 0
+	}
+
+	files, err := m.client.ReadDir(m.remote(p))
+	if err != nil {
+		return nil, mountErrno(err)
+	}
+	d = &mountDir{members: map[string]*RemoteFile{}, fetched: time.Now()}
+	for _, f := range files {
+		d.members[path.Base(f.Path)] = f
+	}
+	m.mu.Lock()
+	m.dirs[p] = d
+	m.mu.Unlock()
+	return d.members, 0
+}
+
+// invalidate drops the cached listing of the directory of p.
+func (m *mountFS) invalidate(p string) {
+	m.mu.Lock()
+	delete(m.dirs, path.Dir(p))
+	m.mu.Unlock()
+}
+
+// stat returns the attributes of a path. Files opened for writing report their local size.
+func (m *mountFS) stat(p string) (*mountAttr, syscall.Errno) {
+	var f *RemoteFile
+	if p == "/" {
+		var err error
+		if f, err = m.client.Stat(m.remote(p)); err != nil {
+			return nil, mountErrno(err)
+		}
+	} else {
+		members, errno := m.listDir(path.Dir(p))
+		if errno != 0 {
+			return nil, errno
+		}
+		m.mu.Lock()
+		open := m.files[p]
+		m.mu.Unlock()
+		if f = members[path.Base(p)]; f == nil && open == nil {
+			return nil, syscall.ENOENT
+		}
+		if open != nil {
+			fi, err := os.Stat(open.local)
+			if err != nil {
+				return nil, syscall.EIO
+			}
+			f = &RemoteFile{Path: p, Size: fi.Size(), ModTime: fi.ModTime()}
+		}
+	}
+
+	return &mountAttr{size: uint64(f.Size), modTime: f.ModTime, dir: f.IsDir}, 0
+}
+
+// readDir returns the names and attributes of the members of a directory sorted by name.
+func (m *mountFS) readDir(p string) ([]string, []*mountAttr, syscall.Errno) {
+	members, errno := m.listDir(p)
+	if errno != 0 {
+		return nil, nil, errno
+	}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attrs := make([]*mountAttr, len(names))
+	for i, name := range names {
+		f := members[name]
+		attrs[i] = &mountAttr{size: uint64(f.Size), modTime: f.ModTime, dir: f.IsDir}
+	}
+	return names, attrs, 0
+}
+
+// cachePath returns the local copy of a remote path within the cache directory.
+func (m *mountFS) cachePath(p string) string {
+	sum := sha256.Sum256([]byte(m.remote(p)))
+	return filepath.Join(m.opts.CacheDir, hex.EncodeToString(sum[:]))
+}
+
+// fetch updates the local copy of the file, unless its ETag is unchanged. It returns whether
+// the cached content is still valid.
+func (m *mountFS) fetch(p, local string) (bool, syscall.Errno) {
+	m.fetchMu.Lock()
+	defer m.fetchMu.Unlock()
+
+	f, err := m.client.Stat(m.remote(p))
+	if err != nil {
+		return false, mountErrno(err)
+	}
+	if f.IsDir {
+		return false, syscall.EISDIR
+	}
+	if etag, err := ioutil.ReadFile(local + ".etag"); err == nil && f.ETag != "" && string(etag) == f.ETag {
+		if _, err := os.Stat(local); err == nil {
+			return true, 0
+		}
+	}
+
+	body, err := m.client.Open(m.remote(p))
+	if err != nil {
+		return false, mountErrno(err)
+	}
+	defer body.Close()
+	tmp, err := ioutil.TempFile(m.opts.CacheDir, ".download")
+	if err != nil {
+		return false, syscall.EIO
+	}
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), local)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.WithField("path", p).WithError(err).Warn("Error downloading file of mount")
+		return false, syscall.EIO
+	}
+	ioutil.WriteFile(local+".etag", []byte(f.ETag), 0600)
+	return false, 0
+}
+
+// open opens the local copy of a file, which is downloaded first unless it's truncated. It
+// returns whether the kernel can keep the cached pages of the file.
+func (m *mountFS) open(p string, flags uint32, create bool) (uint64, bool, syscall.Errno) {
+	write := flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	if write && m.opts.ReadOnly {
+		return 0, false, syscall.EROFS
+	}
+
+	m.mu.Lock()
+	file := m.files[p]
+	if file == nil {
+		file = &mountFile{path: p, local: m.cachePath(p)}
+	}
+	file.refs++
+	m.files[p] = file
+	m.mu.Unlock()
+
+	var keep bool
+	var errno syscall.Errno
+	switch {
+	case create || flags&syscall.O_TRUNC != 0:
+		os.Remove(file.local + ".etag")
+		if err := ioutil.WriteFile(file.local, nil, 0600); err != nil {
+			errno = syscall.EIO
+		}
+		m.mu.Lock()
+		file.dirty = true
+		m.mu.Unlock()
+	case file.refs == 1:
+		keep, errno = m.fetch(p, file.local)
+	}
+
+	var f *os.File
+	if errno == 0 {
+		var err error
+		if f, err = os.OpenFile(file.local, os.O_RDWR, 0600); err != nil {
+			errno = syscall.EIO
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if errno != 0 {
+		m.releaseFileLocked(file)
+		return 0, false, errno
+	}
+	m.nextHandle++
+	m.handles[m.nextHandle] = &mountHandle{file: file, f: f}
+	return m.nextHandle, keep, 0
+}
+
+func (m *mountFS) handle(fh uint64) (*mountHandle, syscall.Errno) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.handles[fh]
+	if h == nil {
+		return nil, syscall.EBADF
+	}
+	return h, 0
+}
+
+func (m *mountFS) read(fh uint64, offset int64, size int) ([]byte, syscall.Errno) {
+	h, errno := m.handle(fh)
+	if errno != 0 {
+		return nil, errno
+	}
+	data := make([]byte, size)
+	n, err := h.f.ReadAt(data, offset)
+	if err != nil && err != io.EOF {
+		return nil, syscall.EIO
+	}
+	return data[:n], 0
+}
+
+func (m *mountFS) write(fh uint64, offset int64, data []byte) (int, syscall.Errno) {
+	if m.opts.ReadOnly {
+		return 0, syscall.EROFS
+	}
+	h, errno := m.handle(fh)
+	if errno != 0 {
+		return 0, errno
+	}
+	n, err := h.f.WriteAt(data, offset)
+	m.mu.Lock()
+	h.file.dirty = true
+	m.mu.Unlock()
+	if err != nil {
+		return n, syscall.EIO
+	}
+	return n, 0
+}
+
+// truncate changes the size of an open file or of a file, which is opened for the purpose.
+func (m *mountFS) truncate(p string, fh uint64, size int64) syscall.Errno {
+	if m.opts.ReadOnly {
+		return syscall.EROFS
+	}
+	if fh == 0 {
+		fh, _, errno := m.open(p, syscall.O_RDWR, false)
+		if errno != 0 {
+			return errno
+		}
+		defer m.release(fh)
+		if errno := m.truncateHandle(fh, size); errno != 0 {
+			return errno
+		}
+		return m.flush(fh)
+	}
+	return m.truncateHandle(fh, size)
+}
+
+func (m *mountFS) truncateHandle(fh uint64, size int64) syscall.Errno {
+	h, errno := m.handle(fh)
+	if errno != 0 {
+		return errno
+	}
+	if err := h.f.Truncate(size); err != nil {
+		return syscall.EIO
+	}
+	m.mu.Lock()
+	h.file.dirty = true
+	m.mu.Unlock()
+	return 0
+}
+
+// flush uploads a modified file.
+func (m *mountFS) flush(fh uint64) syscall.Errno {
+	h, errno := m.handle(fh)
+	if errno != 0 {
+		return errno
+	}
+	m.mu.Lock()
+	dirty, p := h.file.dirty, h.file.path
+	h.file.dirty = false
+	m.mu.Unlock()
+	if !dirty {
+		return 0
+	}
+
+	f, err := os.Open(h.file.local)
+	if err != nil {
+		return syscall.EIO
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return syscall.EIO
+	}
+	err = m.client.Upload(m.remote(p), f, fi.Size())
+	m.invalidate(p)
+	if err != nil {
+		m.mu.Lock()
+		h.file.dirty = true
+		m.mu.Unlock()
+		log.WithField("path", p).WithError(err).Warn("Error uploading file of mount")
+		return mountErrno(err)
+	}
+	if remote, err := m.client.Stat(m.remote(p)); err == nil {
+		ioutil.WriteFile(h.file.local+".etag", []byte(remote.ETag), 0600)
+	}
+	return 0
+}
+
+func (m *mountFS) release(fh uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.handles[fh]
+	if h == nil {
+		return
+	}
+	delete(m.handles, fh)
+	h.f.Close()
+	m.releaseFileLocked(h.file)
+}
+
+func (m *mountFS) releaseFileLocked(file *mountFile) {
+	if file.refs--; file.refs <= 0 && m.files[file.path] == file {
+		delete(m.files, file.path)
+	}
+}
+
+func (m *mountFS) mkdir(p string) syscall.Errno {
+	if m.opts.ReadOnly {
+		return syscall.EROFS
+	}
+	err := m.client.Mkdir(m.remote(p))
+	m.invalidate(p)
+	return mountErrno(err)
+}
+
+func (m *mountFS) remove(p string, dir bool) syscall.Errno {
+	if m.opts.ReadOnly {
+		return syscall.EROFS
+	}
+	attr, errno := m.stat(p)
+	switch {
+	case errno != 0:
+		return errno
+	case dir && !attr.dir:
+		return syscall.ENOTDIR
+	case !dir && attr.dir:
+		return syscall.EISDIR
+	}
+	if dir {
+		if members, errno := m.listDir(p); errno != 0 {
+			return errno
+		} else if len(members) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	err := m.client.Remove(m.remote(p))
+	m.invalidate(p)
+	if err == nil {
+		m.mu.Lock()
+		delete(m.dirs, p)
+		m.mu.Unlock()
+		os.Remove(m.cachePath(p))
+		os.Remove(m.cachePath(p) + ".etag")
+	}
+	return mountErrno(err)
+}
+
+// rename moves the path on the server and updates the inodes and open files below it.
+func (m *mountFS) rename(oldPath, newPath string) syscall.Errno {
+	if m.opts.ReadOnly {
+		return syscall.EROFS
+	}
+	err := m.client.Move(m.remote(oldPath), m.remote(newPath))
+	m.invalidate(oldPath)
+	m.invalidate(newPath)
+	if err != nil {
+		return mountErrno(err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	moved := func(p string) (string, bool) {
+		if p == oldPath {
+			return newPath, true
+		}
+		if len(p) > len(oldPath) && p[:len(oldPath)] == oldPath && p[len(oldPath)] == '/' {
+			return newPath + p[len(oldPath):], true
+		}
+		return "", false
+	}
+	for id, n := range m.nodes {
+		if p, ok := moved(n.path); ok {
+			delete(m.ids, n.path)
+			n.path = p
+			m.ids[p] = id
+		}
+	}
+	for old, file := range m.files {
+		if p, ok := moved(old); ok {
+			delete(m.files, old)
+			file.path = p
+			m.files[p] = file
+		}
+	}
+	for old := range m.dirs {
+		if _, ok := moved(old); ok {
+			delete(m.dirs, old)
+		}
+	}
+	return 0
+}
+
+// mountErrno maps errors of the client to the errors of the file system.
+func mountErrno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+	re, ok := err.(*RemoteError)
+	if !ok {
+		log.WithError(err).Warn("Error of mount")
+		return syscall.EIO
+	}
+	switch re.StatusCode {
+	case http.StatusNotFound, http.StatusConflict:
+		return syscall.ENOENT
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return syscall.EACCES
+	case http.StatusMethodNotAllowed:
+		return syscall.EEXIST
+	case http.StatusInsufficientStorage, http.StatusRequestEntityTooLarge:
+		return syscall.ENOSPC
+	}
+	log.WithError(err).Warn("Error of mount")
+	return syscall.EIO
+}
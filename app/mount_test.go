@@ -0,0 +1,172 @@
+//go:build linux
+// +build linux
+
+package app
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func newTestMountFS(t *testing.T) (*mountFS, string) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "share"), 0700)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	server := httptest.NewServer(&webdav.Handler{
+		FileSystem: webdav.Dir(filepath.Join(tmpDir, "data")),
+		LockSystem: webdav.NewMemLS(),
+	})
+	t.Cleanup(server.Close)
+	client, err := NewClient(server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listings aren't cached, so changes on the server are visible immediately
+	fs := newMountFS(client, MountOptions{Root: "/share", CacheDir: filepath.Join(tmpDir, "cache"), CacheTTL: time.Nanosecond})
+	os.MkdirAll(fs.opts.CacheDir, 0700)
+	return fs, filepath.Join(tmpDir, "data", "share")
+}
+
+func TestMountReadWrite(t *testing.T) {
+	fs, dir := newTestMountFS(t)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0600)
+
+	attr, errno := fs.stat("/a.txt")
+	if errno != 0 || attr.size != 5 || attr.dir {
+		t.Fatalf("stat() = %+v, %v, want a file of 5 bytes", attr, errno)
+	}
+	if _, errno := fs.stat("/missing"); errno != syscall.ENOENT {
+		t.Errorf("stat() of missing file error = %v, want ENOENT", errno)
+	}
+
+	fh, keep, errno := fs.open("/a.txt", syscall.O_RDONLY, false)
+	if errno != 0 || keep {
+		t.Fatalf("open() = %v, %v, want a downloaded file", keep, errno)
+	}
+	if data, _ := fs.read(fh, 1, 10); string(data) != "ello" {
+		t.Errorf("read() = %q, want ello", data)
+	}
+	fs.flush(fh)
+	fs.release(fh)
+
+	// unchanged files are read from the cache
+	fh, keep, _ = fs.open("/a.txt", syscall.O_RDWR, false)
+	if !keep {
+		t.Errorf("open() of cached file keep = false, want true")
+	}
+	fs.write(fh, 5, []byte(" world"))
+	if attr, _ := fs.stat("/a.txt"); attr.size != 11 {
+		t.Errorf("stat() of written file size = %d, want the local size 11", attr.size)
+	}
+	if errno := fs.flush(fh); errno != 0 {
+		t.Errorf("flush() error = %v", errno)
+	}
+	fs.release(fh)
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "hello world" {
+		t.Errorf("uploaded file = %q, want hello world", data)
+	}
+
+	fh, _, errno = fs.open("/new.txt", syscall.O_WRONLY, true)
+	if errno != 0 {
+		t.Fatalf("open() of created file error = %v", errno)
+	}
+	if _, errno := fs.stat("/new.txt"); errno != 0 {
+		t.Errorf("stat() of created file error = %v, want it to exist before the upload", errno)
+	}
+	fs.flush(fh)
+	fs.release(fh)
+	if _, err := os.Stat(filepath.Join(dir, "new.txt")); err != nil {
+		t.Errorf("created empty file error = %v", err)
+	}
+
+	if errno := fs.truncate("/a.txt", 0, 4); errno != 0 {
+		t.Errorf("truncate() error = %v", errno)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "hell" {
+		t.Errorf("truncated file = %q, want hell", data)
+	}
+}
+
+func TestMountDirectories(t *testing.T) {
+	fs, dir := newTestMountFS(t)
+
+	if errno := fs.mkdir("/docs"); errno != 0 {
+		t.Fatalf("mkdir() error = %v", errno)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "docs", "b.txt"), []byte("b"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0600)
+
+	names, attrs, errno := fs.readDir("/")
+	if errno != 0 || len(names) != 2 || names[0] != "a.txt" || names[1] != "docs" || !attrs[1].dir {
+		t.Errorf("readDir() = %v, %v, want a.txt and the directory docs", names, errno)
+	}
+
+	id := fs.lookupNode("/docs/b.txt")
+	if errno := fs.rename("/docs", "/papers"); errno != 0 {
+		t.Fatalf("rename() error = %v", errno)
+	}
+	if p, _ := fs.nodePath(id); p != "/papers/b.txt" {
+		t.Errorf("path of node below renamed directory = %v, want /papers/b.txt", p)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "papers", "b.txt")); err != nil {
+		t.Errorf("renamed directory error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		dir  bool
+		want syscall.Errno
+	}{
+		{"rmdir non-empty directory", "/papers", true, syscall.ENOTEMPTY},
+		{"rmdir file", "/a.txt", true, syscall.ENOTDIR},
+		{"unlink directory", "/papers", false, syscall.EISDIR},
+		{"unlink missing file", "/missing", false, syscall.ENOENT},
+		{"unlink file", "/papers/b.txt", false, 0},
+		{"rmdir empty directory", "/papers", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if errno := fs.remove(tt.path, tt.dir); errno != tt.want {
+				t.Errorf("remove() error = %v, want %v", errno, tt.want)
+			}
+		})
+	}
+
+	fs.forget(id, 1)
+	if _, errno := fs.nodePath(id); errno != syscall.ESTALE {
+		t.Errorf("nodePath() of forgotten node error = %v, want ESTALE", errno)
+	}
+}
+
+func TestMountReadOnly(t *testing.T) {
+	fs, _ := newTestMountFS(t)
+	fs.opts.ReadOnly = true
+
+	if _, _, errno := fs.open("/a.txt", syscall.O_WRONLY, true); errno != syscall.EROFS {
+		t.Errorf("open() for writing error = %v, want EROFS", errno)
+	}
+	if errno := fs.mkdir("/docs"); errno != syscall.EROFS {
+		t.Errorf("mkdir() error = %v, want EROFS", errno)
+	}
+}
+
+func TestFuseDirent(t *testing.T) {
+	entry := fuseDirent(3, 4, "abc", false)
+	if len(entry)%8 != 0 || len(entry) != 32 {
+		t.Errorf("fuseDirent() length = %d, want 32", len(entry))
+	}
+	if string(entry[24:27]) != "abc" || entry[20] != syscall.DT_REG {
+		t.Errorf("fuseDirent() = %v, want the name and type of a regular file", entry)
+	}
+}
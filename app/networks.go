@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Networks restricts the addresses clients connect from. Requests from addresses outside of
+// Allowed, if it's set, or within Denied are refused with 403 Forbidden. Users can be
+// restricted further by networks of their own. The entries are CIDR ranges or single
+// addresses. Behind one of the TrustedProxies, the client is the last address of the
+// X-Forwarded-For header, which isn't a trusted proxy itself, or the X-Real-IP header.
+// These headers are ignored for other connections, so clients can't claim another address.
+type Networks struct {
+	Allowed        []string
+	Denied         []string
+	TrustedProxies []string
+}
+
+// parseNetwork parses a CIDR range or a single address, which is a range of its own.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// networksContain returns whether the address is within one of the networks. Invalid
+// networks are rejected when the configuration is read and skipped here.
+func networksContain(networks []string, ip net.IP) bool {
+	for _, s := range networks {
+		if network, err := parseNetwork(s); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// networksAllow returns whether the address is within the allowed networks, if there are
+// any, and not within the denied ones. Unknown addresses are only allowed without allowed
+// networks.
+func networksAllow(allowed, denied []string, ip net.IP) bool {
+	if ip == nil {
+		return len(allowed) == 0
+	}
+	return (len(allowed) == 0 || networksContain(allowed, ip)) && !networksContain(denied, ip)
+}
+
+// checkNetworks checks the networks of the configuration and of the users.
+func (cfg *Config) checkNetworks() error {
+	check := func(networks []string, owner string) error {
+		for _, s := range networks {
+			if _, err := parseNetwork(s); err != nil {
+				return fmt.Errorf("invalid network %q %s", s, owner)
+			}
+		}
+		return nil
+	}
+	if n := cfg.Networks; n != nil {
+		for _, networks := range [][]string{n.Allowed, n.Denied, n.TrustedProxies} {
+			if err := check(networks, "in the networks"); err != nil {
+				return err
+			}
+		}
+	}
+	for name, user := range cfg.Users {
+		if user == nil {
+			continue
+		}
+		for _, networks := range [][]string{user.AllowedNetworks, user.DeniedNetworks} {
+			if err := check(networks, "of user "+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clientAddress returns the address of the client, which sent the request. The forwarding
+// headers are only taken into account, if the request has been sent by a trusted proxy.
+// It returns nil, if the address can't be determined.
+func (n *Networks) clientAddress(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || n == nil || !networksContain(n.TrustedProxies, ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(hop))
+		}
+	}
+	if len(forwarded) == 0 && req.Header.Get("X-Real-IP") != "" {
+		forwarded = []string{strings.TrimSpace(req.Header.Get("X-Real-IP"))}
+	}
+	// every proxy appends the address it received the request from, so the addresses are
+	// walked back until one wasn't added by a trusted proxy
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		if ip = net.ParseIP(forwarded[i]); ip == nil || !networksContain(n.TrustedProxies, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// clientIP returns the address of the client, which sent the request, as clientAddress
+// determines it. If it can't be determined, the remote address of the connection is returned.
+func (cfg *Config) clientIP(req *http.Request) string {
+	if ip := cfg.networks().clientAddress(req); ip != nil {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// allowsAddress returns whether the client address is allowed by the networks of the
+// configuration and, with a user, by the ones of the user. The frontends check it before they
+// authenticate a user.
+func (cfg *Config) allowsAddress(ip net.IP, username string) bool {
+	if n := cfg.networks(); n != nil && !networksAllow(n.Allowed, n.Denied, ip) {
+		return false
+	}
+	if username == "" {
+		return true
+	}
+	user := cfg.User(username)
+	return user == nil || networksAllow(user.AllowedNetworks, user.DeniedNetworks, ip)
+}
+
+// refuseAddress logs a login refused, because the client address is outside of the allowed
+// networks.
+func refuseAddress(protocol, username string, ip net.IP) {
+	log.WithFields(log.Fields{"user": username, "address": ip.String()}).Warn("Refused login via " + protocol + " from outside the allowed networks")
+}
+
+// checkNetworks answers requests from addresses outside of the allowed networks with 403
+// Forbidden and returns whether the request may proceed. Without a user, the networks of the
+// configuration are checked, otherwise also the ones of the user.
+func (a *App) checkNetworks(ctx context.Context, w http.ResponseWriter, req *http.Request, username string) bool {
+	ip := a.Config.networks().clientAddress(req)
+	if a.Config.allowsAddress(ip, username) {
+		return true
+	}
+	if username == "" {
+		traceStep(ctx, "address %s is outside of the allowed networks", ip)
+	} else {
+		traceStep(ctx, "address %s is outside of the allowed networks of user %s", ip, username)
+	}
+	log.WithFields(fingerprintFields(ctx, log.Fields{"user": username, "address": ip.String()})).Warn("Refused request from outside the allowed networks")
+	http.Error(w, "403 Forbidden", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClientAddress(t *testing.T) {
+	networks := &Networks{TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"}}
+	tests := []struct {
+		name       string
+		networks   *Networks
+		remoteAddr string
+		header     map[string]string
+		want       string
+	}{
+		{"direct", networks, "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"forwarded by an untrusted client", networks, "203.0.113.5:1234", map[string]string{"X-Forwarded-For": "10.1.1.1"}, "203.0.113.5"},
+		{"forwarded by a trusted proxy", networks, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"spoofed before a trusted proxy", networks, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.1.1.1, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", networks, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7, 192.168.1.1"}, "203.0.113.7"},
+		{"real ip of a trusted proxy", networks, "10.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.8"}, "203.0.113.8"},
+		{"trusted proxy without headers", networks, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"invalid forwarded address", networks, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "unknown"}, "<nil>"},
+		{"without networks", nil, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "10.0.0.1"},
+		{"ipv6", networks, "[2001:db8::1]:1234", nil, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			if got := tt.networks.clientAddress(req).String(); got != tt.want {
+				t.Errorf("clientAddress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		networks   *Networks
+		remoteAddr string
+		want       string
+	}{
+		{"spoofed without trusted proxies", nil, "203.0.113.5:1234", "203.0.113.5"},
+		{"spoofed by an untrusted client", &Networks{TrustedProxies: []string{"10.0.0.1"}}, "203.0.113.5:1234", "203.0.113.5"},
+		{"forwarded by a trusted proxy", &Networks{TrustedProxies: []string{"10.0.0.1"}}, "10.0.0.1:1234", "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+			cfg := &Config{Networks: tt.networks}
+			if got := cfg.clientIP(req); got != tt.want {
+				t.Errorf("clientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowsAddress(t *testing.T) {
+	cfg := &Config{
+		Networks: &Networks{Allowed: []string{"10.0.0.0/8"}},
+		Users: map[string]*UserInfo{
+			"alice": {AllowedNetworks: []string{"10.0.1.0/24"}},
+			"bob":   {DeniedNetworks: []string{"10.0.2.7"}},
+		},
+	}
+	tests := []struct {
+		address string
+		user    string
+		want    bool
+	}{
+		{"10.0.2.5", "", true},
+		{"203.0.113.5", "", false},
+		{"10.0.1.5", "alice", true},
+		{"10.0.2.5", "alice", false},
+		{"10.0.2.7", "bob", false},
+		{"203.0.113.5", "bob", false},
+		{"10.0.2.5", "carol", true},
+	}
+	for _, tt := range tests {
+		if got := cfg.allowsAddress(net.ParseIP(tt.address), tt.user); got != tt.want {
+			t.Errorf("allowsAddress(%s, %q) = %v, want %v", tt.address, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestCheckNetworks(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{
+		Dir: tmpDir,
+		Networks: &Networks{
+			Allowed:        []string{"10.0.0.0/8", "2001:db8::/32"},
+			Denied:         []string{"10.0.13.0/24"},
+			TrustedProxies: []string{"127.0.0.1"},
+		},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), AllowedNetworks: []string{"10.0.1.0/24"}},
+			"bob":   {Password: GenHash([]byte("password")), DeniedNetworks: []string{"10.0.2.7"}},
+		},
+	}
+	if err := cfg.checkNetworks(); err != nil {
+		t.Fatalf("checkNetworks() error = %v", err)
+	}
+	a := newQuotaApp(t, cfg)
+
+	tests := []struct {
+		user       string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"alice", "10.0.1.5:1234", "", http.StatusMultiStatus},
+		{"alice", "10.0.2.5:1234", "", http.StatusForbidden},
+		{"bob", "10.0.2.5:1234", "", http.StatusMultiStatus},
+		{"bob", "10.0.2.7:1234", "", http.StatusForbidden},
+		{"bob", "10.0.13.1:1234", "", http.StatusForbidden},
+		{"bob", "203.0.113.5:1234", "", http.StatusForbidden},
+		{"bob", "203.0.113.5:1234", "10.0.2.5", http.StatusForbidden},
+		{"bob", "127.0.0.1:1234", "10.0.2.5", http.StatusMultiStatus},
+		{"bob", "127.0.0.1:1234", "203.0.113.5", http.StatusForbidden},
+		{"", "203.0.113.5:1234", "", http.StatusForbidden},
+		{"", "10.0.2.5:1234", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("PROPFIND", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("Depth", "0")
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, "password")
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		if w.Code != tt.want {
+			t.Errorf("PROPFIND by %q from %s (forwarded %q) status = %v, want %v", tt.user, tt.remoteAddr, tt.forwarded, w.Code, tt.want)
+		}
+	}
+
+	invalid := &Config{Users: map[string]*UserInfo{"alice": {AllowedNetworks: []string{"10.0.0.0/33"}}}}
+	if err := invalid.checkNetworks(); err == nil {
+		t.Error("checkNetworks() of an invalid network succeeded")
+	}
+}
@@ -0,0 +1,394 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the Nextcloud compatibility
+const (
+	defaultNextcloudVersion = "28.0.4"
+	nextcloudLoginTimeout   = 20 * time.Minute
+
+	// nextcloudAnonymous is the user id reported to clients, if no users are configured
+	nextcloudAnonymous = "anonymous"
+)
+
+// Nextcloud enables the endpoints the official Nextcloud desktop and mobile clients expect,
+// i.e. status.php, the OCS capabilities and user API, the login flow v2 and the WebDAV paths
+// below remote.php. The endpoints are served below the prefix of the configuration.
+type Nextcloud struct {
+	// Version is the Nextcloud version reported to the clients, which refuse to connect to
+	// servers they consider too old.
+	Version string
+
+	mu     sync.Mutex
+	logins map[string]*nextcloudLogin
+}
+
+// nextcloudLogin is a pending login of the login flow v2. The client polls with the token,
+// while the user logs in within the browser at the URL with the flow id.
+type nextcloudLogin struct {
+	flow     string
+	user     string
+	password string
+	granted  bool
+	expires  time.Time
+}
+
+// ocsMeta is the status of an OCS response.
+type ocsMeta struct {
+	Status     string `json:"status"`
+	StatusCode int    `json:"statuscode"`
+	Message    string `json:"message"`
+}
+
+// serveNextcloudPublic serves the endpoints of the Nextcloud compatibility, which are
+// reached without authentication, and returns whether the request has been handled.
+func (a *App) serveNextcloudPublic(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	nc := a.Config.Nextcloud
+	if nc == nil {
+		return false
+	}
+
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	switch {
+	case p == "/status.php":
+		traceStep(ctx, "answered Nextcloud status")
+		nc.serveStatus(w)
+	case p == "/ocs/v1.php/cloud/capabilities" || p == "/ocs/v2.php/cloud/capabilities":
+		traceStep(ctx, "answered Nextcloud capabilities")
+		nc.serveCapabilities(w, p, a.Shares != nil)
+	case p == "/index.php/login/v2" && r.Method == http.MethodPost:
+		nc.startLogin(w, a.baseURL(r))
+	case p == "/index.php/login/v2/poll" && r.Method == http.MethodPost:
+		nc.pollLogin(w, r, a.baseURL(r))
+	case strings.HasPrefix(p, "/index.php/login/v2/flow/"):
+		a.grantNextcloudLogin(ctx, w, r, strings.TrimPrefix(p, "/index.php/login/v2/flow/"))
+	default:
+		return false
+	}
+	return true
+}
+
+// serveNextcloud serves the authenticated endpoints of the Nextcloud compatibility and
+// returns whether the request has been handled. Other paths below remote.php and ocs are
+// answered with 404.
+func (a *App) serveNextcloud(w http.ResponseWriter, r *http.Request) bool {
+	if a.Config.Nextcloud == nil {
+		return false
+	}
+
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	user := nextcloudAnonymous
+	if authInfo := AuthFromContext(r.Context()); authInfo != nil && authInfo.Authenticated {
+		user = authInfo.Username
+	}
+
+	switch {
+	case p == "/ocs/v1.php/cloud/user" || p == "/ocs/v2.php/cloud/user":
+		a.serveNextcloudUser(w, r, p, user)
+	case p == "/remote.php/webdav" || strings.HasPrefix(p, "/remote.php/webdav/"):
+		a.nextcloudDAV("/remote.php/webdav").ServeHTTP(w, r)
+	case strings.HasPrefix(p, "/remote.php/dav/files/"):
+		owner := strings.TrimPrefix(p, "/remote.php/dav/files/")
+		if i := strings.Index(owner, "/"); i >= 0 {
+			owner = owner[:i]
+		}
+		// without users, every user id is accepted
+		if owner != user && a.Config.AuthenticationNeeded() {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return true
+		}
+		a.nextcloudDAV("/remote.php/dav/files/"+owner).ServeHTTP(w, r)
+	case a.Shares != nil && isOCSSharesPath(p):
+		a.serveOCSShares(w, r, p, user)
+	case strings.HasPrefix(p, "/remote.php/") || strings.HasPrefix(p, "/ocs/"):
+		http.NotFound(w, r)
+	default:
+		return false
+	}
+	return true
+}
+
+// relativePath returns the path of the request relative to the prefix of the configuration.
+func (a *App) relativePath(r *http.Request) (string, bool) {
+	if !strings.HasPrefix(r.URL.Path, a.Config.Prefix) {
+		return "", false
+	}
+	return "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, a.Config.Prefix), "/"), true
+}
+
+// baseURL returns the URL of the server including the prefix, as reached by the request.
+func (a *App) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(a.Config.Prefix, "/")
+}
+
+// nextcloudDAV returns a WebDAV handler for the same file system, which is served below the
+// given path.
+func (a *App) nextcloudDAV(prefix string) http.Handler {
+	return a.davHandler(&webdav.Handler{
+		Prefix:     strings.TrimSuffix(a.Config.Prefix, "/") + prefix,
+		FileSystem: a.Handler.FileSystem,
+		LockSystem: a.Handler.LockSystem,
+		Logger:     a.Handler.Logger,
+	})
+}
+
+func (nc *Nextcloud) version() (major, minor, micro int) {
+	fmt.Sscanf(nc.Version, "%d.%d.%d", &major, &minor, &micro)
+	return major, minor, micro
+}
+
+func (nc *Nextcloud) serveStatus(w http.ResponseWriter) {
+	major, minor, micro := nc.version()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"installed":       true,
+		"maintenance":     false,
+		"needsDbUpgrade":  false,
+		"version":         fmt.Sprintf("%d.%d.%d.0", major, minor, micro),
+		"versionstring":   nc.Version,
+		"edition":         "",
+		"productname":     "dave",
+		"extendedSupport": false,
+	})
+}
+
+// serveCapabilities answers the capabilities, the sharing ones only if public links are
+// enabled.
+func (nc *Nextcloud) serveCapabilities(w http.ResponseWriter, p string, sharing bool) {
+	major, minor, micro := nc.version()
+	capabilities := map[string]interface{}{
+		"core": map[string]interface{}{
+			"pollinterval": 60,
+			"webdav-root":  "remote.php/webdav",
+		},
+		// uploads aren't chunked, as the upload endpoints of Nextcloud aren't served
+		"dav": map[string]interface{}{
+			"chunking": "",
+		},
+		"files": map[string]interface{}{
+			"bigfilechunking": false,
+			"undelete":        false,
+			"versioning":      false,
+		},
+	}
+	if sharing {
+		capabilities["files_sharing"] = map[string]interface{}{
+			"api_enabled": true,
+			"resharing":   false,
+			"public": map[string]interface{}{
+				"enabled":     true,
+				"password":    map[string]interface{}{"enforced": false},
+				"expire_date": map[string]interface{}{"enabled": false},
+				"upload":      false,
+				"send_mail":   false,
+			},
+			"user": map[string]interface{}{"send_mail": false},
+		}
+	}
+	writeOCS(w, p, map[string]interface{}{
+		"version": map[string]interface{}{
+			"major":           major,
+			"minor":           minor,
+			"micro":           micro,
+			"string":          nc.Version,
+			"edition":         "",
+			"extendedSupport": false,
+		},
+		"capabilities": capabilities,
+	})
+}
+
+func (a *App) serveNextcloudUser(w http.ResponseWriter, r *http.Request, p, user string) {
+	// Nextcloud reports -3 for unlimited space
+	quota := map[string]interface{}{"free": -3, "used": 0, "total": -3, "relative": 0, "quota": -3}
+	root := Dir{Config: a.Config}.resolve(r.Context(), "/")
+	if used, limit, ok := a.Quotas.remaining(root); ok {
+		quota = map[string]interface{}{
+			"free":     nonNegative(limit - used),
+			"used":     used,
+			"total":    limit,
+			"relative": float64(used) * 100 / float64(limit),
+			"quota":    limit,
+		}
+	}
+	writeOCS(w, p, map[string]interface{}{
+		"id":           user,
+		"display-name": user,
+		"displayname":  user,
+		"email":        nil,
+		"quota":        quota,
+	})
+}
+
+// writeOCS writes the data as JSON response of version 1 or 2 of the OCS API, which only
+// differ by the status code.
+func writeOCS(w http.ResponseWriter, p string, data interface{}) {
+	meta := ocsMeta{Status: "ok", StatusCode: 100, Message: "OK"}
+	if strings.HasPrefix(p, "/ocs/v2.php/") {
+		meta.StatusCode = http.StatusOK
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ocs": map[string]interface{}{"meta": meta, "data": data},
+	})
+}
+
+// writeOCSError writes a failure of the OCS API. Version 1 answers with 200 and reports the
+// status within the meta data only.
+func writeOCSError(w http.ResponseWriter, p string, status int, msg string) {
+	code := http.StatusOK
+	if strings.HasPrefix(p, "/ocs/v2.php/") {
+		code = status
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"ocs": map[string]interface{}{
+			"meta": ocsMeta{Status: "failure", StatusCode: status, Message: msg},
+			"data": []interface{}{},
+		},
+	})
+}
+
+// startLogin begins a login of the login flow v2.
+func (nc *Nextcloud) startLogin(w http.ResponseWriter, base string) {
+	token, err := randomHex(64)
+	var flow string
+	if err == nil {
+		flow, err = randomHex(32)
+	}
+	if err != nil {
+		log.WithError(err).Error("Error creating Nextcloud login")
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	nc.mu.Lock()
+	if nc.logins == nil {
+		nc.logins = map[string]*nextcloudLogin{}
+	}
+	for t, l := range nc.logins {
+		if now.After(l.expires) {
+			delete(nc.logins, t)
+		}
+	}
+	nc.logins[token] = &nextcloudLogin{flow: flow, expires: now.Add(nextcloudLoginTimeout)}
+	nc.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"poll": map[string]string{
+			"token":    token,
+			"endpoint": base + "/index.php/login/v2/poll",
+		},
+		"login": base + "/index.php/login/v2/flow/" + flow,
+	})
+}
+
+// pollLogin returns the credentials of a granted login to the client. The login is answered
+// with 404 until the user logged in.
+func (nc *Nextcloud) pollLogin(w http.ResponseWriter, r *http.Request, base string) {
+	token := r.PostFormValue("token")
+	nc.mu.Lock()
+	l := nc.logins[token]
+	if l == nil || !l.granted || time.Now().After(l.expires) {
+		nc.mu.Unlock()
+		writeJSON(w, http.StatusNotFound, []string{})
+		return
+	}
+	delete(nc.logins, token)
+	nc.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"server":      base,
+		"loginName":   l.user,
+		"appPassword": l.password,
+	})
+}
+
+// grantNextcloudLogin asks the user to log in with basic auth and grants the login of the
+// flow to the client. There are no app passwords, so the client receives the password of the
+// user.
+func (a *App) grantNextcloudLogin(ctx context.Context, w http.ResponseWriter, r *http.Request, flow string) {
+	nc := a.Config.Nextcloud
+	nc.mu.Lock()
+	var login *nextcloudLogin
+	for _, l := range nc.logins {
+		if l.flow == flow && !l.granted && time.Now().Before(l.expires) {
+			login = l
+		}
+	}
+	nc.mu.Unlock()
+	if login == nil {
+		a.Config.writeError(w, r, http.StatusNotFound)
+		return
+	}
+
+	user, password := nextcloudAnonymous, ""
+	if a.Config.AuthenticationNeeded() {
+		username, pw, ok := r.BasicAuth()
+		if !ok {
+			traceStep(ctx, "no basic auth credentials for Nextcloud login, requested authentication")
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+		if a.Tripwire.isDecoy(username) {
+			traceStep(ctx, "Nextcloud login as decoy user %s", username)
+			a.Tripwire.trip(a.Config.clientIP(r), username, "", time.Now())
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+		if wait, locked := a.LoginLimiter.locked(username, a.Config.clientIP(r), time.Now()); locked {
+			traceStep(ctx, "Nextcloud logins of user %s from %s are locked out for %s", username, a.Config.clientIP(r), wait)
+			writeLockedOut(w, wait)
+			return
+		}
+		if _, err := authenticate(a.Config, username, pw); err != nil {
+			traceStep(ctx, "authentication of user %s for Nextcloud login failed: %s", username, err)
+			log.WithFields(fingerprintFields(ctx, log.Fields{"user": username, "address": a.Config.clientIP(r)})).WithError(err).Warn("User failed to login")
+			a.Alerts.authFailed(time.Now())
+			a.LoginLimiter.failed(username, a.Config.clientIP(r), time.Now())
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+		a.LoginLimiter.succeeded(username)
+		user, password = username, pw
+	}
+
+	nc.mu.Lock()
+	login.user, login.password, login.granted = user, password, true
+	nc.mu.Unlock()
+	traceStep(ctx, "granted Nextcloud login of user %s", user)
+	log.WithField("user", user).WithField("address", a.Config.clientIP(r)).Info("Granted Nextcloud client login")
+
+	m := a.Config.I18n.messages(r)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html lang=\"%s\"><head><title>dave</title></head><body><p>%s</p></body></html>\n",
+		html.EscapeString(m.Lang), html.EscapeString(m.T("nextcloud.done", user)))
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
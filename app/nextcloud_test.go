@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newNextcloudApp(t *testing.T) *App {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "a.txt"), []byte("hello"), 0600)
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	subdir := "alice"
+	cfg := &Config{
+		Dir:       tmpDir,
+		Prefix:    "/cloud",
+		Realm:     "dave",
+		Nextcloud: &Nextcloud{Version: defaultNextcloudVersion},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, Quota: 1000},
+			"bob":   {Password: GenHash([]byte("password"))},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+	a.Handler.Prefix = cfg.Prefix
+	return a
+}
+
+func TestNextcloudEndpoints(t *testing.T) {
+	a := newNextcloudApp(t)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		user     string
+		want     int
+		wantBody string
+	}{
+		{"status", "GET", "/cloud/status.php", "", http.StatusOK, `"installed":true`},
+		{"capabilities v1", "GET", "/cloud/ocs/v1.php/cloud/capabilities?format=json", "", http.StatusOK, `"statuscode":100`},
+		{"capabilities v2", "GET", "/cloud/ocs/v2.php/cloud/capabilities?format=json", "", http.StatusOK, `"webdav-root":"remote.php/webdav"`},
+		{"user without login", "GET", "/cloud/ocs/v1.php/cloud/user?format=json", "", http.StatusUnauthorized, ""},
+		{"user", "GET", "/cloud/ocs/v2.php/cloud/user?format=json", "alice", http.StatusOK, `"quota":{"free":995,"quota":1000,"relative":0.5,"total":1000,"used":5}`},
+		{"unknown OCS endpoint", "GET", "/cloud/ocs/v2.php/apps/notifications/api/v2/notifications", "alice", http.StatusNotFound, ""},
+		{"files of user", "PROPFIND", "/cloud/remote.php/dav/files/alice/", "alice", http.StatusMultiStatus, "<D:href>/cloud/remote.php/dav/files/alice/a.txt</D:href>"},
+		{"files of other user", "PROPFIND", "/cloud/remote.php/dav/files/alice/", "bob", http.StatusForbidden, ""},
+		{"legacy WebDAV root", "GET", "/cloud/remote.php/webdav/a.txt", "alice", http.StatusOK, "hello"},
+		{"plain WebDAV", "GET", "/cloud/a.txt", "alice", http.StatusOK, "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, "password")
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("handle() body = %s, want it to contain %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	a.Config.Nextcloud = nil
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, httptest.NewRequest("GET", "/cloud/status.php", nil), a)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("handle() of disabled status.php status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestNextcloudLoginFlow(t *testing.T) {
+	a := newNextcloudApp(t)
+	do := func(method, path, body, user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	w := do("POST", "/cloud/index.php/login/v2", "", "", "")
+	var start struct {
+		Poll struct {
+			Token    string
+			Endpoint string
+		}
+		Login string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &start); err != nil {
+		t.Fatalf("starting login error = %v", err)
+	}
+	if start.Poll.Endpoint != "http://example.com/cloud/index.php/login/v2/poll" {
+		t.Errorf("poll endpoint = %v, want http://example.com/cloud/index.php/login/v2/poll", start.Poll.Endpoint)
+	}
+	login, _ := url.Parse(start.Login)
+	poll := "token=" + start.Poll.Token
+
+	if w := do("POST", "/cloud/index.php/login/v2/poll", poll, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("poll before login status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	if w := do("GET", login.Path, "", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("login without credentials status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+	if w := do("GET", login.Path, "", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with wrong password status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+	if w := do("GET", login.Path, "", "alice", "password"); w.Code != http.StatusOK {
+		t.Errorf("login status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if w := do("GET", login.Path, "", "bob", "password"); w.Code != http.StatusNotFound {
+		t.Errorf("second login status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	w = do("POST", "/cloud/index.php/login/v2/poll", poll, "", "")
+	want := `{"appPassword":"password","loginName":"alice","server":"http://example.com/cloud"}` + "\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("poll after login = %v %s, want %v %s", w.Code, w.Body.String(), http.StatusOK, want)
+	}
+	if w := do("POST", "/cloud/index.php/login/v2/poll", poll, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second poll status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
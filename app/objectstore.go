@@ -0,0 +1,766 @@
+package app
+
+import (
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// objectStorage keeps the files below the base directory in a bucket of an S3 compatible
+// object storage like MinIO, so the server keeps no files itself. The path of a file relative
+// to the base directory is the key of its object below the prefix. Directories are empty
+// folder objects, whose keys end with a slash, or implied by the keys of their members. Other
+// paths, like the ones of the trash and the versions, stay on the local file system, files
+// moved between them and the bucket are transferred.
+type objectStorage struct {
+	localStorage
+	root   string
+	abs    string
+	bucket *s3Bucket
+}
+
+// newObjectStorage creates the storage of the object store of the configuration.
+func newObjectStorage(cfg *Config) (*objectStorage, error) {
+	s := cfg.ObjectStore
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || s.Bucket == "" {
+		return nil, fmt.Errorf("object store requires an http or https endpoint and a bucket")
+	}
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &objectStorage{
+		root:   filepath.Clean(dir),
+		abs:    abs,
+		bucket: &s3Bucket{settings: s, endpoint: endpoint, http: http.DefaultClient},
+	}, nil
+}
+
+// checkObjectStore verifies the endpoint and the bucket of the object store. The headers of
+// encrypted folders are kept next to their files, which the bucket can't hold.
+func (cfg *Config) checkObjectStore() error {
+	if cfg.ObjectStore == nil {
+		return nil
+	}
+	if cfg.ContentStore != nil {
+		return fmt.Errorf("files can't be stored in the object store and the content store at once")
+	}
+	if cfg.Encryption != nil {
+		return fmt.Errorf("encrypted folders can't be stored in the object store")
+	}
+	_, err := newObjectStorage(cfg)
+	return err
+}
+
+// object returns the name of the physical path within the bucket and whether the path is
+// stored in the bucket at all.
+func (s *objectStorage) object(name string) (string, bool) {
+	root := s.root
+	if filepath.IsAbs(name) {
+		root = s.abs
+	}
+	name = filepath.Clean(name)
+	if !withinDir(name, root) {
+		return "", false
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return "", false
+	}
+	return path.Clean("/" + filepath.ToSlash(rel)), true
+}
+
+// objectInfo is a file or a directory of the object store.
+type objectInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *objectInfo) Name() string       { return fi.name }
+func (fi *objectInfo) Size() int64        { return fi.size }
+func (fi *objectInfo) ModTime() time.Time { return fi.modTime }
+func (fi *objectInfo) IsDir() bool        { return fi.dir }
+func (fi *objectInfo) Sys() interface{}   { return nil }
+
+func (fi *objectInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0700
+	}
+	return 0600
+}
+
+// prefix returns the prefix of the keys of the members of the directory with the name.
+func (d *s3Bucket) prefix(name string) string {
+	if key := d.key(name); key != "" {
+		return key + "/"
+	}
+	return ""
+}
+
+// members lists the files and directories directly within the directory with the name.
+func (d *s3Bucket) members(name string) ([]os.FileInfo, error) {
+	prefix := d.prefix(name)
+	var members []os.FileInfo
+	token := ""
+	for {
+		query := [][2]string{{"list-type", "2"}, {"prefix", prefix}, {"delimiter", "/"}}
+		if token != "" {
+			query = append(query, [2]string{"continuation-token", token})
+		}
+		result, err := d.listObjects(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				// the folder object of the directory itself
+				continue
+			}
+			// in seconds like the Last-Modified header of stat, so the times of both compare
+			modTime, _ := time.Parse(time.RFC3339, c.LastModified)
+			members = append(members, &objectInfo{name: strings.TrimPrefix(c.Key, prefix), size: c.Size, modTime: modTime.Truncate(time.Second)})
+		}
+		for _, p := range result.CommonPrefixes {
+			members = append(members, &objectInfo{name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"), dir: true})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			sort.Slice(members, func(i, j int) bool { return members[i].Name() < members[j].Name() })
+			return members, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// listObjects sends a ListObjectsV2 request with the query.
+func (d *s3Bucket) listObjects(query [][2]string) (*s3ListResult, error) {
+	resp, err := d.do(http.MethodGet, "", query, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// copy copies the object of the key to the new key on the side of the object storage.
+func (d *s3Bucket) copy(key, newKey string) error {
+	source := "/" + s3Escape(d.settings.Bucket+"/"+key, true)
+	resp, err := d.send(http.MethodPut, newKey, nil, http.Header{"X-Amz-Copy-Source": {source}}, http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// delete removes the object of the key, a missing object isn't an error.
+func (d *s3Bucket) delete(key string) error {
+	resp, err := d.do(http.MethodDelete, key, nil, nil, 0)
+	if IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// copyDir copies the directory with the name and its members to the new name. The folders are
+// walked, so directories without members get a folder object as well.
+func (d *s3Bucket) copyDir(name, newName string) error {
+	resp, err := d.do(http.MethodPut, d.prefix(newName), nil, http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	members, err := d.members(name)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.IsDir() {
+			err = d.copyDir(path.Join(name, m.Name()), path.Join(newName, m.Name()))
+		} else {
+			err = d.copy(d.key(path.Join(name, m.Name())), d.key(path.Join(newName, m.Name())))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDir removes the members of the directory with the name and its folder object.
+func (d *s3Bucket) removeDir(name string) error {
+	members, err := d.members(name)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.IsDir() {
+			err = d.removeDir(path.Join(name, m.Name()))
+		} else {
+			err = d.delete(d.key(path.Join(name, m.Name())))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return d.delete(d.prefix(name))
+}
+
+// stat returns the file of the name, if its object exists, or the directory, if its folder
+// object or any member exists. The root always exists.
+func (d *s3Bucket) stat(name string) (os.FileInfo, error) {
+	if name == "/" {
+		return &objectInfo{name: name, dir: true}, nil
+	}
+	resp, err := d.do(http.MethodHead, d.key(name), nil, nil, 0)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &objectInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+	}
+	if !IsNotFound(err) {
+		return nil, err
+	}
+	resp, err = d.do(http.MethodHead, d.prefix(name), nil, nil, 0)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &objectInfo{name: path.Base(name), modTime: modTime, dir: true}, nil
+	}
+	if !IsNotFound(err) {
+		return nil, err
+	}
+	result, err := d.listObjects([][2]string{{"list-type", "2"}, {"prefix", d.prefix(name)}, {"max-keys", "1"}})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return &objectInfo{name: path.Base(name), dir: true}, nil
+}
+
+// putDir creates the folder object of the directory with the name.
+func (d *s3Bucket) putDir(name string) error {
+	resp, err := d.do(http.MethodPut, d.prefix(name), nil, http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// checkParent returns os.ErrNotExist, if the parent of the name isn't a directory.
+func (d *s3Bucket) checkParent(name string) error {
+	parent, err := d.stat(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (s *objectStorage) Stat(name string) (os.FileInfo, error) {
+	o, ok := s.object(name)
+	if !ok {
+		return s.localStorage.Stat(name)
+	}
+	fi, err := s.bucket.stat(o)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if o == "/" {
+		return &objectInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return fi, nil
+}
+
+// Lstat is Stat, there are no symbolic links within the bucket.
+func (s *objectStorage) Lstat(name string) (os.FileInfo, error) {
+	if _, ok := s.object(name); !ok {
+		return s.localStorage.Lstat(name)
+	}
+	return s.Stat(name)
+}
+
+func (s *objectStorage) OpenFile(name string, flag int, perm os.FileMode) (webdav.File, error) {
+	o, ok := s.object(name)
+	if !ok {
+		return s.localStorage.OpenFile(name, flag, perm)
+	}
+	fi, err := s.Stat(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if flag&writeFlags == 0 {
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			return &objectDir{bucket: s.bucket, name: o, info: fi}, nil
+		}
+		return &objectFile{bucket: s.bucket, key: s.bucket.key(o), info: fi}, nil
+	}
+
+	switch {
+	case err == nil && fi.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case err != nil && flag&os.O_CREATE == 0:
+		return nil, err
+	case err != nil:
+		if err := s.bucket.checkParent(o); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	tmp, err := ioutil.TempFile("", "dave-object-")
+	if err != nil {
+		return nil, err
+	}
+	f := &objectWriter{File: tmp, bucket: s.bucket, name: o}
+	if fi != nil && flag&os.O_TRUNC == 0 {
+		// the content is kept, it's uploaded again with the changes when the file is closed
+		if err := f.download(fi, flag&os.O_APPEND != 0); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (s *objectStorage) Mkdir(name string, perm os.FileMode) error {
+	o, ok := s.object(name)
+	if !ok {
+		return s.localStorage.Mkdir(name, perm)
+	}
+	if _, err := s.bucket.stat(o); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := s.bucket.checkParent(o); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return s.bucket.putDir(o)
+}
+
+// MkdirAll creates the folder objects of the directory and its missing parents.
+func (s *objectStorage) MkdirAll(name string, perm os.FileMode) error {
+	o, ok := s.object(name)
+	if !ok {
+		return s.localStorage.MkdirAll(name, perm)
+	}
+	fi, err := s.bucket.stat(o)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil
+	case err == nil:
+		return &os.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := s.MkdirAll(filepath.Dir(name), perm); err != nil {
+		return err
+	}
+	return s.bucket.putDir(o)
+}
+
+// Remove removes the object of the file or the folder object of the empty directory.
+func (s *objectStorage) Remove(name string) error {
+	o, ok := s.object(name)
+	if !ok {
+		return s.localStorage.Remove(name)
+	}
+	fi, err := s.bucket.stat(o)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if !fi.IsDir() {
+		return s.bucket.delete(s.bucket.key(o))
+	}
+	members, err := s.bucket.members(o)
+	if err != nil {
+		return err
+	}
+	if len(members) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	return s.bucket.delete(s.bucket.prefix(o))
+}
+
+func (s *objectStorage) RemoveAll(name string) error {
+	o, ok := s.object(name)
+	if !ok {
+		return s.localStorage.RemoveAll(name)
+	}
+	fi, err := s.bucket.stat(o)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case fi.IsDir():
+		return s.bucket.removeDir(o)
+	default:
+		return s.bucket.delete(s.bucket.key(o))
+	}
+}
+
+// Rename copies the object or the objects of the directory to the new name and removes them
+// then, because objects can't be renamed. Between the bucket and the local file system, the
+// files are transferred.
+func (s *objectStorage) Rename(oldName, newName string) error {
+	oldObject, oldOK := s.object(oldName)
+	newObject, newOK := s.object(newName)
+	switch {
+	case !oldOK && !newOK:
+		return s.localStorage.Rename(oldName, newName)
+	case !oldOK:
+		return s.upload(oldName, newName)
+	case !newOK:
+		return s.download(oldName, newName)
+	}
+	fi, err := s.bucket.stat(oldObject)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+	if err := s.bucket.checkParent(newObject); err != nil {
+		return &os.PathError{Op: "rename", Path: newName, Err: err}
+	}
+	if !fi.IsDir() {
+		if err := s.bucket.copy(s.bucket.key(oldObject), s.bucket.key(newObject)); err != nil {
+			return err
+		}
+		return s.bucket.delete(s.bucket.key(oldObject))
+	}
+	if err := s.bucket.copyDir(oldObject, newObject); err != nil {
+		return err
+	}
+	return s.bucket.removeDir(oldObject)
+}
+
+// upload moves the local file or directory into the bucket.
+func (s *objectStorage) upload(local, name string) error {
+	err := filepath.Walk(local, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		o, _ := s.object(filepath.Join(name, rel))
+		if fi.IsDir() {
+			return s.bucket.putDir(o)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return s.bucket.put(o, f, fi.Size(), fi.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(local)
+}
+
+// download moves the file or directory of the bucket to the local path.
+func (s *objectStorage) download(name, local string) error {
+	err := s.Walk(name, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(name, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(local, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		src, err := s.OpenFile(p, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, src); err != nil {
+			dst.Close()
+			return err
+		}
+		if err := dst.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+	return s.RemoveAll(name)
+}
+
+// Chmod is ignored within the bucket, the objects have no modes.
+func (s *objectStorage) Chmod(name string, mode os.FileMode) error {
+	if _, ok := s.object(name); !ok {
+		return s.localStorage.Chmod(name, mode)
+	}
+	_, err := s.Stat(name)
+	return err
+}
+
+// Chtimes is ignored within the bucket, the objects are modified when they're written or
+// moved.
+func (s *objectStorage) Chtimes(name string, atime, mtime time.Time) error {
+	if _, ok := s.object(name); !ok {
+		return s.localStorage.Chtimes(name, atime, mtime)
+	}
+	_, err := s.Stat(name)
+	return err
+}
+
+func (s *objectStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	o, ok := s.object(name)
+	if !ok {
+		return s.localStorage.ReadDir(name)
+	}
+	fi, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	return s.bucket.members(o)
+}
+
+func (s *objectStorage) Walk(root string, fn filepath.WalkFunc) error {
+	if _, ok := s.object(root); !ok {
+		return s.localStorage.Walk(root, fn)
+	}
+	fi, err := s.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = s.walk(root, fi, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walk walks the tree of the name in lexical order like filepath.Walk.
+func (s *objectStorage) walk(name string, fi os.FileInfo, fn filepath.WalkFunc) error {
+	if !fi.IsDir() {
+		return fn(name, fi, nil)
+	}
+	members, err := s.ReadDir(name)
+	if walkErr := fn(name, fi, err); err != nil || walkErr != nil {
+		return walkErr
+	}
+	for _, m := range members {
+		if err := s.walk(filepath.Join(name, m.Name()), m, fn); err != nil && (!m.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectFile is a file of the object store opened for reading. Its content is requested from
+// the current offset, when it's read first after opening or seeking.
+type objectFile struct {
+	bucket *s3Bucket
+	key    string
+	info   os.FileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	if f.offset >= f.info.Size() {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.offset)}}
+		resp, err := f.bucket.send(http.MethodGet, f.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.Size()
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *objectFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *objectFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *objectFile) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	return f.body.Close()
+}
+
+// objectWriter is a file of the object store opened for writing. The content is written to a
+// temporary file and uploaded, when it's closed.
+type objectWriter struct {
+	*os.File
+	bucket *s3Bucket
+	name   string
+}
+
+// download writes the current content of the file to the temporary file. The next write
+// appends to it, if append is set, otherwise it overwrites it from the start.
+func (f *objectWriter) download(fi os.FileInfo, append bool) error {
+	if fi.Size() == 0 {
+		return nil
+	}
+	resp, err := f.bucket.do(http.MethodGet, f.bucket.key(f.name), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(f.File, resp.Body); err != nil {
+		return err
+	}
+	if append {
+		return nil
+	}
+	_, err = f.File.Seek(0, io.SeekStart)
+	return err
+}
+
+func (f *objectWriter) Stat() (os.FileInfo, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &objectInfo{name: path.Base(f.name), size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+func (f *objectWriter) Close() error {
+	defer os.Remove(f.File.Name())
+	defer f.File.Close()
+	fi, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return f.bucket.put(f.name, f.File, fi.Size(), fi.ModTime())
+}
+
+// objectDir is a directory of the object store. Its members are listed, when they're read
+// first.
+type objectDir struct {
+	bucket  *s3Bucket
+	name    string
+	info    os.FileInfo
+	members []os.FileInfo
+	listed  bool
+}
+
+func (d *objectDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *objectDir) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *objectDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *objectDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		members, err := d.bucket.members(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.members, d.listed = members, true
+	}
+	if count <= 0 {
+		members := d.members
+		d.members = nil
+		return members, nil
+	}
+	if len(d.members) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.members) {
+		count = len(d.members)
+	}
+	members := d.members[:count]
+	d.members = d.members[count:]
+	return members, nil
+}
+
+func (d *objectDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *objectDir) Close() error {
+	return nil
+}
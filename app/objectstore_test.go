@@ -0,0 +1,210 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckObjectStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Config
+		wantErr bool
+	}{
+		{"disabled", &Config{}, false},
+		{"missing bucket", &Config{ObjectStore: &ReplicationS3{Endpoint: "https://s3.example.com"}}, true},
+		{"invalid endpoint", &Config{ObjectStore: &ReplicationS3{Endpoint: "s3.example.com", Bucket: "dave"}}, true},
+		{"valid", &Config{ObjectStore: &ReplicationS3{Endpoint: "https://s3.example.com", Bucket: "dave"}}, false},
+		{"content store", &Config{ObjectStore: &ReplicationS3{Endpoint: "https://s3.example.com", Bucket: "dave"}, ContentStore: &ContentStore{}}, true},
+		{"encryption", &Config{ObjectStore: &ReplicationS3{Endpoint: "https://s3.example.com", Bucket: "dave"}, Encryption: &Encryption{}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.checkObjectStore(); (err != nil) != tt.wantErr {
+				t.Errorf("checkObjectStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestObjectStorage(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "s3", "minio"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "minio"
+	s3Server := startS3(t, &Config{
+		Dir: filepath.Join(tmpDir, "s3"),
+		Users: map[string]*UserInfo{
+			"minio": {Password: GenHash([]byte("password")), Subdir: &subdir, S3AccessKey: "minio-key", S3SecretKey: "minio-secret"},
+		},
+	})
+	c := &s3Client{t: t, url: s3Server.URL, accessKey: "minio-key", secretKey: "minio-secret"}
+	if code, _, _ := c.request(http.MethodPut, "/store", ""); code != http.StatusOK {
+		t.Fatalf("create bucket = %d", code)
+	}
+
+	alice := "/alice"
+	cfg := &Config{
+		Dir:        filepath.Join(tmpDir, "data"),
+		CreateDirs: true,
+		Realm:      "dave",
+		Trash:      &Trash{Dir: filepath.Join(tmpDir, "trash")},
+		ObjectStore: &ReplicationS3{Endpoint: s3Server.URL, Bucket: "store", Prefix: "files",
+			AccessKey: "minio-key", SecretKey: "minio-secret"},
+		Users: map[string]*UserInfo{
+			"alice":  {Password: GenHash([]byte("password")), Subdir: &alice, Quota: 20},
+			"viewer": {Password: GenHash([]byte("password")), Subdir: &alice, Permissions: Permissions{Template: TemplateReadOnly}},
+		},
+	}
+	if err := cfg.checkDirs(); err != nil {
+		t.Fatalf("checkDirs() error = %v", err)
+	}
+	a := newQuotaApp(t, cfg)
+	trash, err := NewTrashBin(cfg, a.Quotas, nil, nil)
+	if err != nil {
+		t.Fatalf("NewTrashBin() error = %v", err)
+	}
+	a.Handler.FileSystem = Dir{Config: cfg, Quotas: a.Quotas, Trash: trash}
+	do := func(user, method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth(user, "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	if w := do("alice", "MKCOL", "/docs", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL = %v %s", w.Code, w.Body)
+	}
+	if w := do("alice", "MKCOL", "/docs/empty", ""); w.Code != http.StatusCreated {
+		t.Fatalf("MKCOL of a subdirectory = %v %s", w.Code, w.Body)
+	}
+	if w := do("alice", "PUT", "/docs/a.txt", "hello world"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT = %v %s", w.Code, w.Body)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "s3", "minio", "store", "files", "alice", "docs", "a.txt")); string(data) != "hello world" {
+		t.Errorf("object = %q, want hello world", data)
+	}
+	if w := do("alice", "GET", "/docs/a.txt", ""); w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Errorf("GET = %v %q", w.Code, w.Body)
+	}
+	if w := do("alice", "GET", "/docs/a.txt", "", "Range", "bytes=6-"); w.Code != http.StatusPartialContent || w.Body.String() != "world" {
+		t.Errorf("GET of a range = %v %q", w.Code, w.Body)
+	}
+	w := do("alice", "PROPFIND", "/docs", "", "Depth", "1")
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:href>/docs/a.txt</D:href>") || !strings.Contains(w.Body.String(), "<D:href>/docs/empty/</D:href>") {
+		t.Errorf("PROPFIND = %v %s", w.Code, w.Body)
+	}
+	if w := do("alice", "PUT", "/missing/a.txt", "data"); w.Code < 400 {
+		t.Errorf("PUT below a missing directory = %v", w.Code)
+	}
+	if used := quotaUsed(a); used != 11 {
+		t.Errorf("used quota = %d, want 11", used)
+	}
+	if w := do("alice", "PUT", "/docs/large.txt", strings.Repeat("x", 10)); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("PUT exceeding the quota = %v, want %v", w.Code, http.StatusInsufficientStorage)
+	}
+
+	if w := do("viewer", "GET", "/docs/a.txt", ""); w.Code != http.StatusOK {
+		t.Errorf("GET by the viewer = %v", w.Code)
+	}
+	if w := do("viewer", "PUT", "/docs/b.txt", "data"); w.Code != http.StatusForbidden {
+		t.Errorf("PUT by the viewer = %v, want %v", w.Code, http.StatusForbidden)
+	}
+	if w := do("viewer", "DELETE", "/docs", ""); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE by the viewer = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	if w := do("alice", "MOVE", "/docs", "", "Destination", "/moved"); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE = %v %s", w.Code, w.Body)
+	}
+	if w := do("alice", "GET", "/moved/a.txt", ""); w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Errorf("GET of the moved file = %v %q", w.Code, w.Body)
+	}
+	if w := do("alice", "PROPFIND", "/moved/empty", "", "Depth", "0"); w.Code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND of the moved empty directory = %v", w.Code)
+	}
+	if w := do("alice", "GET", "/docs/a.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of the old name = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	if w := do("alice", "DELETE", "/moved", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %v", w.Code)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(tmpDir, "s3", "minio", "store", "files", "alice")); len(entries) != 0 {
+		t.Errorf("objects after the deletion = %v", entries)
+	}
+
+	user := "alice"
+	items := trash.list(&user)
+	if len(items) != 1 || items[0].Path != "/moved" || items[0].Size != 11 {
+		t.Fatalf("trash = %+v", items)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "trash", items[0].ID, trashContentName, "a.txt")); string(data) != "hello world" {
+		t.Errorf("trashed content = %q, want hello world", data)
+	}
+	if _, err := trash.restore(context.Background(), items[0].ID, ""); err != nil {
+		t.Fatalf("restore() error = %v", err)
+	}
+	if w := do("alice", "GET", "/moved/a.txt", ""); w.Code != http.StatusOK || w.Body.String() != "hello world" {
+		t.Errorf("GET of the restored file = %v %q", w.Code, w.Body)
+	}
+
+	cfg.Search = &Search{}
+	index, err := NewSearchIndex(cfg)
+	if err != nil {
+		t.Fatalf("NewSearchIndex() error = %v", err)
+	}
+	index.update(time.Now())
+	if matches, _ := index.search(index.dir, "hello", nil, 0); len(matches) != 1 || matches[0].name != "/alice/moved/a.txt" {
+		t.Errorf("search() = %+v, want /alice/moved/a.txt", matches)
+	}
+
+	cfg.Integrity = &Integrity{File: filepath.Join(tmpDir, "checksums.json")}
+	checker, err := NewIntegrityChecker(cfg, nil)
+	if err != nil {
+		t.Fatalf("NewIntegrityChecker() error = %v", err)
+	}
+	if run, err := checker.run(time.Now()); err != nil || run.Hashed != 1 || run.Errors != 0 {
+		t.Errorf("integrity run = %+v, error = %v", run, err)
+	}
+
+	cfg.Replication = &Replication{Dir: filepath.Join(tmpDir, "replica")}
+	replicator, err := NewReplicator(cfg)
+	if err != nil {
+		t.Fatalf("NewReplicator() error = %v", err)
+	}
+	if _, err := replicator.reconcile(time.Now()); err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "replica", "alice", "moved", "a.txt")); string(data) != "hello world" {
+		t.Errorf("replicated content = %q, want hello world", data)
+	}
+
+	cfg.Expiry = &Expiry{Directories: []*ExpiryDir{{Path: "/alice/moved", TTL: time.Hour}}}
+	janitor, err := NewJanitor(cfg, a.Quotas, nil)
+	if err != nil {
+		t.Fatalf("NewJanitor() error = %v", err)
+	}
+	if purged := janitor.purge(time.Now().Add(2 * time.Hour)); purged != 2 {
+		t.Errorf("purge() = %d, want 2", purged)
+	}
+	if w := do("alice", "GET", "/moved/a.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of the expired file = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	if _, err := os.Stat(cfg.Dir); !os.IsNotExist(err) {
+		t.Errorf("local base dir exists, error = %v", err)
+	}
+}
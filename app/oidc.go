@@ -0,0 +1,361 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha512" // hashes of the RS384, RS512, ES384 and ES512 signatures
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the OIDC authentication
+const (
+	defaultOIDCUsernameClaim = "preferred_username"
+	defaultOIDCKeysTTL       = time.Hour
+	defaultOIDCTimeout       = 10 * time.Second
+	oidcRefreshInterval      = time.Minute
+	oidcLeeway               = time.Minute
+)
+
+// OIDC authenticates requests with an "Authorization: Bearer" header by the JSON web token of
+// the OpenID Connect issuer Issuer. The signing keys are fetched from JWKSURL, or from the
+// jwks_uri of the discovery document of the issuer, and are cached for KeysTTL, 1h by
+// default. Tokens have to be issued by Issuer for Audience and not be expired. The claim
+// UsernameClaim, preferred_username by default, names the configured user of the request.
+type OIDC struct {
+	Issuer        string
+	Audience      string
+	JWKSURL       string
+	UsernameClaim string
+	KeysTTL       time.Duration
+	Timeout       time.Duration
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	expires time.Time
+}
+
+// oidcAlgorithms maps the supported signature algorithms of JSON web tokens to their hashes.
+var oidcAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// oidcClaims holds the registered claims of a token, which are verified.
+type oidcClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   *json.Number    `json:"exp"`
+	NotBefore *json.Number    `json:"nbf"`
+}
+
+// checkOIDC verifies the issuer and the key URL of the OIDC authentication.
+func (cfg *Config) checkOIDC() error {
+	o := cfg.OIDC
+	if o == nil {
+		return nil
+	}
+	if u, err := url.Parse(o.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("OIDC requires the URL of the issuer")
+	}
+	if o.Audience == "" {
+		return fmt.Errorf("OIDC requires an audience")
+	}
+	if o.JWKSURL != "" {
+		if u, err := url.Parse(o.JWKSURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid JWKS URL %s", o.JWKSURL)
+		}
+	}
+	return nil
+}
+
+// bearerToken returns the token of a request with an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// oidcAuth authenticates a request by its bearer token as the configured user named by the
+// username claim.
+func (cfg *Config) oidcAuth(token string) (*AuthInfo, error) {
+	claims, err := cfg.OIDC.verify(token, time.Now())
+	if err != nil {
+		return &AuthInfo{Authenticated: false}, err
+	}
+	claim := cfg.OIDC.UsernameClaim
+	if claim == "" {
+		claim = defaultOIDCUsernameClaim
+	}
+	username, _ := claims[claim].(string)
+	if username == "" {
+		return &AuthInfo{Authenticated: false}, fmt.Errorf("token has no claim %s", claim)
+	}
+	if cfg.User(username) == nil {
+		return &AuthInfo{Username: username, Authenticated: false}, errors.New("user not found")
+	}
+	return &AuthInfo{Username: username, Authenticated: true}, nil
+}
+
+// verify checks the signature, the issuer, the audience and the validity of the token and
+// returns its claims.
+func (o *OIDC) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	hash, ok := oidcAlgorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	keys, err := o.signingKeys(header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	verified := false
+	for _, key := range keys {
+		if verifyJWTSignature(header.Alg, key, hash, digest, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var registered oidcClaims
+	if err := decodeJWTPart(parts[1], &registered); err != nil {
+		return nil, err
+	}
+	if registered.Issuer != o.Issuer {
+		return nil, fmt.Errorf("token of issuer %q", registered.Issuer)
+	}
+	if !oidcAudience(registered.Audience, o.Audience) {
+		return nil, fmt.Errorf("token isn't meant for audience %s", o.Audience)
+	}
+	if registered.Expires == nil {
+		return nil, errors.New("token doesn't expire")
+	}
+	if exp, err := registered.Expires.Float64(); err != nil || now.Add(-oidcLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token expired")
+	}
+	if registered.NotBefore != nil {
+		if nbf, err := registered.NotBefore.Float64(); err != nil || now.Add(oidcLeeway).Before(time.Unix(int64(nbf), 0)) {
+			return nil, errors.New("token not valid yet")
+		}
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil || json.Unmarshal(data, v) != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// verifyJWTSignature verifies the signature by the key for the algorithm, RSA PKCS #1 v1.5 for
+// RS* and ECDSA with the concatenated r and s for ES*.
+func verifyJWTSignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) bool {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// oidcAudience returns whether the aud claim, a string or an array of strings, contains the
+// audience.
+func oidcAudience(aud json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(aud, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(aud, &many) != nil {
+		return false
+	}
+	for _, a := range many {
+		if a == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKeys returns the key with the ID, or all keys for tokens without key ID. The keys
+// are fetched again after KeysTTL, or at most once a minute for an unknown key ID, so keys of
+// the issuer are picked up after a rotation.
+func (o *OIDC) signingKeys(kid string, now time.Time) ([]crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	find := func() []crypto.PublicKey {
+		if kid != "" {
+			if key, ok := o.keys[kid]; ok {
+				return []crypto.PublicKey{key}
+			}
+			// keys without ID verify the tokens with any ID
+			if key, ok := o.keys[""]; ok {
+				return []crypto.PublicKey{key}
+			}
+			return nil
+		}
+		keys := make([]crypto.PublicKey, 0, len(o.keys))
+		for _, key := range o.keys {
+			keys = append(keys, key)
+		}
+		return keys
+	}
+	keys := find()
+	if (len(keys) > 0 && now.Before(o.expires)) || now.Sub(o.fetched) < oidcRefreshInterval {
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return keys, nil
+	}
+
+	fetched, err := o.fetchKeys()
+	o.fetched = now
+	if err != nil {
+		if len(keys) > 0 {
+			// the cached keys stay valid while the issuer isn't reachable
+			return keys, nil
+		}
+		return nil, err
+	}
+	ttl := o.KeysTTL
+	if ttl == 0 {
+		ttl = defaultOIDCKeysTTL
+	}
+	o.keys = fetched
+	o.expires = now.Add(ttl)
+	if keys = find(); len(keys) == 0 {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return keys, nil
+}
+
+// fetchKeys fetches the JSON web key set of the issuer. Keys which aren't meant for
+// signatures or of unsupported types are skipped.
+func (o *OIDC) fetchKeys() (map[string]crypto.PublicKey, error) {
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = defaultOIDCTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	jwksURL := o.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(client, strings.TrimSuffix(o.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed: %s", err)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("OIDC discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(client, jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("fetching the keys of the issuer failed: %s", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if !ok || errX != nil || errY != nil {
+				continue
+			}
+			key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("issuer has no signing keys")
+	}
+	return keys, nil
+}
+
+func getJSON(client *http.Client, target string, v interface{}) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered with %s", target, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// oidcIssuer serves the discovery document and the keys of an RSA and an EC key.
+type oidcIssuer struct {
+	url     string
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	fetches int64
+}
+
+func startOIDC(t *testing.T) *oidcIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &oidcIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	b64 := base64.RawURLEncoding.EncodeToString
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.url, "jwks_uri": issuer.url + "/keys"})
+		case "/keys":
+			atomic.AddInt64(&issuer.fetches, 1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+				{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	issuer.url = srv.URL
+	return issuer
+}
+
+// sign returns a token of the claims signed with the algorithm, RS256, ES256 or none.
+func (issuer *oidcIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, issuer.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, issuer.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(signature)
+}
+
+func TestOIDCAuthentication(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	issuer := startOIDC(t)
+	cfg := &Config{
+		Dir:   tmpDir,
+		Realm: "dave",
+		Users: map[string]*UserInfo{
+			"alice": {},
+			"bob":   {Password: GenHash([]byte("password"))},
+		},
+		OIDC: &OIDC{Issuer: issuer.url, Audience: "dave"},
+	}
+	if err := cfg.checkOIDC(); err != nil {
+		t.Fatalf("checkOIDC() error = %v", err)
+	}
+	a := newQuotaApp(t, cfg)
+
+	now := time.Now().Unix()
+	claims := func(changes ...interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": issuer.url, "aud": []string{"other", "dave"}, "exp": now + 300,
+			"preferred_username": "alice"}
+		for i := 0; i+1 < len(changes); i += 2 {
+			if changes[i+1] == nil {
+				delete(c, changes[i].(string))
+			} else {
+				c[changes[i].(string)] = changes[i+1]
+			}
+		}
+		return c
+	}
+	valid := issuer.sign(t, "RS256", "rsa", claims())
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"RS256", "Bearer " + valid, http.StatusMultiStatus},
+		{"lower-case scheme", "bearer " + valid, http.StatusMultiStatus},
+		{"ES256", "Bearer " + issuer.sign(t, "ES256", "ec", claims()), http.StatusMultiStatus},
+		{"without key ID", "Bearer " + issuer.sign(t, "ES256", "", claims()), http.StatusMultiStatus},
+		{"audience string", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("aud", "dave")), http.StatusMultiStatus},
+		{"tampered", "Bearer " + valid[:len(valid)-4] + "AAAA", http.StatusUnauthorized},
+		{"alg none", "Bearer " + issuer.sign(t, "none", "rsa", claims()), http.StatusUnauthorized},
+		{"key of the other type", "Bearer " + issuer.sign(t, "ES256", "rsa", claims()), http.StatusUnauthorized},
+		{"encryption key", "Bearer " + issuer.sign(t, "RS256", "enc", claims()), http.StatusUnauthorized},
+		{"unknown key", "Bearer " + issuer.sign(t, "RS256", "other", claims()), http.StatusUnauthorized},
+		{"expired", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("exp", now-120)), http.StatusUnauthorized},
+		{"without expiry", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("exp", nil)), http.StatusUnauthorized},
+		{"not valid yet", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("nbf", now+120)), http.StatusUnauthorized},
+		{"other issuer", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("iss", "https://evil.example.com")), http.StatusUnauthorized},
+		{"other audience", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("aud", "other")), http.StatusUnauthorized},
+		{"unknown user", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("preferred_username", "carol")), http.StatusUnauthorized},
+		{"without username", "Bearer " + issuer.sign(t, "RS256", "rsa", claims("preferred_username", nil)), http.StatusUnauthorized},
+		{"malformed", "Bearer abc", http.StatusUnauthorized},
+		{"basic auth", "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:password")), http.StatusMultiStatus},
+		{"none", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PROPFIND", "/", nil)
+			req.Header.Set("Depth", "0")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Errorf("PROPFIND = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// the keys are fetched once, unknown keys are fetched again only after a minute
+	if got := atomic.LoadInt64(&issuer.fetches); got != 1 {
+		t.Errorf("keys fetched %d times, want 1", got)
+	}
+	if _, err := cfg.OIDC.signingKeys("other", time.Now().Add(2*time.Minute)); err == nil || atomic.LoadInt64(&issuer.fetches) != 2 {
+		t.Errorf("signingKeys() of unknown key = %v after %d fetches, want an error after 2", err, atomic.LoadInt64(&issuer.fetches))
+	}
+
+	req := httptest.NewRequest("PROPFIND", "/", nil)
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	if got := strings.Join(w.Header()["Www-Authenticate"], ", "); got != "Bearer realm=dave, Basic realm=dave" {
+		t.Errorf("challenges = %s, want bearer and basic", got)
+	}
+	req.Header.Set("Authorization", "Bearer abc")
+	w = httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, `error="invalid_token"`) {
+		t.Errorf("challenge = %s, want invalid_token", got)
+	}
+}
+
+func TestCheckOIDC(t *testing.T) {
+	tests := []struct {
+		name    string
+		oidc    *OIDC
+		wantErr bool
+	}{
+		{"disabled", nil, false},
+		{"missing issuer", &OIDC{Audience: "dave"}, true},
+		{"missing audience", &OIDC{Issuer: "https://id.example.com"}, true},
+		{"invalid JWKS URL", &OIDC{Issuer: "https://id.example.com", Audience: "dave", JWKSURL: "keys"}, true},
+		{"valid", &OIDC{Issuer: "https://id.example.com/realms/dave", Audience: "dave"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (&Config{OIDC: tt.oidc}).checkOIDC(); (err != nil) != tt.wantErr {
+				t.Errorf("checkOIDC() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
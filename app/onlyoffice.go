@@ -0,0 +1,365 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Settings of the OnlyOffice integration
+const (
+	defaultOnlyOfficeTokenTTL = 10 * time.Hour
+	onlyOfficeTimeout         = time.Minute
+	onlyOfficePrefix          = "/onlyoffice/"
+)
+
+var onlyOfficeClient = &http.Client{Timeout: onlyOfficeTimeout}
+
+// onlyOfficeTypes maps the extensions of the documents to the editors of the Document
+// Server. Documents of the other extensions are opened for viewing only.
+var onlyOfficeTypes = map[string]string{
+	"doc": "word", "docm": "word", "docx": "word", "dot": "word", "dotx": "word", "epub": "word",
+	"htm": "word", "html": "word", "odt": "word", "ott": "word", "pdf": "word", "rtf": "word",
+	"txt": "word", "xps": "word",
+	"csv": "cell", "ods": "cell", "ots": "cell", "xls": "cell", "xlsm": "cell", "xlsx": "cell",
+	"xlt": "cell", "xltx": "cell",
+	"odp": "slide", "otp": "slide", "pot": "slide", "potx": "slide", "pps": "slide",
+	"ppsx": "slide", "ppt": "slide", "pptm": "slide", "pptx": "slide",
+}
+
+var onlyOfficeEditable = map[string]bool{
+	"csv": true, "docm": true, "docx": true, "odp": true, "ods": true, "odt": true, "pptm": true,
+	"pptx": true, "rtf": true, "txt": true, "xlsm": true, "xlsx": true,
+}
+
+// The states of a document reported to the callback, which need an action
+const (
+	onlyOfficeMustSave    = 2
+	onlyOfficeSaveError   = 3
+	onlyOfficeForceSave   = 6
+	onlyOfficeForceFailed = 7
+)
+
+// OnlyOffice opens documents in the editors of an OnlyOffice Document Server. A file is
+// opened with the query ?onlyoffice=edit or ?onlyoffice=view, the Document Server then
+// downloads it below /onlyoffice/ and posts the edited document to the callback there.
+type OnlyOffice struct {
+	// ServerURL is the URL of the Document Server, which serves the editors.
+	ServerURL string
+
+	// HostURL is the URL of dave including the prefix as reached by the Document Server. It
+	// defaults to the URL the browser used.
+	HostURL string
+
+	// Secret is the JWT secret of the Document Server. It signs the configurations of the
+	// editors and the links of the files, and authenticates the callbacks of the server.
+	Secret   string
+	TokenTTL time.Duration
+}
+
+// onlyOfficeToken is the content of the token of the links to a file and its callback.
+type onlyOfficeToken struct {
+	User    string `json:"u,omitempty"`
+	Path    string `json:"p"`
+	Key     string `json:"k"`
+	Write   bool   `json:"w,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// onlyOfficeCallback is the body of a callback of the Document Server.
+type onlyOfficeCallback struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	URL    string `json:"url"`
+	Token  string `json:"token,omitempty"`
+}
+
+var onlyOfficeLaunchPage = template.Must(template.New("onlyoffice").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>html, body { margin: 0; height: 100%; }</style>
+<script src="{{.API}}"></script>
+</head>
+<body>
+<div id="editor"></div>
+<script>new DocsAPI.DocEditor("editor", {{.Config}});</script>
+</body>
+</html>
+`))
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signJWT returns a JSON web token of the claims signed with HS256, which is the algorithm
+// of the Document Server.
+func signJWT(secret string, claims interface{}) string {
+	data, _ := json.Marshal(claims)
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + jwtSignature(secret, payload)
+}
+
+// parseJWT verifies a JSON web token signed with HS256 and decodes its claims.
+func parseJWT(secret, token string, claims interface{}) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(jwtSignature(secret, parts[0]+"."+parts[1]))) {
+		return false
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "HS256" {
+		return false
+	}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	return err == nil && json.Unmarshal(data, claims) == nil
+}
+
+func jwtSignature(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseToken verifies the signature and the expiry of the token of a link.
+func (oo *OnlyOffice) parseToken(token string, now time.Time) (*onlyOfficeToken, bool) {
+	var t onlyOfficeToken
+	if !parseJWT(oo.Secret, token, &t) || now.Unix() > t.Expires {
+		return nil, false
+	}
+	return &t, true
+}
+
+// parseCallback verifies that a callback has been signed by the Document Server. The
+// server sends the signed callback either in the body or in the Authorization header.
+func (oo *OnlyOffice) parseCallback(r *http.Request) (*onlyOfficeCallback, bool) {
+	var body onlyOfficeCallback
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, false
+	}
+	if body.Token != "" {
+		var cb onlyOfficeCallback
+		return &cb, parseJWT(oo.Secret, body.Token, &cb)
+	}
+	var header struct {
+		Payload onlyOfficeCallback `json:"payload"`
+	}
+	bearer := r.Header.Get("Authorization")
+	if !strings.HasPrefix(bearer, "Bearer ") || !parseJWT(oo.Secret, strings.TrimPrefix(bearer, "Bearer "), &header) {
+		return nil, false
+	}
+	return &header.Payload, true
+}
+
+// onlyOfficeKey returns the key of a version of a document. The Document Server shares the
+// editing session of a key, so it's derived from the physical path and the version.
+func onlyOfficeKey(name string, fi os.FileInfo) string {
+	sum := sha256.Sum256([]byte(name + "\x00" + wopiVersion(fi)))
+	return base64.RawURLEncoding.EncodeToString(sum[:15])
+}
+
+// serveOnlyOfficeLaunch answers a GET of a file with the query onlyoffice=edit or
+// onlyoffice=view by a page, which opens the file in the editor of the Document Server. It
+// returns whether the request has been handled.
+func (a *App) serveOnlyOfficeLaunch(w http.ResponseWriter, r *http.Request) bool {
+	oo := a.Config.OnlyOffice
+	mode := r.URL.Query().Get("onlyoffice")
+	if oo == nil || r.Method != http.MethodGet || mode == "" {
+		return false
+	}
+	if mode != "edit" && mode != "view" {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+	if oo.Secret == "" {
+		log.Error("OnlyOffice requires the JWT secret of the Document Server")
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return true
+	}
+
+	ctx := r.Context()
+	if !strings.HasPrefix(r.URL.Path, a.Handler.Prefix) {
+		http.NotFound(w, r)
+		return true
+	}
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, a.Handler.Prefix))
+	fi, err := a.Handler.FileSystem.Stat(ctx, name)
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return true
+	}
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	docType, ok := onlyOfficeTypes[ext]
+	if !ok {
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return true
+	}
+
+	ttl := oo.TokenTTL
+	if ttl <= 0 {
+		ttl = defaultOnlyOfficeTokenTTL
+	}
+	user := "anonymous"
+	t := onlyOfficeToken{
+		Path:    name,
+		Key:     onlyOfficeKey(Dir{Config: a.Config}.resolve(ctx, name), fi),
+		Write:   mode == "edit" && onlyOfficeEditable[ext] && !a.Config.dryRun() && !a.Config.ReadOnly(),
+		Expires: time.Now().Add(ttl).Unix(),
+	}
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		t.User, user = authInfo.Username, authInfo.Username
+	}
+	token := url.QueryEscape(signJWT(oo.Secret, t))
+
+	host := oo.HostURL
+	if host == "" {
+		host = a.baseURL(r)
+	}
+	host = strings.TrimSuffix(host, "/") + onlyOfficePrefix
+	editorConfig := map[string]interface{}{
+		"mode": "view",
+		"user": map[string]string{"id": user, "name": user},
+	}
+	if t.Write {
+		editorConfig["mode"] = "edit"
+		editorConfig["callbackUrl"] = host + "callback?token=" + token
+	}
+	config := map[string]interface{}{
+		"document": map[string]interface{}{
+			"fileType":    ext,
+			"key":         t.Key,
+			"title":       path.Base(name),
+			"url":         host + "file?token=" + token,
+			"permissions": map[string]bool{"edit": t.Write},
+		},
+		"documentType": docType,
+		"editorConfig": editorConfig,
+		"width":        "100%",
+		"height":       "100%",
+	}
+	config["token"] = signJWT(oo.Secret, config)
+	traceStep(ctx, "opening %s in OnlyOffice", name)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = onlyOfficeLaunchPage.Execute(w, map[string]interface{}{
+		"Name":   path.Base(name),
+		"API":    strings.TrimSuffix(oo.ServerURL, "/") + "/web-apps/apps/api/documents/api.js",
+		"Config": config,
+	})
+	if err != nil {
+		log.WithError(err).Error("Error writing OnlyOffice page")
+	}
+	return true
+}
+
+// serveOnlyOffice serves the file and the callback of an editor for the Document Server,
+// which authenticates with the token of the links instead of the credentials of the user. It
+// returns whether the request has been handled.
+func (a *App) serveOnlyOffice(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	oo := a.Config.OnlyOffice
+	if oo == nil || oo.Secret == "" {
+		return false
+	}
+	p, ok := a.relativePath(r)
+	if !ok || !strings.HasPrefix(p, onlyOfficePrefix) {
+		return false
+	}
+
+	token, ok := oo.parseToken(r.URL.Query().Get("token"), time.Now())
+	if !ok {
+		traceStep(ctx, "invalid or expired OnlyOffice token")
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return true
+	}
+	traceStep(ctx, "authenticated OnlyOffice request of user %s for %s", token.User, token.Path)
+	a.serveAs(ctx, w, r, token.User, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case p == onlyOfficePrefix+"file" && r.Method == http.MethodGet:
+			a.getOnlyOfficeFile(w, r, token)
+		case p == onlyOfficePrefix+"callback" && r.Method == http.MethodPost && token.Write:
+			a.saveOnlyOfficeFile(w, r, token)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return true
+}
+
+func (a *App) getOnlyOfficeFile(w http.ResponseWriter, r *http.Request, token *onlyOfficeToken) {
+	f, err := a.Handler.FileSystem.OpenFile(r.Context(), token.Path, os.O_RDONLY, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// saveOnlyOfficeFile handles a callback of the Document Server. Once all users closed the
+// editor or one forced a save, the edited document is downloaded from the server and
+// replaces the file.
+func (a *App) saveOnlyOfficeFile(w http.ResponseWriter, r *http.Request, token *onlyOfficeToken) {
+	oo := a.Config.OnlyOffice
+	cb, ok := oo.parseCallback(r)
+	if !ok || cb.Key != token.Key {
+		traceStep(r.Context(), "OnlyOffice callback isn't signed by the Document Server")
+		writeJSON(w, http.StatusUnauthorized, map[string]int{"error": 1})
+		return
+	}
+
+	switch cb.Status {
+	case onlyOfficeMustSave, onlyOfficeForceSave:
+		if err := a.downloadOnlyOfficeFile(r.Context(), cb.URL, token.Path); err != nil {
+			log.WithField("path", token.Path).WithError(err).Error("Error saving OnlyOffice document")
+			writeJSON(w, http.StatusOK, map[string]int{"error": 1})
+			return
+		}
+		traceStep(r.Context(), "saved %s edited in OnlyOffice", token.Path)
+	case onlyOfficeSaveError, onlyOfficeForceFailed:
+		log.WithField("path", token.Path).WithField("status", cb.Status).Warn("Document Server failed to save OnlyOffice document")
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"error": 0})
+}
+
+// downloadOnlyOfficeFile replaces the content of a file by the document of the Document
+// Server.
+func (a *App) downloadOnlyOfficeFile(ctx context.Context, src, name string) error {
+	resp, err := onlyOfficeClient.Get(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download of %s failed with %s", src, resp.Status)
+	}
+
+	f, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
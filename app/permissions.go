@@ -0,0 +1,386 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Names of the built-in permission templates
+const (
+	TemplateReadOnly = "readonly"
+	TemplateDropbox  = "dropbox"
+	TemplateFull     = "full"
+)
+
+var errPermissionDenied = errors.New("permission denied")
+
+// Permissions allow reading files, writing files and directories, deleting them and listing
+// directories. A set of permissions brings the ones of its Template, unset permissions are
+// denied then. Set permissions override the ones of the template.
+type Permissions struct {
+	Template string `json:"template,omitempty" yaml:",omitempty"`
+	Read     *bool  `json:"read,omitempty" yaml:",omitempty"`
+	Write    *bool  `json:"write,omitempty" yaml:",omitempty"`
+	Delete   *bool  `json:"delete,omitempty" yaml:",omitempty"`
+	List     *bool  `json:"list,omitempty" yaml:",omitempty"`
+}
+
+// PermissionRule overrides the permissions of a user for the paths matching Path, a pattern
+// like /archive/*.pdf as seen by the user. A pattern ending with /** matches the directory and
+// everything beneath it. A rule with a template replaces the permissions by the ones of the
+// template, before the permissions set by the rule override them.
+type PermissionRule struct {
+	Path        string `json:"path"`
+	Permissions `yaml:",inline" mapstructure:",squash"`
+}
+
+// matches reports, whether the rule applies to the path of the user.
+func (r *PermissionRule) matches(name string) bool {
+	pattern := r.Path
+	if !strings.HasSuffix(pattern, "/**") {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	}
+	pattern = strings.TrimSuffix(pattern, "/**")
+	if pattern == "" {
+		return true
+	}
+	for ; name != "/"; name = path.Dir(name) {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// access is the resolved permissions of a user.
+type access struct {
+	read, write, delete, list bool
+}
+
+var fullAccess = access{read: true, write: true, delete: true, list: true}
+
+// builtinTemplates are the templates, which exist unless the configuration replaces them.
+var builtinTemplates = map[string]access{
+	TemplateReadOnly: {read: true, list: true},
+	TemplateDropbox:  {write: true},
+	TemplateFull:     fullAccess,
+}
+
+// overlay returns the access with the set permissions replaced.
+func (p *Permissions) overlay(a access) access {
+	if p == nil {
+		return a
+	}
+	set := func(v *bool, current bool) bool {
+		if v == nil {
+			return current
+		}
+		return *v
+	}
+	return access{
+		read:   set(p.Read, a.read),
+		write:  set(p.Write, a.write),
+		delete: set(p.Delete, a.delete),
+		list:   set(p.List, a.list),
+	}
+}
+
+// union returns the permissions granted by either access.
+func (a access) union(b access) access {
+	return access{read: a.read || b.read, write: a.write || b.write, delete: a.delete || b.delete, list: a.list || b.list}
+}
+
+// template returns the access of the named template. cfg.usersMu must be held.
+func (cfg *Config) template(name string) (access, bool) {
+	if t, ok := cfg.PermissionTemplates[name]; ok {
+		if t == nil {
+			return access{}, true
+		}
+		return t.overlay(access{}), true
+	}
+	a, ok := builtinTemplates[name]
+	return a, ok
+}
+
+// resolvePermissions returns the access of the permissions, an empty template grants nothing without a
+// template. cfg.usersMu must be held.
+func (cfg *Config) resolvePermissions(p *Permissions) access {
+	var base access
+	if p != nil && p.Template != "" {
+		base, _ = cfg.template(p.Template)
+	}
+	return p.overlay(base)
+}
+
+// access returns the permissions of the user for the path as seen by the user. Users without
+// a template and groups have full access, unless they restrict single permissions. Otherwise
+// the access of the template and the groups is combined, before the permissions set for the
+// user override it. Within an export restricted to its users, the permissions of the user for
+// the export replace them. The matching rules of the user override them in their order at
+// last.
+func (cfg *Config) access(username, name string) access {
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+
+	export := cfg.exportAt(name)
+	if export != nil && !export.restricted() {
+		export = nil
+	}
+	user := cfg.Users[username]
+	if user == nil {
+		user = cfg.LDAP.user(username)
+	}
+	if user == nil {
+		if export != nil {
+			return cfg.exportAccess(export, username)
+		}
+		return fullAccess
+	}
+	var a access
+	if export != nil {
+		a = cfg.exportAccess(export, username)
+	} else if user.Template == "" && len(user.Groups) == 0 {
+		a = user.Permissions.overlay(fullAccess)
+	} else {
+		if user.Template != "" {
+			a, _ = cfg.template(user.Template)
+		}
+		for _, group := range user.Groups {
+			a = a.union(cfg.resolvePermissions(cfg.Groups[group]))
+		}
+		a = user.Permissions.overlay(a)
+	}
+	for _, rule := range user.Rules {
+		if rule == nil || !rule.matches(name) {
+			continue
+		}
+		if rule.Template != "" {
+			a, _ = cfg.template(rule.Template)
+		}
+		a = rule.Permissions.overlay(a)
+	}
+	return a
+}
+
+// restrictsPermissions reports, whether the permissions of any user are restricted.
+func (cfg *Config) restrictsPermissions() bool {
+	if cfg.LDAP != nil && len(cfg.LDAP.Groups) > 0 {
+		return true
+	}
+	for _, m := range cfg.Exports {
+		if m != nil && m.restricted() {
+			return true
+		}
+	}
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	for _, user := range cfg.Users {
+		if user != nil && (user.Permissions != Permissions{} || len(user.Groups) > 0 || len(user.Rules) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPermissions verifies, that the templates and groups referenced by the users, groups,
+// templates and rules exist and the patterns of the rules are valid. Templates can't be based
+// on templates.
+func (cfg *Config) checkPermissions() error {
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	if err := checkPermissionReferences(cfg.PermissionTemplates, cfg.Groups, cfg.Users); err != nil {
+		return err
+	}
+	if g := cfg.Guest; g != nil && g.Template != "" {
+		if _, ok := cfg.template(g.Template); !ok {
+			return fmt.Errorf("guest references unknown permission template %s", g.Template)
+		}
+	}
+	for _, m := range cfg.Exports {
+		if m == nil {
+			continue
+		}
+		for _, name := range permissionNames(m.Users) {
+			if p := m.Users[name]; p != nil && p.Template != "" {
+				if _, ok := cfg.template(p.Template); !ok {
+					return fmt.Errorf("user %s of export %s references unknown permission template %s", name, m.Path, p.Template)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkUserPermissions verifies the references of a user, which is about to be saved.
+func (cfg *Config) checkUserPermissions(name string, user *UserInfo) error {
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	return checkPermissionReferences(cfg.PermissionTemplates, cfg.Groups, map[string]*UserInfo{name: user})
+}
+
+func checkPermissionReferences(templates map[string]*Permissions, groups map[string]*Permissions, users map[string]*UserInfo) error {
+	exists := func(name string) bool {
+		if _, ok := templates[name]; ok {
+			return true
+		}
+		_, ok := builtinTemplates[name]
+		return ok
+	}
+	for _, name := range permissionNames(templates) {
+		if t := templates[name]; t != nil && t.Template != "" {
+			return fmt.Errorf("permission template %s must not be based on template %s", name, t.Template)
+		}
+	}
+	for _, name := range permissionNames(groups) {
+		if g := groups[name]; g != nil && g.Template != "" && !exists(g.Template) {
+			return fmt.Errorf("group %s references unknown permission template %s", name, g.Template)
+		}
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		user := users[name]
+		if user == nil {
+			continue
+		}
+		if user.Template != "" && !exists(user.Template) {
+			return fmt.Errorf("user %s references unknown permission template %s", name, user.Template)
+		}
+		for _, group := range user.Groups {
+			if _, ok := groups[group]; !ok {
+				return fmt.Errorf("user %s references unknown group %s", name, group)
+			}
+		}
+		for _, rule := range user.Rules {
+			if rule == nil {
+				continue
+			}
+			if _, err := path.Match(rule.Path, "/"); err != nil || !strings.HasPrefix(rule.Path, "/") {
+				return fmt.Errorf("invalid path %q of a permission rule of user %s", rule.Path, name)
+			}
+			if rule.Template != "" && !exists(rule.Template) {
+				return fmt.Errorf("permission rule %s of user %s references unknown permission template %s", rule.Path, name, rule.Template)
+			}
+		}
+	}
+	return nil
+}
+
+// permissionNames returns the names of the templates or groups in order, so validation errors
+// are reproducible.
+func permissionNames(m map[string]*Permissions) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// permitted reports, whether the authenticated user has the permission selected by allowed
+// for the physical path. Unauthenticated requests are restricted by other means.
+func (d Dir) permitted(ctx context.Context, name string, allowed func(access) bool) bool {
+	return d.Config.permitted(ctx, d.userPath(ctx, name), allowed)
+}
+
+// permitted reports, whether the authenticated user or the guest has the permission selected
+// by allowed for the path as seen by the user.
+func (cfg *Config) permitted(ctx context.Context, name string, allowed func(access) bool) bool {
+	if isGuest(ctx) {
+		return allowed(cfg.guestAccess())
+	}
+	authInfo := AuthFromContext(ctx)
+	if authInfo == nil || !authInfo.Authenticated {
+		return true
+	}
+	return allowed(cfg.access(authInfo.Username, name))
+}
+
+// userPath returns the path of the physical path as seen by the authenticated user, the
+// inverse of resolve.
+func (d Dir) userPath(ctx context.Context, name string) string {
+	if exported, ok := d.Config.exportPath(name); ok {
+		return exported
+	}
+	if shared := d.Config.SharedFolder; shared.contains(name) {
+		rel, _ := filepath.Rel(filepath.Clean(shared.Dir), name)
+		return path.Join("/"+shared.name(), filepath.ToSlash(rel))
+	}
+	root := filepath.Clean(d.Config.Dir)
+	prefix := "/"
+	if d.Versions.contains(name) {
+		root, prefix = d.Versions.dir, "/"+d.Versions.settings.name()
+	}
+	root = filepath.Join(root, d.userSubdir(ctx))
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return "/"
+	}
+	return path.Join(prefix, filepath.ToSlash(rel))
+}
+
+// checkPermission returns errPermissionDenied, if the authenticated user lacks the permission
+// selected by allowed for the physical path.
+func (d Dir) checkPermission(ctx context.Context, name, op string, allowed func(access) bool) error {
+	if d.permitted(ctx, name, allowed) {
+		return nil
+	}
+	traceStep(ctx, "user %s isn't permitted to %s %s", AuthFromContext(ctx).Username, op, name)
+	rejectionFromContext(ctx).reject(deniedStatus(ctx))
+	return errPermissionDenied
+}
+
+// checkOpenPermission checks the permission of opening the physical path. Writes require the
+// write permission and reads of files the read permission. Directories can always be opened,
+// so their properties are available, listing them is checked by openPermissionDir.
+func (d Dir) checkOpenPermission(ctx context.Context, name string, flag int) error {
+	if flag&writeFlags != 0 {
+		return d.checkPermission(ctx, name, "write", func(a access) bool { return a.write })
+	}
+	return d.checkPermission(ctx, name, "read", func(a access) bool {
+		if a.read {
+			return true
+		}
+		fi, err := d.Config.storage().Stat(name)
+		return err == nil && fi.IsDir()
+	})
+}
+
+// openPermissionDir wraps directories, which the authenticated user isn't permitted to list.
+func (d Dir) openPermissionDir(ctx context.Context, f webdav.File, name string, flag int) webdav.File {
+	if flag&writeFlags != 0 || d.permitted(ctx, name, func(a access) bool { return a.list }) {
+		return f
+	}
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		return f
+	}
+	return &unlistedDir{File: f, ctx: ctx, name: name}
+}
+
+// unlistedDir is a directory, whose members are hidden from the user. Like a locked encrypted
+// folder it appears empty.
+type unlistedDir struct {
+	webdav.File
+	ctx  context.Context
+	name string
+}
+
+func (d *unlistedDir) Readdir(count int) ([]os.FileInfo, error) {
+	traceStep(d.ctx, "user %s isn't permitted to list %s", AuthFromContext(d.ctx).Username, d.name)
+	if count > 0 {
+		return nil, io.EOF
+	}
+	return nil, nil
+}
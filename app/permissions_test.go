@@ -0,0 +1,259 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestConfigAccess(t *testing.T) {
+	yes, no := true, false
+	cfg := &Config{
+		PermissionTemplates: map[string]*Permissions{
+			"upload":   {Read: &yes, Write: &yes, List: &yes},
+			"readonly": {Read: &yes},
+		},
+		Groups: map[string]*Permissions{
+			"editors": {Template: "upload", Delete: &yes},
+			"guests":  {Template: TemplateDropbox},
+		},
+		Users: map[string]*UserInfo{
+			"admin":   {},
+			"nodel":   {Permissions: Permissions{Delete: &no}},
+			"viewer":  {Permissions: Permissions{Template: TemplateReadOnly}},
+			"dropbox": {Permissions: Permissions{Template: TemplateDropbox}},
+			"full":    {Permissions: Permissions{Template: TemplateFull, Delete: &no}},
+			"editor":  {Groups: []string{"editors"}},
+			"mixed":   {Permissions: Permissions{Template: "readonly"}, Groups: []string{"guests"}},
+			"limited": {Permissions: Permissions{Write: &no}, Groups: []string{"editors"}},
+		},
+	}
+	tests := []struct {
+		user string
+		want access
+	}{
+		{"unknown", fullAccess},
+		{"admin", fullAccess},
+		{"nodel", access{read: true, write: true, list: true}},
+		// the configured template replaces the built-in one
+		{"viewer", access{read: true}},
+		{"dropbox", access{write: true}},
+		{"full", access{read: true, write: true, list: true}},
+		{"editor", fullAccess},
+		{"mixed", access{read: true, write: true}},
+		{"limited", access{read: true, delete: true, list: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			if got := cfg.access(tt.user, "/"); got != tt.want {
+				t.Errorf("access() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Config
+		wantErr bool
+	}{
+		{"none", &Config{Users: map[string]*UserInfo{"a": {}}}, false},
+		{"builtin template", &Config{Users: map[string]*UserInfo{"a": {Permissions: Permissions{Template: TemplateReadOnly}}}}, false},
+		{"unknown template", &Config{Users: map[string]*UserInfo{"a": {Permissions: Permissions{Template: "x"}}}}, true},
+		{"unknown group", &Config{Users: map[string]*UserInfo{"a": {Groups: []string{"x"}}}}, true},
+		{"group with unknown template", &Config{Groups: map[string]*Permissions{"g": {Template: "x"}}}, true},
+		{"nested template", &Config{PermissionTemplates: map[string]*Permissions{"t": {Template: TemplateFull}}}, true},
+		{"relative rule", &Config{Users: map[string]*UserInfo{"a": {Rules: []*PermissionRule{{Path: "docs/**"}}}}}, true},
+		{"malformed rule", &Config{Users: map[string]*UserInfo{"a": {Rules: []*PermissionRule{{Path: "/[docs"}}}}}, true},
+		{"rule with unknown template", &Config{Users: map[string]*UserInfo{"a": {Rules: []*PermissionRule{
+			{Path: "/**", Permissions: Permissions{Template: "x"}}}}}}, true},
+		{"custom template", &Config{
+			PermissionTemplates: map[string]*Permissions{"t": {}},
+			Groups:              map[string]*Permissions{"g": {Template: "t"}},
+			Users:               map[string]*UserInfo{"a": {Permissions: Permissions{Template: "t"}, Groups: []string{"g"}}},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.checkPermissions(); (err != nil) != tt.wantErr {
+				t.Errorf("checkPermissions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPermissionsWebDAV(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "docs"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "docs", "a.txt"), []byte("hello"), 0600)
+
+	cfg := &Config{
+		Dir:   tmpDir,
+		Realm: "dave",
+		Users: map[string]*UserInfo{
+			"viewer":  {Password: GenHash([]byte("password")), Permissions: Permissions{Template: TemplateReadOnly}},
+			"dropbox": {Password: GenHash([]byte("password")), Permissions: Permissions{Template: TemplateDropbox}},
+		},
+	}
+	a := &App{
+		Config: cfg,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	do := func(user, method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth(user, "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	tests := []struct {
+		user, method, target string
+		header               []string
+		want                 int
+	}{
+		{"viewer", "GET", "/docs/a.txt", nil, http.StatusOK},
+		{"viewer", "PROPFIND", "/docs", []string{"Depth", "1"}, http.StatusMultiStatus},
+		{"viewer", "PUT", "/docs/b.txt", nil, http.StatusForbidden},
+		{"viewer", "MKCOL", "/new", nil, http.StatusForbidden},
+		{"viewer", "DELETE", "/docs/a.txt", nil, http.StatusForbidden},
+		{"viewer", "MOVE", "/docs/a.txt", []string{"Destination", "/docs/c.txt"}, http.StatusForbidden},
+		{"dropbox", "PUT", "/docs/b.txt", nil, http.StatusCreated},
+		{"dropbox", "GET", "/docs/a.txt", nil, http.StatusForbidden},
+		{"dropbox", "PROPFIND", "/docs", []string{"Depth", "0"}, http.StatusMultiStatus},
+		{"dropbox", "DELETE", "/docs/b.txt", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.method == "PUT" {
+			body = "data"
+		}
+		if got := do(tt.user, tt.method, tt.target, body, tt.header...).Code; got != tt.want {
+			t.Errorf("%s %s by %s = %v, want %v", tt.method, tt.target, tt.user, got, tt.want)
+		}
+	}
+	if w := do("dropbox", "PROPFIND", "/docs", "", "Depth", "1"); w.Code != http.StatusMultiStatus || strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("PROPFIND of the directory by dropbox = %v %s, want no members", w.Code, w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "docs", "a.txt")); err != nil {
+		t.Errorf("file of the read-only user got removed: %v", err)
+	}
+}
+
+func TestPermissionRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"/**", "/", true},
+		{"/**", "/a/b", true},
+		{"/projects/**", "/projects", true},
+		{"/projects/**", "/projects/a/b.txt", true},
+		{"/projects/**", "/projectsx", false},
+		{"/projects/**", "/", false},
+		{"/*/drafts/**", "/a/drafts/b.txt", true},
+		{"/*.pdf", "/a.pdf", true},
+		{"/*.pdf", "/docs/a.pdf", false},
+	}
+	for _, tt := range tests {
+		if got := (&PermissionRule{Path: tt.pattern}).matches(tt.name); got != tt.want {
+			t.Errorf("matches(%s, %s) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionRules(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice", "archive"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice", "projects"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "shared"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "alice", "archive", "a.txt"), []byte("hello"), 0600)
+
+	yes, no := true, false
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:          filepath.Join(tmpDir, "data"),
+		Realm:        "dave",
+		SharedFolder: &SharedFolder{Dir: filepath.Join(tmpDir, "shared")},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, Rules: []*PermissionRule{
+				{Path: "/archive/**", Permissions: Permissions{Write: &no, Delete: &no}},
+				{Path: "/archive/drafts/**", Permissions: Permissions{Write: &yes}},
+				{Path: "/projects/**", Permissions: Permissions{Template: TemplateDropbox}},
+			}},
+		},
+	}
+	if err := cfg.checkPermissions(); err != nil {
+		t.Fatalf("checkPermissions() error = %v", err)
+	}
+	if want := (access{read: true, list: true}); cfg.access("alice", "/archive/a.txt") != want {
+		t.Errorf("access() of /archive/a.txt = %+v, want %+v", cfg.access("alice", "/archive/a.txt"), want)
+	}
+	if want := (access{read: true, write: true, list: true}); cfg.access("alice", "/archive/drafts/a.txt") != want {
+		t.Errorf("access() of /archive/drafts/a.txt = %+v, want %+v", cfg.access("alice", "/archive/drafts/a.txt"), want)
+	}
+	if cfg.access("alice", "/other.txt") != fullAccess {
+		t.Errorf("access() of /other.txt = %+v, want full access", cfg.access("alice", "/other.txt"))
+	}
+
+	a := &App{
+		Config: cfg,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/archive/a.txt", http.StatusOK},
+		{"PUT", "/archive/a.txt", http.StatusForbidden},
+		{"DELETE", "/archive/a.txt", http.StatusForbidden},
+		{"MKCOL", "/archive/other", http.StatusForbidden},
+		{"MKCOL", "/archive/drafts", http.StatusCreated},
+		{"PUT", "/projects/b.txt", http.StatusCreated},
+		{"GET", "/projects/b.txt", http.StatusForbidden},
+		{"PUT", "/c.txt", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		body := ""
+		if tt.method == "PUT" {
+			body = "data"
+		}
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(body))
+		req.SetBasicAuth("alice", "password")
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		if w.Code != tt.want {
+			t.Errorf("%s %s = %v, want %v", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "alice", Authenticated: true})
+	d := Dir{Config: cfg}
+	if got := d.userPath(ctx, filepath.Join(tmpDir, "data", "alice", "archive", "a.txt")); got != "/archive/a.txt" {
+		t.Errorf("userPath() = %s, want /archive/a.txt", got)
+	}
+	if got := d.userPath(ctx, filepath.Join(tmpDir, "shared", "x")); got != "/_shared/x" {
+		t.Errorf("userPath() of the shared folder = %s, want /_shared/x", got)
+	}
+}
@@ -0,0 +1,406 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-hclog"
+	goplugin "github.com/hashicorp/go-plugin"
+	daveplugin "github.com/micromata/dave/plugin"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var errPluginDenied = errors.New("access denied by a plugin")
+
+// Plugin is an external binary extending dave, which is started with the server and talks to
+// it via RPC, see the package plugin. Kinds are the interfaces of the plugin which are used:
+// authenticator, authorizer, events and storage. Authenticators are asked for the passwords
+// of the configured users, which don't match their hash. Authorizers are asked for every
+// access of the file system and all of them have to allow it. Event handlers are notified of
+// its changes. A storage plugin replaces the directory for all frontends.
+type Plugin struct {
+	Path  string
+	Args  []string
+	Kinds []string
+
+	client        *goplugin.Client
+	authenticator daveplugin.Authenticator
+	authorizer    daveplugin.Authorizer
+	events        daveplugin.EventHandler
+	storage       daveplugin.Storage
+}
+
+// StartPlugins starts the plugin binaries and dispenses their kinds.
+func (cfg *Config) StartPlugins() error {
+	storages := 0
+	for _, p := range cfg.Plugins {
+		p.client = goplugin.NewClient(&goplugin.ClientConfig{
+			HandshakeConfig:  daveplugin.Handshake,
+			Plugins:          daveplugin.PluginSet(),
+			Cmd:              exec.Command(p.Path, p.Args...),
+			AllowedProtocols: []goplugin.Protocol{goplugin.ProtocolNetRPC},
+			Logger: hclog.New(&hclog.LoggerOptions{
+				Name:   p.Path,
+				Level:  hclog.Info,
+				Output: log.StandardLogger().Writer(),
+			}),
+		})
+		protocol, err := p.client.Client()
+		if err != nil {
+			return fmt.Errorf("error starting plugin %s: %s", p.Path, err)
+		}
+		if err := p.dispense(protocol); err != nil {
+			return fmt.Errorf("error dispensing plugin %s: %s", p.Path, err)
+		}
+		if p.storage != nil {
+			storages++
+		}
+		log.WithField("path", p.Path).WithField("kinds", p.Kinds).Info("Started plugin")
+	}
+	if storages > 1 {
+		return errors.New("only one storage plugin can be used")
+	}
+	return nil
+}
+
+// StopPlugins stops the plugin binaries.
+func (cfg *Config) StopPlugins() {
+	for _, p := range cfg.Plugins {
+		if p.client != nil {
+			p.client.Kill()
+		}
+	}
+}
+
+// dispense dispenses the kinds of the plugin from its connection.
+func (p *Plugin) dispense(protocol goplugin.ClientProtocol) error {
+	if len(p.Kinds) == 0 {
+		return errors.New("no kinds configured")
+	}
+	for _, kind := range p.Kinds {
+		raw, err := protocol.Dispense(kind)
+		if err != nil {
+			return err
+		}
+		switch impl := raw.(type) {
+		case daveplugin.Authenticator:
+			p.authenticator = impl
+		case daveplugin.Authorizer:
+			p.authorizer = impl
+		case daveplugin.EventHandler:
+			p.events = impl
+		case daveplugin.Storage:
+			p.storage = impl
+		}
+	}
+	return nil
+}
+
+// pluginAuthenticate returns whether an authenticator plugin accepts the password of the
+// user.
+func (cfg *Config) pluginAuthenticate(username, password string) bool {
+	for _, p := range cfg.Plugins {
+		if p.authenticator == nil {
+			continue
+		}
+		ok, err := p.authenticator.Authenticate(username, password)
+		if err != nil {
+			log.WithField("plugin", p.Path).WithField("user", username).WithError(err).Error("Error authenticating user by plugin")
+			continue
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAuthorizers returns whether accesses of the file system are authorized by plugins.
+func (cfg *Config) hasAuthorizers() bool {
+	for _, p := range cfg.Plugins {
+		if p.authorizer != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize returns errPluginDenied, if an authorizer plugin denies the access. Failing
+// plugins deny it as well.
+func (cfg *Config) authorize(ctx context.Context, access daveplugin.Access) error {
+	for _, p := range cfg.Plugins {
+		if p.authorizer == nil {
+			continue
+		}
+		ok, err := p.authorizer.Authorize(access)
+		if err != nil {
+			log.WithField("plugin", p.Path).WithField("path", access.Path).WithError(err).Error("Error authorizing access by plugin")
+		}
+		if err != nil || !ok {
+			traceStep(ctx, "%s of %s denied by plugin %s", access.Op, access.Path, p.Path)
+			rejectionFromContext(ctx).reject(http.StatusForbidden)
+			return errPluginDenied
+		}
+	}
+	return nil
+}
+
+// publish sends the event to the event handler plugins in the background.
+func (cfg *Config) publish(event daveplugin.Event) {
+	event.Time = time.Now()
+	for _, p := range cfg.Plugins {
+		if p.events == nil {
+			continue
+		}
+		go func(p *Plugin) {
+			if err := p.events.HandleEvent(event); err != nil {
+				log.WithField("plugin", p.Path).WithField("path", event.Path).WithError(err).Warn("Error handling event by plugin")
+			}
+		}(p)
+	}
+}
+
+// pluginPath returns the path of a physical file as seen by the plugins, which is relative
+// to the directory, or to its export below the path of the export.
+func (d Dir) pluginPath(name string) string {
+	if exported, ok := d.Config.exportPath(name); ok {
+		return exported
+	}
+	rel, err := filepath.Rel(filepath.Clean(d.Config.Dir), name)
+	if err != nil {
+		return ""
+	}
+	return path.Clean("/" + filepath.ToSlash(rel))
+}
+
+// authorize checks the access of a physical file with the authorizer plugins.
+func (d Dir) authorize(ctx context.Context, op, name, destination string) error {
+	if !d.Config.hasAuthorizers() {
+		return nil
+	}
+	access := daveplugin.Access{User: d.resolveUser(ctx), Op: op, Path: d.pluginPath(name)}
+	if destination != "" {
+		access.Destination = d.pluginPath(destination)
+	}
+	return d.Config.authorize(ctx, access)
+}
+
+// publish notifies the event handler plugins of a change of a physical file.
+func (d Dir) publish(ctx context.Context, typ, name, destination string) {
+	if len(d.Config.Plugins) == 0 {
+		return
+	}
+	event := daveplugin.Event{Type: typ, User: d.resolveUser(ctx), Path: d.pluginPath(name)}
+	if destination != "" {
+		event.Destination = d.pluginPath(destination)
+	}
+	d.Config.publish(event)
+}
+
+// eventFile notifies the event handler plugins and the webhooks of a written file when it's
+// closed.
+type eventFile struct {
+	webdav.File
+	close func(err error)
+}
+
+func (f *eventFile) Close() error {
+	err := f.File.Close()
+	f.close(err)
+	return err
+}
+
+// PluginStorage returns the file system of the storage plugin, or nil if there is none.
+func (cfg *Config) PluginStorage() webdav.FileSystem {
+	for _, p := range cfg.Plugins {
+		if p.storage != nil {
+			return &pluginFS{virtualFS: virtualFS{cfg: cfg}, storage: p.storage}
+		}
+	}
+	return nil
+}
+
+// virtualFS resolves the names and checks the access of the file systems, which don't store
+// the files in the directory itself. The names are resolved within the subdir of the user, the
+// checks of the directory besides the read-only mode, the authorizers and the permissions of
+// the guests don't apply.
+type virtualFS struct {
+	cfg *Config
+}
+
+// pluginFS is the file system of a storage plugin.
+type pluginFS struct {
+	virtualFS
+	storage daveplugin.Storage
+}
+
+// resolve returns the path of the storage of a name of the user.
+func (fs *virtualFS) resolve(ctx context.Context, name string) string {
+	if subdir := fs.cfg.guestSubdir(ctx); subdir != nil {
+		return path.Join("/", *subdir, path.Clean("/"+name))
+	}
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		if user := fs.cfg.User(authInfo.Username); user != nil && user.Subdir != nil {
+			return path.Join("/", *user.Subdir, path.Clean("/"+name))
+		}
+	}
+	return path.Clean("/" + name)
+}
+
+// check checks the read-only mode for writes and asks the authorizers.
+func (fs *virtualFS) check(ctx context.Context, op string, write bool, name, destination string) error {
+	if write && fs.cfg.ReadOnly() {
+		rejectionFromContext(ctx).reject(http.StatusForbidden)
+		return errReadOnly
+	}
+	if isGuest(ctx) && !guestPermits(fs.cfg.guestAccess(), op) {
+		traceStep(ctx, "guest isn't permitted to %s %s", op, name)
+		rejectionFromContext(ctx).reject(http.StatusUnauthorized)
+		return errPermissionDenied
+	}
+	if !fs.cfg.hasAuthorizers() {
+		return nil
+	}
+	return fs.cfg.authorize(ctx, daveplugin.Access{User: Dir{Config: fs.cfg}.resolveUser(ctx), Op: op, Path: name, Destination: destination})
+}
+
+func (fs *virtualFS) event(ctx context.Context, typ, name, destination string) {
+	fs.cfg.publish(daveplugin.Event{Type: typ, User: Dir{Config: fs.cfg}.resolveUser(ctx), Path: name, Destination: destination})
+}
+
+func (fs *pluginFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = fs.resolve(ctx, name)
+	if err := fs.check(ctx, daveplugin.OpMkdir, true, name, ""); err != nil {
+		return err
+	}
+	if err := fs.storage.Mkdir(name, perm); err != nil {
+		return err
+	}
+	fs.event(ctx, daveplugin.EventMkdir, name, "")
+	return nil
+}
+
+func (fs *pluginFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = fs.resolve(ctx, name)
+	write := flag&writeFlags != 0
+	op := daveplugin.OpRead
+	if write {
+		op = daveplugin.OpWrite
+	}
+	if err := fs.check(ctx, op, write, name, ""); err != nil {
+		return nil, err
+	}
+	handle, err := fs.storage.Open(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	f := &pluginFile{storage: fs.storage, handle: handle}
+	if !write {
+		return f, nil
+	}
+	return &eventFile{File: f, close: func(error) { fs.event(ctx, daveplugin.EventWrite, name, "") }}, nil
+}
+
+func (fs *pluginFS) RemoveAll(ctx context.Context, name string) error {
+	name = fs.resolve(ctx, name)
+	if name == "/" {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	if err := fs.check(ctx, daveplugin.OpDelete, true, name, ""); err != nil {
+		return err
+	}
+	if err := fs.storage.RemoveAll(name); err != nil {
+		return err
+	}
+	fs.event(ctx, daveplugin.EventDelete, name, "")
+	return nil
+}
+
+func (fs *pluginFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName, newName = fs.resolve(ctx, oldName), fs.resolve(ctx, newName)
+	if oldName == "/" || newName == "/" {
+		// Prohibit renaming from or to the virtual root directory.
+		return os.ErrInvalid
+	}
+	if err := fs.check(ctx, daveplugin.OpRename, true, oldName, newName); err != nil {
+		return err
+	}
+	if err := fs.storage.Rename(oldName, newName); err != nil {
+		return err
+	}
+	fs.event(ctx, daveplugin.EventRename, oldName, newName)
+	return nil
+}
+
+func (fs *pluginFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	fi, err := fs.storage.Stat(fs.resolve(ctx, name))
+	if err != nil {
+		return nil, err
+	}
+	return pluginFileInfo{fi}, nil
+}
+
+// pluginFile is a file opened by a storage plugin.
+type pluginFile struct {
+	storage daveplugin.Storage
+	handle  uint64
+}
+
+func (f *pluginFile) Read(p []byte) (int, error) {
+	data, err := f.storage.Read(f.handle, len(p))
+	n := copy(p, data)
+	if err == nil && n == 0 && len(p) > 0 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *pluginFile) Write(p []byte) (int, error) {
+	return f.storage.Write(f.handle, p)
+}
+
+func (f *pluginFile) Seek(offset int64, whence int) (int64, error) {
+	return f.storage.Seek(f.handle, offset, whence)
+}
+
+func (f *pluginFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.storage.Readdir(f.handle, count)
+	fis := make([]os.FileInfo, len(infos))
+	for i, fi := range infos {
+		fis[i] = pluginFileInfo{fi}
+	}
+	return fis, err
+}
+
+func (f *pluginFile) Stat() (os.FileInfo, error) {
+	fi, err := f.storage.StatHandle(f.handle)
+	if err != nil {
+		return nil, err
+	}
+	return pluginFileInfo{fi}, nil
+}
+
+func (f *pluginFile) Close() error {
+	return f.storage.Close(f.handle)
+}
+
+// pluginFileInfo is the os.FileInfo of a file of a storage plugin.
+type pluginFileInfo struct {
+	fi daveplugin.FileInfo
+}
+
+func (fi pluginFileInfo) Name() string       { return fi.fi.Name }
+func (fi pluginFileInfo) Size() int64        { return fi.fi.Size }
+func (fi pluginFileInfo) Mode() os.FileMode  { return fi.fi.Mode }
+func (fi pluginFileInfo) ModTime() time.Time { return fi.fi.ModTime }
+func (fi pluginFileInfo) IsDir() bool        { return fi.fi.Mode.IsDir() }
+func (fi pluginFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,309 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micromata/dave/plugin"
+	"golang.org/x/net/webdav"
+)
+
+// testPlugin implements all kinds of plugins. The events are appended to the file of the
+// environment variable DAVE_TEST_EVENTS, the storage keeps the files below the directory of
+// DAVE_TEST_STORAGE.
+type testPlugin struct {
+	mu      sync.Mutex
+	nextID  uint64
+	handles map[uint64]*os.File
+}
+
+func (p *testPlugin) Authenticate(username, password string) (bool, error) {
+	if password == "unavailable" {
+		return false, errors.New("directory unavailable")
+	}
+	return username == "alice" && password == "from-plugin", nil
+}
+
+func (p *testPlugin) Authorize(access plugin.Access) (bool, error) {
+	private := "/" + access.User + "/private"
+	return !strings.HasPrefix(access.Path, private) && !strings.HasPrefix(access.Destination, private), nil
+}
+
+func (p *testPlugin) HandleEvent(event plugin.Event) error {
+	f, err := os.OpenFile(os.Getenv("DAVE_TEST_EVENTS"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s %s %s %s\n", event.Type, event.User, event.Path, event.Destination)
+	return err
+}
+
+func (p *testPlugin) name(name string) string {
+	return filepath.Join(os.Getenv("DAVE_TEST_STORAGE"), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (p *testPlugin) file(handle uint64) *os.File {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.handles[handle]
+}
+
+func fileInfo(fi os.FileInfo) plugin.FileInfo {
+	return plugin.FileInfo{Name: fi.Name(), Size: fi.Size(), Mode: fi.Mode(), ModTime: fi.ModTime()}
+}
+
+func (p *testPlugin) Mkdir(name string, perm os.FileMode) error { return os.Mkdir(p.name(name), perm) }
+func (p *testPlugin) RemoveAll(name string) error               { return os.RemoveAll(p.name(name)) }
+func (p *testPlugin) Rename(oldName, newName string) error {
+	return os.Rename(p.name(oldName), p.name(newName))
+}
+
+func (p *testPlugin) Open(name string, flag int, perm os.FileMode) (uint64, error) {
+	f, err := os.OpenFile(p.name(name), flag, perm)
+	if err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	p.handles[p.nextID] = f
+	return p.nextID, nil
+}
+
+func (p *testPlugin) Read(handle uint64, n int) ([]byte, error) {
+	data := make([]byte, n)
+	n, err := p.file(handle).Read(data)
+	return data[:n], err
+}
+
+func (p *testPlugin) Write(handle uint64, data []byte) (int, error) {
+	return p.file(handle).Write(data)
+}
+
+func (p *testPlugin) Seek(handle uint64, offset int64, whence int) (int64, error) {
+	return p.file(handle).Seek(offset, whence)
+}
+
+func (p *testPlugin) Readdir(handle uint64, count int) ([]plugin.FileInfo, error) {
+	fis, err := p.file(handle).Readdir(count)
+	infos := make([]plugin.FileInfo, len(fis))
+	for i, fi := range fis {
+		infos[i] = fileInfo(fi)
+	}
+	return infos, err
+}
+
+func (p *testPlugin) StatHandle(handle uint64) (plugin.FileInfo, error) {
+	fi, err := p.file(handle).Stat()
+	if err != nil {
+		return plugin.FileInfo{}, err
+	}
+	return fileInfo(fi), nil
+}
+
+func (p *testPlugin) Close(handle uint64) error {
+	p.mu.Lock()
+	f := p.handles[handle]
+	delete(p.handles, handle)
+	p.mu.Unlock()
+	return f.Close()
+}
+
+func (p *testPlugin) Stat(name string) (plugin.FileInfo, error) {
+	fi, err := os.Stat(p.name(name))
+	if err != nil {
+		return plugin.FileInfo{}, err
+	}
+	return fileInfo(fi), nil
+}
+
+// TestHelperPlugin isn't a real test, it's the plugin binary started by the tests.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv("DAVE_TEST_PLUGIN") != "1" {
+		return
+	}
+	p := &testPlugin{handles: map[uint64]*os.File{}}
+	plugin.Serve(&plugin.Plugins{Authenticator: p, Authorizer: p, EventHandler: p, Storage: p})
+	os.Exit(0)
+}
+
+// startTestPlugin starts the test binary as plugin of the kinds.
+func startTestPlugin(t *testing.T, cfg *Config, kinds ...string) {
+	t.Setenv("DAVE_TEST_PLUGIN", "1")
+	cfg.Plugins = []*Plugin{{Path: os.Args[0], Args: []string{"-test.run=^TestHelperPlugin$"}, Kinds: kinds}}
+	if err := cfg.StartPlugins(); err != nil {
+		t.Fatalf("StartPlugins() error = %v", err)
+	}
+	t.Cleanup(cfg.StopPlugins)
+}
+
+// waitForEvents returns the events written by the plugin, once there are n of them.
+func waitForEvents(t *testing.T, file string, n int) []string {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		var events []string
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			events = append(events, strings.TrimSpace(scanner.Text()))
+		}
+		f.Close()
+		if len(events) >= n {
+			return events
+		}
+	}
+	t.Fatalf("plugin didn't receive %d events", n)
+	return nil
+}
+
+func TestPlugins(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice", "private"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "alice", "private", "secret.txt"), []byte("secret"), 0600)
+	events := filepath.Join(tmpDir, "events.log")
+	t.Setenv("DAVE_TEST_EVENTS", events)
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:   filepath.Join(tmpDir, "data"),
+		Realm: "dave",
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	startTestPlugin(t, cfg, plugin.KindAuthenticator, plugin.KindAuthorizer, plugin.KindEvents)
+	a := newQuotaApp(t, cfg)
+	do := func(method, target, password string, header ...string) int {
+		var body io.Reader
+		if method == "PUT" {
+			body = strings.NewReader("content")
+		}
+		req := httptest.NewRequest(method, target, body)
+		req.SetBasicAuth("alice", password)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w.Code
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		password string
+		header   []string
+		want     int
+	}{
+		{"password of the configuration", "PUT", "/a.txt", "password", nil, http.StatusCreated},
+		{"password of the plugin", "MKCOL", "/dir", "from-plugin", nil, http.StatusCreated},
+		{"wrong password", "GET", "/a.txt", "wrong", nil, http.StatusUnauthorized},
+		{"failing plugin", "GET", "/a.txt", "unavailable", nil, http.StatusUnauthorized},
+		{"denied read", "GET", "/private/secret.txt", "password", nil, http.StatusForbidden},
+		{"denied write", "PUT", "/private/b.txt", "password", nil, http.StatusForbidden},
+		{"denied move", "MOVE", "/a.txt", "password", []string{"Destination", "/private/a.txt"}, http.StatusForbidden},
+		{"move", "MOVE", "/a.txt", "password", []string{"Destination", "/dir/a.txt"}, http.StatusCreated},
+		{"delete", "DELETE", "/dir", "password", nil, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := do(tt.method, tt.target, tt.password, tt.header...); got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "data", "alice", "private", "b.txt")); err == nil {
+		t.Error("denied write created the file")
+	}
+
+	// the events are delivered in the background, in any order
+	got := strings.Join(waitForEvents(t, events, 4), "\n")
+	for _, want := range []string{
+		"write alice /alice/a.txt",
+		"mkdir alice /alice/dir",
+		"rename alice /alice/a.txt /alice/dir/a.txt",
+		"delete alice /alice/dir",
+	} {
+		if !strings.Contains(got+"\n", want+"\n") {
+			t.Errorf("events = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPluginStorage(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "storage", "bob"), 0700)
+	defer os.RemoveAll(tmpDir)
+	t.Setenv("DAVE_TEST_STORAGE", filepath.Join(tmpDir, "storage"))
+
+	subdir := "/bob"
+	cfg := &Config{
+		Dir:   filepath.Join(tmpDir, "unused"),
+		Realm: "dave",
+		Users: map[string]*UserInfo{
+			"bob": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	startTestPlugin(t, cfg, plugin.KindStorage)
+	fs := cfg.PluginStorage()
+	if fs == nil {
+		t.Fatal("PluginStorage() = nil, want the storage of the plugin")
+	}
+	a := &App{Config: cfg, Handler: &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}}
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("bob", "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	if w := do("MKCOL", "/docs", ""); w.Code != http.StatusCreated {
+		t.Errorf("MKCOL status = %v, want %v", w.Code, http.StatusCreated)
+	}
+	if w := do("PUT", "/docs/a.txt", "stored by the plugin"); w.Code != http.StatusCreated {
+		t.Errorf("PUT status = %v, want %v", w.Code, http.StatusCreated)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "storage", "bob", "docs", "a.txt")); string(data) != "stored by the plugin" {
+		t.Errorf("stored content = %q, want it within the subdir of the user", data)
+	}
+	if w := do("GET", "/docs/a.txt", ""); w.Code != http.StatusOK || w.Body.String() != "stored by the plugin" {
+		t.Errorf("GET = %v %q, want %v with the content", w.Code, w.Body.String(), http.StatusOK)
+	}
+	if w := do("PROPFIND", "/docs", "", "Depth", "1"); w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "a.txt") {
+		t.Errorf("PROPFIND = %v %q, want %v listing a.txt", w.Code, w.Body.String(), http.StatusMultiStatus)
+	}
+	if w := do("MOVE", "/docs/a.txt", "", "Destination", "/b.txt"); w.Code != http.StatusCreated {
+		t.Errorf("MOVE status = %v, want %v", w.Code, http.StatusCreated)
+	}
+	if w := do("GET", "/docs/a.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of moved file status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	if w := do("DELETE", "/docs", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE status = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "storage", "bob", "b.txt")); err != nil {
+		t.Errorf("moved file missing: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package app
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// defaultPolicySteps is the number of steps a policy may take per request by default, so a
+// script looping forever can't hang the requests.
+const defaultPolicySteps = 1000000
+
+// policyDecision is the constructor of the decisions returned by allow, deny and rewrite.
+const policyDecision = starlark.String("decision")
+
+// Policy runs a Starlark script for every WebDAV request, which allows, denies or rewrites
+// it. The script defines a function policy(request), which takes at most MaxSteps steps.
+type Policy struct {
+	Script   string
+	MaxSteps uint64
+}
+
+// PolicyScript is the compiled script of the policy. A nil PolicyScript is valid and allows
+// every request.
+type PolicyScript struct {
+	settings *Policy
+	policy   starlark.Value
+}
+
+// NewPolicyScript compiles the script of the policy of the configuration. It returns nil, if
+// no policy is configured.
+func NewPolicyScript(cfg *Config) (*PolicyScript, error) {
+	if cfg.Policy == nil {
+		return nil, nil
+	}
+	thread := &starlark.Thread{Name: "load", Print: cfg.Policy.print}
+	globals, err := starlark.ExecFile(thread, cfg.Policy.Script, nil, starlark.StringDict{
+		"allow":   starlark.NewBuiltin("allow", policyAllow),
+		"deny":    starlark.NewBuiltin("deny", policyDeny),
+		"rewrite": starlark.NewBuiltin("rewrite", policyRewrite),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("policy script %s: %w", cfg.Policy.Script, err)
+	}
+	policy, ok := globals["policy"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("policy script %s doesn't define a function policy", cfg.Policy.Script)
+	}
+	// the globals are shared by the requests, which must not modify them
+	globals.Freeze()
+
+	return &PolicyScript{settings: cfg.Policy, policy: policy}, nil
+}
+
+// print logs the output of print calls of the script.
+func (p *Policy) print(_ *starlark.Thread, msg string) {
+	log.WithField("script", p.Script).Info(msg)
+}
+
+func policyAllow(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return starlarkstruct.FromStringDict(policyDecision, starlark.StringDict{"action": starlark.String("allow")}), nil
+}
+
+func policyDeny(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	status, message := http.StatusForbidden, ""
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "status?", &status, "message?", &message); err != nil {
+		return nil, err
+	}
+	if status < 400 || status > 599 {
+		return nil, fmt.Errorf("%s: status %d isn't an error", b.Name(), status)
+	}
+	return starlarkstruct.FromStringDict(policyDecision, starlark.StringDict{
+		"action":  starlark.String("deny"),
+		"status":  starlark.MakeInt(status),
+		"message": starlark.String(message),
+	}), nil
+}
+
+func policyRewrite(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "path", &p); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("%s: path %q isn't absolute", b.Name(), p)
+	}
+	return starlarkstruct.FromStringDict(policyDecision, starlark.StringDict{
+		"action": starlark.String("rewrite"),
+		"path":   starlark.String(path.Clean(p)),
+	}), nil
+}
+
+// policyRequest returns the request passed to the policy. The paths are relative to the
+// prefix, the headers are keyed by their canonical names.
+func (a *App) policyRequest(r *http.Request) starlark.Value {
+	user := ""
+	if authInfo := AuthFromContext(r.Context()); authInfo != nil {
+		user = authInfo.Username
+	}
+	p, _ := a.relativePath(r)
+	destination := ""
+	if u, err := url.Parse(r.Header.Get("Destination")); err == nil && u.Path != "" {
+		destination = "/" + strings.TrimLeft(strings.TrimPrefix(u.Path, a.Config.Prefix), "/")
+	}
+	headers := starlark.NewDict(len(r.Header))
+	for name := range r.Header {
+		headers.SetKey(starlark.String(name), starlark.String(r.Header.Get(name)))
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"user":        starlark.String(user),
+		"method":      starlark.String(r.Method),
+		"path":        starlark.String(p),
+		"destination": starlark.String(destination),
+		"address":     starlark.String(a.Config.clientIP(r)),
+		"headers":     headers,
+	})
+}
+
+// applyPolicy runs the policy for the request. It answers denied requests and returns false
+// for them, rewritten requests are returned with the new path. The request is refused, if
+// the script fails, so a broken policy doesn't let everything pass.
+func (a *App) applyPolicy(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	p := a.Policy
+	if p == nil {
+		return r, true
+	}
+	ctx := r.Context()
+	thread := &starlark.Thread{Name: r.Method + " " + r.URL.Path, Print: p.settings.print}
+	steps := p.settings.MaxSteps
+	if steps == 0 {
+		steps = defaultPolicySteps
+	}
+	thread.SetMaxExecutionSteps(steps)
+
+	result, err := starlark.Call(thread, p.policy, starlark.Tuple{a.policyRequest(r)}, nil)
+	if err == nil {
+		r, err = p.apply(w, r, result, a.Config.Prefix)
+	}
+	if err != nil {
+		traceStep(ctx, "policy script failed: %s", err)
+		log.WithField("script", p.settings.Script).WithError(err).Error("Policy script failed")
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return r, r != nil
+}
+
+// apply applies the result of the policy to the request, whose path is rewritten below the
+// prefix. It returns nil, if the request is denied.
+func (p *PolicyScript) apply(w http.ResponseWriter, r *http.Request, result starlark.Value, prefix string) (*http.Request, error) {
+	ctx := r.Context()
+	switch result := result.(type) {
+	case starlark.NoneType:
+		return r, nil
+	case starlark.Bool:
+		if !result {
+			traceStep(ctx, "denied by the policy")
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return nil, nil
+		}
+		return r, nil
+	case *starlarkstruct.Struct:
+		if result.Constructor() != policyDecision {
+			break
+		}
+		action, _ := result.Attr("action")
+		switch action {
+		case starlark.String("allow"):
+			return r, nil
+		case starlark.String("deny"):
+			status, _ := result.Attr("status")
+			code, _ := starlark.AsInt32(status)
+			message, _ := result.Attr("message")
+			text := string(message.(starlark.String))
+			if text == "" {
+				text = fmt.Sprintf("%d %s", code, http.StatusText(code))
+			}
+			traceStep(ctx, "denied by the policy with status %d", code)
+			http.Error(w, text, code)
+			return nil, nil
+		case starlark.String("rewrite"):
+			value, _ := result.Attr("path")
+			rewritten := strings.TrimSuffix(prefix, "/") + string(value.(starlark.String))
+			traceStep(ctx, "policy rewrote %s to %s", r.URL.Path, rewritten)
+			r = r.Clone(ctx)
+			r.URL.Path, r.URL.RawPath = rewritten, ""
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("policy returned %s instead of a decision", result.Type())
+}
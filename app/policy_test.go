@@ -0,0 +1,112 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+def policy(request):
+    if request.path.startswith("/archive/") and request.method not in ("GET", "PROPFIND"):
+        return deny(message = "the archive is read-only")
+    if request.headers.get("X-Client") == "legacy":
+        return rewrite("/legacy" + request.path)
+    if request.destination.startswith("/archive/"):
+        return False
+    if request.path == "/teapot":
+        return deny(418)
+    if request.path == "/broken":
+        return "yes"
+    if request.path == "/loop":
+        for i in range(100000000):
+            pass
+    return allow() if request.user == "alice" else None
+`
+
+func TestPolicy(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "archive"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "legacy"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("current"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "legacy", "a.txt"), []byte("legacy"), 0600)
+	script := filepath.Join(tmpDir, "policy.star")
+	ioutil.WriteFile(script, []byte(testPolicy), 0600)
+
+	cfg := &Config{Dir: tmpDir, Policy: &Policy{Script: script, MaxSteps: 10000}}
+	a := newQuotaApp(t, cfg)
+	var err error
+	if a.Policy, err = NewPolicyScript(cfg); err != nil {
+		t.Fatalf("NewPolicyScript() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   []string
+		want     int
+		wantBody string
+	}{
+		{"allowed", "GET", "/a.txt", nil, http.StatusOK, "current"},
+		{"denied with message", "PUT", "/archive/b.txt", nil, http.StatusForbidden, "the archive is read-only"},
+		{"denied with status", "GET", "/teapot", nil, http.StatusTeapot, "418 I'm a teapot"},
+		{"denied by false", "COPY", "/a.txt", []string{"Destination", "/archive/a.txt"}, http.StatusForbidden, "403 Forbidden"},
+		{"rewritten", "GET", "/a.txt", []string{"X-Client", "legacy"}, http.StatusOK, "legacy"},
+		{"invalid decision", "GET", "/broken", nil, http.StatusInternalServerError, "500 Internal Server Error"},
+		{"too many steps", "GET", "/loop", nil, http.StatusInternalServerError, "500 Internal Server Error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader("content"))
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				req.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want || strings.TrimSpace(w.Body.String()) != tt.wantBody {
+				t.Errorf("response = %v %q, want %v %q", w.Code, w.Body.String(), tt.want, tt.wantBody)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "archive", "b.txt")); err == nil {
+		t.Error("denied request created the file")
+	}
+}
+
+func TestNewPolicyScript(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name    string
+		script  string
+		wantErr string
+	}{
+		{"syntax error", "def policy(request)\n    return None\n", "got newline"},
+		{"no policy", "def check(request):\n    return None\n", "doesn't define a function policy"},
+		{"policy isn't a function", "policy = True\n", "doesn't define a function policy"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := filepath.Join(tmpDir, strconv.Itoa(i)+".star")
+			ioutil.WriteFile(script, []byte(tt.script), 0600)
+			_, err := NewPolicyScript(&Config{Policy: &Policy{Script: script}})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewPolicyScript() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if p, err := NewPolicyScript(&Config{}); p != nil || err != nil {
+		t.Errorf("NewPolicyScript() without policy = %v, %v, want nil", p, err)
+	}
+}
@@ -0,0 +1,238 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// principalsPrefix is the path of the principal collection below the prefix. It's hidden, so
+// it doesn't shadow a directory of the users.
+const principalsPrefix = "/.principals/users/"
+
+var currentUserPrincipalName = xml.Name{Space: "DAV:", Local: "current-user-principal"}
+
+// principalPropfind is the body of a PROPFIND of a principal.
+type principalPropfind struct {
+	Allprop  *struct{} `xml:"DAV: allprop"`
+	Propname *struct{} `xml:"DAV: propname"`
+	Prop     *struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// principalHref returns the escaped URL of the principal of a user.
+func (a *App) principalHref(user string) string {
+	return syncHref(a.Config.Prefix, principalsPrefix+user) + "/"
+}
+
+// currentUserPrincipal returns the DAV:current-user-principal property of the request, which
+// is DAV:unauthenticated without login.
+func (a *App) currentUserPrincipal(ctx context.Context) webdav.Property {
+	inner := "<D:unauthenticated/>"
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		inner = "<D:href>" + a.principalHref(authInfo.Username) + "</D:href>"
+	}
+	return webdav.Property{XMLName: currentUserPrincipalName, InnerXML: []byte(inner)}
+}
+
+// principalHandler returns the WebDAV handler for a PROPFIND. If the PROPFIND asks for the
+// DAV:current-user-principal property, the files of the handler report it as dead property.
+// Other PROPFINDs don't get it, as it shouldn't be returned for allprop.
+func (a *App) principalHandler(h *webdav.Handler, r *http.Request) *webdav.Handler {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil || !requestsProperty(body, currentUserPrincipalName) {
+		return h
+	}
+
+	principal := *h
+	principal.FileSystem = &principalFS{FileSystem: h.FileSystem, prop: a.currentUserPrincipal(r.Context())}
+	return &principal
+}
+
+// requestsProperty returns whether the body of a PROPFIND names the property.
+func requestsProperty(body []byte, name xml.Name) bool {
+	var pf principalPropfind
+	if xml.Unmarshal(body, &pf) != nil || pf.Prop == nil {
+		return false
+	}
+	for _, n := range pf.Prop.Names {
+		if n.XMLName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// principalFS adds a property to the files it opens.
+type principalFS struct {
+	webdav.FileSystem
+	prop webdav.Property
+}
+
+func (fs *principalFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := fs.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &principalFile{File: f, prop: fs.prop}, nil
+}
+
+// principalFile reports the property in addition to the dead properties of the file.
+type principalFile struct {
+	webdav.File
+	prop webdav.Property
+}
+
+// DeadProps returns the property and the dead properties of the file.
+func (f *principalFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		inner, err := holder.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range inner {
+			props[name] = p
+		}
+	}
+	props[f.prop.XMLName] = f.prop
+	return props, nil
+}
+
+func (f *principalFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := f.File.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// servePrincipal answers the PROPFINDs of the principal collection and of the principal of
+// the user, which is the only member of the collection visible to the user. It returns
+// whether the request has been handled.
+func (a *App) servePrincipal(w http.ResponseWriter, r *http.Request) bool {
+	p, ok := a.relativePath(r)
+	collection := strings.TrimSuffix(principalsPrefix, "/")
+	if !ok || (p != collection && !strings.HasPrefix(p, principalsPrefix)) {
+		return false
+	}
+
+	var user string
+	if authInfo := AuthFromContext(r.Context()); authInfo != nil && authInfo.Authenticated {
+		user = authInfo.Username
+	}
+	name := strings.Trim(strings.TrimPrefix(p, collection), "/")
+	if user == "" || (name != "" && name != user) {
+		http.NotFound(w, r)
+		return true
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", "OPTIONS, PROPFIND")
+		w.Header().Set("DAV", "1, 2")
+		w.WriteHeader(http.StatusOK)
+		return true
+	case "PROPFIND":
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	var pf principalPropfind
+	if body, _ := ioutil.ReadAll(r.Body); len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, &pf); err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return true
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	if name == "" {
+		a.writePrincipalResponse(&out, r, syncHref(a.Config.Prefix, collection)+"/", "", &pf)
+		if r.Header.Get("Depth") != "0" {
+			a.writePrincipalResponse(&out, r, a.principalHref(user), user, &pf)
+		}
+	} else {
+		a.writePrincipalResponse(&out, r, a.principalHref(user), user, &pf)
+	}
+	out.WriteString("</D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	if _, err := w.Write(out.Bytes()); err != nil {
+		log.WithError(err).Error("Error writing principal")
+	}
+	return true
+}
+
+// writePrincipalResponse writes the response of the principal of the user or of the
+// principal collection, if user is empty.
+func (a *App) writePrincipalResponse(out *bytes.Buffer, r *http.Request, href, user string, pf *principalPropfind) {
+	props := map[string]string{
+		"resourcetype":             "<D:collection/>",
+		"displayname":              "users",
+		"current-user-principal":   string(a.currentUserPrincipal(r.Context()).InnerXML),
+		"principal-collection-set": "<D:href>" + syncHref(a.Config.Prefix, strings.TrimSuffix(principalsPrefix, "/")) + "/</D:href>",
+	}
+	names := []string{"resourcetype", "displayname", "current-user-principal", "principal-collection-set"}
+	if user != "" {
+		var display bytes.Buffer
+		xml.EscapeText(&display, []byte(user))
+		props["resourcetype"] = "<D:collection/><D:principal/>"
+		props["displayname"] = display.String()
+		props["principal-URL"] = "<D:href>" + href + "</D:href>"
+		names = append(names, "principal-URL")
+	}
+
+	fmt.Fprintf(out, "<D:response><D:href>%s</D:href>", href)
+	var found, missing bytes.Buffer
+	switch {
+	case pf.Propname != nil:
+		for _, n := range names {
+			fmt.Fprintf(&found, "<D:%s/>", n)
+		}
+	case pf.Prop != nil:
+		for _, n := range pf.Prop.Names {
+			if v, ok := props[n.XMLName.Local]; ok && n.XMLName.Space == "DAV:" {
+				fmt.Fprintf(&found, "<D:%s>%s</D:%s>", n.XMLName.Local, v, n.XMLName.Local)
+				continue
+			}
+			missing.WriteString("<")
+			xml.EscapeText(&missing, []byte(n.XMLName.Local))
+			missing.WriteString(` xmlns="`)
+			xml.EscapeText(&missing, []byte(n.XMLName.Space))
+			missing.WriteString(`"/>`)
+		}
+	default:
+		// current-user-principal isn't returned for allprop
+		for _, n := range names {
+			if n != "current-user-principal" {
+				fmt.Fprintf(&found, "<D:%s>%s</D:%s>", n, props[n], n)
+			}
+		}
+	}
+	if found.Len() > 0 {
+		fmt.Fprintf(out, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>", found.String())
+	}
+	if missing.Len() > 0 {
+		fmt.Fprintf(out, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>", missing.String())
+	}
+	out.WriteString("</D:response>")
+}
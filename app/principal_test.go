@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrincipals(t *testing.T) {
+	a := newNextcloudApp(t)
+	const principalProps = `<D:propfind xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav"><D:prop>` +
+		`<D:current-user-principal/><D:displayname/><D:resourcetype/><C:calendar-home-set/></D:prop></D:propfind>`
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		depth       string
+		body        string
+		user        string
+		want        int
+		wantBody    []string
+		notWantBody string
+	}{
+		{"current user principal", "PROPFIND", "/cloud/", "0", principalProps, "alice", http.StatusMultiStatus,
+			[]string{"<D:current-user-principal><D:href>/cloud/.principals/users/alice/</D:href></D:current-user-principal>"}, ""},
+		{"nextcloud files", "PROPFIND", "/cloud/remote.php/dav/files/alice/", "0", principalProps, "alice", http.StatusMultiStatus,
+			[]string{"<D:href>/cloud/.principals/users/alice/</D:href>"}, ""},
+		{"allprop", "PROPFIND", "/cloud/", "0", "", "alice", http.StatusMultiStatus, nil, "current-user-principal"},
+		{"principal", "PROPFIND", "/cloud/.principals/users/alice/", "0", principalProps, "alice", http.StatusMultiStatus,
+			[]string{"<D:resourcetype><D:collection/><D:principal/></D:resourcetype>", "<D:displayname>alice</D:displayname>",
+				`<calendar-home-set xmlns="urn:ietf:params:xml:ns:caldav"/></D:prop><D:status>HTTP/1.1 404 Not Found`}, ""},
+		{"principal allprop", "PROPFIND", "/cloud/.principals/users/alice", "0", "", "alice", http.StatusMultiStatus,
+			[]string{"<D:principal-URL><D:href>/cloud/.principals/users/alice/</D:href></D:principal-URL>"}, "current-user-principal"},
+		{"collection", "PROPFIND", "/cloud/.principals/users/", "1", principalProps, "alice", http.StatusMultiStatus,
+			[]string{"<D:href>/cloud/.principals/users/</D:href>", "<D:response><D:href>/cloud/.principals/users/alice/</D:href>"}, ""},
+		{"principal of other user", "PROPFIND", "/cloud/.principals/users/bob/", "0", principalProps, "alice", http.StatusNotFound, nil, ""},
+		{"principal without login", "PROPFIND", "/cloud/.principals/users/alice/", "0", principalProps, "", http.StatusUnauthorized, nil, ""},
+		{"write to principal", "PUT", "/cloud/.principals/users/alice/x", "", "x", "alice", http.StatusNotFound, nil, ""},
+		{"delete of principal", "DELETE", "/cloud/.principals/users/alice/", "", "", "alice", http.StatusMethodNotAllowed, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.depth != "" {
+				req.Header.Set("Depth", tt.depth)
+			}
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, "password")
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+			for _, want := range tt.wantBody {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("handle() body = %s, want it to contain %s", w.Body.String(), want)
+				}
+			}
+			if tt.notWantBody != "" && strings.Contains(w.Body.String(), tt.notWantBody) {
+				t.Errorf("handle() body = %s, don't want %s", w.Body.String(), tt.notWantBody)
+			}
+		})
+	}
+}
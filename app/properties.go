@@ -0,0 +1,438 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Namespaces of the properties defined by dave
+const (
+	daveNamespace     = "https://github.com/micromata/dave/ns"
+	metadataNamespace = daveNamespace + "/metadata"
+)
+
+var (
+	tagsPropName = xml.Name{Space: daveNamespace, Local: "tags"}
+	metadataKey  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+)
+
+// Properties enables the dead properties of the files and directories, which clients set with
+// PROPPATCH. They're kept in File, so they survive restarts, without a file they're only kept
+// in memory. The tags and the metadata of the files are dead properties of the dave
+// namespace, which are managed with the meta parameter as well.
+type Properties struct {
+	File string
+}
+
+// deadProp is a stored dead property.
+type deadProp struct {
+	Space string `json:"space"`
+	Local string `json:"local"`
+	Lang  string `json:"lang,omitempty"`
+	XML   string `json:"xml"`
+}
+
+// FileMetadata are the tags and the key-value metadata of a file or directory.
+type FileMetadata struct {
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// PropertyStore holds the dead properties by the path relative to the base dir. A nil
+// PropertyStore is valid and holds no properties.
+type PropertyStore struct {
+	file string
+	dir  string
+
+	mu    sync.Mutex
+	props map[string][]deadProp
+}
+
+// NewPropertyStore loads the dead properties of the configuration. Properties of paths, which
+// have been removed while the server was down, are dropped. It returns nil, if dead
+// properties aren't configured.
+func NewPropertyStore(cfg *Config) (*PropertyStore, error) {
+	if cfg.Properties == nil {
+		return nil, nil
+	}
+	if cfg.ContentStore != nil {
+		return nil, fmt.Errorf("dead properties require the files to be stored in the base dir, not in the content store")
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "."
+	}
+	s := &PropertyStore{file: cfg.Properties.File, dir: dir, props: map[string][]deadProp{}}
+	if s.file == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.props); err != nil {
+		return nil, fmt.Errorf("invalid property file %s: %s", s.file, err)
+	}
+	for key := range s.props {
+		if _, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(key))); os.IsNotExist(err) {
+			delete(s.props, key)
+		}
+	}
+	return s, nil
+}
+
+// key returns the key of the physical path, ok is false for paths outside of the base dir.
+func (s *PropertyStore) key(name string) (string, bool) {
+	rel, err := filepath.Rel(s.dir, name)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path.Join("/", filepath.ToSlash(rel)), true
+}
+
+// get returns the dead properties of the path with the key.
+func (s *PropertyStore) get(key string) map[xml.Name]webdav.Property {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	props := map[xml.Name]webdav.Property{}
+	for _, p := range s.props[key] {
+		name := xml.Name{Space: p.Space, Local: p.Local}
+		props[name] = webdav.Property{XMLName: name, Lang: p.Lang, InnerXML: []byte(p.XML)}
+	}
+	return props
+}
+
+// patch sets and removes the dead properties of the path with the key in their order.
+func (s *PropertyStore) patch(key string, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	props := append([]deadProp{}, s.props[key]...)
+	pstat := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+			kept := props[:0]
+			for _, old := range props {
+				if old.Space != p.XMLName.Space || old.Local != p.XMLName.Local {
+					kept = append(kept, old)
+				}
+			}
+			props = kept
+			if !patch.Remove {
+				props = append(props, deadProp{Space: p.XMLName.Space, Local: p.XMLName.Local, Lang: p.Lang, XML: string(p.InnerXML)})
+			}
+		}
+	}
+
+	old, existed := s.props[key]
+	if len(props) > 0 {
+		s.props[key] = props
+	} else {
+		delete(s.props, key)
+	}
+	if err := s.save(); err != nil {
+		if existed {
+			s.props[key] = old
+		} else {
+			delete(s.props, key)
+		}
+		return nil, err
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// move moves the properties of the physical path and of the paths below it to the new path.
+func (s *PropertyStore) move(oldName, newName string) {
+	if s == nil {
+		return
+	}
+	oldKey, ok := s.key(oldName)
+	newKey, newOK := s.key(newName)
+	if !ok || !newOK {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved := false
+	for key, props := range s.props {
+		if key == oldKey || strings.HasPrefix(key, oldKey+"/") {
+			delete(s.props, key)
+			s.props[newKey+strings.TrimPrefix(key, oldKey)] = props
+			moved = true
+		}
+	}
+	if moved {
+		if err := s.save(); err != nil {
+			log.WithError(err).Error("Error saving the properties")
+		}
+	}
+}
+
+// remove drops the properties of the physical path and of the paths below it.
+func (s *PropertyStore) remove(name string) {
+	if s == nil {
+		return
+	}
+	removed, ok := s.key(name)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for key := range s.props {
+		if key == removed || strings.HasPrefix(key, removed+"/") {
+			delete(s.props, key)
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil {
+			log.WithError(err).Error("Error saving the properties")
+		}
+	}
+}
+
+// save writes the properties to the file, if there is one. s.mu must be held.
+func (s *PropertyStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.props)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data)
+}
+
+// metadata returns the tags and the metadata of the path with the key.
+func (s *PropertyStore) metadata(key string) FileMetadata {
+	m := FileMetadata{Tags: []string{}, Metadata: map[string]string{}}
+	if s == nil {
+		return m
+	}
+	for name, p := range s.get(key) {
+		switch {
+		case name == tagsPropName:
+			for _, tag := range strings.Split(propText(p), ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					m.Tags = append(m.Tags, tag)
+				}
+			}
+		case name.Space == metadataNamespace:
+			m.Metadata[name.Local] = propText(p)
+		}
+	}
+	sort.Strings(m.Tags)
+	return m
+}
+
+// matches returns whether the path with the key has all tags and the values of the metadata.
+func (s *PropertyStore) matches(key string, tags []string, metadata map[string]string) bool {
+	m := s.metadata(key)
+	for _, tag := range tags {
+		i := sort.SearchStrings(m.Tags, tag)
+		if i == len(m.Tags) || m.Tags[i] != tag {
+			return false
+		}
+	}
+	for k, v := range metadata {
+		if value, ok := m.Metadata[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks, that the tags contain no commas, which separate them, and that the keys of
+// the metadata are valid XML names, which name their properties.
+func (m *FileMetadata) validate() error {
+	for _, tag := range m.Tags {
+		if strings.TrimSpace(tag) == "" || strings.Contains(tag, ",") {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	for key := range m.Metadata {
+		if !metadataKey.MatchString(key) {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+	}
+	return nil
+}
+
+// patches returns the changes of the dead properties, which replace the old tags and
+// metadata by these.
+func (m *FileMetadata) patches(old FileMetadata) []webdav.Proppatch {
+	remove := webdav.Proppatch{Remove: true}
+	set := webdav.Proppatch{}
+	if len(m.Tags) > 0 {
+		tags := make([]string, len(m.Tags))
+		for i, tag := range m.Tags {
+			tags[i] = strings.TrimSpace(tag)
+		}
+		set.Props = append(set.Props, textProp(tagsPropName, strings.Join(tags, ", ")))
+	} else if len(old.Tags) > 0 {
+		remove.Props = append(remove.Props, webdav.Property{XMLName: tagsPropName})
+	}
+	for key := range old.Metadata {
+		if _, ok := m.Metadata[key]; !ok {
+			remove.Props = append(remove.Props, webdav.Property{XMLName: xml.Name{Space: metadataNamespace, Local: key}})
+		}
+	}
+	for key, value := range m.Metadata {
+		set.Props = append(set.Props, textProp(xml.Name{Space: metadataNamespace, Local: key}, value))
+	}
+	return []webdav.Proppatch{remove, set}
+}
+
+// textProp returns a property with the text as content.
+func textProp(name xml.Name, text string) webdav.Property {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(text))
+	return webdav.Property{XMLName: name, InnerXML: b.Bytes()}
+}
+
+// propText returns the text of the content of the property.
+func propText(p webdav.Property) string {
+	var text struct {
+		Value string `xml:",chardata"`
+	}
+	xml.Unmarshal(append(append([]byte("<v>"), p.InnerXML...), "</v>"...), &text)
+	return strings.TrimSpace(text.Value)
+}
+
+// openPropFile wraps the file of the physical path, so its dead properties are reported and
+// changed by the store. dryRun is called instead of changing the properties, if it's set.
+func (s *PropertyStore) openPropFile(f webdav.File, name string, dryRun func()) webdav.File {
+	if s == nil {
+		return f
+	}
+	key, ok := s.key(name)
+	if !ok {
+		return f
+	}
+	return &propFile{File: f, store: s, key: key, dryRun: dryRun}
+}
+
+// propFile is a file with the dead properties of the store.
+type propFile struct {
+	webdav.File
+	store  *PropertyStore
+	key    string
+	dryRun func()
+}
+
+// DeadProps returns the stored properties of the file.
+func (f *propFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.store.get(f.key), nil
+}
+
+// Patch changes the stored properties of the file.
+func (f *propFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if f.dryRun != nil {
+		f.dryRun()
+		pstat := webdav.Propstat{Status: http.StatusOK}
+		for _, patch := range patches {
+			pstat.Props = append(pstat.Props, patch.Props...)
+		}
+		return []webdav.Propstat{pstat}, nil
+	}
+	return f.store.patch(f.key, patches)
+}
+
+// serveMetadata answers a GET of a file or directory with the meta parameter by its tags and
+// metadata, and a PUT by replacing them. The changes are made like by a PROPPATCH, so the
+// user needs to be allowed to write the file. It returns whether the request has been handled.
+func (a *App) serveMetadata(w http.ResponseWriter, r *http.Request) bool {
+	if a.Props == nil || !r.URL.Query().Has("meta") {
+		return false
+	}
+	ctx := r.Context()
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	name := path.Clean(p)
+	physical := Dir{Config: a.Config}.resolve(ctx, name)
+	key, ok := a.Props.key(physical)
+	if _, err := a.Handler.FileSystem.Stat(ctx, name); err != nil || !ok {
+		http.NotFound(w, r)
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.Props.metadata(key))
+	case http.MethodPut:
+		var m FileMetadata
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return true
+		}
+		if err := m.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+		f, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDWR, 0)
+		if err != nil {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return true
+		}
+		defer f.Close()
+		holder, ok := f.(webdav.DeadPropsHolder)
+		if !ok {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return true
+		}
+		if _, err := holder.Patch(m.patches(a.Props.metadata(key))); err != nil {
+			log.WithField("path", name).WithError(err).Error("Error changing the metadata")
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return true
+		}
+		traceStep(ctx, "changed the metadata of %s", name)
+		writeJSON(w, http.StatusOK, a.Props.metadata(key))
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+// searchFilter returns the filter of the index keys by the tag and meta.KEY parameters of a
+// search. It returns nil without these parameters.
+func (a *App) searchFilter(r *http.Request) searchPredicate {
+	query := r.URL.Query()
+	tags := query["tag"]
+	metadata := map[string]string{}
+	for param, values := range query {
+		if key := strings.TrimPrefix(param, "meta."); key != param && len(values) > 0 {
+			metadata[key] = values[0]
+		}
+	}
+	if len(tags) == 0 && len(metadata) == 0 {
+		return nil
+	}
+	return func(key string, _ *searchDoc) bool {
+		return a.Props != nil && a.Props.matches(key, tags, metadata)
+	}
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestProperties(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "docs"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "docs", "invoice.txt"), []byte("invoice"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "notes.txt"), []byte("notes"), 0600)
+
+	cfg := &Config{
+		Dir:        filepath.Join(tmpDir, "data"),
+		Properties: &Properties{File: filepath.Join(tmpDir, "props.json")},
+		Search:     &Search{},
+	}
+	props, err := NewPropertyStore(cfg)
+	if err != nil {
+		t.Fatalf("NewPropertyStore() error = %v", err)
+	}
+	a := &App{
+		Config: cfg,
+		Props:  props,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg, Props: props},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+	propfind := func(target string) string {
+		w := do("PROPFIND", target, `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`, "Depth", "0")
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPFIND %s status = %v", target, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	proppatch := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:example"><D:set><D:prop><Z:color>blue</Z:color></D:prop></D:set></D:propertyupdate>`
+	for _, target := range []string{"/notes.txt", "/docs"} {
+		if w := do("PROPPATCH", target, proppatch); w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "200 OK") {
+			t.Errorf("PROPPATCH %s = %v %s", target, w.Code, w.Body)
+		}
+		if body := propfind(target); !strings.Contains(body, "blue") {
+			t.Errorf("PROPFIND %s misses the dead property: %s", target, body)
+		}
+	}
+
+	meta := `{"tags": ["finance", " 2024 "], "metadata": {"customer": "ACME & Co", "status": "open"}}`
+	if w := do("PUT", "/docs/invoice.txt?meta", meta); w.Code != http.StatusOK {
+		t.Fatalf("PUT of metadata status = %v %s", w.Code, w.Body)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "data", "docs", "invoice.txt")); string(b) != "invoice" {
+		t.Errorf("PUT of metadata changed the content to %q", b)
+	}
+	var got FileMetadata
+	json.Unmarshal(do("GET", "/docs/invoice.txt?meta", "").Body.Bytes(), &got)
+	if strings.Join(got.Tags, ",") != "2024,finance" || got.Metadata["customer"] != "ACME & Co" || got.Metadata["status"] != "open" {
+		t.Errorf("GET of metadata = %+v", got)
+	}
+	if body := propfind("/docs/invoice.txt"); !strings.Contains(body, "ACME &amp; Co") {
+		t.Errorf("PROPFIND misses the metadata: %s", body)
+	}
+	for _, invalid := range []string{`{"tags": ["a,b"]}`, `{"metadata": {"1st": "x"}}`, `{`} {
+		if w := do("PUT", "/docs/invoice.txt?meta", invalid); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT of metadata %s status = %v, want %v", invalid, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := do("GET", "/missing.txt?meta", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of metadata of missing file status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	if w := do("COPY", "/docs/invoice.txt", "", "Destination", "/invoice-copy.txt"); w.Code != http.StatusCreated {
+		t.Fatalf("COPY status = %v", w.Code)
+	}
+	if w := do("MOVE", "/docs", "", "Destination", "/archive"); w.Code != http.StatusCreated {
+		t.Fatalf("MOVE status = %v", w.Code)
+	}
+	for _, target := range []string{"/invoice-copy.txt", "/archive/invoice.txt"} {
+		got = FileMetadata{}
+		json.Unmarshal(do("GET", target+"?meta", "").Body.Bytes(), &got)
+		if got.Metadata["status"] != "open" {
+			t.Errorf("metadata of %s = %+v", target, got)
+		}
+	}
+	if w := do("PUT", "/archive/invoice.txt?meta", `{"tags": ["paid"]}`); w.Code != http.StatusOK {
+		t.Errorf("PUT of metadata status = %v", w.Code)
+	}
+
+	a.Search, _ = NewSearchIndex(cfg)
+	a.Search.update(time.Now())
+	var res struct {
+		Results []SearchResult `json:"results"`
+	}
+	json.Unmarshal(do("GET", "/?search=&tag=finance&meta.status=open", "").Body.Bytes(), &res)
+	if len(res.Results) != 1 || res.Results[0].Path != "/invoice-copy.txt" || res.Results[0].Metadata["customer"] != "ACME & Co" {
+		t.Errorf("search by tag and metadata = %+v", res.Results)
+	}
+	json.Unmarshal(do("GET", "/?search=invoice&tag=paid", "").Body.Bytes(), &res)
+	if len(res.Results) != 1 || res.Results[0].Path != "/archive/invoice.txt" {
+		t.Errorf("search by word and tag = %+v", res.Results)
+	}
+
+	if w := do("DELETE", "/invoice-copy.txt", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %v", w.Code)
+	}
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "invoice-copy.txt"), []byte("new"), 0600)
+	if body := propfind("/invoice-copy.txt"); strings.Contains(body, "ACME") {
+		t.Errorf("properties of a deleted file are kept: %s", body)
+	}
+
+	os.Remove(filepath.Join(tmpDir, "data", "notes.txt"))
+	reloaded, err := NewPropertyStore(cfg)
+	if err != nil {
+		t.Fatalf("NewPropertyStore() error = %v", err)
+	}
+	if _, ok := reloaded.props["/notes.txt"]; ok || len(reloaded.props) != 2 {
+		t.Errorf("reloaded properties = %v", reloaded.props)
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(cmd, fam byte, payload []byte) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, 0x20|cmd, fam, byte(len(payload)>>8), byte(len(payload)))
+	return append(h, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0xD2, 0x00, 0x50}
+	v6 := make([]byte, 36)
+	v6[15], v6[31], v6[32], v6[33] = 1, 2, 0x04, 0xD2
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n"), "1.2.3.4:1234", false},
+		{"v1 tcp6", []byte("PROXY TCP6 ::1 ::2 1234 80\r\n"), "[::1]:1234", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 invalid address", []byte("PROXY TCP4 foo 5.6.7.8 1234 80\r\n"), "", true},
+		{"v1 too long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...), "", true},
+		{"v2 tcp4", proxyV2Header(0x1, 0x11, v4), "1.2.3.4:1234", false},
+		{"v2 tcp6", proxyV2Header(0x1, 0x21, v6), "[::1]:1234", false},
+		{"v2 local", proxyV2Header(0x0, 0x00, nil), "", false},
+		{"v2 short", proxyV2Header(0x1, 0x11, v4[:4]), "", true},
+		{"missing header", []byte("GET / HTTP/1.1\r\n\r\n"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.header)))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readProxyHeader() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("readProxyHeader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	l := &Listener{Address: "127.0.0.1", Port: "0", ProxyProtocol: true}
+	ln, err := l.Listen()
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\nhello"))
+		c.Close()
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer c.Close()
+
+	if got := c.RemoteAddr().String(); got != "1.2.3.4:1234" {
+		t.Errorf("RemoteAddr() = %v, want %v", got, "1.2.3.4:1234")
+	}
+	if got, _ := ioutil.ReadAll(c); string(got) != "hello" {
+		t.Errorf("Read() = %s, want %s", got, "hello")
+	}
+}
@@ -0,0 +1,955 @@
+package app
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQuotaRecalculation is the interval in which the quota usage is recalculated.
+const defaultQuotaRecalculation = time.Hour
+
+// errQuotaExceeded is returned by file operations, which would exceed a quota.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the total number of bytes stored under the base directory, so a single
+// tenant can't fill up the disk of a shared host. Directories can be limited on their own.
+// Beyond the soft limit, writes are only warned about until the grace period ends.
+type Quota struct {
+	Limit       ByteSize
+	Soft        ByteSize
+	Grace       time.Duration
+	Webhook     string
+	Directories []*DirQuota
+	Recalculate time.Duration
+}
+
+// DirQuota limits the bytes stored beneath a directory, which is given relative to the base
+// directory.
+type DirQuota struct {
+	Path  string
+	Limit ByteSize
+	Soft  ByteSize
+}
+
+// Quotas keeps track of the bytes and files stored within the scopes of the configured
+// quotas. The usage is determined by walking the directory trees once and updated by the
+// file operations afterwards. A nil Quotas is valid and enforces nothing.
+type Quotas struct {
+	root     string
+	files    storage
+	interval time.Duration
+	grace    time.Duration
+	webhook  string
+
+	mu     sync.Mutex
+	scopes []*quotaScope
+}
+
+// quotaScope is the usage and the limit of a quota for a physical directory.
+type quotaScope struct {
+	name  string
+	user  string
+	path  string
+	limit int64
+	soft  int64
+	used  int64
+	files int64
+	dirs  int64
+
+	// fileLimit limits the number of files and directories
+	fileLimit int64
+
+	// softSince is the time the soft limit has been exceeded, expired is set once the grace
+	// period ended
+	softSince time.Time
+	expired   bool
+
+	// changes counts the updates by file operations, corrections counts the corrected drifts
+	changes     int64
+	corrections int64
+
+	// synced are the counters of the coordination store as of the last synchronization, the
+	// difference to the counters are the changes of this node since. reset replaces the
+	// counters of the store by the ones determined by walking the directories.
+	synced quotaCounters
+	reset  bool
+}
+
+// QuotaUsage describes the usage of a quota.
+type QuotaUsage struct {
+	Scope       string     `json:"scope"`
+	User        string     `json:"user,omitempty"`
+	Limit       int64      `json:"limit"`
+	Soft        int64      `json:"soft,omitempty"`
+	GraceEnds   *time.Time `json:"graceEnds,omitempty"`
+	Used        int64      `json:"used"`
+	Files       int64      `json:"files"`
+	Dirs        int64      `json:"dirs"`
+	FileLimit   int64      `json:"fileLimit,omitempty"`
+	Corrections int64      `json:"corrections"`
+}
+
+// NewQuotas determines the current usage of the quotas of the configuration, i.e. of the
+// global quota, the directory quotas and the quotas of the users. It returns nil, if no quota
+// is configured.
+func NewQuotas(cfg *Config) (*Quotas, error) {
+	root := filepath.Clean(cfg.Dir)
+	q := &Quotas{root: root, files: cfg.storage(), interval: defaultQuotaRecalculation, grace: defaultQuotaGrace}
+	if cfg.Quota != nil {
+		if cfg.Quota.Recalculate != 0 {
+			q.interval = cfg.Quota.Recalculate
+		}
+		if cfg.Quota.Grace > 0 {
+			q.grace = cfg.Quota.Grace
+		}
+		q.webhook = cfg.Quota.Webhook
+		if cfg.Quota.Limit > 0 || cfg.Quota.Soft > 0 {
+			q.scopes = append(q.scopes, &quotaScope{
+				name:  "/",
+				path:  root,
+				limit: int64(cfg.Quota.Limit),
+				soft:  int64(cfg.Quota.Soft),
+			})
+		}
+		for _, dq := range cfg.Quota.Directories {
+			if dq == nil || (dq.Limit <= 0 && dq.Soft <= 0) {
+				continue
+			}
+			name := path.Clean("/" + filepath.ToSlash(dq.Path))
+			q.scopes = append(q.scopes, &quotaScope{
+				name:  name,
+				path:  filepath.Join(root, filepath.FromSlash(name)),
+				limit: int64(dq.Limit),
+				soft:  int64(dq.Soft),
+			})
+		}
+	}
+	for _, username := range cfg.UserNames() {
+		user := cfg.User(username)
+		if user == nil || (user.Quota <= 0 && user.SoftQuota <= 0 && user.FileLimit <= 0) {
+			continue
+		}
+		if user.Subdir == nil {
+			log.WithField("user", username).Warn("Quota of user without subdir is ignored")
+			continue
+		}
+		name := path.Clean("/" + filepath.ToSlash(*user.Subdir))
+		q.scopes = append(q.scopes, &quotaScope{
+			name:      name,
+			user:      username,
+			path:      filepath.Join(root, filepath.FromSlash(name)),
+			limit:     int64(user.Quota),
+			soft:      int64(user.SoftQuota),
+			fileLimit: user.FileLimit,
+		})
+	}
+	if len(q.scopes) == 0 {
+		return nil, nil
+	}
+
+	usage, err := q.scan()
+	if err != nil {
+		return nil, fmt.Errorf("error determining usage of quotas: %s", err)
+	}
+	now := time.Now()
+	for i, s := range q.scopes {
+		s.used, s.files, s.dirs = usage[i].Used, usage[i].Files, usage[i].Dirs
+		s.reset = true
+		q.updateSoft(s, now)
+		log.WithFields(log.Fields{
+			"scope": s.name,
+			"user":  s.user,
+			"used":  ByteSize(s.used).String(),
+			"limit": ByteSize(s.limit).String(),
+		}).Info("Determined quota usage")
+	}
+	return q, nil
+}
+
+// scan determines the usage of all quotas with a single walk of the base directory. The
+// results are in the order of the scopes.
+func (q *Quotas) scan() ([]QuotaUsage, error) {
+	usage := make([]QuotaUsage, len(q.scopes))
+	err := q.files.Walk(q.root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		for i, s := range q.scopes {
+			switch {
+			case !withinDir(name, s.path):
+			case info.Mode().IsRegular():
+				usage[i].Used += info.Size()
+				usage[i].Files++
+			case info.IsDir() && name != s.path:
+				usage[i].Dirs++
+			}
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// StartRecalculation recalculates the usage of the quotas periodically. Files changed without
+// dave, e.g. by a backup restore or a shell on the host, let the counters drift from the
+// actual usage, which is corrected by the recalculation.
+func (q *Quotas) StartRecalculation() {
+	if q == nil || q.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(q.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := q.recalculate(); err != nil {
+				log.WithError(err).Error("Error recalculating quota usage")
+			}
+		}
+	}()
+}
+
+// recalculate walks the base directory and corrects the counters, which drifted from the
+// actual usage. The walk doesn't block the file operations, so scopes which have been changed
+// by them meanwhile can't be compared and are left to the next recalculation.
+func (q *Quotas) recalculate() error {
+	q.mu.Lock()
+	changes := make([]int64, len(q.scopes))
+	for i, s := range q.scopes {
+		changes[i] = s.changes
+	}
+	q.mu.Unlock()
+
+	usage, err := q.scan()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, s := range q.scopes {
+		if s.changes != changes[i] {
+			log.WithField("scope", s.name).WithField("user", s.user).Debug("Quota changed during recalculation, skipped it")
+			continue
+		}
+		if s.used == usage[i].Used && s.files == usage[i].Files && s.dirs == usage[i].Dirs {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"scope":      s.name,
+			"user":       s.user,
+			"bytesDrift": usage[i].Used - s.used,
+			"filesDrift": usage[i].Files - s.files,
+			"dirsDrift":  usage[i].Dirs - s.dirs,
+			"used":       ByteSize(usage[i].Used).String(),
+		}).Warn("Corrected drift of quota usage")
+		s.used, s.files, s.dirs = usage[i].Used, usage[i].Files, usage[i].Dirs
+		s.corrections++
+		s.reset = true
+		q.updateSoft(s, time.Now())
+	}
+	return nil
+}
+
+// UpdateLimits applies the quotas of the users of the reloaded configuration to their scopes.
+// The usage of a user, who had no quota before, hasn't been determined, so a new quota only
+// takes effect after a restart.
+func (q *Quotas) UpdateLimits(cfg *Config) {
+	scoped := map[string]bool{}
+	if q != nil {
+		q.mu.Lock()
+		now := time.Now()
+		for _, s := range q.scopes {
+			if s.user == "" {
+				continue
+			}
+			scoped[s.user] = true
+			var limit, soft, fileLimit int64
+			if user := cfg.User(s.user); user != nil {
+				limit, soft, fileLimit = int64(user.Quota), int64(user.SoftQuota), user.FileLimit
+			}
+			if s.limit == limit && s.soft == soft && s.fileLimit == fileLimit {
+				continue
+			}
+			s.limit, s.soft, s.fileLimit = limit, soft, fileLimit
+			if soft <= 0 {
+				s.softSince, s.expired = time.Time{}, false
+			}
+			q.updateSoft(s, now)
+			log.WithFields(log.Fields{"scope": s.name, "user": s.user, "limit": ByteSize(limit).String()}).Info("Updated quota limits of user")
+		}
+		q.mu.Unlock()
+	}
+	for _, username := range cfg.UserNames() {
+		user := cfg.User(username)
+		if user != nil && user.Subdir != nil && !scoped[username] && (user.Quota > 0 || user.SoftQuota > 0 || user.FileLimit > 0) {
+			log.WithField("user", username).Warn("New quota of user takes effect after a restart")
+		}
+	}
+}
+
+// Usage returns a snapshot of the usage of all quotas.
+func (q *Quotas) Usage() []QuotaUsage {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := make([]QuotaUsage, 0, len(q.scopes))
+	for _, s := range q.scopes {
+		usage = append(usage, QuotaUsage{
+			Scope:       s.name,
+			User:        s.user,
+			Limit:       s.limit,
+			Soft:        s.soft,
+			GraceEnds:   q.graceEnds(s),
+			Used:        s.used,
+			Files:       s.files,
+			Dirs:        s.dirs,
+			FileLimit:   s.fileLimit,
+			Corrections: s.corrections,
+		})
+	}
+	return usage
+}
+
+// check returns errQuotaExceeded, if adding bytes to the given file would exceed a quota.
+func (q *Quotas) check(name string, bytes int64) error {
+	if q == nil || bytes <= 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.checkLocked(name, bytes)
+}
+
+func (q *Quotas) checkLocked(name string, bytes int64) error {
+	now := time.Now()
+	for _, s := range q.scopes {
+		if withinDir(name, s.path) && !q.allows(s, bytes, now) {
+			return errQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// allows returns whether bytes can be added to the quota without exceeding its limit or its
+// soft limit after the grace period.
+func (q *Quotas) allows(s *quotaScope, bytes int64, now time.Time) bool {
+	if bytes <= 0 {
+		return true
+	}
+	if s.limit > 0 && s.used+bytes > s.limit {
+		return false
+	}
+	return !q.graceExpired(s, bytes, now)
+}
+
+// reserve adds bytes to all quotas of the given path, unless this would exceed one of them.
+func (q *Quotas) reserve(name string, bytes int64) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.checkLocked(name, bytes); err != nil {
+		return err
+	}
+	q.addLocked(name, bytes, 0, 0)
+	return nil
+}
+
+// add changes the usage of all quotas of the given path without checking their limits.
+func (q *Quotas) add(name string, bytes, files, dirs int64) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.addLocked(name, bytes, files, dirs)
+}
+
+func (q *Quotas) addLocked(name string, bytes, files, dirs int64) {
+	for _, s := range q.scopes {
+		if withinDir(name, s.path) {
+			s.used += bytes
+			s.files += files
+			s.dirs += dirs
+			s.changes++
+			q.updateSoft(s, time.Now())
+		}
+	}
+}
+
+// reserveEntry counts a new file or directory, unless this would exceed a file limit. The
+// directory of a quota itself doesn't count.
+func (q *Quotas) reserveEntry(name string, dir bool) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range q.scopes {
+		if withinDir(name, s.path) && name != s.path && s.fileLimit > 0 && s.files+s.dirs >= s.fileLimit {
+			return errQuotaExceeded
+		}
+	}
+	for _, s := range q.scopes {
+		if withinDir(name, s.path) && name != s.path {
+			if dir {
+				s.dirs++
+			} else {
+				s.files++
+			}
+			s.changes++
+		}
+	}
+	return nil
+}
+
+// releaseEntry reverts reserveEntry.
+func (q *Quotas) releaseEntry(name string, dir bool) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, s := range q.scopes {
+		if withinDir(name, s.path) && name != s.path {
+			if dir {
+				s.dirs--
+			} else {
+				s.files--
+			}
+			s.changes++
+		}
+	}
+}
+
+// mkdir counts a directory, which is about to be created. The returned function reverts it,
+// if the creation fails.
+func (q *Quotas) mkdir(ctx context.Context, name string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	if err := q.reserveEntry(name, true); err != nil {
+		traceStep(ctx, "creating %s exceeds the file limit", name)
+		return nil, quotaFromContext(ctx).exceed()
+	}
+	quotaFromContext(ctx).touch(name)
+	return func() { q.releaseEntry(name, true) }, nil
+}
+
+// withinDir returns whether name is dir or located beneath it.
+func withinDir(name, dir string) bool {
+	if name == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(name, dir)
+}
+
+// treeUsage returns the bytes, the number of regular files and the number of directories
+// stored beneath name in the storage, including name itself.
+func treeUsage(s storage, name string) (bytes int64, files int64, dirs int64, err error) {
+	err = s.Walk(name, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+			files++
+		} else if info.IsDir() {
+			dirs++
+		}
+		return nil
+	})
+	return bytes, files, dirs, err
+}
+
+// quotaState is shared by the file operations of a request and its response writer. It
+// carries the announced size of an upload and remembers whether a quota has been exceeded,
+// so the response is answered with 507 Insufficient Storage instead of the generic status
+// of the webdav handler. The path written last determines the quota headers of the response.
+type quotaState struct {
+	expected int64
+	exceeded int32
+
+	mu      sync.Mutex
+	warning string
+	target  string
+}
+
+func quotaFromContext(ctx context.Context) *quotaState {
+	state, _ := ctx.Value(quotaKey).(*quotaState)
+	return state
+}
+
+// withQuota prepares the quota handling of a request. Uploads announcing their size are
+// rejected before any data is written.
+func (q *Quotas) withQuota(ctx context.Context, w http.ResponseWriter, req *http.Request) (context.Context, http.ResponseWriter) {
+	if q == nil {
+		return ctx, w
+	}
+
+	state := &quotaState{}
+	if req.Method == http.MethodPut && req.ContentLength > 0 {
+		state.expected = req.ContentLength
+	}
+	return context.WithValue(ctx, quotaKey, state), &quotaWriter{ResponseWriter: w, quotas: q, state: state}
+}
+
+// exceed marks the quota of the request as exceeded.
+func (s *quotaState) exceed() error {
+	if s != nil {
+		atomic.StoreInt32(&s.exceeded, 1)
+	}
+	return errQuotaExceeded
+}
+
+func (s *quotaState) isExceeded() bool {
+	return s != nil && atomic.LoadInt32(&s.exceeded) == 1
+}
+
+// warn remembers a warning about an exceeded soft limit for the response.
+func (s *quotaState) warn(warning string) {
+	if s == nil || warning == "" {
+		return
+	}
+	s.mu.Lock()
+	s.warning = warning
+	s.mu.Unlock()
+}
+
+func (s *quotaState) getWarning() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.warning
+}
+
+// touch remembers the path written by the request.
+func (s *quotaState) touch(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.target = name
+	s.mu.Unlock()
+}
+
+func (s *quotaState) getTarget() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// takeExpected returns the announced size of the upload once, so it isn't applied to further
+// files opened by the request.
+func (s *quotaState) takeExpected() int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.SwapInt64(&s.expected, 0)
+}
+
+// quotaWriter adds the remaining quota to the responses of write operations and replaces
+// error responses of requests, which exceeded a quota.
+type quotaWriter struct {
+	http.ResponseWriter
+	quotas    *Quotas
+	state     *quotaState
+	rewritten bool
+}
+
+func (w *quotaWriter) WriteHeader(status int) {
+	if warning := w.state.getWarning(); warning != "" {
+		w.Header().Set("X-Quota-Warning", warning)
+	}
+	if target := w.state.getTarget(); target != "" {
+		w.quotas.setHeaders(w.Header(), target)
+	}
+	if status < 400 || !w.state.isExceeded() {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.rewritten = true
+	w.ResponseWriter.WriteHeader(http.StatusInsufficientStorage)
+	_, err := w.ResponseWriter.Write([]byte(fmt.Sprintf("%d %s", http.StatusInsufficientStorage, "Insufficient Storage")))
+	if err != nil {
+		log.WithError(err).Error("Error sending insufficient storage response")
+	}
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if w.rewritten {
+		// the body of the replaced response is dropped
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// quotaFile accounts the bytes written to a file. Writes beyond the bytes accounted for the
+// file so far reserve the difference, the actual size of the file is reconciled on Close. The
+// previous content of a truncated file stays accounted until it is overwritten, so the usage
+// doesn't drop below a soft limit and reset its grace period in between. A file whose upload
+// exceeded the quota is removed.
+type quotaFile struct {
+	webdav.File
+	name      string
+	quotas    *Quotas
+	state     *quotaState
+	accounted int64
+	written   int64
+	created   bool
+	exceeded  bool
+}
+
+// openQuotaFile opens the file for writing and accounts a truncated or created file.
+func (q *Quotas) openQuotaFile(ctx context.Context, name string, flag int, perm os.FileMode) (*quotaFile, error) {
+	state := quotaFromContext(ctx)
+
+	var size int64
+	fi, statErr := q.files.Stat(name)
+	if statErr == nil && fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+	if expected := state.takeExpected(); expected > 0 && flag&os.O_TRUNC != 0 {
+		if err := q.check(name, expected-size); err != nil {
+			traceStep(ctx, "upload of %d bytes exceeds the quota", expected)
+			return nil, state.exceed()
+		}
+	}
+
+	created := os.IsNotExist(statErr) && flag&os.O_CREATE != 0
+	if created {
+		if err := q.reserveEntry(name, false); err != nil {
+			traceStep(ctx, "creating %s exceeds the file limit", name)
+			return nil, state.exceed()
+		}
+	}
+
+	f, err := q.files.OpenFile(name, flag, perm)
+	if err != nil {
+		if created {
+			q.releaseEntry(name, false)
+		}
+		return nil, err
+	}
+
+	qf := &quotaFile{File: f, name: name, quotas: q, state: state, accounted: size, created: created}
+	if flag&os.O_TRUNC == 0 {
+		// appended or modified in place, the size is reconciled on Close
+		qf.written = size
+	}
+	return qf, nil
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	end := f.written + int64(len(p))
+	if extra := end - f.accounted; extra > 0 {
+		if err := f.quotas.reserve(f.name, extra); err != nil {
+			f.exceeded = true
+			return 0, f.state.exceed()
+		}
+		f.accounted = end
+	}
+	n, err := f.File.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+// Seek moves the position of the next write, writes at an offset within the accounted bytes
+// don't reserve anything.
+func (f *quotaFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.written = pos
+	}
+	return pos, err
+}
+
+func (f *quotaFile) Close() error {
+	fi, statErr := f.File.Stat()
+	err := f.File.Close()
+
+	if f.exceeded {
+		if rmErr := f.quotas.files.Remove(f.name); rmErr == nil {
+			log.WithField("path", f.name).Warn("Removed upload exceeding the quota")
+			f.quotas.add(f.name, -f.accounted, -1, 0)
+			return err
+		}
+	}
+	if statErr == nil {
+		f.quotas.add(f.name, fi.Size()-f.accounted, 0, 0)
+	}
+	f.state.warn(f.quotas.warning(f.name))
+	f.state.touch(f.name)
+	return err
+}
+
+// move transfers the usage of a renamed tree from the quotas of the old path to the quotas of
+// the new path. The returned function reverts the transfer, if the rename fails.
+func (q *Quotas) move(ctx context.Context, oldName, newName string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	bytes, files, dirs, err := treeUsage(q.files, oldName)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the quotas which contain one of the paths but not the other change
+	q.mu.Lock()
+	now := time.Now()
+	for _, s := range q.scopes {
+		if !withinDir(newName, s.path) || withinDir(oldName, s.path) {
+			continue
+		}
+		if !q.allows(s, bytes, now) || (s.fileLimit > 0 && s.files+s.dirs+files+dirs > s.fileLimit) {
+			q.mu.Unlock()
+			traceStep(ctx, "moving %d bytes to %s exceeds the quota", bytes, newName)
+			return nil, quotaFromContext(ctx).exceed()
+		}
+	}
+	q.transferLocked(oldName, newName, bytes, files, dirs)
+	q.mu.Unlock()
+	quotaFromContext(ctx).warn(q.warning(newName))
+	quotaFromContext(ctx).touch(newName)
+
+	return func() {
+		q.mu.Lock()
+		q.transferLocked(newName, oldName, bytes, files, dirs)
+		q.mu.Unlock()
+	}, nil
+}
+
+// transferLocked moves usage from the quotas of one path to the quotas of another one.
+func (q *Quotas) transferLocked(from, to string, bytes, files, dirs int64) {
+	now := time.Now()
+	for _, s := range q.scopes {
+		inFrom, inTo := withinDir(from, s.path), withinDir(to, s.path)
+		switch {
+		case inFrom && !inTo:
+			s.used -= bytes
+			s.files -= files
+			s.dirs -= dirs
+		case inTo && !inFrom:
+			s.used += bytes
+			s.files += files
+			s.dirs += dirs
+		default:
+			continue
+		}
+		s.changes++
+		q.updateSoft(s, now)
+	}
+}
+
+// remove releases the usage of a tree, which is about to be removed. The returned function
+// reverts the release, if the removal fails.
+func (q *Quotas) remove(ctx context.Context, name string) func() {
+	if q == nil {
+		return func() {}
+	}
+
+	bytes, files, dirs, _ := treeUsage(q.files, name)
+	q.add(name, -bytes, -files, -dirs)
+	quotaFromContext(ctx).touch(name)
+	return func() {
+		q.add(name, bytes, files, dirs)
+	}
+}
+
+// setHeaders adds the usage of the most restrictive quota of the path to the response, so
+// clients see how much space is left after a write. The remaining files and directories are
+// added for paths with a file limit.
+func (q *Quotas) setHeaders(h http.Header, name string) {
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	quota, files := q.restrictive(name)
+	if quota != nil {
+		h.Set("X-Quota-Scope", quota.name)
+		h.Set("X-Quota-Used", strconv.FormatInt(quota.used, 10))
+		h.Set("X-Quota-Limit", strconv.FormatInt(quota.limit, 10))
+		h.Set("X-Quota-Remaining", strconv.FormatInt(nonNegative(quota.limit-quota.used), 10))
+	}
+	if files != nil {
+		h.Set("X-Quota-Files-Remaining", strconv.FormatInt(nonNegative(files.fileLimit-files.files-files.dirs), 10))
+	}
+}
+
+// remaining returns the used bytes and the limit of the most restrictive quota of the path.
+// ok is false, if the path isn't limited.
+func (q *Quotas) remaining(name string) (used, limit int64, ok bool) {
+	if q == nil {
+		return 0, 0, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	quota, _ := q.restrictive(name)
+	if quota == nil {
+		return 0, 0, false
+	}
+	return quota.used, quota.limit, true
+}
+
+// restrictive returns the quotas of the path with the fewest remaining bytes and the fewest
+// remaining files. q.mu must be held.
+func (q *Quotas) restrictive(name string) (quota, files *quotaScope) {
+	for _, s := range q.scopes {
+		if !withinDir(name, s.path) {
+			continue
+		}
+		if s.limit > 0 && (quota == nil || s.limit-s.used < quota.limit-quota.used) {
+			quota = s
+		}
+		if s.fileLimit > 0 && (files == nil || s.fileLimit-s.files-s.dirs < files.fileLimit-files.files-files.dirs) {
+			files = s
+		}
+	}
+	return quota, files
+}
+
+var (
+	quotaAvailableName = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	quotaUsedName      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// openQuotaDir wraps directories opened for reading, which are limited by a quota, so they have
+// the quota properties of RFC 4331.
+func (q *Quotas) openQuotaDir(f webdav.File, name string, flag int) webdav.File {
+	if q == nil || flag&writeFlags != 0 {
+		return f
+	}
+	if _, _, ok := q.remaining(name); !ok {
+		return f
+	}
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		return f
+	}
+	return &quotaDir{File: f, quotas: q, name: name}
+}
+
+// quotaDir adds the DAV:quota-available-bytes and DAV:quota-used-bytes properties of the most
+// restrictive quota to the dead properties of a directory. Like the sync token they are
+// served as dead properties.
+type quotaDir struct {
+	webdav.File
+	quotas *Quotas
+	name   string
+}
+
+// DeadProps returns the quota properties and the dead properties of the directory.
+func (d *quotaDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	if holder, ok := d.File.(webdav.DeadPropsHolder); ok {
+		inner, err := holder.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range inner {
+			props[name] = p
+		}
+	}
+	used, limit, ok := d.quotas.remaining(d.name)
+	if !ok {
+		return props, nil
+	}
+	props[quotaAvailableName] = webdav.Property{XMLName: quotaAvailableName, InnerXML: []byte(strconv.FormatInt(nonNegative(limit-used), 10))}
+	props[quotaUsedName] = webdav.Property{XMLName: quotaUsedName, InnerXML: []byte(strconv.FormatInt(used, 10))}
+	return props, nil
+}
+
+// Patch changes the dead properties of the directory, if it has any, and rejects all changes
+// otherwise.
+func (d *quotaDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := d.File.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+func nonNegative(n int64) int64 {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// RegisterMetrics exposes the usage of the quotas.
+func (q *Quotas) RegisterMetrics(m *Metrics) {
+	if q == nil {
+		return
+	}
+
+	collect := func(value func(u QuotaUsage) int64) func() []Sample {
+		return func() []Sample {
+			var samples []Sample
+			for _, u := range q.Usage() {
+				labels := map[string]string{"scope": u.Scope, "user": u.User}
+				samples = append(samples, Sample{Labels: labels, Value: float64(value(u))})
+			}
+			return samples
+		}
+	}
+	m.Gauge("dave_quota_used_bytes", "Bytes stored within the scope of the quota.",
+		collect(func(u QuotaUsage) int64 { return u.Used }))
+	m.Gauge("dave_quota_limit_bytes", "Maximum bytes allowed within the scope of the quota.",
+		collect(func(u QuotaUsage) int64 { return u.Limit }))
+	m.Gauge("dave_quota_soft_limit_bytes", "Bytes within the scope of the quota, beyond which writes are warned about.",
+		collect(func(u QuotaUsage) int64 { return u.Soft }))
+	m.Gauge("dave_quota_used_files", "Files stored within the scope of the quota.",
+		collect(func(u QuotaUsage) int64 { return u.Files }))
+	m.Gauge("dave_quota_used_dirs", "Directories stored within the scope of the quota.",
+		collect(func(u QuotaUsage) int64 { return u.Dirs }))
+	m.Gauge("dave_quota_file_limit", "Maximum files and directories allowed within the scope of the quota.",
+		collect(func(u QuotaUsage) int64 { return u.FileLimit }))
+	m.Counter("dave_quota_drift_corrections_total", "Recalculations which corrected the usage of the quota.",
+		collect(func(u QuotaUsage) int64 { return u.Corrections }))
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// defaultQuotaGrace is the time writes beyond a soft limit are allowed, before it's enforced
+// like a hard limit.
+const defaultQuotaGrace = 7 * 24 * time.Hour
+
+// Events of the soft limits, which are sent to the webhook of the quotas
+const (
+	quotaEventSoftExceeded = "quota.softExceeded"
+	quotaEventGraceExpired = "quota.graceExpired"
+)
+
+// quotaEvent is the payload of the webhook of the quotas.
+type quotaEvent struct {
+	Event     string     `json:"event"`
+	Time      time.Time  `json:"time"`
+	Scope     string     `json:"scope"`
+	User      string     `json:"user,omitempty"`
+	Used      int64      `json:"used"`
+	Soft      int64      `json:"soft"`
+	Limit     int64      `json:"limit,omitempty"`
+	GraceEnds *time.Time `json:"graceEnds,omitempty"`
+}
+
+// updateSoft starts the grace period, once the usage exceeds the soft limit, and ends it, once
+// the usage dropped below it again. The caller must hold the lock.
+func (q *Quotas) updateSoft(s *quotaScope, now time.Time) {
+	if s.soft <= 0 {
+		return
+	}
+
+	over := s.used > s.soft
+	switch {
+	case over && s.softSince.IsZero():
+		s.softSince = now
+		q.notify(s, quotaEventSoftExceeded, "Soft quota exceeded")
+	case !over && !s.softSince.IsZero():
+		s.softSince = time.Time{}
+		s.expired = false
+		log.WithField("scope", s.name).WithField("user", s.user).Info("Usage dropped below soft quota")
+	}
+}
+
+// graceExpired returns whether adding bytes would exceed the soft limit after the end of the
+// grace period. The caller must hold the lock.
+func (q *Quotas) graceExpired(s *quotaScope, bytes int64, now time.Time) bool {
+	if s.soft <= 0 || s.softSince.IsZero() || now.Sub(s.softSince) < q.grace || s.used+bytes <= s.soft {
+		return false
+	}
+
+	if !s.expired {
+		s.expired = true
+		q.notify(s, quotaEventGraceExpired, "Grace period of soft quota expired, writes are blocked")
+	}
+	return true
+}
+
+// graceEnds returns the end of the grace period or nil, if the soft limit isn't exceeded.
+func (q *Quotas) graceEnds(s *quotaScope) *time.Time {
+	if s.softSince.IsZero() {
+		return nil
+	}
+	ends := s.softSince.Add(q.grace)
+	return &ends
+}
+
+// warning describes the exceeded soft limit of the most specific quota of the given file for
+// the X-Quota-Warning header. It is empty, if no soft limit is exceeded.
+func (q *Quotas) warning(name string) string {
+	if q == nil {
+		return ""
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var warning string
+	for _, s := range q.scopes {
+		if withinDir(name, s.path) && !s.softSince.IsZero() {
+			warning = "soft quota of " + s.name + " exceeded, grace period ends " + q.graceEnds(s).UTC().Format(time.RFC3339)
+		}
+	}
+	return warning
+}
+
+// notify logs the event and sends it to the webhook. The caller must hold the lock.
+func (q *Quotas) notify(s *quotaScope, event, msg string) {
+	log.WithFields(log.Fields{
+		"scope": s.name,
+		"user":  s.user,
+		"used":  ByteSize(s.used).String(),
+		"soft":  ByteSize(s.soft).String(),
+	}).Warn(msg)
+
+	if q.webhook != "" {
+		postWebhook(q.webhook, &quotaEvent{
+			Event:     event,
+			Time:      time.Now().UTC(),
+			Scope:     s.name,
+			User:      s.user,
+			Used:      s.used,
+			Soft:      s.soft,
+			Limit:     s.limit,
+			GraceEnds: q.graceEnds(s),
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// newQuotaApp creates an app enforcing the quotas of cfg.
+func newQuotaApp(t *testing.T, cfg *Config) *App {
+	quotas, err := NewQuotas(cfg)
+	if err != nil {
+		t.Fatalf("NewQuotas() error = %v", err)
+	}
+	return &App{
+		Config: cfg,
+		Quotas: quotas,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg, Quotas: quotas},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+}
+
+func quotaUsed(a *App) int64 {
+	return a.Quotas.Usage()[0].Used
+}
+
+func TestNewQuotas(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "sub"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a"), make([]byte, 100), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "sub", "b"), make([]byte, 50), 0600)
+
+	subdir := "sub"
+	a := newQuotaApp(t, &Config{
+		Dir:   tmpDir,
+		Quota: &Quota{Limit: 1000, Directories: []*DirQuota{{Path: "sub/", Limit: 500}, {Path: "/empty", Limit: 10}}},
+		Users: map[string]*UserInfo{
+			"alice": {Subdir: &subdir, Quota: 200},
+			"bob":   {Quota: 200},
+		},
+	})
+	want := []QuotaUsage{
+		{Scope: "/", Limit: 1000, Used: 150, Files: 2, Dirs: 1},
+		{Scope: "/sub", Limit: 500, Used: 50, Files: 1},
+		{Scope: "/empty", Limit: 10},
+		{Scope: "/sub", User: "alice", Limit: 200, Used: 50, Files: 1},
+	}
+	if got := a.Quotas.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Quotas.Usage() = %v, want %v", got, want)
+	}
+
+	if q, err := NewQuotas(&Config{Dir: tmpDir}); q != nil || err != nil {
+		t.Errorf("NewQuotas() without quota = %v, %v, want nil", q, err)
+	}
+}
+
+func TestQuotaUpload(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	a := newQuotaApp(t, &Config{Dir: tmpDir, Quota: &Quota{Limit: 100}})
+
+	tests := []struct {
+		name     string
+		path     string
+		size     int
+		chunked  bool
+		want     int
+		wantUsed int64
+	}{
+		{"within quota", "/a", 60, false, 201, 60},
+		{"announced size exceeds quota", "/b", 50, false, 507, 60},
+		{"streamed upload exceeds quota", "/b", 50, true, 507, 60},
+		{"overwrite frees the old size", "/a", 90, false, 201, 90},
+		{"fills the quota", "/c", 10, true, 201, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", tt.path, strings.NewReader(strings.Repeat("x", tt.size)))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+			if got := quotaUsed(a); got != tt.wantUsed {
+				t.Errorf("quota used = %v, want %v", got, tt.wantUsed)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "b")); !os.IsNotExist(err) {
+		t.Errorf("upload exceeding the quota was kept, error = %v", err)
+	}
+}
+
+func TestQuotaRemoveAndMove(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "dir"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "dir", "a"), make([]byte, 50), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "dir", "b"), make([]byte, 20), 0600)
+	a := newQuotaApp(t, &Config{Dir: tmpDir, Quota: &Quota{Limit: 100}})
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		dest     string
+		want     int
+		wantUsed int64
+	}{
+		{"move keeps the usage", "MOVE", "/dir/a", "/a", 201, 70},
+		{"copy exceeding the quota", "COPY", "/a", "/copy", 507, 70},
+		{"delete frees the usage", "DELETE", "/dir", "", 204, 50},
+		{"copy within the quota", "COPY", "/a", "/copy", 201, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.dest != "" {
+				req.Header.Set("Destination", tt.dest)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+			if got := quotaUsed(a); got != tt.wantUsed {
+				t.Errorf("quota used = %v, want %v", got, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func TestDirectoryAndUserQuota(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "dropbox"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "alice"
+	a := newQuotaApp(t, &Config{
+		Dir:   tmpDir,
+		Quota: &Quota{Limit: 1000, Directories: []*DirQuota{{Path: "/dropbox", Limit: 50}}},
+		Users: map[string]*UserInfo{
+			"admin": {Password: GenHash([]byte("password"))},
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, Quota: 30},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		dest   string
+		size   int
+		want   int
+	}{
+		{"within directory quota", "admin", "PUT", "/dropbox/a", "", 40, 201},
+		{"exceeds directory quota", "admin", "PUT", "/dropbox/b", "", 20, 507},
+		{"outside directory quota", "admin", "PUT", "/b", "", 100, 201},
+		{"move into directory exceeding it", "admin", "MOVE", "/b", "/dropbox/b", 0, 507},
+		{"move out of directory", "admin", "MOVE", "/dropbox/a", "/a", 0, 201},
+		{"move into directory within it", "admin", "MOVE", "/a", "/dropbox/a", 0, 201},
+		{"within user quota", "alice", "PUT", "/a", "", 30, 201},
+		{"exceeds user quota", "alice", "PUT", "/b", "", 1, 507},
+		{"user quota applies to subdir", "admin", "PUT", "/alice/b", "", 1, 507},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(strings.Repeat("x", tt.size)))
+			req.SetBasicAuth(tt.user, "password")
+			if tt.dest != "" {
+				req.Header.Set("Destination", tt.dest)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+
+	want := []QuotaUsage{
+		{Scope: "/", Limit: 1000, Used: 170, Files: 3, Dirs: 2},
+		{Scope: "/dropbox", Limit: 50, Used: 40, Files: 1},
+		{Scope: "/alice", User: "alice", Limit: 30, Used: 30, Files: 1},
+	}
+	if got := a.Quotas.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Quotas.Usage() = %v, want %v", got, want)
+	}
+}
+
+func TestQuotaHeaders(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "dropbox"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "alice"
+	a := newQuotaApp(t, &Config{
+		Dir:   tmpDir,
+		Quota: &Quota{Limit: 1000, Directories: []*DirQuota{{Path: "/dropbox", Limit: 50}}},
+		Users: map[string]*UserInfo{
+			"admin": {Password: GenHash([]byte("password"))},
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, FileLimit: 10},
+		},
+	})
+
+	tests := []struct {
+		name               string
+		user               string
+		method             string
+		path               string
+		size               int
+		wantScope          string
+		wantRemaining      string
+		wantFilesRemaining string
+	}{
+		{"most restrictive quota", "admin", "PUT", "/dropbox/a", 10, "/dropbox", "40", ""},
+		{"global quota", "admin", "PUT", "/b", 100, "/", "890", ""},
+		{"after removal", "admin", "DELETE", "/b", 0, "/", "990", ""},
+		{"no headers for reads", "admin", "GET", "/dropbox/a", 0, "", "", ""},
+		{"file limit", "alice", "MKCOL", "/d", 0, "/", "990", "9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.method == "PUT" {
+				body = strings.NewReader(strings.Repeat("x", tt.size))
+			}
+			req := httptest.NewRequest(tt.method, tt.path, body)
+			req.SetBasicAuth(tt.user, "password")
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if got := w.Header().Get("X-Quota-Scope"); got != tt.wantScope {
+				t.Errorf("handle() X-Quota-Scope = %q, want %q", got, tt.wantScope)
+			}
+			if got := w.Header().Get("X-Quota-Remaining"); got != tt.wantRemaining {
+				t.Errorf("handle() X-Quota-Remaining = %q, want %q", got, tt.wantRemaining)
+			}
+			if got := w.Header().Get("X-Quota-Files-Remaining"); got != tt.wantFilesRemaining {
+				t.Errorf("handle() X-Quota-Files-Remaining = %q, want %q", got, tt.wantFilesRemaining)
+			}
+		})
+	}
+}
+
+func TestQuotaProperties(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice", "docs"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "docs", "a"), make([]byte, 30), 0600)
+
+	subdir := "alice"
+	a := newQuotaApp(t, &Config{
+		Dir:   tmpDir,
+		Quota: &Quota{Limit: 1000},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, Quota: 100},
+		},
+	})
+
+	propfind := func(target, body string) string {
+		req := httptest.NewRequest("PROPFIND", target, strings.NewReader(body))
+		req.SetBasicAuth("alice", "password")
+		req.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		if w.Code != http.StatusMultiStatus {
+			t.Fatalf("PROPFIND of %s = %v", target, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	body := `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`
+	got := propfind("/docs", body)
+	if !strings.Contains(got, "<D:quota-available-bytes>70</D:quota-available-bytes>") || !strings.Contains(got, "<D:quota-used-bytes>30</D:quota-used-bytes>") {
+		t.Errorf("PROPFIND of a directory = %s, want the quota of the user", got)
+	}
+	if got := propfind("/docs/a", body); !strings.Contains(got, "404 Not Found") {
+		t.Errorf("PROPFIND of a file = %s, want no quota", got)
+	}
+}
+
+func TestQuotaRecalculate(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "dropbox"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a"), make([]byte, 40), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "dropbox", "b"), make([]byte, 20), 0600)
+
+	a := newQuotaApp(t, &Config{
+		Dir:   tmpDir,
+		Quota: &Quota{Limit: 1000, Directories: []*DirQuota{{Path: "/dropbox", Limit: 100}}},
+	})
+
+	// changes made without dave
+	os.Remove(filepath.Join(tmpDir, "a"))
+	ioutil.WriteFile(filepath.Join(tmpDir, "dropbox", "c"), make([]byte, 30), 0600)
+
+	if err := a.Quotas.recalculate(); err != nil {
+		t.Fatalf("recalculate() error = %v", err)
+	}
+	want := []QuotaUsage{
+		{Scope: "/", Limit: 1000, Used: 50, Files: 2, Dirs: 1, Corrections: 1},
+		{Scope: "/dropbox", Limit: 100, Used: 50, Files: 2, Corrections: 1},
+	}
+	if got := a.Quotas.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Quotas.Usage() = %v, want %v", got, want)
+	}
+
+	// without drift, nothing is corrected
+	if err := a.Quotas.recalculate(); err != nil {
+		t.Fatalf("recalculate() error = %v", err)
+	}
+	if got := a.Quotas.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Quotas.Usage() = %v, want %v", got, want)
+	}
+}
+
+func TestFileLimit(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "a"), make([]byte, 10), 0600)
+
+	subdir := "alice"
+	a := newQuotaApp(t, &Config{
+		Dir: tmpDir,
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, FileLimit: 3},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   int
+	}{
+		{"create directory", "MKCOL", "/d", 201},
+		{"create file", "PUT", "/d/b", 201},
+		{"exceeds file limit", "PUT", "/c", 507},
+		{"directory exceeds file limit", "MKCOL", "/e", 507},
+		{"overwrite existing file", "PUT", "/a", 201},
+		{"remove file", "DELETE", "/d/b", 204},
+		{"create file after removal", "PUT", "/c", 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.method == "PUT" {
+				body = strings.NewReader("x")
+			}
+			req := httptest.NewRequest(tt.method, tt.path, body)
+			req.SetBasicAuth("alice", "password")
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "alice", "e")); !os.IsNotExist(err) {
+		t.Errorf("directory exceeding the file limit exists, error = %v", err)
+	}
+	want := []QuotaUsage{
+		{Scope: "/alice", User: "alice", Used: 2, Files: 2, Dirs: 1, FileLimit: 3},
+	}
+	if got := a.Quotas.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Quotas.Usage() = %v, want %v", got, want)
+	}
+}
+
+func TestSoftQuota(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	events := make(chan quotaEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e quotaEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events <- e
+	}))
+	defer receiver.Close()
+
+	grace := 100 * time.Millisecond
+	a := newQuotaApp(t, &Config{
+		Dir:   tmpDir,
+		Quota: &Quota{Limit: 100, Soft: 50, Grace: grace, Webhook: receiver.URL},
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		size        int
+		wait        time.Duration
+		want        int
+		wantWarning bool
+		wantEvent   string
+	}{
+		{"below soft limit", "PUT", "/a", 40, 0, 201, false, ""},
+		{"exceeds soft limit", "PUT", "/b", 20, 0, 201, true, quotaEventSoftExceeded},
+		{"overwrite within grace period", "PUT", "/b", 30, 0, 201, true, ""},
+		{"exceeds hard limit", "PUT", "/c", 40, 0, 507, false, ""},
+		{"grace period expired", "PUT", "/c", 1, grace, 507, false, quotaEventGraceExpired},
+		{"drops below soft limit", "DELETE", "/b", 0, 0, 204, false, ""},
+		{"below soft limit again", "PUT", "/c", 5, 0, 201, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			time.Sleep(tt.wait)
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(strings.Repeat("x", tt.size)))
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+			if got := w.Header().Get("X-Quota-Warning") != ""; got != tt.wantWarning {
+				t.Errorf("handle() X-Quota-Warning = %q, want %v", w.Header().Get("X-Quota-Warning"), tt.wantWarning)
+			}
+			if tt.wantEvent != "" {
+				select {
+				case e := <-events:
+					if e.Event != tt.wantEvent || e.Scope != "/" || e.Soft != 50 {
+						t.Errorf("webhook event = %+v, want %v", e, tt.wantEvent)
+					}
+				case <-time.After(time.Second):
+					t.Errorf("webhook event %v not received", tt.wantEvent)
+				}
+			}
+		})
+	}
+
+	select {
+	case e := <-events:
+		t.Errorf("unexpected webhook event %+v", e)
+	default:
+	}
+}
+
+func TestQuotaUpdateLimits(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "a"), make([]byte, 50), 0600)
+
+	subdir := "alice"
+	cfg := &Config{Dir: tmpDir, Users: map[string]*UserInfo{"alice": {Subdir: &subdir, Quota: 60}}}
+	a := newQuotaApp(t, cfg)
+	if err := a.Quotas.check(filepath.Join(tmpDir, "alice", "b"), 20); err != errQuotaExceeded {
+		t.Fatalf("check() before the reload error = %v, want %v", err, errQuotaExceeded)
+	}
+
+	updateConfig(cfg, &Config{Dir: tmpDir, Users: map[string]*UserInfo{"alice": {Subdir: &subdir, Quota: 100, FileLimit: 5}}})
+	a.Quotas.UpdateLimits(cfg)
+	if err := a.Quotas.check(filepath.Join(tmpDir, "alice", "b"), 20); err != nil {
+		t.Errorf("check() after the reload error = %v, want the raised quota", err)
+	}
+	want := []QuotaUsage{{Scope: "/alice", User: "alice", Limit: 100, Used: 50, Files: 1, FileLimit: 5}}
+	if got := a.Quotas.Usage(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Quotas.Usage() = %v, want %v", got, want)
+	}
+
+	var q *Quotas
+	q.UpdateLimits(cfg)
+}
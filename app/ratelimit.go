@@ -0,0 +1,168 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Settings of the write limits
+const (
+	defaultWriteWindow = time.Minute
+	maxWriteCounters   = 1024
+)
+
+// errWriteLimited is returned for write operations exceeding the write limit.
+var errWriteLimited = errors.New("write limit exceeded")
+
+// WriteLimit limits the number of write operations per user within a time window, regardless
+// of their size. It contains scripts, which create huge numbers of tiny files.
+type WriteLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// window returns the configured window or its default.
+func (l *WriteLimit) window() time.Duration {
+	if l.Window <= 0 {
+		return defaultWriteWindow
+	}
+	return l.Window
+}
+
+// isWrite returns whether the method creates, modifies or removes resources.
+func isWrite(method string) bool {
+	switch method {
+	case http.MethodPut, "MKCOL", "COPY", "MOVE", http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// WriteLimiter counts the write operations of the users within fixed time windows. Clients
+// of servers without users are counted by their address. A nil WriteLimiter is valid and
+// limits nothing.
+type WriteLimiter struct {
+	mu       sync.Mutex
+	counters map[string]*writeCounter
+	rejected int64
+}
+
+type writeCounter struct {
+	start  time.Time
+	count  int
+	warned bool
+}
+
+// NewWriteLimiter creates a limiter without any counted operations.
+func NewWriteLimiter() *WriteLimiter {
+	return &WriteLimiter{counters: map[string]*writeCounter{}}
+}
+
+// allow counts the write operation of key and returns whether it is within the limit. If it
+// isn't, the time until the window ends is returned and whether it's the first rejection
+// within the window.
+func (wl *WriteLimiter) allow(key string, limit *WriteLimit, now time.Time) (bool, time.Duration, bool) {
+	if wl == nil || limit == nil || limit.Requests <= 0 {
+		return true, 0, false
+	}
+	window := limit.window()
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if len(wl.counters) >= maxWriteCounters {
+		wl.prune(now, window)
+	}
+
+	c := wl.counters[key]
+	if c == nil || now.Sub(c.start) >= window {
+		c = &writeCounter{start: now}
+		wl.counters[key] = c
+	}
+	if c.count >= limit.Requests {
+		atomic.AddInt64(&wl.rejected, 1)
+		first := !c.warned
+		c.warned = true
+		return false, c.start.Add(window).Sub(now), first
+	}
+	c.count++
+	return true, 0, false
+}
+
+// prune drops the counters of windows which have ended.
+func (wl *WriteLimiter) prune(now time.Time, window time.Duration) {
+	for key, c := range wl.counters {
+		if now.Sub(c.start) >= window {
+			delete(wl.counters, key)
+		}
+	}
+}
+
+// RegisterMetrics exposes the number of rejected write operations.
+func (wl *WriteLimiter) RegisterMetrics(m *Metrics) {
+	if wl == nil {
+		return
+	}
+
+	m.Counter("dave_write_limit_rejections_total", "Write operations rejected by the write limit.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&wl.rejected))}}
+	})
+}
+
+// writeLimit returns the write limit of the user, which overrides the global one.
+func (cfg *Config) writeLimit(username string) *WriteLimit {
+	if user := cfg.User(username); user != nil && user.WriteLimit != nil {
+		return user.WriteLimit
+	}
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	return cfg.WriteLimit
+}
+
+// allowWrite checks a write operation of the user from the address against the write limit
+// and returns whether it may proceed, or else the time until the next one may. The frontends
+// without HTTP, like FTP and SFTP, check their write operations with it. Only the first
+// rejection within a window is logged.
+func (a *App) allowWrite(ctx context.Context, username, address string) (bool, time.Duration) {
+	key := username
+	if key == "" {
+		key = "@" + address
+	}
+	ok, retry, first := a.WriteLimiter.allow(key, a.Config.writeLimit(username), time.Now())
+	if ok {
+		return true, 0
+	}
+
+	traceStep(ctx, "write limit exceeded, retry after %s", retry)
+	if first {
+		log.WithField("user", username).WithField("address", address).Warn("Write limit exceeded")
+	}
+	return false, retry
+}
+
+// checkWriteLimit answers write operations exceeding the write limit with 429 Too Many
+// Requests and returns whether the request may proceed.
+func (a *App) checkWriteLimit(ctx context.Context, w http.ResponseWriter, req *http.Request, username string) bool {
+	if !isWrite(req.Method) {
+		return true
+	}
+	ok, retry := a.allowWrite(ctx, username, a.Config.clientIP(req))
+	if ok {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, err := w.Write([]byte(fmt.Sprintf("%d %s", http.StatusTooManyRequests, "Too Many Requests")))
+	if err != nil {
+		log.WithError(err).Error("Error sending too many requests response")
+	}
+	return false
+}
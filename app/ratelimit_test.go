@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestWriteLimiterAllow(t *testing.T) {
+	wl := NewWriteLimiter()
+	limit := &WriteLimit{Requests: 2, Window: 10 * time.Second}
+	start := time.Now()
+
+	tests := []struct {
+		name      string
+		key       string
+		offset    time.Duration
+		want      bool
+		wantRetry time.Duration
+		wantFirst bool
+	}{
+		{"first write", "foo", 0, true, 0, false},
+		{"second write", "foo", time.Second, true, 0, false},
+		{"exceeding write", "foo", 2 * time.Second, false, 8 * time.Second, true},
+		{"repeated exceeding write", "foo", 3 * time.Second, false, 7 * time.Second, false},
+		{"other user", "bar", 3 * time.Second, true, 0, false},
+		{"next window", "foo", 10 * time.Second, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, retry, first := wl.allow(tt.key, limit, start.Add(tt.offset))
+			if got != tt.want || retry != tt.wantRetry || first != tt.wantFirst {
+				t.Errorf("WriteLimiter.allow() = %v, %v, %v, want %v, %v, %v", got, retry, first, tt.want, tt.wantRetry, tt.wantFirst)
+			}
+		})
+	}
+
+	var nilLimiter *WriteLimiter
+	if ok, _, _ := nilLimiter.allow("foo", limit, start); !ok {
+		t.Errorf("WriteLimiter.allow() of nil limiter = %v, want true", ok)
+	}
+	if ok, _, _ := wl.allow("foo", nil, start.Add(time.Minute)); !ok {
+		t.Errorf("WriteLimiter.allow() without limit = %v, want true", ok)
+	}
+}
+
+func TestHandleWriteLimit(t *testing.T) {
+	a := &App{
+		Config: &Config{
+			WriteLimit: &WriteLimit{Requests: 1},
+			Users: map[string]*UserInfo{
+				"foo": {Password: GenHash([]byte("password"))},
+				"bot": {Password: GenHash([]byte("password")), WriteLimit: &WriteLimit{Requests: 2}},
+			},
+		},
+		Handler: &webdav.Handler{
+			FileSystem: webdav.NewMemFS(),
+			LockSystem: webdav.NewMemLS(),
+		},
+		WriteLimiter: NewWriteLimiter(),
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		method string
+		path   string
+		want   int
+	}{
+		{"first write", "foo", "MKCOL", "/a", 201},
+		{"read is not limited", "foo", "PROPFIND", "/", 207},
+		{"exceeding write", "foo", "PUT", "/a/b", 429},
+		{"user limit", "bot", "PUT", "/b", 201},
+		{"within user limit", "bot", "PUT", "/c", 201},
+		{"exceeding user limit", "bot", "DELETE", "/c", 429},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.SetBasicAuth(tt.user, "password")
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+
+			if w.Code != tt.want {
+				t.Errorf("handle() status = %v, want %v", w.Code, tt.want)
+			}
+			if tt.want == 429 {
+				// the end of the default window of one minute
+				if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry <= 0 || retry > 60 {
+					t.Errorf("handle() Retry-After = %v, want at most %v", w.Header().Get("Retry-After"), 60)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync/atomic"
+)
+
+var errReadOnly = errors.New("server is in read-only mode")
+
+// SetReadOnly switches the emergency read-only mode, which rejects all writes of all frontends
+// with 403 Forbidden until it's switched off again. It's meant for incident response or the
+// failover of the storage and isn't kept across restarts.
+func (cfg *Config) SetReadOnly(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	if atomic.SwapInt32(&cfg.readOnly, v) != v {
+		if enabled {
+			log.Warn("Enabled read-only mode, all writes are rejected")
+		} else {
+			log.Warn("Disabled read-only mode")
+		}
+	}
+}
+
+// ReadOnly returns whether the emergency read-only mode is enabled.
+func (cfg *Config) ReadOnly() bool {
+	return atomic.LoadInt32(&cfg.readOnly) == 1
+}
+
+// checkReadOnly returns errReadOnly, if writes are rejected by the read-only mode.
+func (d Dir) checkReadOnly(ctx context.Context, name string) error {
+	if !d.Config.ReadOnly() {
+		return nil
+	}
+	traceStep(ctx, "rejected write of %s in read-only mode", name)
+	rejectionFromContext(ctx).reject(http.StatusForbidden)
+	return errReadOnly
+}
+
+// RegisterMetrics exposes whether the read-only mode is enabled.
+func (cfg *Config) RegisterMetrics(m *Metrics) {
+	m.Gauge("dave_read_only", "Whether the emergency read-only mode is enabled.", func() []Sample {
+		var v float64
+		if cfg.ReadOnly() {
+			v = 1
+		}
+		return []Sample{{Value: v}}
+	})
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+
+	cfg := &Config{
+		Dir: tmpDir,
+		Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}},
+	}
+	a := newQuotaApp(t, cfg)
+	admin := NewAdminHandler(a)
+	setReadOnly := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/api/v1/readonly", strings.NewReader(body))
+		req.SetBasicAuth("root", "secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+	if w := setReadOnly(`{"enabled":true}`); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":true`) {
+		t.Fatalf("enabling read-only mode = %v %s, want %v", w.Code, w.Body.String(), http.StatusOK)
+	}
+	if w := setReadOnly(`{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("switching without state status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header []string
+		want   int
+	}{
+		{"read", "GET", "/a.txt", nil, http.StatusOK},
+		{"listing", "PROPFIND", "/", []string{"Depth", "1"}, http.StatusMultiStatus},
+		{"upload", "PUT", "/b.txt", nil, http.StatusForbidden},
+		{"overwrite", "PUT", "/a.txt", nil, http.StatusForbidden},
+		{"mkcol", "MKCOL", "/dir", nil, http.StatusForbidden},
+		{"delete", "DELETE", "/a.txt", nil, http.StatusForbidden},
+		{"move", "MOVE", "/a.txt", []string{"Destination", "/c.txt"}, http.StatusForbidden},
+		{"copy", "COPY", "/a.txt", []string{"Destination", "/c.txt"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body string
+			if tt.method == "PUT" {
+				body = "content"
+			}
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(body))
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				req.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "a.txt")); string(data) != "a" {
+		t.Errorf("file in read-only mode = %q, want %q", data, "a")
+	}
+
+	setReadOnly(`{"enabled":false}`)
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, httptest.NewRequest("PUT", "/b.txt", strings.NewReader("b")), a)
+	if w.Code != http.StatusCreated {
+		t.Errorf("PUT after disabling read-only mode status = %v, want %v", w.Code, http.StatusCreated)
+	}
+}
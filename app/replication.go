@@ -0,0 +1,788 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the replication
+const (
+	defaultReplicationInterval = 24 * time.Hour
+	defaultReplicationRetry    = time.Minute
+	defaultReplicationRegion   = "us-east-1"
+)
+
+var errReplicationRunning = errors.New("reconciliation is already running")
+
+// Replication mirrors the files and directories below the base dir to a secondary backend,
+// either the directory Dir, the bucket of S3 or the remote dave of the remotes named by
+// Remote. Every write, rename and deletion is replicated asynchronously, failures are retried
+// every Retry, 1m by default. A reconciliation compares both sides every Interval, 24h by
+// default, and fixes what the replication missed.
+type Replication struct {
+	Dir      string
+	S3       *ReplicationS3
+	Remote   string
+	Interval time.Duration
+	Retry    time.Duration
+}
+
+// ReplicationS3 is a bucket of an S3 compatible object storage. The objects are stored below
+// Prefix, path-style on Endpoint, signed for Region, us-east-1 by default.
+type ReplicationS3 struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// ReplicationRun is the result of a reconciliation, Finished is nil while it's running.
+type ReplicationRun struct {
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Uploaded int64      `json:"uploaded"`
+	Removed  int64      `json:"removed"`
+	Errors   int64      `json:"errors"`
+}
+
+// ReplicationStatus is the state of the replication reported by the admin API.
+type ReplicationStatus struct {
+	Backend    string          `json:"backend"`
+	Pending    int             `json:"pending"`
+	Replicated int64           `json:"replicated"`
+	Failures   int64           `json:"failures"`
+	Running    *ReplicationRun `json:"running,omitempty"`
+	LastRun    *ReplicationRun `json:"lastRun,omitempty"`
+}
+
+// replicaObject is a file or directory of a backend.
+type replicaObject struct {
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+// replicaBackend stores the replicated files. The names are slash separated and relative to
+// the base dir, removing a missing name isn't an error.
+type replicaBackend interface {
+	list() (map[string]replicaObject, error)
+	put(name string, r io.Reader, size int64, modTime time.Time) error
+	mkdir(name string) error
+	remove(name string) error
+	String() string
+}
+
+// Replicator replicates the changes of the base dir in the background. A nil Replicator is
+// valid and replicates nothing.
+type Replicator struct {
+	settings *Replication
+	dir      string
+	files    storage
+	backend  replicaBackend
+	wake     chan struct{}
+
+	// work serializes the replication of the changes and the reconciliation
+	work sync.Mutex
+
+	mu      sync.Mutex
+	pending map[string]bool
+	running *ReplicationRun
+	last    *ReplicationRun
+
+	replicated int64
+	failures   int64
+}
+
+// NewReplicator creates the replication of the configuration. It returns nil, if no
+// replication is configured.
+func NewReplicator(cfg *Config) (*Replicator, error) {
+	if cfg.Replication == nil {
+		return nil, nil
+	}
+	if cfg.ContentStore != nil {
+		return nil, fmt.Errorf("replication isn't available with the content store")
+	}
+	settings := cfg.Replication
+	base, err := filepath.Abs(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backends []replicaBackend
+	if settings.Dir != "" {
+		dir, err := filepath.Abs(settings.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if withinDir(dir, base) || withinDir(base, dir) {
+			return nil, fmt.Errorf("replication dir %s must be outside of the base dir %s", settings.Dir, cfg.Dir)
+		}
+		backends = append(backends, &dirReplica{dir: dir})
+	}
+	if s := settings.S3; s != nil {
+		endpoint, err := url.Parse(s.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || s.Bucket == "" {
+			return nil, fmt.Errorf("replication to S3 requires an http or https endpoint and a bucket")
+		}
+		backends = append(backends, &s3Bucket{settings: s, endpoint: endpoint, http: http.DefaultClient})
+	}
+	if settings.Remote != "" {
+		remote := cfg.Remotes[settings.Remote]
+		if remote == nil {
+			return nil, fmt.Errorf("unknown remote %s of the replication", settings.Remote)
+		}
+		client, err := NewClient(remote.URL, remote.Username, remote.Password)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, &remoteReplica{name: settings.Remote, client: client})
+	}
+	if len(backends) != 1 {
+		return nil, fmt.Errorf("replication requires exactly one of dir, s3 and remote")
+	}
+
+	return &Replicator{
+		settings: settings,
+		dir:      base,
+		files:    cfg.storage(),
+		backend:  backends[0],
+		wake:     make(chan struct{}, 1),
+		pending:  map[string]bool{},
+	}, nil
+}
+
+// Start replicates the changes as they happen and reconciles the backend right away and then
+// every interval.
+func (r *Replicator) Start() {
+	if r == nil {
+		return
+	}
+
+	retry := r.settings.Retry
+	if retry <= 0 {
+		retry = defaultReplicationRetry
+	}
+	interval := r.settings.Interval
+	if interval <= 0 {
+		interval = defaultReplicationInterval
+	}
+	go func() {
+		ticker := time.NewTicker(retry)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.wake:
+			case <-ticker.C:
+			}
+			r.flush()
+		}
+	}()
+	go func() {
+		for {
+			r.reconcile(time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// changed queues the physical path for the replication. The whole tree below it is replicated,
+// if tree is set, otherwise only the path itself.
+func (r *Replicator) changed(physical string, tree bool) {
+	if r == nil {
+		return
+	}
+	rel, err := filepath.Rel(r.dir, physical)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+
+	r.mu.Lock()
+	name := path.Join("/", filepath.ToSlash(rel))
+	r.pending[name] = r.pending[name] || tree
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush replicates the queued changes, parents before their members. Failed changes stay
+// queued until the next retry.
+func (r *Replicator) flush() {
+	r.work.Lock()
+	defer r.work.Unlock()
+
+	r.mu.Lock()
+	batch := r.pending
+	r.pending = map[string]bool{}
+	r.mu.Unlock()
+	names := make([]string, 0, len(batch))
+	for name := range batch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := r.replicate(name, batch[name]); err != nil {
+			atomic.AddInt64(&r.failures, 1)
+			log.WithFields(log.Fields{"path": name, "backend": r.backend.String()}).WithError(err).Warn("Error replicating change")
+			r.mu.Lock()
+			r.pending[name] = r.pending[name] || batch[name]
+			r.mu.Unlock()
+			continue
+		}
+		atomic.AddInt64(&r.replicated, 1)
+	}
+}
+
+// replicate brings the backend in line with the current state of the path.
+func (r *Replicator) replicate(name string, tree bool) error {
+	physical := filepath.Join(r.dir, filepath.FromSlash(name))
+	fi, err := r.files.Lstat(physical)
+	switch {
+	case os.IsNotExist(err):
+		return r.backend.remove(name)
+	case err != nil:
+		return err
+	case fi.Mode().IsRegular():
+		return r.upload(name, physical)
+	case !fi.IsDir():
+		return nil
+	}
+
+	if err := r.backend.mkdir(name); err != nil || !tree {
+		return err
+	}
+	return r.files.Walk(physical, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == physical {
+			return err
+		}
+		rel, _ := filepath.Rel(r.dir, p)
+		member := path.Join("/", filepath.ToSlash(rel))
+		if fi.IsDir() {
+			return r.backend.mkdir(member)
+		}
+		if fi.Mode().IsRegular() {
+			return r.upload(member, p)
+		}
+		return nil
+	})
+}
+
+// upload copies the file to the backend.
+func (r *Replicator) upload(name, physical string) error {
+	f, err := r.files.OpenFile(physical, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return r.backend.put(name, f, fi.Size(), fi.ModTime())
+}
+
+// reconcile compares the base dir with the backend. Missing and outdated files are uploaded,
+// files and directories, which don't exist below the base dir, are removed.
+func (r *Replicator) reconcile(now time.Time) (*ReplicationRun, error) {
+	r.mu.Lock()
+	if r.running != nil {
+		r.mu.Unlock()
+		return nil, errReplicationRunning
+	}
+	run := &ReplicationRun{Started: now}
+	r.running = run
+	r.mu.Unlock()
+	log.WithField("backend", r.backend.String()).Info("Reconciling the replication")
+
+	r.work.Lock()
+	r.compare(run)
+	r.work.Unlock()
+
+	r.mu.Lock()
+	finished := time.Now()
+	run.Finished = &finished
+	r.running = nil
+	r.last = run
+	result := *run
+	r.mu.Unlock()
+
+	log.WithFields(log.Fields{"backend": r.backend.String(), "uploaded": result.Uploaded, "removed": result.Removed,
+		"errors": result.Errors, "duration": finished.Sub(now).Round(time.Second).String()}).Info("Reconciled the replication")
+	return &result, nil
+}
+
+// compare applies the differences between the base dir and the backend. The counters of the
+// run are updated while it runs. r.work must be held.
+func (r *Replicator) compare(run *ReplicationRun) {
+	count := func(counter *int64) {
+		r.mu.Lock()
+		*counter++
+		r.mu.Unlock()
+	}
+	failed := func(name string, err error) {
+		count(&run.Errors)
+		log.WithFields(log.Fields{"path": name, "backend": r.backend.String()}).WithError(err).Warn("Error reconciling the replication")
+	}
+
+	local := map[string]replicaObject{}
+	r.files.Walk(r.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			failed(p, err)
+			return nil
+		}
+		if p == r.dir || (!fi.IsDir() && !fi.Mode().IsRegular()) {
+			return nil
+		}
+		rel, _ := filepath.Rel(r.dir, p)
+		local[path.Join("/", filepath.ToSlash(rel))] = replicaObject{size: fi.Size(), modTime: fi.ModTime(), dir: fi.IsDir()}
+		return nil
+	})
+	remote, err := r.backend.list()
+	if err != nil {
+		failed("/", err)
+		return
+	}
+
+	names := make([]string, 0, len(local))
+	for name := range local {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, rem := local[name], remote[name]
+		_, exists := remote[name]
+		if exists && rem.dir != o.dir {
+			if err := r.backend.remove(name); err != nil {
+				failed(name, err)
+				continue
+			}
+			exists = false
+		}
+		switch {
+		case o.dir && !exists:
+			if err := r.backend.mkdir(name); err != nil {
+				failed(name, err)
+			}
+		case !o.dir && (!exists || rem.size != o.size || o.modTime.Truncate(time.Second).After(rem.modTime)):
+			if err := r.upload(name, filepath.Join(r.dir, filepath.FromSlash(name))); err != nil {
+				failed(name, err)
+				continue
+			}
+			count(&run.Uploaded)
+		}
+	}
+
+	extra := []string{}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	removed := ""
+	for _, name := range extra {
+		if removed != "" && strings.HasPrefix(name, removed+"/") {
+			continue
+		}
+		if err := r.backend.remove(name); err != nil {
+			failed(name, err)
+			continue
+		}
+		removed = name
+		count(&run.Removed)
+	}
+}
+
+// status returns the state of the replication.
+func (r *Replicator) status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := ReplicationStatus{
+		Backend:    r.backend.String(),
+		Pending:    len(r.pending),
+		Replicated: atomic.LoadInt64(&r.replicated),
+		Failures:   atomic.LoadInt64(&r.failures),
+	}
+	if r.running != nil {
+		running := *r.running
+		status.Running = &running
+	}
+	if r.last != nil {
+		last := *r.last
+		status.LastRun = &last
+	}
+	return status
+}
+
+// openReplicaFile wraps a file opened for writing, so it's replicated when it's closed.
+func (r *Replicator) openReplicaFile(f webdav.File, name string, flag int) webdav.File {
+	if r == nil || flag&writeFlags == 0 {
+		return f
+	}
+	return &replicaFile{File: f, replicator: r, name: name}
+}
+
+// replicaFile queues the written file for the replication when it's closed, so its content
+// is complete.
+type replicaFile struct {
+	webdav.File
+	replicator *Replicator
+	name       string
+}
+
+func (f *replicaFile) Close() error {
+	err := f.File.Close()
+	f.replicator.changed(f.name, false)
+	return err
+}
+
+// RegisterMetrics exposes the queued and replicated changes and the last reconciliation.
+func (r *Replicator) RegisterMetrics(m *Metrics) {
+	if r == nil {
+		return
+	}
+
+	m.Gauge("dave_replication_pending", "Changes waiting for the replication.", func() []Sample {
+		return []Sample{{Value: float64(r.status().Pending)}}
+	})
+	m.Counter("dave_replication_replicated_total", "Changes replicated to the secondary backend.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&r.replicated))}}
+	})
+	m.Counter("dave_replication_failures_total", "Failed attempts to replicate a change.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&r.failures))}}
+	})
+	m.Gauge("dave_replication_last_reconcile_timestamp_seconds", "Time the last reconciliation finished.", func() []Sample {
+		last := r.status().LastRun
+		if last == nil || last.Finished == nil {
+			return nil
+		}
+		return []Sample{{Value: float64(last.Finished.Unix())}}
+	})
+}
+
+// dirReplica replicates to a directory, the modification times are kept.
+type dirReplica struct {
+	dir string
+}
+
+func (d *dirReplica) String() string {
+	return d.dir
+}
+
+func (d *dirReplica) list() (map[string]replicaObject, error) {
+	objects := map[string]replicaObject{}
+	if err := os.MkdirAll(d.dir, 0700); err != nil {
+		return nil, err
+	}
+	err := filepath.Walk(d.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == d.dir {
+			return err
+		}
+		rel, _ := filepath.Rel(d.dir, p)
+		objects[path.Join("/", filepath.ToSlash(rel))] = replicaObject{size: fi.Size(), modTime: fi.ModTime(), dir: fi.IsDir()}
+		return nil
+	})
+	return objects, err
+}
+
+func (d *dirReplica) put(name string, r io.Reader, size int64, modTime time.Time) error {
+	target := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(target), ".dave-replica-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(f.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), target)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (d *dirReplica) mkdir(name string) error {
+	return os.MkdirAll(filepath.Join(d.dir, filepath.FromSlash(name)), 0700)
+}
+
+func (d *dirReplica) remove(name string) error {
+	return os.RemoveAll(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+// remoteReplica replicates to a WebDAV server, usually another dave.
+type remoteReplica struct {
+	name   string
+	client *Client
+}
+
+func (d *remoteReplica) String() string {
+	return "remote " + d.name
+}
+
+func (d *remoteReplica) list() (map[string]replicaObject, error) {
+	objects := map[string]replicaObject{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		members, err := d.client.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			objects[m.Path] = replicaObject{size: m.Size, modTime: m.ModTime, dir: m.IsDir}
+			if m.IsDir {
+				if err := walk(m.Path); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return objects, walk("/")
+}
+
+// put uploads the file. Missing parents are created, if the server rejects the upload
+// because of them.
+func (d *remoteReplica) put(name string, r io.Reader, size int64, modTime time.Time) error {
+	upload := func() error {
+		if size == 0 {
+			return d.client.Upload(name, http.NoBody, 0)
+		}
+		return d.client.Upload(name, r, size)
+	}
+	err := upload()
+	var re *RemoteError
+	if !errors.As(err, &re) || re.StatusCode != http.StatusConflict {
+		return err
+	}
+	var parents []string
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		parents = append([]string{dir}, parents...)
+	}
+	for _, parent := range parents {
+		if err := d.mkdir(parent); err != nil {
+			return err
+		}
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return upload()
+}
+
+// mkdir creates the collection, an existing one is accepted.
+func (d *remoteReplica) mkdir(name string) error {
+	err := d.client.Mkdir(name)
+	var re *RemoteError
+	if errors.As(err, &re) && re.StatusCode == http.StatusMethodNotAllowed {
+		return nil
+	}
+	return err
+}
+
+func (d *remoteReplica) remove(name string) error {
+	if err := d.client.Remove(name); err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// s3Bucket is a bucket of S3, the backend of the replication and the object store. Directories
+// are implied by the keys of their members.
+type s3Bucket struct {
+	settings *ReplicationS3
+	endpoint *url.URL
+	http     *http.Client
+}
+
+// s3ListResult is the result of a ListObjectsV2 request.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (d *s3Bucket) String() string {
+	return "s3 " + d.settings.Bucket
+}
+
+// key returns the key of the object of a name.
+func (d *s3Bucket) key(name string) string {
+	return path.Join(d.settings.Prefix, strings.TrimPrefix(path.Clean("/"+name), "/"))
+}
+
+func (d *s3Bucket) list() (map[string]replicaObject, error) {
+	prefix := d.key("/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	objects, err := d.objects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]replicaObject{}
+	for key, o := range objects {
+		names[path.Join("/", strings.TrimPrefix(key, prefix))] = o
+	}
+	return names, nil
+}
+
+// objects returns the objects, whose keys start with the prefix, by their keys.
+func (d *s3Bucket) objects(prefix string) (map[string]replicaObject, error) {
+	objects := map[string]replicaObject{}
+	token := ""
+	for {
+		query := [][2]string{{"list-type", "2"}, {"prefix", prefix}}
+		if token != "" {
+			query = append(query, [2]string{"continuation-token", token})
+		}
+		result, err := d.listObjects(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			modTime, _ := time.Parse(time.RFC3339, c.LastModified)
+			objects[c.Key] = replicaObject{size: c.Size, modTime: modTime}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (d *s3Bucket) put(name string, r io.Reader, size int64, modTime time.Time) error {
+	if size == 0 {
+		r = http.NoBody
+	}
+	resp, err := d.do(http.MethodPut, d.key(name), nil, r, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (d *s3Bucket) mkdir(name string) error {
+	return nil
+}
+
+// remove deletes the object of the name and the objects below it.
+func (d *s3Bucket) remove(name string) error {
+	key := d.key(name)
+	members, err := d.objects(key + "/")
+	if err != nil {
+		return err
+	}
+	keys := []string{key}
+	for member := range members {
+		keys = append(keys, member)
+	}
+	for _, k := range keys {
+		resp, err := d.do(http.MethodDelete, k, nil, nil, 0)
+		if IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// do sends a request for the key of the bucket signed with the signature version 4. Responses
+// with an error status are returned as RemoteError.
+func (d *s3Bucket) do(method, key string, query [][2]string, body io.Reader, size int64) (*http.Response, error) {
+	return d.send(method, key, query, nil, body, size)
+}
+
+// send is do with additional headers, the x-amz headers among them are signed. The trailing
+// slash of the keys of folder objects is kept.
+func (d *s3Bucket) send(method, key string, query [][2]string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *d.endpoint
+	u.Path = path.Join("/", u.Path, d.settings.Bucket, key)
+	if strings.HasSuffix(key, "/") {
+		u.Path += "/"
+	}
+	var params []string
+	for _, q := range query {
+		params = append(params, s3Escape(q[0], false)+"="+s3Escape(q[1], false))
+	}
+	u.RawQuery = strings.Join(params, "&")
+	req, err := http.NewRequestWithContext(context.Background(), method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	region := d.settings.Region
+	if region == "" {
+		region = defaultReplicationRegion
+	}
+	amzDate := time.Now().UTC().Format(s3AmzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	cred := &s3Credential{
+		scope:         amzDate[:8] + "/" + region + "/s3/aws4_request",
+		signedHeaders: signedHeaders,
+	}
+	signature := s3Signature(req, cred, s3SigningKey(d.settings.SecretKey, cred.scope), amzDate, s3UnsignedPayload)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, d.settings.AccessKey, cred.scope, strings.Join(cred.signedHeaders, ";"), signature))
+
+	resp, err := d.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &RemoteError{Method: method, Path: "/" + key, StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
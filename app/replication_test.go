@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestNewReplicator(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name        string
+		replication *Replication
+		wantErr     bool
+	}{
+		{"disabled", nil, false},
+		{"no backend", &Replication{}, true},
+		{"within base dir", &Replication{Dir: filepath.Join(tmpDir, "data", "replica")}, true},
+		{"two backends", &Replication{Dir: filepath.Join(tmpDir, "replica"), Remote: "backup"}, true},
+		{"unknown remote", &Replication{Remote: "missing"}, true},
+		{"s3 without bucket", &Replication{S3: &ReplicationS3{Endpoint: "https://s3.example.com"}}, true},
+		{"dir", &Replication{Dir: filepath.Join(tmpDir, "replica")}, false},
+		{"remote", &Replication{Remote: "backup"}, false},
+		{"s3", &Replication{S3: &ReplicationS3{Endpoint: "https://s3.example.com", Bucket: "backup"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Dir:         filepath.Join(tmpDir, "data"),
+				Replication: tt.replication,
+				Remotes:     map[string]*Remote{"backup": {URL: "https://backup.example.com"}},
+			}
+			r, err := NewReplicator(cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewReplicator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.replication == nil && r != nil {
+				t.Errorf("NewReplicator() = %v, want nil", r)
+			}
+		})
+	}
+}
+
+func TestReplicationToDir(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+	replica := filepath.Join(tmpDir, "replica")
+
+	cfg := &Config{Dir: filepath.Join(tmpDir, "data"), Replication: &Replication{Dir: replica}}
+	r, err := NewReplicator(cfg)
+	if err != nil {
+		t.Fatalf("NewReplicator() error = %v", err)
+	}
+	a := &App{
+		Config:  cfg,
+		Replica: r,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg, Replica: r},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	do := func(method, target, body string, header ...string) {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		if w.Code >= 300 {
+			t.Fatalf("%s %s = %v", method, target, w.Code)
+		}
+	}
+
+	do("MKCOL", "/docs", "")
+	do("PUT", "/docs/a.txt", "hello")
+	do("PUT", "/docs/b.txt", "bye")
+	if pending := r.status().Pending; pending != 3 {
+		t.Errorf("status().Pending = %v, want 3", pending)
+	}
+	r.flush()
+	if data, err := ioutil.ReadFile(filepath.Join(replica, "docs", "a.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("replicated file = %q, %v", data, err)
+	}
+	local, _ := os.Stat(filepath.Join(tmpDir, "data", "docs", "a.txt"))
+	if replicated, err := os.Stat(filepath.Join(replica, "docs", "a.txt")); err != nil || !replicated.ModTime().Equal(local.ModTime()) {
+		t.Errorf("modification time of the replicated file = %v, want %v", replicated, local.ModTime())
+	}
+
+	do("MOVE", "/docs", "", "Destination", "/archive")
+	do("DELETE", "/archive/b.txt", "")
+	r.flush()
+	if _, err := os.Stat(filepath.Join(replica, "docs")); !os.IsNotExist(err) {
+		t.Errorf("renamed directory still exists in the replica: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(replica, "archive", "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("deleted file still exists in the replica: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(replica, "archive", "a.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("file of the renamed directory = %q, %v", data, err)
+	}
+	if status := r.status(); status.Pending != 0 || status.Replicated != 6 || status.Failures != 0 {
+		t.Errorf("status() = %+v", status)
+	}
+
+	// changes bypassing the server are fixed by the reconciliation
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "archive", "c.txt"), []byte("new"), 0600)
+	os.MkdirAll(filepath.Join(replica, "stale", "sub"), 0700)
+	ioutil.WriteFile(filepath.Join(replica, "stale", "sub", "x"), []byte("x"), 0600)
+	ioutil.WriteFile(filepath.Join(replica, "archive", "a.txt"), []byte("changed"), 0600)
+	run, err := r.reconcile(time.Now())
+	if err != nil || run.Uploaded != 2 || run.Removed != 1 || run.Errors != 0 {
+		t.Fatalf("reconcile() = %+v, %v", run, err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(replica, "archive", "a.txt")); string(data) != "hello" {
+		t.Errorf("reconciled file = %q, want hello", data)
+	}
+	if _, err := os.Stat(filepath.Join(replica, "stale")); !os.IsNotExist(err) {
+		t.Errorf("stale directory still exists in the replica: %v", err)
+	}
+	if run, _ := r.reconcile(time.Now()); run.Uploaded != 0 || run.Removed != 0 {
+		t.Errorf("reconcile() of the reconciled replica = %+v", run)
+	}
+}
+
+func TestReplicationBackends(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "docs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "s3", "alice"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "remote"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "docs", "a.txt"), []byte("hello"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "empty"), nil, 0600)
+
+	subdir := "alice"
+	s3Server := startS3(t, &Config{
+		Dir: filepath.Join(tmpDir, "s3"),
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, S3AccessKey: "alice-key", S3SecretKey: "alice-secret"},
+		},
+	})
+	c := &s3Client{t: t, url: s3Server.URL, accessKey: "alice-key", secretKey: "alice-secret"}
+	if code, _, _ := c.request(http.MethodPut, "/backup", ""); code != http.StatusOK {
+		t.Fatalf("create bucket = %d", code)
+	}
+	remoteServer := httptest.NewServer(&webdav.Handler{
+		FileSystem: webdav.Dir(filepath.Join(tmpDir, "remote")),
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer remoteServer.Close()
+
+	tests := []struct {
+		name        string
+		replication *Replication
+	}{
+		{"s3", &Replication{S3: &ReplicationS3{Endpoint: s3Server.URL, Bucket: "backup", Prefix: "dave",
+			AccessKey: "alice-key", SecretKey: "alice-secret"}}},
+		{"remote", &Replication{Remote: "backup"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReplicator(&Config{
+				Dir:         filepath.Join(tmpDir, "data"),
+				Replication: tt.replication,
+				Remotes:     map[string]*Remote{"backup": {URL: remoteServer.URL}},
+			})
+			if err != nil {
+				t.Fatalf("NewReplicator() error = %v", err)
+			}
+			r.changed(filepath.Join(tmpDir, "data", "docs"), true)
+			r.changed(filepath.Join(tmpDir, "data", "empty"), false)
+			r.flush()
+			if status := r.status(); status.Pending != 0 || status.Failures != 0 {
+				t.Fatalf("status() = %+v", status)
+			}
+			objects, err := r.backend.list()
+			if err != nil || objects["/docs/a.txt"].size != 5 {
+				t.Fatalf("list() = %+v, %v", objects, err)
+			}
+			if _, ok := objects["/empty"]; !ok {
+				t.Errorf("list() = %+v, want the empty file", objects)
+			}
+
+			os.Remove(filepath.Join(tmpDir, "data", "empty"))
+			r.changed(filepath.Join(tmpDir, "data", "empty"), false)
+			r.flush()
+			objects, _ = r.backend.list()
+			if _, ok := objects["/empty"]; ok || len(objects) == 0 {
+				t.Errorf("list() after removal = %+v", objects)
+			}
+			if run, err := r.reconcile(time.Now()); err != nil || run.Uploaded != 0 || run.Errors != 0 {
+				t.Errorf("reconcile() = %+v, %v", run, err)
+			}
+			ioutil.WriteFile(filepath.Join(tmpDir, "data", "empty"), nil, 0600)
+		})
+	}
+}
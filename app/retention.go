@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var errRetained = errors.New("file is retained")
+
+// Retention keeps the files beneath the directories from being modified or deleted before
+// their retention period has passed, to satisfy regulatory retention requirements (WORM).
+// Only the admin API may delete retained files.
+type Retention struct {
+	Directories []*RetentionDir
+}
+
+// RetentionDir retains the files beneath a directory, which is given relative to the base
+// directory, for the period after their creation.
+type RetentionDir struct {
+	Path   string
+	Period time.Duration
+}
+
+// directory returns the retention of the innermost configured directory containing the file,
+// or nil if the file isn't retained.
+func (r *Retention) directory(root, name string) *RetentionDir {
+	if r == nil {
+		return nil
+	}
+	var found *RetentionDir
+	var length int
+	for _, d := range r.Directories {
+		if d == nil {
+			continue
+		}
+		dir := filepath.Join(root, filepath.FromSlash(path.Clean("/"+filepath.ToSlash(d.Path))))
+		if withinDir(name, dir) && (found == nil || len(dir) > length) {
+			found, length = d, len(dir)
+		}
+	}
+	return found
+}
+
+// affects returns whether the physical path is within or contains a retention directory.
+func (r *Retention) affects(root, name string) bool {
+	if r == nil {
+		return false
+	}
+	for _, d := range r.Directories {
+		if d == nil {
+			continue
+		}
+		dir := filepath.Join(root, filepath.FromSlash(path.Clean("/"+filepath.ToSlash(d.Path))))
+		if withinDir(name, dir) || withinDir(dir, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// retainedUntil returns the end of the retention of a file. Files are created with their
+// modification time, which can't change while they're retained. Empty files aren't retained,
+// as clients create them before uploading the content.
+func (r *Retention) retainedUntil(root, name string, fi os.FileInfo) time.Time {
+	d := r.directory(root, name)
+	if d == nil || fi.IsDir() || fi.Size() == 0 {
+		return time.Time{}
+	}
+	return fi.ModTime().Add(d.Period)
+}
+
+// retained returns the first file at or beneath the physical path, which is retained at the
+// time, and the end of its retention.
+func (r *Retention) retained(files storage, root, name string, now time.Time) (string, time.Time) {
+	if !r.affects(root, name) {
+		return "", time.Time{}
+	}
+	var file string
+	var until time.Time
+	files.Walk(name, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if u := r.retainedUntil(root, p, fi); now.Before(u) {
+			file, until = p, u
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return file, until
+}
+
+// withRetentionOverride allows the file operations of the context to ignore the retention.
+func withRetentionOverride(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retentionOverrideKey, true)
+}
+
+// checkRetention returns errRetained, if the physical path is or contains a file, which must
+// not be modified or deleted yet.
+func (d Dir) checkRetention(ctx context.Context, name string) error {
+	if d.Config.Retention == nil || ctx.Value(retentionOverrideKey) != nil {
+		return nil
+	}
+	file, until := d.Config.Retention.retained(d.Config.storage(), d.Config.Dir, name, time.Now())
+	if file == "" {
+		return nil
+	}
+	log.WithFields(log.Fields{"path": file, "user": d.resolveUser(ctx), "until": until.Format(time.RFC3339)}).Warn("Rejected modification of retained file")
+	traceStep(ctx, "%s is retained until %s", file, until.Format(time.RFC3339))
+	rejectionFromContext(ctx).reject(http.StatusForbidden)
+	return fmt.Errorf("%w until %s", errRetained, until.Format(time.RFC3339))
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetention(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "records", "old"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "records", "2024"), 0700)
+	defer os.RemoveAll(tmpDir)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"records/a.txt", "records/2024/b.txt", "records/old/c.txt", "records/old/d.txt"} {
+		ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("record"), 0600)
+	}
+	for _, name := range []string{"records/old/c.txt", "records/old/d.txt"} {
+		os.Chtimes(filepath.Join(tmpDir, name), old, old)
+	}
+	ioutil.WriteFile(filepath.Join(tmpDir, "records", "empty.txt"), nil, 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "plain.txt"), []byte("plain"), 0600)
+
+	cfg := &Config{
+		Dir:       tmpDir,
+		Retention: &Retention{Directories: []*RetentionDir{{Path: "/records", Period: 24 * time.Hour}}},
+		Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}},
+	}
+	a := newQuotaApp(t, cfg)
+	do := func(method, target, body string, header ...string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header []string
+		want   int
+	}{
+		{"overwrite", "PUT", "/records/a.txt", "changed", nil, http.StatusForbidden},
+		{"delete", "DELETE", "/records/a.txt", "", nil, http.StatusForbidden},
+		{"delete directory", "DELETE", "/records/2024", "", nil, http.StatusForbidden},
+		{"delete parent", "DELETE", "/records", "", nil, http.StatusForbidden},
+		{"move", "MOVE", "/records/a.txt", "", []string{"Destination", "/a.txt"}, http.StatusForbidden},
+		{"move onto", "MOVE", "/plain.txt", "", []string{"Destination", "/records/a.txt", "Overwrite", "T"}, http.StatusForbidden},
+		{"copy", "COPY", "/records/a.txt", "", []string{"Destination", "/copy.txt"}, http.StatusCreated},
+		{"new file", "PUT", "/records/new.txt", "new", nil, http.StatusCreated},
+		{"new file again", "PUT", "/records/new.txt", "changed", nil, http.StatusForbidden},
+		{"empty file", "PUT", "/records/empty.txt", "content", nil, http.StatusCreated},
+		{"expired", "PUT", "/records/old/c.txt", "changed", nil, http.StatusCreated},
+		{"delete expired", "DELETE", "/records/old/d.txt", "", nil, http.StatusNoContent},
+		{"unprotected", "DELETE", "/plain.txt", "", nil, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := do(tt.method, tt.target, tt.body, tt.header...); got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "records", "a.txt")); string(data) != "record" {
+		t.Errorf("retained file = %q, want %q", data, "record")
+	}
+
+	admin := NewAdminHandler(a)
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/api/v1/retention/records/2024", http.StatusNoContent},
+		{"/api/v1/retention/records/missing.txt", http.StatusNotFound},
+		{"/api/v1/retention/", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("DELETE", tt.path, nil)
+		req.SetBasicAuth("root", "secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("DELETE %s status = %v, want %v", tt.path, w.Code, tt.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "records", "2024")); !os.IsNotExist(err) {
+		t.Errorf("Stat() after override error = %v, want not exist", err)
+	}
+}
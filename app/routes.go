@@ -0,0 +1,99 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// UploadRoute stores the uploads matching the Path, a pattern like /incoming/*.jpg, at the
+// Target instead, a template like /incoming/{user}/{yyyy}/{mm}/{filename}. Both are paths as
+// seen by the client, so the uploads stay within the subdir of the user.
+type UploadRoute struct {
+	Path   string
+	Target string
+}
+
+var routePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// routeValues returns the values of the placeholders of the targets for the upload of the
+// user at the time.
+func routeValues(name, user string, now time.Time) map[string]string {
+	filename := path.Base(name)
+	ext := path.Ext(filename)
+	if user == "" {
+		user = "anonymous"
+	}
+	return map[string]string{
+		"{user}":     user,
+		"{yyyy}":     now.Format("2006"),
+		"{mm}":       now.Format("01"),
+		"{dd}":       now.Format("02"),
+		"{hh}":       now.Format("15"),
+		"{filename}": filename,
+		"{name}":     strings.TrimSuffix(filename, ext),
+		"{ext}":      strings.TrimPrefix(ext, "."),
+		"{dir}":      strings.TrimPrefix(path.Dir(name), "/"),
+	}
+}
+
+// checkUploadRoutes returns an error, if a pattern is malformed or a target isn't an absolute
+// path or uses an unknown placeholder.
+func (cfg *Config) checkUploadRoutes() error {
+	known := routeValues("/", "", time.Time{})
+	for _, route := range cfg.UploadRoutes {
+		if _, err := path.Match(route.Path, "/"); err != nil || !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("invalid path %q of an upload route", route.Path)
+		}
+		if !strings.HasPrefix(route.Target, "/") {
+			return fmt.Errorf("target %q of an upload route isn't an absolute path", route.Target)
+		}
+		for _, placeholder := range routePlaceholder.FindAllString(route.Target, -1) {
+			if _, ok := known[placeholder]; !ok {
+				return fmt.Errorf("unknown placeholder %s in the target %q of an upload route", placeholder, route.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// routeUpload returns the path the upload of the name is stored at, which is the target of
+// the first matching route or the name itself.
+func (d Dir) routeUpload(ctx context.Context, name string, now time.Time) string {
+	name = path.Clean("/" + name)
+	for _, route := range d.Config.UploadRoutes {
+		if ok, _ := path.Match(route.Path, name); !ok {
+			continue
+		}
+		values := routeValues(name, d.resolveUser(ctx), now)
+		routed := path.Clean("/" + routePlaceholder.ReplaceAllStringFunc(route.Target, func(placeholder string) string {
+			return values[placeholder]
+		}))
+		traceStep(ctx, "routed upload of %s to %s", name, routed)
+		return routed
+	}
+	return name
+}
+
+// mkdirParents creates the missing parent directories of the name. They're created by Mkdir,
+// so the checks and the accounting of new directories apply to them.
+func (d Dir) mkdirParents(ctx context.Context, name string) error {
+	parent := path.Dir(name)
+	if parent == "/" {
+		return nil
+	}
+	if _, err := d.Stat(ctx, parent); err == nil {
+		return nil
+	}
+	if err := d.mkdirParents(ctx, parent); err != nil {
+		return err
+	}
+	if err := d.Mkdir(ctx, parent, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadRoutes(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice", "incoming"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:   tmpDir,
+		Realm: "dave",
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+		UploadRoutes: []*UploadRoute{
+			{Path: "/incoming/*.jpg", Target: "/photos/{user}/{yyyy}/{mm}/{filename}"},
+			{Path: "/incoming/*", Target: "/other/{name}-{dd}.{ext}"},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"first matching route", "/incoming/cam.jpg", filepath.Join("alice", "photos", "alice", now.Format("2006"), now.Format("01"), "cam.jpg")},
+		{"second route", "/incoming/scan.pdf", filepath.Join("alice", "other", "scan-"+now.Format("02")+".pdf")},
+		{"no route", "/notes.txt", filepath.Join("alice", "notes.txt")},
+		{"subdirectory isn't matched", "/incoming/sub/cam.jpg", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("PUT", tt.target, strings.NewReader("content"))
+			req.SetBasicAuth("alice", "password")
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if tt.want == "" {
+				if w.Code != http.StatusNotFound && w.Code != http.StatusConflict {
+					t.Errorf("status = %v, want the missing directory to fail the upload", w.Code)
+				}
+				return
+			}
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status = %v, want %v", w.Code, http.StatusCreated)
+			}
+			if data, err := ioutil.ReadFile(filepath.Join(tmpDir, tt.want)); err != nil || string(data) != "content" {
+				t.Errorf("routed file = %q, %v, want the content at %s", data, err, tt.want)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "alice", "incoming", "cam.jpg")); err == nil {
+		t.Error("routed upload is also stored at its original path")
+	}
+}
+
+func TestCheckUploadRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		route UploadRoute
+		valid bool
+	}{
+		{"valid", UploadRoute{Path: "/incoming/*", Target: "/{user}/{yyyy}-{mm}-{dd}/{hh}/{dir}/{name}.{ext}"}, true},
+		{"relative path", UploadRoute{Path: "incoming/*", Target: "/{filename}"}, false},
+		{"malformed pattern", UploadRoute{Path: "/incoming/[", Target: "/{filename}"}, false},
+		{"relative target", UploadRoute{Path: "/incoming/*", Target: "{user}/{filename}"}, false},
+		{"unknown placeholder", UploadRoute{Path: "/incoming/*", Target: "/{month}/{filename}"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := tt.route
+			err := (&Config{UploadRoutes: []*UploadRoute{&route}}).checkUploadRoutes()
+			if (err == nil) != tt.valid {
+				t.Errorf("checkUploadRoutes() error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
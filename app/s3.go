@@ -0,0 +1,965 @@
+package app
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings of the S3 gateway
+const (
+	defaultS3Port    = "9000"
+	s3MaxKeys        = 1000
+	s3MaxParts       = 10000
+	s3UploadExpiry   = 24 * time.Hour
+	s3UploadMetadata = "upload.json"
+	s3Namespace      = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+// S3 configures a gateway, which serves the same directory to the same users via a minimal S3
+// API for tools which only speak S3. The top level directories of a user are the buckets.
+// Users authenticate with the S3AccessKey and S3SecretKey of their configuration. The parts of
+// multipart uploads are staged within UploadDir until the upload is completed.
+type S3 struct {
+	Address   string
+	Port      string
+	TLS       *TLS
+	UploadDir string
+}
+
+// Listener returns the listener of the S3 requests.
+func (s *S3) Listener() *Listener {
+	return &Listener{Address: s.Address, Port: s.Port, TLS: s.TLS}
+}
+
+// s3Error is an error response of the S3 API.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.message
+}
+
+// Errors of the S3 API
+var (
+	errS3AccessDenied          = &s3Error{http.StatusForbidden, "AccessDenied", "Access denied."}
+	errS3DeletionPending       = &s3Error{http.StatusForbidden, "AccessDenied", "The deletion is pending approval."}
+	errS3InvalidAccessKey      = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key doesn't exist."}
+	errS3SignatureMismatch     = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The signature doesn't match."}
+	errS3TimeSkewed            = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The time of the request differs too much from the server time."}
+	errS3ContentSHA256Mismatch = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The SHA256 of the content doesn't match."}
+	errS3BadDigest             = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 doesn't match."}
+	errS3IncompleteBody        = &s3Error{http.StatusBadRequest, "IncompleteBody", "The body of the request is incomplete."}
+	errS3MissingContentLength  = &s3Error{http.StatusLengthRequired, "MissingContentLength", "The decoded content length is missing."}
+	errS3MalformedXML          = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML of the request is invalid."}
+	errS3InvalidArgument       = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errS3InvalidBucketName     = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The bucket name is invalid."}
+	errS3InvalidPart           = &s3Error{http.StatusBadRequest, "InvalidPart", "A part of the upload is missing or its ETag doesn't match."}
+	errS3InvalidPartOrder      = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The parts aren't in ascending order."}
+	errS3NoSuchBucket          = &s3Error{http.StatusNotFound, "NoSuchBucket", "The bucket doesn't exist."}
+	errS3NoSuchKey             = &s3Error{http.StatusNotFound, "NoSuchKey", "The key doesn't exist."}
+	errS3NoSuchUpload          = &s3Error{http.StatusNotFound, "NoSuchUpload", "The upload doesn't exist."}
+	errS3BucketExists          = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists."}
+	errS3BucketNotEmpty        = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket isn't empty."}
+	errS3MethodNotAllowed      = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The method isn't allowed."}
+	errS3QuotaExceeded         = &s3Error{http.StatusInsufficientStorage, "QuotaExceeded", "The quota is exceeded."}
+	errS3EntityTooLarge        = &s3Error{http.StatusRequestEntityTooLarge, "EntityTooLarge", "The object exceeds the maximum size."}
+	errS3UnsupportedType       = &s3Error{http.StatusUnsupportedMediaType, "InvalidArgument", "The type of the object isn't allowed."}
+	errS3NotImplemented        = &s3Error{http.StatusNotImplemented, "NotImplemented", "The operation isn't implemented."}
+	errS3Internal              = &s3Error{http.StatusInternalServerError, "InternalError", "An internal error occurred."}
+	errS3ServiceUnavailable    = &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", "The server is down for maintenance."}
+	errS3SlowDown              = &s3Error{http.StatusServiceUnavailable, "SlowDown", "The server is running out of resources, please reduce the request rate."}
+	errS3WriteLimited          = &s3Error{http.StatusServiceUnavailable, "SlowDown", "The write limit is exceeded, please reduce the request rate."}
+	errS3BandwidthExceeded     = &s3Error{http.StatusTooManyRequests, "BandwidthLimitExceeded", "The bandwidth cap is exceeded until the period ends."}
+)
+
+// S3Handler serves the file system of the WebDAV handler via the S3 API.
+type S3Handler struct {
+	app       *App
+	fs        webdav.FileSystem
+	uploadDir string
+}
+
+// NewS3Handler creates the S3 gateway for the users of the app and the file system.
+func NewS3Handler(a *App, fs webdav.FileSystem) (*S3Handler, error) {
+	uploadDir := a.Config.S3.UploadDir
+	if uploadDir == "" {
+		uploadDir = filepath.Join(os.TempDir(), "dave-s3-uploads")
+	}
+	if err := os.MkdirAll(uploadDir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &S3Handler{app: a, fs: fs, uploadDir: uploadDir}, nil
+}
+
+func (h *S3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m := h.app.Config.maintenanceMode(); m != nil {
+		w.Header().Set("Retry-After", m.retryAfter())
+		h.writeError(w, r, errS3ServiceUnavailable)
+		return
+	}
+	if m := h.app.Resources; m.shedReason(r.Method) != "" {
+		m.setRetryAfter(w.Header())
+		h.writeError(w, r, errS3SlowDown)
+		return
+	}
+	ctx, err := h.authenticate(r)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	// the same limits and accounting as for WebDAV apply, every request other than a read
+	// counts as a write operation
+	a, user, address := h.app, "", h.app.Config.clientIP(r)
+	if authInfo := AuthFromContext(ctx); authInfo != nil {
+		user = authInfo.Username
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if ok, retry := a.allowWrite(ctx, user, address); !ok {
+			w.Header().Set("Retry-After", retryAfter(retry))
+			h.writeError(w, r, errS3WriteLimited)
+			return
+		}
+	}
+	t, blocked := a.limitBandwidth(ctx, user)
+	if blocked > 0 {
+		w.Header().Set("Retry-After", retryAfter(blocked))
+		h.writeError(w, r, errS3BandwidthExceeded)
+		return
+	}
+	w = a.throttleHTTP(w, r, t)
+	transfer, w := a.Tracker.Begin(w, r, address, user)
+	defer a.Tracker.End(transfer)
+	defer a.Usage.record(transfer)
+	defer a.Bandwidth.record(transfer)
+
+	if err := h.serve(ctx, w, r); err != nil {
+		h.writeError(w, r, err)
+	}
+}
+
+func (h *S3Handler) serve(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	bucket, key := splitS3Path(r.URL.Path)
+	query := r.URL.Query()
+
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		return h.listBuckets(ctx, w)
+	case bucket == "":
+		return errS3MethodNotAllowed
+	case !validBucket(bucket):
+		return errS3InvalidBucketName
+	case key == "":
+		return h.serveBucket(ctx, w, r, bucket, query)
+	case !validKey(key):
+		return errS3InvalidArgument
+	}
+
+	name := path.Join("/", bucket, key)
+	_, hasUploadID := query["uploadId"]
+	switch {
+	case r.Method == http.MethodPost && hasQuery(query, "uploads"):
+		return h.createUpload(ctx, w, bucket, key)
+	case r.Method == http.MethodPut && hasUploadID:
+		return h.uploadPart(ctx, w, r, bucket, key, query)
+	case r.Method == http.MethodPost && hasUploadID:
+		return h.completeUpload(ctx, w, r, bucket, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && hasUploadID:
+		return h.abortUpload(ctx, w, bucket, key, query.Get("uploadId"))
+	case hasUploadID:
+		return errS3NotImplemented
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return h.getObject(ctx, w, r, name)
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			return h.copyObject(ctx, w, name, source)
+		}
+		return h.putObject(ctx, w, r, bucket, name)
+	case http.MethodDelete:
+		if err := h.deleteObject(ctx, name, strings.HasSuffix(key, "/")); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errS3MethodNotAllowed
+}
+
+func (h *S3Handler) serveBucket(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string, query url.Values) error {
+	name := "/" + bucket
+	switch r.Method {
+	case http.MethodGet:
+		if hasQuery(query, "location") {
+			if err := h.checkBucket(ctx, bucket); err != nil {
+				return err
+			}
+			return writeS3XML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		}
+		if hasQuery(query, "uploads") || hasQuery(query, "versions") {
+			return errS3NotImplemented
+		}
+		return h.listObjects(ctx, w, bucket, query)
+	case http.MethodHead:
+		return h.checkBucket(ctx, bucket)
+	case http.MethodPut:
+		if _, err := h.fs.Stat(ctx, name); err == nil {
+			return errS3BucketExists
+		}
+		if err := h.fs.Mkdir(ctx, name, 0700); err != nil {
+			return err
+		}
+		w.Header().Set("Location", name)
+		return nil
+	case http.MethodDelete:
+		if err := h.checkBucket(ctx, bucket); err != nil {
+			return err
+		}
+		if entries, err := h.readDir(ctx, name); err != nil {
+			return err
+		} else if len(entries) > 0 {
+			return errS3BucketNotEmpty
+		}
+		if err := h.fs.RemoveAll(ctx, name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodPost:
+		if hasQuery(query, "delete") {
+			return h.deleteObjects(ctx, w, r, bucket)
+		}
+	}
+	return errS3MethodNotAllowed
+}
+
+func (h *S3Handler) checkBucket(ctx context.Context, bucket string) error {
+	fi, err := h.fs.Stat(ctx, "/"+bucket)
+	if err != nil || !fi.IsDir() {
+		return errS3NoSuchBucket
+	}
+	return nil
+}
+
+func (h *S3Handler) readDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	f, err := h.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
+
+func (h *S3Handler) listBuckets(ctx context.Context, w http.ResponseWriter) error {
+	entries, err := h.readDir(ctx, "/")
+	if err != nil {
+		return err
+	}
+
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   s3Owner
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: s3OwnerOf(ctx)}
+	for _, fi := range entries {
+		if fi.IsDir() && validBucket(fi.Name()) {
+			result.Buckets = append(result.Buckets, bucket{Name: fi.Name(), CreationDate: s3Time(fi.ModTime())})
+		}
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool { return result.Buckets[i].Name < result.Buckets[j].Name })
+	return writeS3XML(w, http.StatusOK, result)
+}
+
+// s3Entry is an object or a common prefix of a listing.
+type s3Entry struct {
+	key    string
+	info   os.FileInfo
+	prefix bool
+}
+
+// listObjects answers both versions of ListObjects. The tree is walked in the order of the
+// keys, directories which are rolled up into a common prefix aren't descended into.
+func (h *S3Handler) listObjects(ctx context.Context, w http.ResponseWriter, bucket string, query url.Values) error {
+	if err := h.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return errS3InvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	v2 := query.Get("list-type") == "2"
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return errS3InvalidArgument
+			}
+			after = string(decoded)
+		}
+	}
+
+	var entries []s3Entry
+	prefixes := map[string]bool{}
+	err := h.walk(ctx, "/"+bucket, "", func(key string, fi os.FileInfo) bool {
+		if fi.IsDir() && !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+			return false
+		}
+		if !strings.HasPrefix(key, prefix) {
+			return fi.IsDir()
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common := key[:len(prefix)+i+len(delimiter)]
+				if !prefixes[common] {
+					prefixes[common] = true
+					entries = append(entries, s3Entry{key: common, prefix: true})
+				}
+				return false
+			}
+		}
+		if !fi.IsDir() {
+			entries = append(entries, s3Entry{key: key, info: fi})
+		}
+		return fi.IsDir()
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	start := sort.Search(len(entries), func(i int) bool { return entries[i].key > after })
+	entries = entries[start:]
+	truncated := len(entries) > maxKeys
+	if truncated {
+		entries = entries[:maxKeys]
+	}
+
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		Marker                string `xml:",omitempty"`
+		NextMarker            string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		KeyCount              int    `xml:",omitempty"`
+		MaxKeys               int
+		IsTruncated           bool
+		Contents              []object
+		CommonPrefixes        []commonPrefix
+	}{Xmlns: s3Namespace, Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys, IsTruncated: truncated}
+	for _, e := range entries {
+		if e.prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: e.key})
+		} else {
+			result.Contents = append(result.Contents, object{
+				Key:          e.key,
+				LastModified: s3Time(e.info.ModTime()),
+				ETag:         s3ETag(e.info),
+				Size:         e.info.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+
+	var last string
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].key
+	}
+	if v2 {
+		result.StartAfter = query.Get("start-after")
+		result.ContinuationToken = query.Get("continuation-token")
+		result.KeyCount = len(entries)
+		if truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		result.Marker = query.Get("marker")
+		if truncated && delimiter != "" {
+			result.NextMarker = last
+		}
+	}
+	return writeS3XML(w, http.StatusOK, result)
+}
+
+// walk calls fn for the entries below name in the order of their keys, the keys of directories
+// end with a slash. Directories are only descended into, when fn returns true.
+func (h *S3Handler) walk(ctx context.Context, name, keyPrefix string, fn func(key string, fi os.FileInfo) bool) error {
+	entries, err := h.readDir(ctx, name)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, fi := range entries {
+		key := keyPrefix + fi.Name()
+		if fi.IsDir() {
+			key += "/"
+		}
+		if fn(key, fi) && fi.IsDir() {
+			if err := h.walk(ctx, path.Join(name, fi.Name()), key, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *S3Handler) getObject(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	f, err := h.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			return errS3NoSuchKey
+		}
+		// directories are the folder objects of S3 clients
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), strings.NewReader(""))
+		return nil
+	}
+
+	w.Header().Set("ETag", s3ETag(fi))
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	return nil
+}
+
+func (h *S3Handler) putObject(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, name string) error {
+	if err := h.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if strings.HasSuffix(r.URL.Path, "/") {
+		// folder objects of S3 clients are directories
+		if err := h.mkdirAll(ctx, name); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		return nil
+	}
+
+	sum, err := h.writeObject(ctx, name, r.Body)
+	if err != nil {
+		return err
+	}
+	if want := r.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(sum) {
+		h.fs.RemoveAll(ctx, name)
+		return errS3BadDigest
+	}
+	fi, err := h.fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", s3ETag(fi))
+	return nil
+}
+
+func (h *S3Handler) copyObject(ctx context.Context, w http.ResponseWriter, name, source string) error {
+	bucket, key, ok := s3Source(source)
+	if !ok || !validBucket(bucket) || !validKey(key) {
+		return errS3InvalidArgument
+	}
+	src, err := h.fs.OpenFile(ctx, path.Join("/", bucket, key), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if fi, err := src.Stat(); err != nil || fi.IsDir() {
+		return errS3NoSuchKey
+	}
+
+	if _, err := h.writeObject(ctx, name, src); err != nil {
+		return err
+	}
+	fi, err := h.fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	return writeS3XML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string
+		ETag         string
+	}{Xmlns: s3Namespace, LastModified: s3Time(fi.ModTime()), ETag: s3ETag(fi)})
+}
+
+// writeObject writes the content to the file, the parent directories are created as needed.
+// It returns the MD5 of the content. An incomplete file is removed, a file whose content
+// has been rejected hasn't been touched.
+func (h *S3Handler) writeObject(ctx context.Context, name string, content io.Reader) ([]byte, error) {
+	if err := h.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return nil, err
+	}
+	f, err := h.fs.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, sum), content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if !uploadRejected(err) {
+			h.fs.RemoveAll(ctx, name)
+		}
+		return nil, err
+	}
+	return sum.Sum(nil), nil
+}
+
+// mkdirAll creates the directory and its missing parents within a bucket.
+func (h *S3Handler) mkdirAll(ctx context.Context, name string) error {
+	if fi, err := h.fs.Stat(ctx, name); err == nil {
+		if !fi.IsDir() {
+			return errS3InvalidArgument
+		}
+		return nil
+	}
+	if err := h.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return err
+	}
+	if err := h.fs.Mkdir(ctx, name, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteObject removes a file or an empty folder object. Deleting a missing key succeeds, as
+// with S3.
+func (h *S3Handler) deleteObject(ctx context.Context, name string, dir bool) error {
+	fi, err := h.fs.Stat(ctx, name)
+	if err != nil || fi.IsDir() != dir {
+		return nil
+	}
+	if dir {
+		if entries, err := h.readDir(ctx, name); err != nil || len(entries) > 0 {
+			return nil
+		}
+	}
+	return h.fs.RemoveAll(ctx, name)
+}
+
+func (h *S3Handler) deleteObjects(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket string) error {
+	if err := h.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil || len(req.Objects) > s3MaxKeys {
+		return errS3MalformedXML
+	}
+
+	type deleted struct {
+		Key string
+	}
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	result := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{Xmlns: s3Namespace}
+	for _, o := range req.Objects {
+		var err error = errS3InvalidArgument
+		if validKey(o.Key) {
+			err = h.deleteObject(ctx, path.Join("/", bucket, o.Key), strings.HasSuffix(o.Key, "/"))
+		}
+		if err != nil {
+			e := s3ErrorOf(err)
+			result.Errors = append(result.Errors, deleteError{Key: o.Key, Code: e.code, Message: e.message})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: o.Key})
+		}
+	}
+	return writeS3XML(w, http.StatusOK, result)
+}
+
+// s3Upload is the metadata of a multipart upload.
+type s3Upload struct {
+	User      string    `json:"user"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Initiated time.Time `json:"initiated"`
+}
+
+func (h *S3Handler) createUpload(ctx context.Context, w http.ResponseWriter, bucket, key string) error {
+	if err := h.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	h.removeExpiredUploads(time.Now())
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	uploadID := hex.EncodeToString(id)
+	data, _ := json.Marshal(&s3Upload{User: s3OwnerOf(ctx).ID, Bucket: bucket, Key: key, Initiated: time.Now()})
+	dir := filepath.Join(h.uploadDir, uploadID)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, s3UploadMetadata), data, 0600); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	return writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: uploadID})
+}
+
+// upload returns the staging directory of the upload of the user.
+func (h *S3Handler) upload(ctx context.Context, bucket, key, uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", errS3NoSuchUpload
+	}
+	dir := filepath.Join(h.uploadDir, uploadID)
+	data, err := ioutil.ReadFile(filepath.Join(dir, s3UploadMetadata))
+	if err != nil {
+		return "", errS3NoSuchUpload
+	}
+	var upload s3Upload
+	if err := json.Unmarshal(data, &upload); err != nil || upload.User != s3OwnerOf(ctx).ID ||
+		upload.Bucket != bucket || upload.Key != key {
+		return "", errS3NoSuchUpload
+	}
+	return dir, nil
+}
+
+func (h *S3Handler) uploadPart(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) error {
+	dir, err := h.upload(ctx, bucket, key, query.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > s3MaxParts {
+		return errS3InvalidArgument
+	}
+
+	name := filepath.Join(dir, strconv.Itoa(number))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	sum := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, sum), r.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name)
+		return err
+	}
+	if want := r.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(sum.Sum(nil)) {
+		os.Remove(name)
+		return errS3BadDigest
+	}
+
+	etag := `"` + hex.EncodeToString(sum.Sum(nil)) + `"`
+	if err := ioutil.WriteFile(name+".etag", []byte(etag), 0600); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+func (h *S3Handler) completeUpload(ctx context.Context, w http.ResponseWriter, r *http.Request, bucket, key, uploadID string) error {
+	dir, err := h.upload(ctx, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return errS3MalformedXML
+	}
+
+	parts := &s3PartReader{}
+	defer parts.Close()
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return errS3InvalidPartOrder
+		}
+		name := filepath.Join(dir, strconv.Itoa(p.PartNumber))
+		etag, err := ioutil.ReadFile(name + ".etag")
+		if err != nil || strings.Trim(string(etag), `"`) != strings.Trim(p.ETag, `"`) {
+			return errS3InvalidPart
+		}
+		parts.names = append(parts.names, name)
+	}
+
+	name := path.Join("/", bucket, key)
+	if _, err := h.writeObject(ctx, name, parts); err != nil {
+		return err
+	}
+	os.RemoveAll(dir)
+	fi, err := h.fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	return writeS3XML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, ETag: s3ETag(fi)})
+}
+
+// s3PartReader reads the parts of an upload one after another, so only one of them is open.
+type s3PartReader struct {
+	names []string
+	f     *os.File
+}
+
+func (p *s3PartReader) Read(b []byte) (int, error) {
+	for {
+		if p.f == nil {
+			if len(p.names) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(p.names[0])
+			if err != nil {
+				return 0, err
+			}
+			p.f, p.names = f, p.names[1:]
+		}
+		n, err := p.f.Read(b)
+		if err == io.EOF {
+			p.f.Close()
+			p.f = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (p *s3PartReader) Close() error {
+	if p.f == nil {
+		return nil
+	}
+	return p.f.Close()
+}
+
+func (h *S3Handler) abortUpload(ctx context.Context, w http.ResponseWriter, bucket, key, uploadID string) error {
+	dir, err := h.upload(ctx, bucket, key, uploadID)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// removeExpiredUploads removes the parts of uploads, which were neither completed nor aborted.
+func (h *S3Handler) removeExpiredUploads(now time.Time) {
+	entries, err := ioutil.ReadDir(h.uploadDir)
+	if err != nil {
+		return
+	}
+	for _, fi := range entries {
+		if fi.IsDir() && now.Sub(fi.ModTime()) > s3UploadExpiry {
+			log.WithField("upload", fi.Name()).Info("Removed expired S3 upload")
+			os.RemoveAll(filepath.Join(h.uploadDir, fi.Name()))
+		}
+	}
+}
+
+func (h *S3Handler) loginFailed(r *http.Request, accessKey string) {
+	log.WithField("accessKey", accessKey).WithField("address", h.app.Config.clientIP(r)).Warn("User failed to login via S3")
+	h.app.Alerts.authFailed(time.Now())
+}
+
+// s3ErrorOf maps errors of the file system to the errors of the S3 API.
+func s3ErrorOf(err error) *s3Error {
+	var e *s3Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, errQuotaExceeded):
+		return errS3QuotaExceeded
+	case errors.Is(err, errUploadTooLarge):
+		return errS3EntityTooLarge
+	case errors.Is(err, errUploadNotAllowed), errors.Is(err, errUploadPartial):
+		return errS3UnsupportedType
+	case errors.Is(err, errScanRejected), errors.Is(err, errContentMismatch), errors.Is(err, errAppendOnly),
+		errors.Is(err, errRetained), errors.Is(err, errReadOnly), errors.Is(err, errPluginDenied):
+		return errS3AccessDenied
+	case errors.Is(err, errDeletionPending):
+		return errS3DeletionPending
+	case os.IsNotExist(err):
+		return errS3NoSuchKey
+	case os.IsPermission(err):
+		return errS3AccessDenied
+	}
+	return errS3Internal
+}
+
+func (h *S3Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := s3ErrorOf(err)
+	if e == errS3Internal {
+		log.WithField("path", r.URL.Path).WithError(err).Error("Error handling S3 request")
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.status)
+		return
+	}
+
+	writeS3XML(w, e.status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: e.code, Message: e.message, Resource: r.URL.Path})
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Error writing S3 response")
+	}
+	return nil
+}
+
+// s3Owner is the owner of buckets, which is the user.
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+func s3OwnerOf(ctx context.Context) s3Owner {
+	var name string
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		name = authInfo.Username
+	}
+	return s3Owner{ID: name, DisplayName: name}
+}
+
+// s3ETag is the entity tag of a file, it's the same as the one of WebDAV.
+func s3ETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// splitS3Path splits a path style request into the bucket and the key.
+func splitS3Path(p string) (string, string) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	return bucket, key
+}
+
+// s3Source parses the bucket and the key of the x-amz-copy-source header.
+func s3Source(header string) (string, string, bool) {
+	source, _, _ := strings.Cut(header, "?")
+	source, err := url.PathUnescape(source)
+	if err != nil {
+		return "", "", false
+	}
+	bucket, key := splitS3Path(source)
+	return bucket, key, bucket != "" && key != ""
+}
+
+func validBucket(bucket string) bool {
+	return bucket != "" && bucket != "." && bucket != ".." && !strings.ContainsAny(bucket, "/\\\x00")
+}
+
+// validKey rejects keys, which don't map to a path within the bucket.
+func validKey(key string) bool {
+	trimmed := strings.TrimSuffix(key, "/")
+	return trimmed != "" && !strings.Contains(key, "\x00") && path.Clean("/"+trimmed) == "/"+trimmed
+}
+
+func hasQuery(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
@@ -0,0 +1,288 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values of the AWS signature version 4
+const (
+	s3Algorithm        = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat    = "20060102T150405Z"
+	s3UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3MaxClockSkew     = 15 * time.Minute
+	s3MaxChunkSize     = 16 << 20
+)
+
+var s3EmptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// s3Credential is the parsed Authorization header of a signed request.
+type s3Credential struct {
+	accessKey     string
+	date          string
+	scope         string
+	signedHeaders []string
+	signature     string
+}
+
+func parseS3Authorization(header string) (*s3Credential, bool) {
+	if !strings.HasPrefix(header, s3Algorithm+" ") {
+		return nil, false
+	}
+
+	c := &s3Credential{}
+	for _, field := range strings.Split(strings.TrimPrefix(header, s3Algorithm+" "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			parts := strings.Split(value, "/")
+			if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+				return nil, false
+			}
+			c.accessKey, c.date, c.scope = parts[0], parts[1], strings.Join(parts[1:], "/")
+		case "SignedHeaders":
+			c.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			c.signature = value
+		}
+	}
+	return c, c.accessKey != "" && len(c.signedHeaders) > 0 && c.signature != ""
+}
+
+// authenticate verifies the signature of the request and returns the context of its user. The
+// body of the request is replaced by a reader, which verifies the payload while it's read.
+func (h *S3Handler) authenticate(r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	ip := h.app.Config.networks().clientAddress(r)
+	if !h.app.Config.allowsAddress(ip, "") {
+		refuseAddress("S3", "", ip)
+		return nil, errS3AccessDenied
+	}
+	if !h.app.Config.AuthenticationNeeded() {
+		return ctx, nil
+	}
+
+	c, ok := parseS3Authorization(r.Header.Get("Authorization"))
+	if !ok {
+		return nil, errS3AccessDenied
+	}
+	username, secret := h.credentials(c.accessKey)
+	if username == "" {
+		h.loginFailed(r, c.accessKey)
+		return nil, errS3InvalidAccessKey
+	}
+	if !h.app.Config.allowsAddress(ip, username) {
+		refuseAddress("S3", username, ip)
+		return nil, errS3AccessDenied
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(s3AmzDateFormat, amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, c.date) {
+		return nil, errS3AccessDenied
+	}
+	if skew := time.Since(t); skew > s3MaxClockSkew || skew < -s3MaxClockSkew {
+		return nil, errS3TimeSkewed
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = s3EmptySHA256
+	}
+	key := s3SigningKey(secret, c.scope)
+	if !hmac.Equal([]byte(s3Signature(r, c, key, amzDate, payload)), []byte(c.signature)) {
+		h.loginFailed(r, c.accessKey)
+		return nil, errS3SignatureMismatch
+	}
+
+	switch payload {
+	case s3UnsignedPayload:
+	case s3StreamingPayload:
+		length, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil {
+			return nil, errS3MissingContentLength
+		}
+		r.ContentLength = length
+		r.Body = &s3ChunkedReader{
+			r: bufio.NewReader(r.Body), body: r.Body, key: key, date: amzDate, scope: c.scope, signature: c.signature,
+		}
+	default:
+		r.Body = &s3HashReader{r: r.Body, hash: sha256.New(), want: payload}
+	}
+	return context.WithValue(ctx, authInfoKey, &AuthInfo{Username: username, Authenticated: true}), nil
+}
+
+// credentials returns the user and the secret key of the access key.
+func (h *S3Handler) credentials(accessKey string) (string, string) {
+	for _, name := range h.app.Config.UserNames() {
+		user := h.app.Config.User(name)
+		if user != nil && user.S3AccessKey != "" && user.S3AccessKey == accessKey && user.S3SecretKey != "" {
+			return name, user.S3SecretKey
+		}
+	}
+	return "", ""
+}
+
+// s3Signature computes the signature of the request with the signing key of the credential.
+func s3Signature(r *http.Request, c *s3Credential, key []byte, amzDate, payload string) string {
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, c.scope, s3SHA256(s3CanonicalRequest(r, c.signedHeaders, payload))}, "\n")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+// s3CanonicalRequest builds the canonical form of the request, which is signed.
+func s3CanonicalRequest(r *http.Request, signedHeaders []string, payload string) string {
+	var query []string
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			query = append(query, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(query)
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			values := r.Header.Values(name)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, true),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of RFC 3986.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func s3SigningKey(secret, scope string) []byte {
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = s3HMAC(key, part)
+	}
+	return key
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3SHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// s3HashReader fails at the end of the body, if its hash doesn't match the signed one.
+type s3HashReader struct {
+	r    io.ReadCloser
+	hash hash.Hash
+	want string
+}
+
+func (h *s3HashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.want {
+		return n, errS3ContentSHA256Mismatch
+	}
+	return n, err
+}
+
+func (h *s3HashReader) Close() error {
+	return h.r.Close()
+}
+
+// s3ChunkedReader decodes a body in the aws-chunked encoding and verifies the signature of each
+// chunk, which chains the signature of the previous one.
+type s3ChunkedReader struct {
+	r         *bufio.Reader
+	body      io.Closer
+	key       []byte
+	date      string
+	scope     string
+	signature string
+	chunk     []byte
+	done      bool
+}
+
+func (c *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads and verifies the next chunk.
+func (c *s3ChunkedReader) next() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return errS3IncompleteBody
+	}
+	size, signature, ok := strings.Cut(strings.TrimRight(string(line), "\r\n"), ";chunk-signature=")
+	length, err := strconv.ParseInt(size, 16, 64)
+	if !ok || err != nil || length < 0 || length > s3MaxChunkSize {
+		return errS3IncompleteBody
+	}
+
+	chunk := make([]byte, length+2)
+	if _, err := io.ReadFull(c.r, chunk); err != nil || !bytes.HasSuffix(chunk, []byte("\r\n")) {
+		return errS3IncompleteBody
+	}
+	chunk = chunk[:length]
+
+	stringToSign := strings.Join([]string{s3Algorithm + "-PAYLOAD", c.date, c.scope, c.signature, s3EmptySHA256, s3SHA256(string(chunk))}, "\n")
+	if !hmac.Equal([]byte(hex.EncodeToString(s3HMAC(c.key, stringToSign))), []byte(signature)) {
+		return errS3SignatureMismatch
+	}
+	c.signature, c.chunk, c.done = signature, chunk, length == 0
+	return nil
+}
+
+func (c *s3ChunkedReader) Close() error {
+	return c.body.Close()
+}
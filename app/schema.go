@@ -0,0 +1,76 @@
+package app
+
+import (
+	"reflect"
+	"time"
+	"unicode"
+)
+
+// Schema returns a JSON Schema (draft-07) of the configuration file. It is derived from the
+// Config type, so it always matches the keys the server understands. Keys are spelled in
+// lower camel case like in the documentation, although the server matches them case
+// insensitively.
+func Schema() map[string]interface{} {
+	s := typeSchema(reflect.TypeOf(Config{}))
+	s["$schema"] = "http://json-schema.org/draft-07/schema#"
+	s["title"] = "dave configuration"
+	return s
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(ByteSize(0)) || t == reflect.TypeOf(time.Duration(0)) {
+		// sizes and durations are given with a unit, e.g. 10GB or 1h
+		return map[string]interface{}{"type": []string{"string", "integer"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		// numbers are converted to strings while decoding, e.g. for port: 8000
+		return map[string]interface{}{"type": []string{"string", "number"}}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Anonymous {
+				// embedded structs are squashed into the enclosing one
+				for key, prop := range typeSchema(f.Type)["properties"].(map[string]interface{}) {
+					props[key] = prop
+				}
+				continue
+			}
+			props[schemaKey(f.Name)] = typeSchema(f.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]interface{}{}
+}
+
+// schemaKey converts a field name to the lower camel case spelling of the documentation,
+// e.g. CertFile to certFile and TLS to tls.
+func schemaKey(name string) string {
+	r := []rune(name)
+	for i := 0; i < len(r) && unicode.IsUpper(r[i]); i++ {
+		if i > 0 && i+1 < len(r) && unicode.IsLower(r[i+1]) {
+			break
+		}
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	s := Schema()
+	props := s["properties"].(map[string]interface{})
+
+	for _, key := range []string{"address", "dryRun", "tls", "users", "strict"} {
+		if _, ok := props[key]; !ok {
+			t.Errorf("Schema() has no property %s", key)
+		}
+	}
+	if _, ok := props["usersMu"]; ok {
+		t.Errorf("Schema() contains unexported field usersMu")
+	}
+	if s["additionalProperties"] != false {
+		t.Errorf("Schema() additionalProperties = %v, want false", s["additionalProperties"])
+	}
+
+	users := props["users"].(map[string]interface{})
+	user := users["additionalProperties"].(map[string]interface{})
+	want := map[string]interface{}{"type": "boolean"}
+	if got := user["properties"].(map[string]interface{})["trace"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Schema() users.*.trace = %v, want %v", got, want)
+	}
+	if _, ok := user["properties"].(map[string]interface{})["template"]; !ok {
+		t.Errorf("Schema() has no property users.*.template of the embedded permissions")
+	}
+}
+
+func TestSchemaKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Address", "address"},
+		{"CertFile", "certFile"},
+		{"TLS", "tls"},
+		{"URL", "url"},
+		{"DryRun", "dryRun"},
+		{"HTTPPort", "httpPort"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := schemaKey(tt.name); got != tt.want {
+				t.Errorf("schemaKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,835 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Defaults of the search index
+const (
+	defaultSearchInterval    = 10 * time.Minute
+	defaultSearchMaxFileSize = 10 << 20
+	defaultSearchMaxResults  = 100
+
+	// searchMaxTermLength is the length of the longest word, which is indexed.
+	searchMaxTermLength = 64
+)
+
+// Search indexes the names of the files below dir and the text of common document types every
+// Interval, 10m by default, so users can search them via the search parameter of a GET or the
+// SEARCH method. The text of files up to MaxFileSize, 10MB by default, is extracted, larger
+// files are found by their name only. The index is kept in File, if it's set, so it doesn't
+// need to be rebuilt after a restart. MaxResults limits the results of a search, 100 by
+// default.
+type Search struct {
+	File        string
+	Interval    time.Duration
+	MaxFileSize ByteSize
+	MaxResults  int
+}
+
+// searchDoc is an indexed file or directory with the size and the modification time its text
+// has been extracted at.
+type searchDoc struct {
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Terms   []string  `json:"terms,omitempty"`
+}
+
+// SearchResult is a file or directory found by a search. The path is the one seen by the user.
+type SearchResult struct {
+	Path    string    `json:"path"`
+	Href    string    `json:"href"`
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Score   int       `json:"score"`
+
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// searchMatch is an indexed file matching a query. The name is the one of the index, the path
+// the one seen by the user.
+type searchMatch struct {
+	name  string
+	path  string
+	doc   *searchDoc
+	score int
+}
+
+// SearchIndex is the index of the stored files. A nil SearchIndex is valid and finds nothing.
+type SearchIndex struct {
+	settings *Search
+	dir      string
+	files    storage
+
+	mu    sync.RWMutex
+	docs  map[string]*searchDoc
+	terms map[string]map[string]bool
+	last  time.Time
+}
+
+// NewSearchIndex creates the search index of the configuration with the documents of its file.
+// It returns nil, if no search is configured.
+func NewSearchIndex(cfg *Config) (*SearchIndex, error) {
+	if cfg.Search == nil {
+		return nil, nil
+	}
+	if cfg.ContentStore != nil {
+		return nil, fmt.Errorf("the search index requires the files to be stored in the base dir, not in the content store")
+	}
+	if cfg.Search.MaxFileSize < 0 || cfg.Search.MaxResults < 0 {
+		return nil, fmt.Errorf("limits of the search must not be negative")
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = "."
+	}
+	s := &SearchIndex{settings: cfg.Search, dir: dir, files: cfg.storage(), docs: map[string]*searchDoc{}}
+	if cfg.Search.File != "" {
+		data, err := ioutil.ReadFile(cfg.Search.File)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &s.docs); err != nil {
+				return nil, fmt.Errorf("invalid search index %s: %s", cfg.Search.File, err)
+			}
+		}
+	}
+	s.terms = invertDocs(s.docs)
+	return s, nil
+}
+
+// Start updates the index right away and every interval afterwards.
+func (s *SearchIndex) Start() {
+	if s == nil {
+		return
+	}
+
+	interval := s.settings.Interval
+	if interval <= 0 {
+		interval = defaultSearchInterval
+	}
+	go func() {
+		for {
+			s.update(time.Now())
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// update walks the files below the base directory and extracts the text of the new and
+// changed ones. Directories of encrypted folders are skipped, since their text can't be read
+// without the key of the user.
+func (s *SearchIndex) update(now time.Time) {
+	s.mu.RLock()
+	old := s.docs
+	s.mu.RUnlock()
+
+	var file string
+	if s.settings.File != "" {
+		file, _ = filepath.Abs(s.settings.File)
+	}
+	docs := map[string]*searchDoc{}
+	extracted := 0
+	s.files.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			log.WithField("path", p).WithError(err).Debug("Error walking the files to index")
+			return nil
+		}
+		rel, _ := filepath.Rel(s.dir, p)
+		name := path.Join("/", filepath.ToSlash(rel))
+		if fi.IsDir() {
+			if _, err := s.files.Stat(filepath.Join(p, encryptionHeaderName)); err == nil {
+				return filepath.SkipDir
+			}
+			if name != "/" {
+				docs[name] = &searchDoc{Dir: true, ModTime: fi.ModTime()}
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if abs, _ := filepath.Abs(p); abs == file {
+			return nil
+		}
+		if doc := old[name]; doc != nil && !doc.Dir && doc.Size == fi.Size() && doc.ModTime.Equal(fi.ModTime()) {
+			docs[name] = doc
+			return nil
+		}
+		docs[name] = &searchDoc{Size: fi.Size(), ModTime: fi.ModTime(), Terms: s.extract(p, fi)}
+		extracted++
+		return nil
+	})
+
+	terms := invertDocs(docs)
+	s.mu.Lock()
+	s.docs, s.terms, s.last = docs, terms, now
+	err := s.save()
+	s.mu.Unlock()
+
+	if err != nil {
+		log.WithError(err).Error("Error saving the search index")
+	}
+	log.WithFields(log.Fields{"documents": len(docs), "extracted": extracted,
+		"duration": time.Since(now).Round(time.Millisecond).String()}).Debug("Updated the search index")
+}
+
+// extract returns the words of the text of the file, if it's a document type with known text
+// and isn't larger than the maximum size.
+func (s *SearchIndex) extract(p string, fi os.FileInfo) []string {
+	maxSize := int64(s.settings.MaxFileSize)
+	if maxSize == 0 {
+		maxSize = defaultSearchMaxFileSize
+	}
+	extract := searchExtractor(p)
+	if extract == nil || fi.Size() > maxSize {
+		return nil
+	}
+	f, err := s.files.OpenFile(p, os.O_RDONLY, 0)
+	if err != nil {
+		log.WithField("path", p).WithError(err).Debug("Error opening file to index")
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxSize))
+	f.Close()
+	var text string
+	if err == nil {
+		text, err = extract(data)
+	}
+	if err != nil {
+		log.WithField("path", p).WithError(err).Debug("Error extracting the text of file to index")
+		return nil
+	}
+	return searchTerms(text)
+}
+
+// save writes the documents to the file, if there is one. s.mu must be held.
+func (s *SearchIndex) save() error {
+	if s.settings.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.docs)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.settings.File, data)
+}
+
+// search returns the files and directories with the physical path within dir, which match
+// all words of the query and the filter, if it's set, ordered by their score. A word matches,
+// if the name contains it, which scores higher, or the text of the file. Without words, all
+// files matching the filter are returned. ok is false, if the results were limited.
+func (s *SearchIndex) search(dir, query string, filter searchPredicate, limit int) ([]searchMatch, bool) {
+	words := searchTerms(query)
+	if s == nil || (len(words) == 0 && filter == nil) {
+		return nil, true
+	}
+	rel, err := filepath.Rel(s.dir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, true
+	}
+	scope := path.Join("/", filepath.ToSlash(rel))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	prefix := strings.TrimSuffix(scope, "/") + "/"
+	var matches []searchMatch
+	for name, doc := range s.docs {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if filter != nil && !filter(name, doc) {
+			continue
+		}
+		base := strings.ToLower(path.Base(name))
+		score := 0
+		if len(words) == 0 {
+			score = 1
+		}
+		for _, word := range words {
+			switch {
+			case strings.Contains(base, word):
+				score += 2
+			case s.terms[word][name]:
+				score++
+			default:
+				score = 0
+			}
+			if score == 0 {
+				break
+			}
+		}
+		if score > 0 {
+			matches = append(matches, searchMatch{name: name, doc: doc, score: score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].name < matches[j].name
+	})
+	if limit > 0 && len(matches) > limit {
+		return matches[:limit], false
+	}
+	return matches, true
+}
+
+// searchPredicate selects the files and directories a search returns by their name in the
+// index and their document.
+type searchPredicate func(name string, doc *searchDoc) bool
+
+// allOf returns the predicate selecting the files selected by all predicates, which aren't
+// nil. It returns nil, if all of them are nil.
+func allOf(predicates ...searchPredicate) searchPredicate {
+	var set []searchPredicate
+	for _, p := range predicates {
+		if p != nil {
+			set = append(set, p)
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return func(name string, doc *searchDoc) bool {
+		for _, p := range set {
+			if !p(name, doc) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// namePredicate selects the files and directories, whose name matches the glob pattern of
+// path.Match regardless of the case.
+func namePredicate(pattern string) (searchPredicate, error) {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(name string, _ *searchDoc) bool {
+		matched, _ := path.Match(pattern, strings.ToLower(path.Base(name)))
+		return matched
+	}, nil
+}
+
+// sizePredicate selects the files, whose size compares to n by the operator gt, gte, lt or
+// lte of a basic search. Directories have no size and aren't selected.
+func sizePredicate(op string, n int64) searchPredicate {
+	return func(_ string, doc *searchDoc) bool {
+		if doc.Dir {
+			return false
+		}
+		switch {
+		case doc.Size > n:
+			return op == "gt" || op == "gte"
+		case doc.Size < n:
+			return op == "lt" || op == "lte"
+		}
+		return op == "gte" || op == "lte"
+	}
+}
+
+// modTimePredicate selects the files and directories, whose modification time compares to t
+// by the operator gt, gte, lt or lte of a basic search. The times are compared by seconds, the
+// precision of getlastmodified.
+func modTimePredicate(op string, t time.Time) searchPredicate {
+	t = t.Truncate(time.Second)
+	return func(_ string, doc *searchDoc) bool {
+		modTime := doc.ModTime.Truncate(time.Second)
+		switch {
+		case modTime.After(t):
+			return op == "gt" || op == "gte"
+		case modTime.Before(t):
+			return op == "lt" || op == "lte"
+		}
+		return op == "gte" || op == "lte"
+	}
+}
+
+// parseSearchTime parses a time of the search parameters, either RFC 3339 or a date, which
+// is midnight in UTC.
+func parseSearchTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// searchCriteria returns the predicate of the name, minSize, maxSize, after and before
+// parameters of a search. It returns nil without these parameters.
+func searchCriteria(query url.Values) (searchPredicate, error) {
+	var predicates []searchPredicate
+	if pattern := query.Get("name"); pattern != "" {
+		p, err := namePredicate(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern %s", pattern)
+		}
+		predicates = append(predicates, p)
+	}
+	for param, op := range map[string]string{"minSize": "gte", "maxSize": "lte"} {
+		if value := query.Get(param); value != "" {
+			size, err := ParseByteSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s", param, value)
+			}
+			predicates = append(predicates, sizePredicate(op, int64(size)))
+		}
+	}
+	for param, op := range map[string]string{"after": "gte", "before": "lt"} {
+		if value := query.Get(param); value != "" {
+			t, err := parseSearchTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %s", param, value)
+			}
+			predicates = append(predicates, modTimePredicate(op, t))
+		}
+	}
+	return allOf(predicates...), nil
+}
+
+// maxResults returns the number of results a search returns at most.
+func (s *SearchIndex) maxResults(requested string) int {
+	max := s.settings.MaxResults
+	if max == 0 {
+		max = defaultSearchMaxResults
+	}
+	if n, err := strconv.Atoi(requested); err == nil && n > 0 && n < max {
+		return n
+	}
+	return max
+}
+
+// invertDocs returns the names of the documents containing each word.
+func invertDocs(docs map[string]*searchDoc) map[string]map[string]bool {
+	terms := map[string]map[string]bool{}
+	for name, doc := range docs {
+		for _, term := range doc.Terms {
+			if terms[term] == nil {
+				terms[term] = map[string]bool{}
+			}
+			terms[term][name] = true
+		}
+	}
+	return terms
+}
+
+// searchTerms returns the distinct lower case words of the text.
+func searchTerms(text string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if utf8.RuneCountInString(word) > searchMaxTermLength || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// searchExtractor returns the function extracting the text of the content of the file by its
+// extension. It returns nil for files of types without text, like images.
+func searchExtractor(p string) func(data []byte) (string, error) {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".txt", ".md", ".markdown", ".rst", ".csv", ".tsv", ".log", ".json", ".xml", ".yaml", ".yml",
+		".toml", ".ini", ".conf", ".tex", ".go", ".py", ".js", ".ts", ".java", ".c", ".h", ".cpp",
+		".rs", ".rb", ".php", ".sh", ".sql", ".css":
+		return extractPlainText
+	case ".html", ".htm", ".xhtml":
+		return extractHTMLText
+	case ".docx":
+		return extractOfficeText("word/document.xml")
+	case ".xlsx":
+		return extractOfficeText("xl/sharedStrings.xml")
+	case ".pptx":
+		return extractOfficeText("ppt/slides/")
+	case ".odt", ".ods", ".odp":
+		return extractOfficeText("content.xml")
+	}
+	return nil
+}
+
+// extractPlainText returns the content of a text file. Files, which aren't valid UTF-8, like
+// the encrypted files, have no text.
+func extractPlainText(data []byte) (string, error) {
+	if !utf8.Valid(data) || bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		return "", nil
+	}
+	return string(data), nil
+}
+
+// extractHTMLText returns the text of an HTML file without the scripts and the styles.
+func extractHTMLText(data []byte) (string, error) {
+	var text strings.Builder
+	skip := false
+	z := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return text.String(), nil
+			}
+			return "", z.Err()
+		case html.StartTagToken:
+			name, _ := z.TagName()
+			skip = string(name) == "script" || string(name) == "style"
+		case html.EndTagToken:
+			skip = false
+		case html.TextToken:
+			if !skip {
+				text.Write(z.Text())
+				text.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// extractOfficeText returns a function extracting the text of the XML members of an Office
+// Open XML or OpenDocument file, whose names start with prefix.
+func extractOfficeText(prefix string) func(data []byte) (string, error) {
+	return func(data []byte) (string, error) {
+		size := int64(len(data))
+		zr, err := zip.NewReader(bytes.NewReader(data), size)
+		if err != nil {
+			return "", err
+		}
+
+		var text strings.Builder
+		for _, member := range zr.File {
+			if !strings.HasPrefix(member.Name, prefix) || !strings.HasSuffix(member.Name, ".xml") {
+				continue
+			}
+			r, err := member.Open()
+			if err != nil {
+				return "", err
+			}
+			err = xmlText(&text, io.LimitReader(r, size*10))
+			r.Close()
+			if err != nil {
+				return "", err
+			}
+		}
+		return text.String(), nil
+	}
+}
+
+// xmlText writes the character data of the XML document separated by spaces.
+func xmlText(text *strings.Builder, r io.Reader) error {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if data, ok := tok.(xml.CharData); ok {
+			text.Write(data)
+			text.WriteByte(' ')
+		}
+	}
+}
+
+// serveSearch answers a GET of a collection with the search parameter by the files and
+// directories below it matching the query, the criteria of the name, the size and the date,
+// and the tag and metadata filters. It returns whether the request has been handled.
+func (a *App) serveSearch(w http.ResponseWriter, r *http.Request) bool {
+	if a.Search == nil || r.Method != http.MethodGet || !r.URL.Query().Has("search") {
+		return false
+	}
+	ctx := r.Context()
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	name := path.Clean(p)
+	if fi, err := a.Handler.FileSystem.Stat(ctx, name); err != nil || !fi.IsDir() {
+		return false
+	}
+
+	criteria, err := searchCriteria(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return true
+	}
+	query := r.URL.Query().Get("search")
+	matches, complete := a.Search.search(Dir{Config: a.Config}.resolve(ctx, name), query, allOf(a.searchFilter(r), criteria),
+		a.Search.maxResults(r.URL.Query().Get("limit")))
+	results := []SearchResult{}
+	for _, m := range a.visibleMatches(r, a.Handler, name, matches) {
+		result := SearchResult{
+			Path:    m.path,
+			Href:    (&url.URL{Path: path.Join("/", a.Config.Prefix, m.path)}).EscapedPath(),
+			Dir:     m.doc.Dir,
+			Size:    m.doc.Size,
+			ModTime: m.doc.ModTime,
+			Score:   m.score,
+		}
+		if a.Props != nil {
+			meta := a.Props.metadata(m.name)
+			result.Tags, result.Metadata = meta.Tags, meta.Metadata
+		}
+		results = append(results, result)
+	}
+	traceStep(ctx, "found %d files matching %q below %s", len(results), query, name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"query":     query,
+		"results":   results,
+		"truncated": !complete,
+	})
+	return true
+}
+
+// visibleMatches maps the physical paths of the matches to the paths below the collection of
+// the request, which the user is able to see. Files, which have been removed since they were
+// indexed, or which are within locked encrypted folders, are left out.
+func (a *App) visibleMatches(r *http.Request, h *webdav.Handler, collection string, matches []searchMatch) []searchMatch {
+	dir := Dir{Config: a.Config}.resolve(r.Context(), collection)
+	var visible []searchMatch
+	for _, m := range matches {
+		rel, err := filepath.Rel(dir, filepath.Join(a.Search.dir, filepath.FromSlash(m.name)))
+		if err != nil {
+			continue
+		}
+		name := path.Join(collection, filepath.ToSlash(rel))
+		if _, err := h.FileSystem.Stat(r.Context(), name); err != nil {
+			continue
+		}
+		m.path = name
+		visible = append(visible, m)
+	}
+	return visible
+}
+
+// searchRequest is the body of a SEARCH of RFC 5323. Of the basic search, the conditions
+// contains, like of the display name and the comparisons of the content length and the last
+// modification date are supported, combined by and.
+type searchRequest struct {
+	XMLName xml.Name   `xml:"DAV: searchrequest"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Basic   *struct {
+		Select struct {
+			Prop *struct {
+				Attrs []xml.Attr `xml:",any,attr"`
+				Inner []byte     `xml:",innerxml"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: select"`
+		Scope []struct {
+			Href string `xml:"DAV: href"`
+		} `xml:"DAV: from>scope"`
+		Where searchCondition `xml:"DAV: where"`
+		Limit *struct {
+			NResults int `xml:"DAV: nresults"`
+		} `xml:"DAV: limit"`
+	} `xml:"DAV: basicsearch"`
+}
+
+// searchCondition is a condition of a basic search.
+type searchCondition struct {
+	Contains []string `xml:"DAV: contains"`
+	Like     []struct {
+		Literal string `xml:"DAV: literal"`
+	} `xml:"DAV: like"`
+	Gt  []searchComparison `xml:"DAV: gt"`
+	Gte []searchComparison `xml:"DAV: gte"`
+	Lt  []searchComparison `xml:"DAV: lt"`
+	Lte []searchComparison `xml:"DAV: lte"`
+	And []searchCondition  `xml:"DAV: and"`
+	Or  []struct{}         `xml:"DAV: or"`
+	Not []struct{}         `xml:"DAV: not"`
+}
+
+// searchComparison compares a property with a literal.
+type searchComparison struct {
+	Prop struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+	Literal string `xml:"DAV: literal"`
+}
+
+// predicate returns the predicate of the comparison by the operator and whether the property
+// and the literal are supported.
+func (c *searchComparison) predicate(op string) (searchPredicate, bool) {
+	if len(c.Prop.Names) != 1 {
+		return nil, false
+	}
+	literal := strings.TrimSpace(c.Literal)
+	switch c.Prop.Names[0].XMLName {
+	case xml.Name{Space: "DAV:", Local: "getcontentlength"}:
+		n, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return sizePredicate(op, n), true
+	case xml.Name{Space: "DAV:", Local: "getlastmodified"}:
+		t, err := http.ParseTime(literal)
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, literal); err != nil {
+				return nil, false
+			}
+		}
+		return modTimePredicate(op, t), true
+	}
+	return nil, false
+}
+
+// query returns the words and the predicate of the condition and whether it's supported.
+func (c *searchCondition) query() (string, searchPredicate, bool) {
+	if len(c.Or) > 0 || len(c.Not) > 0 {
+		return "", nil, false
+	}
+	words := append([]string{}, c.Contains...)
+	for _, like := range c.Like {
+		words = append(words, strings.NewReplacer("%", " ", "_", " ").Replace(like.Literal))
+	}
+	var predicates []searchPredicate
+	for op, comparisons := range map[string][]searchComparison{"gt": c.Gt, "gte": c.Gte, "lt": c.Lt, "lte": c.Lte} {
+		for i := range comparisons {
+			p, ok := comparisons[i].predicate(op)
+			if !ok {
+				return "", nil, false
+			}
+			predicates = append(predicates, p)
+		}
+	}
+	for i := range c.And {
+		query, p, ok := c.And[i].query()
+		if !ok {
+			return "", nil, false
+		}
+		words = append(words, query)
+		predicates = append(predicates, p)
+	}
+	return strings.Join(words, " "), allOf(predicates...), true
+}
+
+// serveSearchRequest answers a SEARCH with a basic search of the scope, which has to be the
+// collection of the request or below it. The properties of the matches are taken from a
+// PROPFIND of the WebDAV handler, like for a sync-collection report.
+func (a *App) serveSearchRequest(w http.ResponseWriter, r *http.Request, h *webdav.Handler) {
+	ctx := r.Context()
+	if !strings.HasPrefix(r.URL.Path, h.Prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	reqPath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, h.Prefix))
+
+	var body searchRequest
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil || body.Basic == nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	query, filter, ok := body.Basic.Where.query()
+	if !ok {
+		http.Error(w, "422 Unprocessable Entity", http.StatusUnprocessableEntity)
+		return
+	}
+	scope := reqPath
+	if len(body.Basic.Scope) > 0 {
+		href, err := url.Parse(body.Basic.Scope[0].Href)
+		if err != nil || !strings.HasPrefix(href.Path, h.Prefix) {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		scope = path.Clean("/" + strings.TrimPrefix(href.Path, h.Prefix))
+	}
+	if scope != reqPath && !strings.HasPrefix(scope, strings.TrimSuffix(reqPath, "/")+"/") {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	if fi, err := h.FileSystem.Stat(ctx, scope); err != nil || !fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	limit := a.Search.maxResults("")
+	if body.Basic.Limit != nil {
+		limit = a.Search.maxResults(strconv.Itoa(body.Basic.Limit.NResults))
+	}
+	matches, complete := a.Search.search(Dir{Config: a.Config}.resolve(ctx, scope), query, filter, limit)
+	matches = a.visibleMatches(r, h, scope, matches)
+	traceStep(ctx, "found %d files matching %q below %s", len(matches), query, scope)
+
+	propfind := []byte(`<D:propfind xmlns:D="DAV:"><D:allprop/></D:propfind>`)
+	if body.Basic.Select.Prop != nil {
+		propfind = (&syncCollection{Attrs: body.Attrs, Prop: body.Basic.Select.Prop}).propfind()
+	}
+	var out bytes.Buffer
+	out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	for _, m := range matches {
+		if responses, ok := a.propfindMember(r, h, m.path, propfind); ok {
+			out.Write(responses)
+		}
+	}
+	if !complete {
+		fmt.Fprintf(&out, "<D:response><D:href>%s</D:href><D:status>HTTP/1.1 507 Insufficient Storage</D:status></D:response>",
+			syncHref(h.Prefix, scope))
+	}
+	out.WriteString("</D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	if _, err := w.Write(out.Bytes()); err != nil {
+		log.WithError(err).Error("Error writing search results")
+	}
+}
+
+// RegisterMetrics exposes the indexed documents and words.
+func (s *SearchIndex) RegisterMetrics(m *Metrics) {
+	if s == nil {
+		return
+	}
+
+	m.Gauge("dave_search_documents", "Files and directories of the search index.", func() []Sample {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return []Sample{{Value: float64(len(s.docs))}}
+	})
+	m.Gauge("dave_search_terms", "Distinct words of the search index.", func() []Sample {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return []Sample{{Value: float64(len(s.terms))}}
+	})
+	m.Gauge("dave_search_last_update_timestamp_seconds", "Time the search index has been updated.", func() []Sample {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if s.last.IsZero() {
+			return nil
+		}
+		return []Sample{{Value: float64(s.last.Unix())}}
+	})
+}
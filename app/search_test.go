@@ -0,0 +1,141 @@
+package app
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice", "docs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "alice", "vault"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "bob"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "docs", "notes.txt"), []byte("The quarterly budget meeting"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "docs", "page.html"), []byte("<html><script>var hidden;</script><p>Roadmap</p></html>"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "vault", encryptionHeaderName), []byte("{}"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "vault", "budget.txt"), []byte("budget"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "bob", "budget.txt"), []byte("budget"), 0600)
+	f, _ := os.Create(filepath.Join(tmpDir, "alice", "report.docx"))
+	zw := zip.NewWriter(f)
+	member, _ := zw.Create("word/document.xml")
+	member.Write([]byte(`<w:document xmlns:w="w"><w:body><w:p><w:t>Invoice</w:t></w:p></w:body></w:document>`))
+	zw.Close()
+	f.Close()
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:    tmpDir,
+		Realm:  "dave",
+		Search: &Search{File: filepath.Join(tmpDir, "index.json")},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+	var err error
+	if a.Search, err = NewSearchIndex(cfg); err != nil {
+		t.Fatalf("NewSearchIndex() error = %v", err)
+	}
+	a.Search.update(time.Now())
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("alice", "password")
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"/?search=budget", []string{"/docs/notes.txt"}},
+		{"/?search=Quarterly+MEETING", []string{"/docs/notes.txt"}},
+		{"/?search=budget+roadmap", nil},
+		{"/?search=roadmap", []string{"/docs/page.html"}},
+		{"/?search=hidden", nil},
+		{"/?search=invoice", []string{"/report.docx"}},
+		{"/?search=docs", []string{"/docs"}},
+		{"/?search=notes+budget", []string{"/docs/notes.txt"}},
+		{"/docs?search=invoice", nil},
+		{"/?search=", nil},
+		{"/?search=&name=*.TXT", []string{"/docs/notes.txt"}},
+		{"/?search=&name=*o*&maxSize=30", []string{"/docs/notes.txt"}},
+		{"/?search=&minSize=40", []string{"/docs/page.html", "/report.docx"}},
+		{"/?search=&name=*.html&after=2000-01-01T00:00:00Z", []string{"/docs/page.html"}},
+		{"/?search=&name=*.html&before=2000-01-01", nil},
+	}
+	for _, tt := range tests {
+		w := do("GET", tt.target, "")
+		var res struct {
+			Results []SearchResult `json:"results"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); w.Code != http.StatusOK || err != nil {
+			t.Errorf("GET %s status = %v, error = %v", tt.target, w.Code, err)
+			continue
+		}
+		var got []string
+		for _, r := range res.Results {
+			got = append(got, r.Path)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("GET %s results = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+
+	reloaded, err := NewSearchIndex(cfg)
+	if err != nil || len(reloaded.docs) != len(a.Search.docs) {
+		t.Errorf("reloaded index has %d documents, want %d, error = %v", len(reloaded.docs), len(a.Search.docs), err)
+	}
+
+	search := `<?xml version="1.0"?><D:searchrequest xmlns:D="DAV:"><D:basicsearch>
+		<D:select><D:prop><D:displayname/></D:prop></D:select>
+		<D:from><D:scope><D:href>/docs</D:href><D:depth>infinity</D:depth></D:scope></D:from>
+		<D:where><D:and><D:contains>budget</D:contains><D:like><D:prop><D:displayname/></D:prop><D:literal>%notes%</D:literal></D:like></D:and></D:where>
+		</D:basicsearch></D:searchrequest>`
+	w := do("SEARCH", "/", search)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:href>/docs/notes.txt</D:href>") ||
+		!strings.Contains(w.Body.String(), "notes.txt</D:displayname>") || strings.Count(w.Body.String(), "<D:response>") != 1 {
+		t.Errorf("SEARCH = %v %s", w.Code, w.Body)
+	}
+	if w := do("SEARCH", "/", strings.Replace(search, "D:and", "D:or", -1)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("SEARCH with or status = %v, want %v", w.Code, http.StatusUnprocessableEntity)
+	}
+	if w := do("SEARCH", "/docs", strings.Replace(search, "<D:href>/docs</D:href>", "<D:href>/</D:href>", 1)); w.Code != http.StatusBadRequest {
+		t.Errorf("SEARCH outside of the collection status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	if w := do("GET", "/?search=&name=[", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET with invalid name pattern status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	sized := `<?xml version="1.0"?><D:searchrequest xmlns:D="DAV:"><D:basicsearch>
+		<D:select><D:prop><D:getcontentlength/></D:prop></D:select>
+		<D:where><D:and>
+		<D:gt><D:prop><D:getcontentlength/></D:prop><D:literal>40</D:literal></D:gt>
+		<D:lt><D:prop><D:getlastmodified/></D:prop><D:literal>Fri, 01 Jan 2100 00:00:00 GMT</D:literal></D:lt>
+		</D:and></D:where>
+		</D:basicsearch></D:searchrequest>`
+	if w := do("SEARCH", "/", sized); w.Code != http.StatusMultiStatus || strings.Count(w.Body.String(), "<D:response>") != 2 ||
+		!strings.Contains(w.Body.String(), "/docs/page.html") || !strings.Contains(w.Body.String(), "/report.docx") {
+		t.Errorf("SEARCH by size and date = %v %s", w.Code, w.Body)
+	}
+	if w := do("SEARCH", "/", strings.Replace(sized, "getlastmodified", "getetag", 2)); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("SEARCH comparing etags status = %v, want %v", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	os.Remove(filepath.Join(tmpDir, "alice", "docs", "notes.txt"))
+	if w := do("GET", "/?search=budget", ""); strings.Contains(w.Body.String(), "notes.txt") {
+		t.Errorf("removed file is found: %s", w.Body)
+	}
+}
@@ -7,12 +7,26 @@ import (
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
-	"strings"
+	"time"
 )
 
 type contextKey int
 
-var authInfoKey contextKey
+// The keys of the values in the contexts of the requests.
+const (
+	authInfoKey contextKey = iota
+	traceKey
+	tailscaleKey
+	quotaKey
+	rejectionKey
+	fingerprintKey
+	retentionOverrideKey
+	deletionApprovedKey
+	duplicateKey
+	guestKey
+	checksumKey
+	uploadBodyKey
+)
 
 // AuthInfo holds the username and authentication status
 type AuthInfo struct {
@@ -48,13 +62,18 @@ func authenticate(config *Config, username, password string) (*AuthInfo, error)
 		return &AuthInfo{Username: username, Authenticated: false}, errors.New("username not found or password empty")
 	}
 
-	user := config.Users[username]
-	if user == nil {
+	user := config.User(username)
+	if user == nil && config.LDAP == nil {
 		return &AuthInfo{Username: username, Authenticated: false}, errors.New("user not found")
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
-	if err != nil {
+	// the password of the configuration is checked first, then the authenticator plugins of
+	// the configured users. The LDAP server is only asked about users without a password of
+	// their own, so it isn't a second password of the configured ones.
+	ok := user != nil && ComparePassword(user.Password, []byte(password)) == nil
+	ok = ok || (user != nil && config.pluginAuthenticate(username, password))
+	ok = ok || ((user == nil || user.Password == "") && config.ldapAuthenticate(username, password))
+	if !ok {
 		return &AuthInfo{Username: username, Authenticated: false}, errors.New("Password doesn't match")
 	}
 
@@ -72,51 +91,206 @@ func AuthFromContext(ctx context.Context) *AuthInfo {
 }
 
 func handle(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) {
-	// handle a preflight if such a CORS request would be allowed
-	if req.Method == "OPTIONS" {
-		if a.Config.Cors.Origin == req.Header.Get("Origin") &&
-			req.Header.Get("Access-Control-Request-Method") != "" &&
-			req.Header.Get("Access-Control-Request-Headers") != "" {
-			w.WriteHeader(http.StatusNoContent)
-			return
+	started := time.Now()
+	ctx = withFingerprint(ctx, req)
+	ctx, tr := withTrace(ctx)
+	tw := &traceWriter{ResponseWriter: w}
+	defer a.Config.logTrace(tr, tw, req)
+	if a.AccessLog != nil {
+		var received int64
+		if req.Body != nil {
+			req.Body = &countingReader{ReadCloser: req.Body, n: &received}
 		}
+		defer a.AccessLog.record(tr, tw, req, a.Config.clientIP(req), &received, started)
 	}
+	w = a.Config.withErrorPages(tw, req)
+	ctx, w = a.Quotas.withQuota(ctx, w, req)
+	ctx, w = a.Config.withRejections(ctx, w, req)
+	ctx = a.Config.Duplicates.withDuplicates(ctx, w)
+	ctx = a.Config.withChecksums(ctx, req)
+	ctx = a.Config.withAtomicUploads(ctx, req)
 
-	// if there are no users, we don't need authentication here
-	if !a.Config.AuthenticationNeeded() {
-		a.Handler.ServeHTTP(w, req.WithContext(ctx))
+	// new requests are refused during maintenance, so they don't interfere with the work on
+	// the storage
+	if m := a.Config.maintenanceMode(); m != nil {
+		traceStep(ctx, "server is in maintenance mode")
+		m.writeUnavailable(w)
+		return
+	}
+	if a.Resources.shed(ctx, w, req) {
 		return
 	}
 
-	username, password, ok := httpAuth(req, a.Config)
-	if !ok {
-		writeUnauthorized(w, a.Config.Realm)
+	// addresses outside of the allowed networks are refused before anything else is served
+	if !a.checkNetworks(ctx, w, req, "") {
 		return
 	}
 
-	authInfo, err := authenticate(a.Config, username, password)
-	if err != nil {
-		ipAddr := req.Header.Get("X-Forwarded-For")
-		if len(ipAddr) == 0 {
-			remoteAddr := req.RemoteAddr
-			lastIndex := strings.LastIndex(remoteAddr, ":")
-			if lastIndex != -1 {
-				ipAddr = remoteAddr[:lastIndex]
-			} else {
-				ipAddr = remoteAddr
+	// banned addresses are refused, requests of canary paths are served as usual but trip the
+	// honeypot
+	if address := a.Config.clientIP(req); a.Tripwire.isBanned(address, time.Now()) {
+		traceStep(ctx, "address %s is banned by the honeypot", address)
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	} else if p, ok := a.relativePath(req); ok && a.Tripwire.isCanary(p) {
+		traceStep(ctx, "requested canary path %s", p)
+		user, _, _ := req.BasicAuth()
+		a.Tripwire.trip(address, user, p, time.Now())
+	}
+
+	// handle a preflight if such a CORS request would be allowed
+	if a.Config.Cors.preflight(w, req) {
+		traceStep(ctx, "answered CORS preflight for origin %s", req.Header.Get("Origin"))
+		return
+	}
+
+	// the status and login endpoints of Nextcloud, the public links, the signed URLs and the
+	// endpoints of the office editors with their tokens are reached before the login
+	if a.serveNextcloudPublic(ctx, w, req) || a.serveShare(ctx, w, req) || a.serveSignedURL(ctx, w, req) ||
+		a.serveWOPI(ctx, w, req) || a.serveOnlyOffice(ctx, w, req) {
+		return
+	}
+
+	// if there are no users, we don't need authentication here
+	if !a.Config.AuthenticationNeeded() {
+		traceStep(ctx, "no users configured, skipped authentication")
+		if !a.checkWriteLimit(ctx, w, req, "") || !a.checkUploadLimit(ctx, w, req, "") {
+			return
+		}
+		transfer, w := a.Tracker.Begin(w, req, a.Config.clientIP(req), "")
+		defer a.Tracker.End(transfer)
+		defer a.Usage.record(transfer)
+		a.serveWebdav(w, req.WithContext(ctx))
+		return
+	}
+
+	authInfo, login, ok := a.Config.tailscaleAuth(req)
+	if !ok && login != "" {
+		traceStep(ctx, "Tailscale identity %s is not mapped to a user", login)
+	}
+	if ok {
+		traceStep(ctx, "authenticated user %s by Tailscale identity %s", authInfo.Username, login)
+	} else if token, bearer := bearerToken(req); bearer && a.Config.OIDC != nil {
+		// the scheme of the Authorization header selects the bearer token over basic auth
+		if wait, locked := a.LoginLimiter.locked("", a.Config.clientIP(req), time.Now()); locked {
+			traceStep(ctx, "logins from %s are locked out for %s", a.Config.clientIP(req), wait)
+			writeLockedOut(w, wait)
+			return
+		}
+		var err error
+		authInfo, err = a.Config.oidcAuth(token)
+		if err != nil {
+			traceStep(ctx, "authentication by bearer token failed: %s", err)
+			log.WithFields(fingerprintFields(ctx, log.Fields{"user": authInfo.Username, "address": a.Config.clientIP(req)})).WithError(err).Warn("User failed to login")
+			a.Alerts.authFailed(time.Now())
+			a.LoginLimiter.failed("", a.Config.clientIP(req), time.Now())
+			writeInvalidToken(w, a.Config.Realm)
+			return
+		}
+		traceStep(ctx, "authenticated user %s by bearer token", authInfo.Username)
+	} else if a.Config.Guest != nil && req.Header.Get("Authorization") == "" {
+		traceStep(ctx, "no credentials, served as guest")
+		a.serveGuest(ctx, w, req)
+		return
+	} else {
+		username, password, ok := httpAuth(req, a.Config)
+		if !ok {
+			traceStep(ctx, "no basic auth credentials, requested authentication")
+			if a.Config.OIDC != nil {
+				w.Header().Add("WWW-Authenticate", "Bearer realm="+a.Config.Realm)
 			}
+			writeUnauthorized(w, a.Config.Realm)
+			return
 		}
 
-		log.WithField("user", username).WithField("address", ipAddr).WithError(err).Warn("User failed to login")
+		if a.Tripwire.isDecoy(username) {
+			traceStep(ctx, "login as decoy user %s", username)
+			a.Tripwire.trip(a.Config.clientIP(req), username, "", time.Now())
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+
+		if wait, locked := a.LoginLimiter.locked(username, a.Config.clientIP(req), time.Now()); locked {
+			traceStep(ctx, "logins of user %s from %s are locked out for %s", username, a.Config.clientIP(req), wait)
+			writeLockedOut(w, wait)
+			return
+		}
+
+		var err error
+		authInfo, err = authenticate(a.Config, username, password)
+		if err != nil {
+			traceStep(ctx, "authentication of user %s failed: %s", username, err)
+			log.WithFields(fingerprintFields(ctx, log.Fields{"user": username, "address": a.Config.clientIP(req)})).WithError(err).Warn("User failed to login")
+		}
+
+		if !authInfo.Authenticated {
+			a.Alerts.authFailed(time.Now())
+			a.LoginLimiter.failed(username, a.Config.clientIP(req), time.Now())
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+		a.LoginLimiter.succeeded(username)
+		traceStep(ctx, "authenticated user %s", authInfo.Username)
 	}
 
-	if !authInfo.Authenticated {
-		writeUnauthorized(w, a.Config.Realm)
+	tr.user = authInfo.Username
+	if !a.checkNetworks(ctx, w, req, authInfo.Username) {
+		return
+	}
+	if !a.checkWriteLimit(ctx, w, req, authInfo.Username) || !a.checkUploadLimit(ctx, w, req, authInfo.Username) {
+		return
+	}
+	w, ok = a.checkBandwidth(ctx, w, req, authInfo.Username)
+	if !ok {
 		return
 	}
-
 	ctx = context.WithValue(ctx, authInfoKey, authInfo)
-	a.Handler.ServeHTTP(w, req.WithContext(ctx))
+	transfer, w := a.Tracker.Begin(w, req, a.Config.clientIP(req), authInfo.Username)
+	defer a.Tracker.End(transfer)
+	defer a.Usage.record(transfer)
+	defer a.Bandwidth.record(transfer)
+	a.serveWebdav(w, req.WithContext(ctx))
+}
+
+// serveWebdav passes an authenticated request, which the policy allows, to the WebDAV
+// handler, to the principals, to the endpoints of the Nextcloud compatibility, to the signing
+// of URLs, to the launch of the office editors or to the listings of the directories.
+func (a *App) serveWebdav(w http.ResponseWriter, req *http.Request) {
+	req, ok := a.applyPolicy(w, req)
+	if !ok {
+		return
+	}
+	if a.servePrincipal(w, req) || a.serveEncryption(w, req) || a.serveNextcloud(w, req) || a.serveSignURL(w, req) ||
+		a.serveWOPILaunch(w, req) || a.serveOnlyOfficeLaunch(w, req) || a.serveImage(w, req) || a.serveArchive(w, req) ||
+		a.serveSearch(w, req) || a.serveMetadata(w, req) || a.serveFeed(w, req) || a.serveBrowse(w, req) {
+		return
+	}
+	a.davHandler(a.Handler).ServeHTTP(w, req)
+}
+
+// serveAs serves a request, which is authenticated by a token of the user instead of the
+// credentials. The limits and the accounting of the user apply like for WebDAV requests.
+func (a *App) serveAs(ctx context.Context, w http.ResponseWriter, r *http.Request, user string, serve http.HandlerFunc) {
+	if user != "" {
+		if a.Config.User(user) == nil {
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ctx = context.WithValue(ctx, authInfoKey, &AuthInfo{Username: user, Authenticated: true})
+	}
+
+	if !a.checkWriteLimit(ctx, w, r, user) {
+		return
+	}
+	w, ok := a.checkBandwidth(ctx, w, r, user)
+	if !ok {
+		return
+	}
+	transfer, w := a.Tracker.Begin(w, r, a.Config.clientIP(r), user)
+	defer a.Tracker.End(transfer)
+	defer a.Usage.record(transfer)
+	defer a.Bandwidth.record(transfer)
+	serve(w, r.WithContext(ctx))
 }
 
 func httpAuth(r *http.Request, config *Config) (string, string, bool) {
@@ -129,7 +303,7 @@ func httpAuth(r *http.Request, config *Config) (string, string, bool) {
 }
 
 func writeUnauthorized(w http.ResponseWriter, realm string) {
-	w.Header().Set("WWW-Authenticate", "Basic realm="+realm)
+	w.Header().Add("WWW-Authenticate", "Basic realm="+realm)
 	w.WriteHeader(http.StatusUnauthorized)
 	_, err := w.Write([]byte(fmt.Sprintf("%d %s", http.StatusUnauthorized, "Unauthorized")))
 
@@ -138,6 +312,12 @@ func writeUnauthorized(w http.ResponseWriter, realm string) {
 	}
 }
 
+// writeInvalidToken answers a request with a rejected bearer token as RFC 6750 describes.
+func writeInvalidToken(w http.ResponseWriter, realm string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm=`+realm+`, error="invalid_token"`)
+	http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+}
+
 // GenHash generates a bcrypt hashed password string
 func GenHash(password []byte) string {
 	pw, err := bcrypt.GenerateFromPassword(password, 10)
@@ -0,0 +1,328 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net/http"
+	"time"
+)
+
+// settingsResource is the representation of the settings within the admin API, which may be
+// changed at runtime: the logging, the write limit, the bandwidth cap and rate, the
+// maintenance mode and the flags and limits of the users. A PATCH only changes the settings
+// it contains, any other part of the configuration is rejected.
+type settingsResource struct {
+	Log         *logSettings             `json:"log,omitempty"`
+	WriteLimit  *writeLimitSettings      `json:"writeLimit,omitempty"`
+	Bandwidth   *bandwidthSettings       `json:"bandwidth,omitempty"`
+	Maintenance *maintenanceSettings     `json:"maintenance,omitempty"`
+	Users       map[string]*userSettings `json:"users,omitempty"`
+}
+
+type logSettings struct {
+	Error  *bool `json:"error,omitempty"`
+	Create *bool `json:"create,omitempty"`
+	Read   *bool `json:"read,omitempty"`
+	Update *bool `json:"update,omitempty"`
+	Delete *bool `json:"delete,omitempty"`
+	Trace  *bool `json:"trace,omitempty"`
+}
+
+// writeLimitSettings are a write limit, which is removed by zero requests.
+type writeLimitSettings struct {
+	Requests *int   `json:"requests,omitempty"`
+	Window   string `json:"window,omitempty"`
+}
+
+type bandwidthSettings struct {
+	Cap  *string `json:"cap,omitempty"`
+	Rate *string `json:"rate,omitempty"`
+}
+
+// maintenanceSettings switch the maintenance mode and set its defaults.
+type maintenanceSettings struct {
+	Enabled    *bool   `json:"enabled,omitempty"`
+	RetryAfter *string `json:"retryAfter,omitempty"`
+	Message    *string `json:"message,omitempty"`
+}
+
+type userSettings struct {
+	Trace        *bool               `json:"trace,omitempty"`
+	WriteLimit   *writeLimitSettings `json:"writeLimit,omitempty"`
+	BandwidthCap *string             `json:"bandwidthCap,omitempty"`
+}
+
+// settingChange is a validated change of a setting. The changes of a request are validated
+// as a whole, before any of them is applied.
+type settingChange struct {
+	// key is the key of the setting within the configuration file, like log.create
+	key string
+	// value is the new value, as it's logged and persisted
+	value interface{}
+	apply func()
+	// user is set for settings of users, which are persisted with the users
+	user bool
+}
+
+// setSetting applies the change of a setting, which requests may read concurrently.
+func (cfg *Config) setSetting(apply func()) {
+	cfg.settingsMu.Lock()
+	defer cfg.settingsMu.Unlock()
+	apply()
+}
+
+// settings returns the current settings.
+func (a *App) settings() *settingsResource {
+	cfg := a.Config
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	l := cfg.Log
+	res := &settingsResource{
+		Log:        &logSettings{Error: &l.Error, Create: &l.Create, Read: &l.Read, Update: &l.Update, Delete: &l.Delete, Trace: &l.Trace},
+		WriteLimit: newWriteLimitSettings(cfg.WriteLimit),
+		Users:      map[string]*userSettings{},
+	}
+	if res.WriteLimit == nil {
+		disabled := 0
+		res.WriteLimit = &writeLimitSettings{Requests: &disabled}
+	}
+	if bw := cfg.Bandwidth; bw != nil {
+		capacity, rate := bw.Cap.String(), bw.Rate.String()
+		res.Bandwidth = &bandwidthSettings{Cap: &capacity, Rate: &rate}
+	}
+	enabled := cfg.maintenanceMode() != nil
+	res.Maintenance = &maintenanceSettings{Enabled: &enabled}
+	if m := cfg.Maintenance; m != nil {
+		retryAfter, message := m.RetryAfter.String(), m.Message
+		res.Maintenance.RetryAfter, res.Maintenance.Message = &retryAfter, &message
+	}
+	for name, user := range cfg.UsersCopy() {
+		trace, bandwidthCap := user.Trace, user.BandwidthCap.String()
+		res.Users[name] = &userSettings{Trace: &trace, WriteLimit: newWriteLimitSettings(user.WriteLimit), BandwidthCap: &bandwidthCap}
+	}
+	return res
+}
+
+func newWriteLimitSettings(l *WriteLimit) *writeLimitSettings {
+	if l == nil {
+		return nil
+	}
+	requests := l.Requests
+	res := &writeLimitSettings{Requests: &requests}
+	if l.Window > 0 {
+		res.Window = l.Window.String()
+	}
+	return res
+}
+
+// limit returns the validated write limit, nil for zero requests.
+func (s *writeLimitSettings) limit() (*WriteLimit, error) {
+	if s.Requests == nil || *s.Requests < 0 {
+		return nil, fmt.Errorf("requests of the write limit must be zero or positive")
+	}
+	if *s.Requests == 0 {
+		return nil, nil
+	}
+	l := &WriteLimit{Requests: *s.Requests}
+	if s.Window != "" {
+		window, err := time.ParseDuration(s.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("window of the write limit must be a positive duration")
+		}
+		l.Window = window
+	}
+	return l, nil
+}
+
+// writeLimitValue returns the write limit as it's persisted.
+func writeLimitValue(l *WriteLimit) interface{} {
+	if l == nil {
+		return nil
+	}
+	value := map[string]interface{}{"requests": l.Requests}
+	if l.Window > 0 {
+		value["window"] = l.Window.String()
+	}
+	return value
+}
+
+// settingChanges validates the settings and returns their changes.
+func (a *App) settingChanges(res *settingsResource) ([]*settingChange, error) {
+	cfg := a.Config
+	var changes []*settingChange
+
+	if l := res.Log; l != nil {
+		for _, s := range []struct {
+			key    string
+			value  *bool
+			target *bool
+		}{
+			{"log.error", l.Error, &cfg.Log.Error},
+			{"log.create", l.Create, &cfg.Log.Create},
+			{"log.read", l.Read, &cfg.Log.Read},
+			{"log.update", l.Update, &cfg.Log.Update},
+			{"log.delete", l.Delete, &cfg.Log.Delete},
+			{"log.trace", l.Trace, &cfg.Log.Trace},
+		} {
+			if s.value == nil {
+				continue
+			}
+			value, target := *s.value, s.target
+			changes = append(changes, &settingChange{key: s.key, value: value, apply: func() { cfg.setSetting(func() { *target = value }) }})
+		}
+	}
+
+	if res.WriteLimit != nil {
+		limit, err := res.WriteLimit.limit()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, &settingChange{key: "writeLimit", value: writeLimitValue(limit), apply: func() { cfg.setSetting(func() { cfg.WriteLimit = limit }) }})
+	}
+
+	if bw := res.Bandwidth; bw != nil {
+		if cfg.Bandwidth == nil {
+			return nil, fmt.Errorf("bandwidth isn't configured")
+		}
+		if bw.Cap != nil {
+			capacity, err := ParseByteSize(*bw.Cap)
+			if err != nil {
+				return nil, fmt.Errorf("cap of the bandwidth: %w", err)
+			}
+			changes = append(changes, &settingChange{key: "bandwidth.cap", value: capacity.String(), apply: func() { cfg.setSetting(func() { cfg.Bandwidth.Cap = capacity }) }})
+		}
+		if bw.Rate != nil {
+			rate, err := ParseByteSize(*bw.Rate)
+			if err != nil {
+				return nil, fmt.Errorf("rate of the bandwidth: %w", err)
+			}
+			changes = append(changes, &settingChange{key: "bandwidth.rate", value: rate.String(), apply: func() { cfg.setSetting(func() { cfg.Bandwidth.Rate = rate }) }})
+		}
+	}
+
+	if m := res.Maintenance; m != nil {
+		// the defaults are replaced as a whole, so SetMaintenance never sees them half updated
+		maintenance := &Maintenance{}
+		if cfg.Maintenance != nil {
+			*maintenance = *cfg.Maintenance
+		}
+		setDefaults := func() { cfg.Maintenance = maintenance }
+		if m.RetryAfter != nil {
+			retryAfter, err := time.ParseDuration(*m.RetryAfter)
+			if err != nil || retryAfter <= 0 {
+				return nil, fmt.Errorf("retryAfter must be a positive duration")
+			}
+			maintenance.RetryAfter = retryAfter
+			changes = append(changes, &settingChange{key: "maintenance.retryAfter", value: retryAfter.String(), apply: setDefaults})
+		}
+		if m.Message != nil {
+			maintenance.Message = *m.Message
+			changes = append(changes, &settingChange{key: "maintenance.message", value: *m.Message, apply: setDefaults})
+		}
+		if m.Enabled != nil {
+			enabled := *m.Enabled
+			maintenance.Enabled = enabled
+			changes = append(changes, &settingChange{key: "maintenance.enabled", value: enabled, apply: func() {
+				setDefaults()
+				cfg.SetMaintenance(enabled, 0, "")
+			}})
+		}
+	}
+
+	for name, u := range res.Users {
+		if cfg.User(name) == nil {
+			return nil, fmt.Errorf("user %s not found", name)
+		}
+		name := name
+		if u.Trace != nil {
+			trace := *u.Trace
+			changes = append(changes, &settingChange{key: "users." + name + ".trace", value: trace, user: true, apply: func() {
+				cfg.updateUser(name, func(user *UserInfo) { user.Trace = trace })
+			}})
+		}
+		if u.WriteLimit != nil {
+			limit, err := u.WriteLimit.limit()
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", name, err)
+			}
+			changes = append(changes, &settingChange{key: "users." + name + ".writeLimit", value: writeLimitValue(limit), user: true, apply: func() {
+				cfg.updateUser(name, func(user *UserInfo) { user.WriteLimit = limit })
+			}})
+		}
+		if u.BandwidthCap != nil {
+			capacity, err := ParseByteSize(*u.BandwidthCap)
+			if err != nil {
+				return nil, fmt.Errorf("bandwidth cap of user %s: %w", name, err)
+			}
+			changes = append(changes, &settingChange{key: "users." + name + ".bandwidthCap", value: capacity.String(), user: true, apply: func() {
+				cfg.updateUser(name, func(user *UserInfo) { user.BandwidthCap = capacity })
+			}})
+		}
+	}
+	return changes, nil
+}
+
+// handleAdminSettings reports the settings and changes them with a PATCH. Every change is
+// logged with the admin and persisted to the configuration file, if there is one.
+func (a *App) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var res settingsResource
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&res); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		changes, err := a.settingChanges(&res)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		username, _, _ := r.BasicAuth()
+		for _, c := range changes {
+			c.apply()
+			log.WithFields(log.Fields{"admin": username, "setting": c.key, "value": c.value}).Info("Changed setting via admin API")
+		}
+		if err := a.persistSettings(changes); err != nil {
+			log.WithError(err).Error("Error persisting settings")
+			writeJSONError(w, http.StatusInternalServerError, "settings changed, but not persisted")
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.settings())
+}
+
+// persistSettings writes the changed settings back to the configuration file, if there is one.
+func (a *App) persistSettings(changes []*settingChange) error {
+	path := viper.ConfigFileUsed()
+	if path == "" || len(changes) == 0 {
+		return nil
+	}
+
+	values := map[string]interface{}{}
+	users := false
+	for _, c := range changes {
+		if c.user {
+			users = true
+		} else {
+			values[c.key] = c.value
+		}
+	}
+	if len(values) > 0 {
+		if err := saveSettings(path, values); err != nil {
+			return err
+		}
+	}
+	if users {
+		return a.persistUsers()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAdminSettings(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	hash := GenHash([]byte("password"))
+	path := filepath.Join(tmpDir, "config.yaml")
+	ioutil.WriteFile(path, []byte("# keep me\ndir: "+tmpDir+"\nlog:\n  error: true\nbandwidth:\n  cap: 10GB\nusers:\n  foo:\n    password: "+hash+"\n"), 0600)
+	viper.SetConfigFile(path)
+
+	cfg := &Config{
+		Dir:       tmpDir,
+		Log:       Logging{Error: true},
+		Bandwidth: &Bandwidth{Cap: 10 << 30},
+		Users:     map[string]*UserInfo{"foo": {Password: hash}},
+		Admin:     &Admin{Users: map[string]*UserInfo{"root": {Password: GenHash([]byte("secret"))}}},
+	}
+	handler := NewAdminHandler(&App{Config: cfg, Tracker: NewTracker()})
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		statusCode int
+	}{
+		{"get", "GET", "", 200},
+		{"other configuration", "PATCH", `{"dir":"/etc"}`, 400},
+		{"invalid write limit", "PATCH", `{"log":{"read":true},"writeLimit":{"requests":10,"window":"-1s"}}`, 400},
+		{"invalid bandwidth cap", "PATCH", `{"bandwidth":{"cap":"lots"}}`, 400},
+		{"invalid retry after", "PATCH", `{"maintenance":{"retryAfter":"soon"}}`, 400},
+		{"missing user", "PATCH", `{"users":{"bar":{"trace":true}}}`, 400},
+		{"change", "PATCH", `{"log":{"read":true},"writeLimit":{"requests":10,"window":"1m"},"bandwidth":{"cap":"1GB"},` +
+			`"maintenance":{"enabled":true,"message":"Back soon"},"users":{"foo":{"trace":true,"bandwidthCap":"5GB"}}}`, 200},
+		{"delete", "DELETE", "", 405},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/v1/settings", strings.NewReader(tt.body))
+		r.SetBasicAuth("root", "secret")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.statusCode {
+			t.Errorf("%s: status = %v, want %v. body = %s", tt.name, w.Code, tt.statusCode, w.Body)
+		}
+		if tt.statusCode == 400 && cfg.Log.Read {
+			t.Fatalf("%s: changed settings of an invalid request", tt.name)
+		}
+		if tt.name == "change" {
+			var res settingsResource
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil || !*res.Log.Read || !*res.Maintenance.Enabled || !*res.Users["foo"].Trace {
+				t.Errorf("%s: settings = %s, %v", tt.name, w.Body, err)
+			}
+		}
+	}
+
+	if !cfg.Log.Read || cfg.WriteLimit == nil || cfg.WriteLimit.Requests != 10 || cfg.Bandwidth.Cap != 1<<30 || !cfg.User("foo").Trace {
+		t.Errorf("settings not applied: log = %+v, write limit = %+v, bandwidth = %+v", cfg.Log, cfg.WriteLimit, cfg.Bandwidth)
+	}
+	if m := cfg.maintenanceMode(); m == nil || m.Message != "Back soon" {
+		t.Errorf("maintenance mode = %+v, want enabled with the message", m)
+	}
+
+	content, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(content), "# keep me") {
+		t.Errorf("persisted configuration lost the comment: %s", content)
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatalf("reading the persisted configuration: %v", err)
+	}
+	persisted := &Config{}
+	if err := unmarshalConfig(v, persisted, true); err != nil {
+		t.Fatalf("parsing the persisted configuration: %v", err)
+	}
+	if !persisted.Log.Error || !persisted.Log.Read || persisted.WriteLimit == nil || persisted.WriteLimit.Window != time.Minute ||
+		persisted.Bandwidth.Cap != 1<<30 || persisted.Maintenance == nil || !persisted.Maintenance.Enabled ||
+		persisted.Maintenance.Message != "Back soon" || !persisted.Users["foo"].Trace || persisted.Users["foo"].BandwidthCap != 5<<30 {
+		t.Errorf("persisted configuration = %s", content)
+	}
+}
@@ -0,0 +1,704 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Settings of the SFTP frontend
+const (
+	defaultSFTPPort      = "2022"
+	sftpHandshakeTimeout = 30 * time.Second
+	sftpMaxPacket        = 256 * 1024
+	sftpMaxRead          = 32 * 1024
+	sftpDirBatch         = 100
+)
+
+// Packet types and status codes of version 3 of the SFTP protocol
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// Flags of SFTP open requests and attributes
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+// SFTP configures an SSH frontend for power users, who prefer sftp and scp. It serves the same
+// directory to the same users as WebDAV, including their subdirs and quotas. Users log in with
+// their password or one of their SSH keys. The host key is generated on the first start, if
+// HostKeyFile doesn't exist.
+type SFTP struct {
+	Address     string
+	Port        string
+	HostKeyFile string
+}
+
+// Listener returns the listener of the SSH connections.
+func (s *SFTP) Listener() *Listener {
+	return &Listener{Address: s.Address, Port: s.Port}
+}
+
+// SFTPServer serves the file system of the WebDAV handler via SFTP. Connections are idle
+// while they wait for the next request without an open file, so Shutdown closes them then.
+type SFTPServer struct {
+	connServer
+	app    *App
+	fs     webdav.FileSystem
+	config *ssh.ServerConfig
+}
+
+// NewSFTPServer creates an SFTP frontend for the users of the app and the file system.
+func NewSFTPServer(a *App, fs webdav.FileSystem) (*SFTPServer, error) {
+	hostKey, err := loadHostKey(a.Config.SFTP.HostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SFTPServer{app: a, fs: fs}
+	s.config = &ssh.ServerConfig{
+		NoClientAuth:      !a.Config.AuthenticationNeeded(),
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	s.config.AddHostKey(hostKey)
+	return s, nil
+}
+
+// loadHostKey reads the host key or generates it, if the file doesn't exist yet.
+func loadHostKey(file string) (ssh.Signer, error) {
+	if file == "" {
+		return nil, errors.New("SFTP requires a hostKeyFile")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			return nil, err
+		}
+		log.WithField("path", file).Info("Generated SFTP host key")
+	} else if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP host key %s: %s", file, err)
+	}
+	return signer, nil
+}
+
+func (s *SFTPServer) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if s.app.Tripwire.isDecoy(conn.User()) {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		s.app.Tripwire.trip(host, conn.User(), "", time.Now())
+		return nil, errors.New("login incorrect")
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if err := s.checkAddress(conn); err != nil {
+		return nil, err
+	}
+	if _, locked := s.app.LoginLimiter.locked(conn.User(), host, time.Now()); locked {
+		return nil, errors.New("too many failed logins")
+	}
+	authInfo, err := authenticate(s.app.Config, conn.User(), string(password))
+	if err != nil || !authInfo.Authenticated {
+		s.loginFailed(conn, err)
+		s.app.LoginLimiter.failed(conn.User(), host, time.Now())
+		return nil, errors.New("login incorrect")
+	}
+	s.app.LoginLimiter.succeeded(conn.User())
+	return nil, nil
+}
+
+func (s *SFTPServer) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if err := s.checkAddress(conn); err != nil {
+		return nil, err
+	}
+	if user := s.app.Config.User(conn.User()); user != nil {
+		for _, line := range user.SSHKeys {
+			authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				log.WithField("user", conn.User()).WithError(err).Warn("Invalid SSH key of user")
+				continue
+			}
+			if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+				return nil, nil
+			}
+		}
+	}
+	// clients try their keys one after another, so a rejected key isn't a failed login
+	return nil, errors.New("key not authorized")
+}
+
+// checkAddress refuses the logins from addresses outside of the allowed networks of the
+// configuration and of the user.
+func (s *SFTPServer) checkAddress(conn ssh.ConnMetadata) error {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if ip := net.ParseIP(host); !s.app.Config.allowsAddress(ip, conn.User()) {
+		refuseAddress("SFTP", conn.User(), ip)
+		return errors.New("login not allowed from this address")
+	}
+	return nil
+}
+
+func (s *SFTPServer) loginFailed(conn ssh.ConnMetadata, err error) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	entry := log.WithField("user", conn.User()).WithField("address", host)
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Warn("User failed to login via SFTP")
+	s.app.Alerts.authFailed(time.Now())
+}
+
+// Serve accepts SSH connections until the listener fails. It returns http.ErrServerClosed
+// after Shutdown or Close.
+func (s *SFTPServer) Serve(ln net.Listener) error {
+	return s.serve(ln, s.serveConn)
+}
+
+func (s *SFTPServer) serveConn(conn net.Conn) {
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); s.app.Tripwire.isBanned(host, time.Now()) ||
+		s.app.Config.maintenanceMode() != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(sftpHandshakeTimeout))
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.WithField("address", conn.RemoteAddr().String()).WithError(err).Debug("SSH handshake failed")
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	ctx := context.Background()
+	if s.app.Config.AuthenticationNeeded() {
+		ctx = context.WithValue(ctx, authInfoKey, &AuthInfo{Username: sshConn.User(), Authenticated: true})
+	}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.serveSession(ctx, conn, channel, requests)
+	}
+}
+
+// serveSession runs the SFTP subsystem, other requests like shells or commands are refused.
+func (s *SFTPServer) serveSession(ctx context.Context, conn net.Conn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "subsystem" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		session := &sftpSession{server: s, ctx: ctx, conn: conn, rw: channel, handles: map[string]*sftpOpenFile{}}
+		err := session.serve()
+		if err != nil && err != io.EOF {
+			log.WithError(err).Warn("Error serving SFTP session")
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		return
+	}
+}
+
+// sftpSession is the state of a single SFTP subsystem.
+type sftpSession struct {
+	server     *SFTPServer
+	ctx        context.Context
+	conn       net.Conn
+	rw         io.ReadWriter
+	handles    map[string]*sftpOpenFile
+	nextHandle uint64
+}
+
+type sftpOpenFile struct {
+	file    webdav.File
+	stream  *stream
+	entries []os.FileInfo
+	read    bool
+}
+
+// close closes the file and records its transfer.
+func (h *sftpOpenFile) close() error {
+	err := h.file.Close()
+	if h.stream != nil {
+		h.stream.end()
+	}
+	return err
+}
+
+func (s *sftpSession) serve() error {
+	defer func() {
+		for _, h := range s.handles {
+			h.close()
+		}
+	}()
+
+	var header [4]byte
+	for {
+		if !s.server.idle(s.conn, len(s.handles) == 0) {
+			return nil
+		}
+		if _, err := io.ReadFull(s.rw, header[:]); err != nil {
+			return err
+		}
+		s.server.idle(s.conn, false)
+		length := binary.BigEndian.Uint32(header[:])
+		if length == 0 || length > sftpMaxPacket {
+			return fmt.Errorf("invalid SFTP packet length %d", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(s.rw, packet); err != nil {
+			return err
+		}
+		if err := s.handle(packet[0], &sftpBuffer{b: packet[1:]}); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers a single request.
+func (s *sftpSession) handle(kind byte, p *sftpBuffer) error {
+	if kind == sftpInit {
+		return s.send(sftpVersion, uint32(3))
+	}
+
+	id := p.uint32()
+	if p.err != nil {
+		return p.err
+	}
+	fs := s.server.fs
+	switch kind {
+	case sftpRealpath:
+		name := sftpPath(p.string())
+		return s.send(sftpName, id, uint32(1), name, name, uint32(0))
+	case sftpStat, sftpLstat:
+		fi, err := fs.Stat(s.ctx, sftpPath(p.string()))
+		return s.sendAttrs(id, fi, err)
+	case sftpFstat:
+		h := s.handles[p.string()]
+		if h == nil {
+			return s.sendStatus(id, os.ErrNotExist)
+		}
+		fi, err := h.file.Stat()
+		return s.sendAttrs(id, fi, err)
+	case sftpOpen:
+		name, pflags := sftpPath(p.string()), p.uint32()
+		return s.open(id, name, pflags)
+	case sftpOpendir:
+		return s.opendir(id, sftpPath(p.string()))
+	case sftpClose:
+		handle := p.string()
+		h := s.handles[handle]
+		if h == nil {
+			return s.sendStatus(id, os.ErrNotExist)
+		}
+		delete(s.handles, handle)
+		return s.sendStatus(id, h.close())
+	case sftpRead:
+		h, offset, length := s.handles[p.string()], p.uint64(), p.uint32()
+		if h == nil {
+			return s.sendStatus(id, os.ErrNotExist)
+		}
+		return s.read(id, h, offset, length)
+	case sftpWrite:
+		h, offset, data := s.handles[p.string()], p.uint64(), p.string()
+		if h == nil {
+			return s.sendStatus(id, os.ErrNotExist)
+		}
+		if _, err := h.file.Seek(int64(offset), io.SeekStart); err != nil {
+			return s.sendStatus(id, err)
+		}
+		n, err := h.file.Write([]byte(data))
+		if h.stream != nil {
+			h.stream.received(n)
+		}
+		return s.sendStatus(id, err)
+	case sftpReaddir:
+		h := s.handles[p.string()]
+		if h == nil {
+			return s.sendStatus(id, os.ErrNotExist)
+		}
+		return s.readdir(id, h)
+	case sftpMkdir:
+		name := sftpPath(p.string())
+		if err := s.allowWrite(); err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.sendStatus(id, fs.Mkdir(s.ctx, name, 0700))
+	case sftpRmdir:
+		name := sftpPath(p.string())
+		if err := s.allowWrite(); err != nil {
+			return s.sendStatus(id, err)
+		}
+		return s.rmdir(id, name)
+	case sftpRemove:
+		name := sftpPath(p.string())
+		if err := s.allowWrite(); err != nil {
+			return s.sendStatus(id, err)
+		}
+		fi, err := fs.Stat(s.ctx, name)
+		if err == nil && fi.IsDir() {
+			err = errors.New("is a directory")
+		}
+		if err == nil {
+			err = fs.RemoveAll(s.ctx, name)
+		}
+		return s.sendStatus(id, err)
+	case sftpRename:
+		oldName, newName := sftpPath(p.string()), sftpPath(p.string())
+		if err := s.allowWrite(); err != nil {
+			return s.sendStatus(id, err)
+		}
+		if _, err := fs.Stat(s.ctx, newName); err == nil {
+			return s.sendStatus(id, os.ErrExist)
+		}
+		return s.sendStatus(id, fs.Rename(s.ctx, oldName, newName))
+	case sftpSetstat, sftpFsetstat:
+		// attributes are managed by the server, clients setting them after uploads succeed
+		return s.sendStatus(id, nil)
+	}
+	return s.send(sftpStatus, id, uint32(sftpOpUnsupported), "Operation unsupported", "")
+}
+
+// username returns the name of the logged in user, which is empty without authentication.
+func (s *sftpSession) username() string {
+	if authInfo := AuthFromContext(s.ctx); authInfo != nil && authInfo.Authenticated {
+		return authInfo.Username
+	}
+	return ""
+}
+
+func (s *sftpSession) remoteIP() string {
+	host, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	return host
+}
+
+// allowWrite returns errWriteLimited, if a write operation exceeds the write limit.
+func (s *sftpSession) allowWrite() error {
+	if ok, _ := s.server.app.allowWrite(s.ctx, s.username(), s.remoteIP()); !ok {
+		return errWriteLimited
+	}
+	return nil
+}
+
+func (s *sftpSession) addHandle(h *sftpOpenFile) string {
+	s.nextHandle++
+	handle := strconv.FormatUint(s.nextHandle, 10)
+	s.handles[handle] = h
+	return handle
+}
+
+func (s *sftpSession) open(id uint32, name string, pflags uint32) error {
+	var flag int
+	switch {
+	case pflags&sftpFlagRead != 0 && pflags&sftpFlagWrite != 0:
+		flag = os.O_RDWR
+	case pflags&sftpFlagWrite != 0:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+	if pflags&sftpFlagAppend != 0 {
+		flag |= os.O_APPEND
+	}
+	if pflags&sftpFlagCreate != 0 {
+		flag |= os.O_CREATE
+	}
+	if pflags&sftpFlagTrunc != 0 {
+		flag |= os.O_TRUNC
+	}
+	if pflags&sftpFlagExcl != 0 {
+		flag |= os.O_EXCL
+	}
+
+	// opening a file for writing counts as a single write operation like a PUT
+	command := "READ"
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		command = "WRITE"
+		if err := s.allowWrite(); err != nil {
+			return s.sendStatus(id, err)
+		}
+	}
+	st, err := s.server.app.beginStream(s.ctx, command, name, s.remoteIP(), s.username())
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	f, err := s.server.fs.OpenFile(s.ctx, name, flag, 0600)
+	if err != nil {
+		st.end()
+		return s.sendStatus(id, err)
+	}
+	return s.send(sftpHandle, id, s.addHandle(&sftpOpenFile{file: f, stream: st}))
+}
+
+func (s *sftpSession) opendir(id uint32, name string) error {
+	f, err := s.server.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		f.Close()
+		return s.send(sftpStatus, id, uint32(sftpFailure), "Not a directory", "")
+	}
+	return s.send(sftpHandle, id, s.addHandle(&sftpOpenFile{file: f}))
+}
+
+func (s *sftpSession) read(id uint32, h *sftpOpenFile, offset uint64, length uint32) error {
+	if length > sftpMaxRead {
+		length = sftpMaxRead
+	}
+	if _, err := h.file.Seek(int64(offset), io.SeekStart); err != nil {
+		return s.sendStatus(id, err)
+	}
+	data := make([]byte, length)
+	n, err := io.ReadFull(h.file, data)
+	if n == 0 {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return s.sendStatus(id, err)
+	}
+	if h.stream != nil {
+		h.stream.sent(n)
+	}
+	return s.send(sftpData, id, string(data[:n]))
+}
+
+func (s *sftpSession) readdir(id uint32, h *sftpOpenFile) error {
+	if !h.read {
+		entries, err := h.file.Readdir(-1)
+		if err != nil {
+			return s.sendStatus(id, err)
+		}
+		h.entries, h.read = entries, true
+	}
+	if len(h.entries) == 0 {
+		return s.sendStatus(id, io.EOF)
+	}
+
+	batch := h.entries
+	if len(batch) > sftpDirBatch {
+		batch = batch[:sftpDirBatch]
+	}
+	h.entries = h.entries[len(batch):]
+
+	now := time.Now()
+	fields := []interface{}{id, uint32(len(batch))}
+	for _, fi := range batch {
+		fields = append(fields, fi.Name(), ftpListLine(fi, now), sftpAttributes(fi))
+	}
+	return s.send(sftpName, fields...)
+}
+
+func (s *sftpSession) rmdir(id uint32, name string) error {
+	f, err := s.server.fs.OpenFile(s.ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	entries, err := f.Readdir(1)
+	f.Close()
+	if err != nil && err != io.EOF {
+		return s.send(sftpStatus, id, uint32(sftpFailure), "Not a directory", "")
+	}
+	if len(entries) > 0 {
+		return s.send(sftpStatus, id, uint32(sftpFailure), "Directory not empty", "")
+	}
+	return s.sendStatus(id, s.server.fs.RemoveAll(s.ctx, name))
+}
+
+func (s *sftpSession) sendAttrs(id uint32, fi os.FileInfo, err error) error {
+	if err != nil {
+		return s.sendStatus(id, err)
+	}
+	return s.send(sftpAttrs, id, sftpAttributes(fi))
+}
+
+// sendStatus answers with the status of err. The messages don't contain paths, so the
+// location of the directory on the server isn't disclosed.
+func (s *sftpSession) sendStatus(id uint32, err error) error {
+	code, msg := uint32(sftpOK), "OK"
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		code, msg = sftpEOF, "EOF"
+	case errors.Is(err, errQuotaExceeded):
+		code, msg = sftpFailure, "Quota exceeded"
+	case errors.Is(err, errUploadTooLarge):
+		code, msg = sftpFailure, "File exceeds the maximum size"
+	case errors.Is(err, errUploadNotAllowed), errors.Is(err, errUploadPartial):
+		code, msg = sftpFailure, "File type isn't allowed"
+	case os.IsNotExist(err):
+		code, msg = sftpNoSuchFile, "No such file"
+	case os.IsExist(err):
+		code, msg = sftpFailure, "File exists"
+	case os.IsPermission(err), errors.Is(err, errAppendOnly), errors.Is(err, errRetained), errors.Is(err, errReadOnly),
+		errors.Is(err, errPluginDenied):
+		code, msg = sftpPermissionDenied, "Permission denied"
+	case errors.Is(err, errDeletionPending):
+		code, msg = sftpFailure, "Deletion pending approval"
+	case errors.Is(err, errWriteLimited):
+		code, msg = sftpFailure, "Write limit exceeded"
+	case errors.Is(err, errBandwidthExceeded):
+		code, msg = sftpFailure, "Bandwidth cap exceeded"
+	default:
+		code, msg = sftpFailure, "Failure"
+	}
+	return s.send(sftpStatus, id, code, msg, "")
+}
+
+// send writes a packet of the fields, which are encoded as defined by the protocol.
+func (s *sftpSession) send(kind byte, fields ...interface{}) error {
+	b := []byte{0, 0, 0, 0, kind}
+	for _, field := range fields {
+		switch v := field.(type) {
+		case uint32:
+			b = binary.BigEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.BigEndian.AppendUint64(b, v)
+		case string:
+			b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+			b = append(b, v...)
+		case []byte:
+			b = append(b, v...)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := s.rw.Write(b)
+	return err
+}
+
+// sftpAttributes encodes the size, the permissions and the times of a file.
+func sftpAttributes(fi os.FileInfo) []byte {
+	mode := uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		mode |= 0040000
+	} else {
+		mode |= 0100000
+	}
+	modTime := uint32(fi.ModTime().Unix())
+
+	b := binary.BigEndian.AppendUint32(nil, sftpAttrSize|sftpAttrPermissions|sftpAttrTimes)
+	b = binary.BigEndian.AppendUint64(b, uint64(fi.Size()))
+	b = binary.BigEndian.AppendUint32(b, mode)
+	b = binary.BigEndian.AppendUint32(b, modTime)
+	return binary.BigEndian.AppendUint32(b, modTime)
+}
+
+// sftpPath cleans a path of a client, relative paths start at the root of the user.
+func sftpPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// sftpBuffer decodes the fields of a request. Once a field is missing, err is set and all
+// further fields are empty.
+type sftpBuffer struct {
+	b   []byte
+	err error
+}
+
+func (p *sftpBuffer) next(n int) []byte {
+	if p.err != nil || len(p.b) < n {
+		p.err = errors.New("truncated SFTP packet")
+		return make([]byte, n)
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *sftpBuffer) uint32() uint32 {
+	return binary.BigEndian.Uint32(p.next(4))
+}
+
+func (p *sftpBuffer) uint64() uint64 {
+	return binary.BigEndian.Uint64(p.next(8))
+}
+
+func (p *sftpBuffer) string() string {
+	n := p.uint32()
+	if int(n) > len(p.b) {
+		p.err = errors.New("truncated SFTP packet")
+		return ""
+	}
+	return string(p.next(int(n)))
+}
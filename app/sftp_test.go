@@ -0,0 +1,329 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpClient is a minimal SFTP client for the tests.
+type sftpClient struct {
+	t  *testing.T
+	w  io.Writer
+	r  io.Reader
+	id uint32
+}
+
+func startSFTP(t *testing.T, cfg *Config) string {
+	return startSFTPApp(t, &App{Config: cfg})
+}
+
+// startSFTPApp serves SFTP for the app, whose quotas are created from its config.
+func startSFTPApp(t *testing.T, a *App) string {
+	cfg := a.Config
+	quotas, err := NewQuotas(cfg)
+	if err != nil {
+		t.Fatalf("NewQuotas() error = %v", err)
+	}
+	cfg.SFTP = &SFTP{HostKeyFile: filepath.Join(cfg.Dir, ".hostkey")}
+	a.Quotas = quotas
+	server, err := NewSFTPServer(a, Dir{Config: cfg, Quotas: quotas})
+	if err != nil {
+		t.Fatalf("NewSFTPServer() error = %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go server.Serve(ln)
+	return ln.Addr().String()
+}
+
+func dialSFTP(t *testing.T, addr string, user string, auth ssh.AuthMethod) (*sftpClient, error) {
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := session.StdinPipe()
+	r, _ := session.StdoutPipe()
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &sftpClient{t: t, w: w, r: r}
+	c.write(sftpInit, uint32(3))
+	if kind, p := c.readPacket(); kind != sftpVersion || p.uint32() != 3 {
+		t.Fatalf("SFTP version packet = %d, want %d", kind, sftpVersion)
+	}
+	return c, nil
+}
+
+func (c *sftpClient) write(kind byte, fields ...interface{}) {
+	c.t.Helper()
+	session := &sftpSession{rw: struct {
+		io.Reader
+		io.Writer
+	}{nil, c.w}}
+	if err := session.send(kind, fields...); err != nil {
+		c.t.Fatalf("sending packet %d: %v", kind, err)
+	}
+}
+
+func (c *sftpClient) readPacket() (byte, *sftpBuffer) {
+	c.t.Helper()
+	var header [4]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		c.t.Fatalf("reading packet: %v", err)
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(c.r, packet); err != nil {
+		c.t.Fatalf("reading packet: %v", err)
+	}
+	return packet[0], &sftpBuffer{b: packet[1:]}
+}
+
+// request sends a request and returns the type and the fields of the response.
+func (c *sftpClient) request(kind byte, fields ...interface{}) (byte, *sftpBuffer) {
+	c.t.Helper()
+	c.id++
+	c.write(kind, append([]interface{}{c.id}, fields...)...)
+	reply, p := c.readPacket()
+	if id := p.uint32(); id != c.id {
+		c.t.Fatalf("response id = %d, want %d", id, c.id)
+	}
+	return reply, p
+}
+
+// status sends a request and returns the status code of the response.
+func (c *sftpClient) status(kind byte, fields ...interface{}) uint32 {
+	c.t.Helper()
+	reply, p := c.request(kind, fields...)
+	if reply != sftpStatus {
+		c.t.Fatalf("response = %d, want status", reply)
+	}
+	return p.uint32()
+}
+
+func (c *sftpClient) open(name string, pflags uint32) string {
+	c.t.Helper()
+	reply, p := c.request(sftpOpen, name, pflags, uint32(0))
+	if reply != sftpHandle {
+		c.t.Fatalf("open %s = %d, want a handle", name, reply)
+	}
+	return p.string()
+}
+
+func TestSFTPSession(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "alice"
+	addr := startSFTP(t, &Config{
+		Dir: tmpDir,
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	})
+
+	if _, err := dialSFTP(t, addr, "alice", ssh.Password("wrong")); err == nil {
+		t.Errorf("login with wrong password succeeded")
+	}
+	c, err := dialSFTP(t, addr, "alice", ssh.Password("password"))
+	if err != nil {
+		t.Fatalf("login error = %v", err)
+	}
+
+	if reply, p := c.request(sftpRealpath, "."); reply != sftpName || p.uint32() != 1 || p.string() != "/" {
+		t.Errorf("realpath . = %d, want /", reply)
+	}
+	if code := c.status(sftpMkdir, "scans", uint32(0)); code != sftpOK {
+		t.Errorf("mkdir = %d, want %d", code, sftpOK)
+	}
+
+	h := c.open("/scans/page.pdf", sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc)
+	c.status(sftpWrite, h, uint64(0), "scanned ")
+	c.status(sftpWrite, h, uint64(8), "page")
+	if code := c.status(sftpClose, h); code != sftpOK {
+		t.Errorf("close = %d, want %d", code, sftpOK)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(tmpDir, "alice", "scans", "page.pdf")); err != nil || string(data) != "scanned page" {
+		t.Errorf("uploaded file = %q, %v, want it within the subdir of alice", data, err)
+	}
+
+	h = c.open("/scans/page.pdf", sftpFlagRead)
+	if reply, p := c.request(sftpRead, h, uint64(8), uint32(100)); reply != sftpData || p.string() != "page" {
+		t.Errorf("read at offset = %d, want the end of the content", reply)
+	}
+	if code := c.status(sftpRead, h, uint64(12), uint32(100)); code != sftpEOF {
+		t.Errorf("read at the end = %d, want %d", code, sftpEOF)
+	}
+	c.status(sftpClose, h)
+
+	reply, p := c.request(sftpOpendir, "/scans")
+	if reply != sftpHandle {
+		t.Fatalf("opendir = %d, want a handle", reply)
+	}
+	h = p.string()
+	if reply, p := c.request(sftpReaddir, h); reply != sftpName || p.uint32() != 1 || p.string() != "page.pdf" {
+		t.Errorf("readdir = %d, want page.pdf", reply)
+	}
+	if code := c.status(sftpReaddir, h); code != sftpEOF {
+		t.Errorf("readdir after the entries = %d, want %d", code, sftpEOF)
+	}
+	c.status(sftpClose, h)
+
+	tests := []struct {
+		name   string
+		kind   byte
+		fields []interface{}
+		want   uint32
+	}{
+		{"stat missing file", sftpStat, []interface{}{"/missing"}, sftpNoSuchFile},
+		{"remove directory", sftpRemove, []interface{}{"/scans"}, sftpFailure},
+		{"remove non-empty directory", sftpRmdir, []interface{}{"/scans"}, sftpFailure},
+		{"rename", sftpRename, []interface{}{"/scans/page.pdf", "/page.pdf"}, sftpOK},
+		{"remove empty directory", sftpRmdir, []interface{}{"/scans"}, sftpOK},
+		{"remove file", sftpRemove, []interface{}{"/page.pdf"}, sftpOK},
+		{"symlink", 20, []interface{}{"/a", "/b"}, sftpOpUnsupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := c.status(tt.kind, tt.fields...); code != tt.want {
+				t.Errorf("request %d = %d, want %d", tt.kind, code, tt.want)
+			}
+		})
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(tmpDir, "alice")); len(entries) != 0 {
+		t.Errorf("subdir of alice contains %d entries, want none", len(entries))
+	}
+}
+
+func TestSFTPPublicKey(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+
+	addr := startSFTP(t, &Config{
+		Dir: tmpDir,
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), SSHKeys: []string{string(ssh.MarshalAuthorizedKey(signer.PublicKey()))}},
+		},
+	})
+
+	if _, err := dialSFTP(t, addr, "alice", ssh.PublicKeys(signer)); err != nil {
+		t.Errorf("login with authorized key error = %v", err)
+	}
+	if _, err := dialSFTP(t, addr, "alice", ssh.PublicKeys(otherSigner)); err == nil {
+		t.Errorf("login with other key succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, ".hostkey")); err != nil {
+		t.Errorf("generated host key error = %v", err)
+	}
+}
+
+func TestSFTPQuota(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "data"
+	addr := startSFTP(t, &Config{
+		Dir:   tmpDir,
+		Users: map[string]*UserInfo{"alice": {Password: GenHash([]byte("password")), Subdir: &subdir, Quota: 10}},
+	})
+	c, err := dialSFTP(t, addr, "alice", ssh.Password("password"))
+	if err != nil {
+		t.Fatalf("login error = %v", err)
+	}
+
+	h := c.open("/big", sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc)
+	if code := c.status(sftpWrite, h, uint64(0), "0123456789abc"); code != sftpFailure {
+		t.Errorf("write exceeding the quota = %d, want %d", code, sftpFailure)
+	}
+	c.status(sftpClose, h)
+	if _, err := os.Stat(filepath.Join(tmpDir, "data", "big")); !os.IsNotExist(err) {
+		t.Errorf("upload exceeding the quota exists, error = %v", err)
+	}
+
+	// rewriting the same bytes doesn't reserve them again
+	h = c.open("/small", sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc)
+	for i := 0; i < 3; i++ {
+		if code := c.status(sftpWrite, h, uint64(0), "01234567"); code != sftpOK {
+			t.Errorf("rewrite %d within the quota = %d, want %d", i, code, sftpOK)
+		}
+	}
+	c.status(sftpClose, h)
+}
+
+func TestSFTPLimits(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{
+		Dir:        tmpDir,
+		WriteLimit: &WriteLimit{Requests: 2, Window: time.Minute},
+		Bandwidth:  &Bandwidth{Cap: 10},
+		Users:      map[string]*UserInfo{"alice": {Password: GenHash([]byte("password"))}},
+	}
+	bandwidth, err := NewBandwidthLimiter(cfg)
+	if err != nil {
+		t.Fatalf("NewBandwidthLimiter() error = %v", err)
+	}
+	a := &App{Config: cfg, Tracker: NewTracker(), WriteLimiter: NewWriteLimiter(), Bandwidth: bandwidth}
+	c, err := dialSFTP(t, startSFTPApp(t, a), "alice", ssh.Password("password"))
+	if err != nil {
+		t.Fatalf("login error = %v", err)
+	}
+
+	h := c.open("/a", sftpFlagWrite|sftpFlagCreate|sftpFlagTrunc)
+	if code := c.status(sftpWrite, h, uint64(0), "0123456789ab"); code != sftpOK {
+		t.Errorf("write within the limits = %d, want %d", code, sftpOK)
+	}
+	c.status(sftpClose, h)
+	if code := c.status(sftpOpen, "/a", uint32(sftpFlagRead), uint32(0)); code != sftpFailure {
+		t.Errorf("open exceeding the bandwidth cap = %d, want %d", code, sftpFailure)
+	}
+	if code := c.status(sftpMkdir, "/d", uint32(0)); code != sftpOK {
+		t.Errorf("mkdir within the write limit = %d, want %d", code, sftpOK)
+	}
+	if code := c.status(sftpRemove, "/a"); code != sftpFailure {
+		t.Errorf("remove exceeding the write limit = %d, want %d", code, sftpFailure)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "a")); err != nil {
+		t.Errorf("file removed despite the write limit, error = %v", err)
+	}
+
+	if usage := bandwidth.Usage(); len(usage) != 1 || usage[0].Used != 12 {
+		t.Errorf("bandwidth usage = %+v, want 12 bytes of alice", usage)
+	}
+	if sessions := a.Tracker.Sessions(); len(sessions) != 1 || sessions[0].User != "alice" || sessions[0].Requests != 1 {
+		t.Errorf("sessions = %+v, want one transfer of alice", sessions)
+	}
+}
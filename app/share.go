@@ -0,0 +1,465 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the public shares
+const (
+	sharePrefix     = "/s/"
+	ocsSharesV1     = "/ocs/v1.php/apps/files_sharing/api/v1/shares"
+	ocsSharesV2     = "/ocs/v2.php/apps/files_sharing/api/v1/shares"
+	ocsShareTypeURL = 3
+	ocsPermRead     = 1
+)
+
+// Shares enables public links to the files and directories of the users, which are reached
+// without login below /s/. The links are read-only and optionally protected by a password or
+// limited by an expiry date. They're managed with the OCS share API of the Nextcloud
+// compatibility and kept in File, so they survive restarts.
+type Shares struct {
+	File string
+}
+
+// ShareStore holds the public links. A nil ShareStore is valid and holds no links.
+type ShareStore struct {
+	path string
+
+	mu     sync.Mutex
+	nextID int64
+	shares map[int64]*Share
+}
+
+// Share is a public link to a path of its owner. The path is the one seen by the owner, so
+// the subdir of the owner applies. The owner is empty, if no users are configured.
+type Share struct {
+	ID       int64      `json:"id"`
+	Token    string     `json:"token"`
+	Owner    string     `json:"owner,omitempty"`
+	Path     string     `json:"path"`
+	Password string     `json:"password,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Created  time.Time  `json:"created"`
+}
+
+var shareListPage = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="{{.M.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+{{if .Entries}}<ul>
+{{range .Entries}}<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{end}}</ul>
+{{else}}<p>{{.M.T "listing.empty"}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+// NewShareStore loads the public links of the configuration. Without a file, the links are
+// only kept in memory. It returns nil, if public links aren't configured.
+func NewShareStore(cfg *Config) (*ShareStore, error) {
+	if cfg.Shares == nil {
+		return nil, nil
+	}
+
+	s := &ShareStore{path: cfg.Shares.File, nextID: 1, shares: map[int64]*Share{}}
+	if s.path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var shares []*Share
+	if err := json.Unmarshal(data, &shares); err != nil {
+		return nil, fmt.Errorf("invalid share file %s: %s", s.path, err)
+	}
+	for _, share := range shares {
+		s.shares[share.ID] = share
+		if share.ID >= s.nextID {
+			s.nextID = share.ID + 1
+		}
+	}
+	return s, nil
+}
+
+// save writes the links to the file. s.mu must be held.
+func (s *ShareStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.sorted(func(*Share) bool { return true }), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// sorted returns the matching links by id. s.mu must be held.
+func (s *ShareStore) sorted(match func(*Share) bool) []*Share {
+	shares := []*Share{}
+	for _, share := range s.shares {
+		if match(share) {
+			shares = append(shares, share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].ID < shares[j].ID })
+	return shares
+}
+
+// create adds a link to the path of the owner.
+func (s *ShareStore) create(owner, name, password string, expires *time.Time) (*Share, error) {
+	token, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	share := &Share{Token: token, Owner: owner, Path: name, Expires: expires, Created: time.Now().UTC()}
+	if password != "" {
+		if share.Password, err = GenHashWith(HashBcrypt, []byte(password), DefaultCost(HashBcrypt)); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share.ID = s.nextID
+	s.nextID++
+	s.shares[share.ID] = share
+	if err := s.save(); err != nil {
+		delete(s.shares, share.ID)
+		return nil, err
+	}
+	return share, nil
+}
+
+// list returns the links of the owner, which match the filter.
+func (s *ShareStore) list(owner string, match func(*Share) bool) []*Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted(func(share *Share) bool { return share.Owner == owner && match(share) })
+}
+
+// get returns a link of the owner by id.
+func (s *ShareStore) get(owner string, id int64) *Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if share := s.shares[id]; share != nil && share.Owner == owner {
+		return share
+	}
+	return nil
+}
+
+// remove deletes a link of the owner and returns whether it existed.
+func (s *ShareStore) remove(owner string, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share := s.shares[id]
+	if share == nil || share.Owner != owner {
+		return false, nil
+	}
+	delete(s.shares, id)
+	if err := s.save(); err != nil {
+		s.shares[id] = share
+		return false, err
+	}
+	return true, nil
+}
+
+// byToken returns the unexpired link of a token.
+func (s *ShareStore) byToken(token string, now time.Time) *Share {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, share := range s.shares {
+		if share.Token == token {
+			if share.Expires != nil && now.After(*share.Expires) {
+				return nil
+			}
+			return share
+		}
+	}
+	return nil
+}
+
+// serveShare serves the public links, which are reached without login. Links with a
+// password ask for it by basic auth, the user name is ignored. Wrong passwords count as
+// failed logins of the link and the address, so they can't be guessed. It returns whether
+// the request has been handled.
+func (a *App) serveShare(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if a.Shares == nil {
+		return false
+	}
+	p, ok := a.relativePath(r)
+	if !ok || !strings.HasPrefix(p, sharePrefix) {
+		return false
+	}
+
+	token := strings.TrimPrefix(p, sharePrefix)
+	sub := ""
+	if i := strings.Index(token, "/"); i >= 0 {
+		token, sub = token[:i], token[i:]
+	}
+	share := a.Shares.byToken(token, time.Now())
+	if share == nil || (share.Owner != "" && a.Config.User(share.Owner) == nil) {
+		traceStep(ctx, "unknown or expired public link")
+		a.Config.writeError(w, r, http.StatusNotFound)
+		return true
+	}
+	// links created without users would be served with access to the whole directory
+	if share.Owner == "" && a.Config.AuthenticationNeeded() {
+		traceStep(ctx, "public link %d has no owner", share.ID)
+		a.Config.writeError(w, r, http.StatusNotFound)
+		return true
+	}
+	if share.Password != "" {
+		link, address := "share/"+token, a.Config.clientIP(r)
+		if wait, locked := a.LoginLimiter.locked(link, address, time.Now()); locked {
+			traceStep(ctx, "passwords of public link %d from %s are locked out for %s", share.ID, address, wait)
+			writeLockedOut(w, wait)
+			return true
+		}
+		_, password, given := r.BasicAuth()
+		if ComparePassword(share.Password, []byte(password)) != nil {
+			if given {
+				log.WithFields(log.Fields{"share": share.ID, "address": address}).Warn("Wrong password of public link")
+				a.LoginLimiter.failed(link, address, time.Now())
+			}
+			traceStep(ctx, "requested the password of public link %d", share.ID)
+			writeUnauthorized(w, a.Config.Realm)
+			return true
+		}
+		a.LoginLimiter.succeeded(link)
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		a.Config.writeError(w, r, http.StatusMethodNotAllowed)
+		return true
+	}
+
+	traceStep(ctx, "serving public link %d of user %s", share.ID, share.Owner)
+	a.serveAs(ctx, w, r, share.Owner, func(w http.ResponseWriter, r *http.Request) {
+		a.serveShareFile(w, r, share, sub)
+	})
+	return true
+}
+
+// serveShareFile serves a file of a link or lists the members of a shared directory.
+func (a *App) serveShareFile(w http.ResponseWriter, r *http.Request, share *Share, sub string) {
+	name := path.Join(share.Path, path.Clean("/"+sub))
+	f, err := a.Handler.FileSystem.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+	if err != nil {
+		a.Config.writeError(w, r, http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		a.Config.writeError(w, r, http.StatusNotFound)
+		return
+	}
+	if !fi.IsDir() {
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+		return
+	}
+
+	// the members are linked relative to the directory
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	children, err := f.Readdir(-1)
+	if err != nil {
+		a.Config.writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	var entries []map[string]string
+	for _, child := range children {
+		entry := map[string]string{"Name": child.Name(), "Href": url.PathEscape(child.Name())}
+		if child.IsDir() {
+			entry["Name"] += "/"
+			entry["Href"] += "/"
+		}
+		entries = append(entries, entry)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := map[string]interface{}{"Name": path.Base(name), "Entries": entries, "M": a.Config.I18n.messages(r)}
+	if err := shareListPage.Execute(w, data); err != nil {
+		log.WithError(err).Error("Error writing share listing")
+	}
+}
+
+// isOCSSharesPath returns whether the path belongs to the OCS share API.
+func isOCSSharesPath(p string) bool {
+	for _, base := range []string{ocsSharesV1, ocsSharesV2} {
+		if p == base || strings.HasPrefix(p, base+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// serveOCSShares serves the subset of the OCS share API the mobile apps use to manage
+// public links: listing, creating, reading and deleting them. user is the user id reported
+// to the clients.
+func (a *App) serveOCSShares(w http.ResponseWriter, r *http.Request, p, user string) {
+	owner := ""
+	if authInfo := AuthFromContext(r.Context()); authInfo != nil && authInfo.Authenticated {
+		owner = authInfo.Username
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(p, ocsSharesV1), ocsSharesV2)
+
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		filter := r.URL.Query().Get("path")
+		subfiles := r.URL.Query().Get("subfiles") == "true"
+		shares := a.Shares.list(owner, func(share *Share) bool {
+			switch {
+			case filter == "":
+				return true
+			case subfiles:
+				return path.Dir(share.Path) == path.Clean("/"+filter)
+			default:
+				return share.Path == path.Clean("/"+filter)
+			}
+		})
+		data := []interface{}{}
+		for _, share := range shares {
+			data = append(data, a.ocsShare(r, share, user))
+		}
+		writeOCS(w, p, data)
+	case rest == "" && r.Method == http.MethodPost:
+		a.createOCSShare(w, r, p, owner, user)
+	case strings.HasPrefix(rest, "/"):
+		id, err := strconv.ParseInt(strings.TrimPrefix(rest, "/"), 10, 64)
+		share := a.Shares.get(owner, id)
+		if err != nil || share == nil {
+			writeOCSError(w, p, http.StatusNotFound, "Wrong share ID, share doesn't exist")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeOCS(w, p, []interface{}{a.ocsShare(r, share, user)})
+		case http.MethodDelete:
+			if _, err := a.Shares.remove(owner, id); err != nil {
+				log.WithError(err).Error("Error saving shares")
+				writeOCSError(w, p, http.StatusInternalServerError, "Error deleting share")
+				return
+			}
+			traceStep(r.Context(), "deleted public link %d of %s", share.ID, share.Path)
+			writeOCS(w, p, []interface{}{})
+		default:
+			writeOCSError(w, p, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	default:
+		writeOCSError(w, p, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func (a *App) createOCSShare(w http.ResponseWriter, r *http.Request, p, owner, user string) {
+	if err := r.ParseForm(); err != nil {
+		writeOCSError(w, p, http.StatusBadRequest, "Invalid request")
+		return
+	}
+	if r.Form.Get("shareType") != strconv.Itoa(ocsShareTypeURL) {
+		writeOCSError(w, p, http.StatusBadRequest, "Only public links can be shared")
+		return
+	}
+	if perm := r.Form.Get("permissions"); perm != "" && perm != strconv.Itoa(ocsPermRead) {
+		writeOCSError(w, p, http.StatusBadRequest, "Public links are read-only")
+		return
+	}
+	var expires *time.Time
+	if date := r.Form.Get("expireDate"); date != "" {
+		day, err := time.ParseInLocation("2006-01-02", strings.SplitN(date, " ", 2)[0], time.Local)
+		if err != nil {
+			writeOCSError(w, p, http.StatusBadRequest, "Invalid date, date format must be YYYY-MM-DD")
+			return
+		}
+		// the link is valid until the end of the day
+		end := day.AddDate(0, 0, 1).Add(-time.Second)
+		expires = &end
+	}
+
+	name := path.Clean("/" + r.Form.Get("path"))
+	if name == "/" {
+		writeOCSError(w, p, http.StatusForbidden, "You cannot share your root folder")
+		return
+	}
+	if _, err := a.Handler.FileSystem.Stat(r.Context(), name); err != nil {
+		writeOCSError(w, p, http.StatusNotFound, "Wrong path, file/folder doesn't exist")
+		return
+	}
+
+	share, err := a.Shares.create(owner, name, r.Form.Get("password"), expires)
+	if err != nil {
+		log.WithError(err).Error("Error creating share")
+		writeOCSError(w, p, http.StatusInternalServerError, "Error creating share")
+		return
+	}
+	traceStep(r.Context(), "created public link %d of %s", share.ID, share.Path)
+	writeOCS(w, p, a.ocsShare(r, share, user))
+}
+
+// ocsShare returns a link in the format of the OCS share API.
+func (a *App) ocsShare(r *http.Request, share *Share, user string) map[string]interface{} {
+	itemType, mimeType := "file", mime.TypeByExtension(path.Ext(share.Path))
+	if fi, err := a.Handler.FileSystem.Stat(r.Context(), share.Path); err == nil && fi.IsDir() {
+		itemType, mimeType = "folder", "httpd/unix-directory"
+	} else if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	var expiration interface{}
+	if share.Expires != nil {
+		expiration = share.Expires.Format("2006-01-02") + " 00:00:00"
+	}
+	var shareWith interface{}
+	if share.Password != "" {
+		shareWith = "***redacted***"
+	}
+
+	return map[string]interface{}{
+		"id":                     strconv.FormatInt(share.ID, 10),
+		"share_type":             ocsShareTypeURL,
+		"uid_owner":              user,
+		"displayname_owner":      user,
+		"uid_file_owner":         user,
+		"displayname_file_owner": user,
+		"permissions":            ocsPermRead,
+		"stime":                  share.Created.Unix(),
+		"expiration":             expiration,
+		"token":                  share.Token,
+		"path":                   share.Path,
+		"item_type":              itemType,
+		"mimetype":               mimeType,
+		"file_target":            "/" + path.Base(share.Path),
+		"share_with":             shareWith,
+		"url":                    a.baseURL(r) + sharePrefix + share.Token,
+		"mail_send":              0,
+		"hide_download":          0,
+	}
+}
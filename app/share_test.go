@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareStore(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{Shares: &Shares{File: filepath.Join(tmpDir, "shares.json")}}
+	s, err := NewShareStore(cfg)
+	if err != nil {
+		t.Fatalf("NewShareStore() error = %v", err)
+	}
+	expired := time.Now().Add(-time.Hour)
+	first, _ := s.create("alice", "/a.txt", "", nil)
+	second, _ := s.create("alice", "/b.txt", "", &expired)
+	s.remove("alice", first.ID)
+
+	s, err = NewShareStore(cfg)
+	if err != nil {
+		t.Fatalf("NewShareStore() of existing file error = %v", err)
+	}
+	if got := s.list("alice", func(*Share) bool { return true }); len(got) != 1 || got[0].ID != second.ID {
+		t.Errorf("list() after reopening = %v, want the second share", got)
+	}
+	if got := s.byToken(second.Token, time.Now()); got != nil {
+		t.Errorf("byToken() of expired share = %v, want nil", got)
+	}
+	if third, _ := s.create("alice", "/c.txt", "", nil); third.ID <= second.ID {
+		t.Errorf("create() id = %v, want one after %v", third.ID, second.ID)
+	}
+	if removed, _ := s.remove("bob", second.ID); removed {
+		t.Error("remove() of share of other user = true, want false")
+	}
+}
+
+func TestOCSShares(t *testing.T) {
+	a := newNextcloudApp(t)
+	a.Config.Shares = &Shares{}
+	a.Shares, _ = NewShareStore(a.Config)
+	os.MkdirAll(filepath.Join(a.Config.Dir, "alice", "docs"), 0700)
+	os.WriteFile(filepath.Join(a.Config.Dir, "alice", "docs", "b c.txt"), []byte("bc"), 0600)
+
+	do := func(method, target string, form url.Values, user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" || password != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+	create := func(form url.Values) map[string]interface{} {
+		w := do("POST", "/cloud"+ocsSharesV2+"?format=json", form, "alice", "password")
+		var resp struct {
+			OCS struct {
+				Data map[string]interface{} `json:"data"`
+			} `json:"ocs"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK {
+			t.Fatalf("create share = %v %s, want %v", w.Code, w.Body.String(), http.StatusOK)
+		}
+		return resp.OCS.Data
+	}
+
+	file := create(url.Values{"path": {"/a.txt"}, "shareType": {"3"}})
+	if file["item_type"] != "file" || !strings.HasPrefix(file["url"].(string), "http://example.com/cloud/s/") {
+		t.Errorf("created share = %v, want a public link of the file", file)
+	}
+	folder := create(url.Values{"path": {"docs"}, "shareType": {"3"}, "password": {"secret"}, "expireDate": {time.Now().AddDate(0, 0, 1).Format("2006-01-02")}})
+	fileLink := "/cloud/s/" + file["token"].(string)
+	folderLink := "/cloud/s/" + folder["token"].(string)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		form     url.Values
+		user     string
+		password string
+		want     int
+		wantBody string
+	}{
+		{"list", "GET", "/cloud" + ocsSharesV2, nil, "alice", "password", http.StatusOK, `"path":"/docs"`},
+		{"list by path", "GET", "/cloud" + ocsSharesV1 + "?path=/a.txt", nil, "alice", "password", http.StatusOK, `"path":"/a.txt"`},
+		{"list of other user", "GET", "/cloud" + ocsSharesV2, nil, "bob", "password", http.StatusOK, `"data":[]`},
+		{"get of other user", "GET", "/cloud" + ocsSharesV2 + "/1", nil, "bob", "password", http.StatusNotFound, ""},
+		{"v1 error", "GET", "/cloud" + ocsSharesV1 + "/9", nil, "alice", "password", http.StatusOK, `"statuscode":404`},
+		{"missing path", "POST", "/cloud" + ocsSharesV2, url.Values{"path": {"/x"}, "shareType": {"3"}}, "alice", "password", http.StatusNotFound, ""},
+		{"user share", "POST", "/cloud" + ocsSharesV2, url.Values{"path": {"/a.txt"}, "shareType": {"0"}}, "alice", "password", http.StatusBadRequest, ""},
+		{"upload link", "POST", "/cloud" + ocsSharesV2, url.Values{"path": {"/docs"}, "shareType": {"3"}, "permissions": {"15"}}, "alice", "password", http.StatusBadRequest, ""},
+		{"root", "POST", "/cloud" + ocsSharesV2, url.Values{"path": {"/"}, "shareType": {"3"}}, "alice", "password", http.StatusForbidden, ""},
+		{"public file", "GET", fileLink, nil, "", "", http.StatusOK, "hello"},
+		{"public upload", "PUT", fileLink, nil, "", "", http.StatusMethodNotAllowed, ""},
+		{"folder without password", "GET", folderLink + "/", nil, "", "", http.StatusUnauthorized, ""},
+		{"folder listing", "GET", folderLink + "/", nil, "", "secret", http.StatusOK, `<a href="b%20c.txt">b c.txt</a>`},
+		{"file of folder", "GET", folderLink + "/b%20c.txt", nil, "", "secret", http.StatusOK, "bc"},
+		{"escape of folder", "GET", folderLink + "/../a.txt", nil, "", "secret", http.StatusNotFound, ""},
+		{"unknown link", "GET", "/cloud/s/unknown", nil, "", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(tt.method, tt.target, tt.form, tt.user, tt.password)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	a.LoginLimiter, _ = NewLoginLimiter(&Config{LoginLimit: &LoginLimit{UserFailures: 2, AddressFailures: 10, Window: time.Minute, Lockout: time.Minute, MaxLockout: time.Minute}})
+	for i := 0; i < 2; i++ {
+		if w := do("GET", folderLink+"/", nil, "", "guess"); w.Code != http.StatusUnauthorized {
+			t.Errorf("wrong password status = %v, want %v", w.Code, http.StatusUnauthorized)
+		}
+	}
+	if w := do("GET", folderLink+"/", nil, "", "secret"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("password after the lockout status = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+	if w := do("GET", fileLink, nil, "", ""); w.Code != http.StatusOK {
+		t.Errorf("link without password after the lockout status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	if w := do("DELETE", "/cloud"+ocsSharesV2+"/"+file["id"].(string), nil, "alice", "password"); w.Code != http.StatusOK {
+		t.Errorf("delete share status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if w := do("GET", fileLink, nil, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of deleted link status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	// links created while no users were configured stop working once there are users
+	ownerless, err := a.Shares.create("", "/alice/a.txt", "", nil)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	if w := do("GET", "/cloud/s/"+ownerless.Token, nil, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of link without owner status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+
+	w := do("GET", "/cloud/ocs/v2.php/cloud/capabilities?format=json", nil, "", "")
+	if !strings.Contains(w.Body.String(), `"files_sharing":{"api_enabled":true`) {
+		t.Errorf("capabilities = %s, want the sharing ones", w.Body.String())
+	}
+}
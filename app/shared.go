@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultSharedFolderName is the name of the shared folder within the root of the users.
+const defaultSharedFolderName = "_shared"
+
+var errSharedReadOnly = errors.New("shared folder is read-only")
+
+// SharedFolder maps Dir as read-only collection Name, _shared by default, into the root of
+// every user, even of users with a subdir, so documents meant for all users don't need to be
+// copied into their subdirs. An entry of the same name within the root of a user is hidden
+// by the shared folder.
+type SharedFolder struct {
+	Dir  string
+	Name string
+}
+
+// name returns the name of the shared folder within the root of the users.
+func (s *SharedFolder) name() string {
+	if s.Name == "" {
+		return defaultSharedFolderName
+	}
+	return s.Name
+}
+
+// validate checks, that the shared folder is a directory and its name a single path element.
+func (s *SharedFolder) validate() error {
+	if s == nil {
+		return nil
+	}
+	if name := s.name(); strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q of the shared folder", name)
+	}
+	fi, err := os.Stat(s.Dir)
+	if err != nil {
+		return fmt.Errorf("can't access shared folder %s: %w", s.Dir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("shared folder %s is not a directory", s.Dir)
+	}
+	return nil
+}
+
+// resolve returns the physical path of a name within the shared folder, ok is false for
+// names outside of it.
+func (s *SharedFolder) resolve(name string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	clean := path.Clean("/" + name)
+	prefix := "/" + s.name()
+	if clean != prefix && !strings.HasPrefix(clean, prefix+"/") {
+		return "", false
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(strings.TrimPrefix(clean, prefix))), true
+}
+
+// contains returns whether the physical path is within the shared folder.
+func (s *SharedFolder) contains(name string) bool {
+	return s != nil && withinDir(name, filepath.Clean(s.Dir))
+}
+
+// checkShared returns errSharedReadOnly for writes within the shared folder.
+func (d Dir) checkShared(ctx context.Context, name string) error {
+	if !d.Config.SharedFolder.contains(name) {
+		return nil
+	}
+	traceStep(ctx, "rejected write of %s within the shared folder", name)
+	rejectionFromContext(ctx).reject(http.StatusForbidden)
+	return errSharedReadOnly
+}
+
+// openSharedRoot wraps the root directory of a user, so its listing contains the shared
+// folder, and the shared folder itself, so it has its name within the root.
+func (d Dir) openSharedRoot(f webdav.File, name string, flag int) webdav.File {
+	shared := d.Config.SharedFolder
+	if shared == nil || flag&writeFlags != 0 {
+		return f
+	}
+	switch path.Clean("/" + name) {
+	case "/":
+		return &sharedRoot{File: f, shared: shared}
+	case "/" + shared.name():
+		return &sharedDir{File: f, name: shared.name()}
+	}
+	return f
+}
+
+// sharedRoot is a root directory listing the shared folder in addition to its members.
+type sharedRoot struct {
+	webdav.File
+	shared *SharedFolder
+	listed bool
+}
+
+func (r *sharedRoot) Readdir(count int) ([]os.FileInfo, error) {
+	children, err := r.File.Readdir(count)
+	if err != nil && err != io.EOF {
+		return children, err
+	}
+	name := r.shared.name()
+	members := children[:0]
+	for _, child := range children {
+		if child.Name() != name {
+			members = append(members, child)
+		}
+	}
+	if !r.listed {
+		r.listed = true
+		if fi, statErr := os.Stat(r.shared.Dir); statErr == nil {
+			members = append(members, sharedFileInfo{FileInfo: fi, name: name})
+			if err == io.EOF {
+				err = nil
+			}
+		}
+	}
+	return members, err
+}
+
+// sharedDir is the opened shared folder, which has its name within the root.
+type sharedDir struct {
+	webdav.File
+	name string
+}
+
+func (d *sharedDir) Stat() (os.FileInfo, error) {
+	fi, err := d.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sharedFileInfo{FileInfo: fi, name: d.name}, nil
+}
+
+// sharedFileInfo is the shared folder with its name within the root of the users.
+type sharedFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (fi sharedFileInfo) Name() string {
+	return fi.name
+}
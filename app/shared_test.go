@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedFolder(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice", "_shared"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "company", "policies"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "alice", "own.txt"), []byte("own"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "company", "policies", "travel.txt"), []byte("travel"), 0600)
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:          filepath.Join(tmpDir, "data"),
+		Realm:        "dave",
+		SharedFolder: &SharedFolder{Dir: filepath.Join(tmpDir, "company")},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	if err := cfg.checkDirs(); err != nil {
+		t.Fatalf("checkDirs() error = %v", err)
+	}
+	a := newQuotaApp(t, cfg)
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("alice", "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	if w := do("GET", "/_shared/policies/travel.txt", ""); w.Code != http.StatusOK || w.Body.String() != "travel" {
+		t.Errorf("GET of shared file = %v %q", w.Code, w.Body)
+	}
+	w := do("PROPFIND", "/", "", "Depth", "1")
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:href>/_shared/</D:href>") ||
+		!strings.Contains(w.Body.String(), "<D:href>/own.txt</D:href>") || strings.Count(w.Body.String(), "/_shared/<") != 1 {
+		t.Errorf("PROPFIND of the root = %v %s", w.Code, w.Body)
+	}
+	if w := do("PROPFIND", "/_shared", "", "Depth", "0"); !strings.Contains(w.Body.String(), "<D:displayname>_shared</D:displayname>") {
+		t.Errorf("PROPFIND of the shared folder = %v %s", w.Code, w.Body)
+	}
+
+	writes := []struct {
+		method, target string
+		header         []string
+	}{
+		{"PUT", "/_shared/new.txt", nil},
+		{"PUT", "/_shared/policies/travel.txt", nil},
+		{"MKCOL", "/_shared/dir", nil},
+		{"DELETE", "/_shared/policies/travel.txt", nil},
+		{"DELETE", "/_shared", nil},
+		{"MOVE", "/_shared/policies/travel.txt", []string{"Destination", "/travel.txt"}},
+		{"MOVE", "/own.txt", []string{"Destination", "/_shared/own.txt"}},
+		{"COPY", "/own.txt", []string{"Destination", "/_shared/own.txt"}},
+	}
+	for _, tt := range writes {
+		if w := do(tt.method, tt.target, "changed", tt.header...); w.Code < 400 {
+			t.Errorf("%s %s status = %v, want an error", tt.method, tt.target, w.Code)
+		}
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "company", "policies", "travel.txt")); string(b) != "travel" {
+		t.Errorf("shared file has been changed to %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "company", "own.txt")); !os.IsNotExist(err) {
+		t.Errorf("file has been moved into the shared folder")
+	}
+
+	if w := do("COPY", "/_shared/policies/travel.txt", "", "Destination", "/travel.txt"); w.Code != http.StatusCreated {
+		t.Errorf("COPY out of the shared folder status = %v, want %v", w.Code, http.StatusCreated)
+	}
+
+	cfg.SharedFolder.Dir = filepath.Join(tmpDir, "missing")
+	if err := cfg.checkDirs(); err == nil {
+		t.Errorf("checkDirs() of a missing shared folder succeeded")
+	}
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// defaultShutdownTimeout is the time the requests in progress have to complete on shutdown,
+// unless Timeout is set.
+const defaultShutdownTimeout = 30 * time.Second
+
+// Shutdown controls the graceful shutdown on SIGTERM and interrupts. The listeners stop
+// accepting connections and the requests in progress have Timeout, 30s by default, to
+// complete, before they're interrupted. Afterwards the usage, the bandwidth totals, the
+// checksums and the WebDAV locks kept in memory are written to their files.
+type Shutdown struct {
+	Timeout time.Duration
+}
+
+// shutdownTimeout returns the time the requests in progress have to complete on shutdown.
+func (cfg *Config) shutdownTimeout() time.Duration {
+	if cfg.Shutdown != nil && cfg.Shutdown.Timeout > 0 {
+		return cfg.Shutdown.Timeout
+	}
+	return defaultShutdownTimeout
+}
+
+// Shutdown stops the servers from accepting connections, waits until the requests in
+// progress completed, at most for the shutdown timeout, and writes the state kept in memory
+// to its files. It returns whether all requests completed.
+func (a *App) Shutdown() bool {
+	timeout := a.Config.shutdownTimeout()
+	log.WithFields(log.Fields{
+		"transfers": len(a.Tracker.Transfers()),
+		"timeout":   timeout,
+	}).Info("Shutting down, waiting for the requests in progress to complete")
+	completed := a.Upgrader.drain(timeout)
+	a.flush()
+	if err := a.Config.Tailscale.Close(); err != nil {
+		log.WithError(err).Warn("Error leaving the tailnet")
+	}
+	return completed
+}
+
+// flush writes the usage, the bandwidth totals and the checksums, which are otherwise written
+// every minute, to their files. The WebDAV locks are written to the lock store or, without
+// one, released.
+func (a *App) flush() {
+	if a.Usage != nil {
+		if err := a.Usage.flush(); err != nil {
+			log.WithField("path", a.Usage.path).WithError(err).Error("Error writing usage file")
+		}
+	}
+	if a.Bandwidth != nil && a.Bandwidth.path != "" {
+		if err := a.Bandwidth.flush(); err != nil {
+			log.WithField("path", a.Bandwidth.path).WithError(err).Error("Error writing bandwidth file")
+		}
+	}
+	if err := a.Integrity.flush(); err != nil {
+		log.WithField("path", a.Integrity.settings.File).WithError(err).Error("Error saving the checksums")
+	}
+	if a.Locks != nil {
+		if released := a.Locks.flush(); released > 0 {
+			log.WithField("locks", released).Warn("Released the WebDAV locks, which are only kept by a lock store")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestShutdown(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		duration  time.Duration
+		completed bool
+	}{
+		{"request completes", 5 * time.Second, 200 * time.Millisecond, true},
+		{"request is interrupted", 100 * time.Millisecond, 5 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(tt.duration):
+				case <-r.Context().Done():
+				}
+				w.Write([]byte("done"))
+			})}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.Serve(ln)
+
+			cfg := &Config{Dir: tmpDir, Shutdown: &Shutdown{Timeout: tt.timeout}, Integrity: &Integrity{File: filepath.Join(tmpDir, tt.name+".json")}, Checksums: &Checksums{}}
+			integrity, _ := NewIntegrityChecker(cfg, nil)
+			fi, _ := os.Stat(tmpDir)
+			integrity.record(tmpDir, fi, nil, nil)
+			a := &App{Config: cfg, Upgrader: &Upgrader{}, Integrity: integrity}
+			a.Upgrader.Track(server)
+
+			responses := make(chan string, 1)
+			go func() {
+				resp, err := http.Get("http://" + ln.Addr().String())
+				if err != nil {
+					responses <- ""
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				responses <- string(body)
+			}()
+			<-started
+
+			if completed := a.Shutdown(); completed != tt.completed {
+				t.Errorf("Shutdown() = %v, want %v", completed, tt.completed)
+			}
+			if got := <-responses; (got == "done") != tt.completed {
+				t.Errorf("response = %q, completed %v", got, tt.completed)
+			}
+			if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+				t.Error("server accepts connections after the shutdown")
+			}
+			if _, err := os.Stat(cfg.Integrity.File); err != nil {
+				t.Errorf("checksums haven't been written: %v", err)
+			}
+		})
+	}
+}
+
+func TestShutdownLocks(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	client := webdav.LockDetails{Root: "/doc.docx", Duration: time.Hour, OwnerXML: "<D:href>alice</D:href>", ZeroDepth: true}
+	temporary := webdav.LockDetails{Root: "/upload.txt", Duration: -1, ZeroDepth: true}
+
+	// the lock store persists the locks of the clients and releases the temporary ones
+	cfg := &Config{Dir: tmpDir, LockStore: &LockStore{File: filepath.Join(tmpDir, "locks.json")}}
+	store, err := NewLockStore(cfg)
+	if err != nil {
+		t.Fatalf("NewLockStore() error = %v", err)
+	}
+	locks := NewLockSystem(store)
+	locks.Create(time.Now(), client)
+	locks.Create(time.Now(), temporary)
+	os.Remove(cfg.LockStore.File)
+	(&App{Config: cfg, Locks: locks}).flush()
+	if got := locks.Locks(); len(got) != 1 || got[0].Root != "/doc.docx" {
+		t.Errorf("Locks() after flush = %+v, want the lock of the client", got)
+	}
+	restored, err := NewLockStore(cfg)
+	if err != nil {
+		t.Fatalf("NewLockStore() error = %v", err)
+	}
+	if got := NewLockSystem(restored).Locks(); len(got) != 1 || got[0].Root != "/doc.docx" {
+		t.Errorf("restored locks = %+v, want the lock of the client", got)
+	}
+
+	// without a lock store, all locks are released
+	locks = NewLockSystem(webdav.NewMemLS())
+	locks.Create(time.Now(), client)
+	locks.Create(time.Now(), temporary)
+	if released := locks.flush(); released != 1 {
+		t.Errorf("flush() = %d, want 1 released lock of a client", released)
+	}
+	if got := locks.Locks(); len(got) != 0 {
+		t.Errorf("Locks() after flush = %+v, want none", got)
+	}
+	if _, err := locks.Create(time.Now(), client); err != nil {
+		t.Errorf("Create() of a released lock error = %v", err)
+	}
+}
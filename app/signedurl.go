@@ -0,0 +1,184 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Settings of the signed URLs
+const (
+	defaultSignedURLTTL    = 24 * time.Hour
+	defaultSignedURLMaxTTL = 7 * 24 * time.Hour
+)
+
+// SignedURLs enables temporary URLs of single files, which are fetched without credentials,
+// e.g. by third parties or from a link in an email. A user signs the URL of a file with a GET
+// of the file with the query ?sign or ?sign=DURATION, the URL expires after the duration or
+// TTL, but at most after MaxTTL.
+type SignedURLs struct {
+	// Secret signs the URLs. Without a secret, a random one is used, so URLs become invalid
+	// with a restart.
+	Secret string
+	TTL    time.Duration
+	MaxTTL time.Duration
+
+	once sync.Once
+	key  []byte
+}
+
+// signingKey returns the key of the URLs.
+func (su *SignedURLs) signingKey() []byte {
+	su.once.Do(func() {
+		if su.Secret != "" {
+			su.key = []byte(su.Secret)
+			return
+		}
+		su.key = make([]byte, 32)
+		if _, err := rand.Read(su.key); err != nil {
+			log.WithError(err).Fatal("Error creating the key of the signed URLs")
+		}
+	})
+	return su.key
+}
+
+// sign returns the signature of the URL of a path of the user, which expires at the unix time.
+func (su *SignedURLs) sign(user, name string, expires int64) string {
+	mac := hmac.New(sha256.New, su.signingKey())
+	mac.Write([]byte(user + "\n" + name + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns whether the query of a URL of the path is signed and hasn't expired. It
+// returns the user, who signed the URL.
+func (su *SignedURLs) verify(name string, query url.Values, now time.Time) (string, bool) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return "", false
+	}
+	user := query.Get("user")
+	return user, hmac.Equal([]byte(query.Get("signature")), []byte(su.sign(user, name, expires)))
+}
+
+// ttl returns the validity of a URL requested by the value of the sign query.
+func (su *SignedURLs) ttl(value string) (time.Duration, bool) {
+	ttl, maxTTL := su.TTL, su.MaxTTL
+	if ttl <= 0 {
+		ttl = defaultSignedURLTTL
+	}
+	if maxTTL <= 0 {
+		maxTTL = defaultSignedURLMaxTTL
+	}
+	if value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 {
+			return 0, false
+		}
+	}
+	return ttl, ttl <= maxTTL
+}
+
+// serveSignURL answers a GET of a file with the query sign by a signed URL of the file. The
+// user has to be able to read the file. It returns whether the request has been handled.
+func (a *App) serveSignURL(w http.ResponseWriter, r *http.Request) bool {
+	su := a.Config.SignedURLs
+	if su == nil || r.Method != http.MethodGet || !r.URL.Query().Has("sign") {
+		return false
+	}
+	ttl, ok := su.ttl(r.URL.Query().Get("sign"))
+	if !ok {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	ctx := r.Context()
+	p, ok := a.relativePath(r)
+	if !ok {
+		http.NotFound(w, r)
+		return true
+	}
+	name := path.Clean(p)
+	f, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil || fi.IsDir() {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	var user string
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		user = authInfo.Username
+	}
+	expires := time.Now().Add(ttl)
+	query := url.Values{"expires": {strconv.FormatInt(expires.Unix(), 10)}}
+	if user != "" {
+		query.Set("user", user)
+	}
+	query.Set("signature", su.sign(user, name, expires.Unix()))
+	traceStep(ctx, "signed URL of %s until %s", name, expires.Format(time.RFC3339))
+	log.WithFields(log.Fields{"path": name, "user": user, "expires": expires.Format(time.RFC3339)}).Info("Signed URL of file")
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"url":     a.baseURL(r) + (&url.URL{Path: name}).EscapedPath() + "?" + query.Encode(),
+		"expires": expires.UTC().Format(time.RFC3339),
+	})
+	return true
+}
+
+// serveSignedURL serves the file of a signed URL, which is reached without login. The file is
+// served as seen by the user who signed the URL, so the URL stops working once the user has
+// been removed or lost access to the file. It returns whether the request has been handled.
+func (a *App) serveSignedURL(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	su := a.Config.SignedURLs
+	if su == nil || r.URL.Query().Get("signature") == "" {
+		return false
+	}
+	p, ok := a.relativePath(r)
+	if !ok {
+		return false
+	}
+	name := path.Clean(p)
+
+	user, ok := su.verify(name, r.URL.Query(), time.Now())
+	if !ok || (user == "" && a.Config.AuthenticationNeeded()) {
+		traceStep(ctx, "invalid or expired signed URL")
+		a.Config.writeError(w, r, http.StatusForbidden)
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		a.Config.writeError(w, r, http.StatusMethodNotAllowed)
+		return true
+	}
+
+	traceStep(ctx, "serving signed URL of user %s for %s", user, name)
+	a.serveAs(ctx, w, r, user, func(w http.ResponseWriter, r *http.Request) {
+		f, err := a.Handler.FileSystem.OpenFile(r.Context(), name, os.O_RDONLY, 0)
+		if err != nil {
+			a.Config.writeError(w, r, http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil || fi.IsDir() {
+			a.Config.writeError(w, r, http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	})
+	return true
+}
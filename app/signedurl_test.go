@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignedURLs(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice", "docs"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "docs", "report 1.pdf"), []byte("report"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "other.txt"), []byte("other"), 0600)
+
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:        tmpDir,
+		Realm:      "dave",
+		SignedURLs: &SignedURLs{Secret: "secret", MaxTTL: 48 * time.Hour},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+	do := func(target string, login bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if login {
+			req.SetBasicAuth("alice", "password")
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+	sign := func(target string) *url.URL {
+		w := do(target, true)
+		if w.Code != http.StatusOK {
+			t.Fatalf("signing %s status = %v, want %v", target, w.Code, http.StatusOK)
+		}
+		var res map[string]string
+		json.Unmarshal(w.Body.Bytes(), &res)
+		u, err := url.Parse(res["url"])
+		if err != nil {
+			t.Fatalf("signed URL %s error = %v", res["url"], err)
+		}
+		return u
+	}
+
+	signed := sign("/docs/report%201.pdf?sign=1h")
+	if w := do(signed.RequestURI(), false); w.Code != http.StatusOK || w.Body.String() != "report" {
+		t.Errorf("GET of signed URL = %v %q, want %v %q", w.Code, w.Body.String(), http.StatusOK, "report")
+	}
+
+	tampered := *signed
+	tampered.Path = "/other.txt"
+	expired := *signed
+	query := expired.Query()
+	past := time.Now().Add(-time.Minute).Unix()
+	query.Set("expires", strconv.FormatInt(past, 10))
+	query.Set("signature", cfg.SignedURLs.sign("alice", "/docs/report 1.pdf", past))
+	expired.RawQuery = query.Encode()
+	anonymous := *signed
+	query = anonymous.Query()
+	query.Del("user")
+	query.Set("signature", cfg.SignedURLs.sign("", "/docs/report 1.pdf", time.Now().Add(time.Hour).Unix()))
+	anonymous.RawQuery = query.Encode()
+
+	tests := []struct {
+		name   string
+		target string
+		login  bool
+		want   int
+	}{
+		{"tampered path", tampered.RequestURI(), false, http.StatusForbidden},
+		{"expired", expired.RequestURI(), false, http.StatusForbidden},
+		{"without user", anonymous.RequestURI(), false, http.StatusForbidden},
+		{"default ttl", "/other.txt?sign", true, http.StatusOK},
+		{"ttl beyond maximum", "/other.txt?sign=72h", true, http.StatusBadRequest},
+		{"invalid ttl", "/other.txt?sign=tomorrow", true, http.StatusBadRequest},
+		{"directory", "/docs?sign=1h", true, http.StatusBadRequest},
+		{"missing file", "/missing.txt?sign=1h", true, http.StatusNotFound},
+		{"without login", "/other.txt?sign=1h", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(tt.target, tt.login); w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+
+	cfg.RemoveUser("alice")
+	cfg.SetUser("bob", &UserInfo{Password: GenHash([]byte("password"))})
+	if w := do(signed.RequestURI(), false); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET of signed URL of removed user status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
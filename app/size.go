@@ -0,0 +1,69 @@
+package app
+
+import (
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is an amount of bytes, which can be configured in a human readable form like 10GB.
+// The units are powers of 1024.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"PIB", 1 << 50}, {"TIB", 1 << 40}, {"GIB", 1 << 30}, {"MIB", 1 << 20}, {"KIB", 1 << 10},
+	{"PB", 1 << 50}, {"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"P", 1 << 50}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize parses sizes like 512, 100MB, 1.5 GiB or 2T.
+func ParseByteSize(s string) (ByteSize, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			factor = u.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return ByteSize(n * float64(factor)), nil
+}
+
+// String formats the size with the largest fitting unit.
+func (b ByteSize) String() string {
+	units := []string{"PB", "TB", "GB", "MB", "KB"}
+	for i, unit := range units {
+		factor := int64(1) << uint(10*(len(units)-i))
+		if int64(b) >= factor {
+			return strconv.FormatFloat(float64(b)/float64(factor), 'f', -1, 64) + unit
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// byteSizeHook decodes human readable sizes of the configuration into ByteSize values.
+func byteSizeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(ByteSize(0)) || from.Kind() != reflect.String {
+		return data, nil
+	}
+	return ParseByteSize(data.(string))
+}
+
+// decodeHook is the decode hook for the configuration, the defaults of viper plus sizes.
+var decodeHook = mapstructure.ComposeDecodeHookFunc(
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+	byteSizeHook,
+)
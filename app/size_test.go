@@ -0,0 +1,85 @@
+package app
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ByteSize
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"1K", 1 << 10, false},
+		{"100MB", 100 << 20, false},
+		{"1.5 GiB", 3 << 29, false},
+		{"10gb", 10 << 30, false},
+		{"2T", 2 << 40, false},
+		{"", 0, true},
+		{"GB", 0, true},
+		{"-1GB", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseByteSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseByteSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseByteSize() = %v, want %v", int64(got), int64(tt.want))
+			}
+		})
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	tests := []struct {
+		in   ByteSize
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1 << 10, "1KB"},
+		{3 << 29, "1.5GB"},
+		{10 << 40, "10TB"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.in.String(); got != tt.want {
+				t.Errorf("ByteSize.String() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestByteSizeDecode(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want ByteSize
+	}{
+		{"quota:\n  limit: 10GB\n", 10 << 30},
+		{"quota:\n  limit: 4096\n", 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			v := viper.New()
+			v.SetConfigType("yaml")
+			if err := v.ReadConfig(strings.NewReader(tt.yaml)); err != nil {
+				t.Fatal(err)
+			}
+			cfg := &Config{}
+			if err := unmarshalConfig(v, cfg, true); err != nil {
+				t.Fatalf("unmarshalConfig() error = %v", err)
+			}
+			if cfg.Quota == nil || cfg.Quota.Limit != tt.want {
+				t.Errorf("unmarshalConfig() quota = %v, want %v", cfg.Quota, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Version is the version of dave. It's set at build time with
+// -ldflags "-X github.com/micromata/dave/app.Version=0.4.0", otherwise the version of the
+// module is reported.
+var Version string
+
+// icapHealthTimeout limits the connection attempt of the health check of the ICAP server.
+const icapHealthTimeout = 2 * time.Second
+
+// serverStatus is the status of the server reported by the status endpoint.
+type serverStatus struct {
+	Status      string         `json:"status"`
+	Version     string         `json:"version"`
+	Commit      string         `json:"commit,omitempty"`
+	BuildTime   string         `json:"buildTime,omitempty"`
+	Modified    bool           `json:"modified,omitempty"`
+	GoVersion   string         `json:"goVersion"`
+	Started     time.Time      `json:"started"`
+	Uptime      string         `json:"uptime"`
+	Connections int64          `json:"connections"`
+	Transfers   int            `json:"transfers"`
+	Sessions    int            `json:"sessions"`
+	ReadOnly    bool           `json:"readOnly"`
+	Maintenance bool           `json:"maintenance"`
+	Health      []healthStatus `json:"health"`
+}
+
+// healthStatus is the result of the health check of a backend.
+type healthStatus struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// buildInfo returns the version, the commit, the commit time and whether the tree was
+// modified of the running binary.
+func buildInfo() (version, commit, buildTime string, modified bool) {
+	version = Version
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		if version == "" {
+			version = "unknown"
+		}
+		return version, "", "", false
+	}
+	if version == "" {
+		version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			commit = setting.Value
+		case "vcs.time":
+			buildTime = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	return version, commit, buildTime, modified
+}
+
+// health checks the backends the server depends on: the directory and, if configured, the
+// ICAP server.
+func (a *App) health() []healthStatus {
+	storage := healthStatus{Name: "storage", OK: true}
+	if fi, err := os.Stat(a.Config.Dir); err != nil {
+		storage.OK, storage.Error = false, err.Error()
+	} else if !fi.IsDir() {
+		storage.OK, storage.Error = false, fmt.Sprintf("%s is not a directory", a.Config.Dir)
+	} else if free, _, err := DiskUsage(a.Config.Dir); err == nil && free == 0 {
+		storage.OK, storage.Error = false, "no space left"
+	}
+	checks := []healthStatus{storage}
+
+	if a.Config.ICAP != nil {
+		icap := healthStatus{Name: "icap", OK: true}
+		if err := checkICAP(a.Config.ICAP.URL); err != nil {
+			icap.OK, icap.Error = false, err.Error()
+		}
+		checks = append(checks, icap)
+	}
+	return checks
+}
+
+// checkICAP returns whether the ICAP server of the URL accepts connections.
+func checkICAP(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	conn, err := net.DialTimeout("tcp", host, icapHealthTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// handleAdminStatus reports the version, the uptime, the connections and the health of the
+// backends. It answers by 503 Service Unavailable, if a backend is unhealthy.
+func (a *App) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s := serverStatus{
+		Status:      "ok",
+		GoVersion:   runtime.Version(),
+		Connections: a.Tracker.Connections(),
+		Transfers:   len(a.Tracker.Transfers()),
+		Sessions:    len(a.Tracker.Sessions()),
+		ReadOnly:    a.Config.ReadOnly(),
+		Maintenance: a.Config.maintenanceMode() != nil,
+		Health:      a.health(),
+	}
+	s.Version, s.Commit, s.BuildTime, s.Modified = buildInfo()
+	if a.Tracker != nil {
+		s.Started = a.Tracker.started
+		s.Uptime = time.Since(a.Tracker.started).Round(time.Second).String()
+	}
+
+	status := http.StatusOK
+	for _, h := range s.Health {
+		if !h.OK {
+			s.Status, status = "unhealthy", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, s)
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAdminStatus(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{
+		Dir: tmpDir,
+		Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}},
+	}
+	a := newQuotaApp(t, cfg)
+	a.Tracker = NewTracker()
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	a.Tracker.ConnState(server, http.StateNew)
+	a.Tracker.ConnState(client, http.StateNew)
+	a.Tracker.ConnState(client, http.StateClosed)
+	cfg.SetReadOnly(true)
+	admin := NewAdminHandler(a)
+	status := func() (int, serverStatus) {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.SetBasicAuth("root", "secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		var s serverStatus
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return w.Code, s
+	}
+
+	code, s := status()
+	if code != http.StatusOK || s.Status != "ok" {
+		t.Errorf("status = %v %q, want %v ok", code, s.Status, http.StatusOK)
+	}
+	if s.Version == "" || s.GoVersion == "" || s.Uptime == "" {
+		t.Errorf("version %q, Go version %q or uptime %q missing", s.Version, s.GoVersion, s.Uptime)
+	}
+	if s.Connections != 1 || !s.ReadOnly || s.Maintenance {
+		t.Errorf("connections %v, read-only %v, maintenance %v, want 1, true, false", s.Connections, s.ReadOnly, s.Maintenance)
+	}
+	if len(s.Health) != 1 || s.Health[0].Name != "storage" || !s.Health[0].OK {
+		t.Errorf("health = %+v, want a healthy storage", s.Health)
+	}
+
+	// a port nobody listens on
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+	cfg.ICAP = &ICAP{URL: "icap://" + ln.Addr().String() + "/avscan"}
+	os.RemoveAll(tmpDir)
+	code, s = status()
+	if code != http.StatusServiceUnavailable || s.Status != "unhealthy" {
+		t.Errorf("status = %v %q, want %v unhealthy", code, s.Status, http.StatusServiceUnavailable)
+	}
+	if len(s.Health) != 2 || s.Health[0].OK || s.Health[1].Name != "icap" || s.Health[1].OK {
+		t.Errorf("health = %+v, want an unhealthy storage and ICAP server", s.Health)
+	}
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status without credentials = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
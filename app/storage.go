@@ -0,0 +1,74 @@
+package app
+
+import (
+	"golang.org/x/net/webdav"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// storage keeps the files of the directory. The names are the physical paths Dir resolves, so
+// the features of the directory, like quotas, the trash or versions, work the same on each
+// storage. The local file system is the default, the object store keeps the files below the
+// base directory in its bucket instead.
+type storage interface {
+	OpenFile(name string, flag int, perm os.FileMode) (webdav.File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	// ReadDir returns the members of the directory sorted by their names.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// Walk walks the tree of root like filepath.Walk.
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+// storage returns the storage of the files, the object store, if one is configured, or the
+// local file system. An invalid object store is rejected when the configuration is read.
+func (cfg *Config) storage() storage {
+	if cfg.ObjectStore == nil {
+		return localStorage{}
+	}
+	cfg.filesOnce.Do(func() {
+		cfg.files = localStorage{}
+		if s, err := newObjectStorage(cfg); err == nil {
+			cfg.files = s
+		}
+	})
+	return cfg.files
+}
+
+// localStorage is the local file system.
+type localStorage struct{}
+
+func (localStorage) OpenFile(name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (localStorage) Stat(name string) (os.FileInfo, error)  { return os.Stat(name) }
+func (localStorage) Lstat(name string) (os.FileInfo, error) { return os.Lstat(name) }
+
+func (localStorage) Mkdir(name string, perm os.FileMode) error    { return os.Mkdir(name, perm) }
+func (localStorage) MkdirAll(name string, perm os.FileMode) error { return os.MkdirAll(name, perm) }
+func (localStorage) Remove(name string) error                     { return os.Remove(name) }
+func (localStorage) RemoveAll(name string) error                  { return os.RemoveAll(name) }
+func (localStorage) Rename(oldName, newName string) error         { return os.Rename(oldName, newName) }
+func (localStorage) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+
+func (localStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (localStorage) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+
+func (localStorage) Walk(root string, fn filepath.WalkFunc) error { return filepath.Walk(root, fn) }
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// userExportVersion is the current version of the user export format.
+const userExportVersion = 1
+
+// UserExport is the portable representation of a set of users, including their password
+// hashes, which is used to move users between instances.
+type UserExport struct {
+	Version  int                  `json:"version"`
+	Exported time.Time            `json:"exported"`
+	Users    map[string]*UserInfo `json:"users"`
+}
+
+// ExportUsers writes the users as JSON to w.
+func ExportUsers(w io.Writer, users map[string]*UserInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&UserExport{
+		Version:  userExportVersion,
+		Exported: time.Now().UTC(),
+		Users:    users,
+	})
+}
+
+// ImportUsers reads and validates users which were written by ExportUsers.
+func ImportUsers(r io.Reader) (map[string]*UserInfo, error) {
+	var export UserExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("invalid user export: %s", err)
+	}
+	if export.Version != userExportVersion {
+		return nil, fmt.Errorf("unsupported user export version %d", export.Version)
+	}
+
+	users := make(map[string]*UserInfo, len(export.Users))
+	for name, user := range export.Users {
+		if user == nil || !ValidHash(user.Password) {
+			return nil, fmt.Errorf("user %s has no valid password hash", name)
+		}
+		if user.Subdir != nil && strings.Contains(*user.Subdir, "..") {
+			return nil, fmt.Errorf("subdir of user %s must not contain '..'", name)
+		}
+		users[strings.ToLower(name)] = user
+	}
+
+	return users, nil
+}
+
+// SaveUsers writes the given users into the users section of the YAML configuration file
+// at path. Everything else of the file, including comments, is kept untouched.
+func SaveUsers(path string, users map[string]*UserInfo) error {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+		return fmt.Errorf("users can only be saved to yaml configuration files, got %s", path)
+	}
+	return editConfigFile(path, func(root *yaml.Node) error {
+		var usersNode yaml.Node
+		if err := usersNode.Encode(users); err != nil {
+			return err
+		}
+		setMappingValue(root, "users", &usersNode)
+		return nil
+	})
+}
+
+// saveSettings writes the values into the YAML configuration file at path. The keys are the
+// dot separated path of the nested mappings to the value, missing mappings are created.
+// Everything else of the file, including comments, is kept untouched.
+func saveSettings(path string, values map[string]interface{}) error {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".yaml" && ext != ".yml" {
+		return fmt.Errorf("settings can only be saved to yaml configuration files, got %s", path)
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return editConfigFile(path, func(root *yaml.Node) error {
+		for _, key := range keys {
+			var valueNode yaml.Node
+			if err := valueNode.Encode(values[key]); err != nil {
+				return err
+			}
+			mapping := root
+			names := strings.Split(key, ".")
+			for _, name := range names[:len(names)-1] {
+				mapping = mappingValue(mapping, name)
+			}
+			setMappingValue(mapping, names[len(names)-1], &valueNode)
+		}
+		return nil
+	})
+}
+
+// editConfigFile edits the root mapping of the YAML configuration file at path and writes
+// the file back.
+func editConfigFile(path string, edit func(root *yaml.Node) error) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		// empty file
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("unexpected structure of configuration file %s", path)
+	}
+	if err := edit(doc.Content[0]); err != nil {
+		return err
+	}
+	// the configuration may have been edited since it has been loaded
+	if err := BackupConfig(path, 0); err != nil {
+		log.WithField("path", path).WithError(err).Warn("Error backing up configuration")
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, buf.Bytes())
+}
+
+// mappingValue returns the mapping of the given key of a mapping node. A missing key or a
+// value, which isn't a mapping, is replaced by an empty mapping.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) && mapping.Content[i+1].Kind == yaml.MappingNode {
+			return mapping.Content[i+1]
+		}
+	}
+
+	value := &yaml.Node{Kind: yaml.MappingNode}
+	setMappingValue(mapping, key, value)
+	return value
+}
+
+// setMappingValue replaces the value of the given key of a mapping node or appends the key,
+// if it doesn't exist. Keys are compared case insensitive like viper does.
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if strings.EqualFold(mapping.Content[i].Value, key) {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+}
+
+// writeFileAtomic writes the data to a temporary file next to path and renames it afterwards,
+// so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	perm := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
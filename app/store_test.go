@@ -0,0 +1,132 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveUsers(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "/bar"
+	users := map[string]*UserInfo{
+		"foo": {Password: "hash1"},
+		"bar": {Password: "hash2", Subdir: &subdir},
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		contains []string
+		wantErr  bool
+	}{
+		{
+			"replace users",
+			"config.yaml",
+			"# the bind address\naddress: 1.2.3.4\nusers:\n  old:\n    password: x\n",
+			[]string{"# the bind address", "address: 1.2.3.4", "foo:", "password: hash1", "subdir: /bar"},
+			false,
+		},
+		{
+			"append users",
+			"config.yml",
+			"address: 1.2.3.4\n",
+			[]string{"address: 1.2.3.4", "users:", "bar:"},
+			false,
+		},
+		{
+			"empty file",
+			"empty.yaml",
+			"",
+			[]string{"users:", "foo:"},
+			false,
+		},
+		{
+			"no yaml",
+			"config.json",
+			"{}",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("SaveUsers() pre condition failed. error = %v", err)
+			}
+
+			if err := SaveUsers(path, users); (err != nil) != tt.wantErr {
+				t.Errorf("SaveUsers() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			got, _ := ioutil.ReadFile(path)
+			if strings.Contains(string(got), "old:") {
+				t.Errorf("SaveUsers() kept removed user. content = %s", got)
+			}
+			for _, c := range tt.contains {
+				if !strings.Contains(string(got), c) {
+					t.Errorf("SaveUsers() content = %s, want it to contain %s", got, c)
+				}
+			}
+		})
+	}
+}
+
+func TestExportImportUsers(t *testing.T) {
+	subdir := "/bar"
+	users := map[string]*UserInfo{
+		"foo": {Password: GenHash([]byte("password"))},
+		"bar": {Password: GenHash([]byte("password")), Subdir: &subdir},
+	}
+
+	var buf bytes.Buffer
+	if err := ExportUsers(&buf, users); err != nil {
+		t.Fatalf("ExportUsers() error = %v", err)
+	}
+
+	got, err := ImportUsers(&buf)
+	if err != nil {
+		t.Fatalf("ImportUsers() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, users) {
+		t.Errorf("ImportUsers() = %v, want %v", got, users)
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `{"version":1,"users":{"Foo":{"password":"$2a$10$yITzSSNJZAdDZs8iVBQzkuZCzZ49PyjTiPIrmBUKUpB0pwX7eySvW"}}}`, false},
+		{"unknown version", `{"version":2,"users":{}}`, true},
+		{"invalid hash", `{"version":1,"users":{"foo":{"password":"plain"}}}`, true},
+		{"escaping subdir", `{"version":1,"users":{"foo":{"password":"$2a$10$yITzSSNJZAdDZs8iVBQzkuZCzZ49PyjTiPIrmBUKUpB0pwX7eySvW","subdir":"../x"}}}`, true},
+		{"no json", `users: {}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ImportUsers(strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ImportUsers() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got["foo"] == nil {
+				t.Errorf("ImportUsers() = %v, want lower cased user foo", got)
+			}
+		})
+	}
+}
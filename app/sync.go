@@ -0,0 +1,389 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSyncRetention is the number of changes kept in the journal of the sync tokens.
+const defaultSyncRetention = 100000
+
+// syncTokenPrefix is the prefix of the sync tokens, which are URIs by RFC 6578.
+const syncTokenPrefix = "urn:dave:sync:"
+
+// Sync enables the sync-collection report of RFC 6578, which lists the changes of a
+// collection since a sync token. The changes are journaled in File, so the tokens stay valid
+// across restarts. Only the latest Retention changes are kept, clients with older tokens
+// have to sync the whole collection again.
+type Sync struct {
+	File      string
+	Retention int
+}
+
+// SyncLog is the journal of the paths changed by the file operations. Each change gets the
+// next sequence number, the current one is the sync token. The epoch identifies the journal,
+// so tokens of a lost journal are rejected. A nil SyncLog is valid and records nothing.
+type SyncLog struct {
+	path      string
+	retention int
+
+	mu      sync.Mutex
+	epoch   int64
+	seq     int64
+	entries []syncEntry
+	file    *os.File
+}
+
+// syncEntry is a single change of the journal. For tree entries, all paths below the
+// changed one are changed as well, e.g. the destination of a moved directory.
+type syncEntry struct {
+	Seq  int64  `json:"seq"`
+	Path string `json:"path"`
+	Tree bool   `json:"tree,omitempty"`
+}
+
+// syncHeader is the first line of the journal file.
+type syncHeader struct {
+	Epoch int64 `json:"epoch"`
+}
+
+// NewSyncLog opens the journal of the configuration and continues its changes. Without a
+// file, the journal is only kept in memory. It returns nil, if the sync-collection report
+// isn't configured.
+func NewSyncLog(cfg *Config) (*SyncLog, error) {
+	if cfg.Sync == nil {
+		return nil, nil
+	}
+
+	l := &SyncLog{path: cfg.Sync.File, retention: cfg.Sync.Retention, epoch: time.Now().UnixNano()}
+	if l.retention <= 0 {
+		l.retention = defaultSyncRetention
+	}
+	if l.path == "" {
+		return l, nil
+	}
+
+	err := l.read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// the journal is rewritten once, so it starts with the retained changes only
+	if err := l.rewrite(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// read loads the changes of the journal file.
+func (l *SyncLog) read() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return scanner.Err()
+	}
+	var header syncHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Epoch == 0 {
+		return fmt.Errorf("invalid sync journal %s", l.path)
+	}
+	l.epoch = header.Epoch
+	for scanner.Scan() {
+		var e syncEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line might be incomplete after a crash
+			log.WithField("path", l.path).WithError(err).Warn("Skipped invalid entry of sync journal")
+			continue
+		}
+		if e.Seq <= l.seq {
+			continue
+		}
+		l.seq = e.Seq
+		l.entries = append(l.entries, e)
+	}
+	if len(l.entries) > l.retention {
+		l.entries = append([]syncEntry(nil), l.entries[len(l.entries)-l.retention:]...)
+	}
+	return scanner.Err()
+}
+
+// rewrite replaces the journal file by the retained changes and keeps it open for appending.
+// l.mu must be held, if the journal is in use.
+func (l *SyncLog) rewrite() error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	enc.Encode(syncHeader{Epoch: l.epoch})
+	for _, e := range l.entries {
+		enc.Encode(e)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// record appends a change of the physical path to the journal.
+func (l *SyncLog) record(name string, tree bool) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	e := syncEntry{Seq: l.seq, Path: name, Tree: tree}
+	l.entries = append(l.entries, e)
+	if len(l.entries) >= 2*l.retention {
+		l.entries = append([]syncEntry(nil), l.entries[l.retention:]...)
+		if l.file != nil {
+			if err := l.rewrite(); err != nil {
+				log.WithField("path", l.path).WithError(err).Error("Error rewriting sync journal")
+			}
+		}
+		return
+	}
+	if l.file == nil {
+		return
+	}
+	data, _ := json.Marshal(e)
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		log.WithField("path", l.path).WithError(err).Error("Error writing sync journal")
+	}
+}
+
+// token returns the current sync token.
+func (l *SyncLog) token() string {
+	return l.tokenOf(l.current())
+}
+
+// current returns the sequence number of the latest change.
+func (l *SyncLog) current() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+func (l *SyncLog) tokenOf(seq int64) string {
+	return syncTokenPrefix + strconv.FormatInt(l.epoch, 10) + ":" + strconv.FormatInt(seq, 10)
+}
+
+// parseToken returns the sequence number of a token. ok is false, if the token isn't one of
+// this journal or so old that its changes aren't retained anymore.
+func (l *SyncLog) parseToken(token string) (int64, bool) {
+	parts := strings.Split(strings.TrimPrefix(token, syncTokenPrefix), ":")
+	if !strings.HasPrefix(token, syncTokenPrefix) || len(parts) != 2 {
+		return 0, false
+	}
+	epoch, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	oldest := l.seq
+	if len(l.entries) > 0 {
+		oldest = l.entries[0].Seq - 1
+	}
+	return seq, epoch == l.epoch && seq >= oldest && seq <= l.seq
+}
+
+// changes returns the changes after the sequence number, which are within the physical
+// directory, and the current sequence number.
+func (l *SyncLog) changes(since int64, dir string) ([]syncEntry, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var changes []syncEntry
+	for _, e := range l.entries {
+		if e.Seq > since && withinDir(e.Path, dir) {
+			changes = append(changes, e)
+		}
+	}
+	return changes, l.seq
+}
+
+// Close closes the journal file.
+func (l *SyncLog) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// openSyncFile wraps a file opened by the file system, so written files are recorded when
+// they're closed and directories report the sync token as property.
+func (l *SyncLog) openSyncFile(f webdav.File, name string, flag int) webdav.File {
+	if l == nil {
+		return f
+	}
+	if flag&writeFlags != 0 {
+		return &syncFile{File: f, log: l, name: name}
+	}
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return &syncDir{File: f, log: l}
+	}
+	return f
+}
+
+// syncFile records the change of a written file when it's closed, so the change isn't
+// reported before its content is complete.
+type syncFile struct {
+	webdav.File
+	log  *SyncLog
+	name string
+}
+
+func (f *syncFile) Close() error {
+	err := f.File.Close()
+	f.log.record(f.name, false)
+	return err
+}
+
+// syncDir adds the DAV:sync-token property to the dead properties of directories, so clients
+// learn the support of the sync-collection report. It's served as dead property, because the
+// properties of the webdav package can't be extended otherwise.
+type syncDir struct {
+	webdav.File
+	log *SyncLog
+}
+
+var syncTokenName = xml.Name{Space: "DAV:", Local: "sync-token"}
+
+// DeadProps returns the sync token and the dead properties of the directory.
+func (d *syncDir) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := map[xml.Name]webdav.Property{}
+	if holder, ok := d.File.(webdav.DeadPropsHolder); ok {
+		inner, err := holder.DeadProps()
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range inner {
+			props[name] = p
+		}
+	}
+	var token strings.Builder
+	xml.EscapeText(&token, []byte(d.log.token()))
+	props[syncTokenName] = webdav.Property{XMLName: syncTokenName, InnerXML: []byte(token.String())}
+	return props, nil
+}
+
+// Patch changes the dead properties of the directory, if it has any, and rejects all changes
+// like for directories without sync token otherwise.
+func (d *syncDir) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if holder, ok := d.File.(webdav.DeadPropsHolder); ok {
+		return holder.Patch(patches)
+	}
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+	return []webdav.Propstat{pstat}, nil
+}
+
+// syncMembers returns the physical paths of the members of dir, which are reported for the
+// changes of the storage. At depth 1 these are the members of dir containing the changes. At infinite depth
+// these are the changed paths, their parents, because their modification time changed, and
+// all paths below tree changes. With a limit, only the members of the first changes within
+// the limit are returned, n is the number of these changes.
+func syncMembers(files storage, changes []syncEntry, dir string, infinite bool, limit int) (members []string, n int) {
+	seen := map[string]bool{}
+	prefix := strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+	for i, e := range changes {
+		var names []string
+		switch {
+		case e.Path == dir:
+			// the collection itself has been replaced
+			if e.Tree {
+				names = treeMembers(files, dir, infinite)
+			}
+		case !infinite:
+			rel := strings.TrimPrefix(e.Path, prefix)
+			names = []string{prefix + strings.SplitN(rel, string(filepath.Separator), 2)[0]}
+		default:
+			names = []string{filepath.Dir(e.Path), e.Path}
+			if e.Tree {
+				names = append(names, treeMembers(files, e.Path, true)...)
+			}
+		}
+
+		var added []string
+		for _, name := range names {
+			if name != dir && strings.HasPrefix(name, prefix) && !seen[name] {
+				seen[name] = true
+				added = append(added, name)
+			}
+		}
+		if limit > 0 && len(members)+len(added) > limit {
+			return members, i
+		}
+		members = append(members, added...)
+	}
+	return members, len(changes)
+}
+
+// treeMembers returns the paths below the physical directory of the storage, at depth 1 only
+// its members.
+func treeMembers(files storage, dir string, infinite bool) []string {
+	var names []string
+	if !infinite {
+		children, _ := files.ReadDir(dir)
+		for _, child := range children {
+			names = append(names, filepath.Join(dir, child.Name()))
+		}
+		return names
+	}
+
+	files.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err == nil && name != dir {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names
+}
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// syncCollection is the body of a sync-collection report. The namespace declarations are
+// kept to pass the requested properties on to a PROPFIND.
+type syncCollection struct {
+	XMLName   xml.Name
+	Attrs     []xml.Attr `xml:",any,attr"`
+	SyncToken string     `xml:"DAV: sync-token"`
+	SyncLevel string     `xml:"DAV: sync-level"`
+	Limit     *struct {
+		NResults int `xml:"DAV: nresults"`
+	} `xml:"DAV: limit"`
+	Prop *struct {
+		Attrs []xml.Attr `xml:",any,attr"`
+		Inner []byte     `xml:",innerxml"`
+	} `xml:"DAV: prop"`
+}
+
+// davHandler wraps a WebDAV handler, so it answers sync-collection reports, if the journal of
+// the changes is enabled, searches, if the search index is enabled, and reports the principal
+// of the user to PROPFINDs asking for it.
+func (a *App) davHandler(h *webdav.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "REPORT" && a.Sync != nil:
+			a.serveSyncCollection(w, r, h)
+		case r.Method == "SEARCH" && a.Search != nil:
+			a.serveSearchRequest(w, r, h)
+		case r.Method == "PROPFIND":
+			a.principalHandler(h, r).ServeHTTP(w, r)
+		default:
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// serveSyncCollection answers a sync-collection report of RFC 6578. Without a token, all
+// members of the collection are reported, otherwise the members changed since the token.
+// The properties of the members are taken from a PROPFIND of the WebDAV handler, so they're
+// the same as for a full sync.
+func (a *App) serveSyncCollection(w http.ResponseWriter, r *http.Request, h *webdav.Handler) {
+	ctx := r.Context()
+	if !strings.HasPrefix(r.URL.Path, h.Prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	reqPath := path.Clean("/" + strings.TrimPrefix(r.URL.Path, h.Prefix))
+
+	var body syncCollection
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	if body.XMLName != (xml.Name{Space: "DAV:", Local: "sync-collection"}) {
+		writeSyncError(w, http.StatusForbidden, "supported-report")
+		return
+	}
+	if body.SyncLevel != "1" && body.SyncLevel != "infinite" {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	infinite := body.SyncLevel == "infinite"
+	limit := 0
+	if body.Limit != nil {
+		limit = body.Limit.NResults
+	}
+
+	fi, err := h.FileSystem.Stat(ctx, reqPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !fi.IsDir() {
+		writeSyncError(w, http.StatusForbidden, "supported-report")
+		return
+	}
+	dir := Dir{Config: a.Config}.resolve(ctx, reqPath)
+
+	var members []string
+	var seq int64
+	truncated := false
+	if body.SyncToken == "" {
+		// the token is taken first, so changes during the walk are reported again
+		seq = a.Sync.current()
+		members = treeMembers(a.Config.storage(), dir, infinite)
+		if limit > 0 && len(members) > limit {
+			writeSyncError(w, http.StatusInsufficientStorage, "number-of-matches-within-limits")
+			return
+		}
+	} else {
+		since, ok := a.Sync.parseToken(body.SyncToken)
+		if !ok {
+			traceStep(ctx, "sync token %s is unknown or expired", body.SyncToken)
+			writeSyncError(w, http.StatusForbidden, "valid-sync-token")
+			return
+		}
+		var changes []syncEntry
+		var n int
+		changes, seq = a.Sync.changes(since, dir)
+		members, n = syncMembers(a.Config.storage(), changes, dir, infinite, limit)
+		if n < len(changes) {
+			if n == 0 {
+				writeSyncError(w, http.StatusInsufficientStorage, "number-of-matches-within-limits")
+				return
+			}
+			truncated = true
+			seq = changes[n-1].Seq
+		}
+	}
+	traceStep(ctx, "reporting %d changed members of %s", len(members), dir)
+
+	var out bytes.Buffer
+	out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	propfind := body.propfind()
+	for _, member := range members {
+		rel, err := filepath.Rel(dir, member)
+		if err != nil {
+			continue
+		}
+		memberPath := path.Join(reqPath, filepath.ToSlash(rel))
+		responses, ok := a.propfindMember(r, h, memberPath, propfind)
+		if !ok {
+			fmt.Fprintf(&out, "<D:response><D:href>%s</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>",
+				syncHref(h.Prefix, memberPath))
+			continue
+		}
+		out.Write(responses)
+	}
+	if truncated {
+		fmt.Fprintf(&out, "<D:response><D:href>%s</D:href><D:status>HTTP/1.1 507 Insufficient Storage</D:status></D:response>",
+			syncHref(h.Prefix, reqPath))
+	}
+	out.WriteString("<D:sync-token>")
+	xml.EscapeText(&out, []byte(a.Sync.tokenOf(seq)))
+	out.WriteString("</D:sync-token></D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	if _, err := w.Write(out.Bytes()); err != nil {
+		log.WithError(err).Error("Error writing sync-collection report")
+	}
+}
+
+// propfind returns the body of a PROPFIND of the requested properties. The entity tags are
+// requested, if the report doesn't name any properties.
+func (c *syncCollection) propfind() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<davesync:propfind xmlns:davesync="DAV:"`)
+	if c.Prop == nil {
+		b.WriteString("><davesync:prop><davesync:getetag/></davesync:prop></davesync:propfind>")
+		return b.Bytes()
+	}
+
+	for _, attr := range append(c.Attrs, c.Prop.Attrs...) {
+		switch {
+		case attr.Name.Space == "xmlns" && attr.Name.Local != "davesync":
+			fmt.Fprintf(&b, " xmlns:%s=\"", attr.Name.Local)
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			b.WriteString(` xmlns="`)
+		default:
+			continue
+		}
+		xml.EscapeText(&b, []byte(attr.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString("><davesync:prop>")
+	b.Write(c.Prop.Inner)
+	b.WriteString("</davesync:prop></davesync:propfind>")
+	return b.Bytes()
+}
+
+// propfindMember returns the responses of a PROPFIND of the member by the WebDAV handler.
+// The elements of the DAV namespace use the prefix D within the responses of the handler,
+// which is declared by the report as well. ok is false, if the member doesn't exist.
+func (a *App) propfindMember(r *http.Request, h *webdav.Handler, name string, propfind []byte) ([]byte, bool) {
+	if _, err := h.FileSystem.Stat(r.Context(), name); os.IsNotExist(err) {
+		return nil, false
+	}
+
+	req, err := http.NewRequest("PROPFIND", syncHref(h.Prefix, name), bytes.NewReader(propfind))
+	if err != nil {
+		return nil, false
+	}
+	req = req.WithContext(r.Context())
+	req.Header.Set("Depth", "0")
+	rec := &syncRecorder{header: http.Header{}}
+	h.ServeHTTP(rec, req)
+	if rec.status != http.StatusMultiStatus {
+		return nil, false
+	}
+
+	var ms struct {
+		Responses []struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:"DAV: response"`
+	}
+	if err := xml.Unmarshal(rec.body.Bytes(), &ms); err != nil {
+		return nil, false
+	}
+	var out bytes.Buffer
+	for _, resp := range ms.Responses {
+		out.WriteString("<D:response>")
+		out.Write(resp.Inner)
+		out.WriteString("</D:response>")
+	}
+	return out.Bytes(), true
+}
+
+// syncHref returns the escaped URL path of a member.
+func syncHref(prefix, name string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte((&url.URL{Path: path.Join("/", prefix, name)}).EscapedPath()))
+	return b.String()
+}
+
+func writeSyncError(w http.ResponseWriter, status int, condition string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<D:error xmlns:D=\"DAV:\"><D:%s/></D:error>\n", condition)
+}
+
+// syncRecorder buffers the response of the PROPFIND of a member.
+type syncRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *syncRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *syncRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(p)
+}
+
+func (r *syncRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestSyncLog(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{Sync: &Sync{File: filepath.Join(tmpDir, "sync.log"), Retention: 2}}
+	l, err := NewSyncLog(cfg)
+	if err != nil {
+		t.Fatalf("NewSyncLog() error = %v", err)
+	}
+	first := l.token()
+	l.record("/a", false)
+	l.record("/b", true)
+	second := l.token()
+	l.Close()
+
+	l, err = NewSyncLog(cfg)
+	if err != nil {
+		t.Fatalf("NewSyncLog() of existing journal error = %v", err)
+	}
+	defer l.Close()
+	if got := l.token(); got != second {
+		t.Errorf("token() after reopening = %v, want %v", got, second)
+	}
+	changes, _ := l.changes(0, "/")
+	if want := []syncEntry{{1, "/a", false}, {2, "/b", true}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes() = %v, want %v", changes, want)
+	}
+
+	// the retention of two changes is exceeded with the fourth one
+	l.record("/c", false)
+	l.record("/d", false)
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{first, false},
+		{second, true},
+		{l.token(), true},
+		{strings.Replace(second, ":2", ":5", 1), false},
+		{syncTokenPrefix + "1:2", false},
+		{"http://example.com/sync/2", false},
+	}
+	for _, tt := range tests {
+		if _, ok := l.parseToken(tt.token); ok != tt.want {
+			t.Errorf("parseToken(%v) = %v, want %v", tt.token, ok, tt.want)
+		}
+	}
+}
+
+// syncReport holds the members of a sync-collection report.
+type syncReport struct {
+	changed   []string
+	removed   []string
+	truncated bool
+	token     string
+}
+
+func TestSyncCollection(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "docs"), 0700)
+	os.WriteFile(filepath.Join(tmpDir, "docs", "a.txt"), []byte("a"), 0600)
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &Config{Dir: tmpDir, Sync: &Sync{}}
+	syncLog, err := NewSyncLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &App{
+		Config: cfg,
+		Sync:   syncLog,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg, Sync: syncLog},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+	report := func(path, token, level string, limit int) (syncReport, int) {
+		body := `<?xml version="1.0"?><d:sync-collection xmlns:d="DAV:" xmlns:x="urn:example"><d:sync-token>` + token +
+			`</d:sync-token><d:sync-level>` + level + `</d:sync-level>`
+		if limit > 0 {
+			body += "<d:limit><d:nresults>" + strconv.Itoa(limit) + "</d:nresults></d:limit>"
+		}
+		body += "<d:prop><d:getetag/><x:color/></d:prop></d:sync-collection>"
+		w := do("REPORT", path, body)
+
+		var ms struct {
+			Responses []struct {
+				Href     string   `xml:"href"`
+				Status   string   `xml:"status"`
+				PropStat []string `xml:"propstat>status"`
+			} `xml:"response"`
+			SyncToken string `xml:"sync-token"`
+		}
+		xml.Unmarshal(w.Body.Bytes(), &ms)
+		var r syncReport
+		for _, resp := range ms.Responses {
+			switch {
+			case strings.Contains(resp.Status, "404"):
+				r.removed = append(r.removed, resp.Href)
+			case strings.Contains(resp.Status, "507"):
+				r.truncated = true
+			case len(resp.PropStat) > 0:
+				r.changed = append(r.changed, resp.Href)
+			}
+		}
+		sort.Strings(r.changed)
+		sort.Strings(r.removed)
+		r.token = ms.SyncToken
+		return r, w.Code
+	}
+
+	initial, code := report("/", "", "infinite", 0)
+	if code != http.StatusMultiStatus || !reflect.DeepEqual(initial.changed, []string{"/docs/", "/docs/a.txt"}) {
+		t.Fatalf("initial report = %v %v, want the whole tree", code, initial)
+	}
+
+	do("PUT", "/docs/b.txt", "b")
+	do("MKCOL", "/photos", "")
+	do("PUT", "/photos/c.jpg", "c")
+	do("MOVE", "/photos", "", "Destination", "/pictures")
+	do("DELETE", "/docs/a.txt", "")
+
+	tests := []struct {
+		name        string
+		path        string
+		level       string
+		limit       int
+		wantChanged []string
+		wantRemoved []string
+	}{
+		{"infinite depth", "/", "infinite", 0, []string{"/docs/", "/docs/b.txt", "/pictures/", "/pictures/c.jpg"}, []string{"/docs/a.txt", "/photos", "/photos/c.jpg"}},
+		{"depth 1", "/", "1", 0, []string{"/docs/", "/pictures/"}, []string{"/photos"}},
+		{"sub collection", "/docs/", "1", 0, []string{"/docs/b.txt"}, []string{"/docs/a.txt"}},
+		{"limit", "/", "infinite", 2, []string{"/docs/", "/docs/b.txt"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, code := report(tt.path, initial.token, tt.level, tt.limit)
+			if code != http.StatusMultiStatus {
+				t.Fatalf("report() status = %v, want %v", code, http.StatusMultiStatus)
+			}
+			if got.truncated != (tt.limit > 0) {
+				t.Errorf("report() truncated = %v, want %v", got.truncated, tt.limit > 0)
+			}
+			if !reflect.DeepEqual(got.changed, tt.wantChanged) || !reflect.DeepEqual(got.removed, tt.wantRemoved) {
+				t.Errorf("report() = %v, %v, want %v, %v", got.changed, got.removed, tt.wantChanged, tt.wantRemoved)
+			}
+			if got.token == initial.token {
+				t.Errorf("report() token = %v, want a new one", got.token)
+			}
+		})
+	}
+
+	latest, _ := report("/", initial.token, "infinite", 0)
+	if got, _ := report("/", latest.token, "infinite", 0); len(got.changed) != 0 || len(got.removed) != 0 {
+		t.Errorf("report() without changes = %v, want no members", got)
+	}
+	if _, code := report("/", syncTokenPrefix+"1:1", "1", 0); code != http.StatusForbidden {
+		t.Errorf("report() with invalid token status = %v, want %v", code, http.StatusForbidden)
+	}
+	if _, code := report("/", "", "1", 1); code != http.StatusInsufficientStorage {
+		t.Errorf("initial report() beyond limit status = %v, want %v", code, http.StatusInsufficientStorage)
+	}
+	if w := do("REPORT", "/", `<D:version-tree xmlns:D="DAV:"/>`); w.Code != http.StatusForbidden {
+		t.Errorf("unsupported report status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	w := do("PROPFIND", "/docs/", `<D:propfind xmlns:D="DAV:"><D:prop><D:sync-token/></D:prop></D:propfind>`, "Depth", "0")
+	if !strings.Contains(w.Body.String(), "<D:sync-token>"+latest.token+"</D:sync-token>") {
+		t.Errorf("PROPFIND of sync-token = %s, want %s", w.Body.String(), latest.token)
+	}
+}
@@ -0,0 +1,219 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"tailscale.com/tsnet"
+	"time"
+)
+
+// Settings of the Tailscale integration
+const (
+	defaultTailscaleHostname = "dave"
+	tailscaleTimeout         = 3 * time.Second
+	tailscaleCacheTime       = time.Minute
+)
+
+// Tailscale configures the Tailscale node embedded into the server. Listeners on the tailnet
+// accept the connections of the node and authenticate the requests by the identity of the
+// connecting Tailscale user, without a tailscaled on the host.
+type Tailscale struct {
+	// Hostname is the name of the node on the tailnet, dave by default
+	Hostname string
+	// Dir keeps the state of the node, so it stays logged in across restarts
+	Dir string
+	// AuthKey logs the node in on its first start, TS_AUTHKEY is used if it's empty
+	AuthKey string
+	// Ephemeral removes the node from the tailnet, once it goes offline
+	Ephemeral bool
+	// ControlURL is the coordination server, e.g. of Headscale, instead of the one of Tailscale
+	ControlURL string
+
+	once   sync.Once
+	server *tsnet.Server
+	err    error
+	// whois returns the login name of the user of the node connecting from an address
+	whois func(ctx context.Context, remoteAddr string) (string, error)
+	mu    sync.Mutex
+	cache map[string]*tailscaleIdentity
+}
+
+type tailscaleIdentity struct {
+	login   string
+	expires time.Time
+}
+
+// start joins the tailnet with the node, which logs in with the auth key, its kept state or
+// the login URL it logs. It blocks until the node is running. Nodes, whose whois is already
+// set, aren't started.
+func (ts *Tailscale) start() error {
+	ts.once.Do(func() {
+		if ts.whois != nil {
+			return
+		}
+		hostname := ts.Hostname
+		if hostname == "" {
+			hostname = defaultTailscaleHostname
+		}
+		ts.server = &tsnet.Server{
+			Hostname:   hostname,
+			Dir:        ts.Dir,
+			AuthKey:    ts.AuthKey,
+			Ephemeral:  ts.Ephemeral,
+			ControlURL: ts.ControlURL,
+			UserLogf: func(format string, args ...interface{}) {
+				log.WithField("node", hostname).Infof("Tailscale: "+format, args...)
+			},
+			Logf: func(format string, args ...interface{}) {
+				log.WithField("node", hostname).Debugf("Tailscale: "+format, args...)
+			},
+		}
+		if _, ts.err = ts.server.Up(context.Background()); ts.err != nil {
+			ts.err = fmt.Errorf("Tailscale node %s can't join the tailnet: %s", hostname, ts.err)
+			return
+		}
+		client, err := ts.server.LocalClient()
+		if err != nil {
+			ts.err = err
+			return
+		}
+		ts.whois = func(ctx context.Context, remoteAddr string) (string, error) {
+			who, err := client.WhoIs(ctx, remoteAddr)
+			if err != nil {
+				return "", err
+			}
+			return who.UserProfile.LoginName, nil
+		}
+	})
+	return ts.err
+}
+
+// Listen accepts the TCP connections of the listener on the tailnet. Without an address it
+// listens on all addresses of the node.
+func (ts *Tailscale) Listen(l *Listener) (net.Listener, error) {
+	if err := ts.start(); err != nil {
+		return nil, err
+	}
+	ln, err := ts.server.Listen("tcp", l.Addr())
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(ln), nil
+}
+
+// ListenPacket accepts the UDP packets of the listener on the tailnet for HTTP/3. Without an
+// address it listens on the IPv4 address of the node.
+func (ts *Tailscale) ListenPacket(l *Listener) (net.PacketConn, error) {
+	addr, err := ts.Address()
+	if err != nil {
+		return nil, err
+	}
+	if l.Address != "" {
+		addr = l.Address
+	}
+	return ts.server.ListenPacket("udp", net.JoinHostPort(addr, l.Port))
+}
+
+// Address returns the IPv4 address of the node on the tailnet, or its IPv6 address if it
+// has none.
+func (ts *Tailscale) Address() (string, error) {
+	if err := ts.start(); err != nil {
+		return "", err
+	}
+	ip4, ip6 := ts.server.TailscaleIPs()
+	switch {
+	case ip4.IsValid():
+		return ip4.String(), nil
+	case ip6.IsValid():
+		return ip6.String(), nil
+	}
+	return "", errors.New("node has no Tailscale address, is it logged in?")
+}
+
+// Close leaves the tailnet. It does nothing, if the node hasn't been started.
+func (ts *Tailscale) Close() error {
+	if ts == nil || ts.server == nil {
+		return nil
+	}
+	return ts.server.Close()
+}
+
+// login returns the Tailscale login name of the node connecting from the given address.
+func (ts *Tailscale) login(remoteAddr string) (string, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	ts.mu.Lock()
+	id, ok := ts.cache[host]
+	ts.mu.Unlock()
+	if ok && time.Now().Before(id.expires) {
+		return id.login, nil
+	}
+
+	if err := ts.start(); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tailscaleTimeout)
+	defer cancel()
+	login, err := ts.whois(ctx, remoteAddr)
+	if err != nil {
+		return "", err
+	}
+
+	login = strings.ToLower(login)
+	ts.mu.Lock()
+	if ts.cache == nil {
+		ts.cache = map[string]*tailscaleIdentity{}
+	}
+	ts.cache[host] = &tailscaleIdentity{login: login, expires: time.Now().Add(tailscaleCacheTime)}
+	ts.mu.Unlock()
+	return login, nil
+}
+
+// tailscaleAuth authenticates requests of a Tailscale listener by the identity of the
+// connecting Tailscale user, if a configured user is mapped to it. It returns the login name
+// for the trace log.
+func (cfg *Config) tailscaleAuth(req *http.Request) (*AuthInfo, string, bool) {
+	if on, _ := req.Context().Value(tailscaleKey).(bool); !on {
+		return nil, "", false
+	}
+
+	if cfg.Tailscale == nil {
+		return nil, "", false
+	}
+	login, err := cfg.Tailscale.login(req.RemoteAddr)
+	if err != nil {
+		log.WithField("address", req.RemoteAddr).WithError(err).Warn("Tailscale identity can't be determined")
+		return nil, "", false
+	}
+
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	for name, user := range cfg.Users {
+		if user != nil && strings.EqualFold(user.Tailscale, login) {
+			return &AuthInfo{Username: name, Authenticated: true}, login, true
+		}
+	}
+	return nil, login, false
+}
+
+// ConnContext marks the connections of Tailscale listeners, so their requests are
+// authenticated by the Tailscale identity, and passes the recorded ClientHello of TLS
+// connections on for the fingerprints. It is meant for http.Server.ConnContext.
+func (l *Listener) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if fc := fingerprintConnOf(c); fc != nil {
+		ctx = context.WithValue(ctx, fingerprintKey, fc)
+	}
+	if !l.Tailscale {
+		return ctx
+	}
+	return context.WithValue(ctx, tailscaleKey, true)
+}
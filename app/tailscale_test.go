@@ -0,0 +1,82 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeWhois answers the identities of the nodes of a tailnet like the local API of the
+// Tailscale node and counts the lookups.
+func fakeWhois(lookups *int) func(ctx context.Context, remoteAddr string) (string, error) {
+	return func(ctx context.Context, remoteAddr string) (string, error) {
+		*lookups++
+		switch remoteAddr {
+		case "100.64.0.2:1234", "100.64.0.2:5678":
+			return "Alice@example.com", nil
+		case "100.64.0.3:1234":
+			return "mallory@example.com", nil
+		}
+		return "", errors.New("no match")
+	}
+}
+
+func TestTailscaleLogin(t *testing.T) {
+	var lookups int
+	ts := &Tailscale{whois: fakeWhois(&lookups)}
+
+	if got, err := ts.login("100.64.0.2:1234"); err != nil || got != "alice@example.com" {
+		t.Errorf("login() = %v, %v, want %v", got, err, "alice@example.com")
+	}
+	// the identity of a node is cached independent of the port
+	if got, err := ts.login("100.64.0.2:5678"); err != nil || got != "alice@example.com" || lookups != 1 {
+		t.Errorf("login() = %v, %v after %d lookups, want the cached %v", got, err, lookups, "alice@example.com")
+	}
+	if _, err := ts.login("100.64.0.4:1234"); err == nil {
+		t.Errorf("login() error = %v, want error for an unknown node", err)
+	}
+	if _, err := ts.login("invalid"); err == nil {
+		t.Errorf("login() error = %v, want error for an invalid address", err)
+	}
+}
+
+func TestTailscaleAuth(t *testing.T) {
+	var lookups int
+	cfg := &Config{
+		Tailscale: &Tailscale{whois: fakeWhois(&lookups)},
+		Users: map[string]*UserInfo{
+			"alice": {Tailscale: "alice@example.com"},
+			"bob":   {Password: GenHash([]byte("password"))},
+		},
+	}
+	tailnet := &Listener{Tailscale: true}
+
+	tests := []struct {
+		name       string
+		listener   *Listener
+		remoteAddr string
+		want       string
+	}{
+		{"mapped identity", tailnet, "100.64.0.2:1234", "alice"},
+		{"unmapped identity", tailnet, "100.64.0.3:1234", ""},
+		{"unknown node", tailnet, "100.64.0.4:1234", ""},
+		{"other listener", &Listener{}, "100.64.0.2:1234", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req = req.WithContext(tt.listener.ConnContext(context.Background(), nil))
+
+			info, _, ok := cfg.tailscaleAuth(req)
+			got := ""
+			if ok {
+				got = info.Username
+			}
+			if got != tt.want {
+				t.Errorf("tailscaleAuth() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
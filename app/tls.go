@@ -0,0 +1,328 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Timeouts of the certificate reload and the revocation checks
+const (
+	certReloadDelay  = time.Second
+	ocspTimeout      = 5 * time.Second
+	ocspDefaultCache = time.Hour
+)
+
+// config builds the TLS configuration of the server certificate and, if a client CA is
+// configured, of the client certificate authentication.
+func (t *TLS) config() (*tls.Config, error) {
+	var cfg *tls.Config
+	if t.ACME != nil {
+		cfg = t.ACME.getManager().TLSConfig()
+	} else {
+		store, err := newCertStore(t.KeyPairs())
+		if err != nil {
+			return nil, err
+		}
+		if err := store.watch(); err != nil {
+			log.WithError(err).Warn("Can't watch TLS certificates, they won't be reloaded on change")
+		}
+		cfg = &tls.Config{GetCertificate: store.getCertificate}
+	}
+
+	if t.ClientCAFile == "" {
+		if len(t.CRLFiles) > 0 || t.OCSP {
+			return nil, errors.New("revocation checks require a clientCAFile")
+		}
+		return cfg, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in clientCAFile %s", t.ClientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if len(t.CRLFiles) > 0 || t.OCSP {
+		rc := &revocationChecker{
+			ocsp:   t.OCSP,
+			client: &http.Client{Timeout: ocspTimeout},
+			crls:   map[string]*crlFile{},
+			cache:  map[string]*ocspEntry{},
+		}
+		for _, path := range t.CRLFiles {
+			if err := rc.loadCRL(path); err != nil {
+				return nil, err
+			}
+		}
+		cfg.VerifyConnection = rc.verify
+	}
+
+	return cfg, nil
+}
+
+// certStore holds the certificates of a TLS configuration and reloads them when the files
+// change, e.g. when certbot renews them.
+type certStore struct {
+	pairs []*KeyPair
+
+	mu    sync.RWMutex
+	certs []tls.Certificate
+}
+
+func newCertStore(pairs []*KeyPair) (*certStore, error) {
+	s := &certStore{pairs: pairs}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads all key pairs. The previous certificates are kept, if one of them is invalid.
+func (s *certStore) load() error {
+	certs := make([]tls.Certificate, 0, len(s.pairs))
+	for _, kp := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	s.mu.Lock()
+	s.certs = certs
+	s.mu.Unlock()
+	return nil
+}
+
+// getCertificate selects the certificate matching the SNI host name of the client. The first
+// certificate is used, if none matches.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range s.certs {
+		if hello.SupportsCertificate(&s.certs[i]) == nil {
+			return &s.certs[i], nil
+		}
+	}
+	return &s.certs[0], nil
+}
+
+// watch reloads the certificates after changes in their directories. The directories are
+// watched instead of the files, because renewals usually replace the files or symlinks.
+func (s *certStore) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{}
+	for _, kp := range s.pairs {
+		dirs[filepath.Dir(kp.CertFile)] = true
+		dirs[filepath.Dir(kp.KeyFile)] = true
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+
+	go func() {
+		// renewals touch several files, so wait until they are complete
+		var timer *time.Timer
+		for {
+			select {
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if timer == nil {
+					timer = time.AfterFunc(certReloadDelay, s.reload)
+				} else {
+					timer.Reset(certReloadDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.WithError(err).Warn("Error watching TLS certificates")
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *certStore) reload() {
+	s.mu.RLock()
+	old := s.certs
+	s.mu.RUnlock()
+
+	if err := s.load(); err != nil {
+		log.WithError(err).Warn("Error reloading TLS certificates, keeping the previous ones")
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range s.certs {
+		if !bytes.Equal(s.certs[i].Certificate[0], old[i].Certificate[0]) {
+			log.WithField("path", s.pairs[i].CertFile).Info("Reloaded TLS certificate")
+		}
+	}
+}
+
+// revocationChecker rejects client certificates which are revoked by one of the CRL files or
+// by the OCSP responder of the certificate.
+type revocationChecker struct {
+	ocsp   bool
+	client *http.Client
+
+	mu    sync.Mutex
+	crls  map[string]*crlFile
+	cache map[string]*ocspEntry
+}
+
+type crlFile struct {
+	modTime time.Time
+	list    *x509.RevocationList
+}
+
+type ocspEntry struct {
+	status  int
+	expires time.Time
+}
+
+func (rc *revocationChecker) verify(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) < 2 {
+		return nil
+	}
+	leaf, issuer := cs.VerifiedChains[0][0], cs.VerifiedChains[0][1]
+
+	if rc.revokedByCRL(leaf, issuer) {
+		return fmt.Errorf("client certificate %s has been revoked", leaf.Subject)
+	}
+	if rc.ocsp && rc.revokedByOCSP(leaf, issuer) {
+		return fmt.Errorf("client certificate %s has been revoked", leaf.Subject)
+	}
+	return nil
+}
+
+// revokedByCRL checks the CRLs of the issuer. Modified CRL files are reloaded, so updates of
+// the CA take effect without a restart.
+func (rc *revocationChecker) revokedByCRL(leaf, issuer *x509.Certificate) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for path, f := range rc.crls {
+		if fi, err := os.Stat(path); err == nil && !fi.ModTime().Equal(f.modTime) {
+			if err := rc.loadCRL(path); err != nil {
+				log.WithField("path", path).WithError(err).Warn("Error reloading CRL, keeping the previous one")
+			}
+			f = rc.crls[path]
+		}
+
+		if f.list.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		for _, entry := range f.list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loadCRL reads a PEM or DER encoded CRL. The caller must hold the lock or own rc exclusively.
+func (rc *revocationChecker) loadCRL(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("error parsing CRL %s: %s", path, err)
+	}
+	rc.crls[path] = &crlFile{modTime: fi.ModTime(), list: list}
+	return nil
+}
+
+// revokedByOCSP asks the OCSP responder of the certificate. If the responder can't be
+// reached, the certificate is accepted, so an outage of the CA doesn't lock out all users.
+func (rc *revocationChecker) revokedByOCSP(leaf, issuer *x509.Certificate) bool {
+	if len(leaf.OCSPServer) == 0 {
+		return false
+	}
+	key := issuer.SerialNumber.String() + "/" + leaf.SerialNumber.String()
+
+	rc.mu.Lock()
+	entry, ok := rc.cache[key]
+	rc.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.status == ocsp.Revoked
+	}
+
+	resp, err := rc.queryOCSP(leaf.OCSPServer[0], leaf, issuer)
+	if err != nil {
+		log.WithField("subject", leaf.Subject.String()).WithError(err).Warn("OCSP check of client certificate failed")
+		return false
+	}
+
+	expires := resp.NextUpdate
+	if expires.IsZero() {
+		expires = time.Now().Add(ocspDefaultCache)
+	}
+	rc.mu.Lock()
+	rc.cache[key] = &ocspEntry{status: resp.Status, expires: expires}
+	rc.mu.Unlock()
+
+	return resp.Status == ocsp.Revoked
+}
+
+func (rc *revocationChecker) queryOCSP(server string, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rc.client.Post(server, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s answered with %s", server, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, leaf, issuer)
+}
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("error creating test ca. error = %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, ocspServer string) *x509.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "client " + strconv.FormatInt(serial, 10)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ocspServer != "" {
+		tmpl.OCSPServer = []string{ocspServer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatalf("error creating test certificate. error = %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, path string, serials ...int64) {
+	var revoked []x509.RevocationListEntry
+	for _, s := range serials {
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("error creating test crl. error = %v", err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600); err != nil {
+		t.Fatalf("error writing test crl. error = %v", err)
+	}
+}
+
+// writeKeyPair issues a server certificate for host and writes it with its key to dir.
+func (ca *testCA) writeKeyPair(t *testing.T, dir, host string) *KeyPair {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatalf("error creating test certificate. error = %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	kp := &KeyPair{CertFile: filepath.Join(dir, host+".pem"), KeyFile: filepath.Join(dir, host+".key")}
+	ioutil.WriteFile(kp.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(kp.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return kp
+}
+
+func TestRevocationCheckerCRL(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestCA(t)
+	other := newTestCA(t)
+	path := filepath.Join(tmpDir, "ca.crl")
+	ca.crl(t, path, 2)
+	otherPath := filepath.Join(tmpDir, "other.crl")
+	other.crl(t, otherPath, 3)
+
+	rc := &revocationChecker{crls: map[string]*crlFile{}, cache: map[string]*ocspEntry{}}
+	for _, p := range []string{path, otherPath} {
+		if err := rc.loadCRL(p); err != nil {
+			t.Fatalf("loadCRL() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		serial  int64
+		wantErr bool
+	}{
+		{"valid", 1, false},
+		{"revoked", 2, true},
+		{"revoked by other ca", 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{ca.issue(t, tt.serial, ""), ca.cert}}}
+			if err := rc.verify(cs); (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// updated CRLs are picked up without a restart
+	ca.crl(t, path, 1, 2)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{ca.issue(t, 1, ""), ca.cert}}}
+	if err := rc.verify(cs); err == nil {
+		t.Errorf("verify() error = %v, want revoked after CRL update", err)
+	}
+}
+
+func TestRevocationCheckerOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	queries := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		status := ocsp.Good
+		if req.SerialNumber.Int64() == 2 {
+			status = ocsp.Revoked
+		}
+		resp, _ := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}, ca.key)
+		w.Write(resp)
+	}))
+	defer srv.Close()
+
+	rc := &revocationChecker{ocsp: true, client: srv.Client(), crls: map[string]*crlFile{}, cache: map[string]*ocspEntry{}}
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		wantErr bool
+	}{
+		{"good", ca.issue(t, 1, srv.URL), false},
+		{"revoked", ca.issue(t, 2, srv.URL), true},
+		{"no responder", ca.issue(t, 3, ""), false},
+		{"unreachable responder", ca.issue(t, 4, "http://127.0.0.1:1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert, ca.cert}}}
+			if err := rc.verify(cs); (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the responses are cached until their next update
+	cs := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tests[1].cert, ca.cert}}}
+	rc.verify(cs)
+	if queries != 2 {
+		t.Errorf("verify() queried the responder %d times, want %d", queries, 2)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestCA(t)
+	caFile := filepath.Join(tmpDir, "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600)
+	keyDER, _ := x509.MarshalECPrivateKey(ca.key.(*ecdsa.PrivateKey))
+	keyFile := filepath.Join(tmpDir, "key.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	crlFile := filepath.Join(tmpDir, "ca.crl")
+	ca.crl(t, crlFile)
+
+	tests := []struct {
+		name       string
+		tls        *TLS
+		clientAuth tls.ClientAuthType
+		wantErr    bool
+	}{
+		{"server only", &TLS{CertFile: caFile, KeyFile: keyFile}, tls.NoClientCert, false},
+		{"client ca", &TLS{CertFile: caFile, KeyFile: keyFile, ClientCAFile: caFile}, tls.RequireAndVerifyClientCert, false},
+		{"crl", &TLS{CertFile: caFile, KeyFile: keyFile, ClientCAFile: caFile, CRLFiles: []string{crlFile}}, tls.RequireAndVerifyClientCert, false},
+		{"crl without client ca", &TLS{CertFile: caFile, KeyFile: keyFile, CRLFiles: []string{crlFile}}, 0, true},
+		{"invalid crl", &TLS{CertFile: caFile, KeyFile: keyFile, ClientCAFile: caFile, CRLFiles: []string{caFile}}, 0, true},
+		{"missing client ca", &TLS{CertFile: caFile, KeyFile: keyFile, ClientCAFile: filepath.Join(tmpDir, "nope")}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.tls.config()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("config() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.ClientAuth != tt.clientAuth {
+				t.Errorf("config() ClientAuth = %v, want %v", got.ClientAuth, tt.clientAuth)
+			}
+		})
+	}
+}
+
+func TestTLSConfigSNI(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestCA(t)
+	def := ca.writeKeyPair(t, tmpDir, "dav.example.com")
+	cfg, err := (&TLS{CertFile: def.CertFile, KeyFile: def.KeyFile, Certificates: []*KeyPair{ca.writeKeyPair(t, tmpDir, "files.other.org")}}).config()
+	if err != nil {
+		t.Fatalf("config() error = %v", err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"dav.example.com", "dav.example.com"},
+		{"files.other.org", "files.other.org"},
+		{"unknown.org", "dav.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				tls.Server(server, cfg).Handshake()
+				server.Close()
+			}()
+
+			conn := tls.Client(client, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			if err := conn.Handshake(); err != nil {
+				t.Fatalf("Handshake() error = %v", err)
+			}
+			if got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; got != tt.want {
+				t.Errorf("certificate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestCA(t)
+	kp := ca.writeKeyPair(t, tmpDir, "dav.example.com")
+	store, err := newCertStore([]*KeyPair{kp})
+	if err != nil {
+		t.Fatalf("newCertStore() error = %v", err)
+	}
+	if err := store.watch(); err != nil {
+		t.Fatalf("watch() error = %v", err)
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "dav.example.com"}
+	before, _ := store.getCertificate(hello)
+
+	// an invalid intermediate state keeps the previous certificate
+	ioutil.WriteFile(kp.KeyFile, []byte("garbage"), 0600)
+	time.Sleep(certReloadDelay + 500*time.Millisecond)
+	if got, _ := store.getCertificate(hello); !bytes.Equal(got.Certificate[0], before.Certificate[0]) {
+		t.Fatalf("getCertificate() changed after invalid update")
+	}
+
+	ca.writeKeyPair(t, tmpDir, "dav.example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if got, _ := store.getCertificate(hello); !bytes.Equal(got.Certificate[0], before.Certificate[0]) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("getCertificate() returned the previous certificate after renewal")
+}
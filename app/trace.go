@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// requestTrace collects the decisions which have been made while processing a request.
+type requestTrace struct {
+	mu    sync.Mutex
+	user  string
+	steps []string
+}
+
+// withTrace adds a new request trace to the context.
+func withTrace(ctx context.Context) (context.Context, *requestTrace) {
+	tr := &requestTrace{}
+	return context.WithValue(ctx, traceKey, tr), tr
+}
+
+// traceStep records a decision for the request of the given context, if it is traced.
+func traceStep(ctx context.Context, format string, args ...interface{}) {
+	tr, ok := ctx.Value(traceKey).(*requestTrace)
+	if !ok {
+		return
+	}
+
+	tr.mu.Lock()
+	tr.steps = append(tr.steps, fmt.Sprintf(format, args...))
+	tr.mu.Unlock()
+}
+
+// traceWriter remembers the status code and the size of the response for the trace log and
+// the access log.
+type traceWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *traceWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.written, int64(n))
+	return n, err
+}
+
+// logTrace writes the trace of a processed request, if tracing is enabled globally or for
+// the authenticated user.
+func (cfg *Config) logTrace(tr *requestTrace, w *traceWriter, req *http.Request) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if !cfg.Logging().Trace {
+		user := cfg.User(tr.user)
+		if tr.user == "" || user == nil || !user.Trace {
+			return
+		}
+	}
+
+	log.WithFields(fingerprintFields(req.Context(), log.Fields{
+		"method":          req.Method,
+		"path":            req.URL.Path,
+		"user":            tr.user,
+		"address":         cfg.clientIP(req),
+		"status":          w.status,
+		"requestHeaders":  formatHeaders(req.Header),
+		"responseHeaders": formatHeaders(w.Header()),
+		"decisions":       strings.Join(tr.steps, "; "),
+	})).Info("Traced request")
+}
+
+// formatHeaders formats the headers for the trace log with the credentials redacted.
+func formatHeaders(h http.Header) string {
+	var parts []string
+	for name, values := range h {
+		for _, v := range values {
+			if strings.EqualFold(name, "Authorization") {
+				if i := strings.Index(v, " "); i != -1 {
+					v = v[:i] + " [redacted]"
+				} else {
+					v = "[redacted]"
+				}
+			}
+			parts = append(parts, name+": "+v)
+		}
+	}
+
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
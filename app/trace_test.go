@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/net/webdav"
+)
+
+func TestHandleTrace(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	users := func(trace bool) map[string]*UserInfo {
+		return map[string]*UserInfo{
+			"foo": {Password: GenHash([]byte("password")), Trace: trace},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		logging   Logging
+		users     map[string]*UserInfo
+		password  string
+		wantTrace bool
+		decision  string
+	}{
+		{"disabled", Logging{}, users(false), "password", false, ""},
+		{"global", Logging{Trace: true}, users(false), "password", true, "authenticated user foo"},
+		{"global failed login", Logging{Trace: true}, users(false), "wrong", true, "authentication of user foo failed"},
+		{"per user", Logging{}, users(true), "password", true, "resolved / to"},
+		{"per user failed login", Logging{}, users(true), "wrong", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			cfg := &Config{Dir: "/tmp", Users: tt.users, Log: tt.logging}
+			a := &App{
+				Config: cfg,
+				Handler: &webdav.Handler{
+					FileSystem: Dir{Config: cfg},
+					LockSystem: webdav.NewMemLS(),
+				},
+			}
+
+			r := httptest.NewRequest("PROPFIND", "/", nil)
+			r.Header.Set("Depth", "0")
+			r.SetBasicAuth("foo", tt.password)
+			handle(context.Background(), httptest.NewRecorder(), r, a)
+
+			var traced []string
+			for _, e := range hook.AllEntries() {
+				if e.Message == "Traced request" {
+					traced = append(traced, e.Data["decisions"].(string))
+					if h := e.Data["requestHeaders"].(string); strings.Contains(h, "Zm9v") {
+						t.Errorf("handle() traced credentials: %s", h)
+					}
+				}
+			}
+
+			if (len(traced) == 1) != tt.wantTrace {
+				t.Fatalf("handle() traces = %v, want trace %v", traced, tt.wantTrace)
+			}
+			if tt.wantTrace && !strings.Contains(traced[0], tt.decision) {
+				t.Errorf("handle() decisions = %v, want %v", traced[0], tt.decision)
+			}
+		})
+	}
+}
+
+func TestFormatHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Depth", "1")
+	h.Set("Authorization", "Basic Zm9vOmJhcg==")
+
+	want := "Authorization: Basic [redacted], Depth: 1"
+	if got := formatHeaders(h); got != want {
+		t.Errorf("formatHeaders() = %v, want %v", got, want)
+	}
+}
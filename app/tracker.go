@@ -0,0 +1,305 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionTimeout is the idle time after which a session isn't reported as active anymore.
+const sessionTimeout = 30 * time.Minute
+
+// errBandwidthExceeded is returned for transfers of a user, whose bandwidth cap blocks them.
+var errBandwidthExceeded = errors.New("bandwidth cap exceeded")
+
+// Transfer describes a request which is currently processed by the server.
+type Transfer struct {
+	ID       uint64    `json:"id"`
+	User     string    `json:"user"`
+	Address  string    `json:"address"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+// Session describes a user which has been recently active from a client address.
+type Session struct {
+	User      string    `json:"user"`
+	Address   string    `json:"address"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Requests  int64     `json:"requests"`
+}
+
+// Tracker keeps track of in-flight requests, open connections and recently active sessions.
+// A nil Tracker is valid and tracks nothing.
+type Tracker struct {
+	mu          sync.Mutex
+	nextID      uint64
+	transfers   map[uint64]*Transfer
+	sessions    map[string]*Session
+	started     time.Time
+	connections int64
+}
+
+// NewTracker creates a new and empty tracker.
+func NewTracker() *Tracker {
+	return &Tracker{
+		transfers: map[uint64]*Transfer{},
+		sessions:  map[string]*Session{},
+		started:   time.Now(),
+	}
+}
+
+// ConnState counts the open connections of an http.Server, whose ConnState it's set as.
+func (t *Tracker) ConnState(c net.Conn, state http.ConnState) {
+	if t == nil {
+		return
+	}
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&t.connections, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&t.connections, -1)
+	}
+}
+
+// Connections returns the number of open connections.
+func (t *Tracker) Connections() int64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.connections)
+}
+
+// Begin registers the request as an active transfer. The returned ResponseWriter must be
+// used to write the response to count the transferred bytes. End must be called with the
+// returned transfer once the request has been processed.
+func (t *Tracker) Begin(w http.ResponseWriter, r *http.Request, address, user string) (*Transfer, http.ResponseWriter) {
+	if t == nil {
+		return nil, w
+	}
+
+	tr := t.begin(r.Method, r.URL.Path, address, user)
+	if r.Body != nil {
+		r.Body = &countingReader{ReadCloser: r.Body, n: &tr.BytesIn}
+	}
+
+	return tr, &countingWriter{ResponseWriter: w, n: &tr.BytesOut}
+}
+
+// begin registers an active transfer of the user from the address.
+func (t *Tracker) begin(method, name, address, user string) *Transfer {
+	now := time.Now()
+	tr := &Transfer{
+		User:    user,
+		Address: address,
+		Method:  method,
+		Path:    name,
+		Started: now,
+	}
+
+	t.mu.Lock()
+	t.nextID++
+	tr.ID = t.nextID
+	t.transfers[tr.ID] = tr
+
+	key := user + "@" + address
+	s := t.sessions[key]
+	if s == nil || now.Sub(s.LastSeen) > sessionTimeout {
+		s = &Session{User: user, Address: address, FirstSeen: now}
+		t.sessions[key] = s
+	}
+	s.LastSeen = now
+	s.Requests++
+	t.mu.Unlock()
+	return tr
+}
+
+// bytes returns the bytes transferred so far.
+func (tr *Transfer) bytes() (in int64, out int64) {
+	return atomic.LoadInt64(&tr.BytesIn), atomic.LoadInt64(&tr.BytesOut)
+}
+
+// End removes the transfer from the list of active transfers.
+func (t *Tracker) End(tr *Transfer) {
+	if t == nil || tr == nil {
+		return
+	}
+
+	t.mu.Lock()
+	delete(t.transfers, tr.ID)
+	t.mu.Unlock()
+}
+
+// Transfers returns a snapshot of all active transfers ordered by their start time.
+func (t *Tracker) Transfers() []Transfer {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	transfers := make([]Transfer, 0, len(t.transfers))
+	for _, tr := range t.transfers {
+		snapshot := *tr
+		snapshot.BytesIn, snapshot.BytesOut = tr.bytes()
+		transfers = append(transfers, snapshot)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].ID < transfers[j].ID })
+	return transfers
+}
+
+// Sessions returns a snapshot of all sessions which were active within the session timeout.
+// Expired sessions are dropped.
+func (t *Tracker) Sessions() []Session {
+	if t == nil {
+		return nil
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	sessions := make([]Session, 0, len(t.sessions))
+	for key, s := range t.sessions {
+		if now.Sub(s.LastSeen) > sessionTimeout {
+			delete(t.sessions, key)
+			continue
+		}
+		sessions = append(sessions, *s)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+	return sessions
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// stream is a transfer of a frontend without HTTP, like FTP and SFTP. It counts the bytes for
+// the admin API, the usage reports and the bandwidth caps like Begin does for HTTP and
+// throttles them, once the user exceeded the bandwidth cap.
+type stream struct {
+	app      *App
+	transfer *Transfer
+	throttle *throttle
+	rate     int64
+}
+
+// beginStream registers the transfer of the file with the name by the command of the user
+// from the address. It returns errBandwidthExceeded, if the bandwidth cap of the user blocks
+// it. end must be called once the transfer is done.
+func (a *App) beginStream(ctx context.Context, command, name, address, user string) (*stream, error) {
+	t, blocked := a.limitBandwidth(ctx, user)
+	if blocked > 0 {
+		return nil, errBandwidthExceeded
+	}
+	tr := &Transfer{User: user, Address: address, Method: command, Path: name, Started: time.Now()}
+	if a.Tracker != nil {
+		tr = a.Tracker.begin(command, name, address, user)
+	}
+	s := &stream{app: a, transfer: tr, throttle: t}
+	if t != nil {
+		s.rate = a.Config.bandwidthRate()
+	}
+	return s, nil
+}
+
+// received counts n bytes received from the client and waits, if they're throttled.
+func (s *stream) received(n int) {
+	atomic.AddInt64(&s.transfer.BytesIn, int64(n))
+	if s.throttle != nil {
+		s.throttle.wait(n, s.rate)
+	}
+}
+
+// sent counts n bytes sent to the client and waits, if they're throttled.
+func (s *stream) sent(n int) {
+	atomic.AddInt64(&s.transfer.BytesOut, int64(n))
+	if s.throttle != nil {
+		s.throttle.wait(n, s.rate)
+	}
+}
+
+// reader returns the reader of the data received from the client.
+func (s *stream) reader(r io.Reader) io.Reader {
+	return &streamReader{Reader: r, stream: s}
+}
+
+// writer returns the writer of the data sent to the client.
+func (s *stream) writer(w io.Writer) io.Writer {
+	return &streamWriter{Writer: w, stream: s}
+}
+
+// end removes the transfer from the active ones and records it.
+func (s *stream) end() {
+	s.app.Tracker.End(s.transfer)
+	s.app.Usage.record(s.transfer)
+	s.app.Bandwidth.record(s.transfer)
+}
+
+type streamReader struct {
+	io.Reader
+	stream *stream
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.stream.throttle != nil && int64(len(p)) > r.stream.rate {
+		p = p[:r.stream.rate]
+	}
+	n, err := r.Reader.Read(p)
+	r.stream.received(n)
+	return n, err
+}
+
+type streamWriter struct {
+	io.Writer
+	stream *stream
+}
+
+// Write writes p in chunks of at most one second of the rate, if it's throttled.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if w.stream.throttle != nil && int64(len(chunk)) > w.stream.rate {
+			chunk = chunk[:w.stream.rate]
+		}
+		n, err := w.Writer.Write(chunk)
+		written += n
+		w.stream.sent(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
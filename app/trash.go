@@ -0,0 +1,405 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the trash
+const (
+	defaultTrashRetention = 30 * 24 * time.Hour
+	defaultTrashInterval  = time.Hour
+
+	// trashItemFile holds the description of a trashed path next to its content.
+	trashItemFile    = "item.json"
+	trashContentName = "content"
+)
+
+var (
+	errNoSuchTrashItem = errors.New("no such item in the trash")
+	errRestoreExists   = errors.New("the path to restore to already exists")
+)
+
+// Trash moves deleted files and directories to Dir instead of removing them, so they can be
+// restored for Retention, 30 days by default. Afterwards, or once the trashed items of a user
+// exceed MaxSize, the oldest ones are purged every Interval, 1h by default. Dir has to be on
+// the file system of the base dir, but outside of it.
+type Trash struct {
+	Dir       string
+	Retention time.Duration
+	MaxSize   ByteSize
+	Interval  time.Duration
+}
+
+// TrashItem is a deleted file or directory of the trash. The path is the one seen by the
+// user, who deleted it, the origin the one relative to the base dir.
+type TrashItem struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user,omitempty"`
+	Path    string    `json:"path"`
+	Origin  string    `json:"origin"`
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// TrashBin holds the deleted files and directories. A nil TrashBin is valid and doesn't keep
+// anything, the paths are removed right away.
+type TrashBin struct {
+	settings *Trash
+	config   *Config
+	quotas   *Quotas
+	sync     *SyncLog
+	replica  *Replicator
+
+	mu     sync.Mutex
+	items  map[string]*TrashItem
+	purged int64
+}
+
+// NewTrashBin creates the trash of the configuration with the items trashed before, which
+// restores paths with the quotas, the sync journal and the replication. It returns nil, if no
+// trash is configured.
+func NewTrashBin(cfg *Config, quotas *Quotas, syncLog *SyncLog, replica *Replicator) (*TrashBin, error) {
+	if cfg.Trash == nil {
+		return nil, nil
+	}
+	t := cfg.Trash
+	switch {
+	case t.Dir == "":
+		return nil, fmt.Errorf("trash requires a directory")
+	case t.Retention < 0 || t.MaxSize < 0:
+		return nil, fmt.Errorf("retention and maximum size of the trash must not be negative")
+	}
+	base, err := filepath.Abs(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(t.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if withinDir(dir, base) || withinDir(base, dir) {
+		return nil, fmt.Errorf("trash %s must be outside of the base dir %s", t.Dir, cfg.Dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// the files of the object store are transferred to the trash anyway
+	if !cfg.dryRun() && cfg.ObjectStore == nil {
+		if err := checkSameFileSystem(base, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &TrashBin{settings: t, config: cfg, quotas: quotas, sync: syncLog, replica: replica, items: map[string]*TrashItem{}}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		data, err := ioutil.ReadFile(filepath.Join(dir, e.Name(), trashItemFile))
+		if err != nil {
+			continue
+		}
+		var item TrashItem
+		if err := json.Unmarshal(data, &item); err != nil || item.ID != e.Name() {
+			log.WithField("path", filepath.Join(dir, e.Name())).Warn("Skipped invalid item of the trash")
+			continue
+		}
+		b.items[item.ID] = &item
+	}
+	return b, nil
+}
+
+// checkSameFileSystem verifies, that files are moved from the base dir to the trash by a
+// rename, so deleting doesn't copy them.
+func checkSameFileSystem(base, dir string) error {
+	f, err := ioutil.TempFile(base, ".dave-trash-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	moved := filepath.Join(dir, filepath.Base(f.Name()))
+	if err := os.Rename(f.Name(), moved); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("trash %s must be on the file system of the base dir %s: %s", dir, base, err)
+	}
+	return os.Remove(moved)
+}
+
+// Start purges the expired items right away and then every interval.
+func (b *TrashBin) Start() {
+	if b == nil {
+		return
+	}
+
+	interval := b.settings.Interval
+	if interval <= 0 {
+		interval = defaultTrashInterval
+	}
+	go func() {
+		b.purgeExpired(time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			b.purgeExpired(now)
+		}
+	}()
+}
+
+// trash moves the physical path, which the user deleted as name, into the trash.
+func (b *TrashBin) trash(ctx context.Context, user, name, physical string) error {
+	fi, err := b.config.storage().Lstat(physical)
+	if err != nil {
+		return err
+	}
+	origin, err := filepath.Rel(filepath.Clean(b.config.Dir), physical)
+	if err != nil {
+		return err
+	}
+	size, _, _, err := treeUsage(b.config.storage(), physical)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	now := time.Now()
+	item := &TrashItem{
+		ID:      fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(id)),
+		User:    user,
+		Path:    path.Clean("/" + name),
+		Origin:  path.Clean("/" + filepath.ToSlash(origin)),
+		Dir:     fi.IsDir(),
+		Size:    size,
+		Deleted: now,
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(b.settings.Dir, item.ID)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, trashItemFile), data, 0600); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := b.config.storage().Rename(physical, filepath.Join(dir, trashContentName)); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	traceStep(ctx, "moved %s to the trash as %s", physical, item.ID)
+
+	b.mu.Lock()
+	b.items[item.ID] = item
+	b.mu.Unlock()
+	b.purgeOversize(user)
+	return nil
+}
+
+// list returns the items of the user, or of all users, if user is nil, latest first.
+func (b *TrashBin) list(user *string) []*TrashItem {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	items := []*TrashItem{}
+	for _, item := range b.items {
+		if user == nil || item.User == *user {
+			copied := *item
+			items = append(items, &copied)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID > items[j].ID })
+	return items
+}
+
+// purge removes the item from the trash for good.
+func (b *TrashBin) purge(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.items[id] == nil {
+		return errNoSuchTrashItem
+	}
+	return b.purgeLocked(id)
+}
+
+// purgeLocked removes the item. b.mu must be held.
+func (b *TrashBin) purgeLocked(id string) error {
+	item := b.items[id]
+	if err := os.RemoveAll(filepath.Join(b.settings.Dir, id)); err != nil {
+		return err
+	}
+	delete(b.items, id)
+	atomic.AddInt64(&b.purged, 1)
+	log.WithFields(log.Fields{"id": id, "path": item.Path, "user": item.User}).Info("Purged item of the trash")
+	return nil
+}
+
+// purgeAll removes the items of the user, or of all users, if user is nil, and returns their
+// number.
+func (b *TrashBin) purgeAll(user *string) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	purged := 0
+	for id, item := range b.items {
+		if user != nil && item.User != *user {
+			continue
+		}
+		if err := b.purgeLocked(id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeExpired removes the items, which have been deleted longer than the retention ago, and
+// the oldest items of the users exceeding the maximum size. Nothing is purged in the
+// read-only mode.
+func (b *TrashBin) purgeExpired(now time.Time) {
+	if b.config.ReadOnly() {
+		return
+	}
+	retention := b.settings.Retention
+	if retention <= 0 {
+		retention = defaultTrashRetention
+	}
+
+	b.mu.Lock()
+	users := map[string]bool{}
+	for id, item := range b.items {
+		users[item.User] = true
+		if now.Sub(item.Deleted) < retention {
+			continue
+		}
+		if err := b.purgeLocked(id); err != nil {
+			log.WithField("id", id).WithError(err).Warn("Error purging expired item of the trash")
+		}
+	}
+	b.mu.Unlock()
+	for user := range users {
+		b.purgeOversize(user)
+	}
+}
+
+// purgeOversize removes the oldest items of the user, until they fit into the maximum size.
+func (b *TrashBin) purgeOversize(user string) {
+	if b.settings.MaxSize <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var items []*TrashItem
+	var size int64
+	for _, item := range b.items {
+		if item.User == user {
+			items = append(items, item)
+			size += item.Size
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	for _, item := range items {
+		if size <= int64(b.settings.MaxSize) {
+			return
+		}
+		if err := b.purgeLocked(item.ID); err != nil {
+			log.WithField("id", item.ID).WithError(err).Warn("Error purging item of the full trash")
+			return
+		}
+		size -= item.Size
+	}
+}
+
+// restore moves the item back to its origin, or to the path relative to the base dir, if it's
+// set, and returns the restored item. Missing parents are created.
+func (b *TrashBin) restore(ctx context.Context, id, to string) (*TrashItem, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	item := b.items[id]
+	if item == nil {
+		return nil, errNoSuchTrashItem
+	}
+	if to == "" {
+		to = item.Origin
+	}
+	to = path.Clean("/" + to)
+	if to == "/" {
+		return nil, os.ErrInvalid
+	}
+	target := filepath.Join(b.config.Dir, filepath.FromSlash(to))
+	if _, err := b.config.storage().Lstat(target); err == nil {
+		return nil, errRestoreExists
+	}
+	if err := b.config.storage().MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	content := filepath.Join(b.settings.Dir, id, trashContentName)
+	revert, err := b.quotas.move(ctx, content, target)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.config.storage().Rename(content, target); err != nil {
+		revert()
+		return nil, err
+	}
+	os.RemoveAll(filepath.Join(b.settings.Dir, id))
+	delete(b.items, id)
+	b.sync.record(target, item.Dir)
+	b.replica.changed(target, item.Dir)
+
+	restored := *item
+	restored.Origin = to
+	log.WithFields(log.Fields{"id": id, "path": to, "user": item.User}).Info("Restored item of the trash")
+	return &restored, nil
+}
+
+// usage returns the number and the size of the trashed items.
+func (b *TrashBin) usage() (items int, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, item := range b.items {
+		items++
+		size += item.Size
+	}
+	return items, size
+}
+
+// RegisterMetrics exposes the size of the trash and the purged items.
+func (b *TrashBin) RegisterMetrics(m *Metrics) {
+	if b == nil {
+		return
+	}
+
+	m.Gauge("dave_trash_items", "Deleted files and directories kept in the trash.", func() []Sample {
+		items, _ := b.usage()
+		return []Sample{{Value: float64(items)}}
+	})
+	m.Gauge("dave_trash_bytes", "Size of the deleted files kept in the trash.", func() []Sample {
+		_, size := b.usage()
+		return []Sample{{Value: float64(size)}}
+	})
+	m.Counter("dave_trash_purged_total", "Items purged from the trash.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&b.purged))}}
+	})
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func newTrashApp(t *testing.T, tmpDir string, trash *Trash) *App {
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:   filepath.Join(tmpDir, "data"),
+		Realm: "dave",
+		Trash: trash,
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+		Admin: &Admin{Users: map[string]*UserInfo{
+			"root": {Password: GenHash([]byte("secret"))},
+		}},
+	}
+	bin, err := NewTrashBin(cfg, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewTrashBin() error = %v", err)
+	}
+	return &App{
+		Config: cfg,
+		Trash:  bin,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg, Trash: bin},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+}
+
+func TestNewTrashBin(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name    string
+		trash   *Trash
+		wantErr bool
+	}{
+		{"disabled", nil, false},
+		{"missing dir", &Trash{}, true},
+		{"within base dir", &Trash{Dir: filepath.Join(tmpDir, "data", "trash")}, true},
+		{"negative retention", &Trash{Dir: filepath.Join(tmpDir, "trash"), Retention: -time.Hour}, true},
+		{"valid", &Trash{Dir: filepath.Join(tmpDir, "trash")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin, err := NewTrashBin(&Config{Dir: filepath.Join(tmpDir, "data"), Trash: tt.trash}, nil, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewTrashBin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.trash == nil && bin != nil {
+				t.Errorf("NewTrashBin() = %v, want nil", bin)
+			}
+		})
+	}
+}
+
+func TestTrashDeleteAndRestore(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice", "docs"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "alice", "docs", "a.txt"), []byte("hello"), 0600)
+
+	a := newTrashApp(t, tmpDir, &Trash{Dir: filepath.Join(tmpDir, "trash")})
+	req := httptest.NewRequest("DELETE", "/docs", nil)
+	req.SetBasicAuth("alice", "password")
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %v, want %v", w.Code, http.StatusNoContent)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "data", "alice", "docs")); !os.IsNotExist(err) {
+		t.Fatalf("deleted directory still exists: %v", err)
+	}
+
+	items := a.Trash.list(nil)
+	if len(items) != 1 || items[0].User != "alice" || items[0].Path != "/docs" || items[0].Origin != "/alice/docs" ||
+		!items[0].Dir || items[0].Size != 5 {
+		t.Fatalf("list() = %+v", items)
+	}
+	reloaded, err := NewTrashBin(a.Config, nil, nil, nil)
+	if err != nil || len(reloaded.list(nil)) != 1 {
+		t.Fatalf("NewTrashBin() of the existing trash = %v, %v", reloaded, err)
+	}
+
+	admin := NewAdminHandler(a)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.SetBasicAuth("root", "secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w
+	}
+	if w := do("GET", "/api/v1/trash?user=bob", ""); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("GET of the trash of another user = %v %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/api/v1/trash/unknown", ""); w.Code != http.StatusNotFound {
+		t.Errorf("POST of a missing item = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice", "docs"), 0700)
+	if w := do("POST", "/api/v1/trash/"+items[0].ID, ""); w.Code != http.StatusConflict {
+		t.Errorf("POST onto an existing path = %v, want %v", w.Code, http.StatusConflict)
+	}
+	w = do("POST", "/api/v1/trash/"+items[0].ID, `{"path":"/alice/restored/docs"}`)
+	var restored TrashItem
+	if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&restored) != nil || restored.Origin != "/alice/restored/docs" {
+		t.Fatalf("POST of the item = %v %+v", w.Code, restored)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(tmpDir, "data", "alice", "restored", "docs", "a.txt")); err != nil || string(data) != "hello" {
+		t.Errorf("restored file = %q, %v", data, err)
+	}
+	if items := a.Trash.list(nil); len(items) != 0 {
+		t.Errorf("list() after restore = %+v", items)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	a := newTrashApp(t, tmpDir, &Trash{Dir: filepath.Join(tmpDir, "trash"), Retention: time.Hour, MaxSize: 10})
+	ctx := context.Background()
+	trash := func(name string, size int) {
+		physical := filepath.Join(tmpDir, "data", "alice", name)
+		ioutil.WriteFile(physical, make([]byte, size), 0600)
+		if err := a.Trash.trash(ctx, "alice", "/"+name, physical); err != nil {
+			t.Fatalf("trash(%s) error = %v", name, err)
+		}
+	}
+	trash("a", 4)
+	trash("b", 4)
+	trash("c", 4)
+	items := a.Trash.list(nil)
+	if len(items) != 2 || items[0].Path != "/c" || items[1].Path != "/b" {
+		t.Fatalf("list() exceeding the maximum size = %+v", items)
+	}
+
+	a.Trash.purgeExpired(time.Now().Add(30 * time.Minute))
+	if items := a.Trash.list(nil); len(items) != 2 {
+		t.Errorf("list() within the retention = %+v", items)
+	}
+	a.Config.SetReadOnly(true)
+	a.Trash.purgeExpired(time.Now().Add(2 * time.Hour))
+	if items := a.Trash.list(nil); len(items) != 2 {
+		t.Errorf("list() after purging in the read-only mode = %+v", items)
+	}
+	a.Config.SetReadOnly(false)
+	a.Trash.purgeExpired(time.Now().Add(2 * time.Hour))
+	if items := a.Trash.list(nil); len(items) != 0 {
+		t.Errorf("list() after the retention = %+v", items)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(tmpDir, "trash")); len(entries) != 0 {
+		t.Errorf("trash dir still contains %v", entries)
+	}
+
+	trash("d", 1)
+	r := httptest.NewRequest("DELETE", "/api/v1/trash?user=alice", nil)
+	r.SetBasicAuth("root", "secret")
+	w := httptest.NewRecorder()
+	NewAdminHandler(a).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"purged":1`) {
+		t.Errorf("DELETE of the trash of alice = %v %s", w.Code, w.Body)
+	}
+}
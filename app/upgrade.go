@@ -0,0 +1,314 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Environment variables, which pass the sockets and the readiness pipe to the process of an
+// upgrade
+const (
+	upgradeSocketsEnv = "DAVE_UPGRADE_SOCKETS"
+	upgradeReadyEnv   = "DAVE_UPGRADE_READY"
+)
+
+// Timeouts of the upgrades
+const (
+	// upgradeReadyTimeout is the time the new process has to open its listeners
+	upgradeReadyTimeout = time.Minute
+	// upgradeDrainTimeout is the time the requests in progress have to complete, before
+	// the old process exits anyway
+	upgradeDrainTimeout = time.Hour
+)
+
+var (
+	errUpgradeInProgress = errors.New("an upgrade is already in progress")
+	errUpgradeDisabled   = errors.New("upgrades aren't enabled")
+)
+
+// activeUpgrader opens the sockets of the listeners, so they can be handed over to the
+// process of an upgrade. It's set once at the start, before any listener is opened.
+var activeUpgrader *Upgrader
+
+// Upgrader hands the listening sockets over to a new process of the binary, so the server
+// is upgraded without refusing connections and without interrupting the transfers in
+// progress: the new process inherits the sockets and tells the old one once its listeners
+// are open, then the old process stops accepting connections and exits after its requests
+// have completed. A nil Upgrader is valid and doesn't upgrade.
+type Upgrader struct {
+	mu sync.Mutex
+	// inherited are the sockets of the previous process by their network and address,
+	// sockets are the sockets of this process, which are passed on
+	inherited map[string]*os.File
+	sockets   map[string]*os.File
+	ready     *os.File
+	servers   []GracefulServer
+	upgrading bool
+
+	done chan struct{}
+}
+
+// NewUpgrader takes over the sockets passed by the previous process, if this process has
+// been started by an upgrade, and opens the sockets of all listeners from now on.
+func NewUpgrader() (*Upgrader, error) {
+	u := &Upgrader{inherited: map[string]*os.File{}, sockets: map[string]*os.File{}, done: make(chan struct{})}
+	if sockets := os.Getenv(upgradeSocketsEnv); sockets != "" {
+		for _, entry := range strings.Split(sockets, ";") {
+			i := strings.LastIndex(entry, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid inherited socket %q", entry)
+			}
+			fd, err := strconv.Atoi(entry[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid inherited socket %q", entry)
+			}
+			u.inherited[entry[:i]] = os.NewFile(uintptr(fd), entry[:i])
+		}
+	}
+	if ready := os.Getenv(upgradeReadyEnv); ready != "" {
+		fd, err := strconv.Atoi(ready)
+		if err != nil {
+			return nil, fmt.Errorf("invalid readiness pipe %q", ready)
+		}
+		u.ready = os.NewFile(uintptr(fd), "ready")
+	}
+	// plugins and later upgrades must not see them
+	os.Unsetenv(upgradeSocketsEnv)
+	os.Unsetenv(upgradeReadyEnv)
+
+	activeUpgrader = u
+	return u, nil
+}
+
+// socketKey identifies a socket by its network and address. Sockets on a random port aren't
+// handed over, since another process wouldn't ask for the same one.
+func socketKey(network, addr string) string {
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "0" || port == "" {
+		return ""
+	}
+	return network + " " + addr
+}
+
+// inherit returns the inherited socket of the key, which is handed out only once.
+// u.mu must be held.
+func (u *Upgrader) inherit(key string) *os.File {
+	f := u.inherited[key]
+	delete(u.inherited, key)
+	return f
+}
+
+// keep remembers the socket of the key for an upgrade. u.mu must be held.
+func (u *Upgrader) keep(key string, socket interface{ File() (*os.File, error) }) {
+	f, err := socket.File()
+	if err != nil {
+		log.WithField("socket", key).WithError(err).Warn("Socket can't be handed over on upgrades")
+		return
+	}
+	if previous := u.sockets[key]; previous != nil {
+		previous.Close()
+	}
+	u.sockets[key] = f
+}
+
+// listen opens a TCP socket or takes over the one of the previous process.
+func listen(network, addr string) (net.Listener, error) {
+	u := activeUpgrader
+	key := socketKey(network, addr)
+	if u == nil || key == "" {
+		return net.Listen(network, addr)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ln net.Listener
+	if f := u.inherit(key); f != nil {
+		var err error
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.WithField("socket", key).WithError(err).Warn("Error taking over socket, opening it anew")
+		}
+	}
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	if socket, ok := ln.(interface{ File() (*os.File, error) }); ok {
+		u.keep(key, socket)
+	}
+	return ln, nil
+}
+
+// listenPacket opens a UDP socket or takes over the one of the previous process.
+func listenPacket(network, addr string) (net.PacketConn, error) {
+	u := activeUpgrader
+	key := socketKey(network, addr)
+	if u == nil || key == "" {
+		return net.ListenPacket(network, addr)
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var conn net.PacketConn
+	if f := u.inherit(key); f != nil {
+		var err error
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			log.WithField("socket", key).WithError(err).Warn("Error taking over socket, opening it anew")
+		}
+	}
+	if conn == nil {
+		var err error
+		if conn, err = net.ListenPacket(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	if socket, ok := conn.(interface{ File() (*os.File, error) }); ok {
+		u.keep(key, socket)
+	}
+	return conn, nil
+}
+
+// GracefulServer is a server, which stops accepting connections and waits for the requests
+// in progress on Shutdown, like an http.Server, and closes all connections on Close.
+type GracefulServer interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// Track lets the server complete its requests in progress, before the process exits after
+// an upgrade or a shutdown.
+func (u *Upgrader) Track(server GracefulServer) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.servers = append(u.servers, server)
+}
+
+// Ready tells the previous process, that the listeners are open, and closes the inherited
+// sockets no listener asked for. The service manager is notified of the main process, so
+// systemd follows the upgrades with NotifyAccess=all.
+func (u *Upgrader) Ready() error {
+	if u == nil {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, f := range u.inherited {
+		log.WithField("socket", key).Info("Closing inherited socket, which isn't configured anymore")
+		f.Close()
+		delete(u.inherited, key)
+	}
+	notifyServiceManager(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+	if u.ready == nil {
+		return nil
+	}
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+	return err
+}
+
+// Upgrade starts the binary anew with the same arguments, hands the sockets over and waits
+// until the new process opened its listeners. It returns the process id of the new process.
+// Afterwards, Done is closed and this process is meant to exit.
+func (u *Upgrader) Upgrade() (int, error) {
+	if u == nil {
+		return 0, errUpgradeDisabled
+	}
+
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return 0, errUpgradeInProgress
+	}
+	u.upgrading = true
+	keys := make([]string, 0, len(u.sockets))
+	for key := range u.sockets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	files := make([]*os.File, len(keys))
+	for i, key := range keys {
+		files[i] = u.sockets[key]
+	}
+	u.mu.Unlock()
+
+	pid, err := startUpgrade(keys, files)
+	if err != nil {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+		return 0, err
+	}
+	log.WithField("pid", pid).Info("Upgraded process took over the listeners")
+	close(u.done)
+	return pid, nil
+}
+
+// Done is closed, once a new process took over the listeners.
+func (u *Upgrader) Done() <-chan struct{} {
+	if u == nil {
+		return nil
+	}
+	return u.done
+}
+
+// Shutdown stops the tracked servers from accepting connections and waits until their
+// requests in progress completed, at most for an hour.
+func (u *Upgrader) Shutdown() {
+	if u == nil {
+		return
+	}
+
+	log.Info("Waiting for the requests in progress to complete")
+	u.drain(upgradeDrainTimeout)
+}
+
+// drain stops the tracked servers from accepting connections and waits until their requests
+// in progress completed, at most for the timeout, before their connections are closed. It
+// returns whether all requests completed.
+func (u *Upgrader) drain(timeout time.Duration) bool {
+	if u == nil {
+		return true
+	}
+
+	u.mu.Lock()
+	servers := u.servers
+	u.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var interrupted int32
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server GracefulServer) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.WithError(err).Warn("Requests still in progress are interrupted")
+				atomic.StoreInt32(&interrupted, 1)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+	return atomic.LoadInt32(&interrupted) == 0
+}
@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// upgradeArgs returns the arguments the binary is started with on upgrades.
+var upgradeArgs = func() []string { return os.Args[1:] }
+
+// startUpgrade starts the binary with the sockets as inherited files and waits until it
+// reports its readiness via a pipe.
+func startUpgrade(keys []string, files []*os.File) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// the inherited files start at 3, after stdin, stdout and stderr
+	entries := make([]string, len(keys))
+	for i, key := range keys {
+		entries[i] = fmt.Sprintf("%s=%d", key, 3+i)
+	}
+	cmd := exec.Command(exe, upgradeArgs()...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		upgradeSocketsEnv+"="+strings.Join(entries, ";"),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, 3+len(files)))
+	cmd.ExtraFiles = append(append([]*os.File{}, files...), w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err == nil {
+			return cmd.Process.Pid, nil
+		}
+		// the pipe is closed without readiness, once the process exited
+		return 0, fmt.Errorf("upgraded process failed to start: %v", <-exited)
+	case <-time.After(upgradeReadyTimeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("upgraded process didn't open its listeners within %s", upgradeReadyTimeout)
+	}
+}
+
+// notifyServiceManager sends the state to systemd, if the process is run by it.
+func notifyServiceManager(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
@@ -0,0 +1,93 @@
+//go:build !windows
+// +build !windows
+
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUpgrade(t *testing.T) {
+	defer func() { activeUpgrader = nil }()
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatalf("NewUpgrader() error = %v", err)
+	}
+
+	// sockets on random ports aren't handed over
+	free, _ := net.Listen("tcp", "127.0.0.1:0")
+	_, port, _ := net.SplitHostPort(free.Addr().String())
+	free.Close()
+	ln, err := (&Listener{Address: "127.0.0.1", Port: port}).Listen()
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	defer func(args func() []string) { upgradeArgs = args }(upgradeArgs)
+	upgradeArgs = func() []string { return []string{"-test.run=^TestUpgradeProcess$"} }
+	t.Setenv("DAVE_UPGRADE_TEST_ADDR", ln.Addr().String())
+	if _, err := u.Upgrade(); err != nil {
+		t.Fatalf("Upgrade() error = %v", err)
+	}
+	select {
+	case <-u.Done():
+	default:
+		t.Errorf("Done() isn't closed after the upgrade")
+	}
+	if _, err := u.Upgrade(); err != errUpgradeInProgress {
+		t.Errorf("second Upgrade() error = %v, want %v", err, errUpgradeInProgress)
+	}
+
+	// the new process accepts the connections, once this one stopped
+	ln.Close()
+	res, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("request after the upgrade error = %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "upgraded" {
+		t.Errorf("response after the upgrade = %q, want upgraded", body)
+	}
+}
+
+// TestUpgradeProcess is the process started by TestUpgrade, which takes over the socket and
+// answers a single request.
+func TestUpgradeProcess(t *testing.T) {
+	addr := os.Getenv("DAVE_UPGRADE_TEST_ADDR")
+	if addr == "" {
+		return
+	}
+	defer func() { activeUpgrader = nil }()
+	u, err := NewUpgrader()
+	if err != nil {
+		t.Fatalf("NewUpgrader() error = %v", err)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	// the socket is still open in the old process, so it can only be inherited
+	ln, err := (&Listener{Address: host, Port: port}).Listen()
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	served := make(chan struct{})
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upgraded"))
+		close(served)
+	}))
+	if err := u.Ready(); err != nil {
+		t.Fatalf("Ready() error = %v", err)
+	}
+	select {
+	case <-served:
+		// let the response reach the client
+		time.Sleep(100 * time.Millisecond)
+	case <-time.After(10 * time.Second):
+		t.Errorf("no request after the upgrade")
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package app
+
+import (
+	"errors"
+	"os"
+)
+
+// startUpgrade fails, since Windows doesn't let processes inherit sockets like files.
+func startUpgrade(keys []string, files []*os.File) (int, error) {
+	return 0, errors.New("upgrades aren't supported on Windows")
+}
+
+func notifyServiceManager(state string) {}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// rejectionState remembers why the checks of the writes, the content scan, the content type
+// check, the upload limits, the append-only directories, the retention, the deletion approval,
+// the read-only mode and the authorizer plugins, rejected a write of a request, so its response is
+// answered with the status of the rejection instead of the generic status of the webdav
+// handler.
+type rejectionState struct {
+	status int
+	method string
+}
+
+func rejectionFromContext(ctx context.Context) *rejectionState {
+	state, _ := ctx.Value(rejectionKey).(*rejectionState)
+	return state
+}
+
+func (s *rejectionState) reject(status int) {
+	if s != nil {
+		s.status = status
+	}
+}
+
+// withRejections prepares the rejection of writes by a request, if writes are checked.
+func (c *Config) withRejections(ctx context.Context, w http.ResponseWriter, req *http.Request) (context.Context, http.ResponseWriter) {
+	if c.ICAP == nil && c.ContentCheck == nil && c.AppendOnly == nil && c.Retention == nil && c.DeletionApproval == nil &&
+		!c.limitsUploads() && !c.ReadOnly() && !c.hasAuthorizers() && !c.restrictsPermissions() && c.Versions == nil && c.Guest == nil &&
+		c.Checksums == nil && c.AtomicUploads == nil {
+		return ctx, w
+	}
+	state := &rejectionState{method: req.Method}
+	return context.WithValue(ctx, rejectionKey, state), &rejectionWriter{ResponseWriter: w, state: state}
+}
+
+// rejectionWriter replaces the error responses of requests, whose upload has been rejected.
+type rejectionWriter struct {
+	http.ResponseWriter
+	state     *rejectionState
+	rewritten bool
+}
+
+func (w *rejectionWriter) WriteHeader(status int) {
+	if status < 400 || w.state.status == 0 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	w.rewritten = true
+	status = w.state.status
+	w.ResponseWriter.WriteHeader(status)
+	_, err := w.ResponseWriter.Write([]byte(fmt.Sprintf("%d %s", status, http.StatusText(status))))
+	if err != nil {
+		log.WithError(err).Error("Error sending rejection response")
+	}
+}
+
+func (w *rejectionWriter) Write(p []byte) (int, error) {
+	if w.rewritten {
+		// the body of the replaced response is dropped
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// uploadRejected returns whether a write has been rejected by a check of the content, so the
+// file hasn't been opened.
+func uploadRejected(err error) bool {
+	return errors.Is(err, errScanRejected) || errors.Is(err, errScanFailed) || errors.Is(err, errContentMismatch) ||
+		errors.Is(err, errChecksumMismatch)
+}
+
+// checkWholeWrite checks a file opened for writing, which is only opened once its content
+// has been checked. It returns the errors opening the file would return, and partial if the
+// file would be modified in place, as only complete contents can be checked. Directories
+// don't need a check.
+func checkWholeWrite(files storage, name string, flag int, partial error) (bool, error) {
+	fi, err := files.Stat(name)
+	switch {
+	case err == nil && fi.IsDir():
+		return true, nil
+	case err == nil && flag&os.O_EXCL != 0:
+		return false, os.ErrExist
+	case err == nil && fi.Size() > 0 && flag&os.O_TRUNC == 0:
+		return false, partial
+	case os.IsNotExist(err) && flag&os.O_CREATE == 0:
+		return false, err
+	}
+	if dir, err := files.Stat(filepath.Dir(name)); err != nil {
+		return false, err
+	} else if !dir.IsDir() {
+		return false, os.ErrNotExist
+	}
+	return false, nil
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// errUploadTooLarge is returned by the writes of an upload exceeding the maximum size.
+	errUploadTooLarge = errors.New("upload exceeds the maximum size")
+	// errUploadNotAllowed is returned for uploads of a denied extension or type.
+	errUploadNotAllowed = errors.New("upload isn't allowed")
+	// errUploadPartial is returned for modifications in place of a file, whose type is checked.
+	errUploadPartial = errors.New("files of checked types can only be written as a whole")
+)
+
+// UploadLimit restricts the files written by any frontend, like PUT, the upload form of the
+// directory listings, S3, FTP and SFTP. Uploads larger than MaxSize are rejected with 413
+// Request Entity Too Large, by their Content-Length or once the content exceeds it. Files whose extension or type, determined
+// by the leading bytes of the content, isn't allowed are rejected with 415 Unsupported Media
+// Type. The extensions and types are allowed, if they match the allowed ones, if any are
+// given, and none of the denied ones. A type may end with a wildcard like image/*. Moving or
+// copying a file to a name of a denied extension is rejected as well.
+type UploadLimit struct {
+	MaxSize           ByteSize
+	AllowedExtensions []string
+	DeniedExtensions  []string
+	AllowedTypes      []string
+	DeniedTypes       []string
+}
+
+// uploadLimit returns the upload limit of the user, which overrides the global one.
+func (cfg *Config) uploadLimit(username string) *UploadLimit {
+	if user := cfg.User(username); user != nil && user.UploadLimit != nil {
+		return user.UploadLimit
+	}
+	cfg.settingsMu.RLock()
+	defer cfg.settingsMu.RUnlock()
+	return cfg.UploadLimit
+}
+
+// limitsUploads returns whether uploads of any user are limited.
+func (cfg *Config) limitsUploads() bool {
+	cfg.settingsMu.RLock()
+	global := cfg.UploadLimit != nil
+	cfg.settingsMu.RUnlock()
+	if global {
+		return true
+	}
+	cfg.usersMu.RLock()
+	defer cfg.usersMu.RUnlock()
+	for _, user := range cfg.Users {
+		if user != nil && user.UploadLimit != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsExtension returns whether files of the name may be uploaded.
+func (l *UploadLimit) allowsExtension(name string) bool {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	matches := func(extensions []string) bool {
+		for _, e := range extensions {
+			if strings.TrimPrefix(strings.ToLower(strings.TrimSpace(e)), ".") == ext {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(l.AllowedExtensions) == 0 || matches(l.AllowedExtensions)) && !matches(l.DeniedExtensions)
+}
+
+// allowsType returns whether contents of the type may be uploaded.
+func (l *UploadLimit) allowsType(t string) bool {
+	return (len(l.AllowedTypes) == 0 || matchesType(t, l.AllowedTypes)) && !matchesType(t, l.DeniedTypes)
+}
+
+// reject logs and traces the rejected upload of the file and rejects the request with the
+// status.
+func (l *UploadLimit) reject(ctx context.Context, name, user string, status int, reason string) {
+	log.WithFields(log.Fields{"path": name, "user": user}).Warn("Rejected upload: " + reason)
+	traceStep(ctx, "upload of %s rejected: %s", name, reason)
+	rejectionFromContext(ctx).reject(status)
+}
+
+// checkRename rejects moving a file of the user to a name of a denied extension.
+func (l *UploadLimit) checkRename(ctx context.Context, name, user string) error {
+	if l == nil || l.allowsExtension(name) {
+		return nil
+	}
+	l.reject(ctx, name, user, http.StatusUnsupportedMediaType, "extension isn't allowed")
+	return errUploadNotAllowed
+}
+
+// checkType returns errUploadNotAllowed, if the content starting with head isn't of an
+// allowed type. Empty contents are accepted, as clients create files before uploading their
+// content.
+func (l *UploadLimit) checkType(name string, head []byte) error {
+	if t := sniffType(head); len(head) > 0 && !l.allowsType(t) {
+		return fmt.Errorf("%w: type %s", errUploadNotAllowed, t)
+	}
+	return nil
+}
+
+// openLimitedFile applies the upload limit to the file of the user opened for writing by
+// open. Every frontend writes the files through the directory, so the limit applies to PUT,
+// the upload form, the editors, S3, FTP and SFTP alike. A name of a denied extension is
+// rejected right away, a content of a denied type once its leading bytes have been written
+// and a content exceeding the maximum size once it's written beyond it.
+func (l *UploadLimit) openLimitedFile(ctx context.Context, files storage, name, user string, flag int, open func() (webdav.File, error)) (webdav.File, error) {
+	if !l.allowsExtension(name) {
+		l.reject(ctx, name, user, http.StatusUnsupportedMediaType, "extension isn't allowed")
+		return nil, errUploadNotAllowed
+	}
+	limited := open
+	if l.MaxSize > 0 {
+		limited = func() (webdav.File, error) {
+			f, err := open()
+			if err != nil {
+				return nil, err
+			}
+			lf := &limitedFile{File: f, ctx: ctx, limit: l, name: name, user: user}
+			if flag&os.O_APPEND != 0 {
+				if fi, err := f.Stat(); err == nil {
+					lf.offset = fi.Size()
+				}
+			}
+			return lf, nil
+		}
+	}
+	if len(l.AllowedTypes) == 0 && len(l.DeniedTypes) == 0 {
+		return limited()
+	}
+	if dir, err := checkWholeWrite(files, name, flag, errUploadPartial); err != nil {
+		return nil, err
+	} else if dir {
+		return open()
+	}
+	return &checkedFile{ctx: ctx, check: l.checkType, name: name, user: user, status: http.StatusUnsupportedMediaType, open: limited}, nil
+}
+
+// limitedFile fails with errUploadTooLarge once it's written beyond the maximum size, so the
+// request is rejected with 413 Request Entity Too Large.
+type limitedFile struct {
+	webdav.File
+	ctx    context.Context
+	limit  *UploadLimit
+	name   string
+	user   string
+	offset int64
+}
+
+func (f *limitedFile) Write(p []byte) (int, error) {
+	if f.offset+int64(len(p)) > int64(f.limit.MaxSize) {
+		f.limit.reject(f.ctx, f.name, f.user, http.StatusRequestEntityTooLarge, "size exceeds "+f.limit.MaxSize.String())
+		return 0, errUploadTooLarge
+	}
+	n, err := f.File.Write(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *limitedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	if err == nil {
+		f.offset = pos
+	}
+	return pos, err
+}
+
+// checkUploadLimit answers a PUT, whose Content-Length exceeds the maximum size of the upload
+// limit of the user, with 413 Request Entity Too Large right away and returns whether the
+// request may proceed. The rest of the limit applies once the file is written.
+func (a *App) checkUploadLimit(ctx context.Context, w http.ResponseWriter, req *http.Request, username string) bool {
+	limit := a.Config.uploadLimit(username)
+	if limit == nil || req.Method != http.MethodPut || limit.MaxSize <= 0 || req.ContentLength <= int64(limit.MaxSize) {
+		return true
+	}
+	name := req.URL.Path
+	if p, ok := a.relativePath(req); ok {
+		name = p
+	}
+	limit.reject(ctx, name, username, http.StatusRequestEntityTooLarge, "size exceeds "+limit.MaxSize.String())
+	a.Config.writeError(w, req, http.StatusRequestEntityTooLarge)
+	return false
+}
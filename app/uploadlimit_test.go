@@ -0,0 +1,99 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadLimitAllows(t *testing.T) {
+	l := &UploadLimit{
+		AllowedExtensions: []string{".JPG", "png", "txt"},
+		DeniedExtensions:  []string{"txt"},
+		AllowedTypes:      []string{"image/*", "text/plain"},
+		DeniedTypes:       []string{"image/gif"},
+	}
+	extensions := map[string]bool{"/a.jpg": true, "/b/c.PNG": true, "/d.txt": false, "/e.exe": false, "/f": false}
+	for name, want := range extensions {
+		if got := l.allowsExtension(name); got != want {
+			t.Errorf("allowsExtension(%s) = %v, want %v", name, got, want)
+		}
+	}
+	types := map[string]bool{"image/png": true, "text/plain": true, "image/gif": false, "application/x-elf": false}
+	for typ, want := range types {
+		if got := l.allowsType(typ); got != want {
+			t.Errorf("allowsType(%s) = %v, want %v", typ, got, want)
+		}
+	}
+}
+
+func TestUploadLimitHandler(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a.txt"), []byte("a"), 0600)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...)
+	tests := []struct {
+		name    string
+		user    string
+		method  string
+		target  string
+		dest    string
+		body    []byte
+		chunked bool
+		want    int
+	}{
+		{"allowed", "alice", "PUT", "/b.txt", "", []byte("hello"), false, http.StatusCreated},
+		{"exactly the maximum", "alice", "PUT", "/c.txt", "", bytes.Repeat([]byte("x"), 10), true, http.StatusCreated},
+		{"content length", "alice", "PUT", "/d.txt", "", bytes.Repeat([]byte("x"), 11), false, http.StatusRequestEntityTooLarge},
+		{"body", "alice", "PUT", "/e.txt", "", bytes.Repeat([]byte("x"), 11), true, http.StatusRequestEntityTooLarge},
+		{"denied extension", "alice", "PUT", "/f.exe", "", []byte("hello"), false, http.StatusUnsupportedMediaType},
+		{"denied type", "alice", "PUT", "/g.txt", "", []byte("\x7fELF\x02\x01\x01"), false, http.StatusUnsupportedMediaType},
+		{"move to denied extension", "alice", "MOVE", "/a.txt", "/a.exe", nil, false, http.StatusUnsupportedMediaType},
+		{"user override", "bob", "PUT", "/h.png", "", png, false, http.StatusCreated},
+		{"user override type", "bob", "PUT", "/i.png", "", []byte("hello"), false, http.StatusUnsupportedMediaType},
+	}
+	cfg := &Config{
+		Dir:         tmpDir,
+		UploadLimit: &UploadLimit{MaxSize: 10, DeniedExtensions: []string{"exe"}, DeniedTypes: []string{"application/x-elf"}},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password"))},
+			"bob":   {Password: GenHash([]byte("password")), UploadLimit: &UploadLimit{AllowedTypes: []string{"image/*"}}},
+		},
+	}
+	a := newQuotaApp(t, cfg)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = bytes.NewReader(tt.body)
+			if tt.chunked {
+				// hides the length from the request
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, body)
+			req.SetBasicAuth(tt.user, "password")
+			if tt.dest != "" {
+				req.Header.Set("Destination", "http://example.com"+tt.dest)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, req, a)
+			if w.Code != tt.want {
+				t.Fatalf("%s %s = %d %s, want %d", tt.method, tt.target, w.Code, w.Body.String(), tt.want)
+			}
+			if tt.method == "PUT" && tt.want != http.StatusCreated && !strings.HasSuffix(tt.name, "body") {
+				if _, err := os.Stat(filepath.Join(tmpDir, tt.target)); !os.IsNotExist(err) {
+					t.Errorf("rejected upload %s has been written", tt.target)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Settings of the usage accounting
+const (
+	usageDateLayout    = "2006-01-02"
+	usageFlushInterval = time.Minute
+)
+
+// Usage configures the accounting of the storage and transfer usage per user, which is
+// persisted in daily records for billing and capacity planning.
+type Usage struct {
+	File string
+}
+
+// UsageRecord is the usage of a user on a single day. The stored bytes and files are taken
+// from the subdir of the user once per day.
+type UsageRecord struct {
+	Date        string `json:"date"`
+	User        string `json:"user"`
+	Requests    int64  `json:"requests"`
+	BytesIn     int64  `json:"bytesIn"`
+	BytesOut    int64  `json:"bytesOut"`
+	StoredBytes int64  `json:"storedBytes"`
+	StoredFiles int64  `json:"storedFiles"`
+}
+
+// UsageSummary is the usage of a user over a date range. The stored bytes and files are the
+// ones of the last day within the range.
+type UsageSummary struct {
+	User            string `json:"user"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Requests        int64  `json:"requests"`
+	BytesIn         int64  `json:"bytesIn"`
+	BytesOut        int64  `json:"bytesOut"`
+	StoredBytes     int64  `json:"storedBytes"`
+	StoredFiles     int64  `json:"storedFiles"`
+	PeakStoredBytes int64  `json:"peakStoredBytes"`
+}
+
+// UsageRecorder accounts the transfers of all requests and the storage of the users in daily
+// records, which are flushed to the usage file periodically. A nil UsageRecorder is valid and
+// records nothing.
+type UsageRecorder struct {
+	config *Config
+	path   string
+
+	mu       sync.Mutex
+	records  map[string]*UsageRecord
+	snapshot string
+	dirty    bool
+}
+
+// NewUsageRecorder creates a recorder, which continues the records of the usage file. It
+// returns nil, if the usage accounting isn't configured.
+func NewUsageRecorder(cfg *Config) (*UsageRecorder, error) {
+	if cfg.Usage == nil || cfg.Usage.File == "" {
+		return nil, nil
+	}
+
+	records, err := ReadUsage(cfg.Usage.File)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	u := &UsageRecorder{config: cfg, path: cfg.Usage.File, records: map[string]*UsageRecord{}}
+	for i := range records {
+		r := records[i]
+		u.records[r.Date+"/"+r.User] = &r
+	}
+	return u, nil
+}
+
+// Start takes a snapshot of the storage of the users and flushes the records periodically.
+func (u *UsageRecorder) Start() {
+	if u == nil {
+		return
+	}
+
+	u.snapshotStorage(time.Now())
+	go func() {
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			u.snapshotStorage(now)
+			if err := u.flush(); err != nil {
+				log.WithField("path", u.path).WithError(err).Error("Error writing usage file")
+			}
+		}
+	}()
+}
+
+// record adds a finished transfer to the record of its user.
+func (u *UsageRecorder) record(tr *Transfer) {
+	if u == nil || tr == nil {
+		return
+	}
+
+	in, out := tr.bytes()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	r := u.recordLocked(time.Now().Format(usageDateLayout), tr.User)
+	r.Requests++
+	r.BytesIn += in
+	r.BytesOut += out
+	u.dirty = true
+}
+
+func (u *UsageRecorder) recordLocked(date, user string) *UsageRecord {
+	key := date + "/" + user
+	r := u.records[key]
+	if r == nil {
+		r = &UsageRecord{Date: date, User: user}
+		u.records[key] = r
+	}
+	return r
+}
+
+// snapshotStorage determines the storage of all users with a subdir once per day. Users
+// without subdir share the base directory, so their storage can't be accounted.
+func (u *UsageRecorder) snapshotStorage(now time.Time) {
+	date := now.Format(usageDateLayout)
+	u.mu.Lock()
+	done := u.snapshot == date
+	u.mu.Unlock()
+	if done {
+		return
+	}
+
+	stored := map[string][2]int64{}
+	for name, user := range u.config.UsersCopy() {
+		if user == nil || user.Subdir == nil {
+			continue
+		}
+		bytes, files, _, err := treeUsage(u.config.storage(), filepath.Join(u.config.Dir, *user.Subdir))
+		if err != nil {
+			log.WithField("user", name).WithError(err).Warn("Error determining storage of user")
+			continue
+		}
+		stored[name] = [2]int64{bytes, files}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, s := range stored {
+		r := u.recordLocked(date, name)
+		r.StoredBytes, r.StoredFiles = s[0], s[1]
+	}
+	u.snapshot = date
+	u.dirty = true
+}
+
+// Records returns all records ordered by date and user.
+func (u *UsageRecorder) Records() []UsageRecord {
+	if u == nil {
+		return nil
+	}
+
+	u.mu.Lock()
+	records := make([]UsageRecord, 0, len(u.records))
+	for _, r := range u.records {
+		records = append(records, *r)
+	}
+	u.mu.Unlock()
+
+	sortUsage(records)
+	return records
+}
+
+// flush writes the records to the usage file, if they have changed. The file is replaced
+// atomically, so a crash doesn't leave a truncated file behind.
+func (u *UsageRecorder) flush() error {
+	u.mu.Lock()
+	dirty := u.dirty
+	u.dirty = false
+	u.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(u.Records(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := u.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.path)
+}
+
+// ReadUsage reads the records of a usage file.
+func ReadUsage(path string) ([]UsageRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []UsageRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("invalid usage file %s: %s", path, err)
+	}
+	return records, nil
+}
+
+// UsageReport sums up the records of each user from the first to the last day of the range,
+// which are given like 2006-01-02.
+func UsageReport(records []UsageRecord, from, to string) []UsageSummary {
+	records = append([]UsageRecord{}, records...)
+	sortUsage(records)
+
+	summaries := map[string]*UsageSummary{}
+	var users []string
+	for _, r := range records {
+		if r.Date < from || r.Date > to {
+			continue
+		}
+		s := summaries[r.User]
+		if s == nil {
+			s = &UsageSummary{User: r.User, From: from, To: to}
+			summaries[r.User] = s
+			users = append(users, r.User)
+		}
+		s.Requests += r.Requests
+		s.BytesIn += r.BytesIn
+		s.BytesOut += r.BytesOut
+		if r.StoredBytes != 0 || r.StoredFiles != 0 {
+			s.StoredBytes, s.StoredFiles = r.StoredBytes, r.StoredFiles
+		}
+		if r.StoredBytes > s.PeakStoredBytes {
+			s.PeakStoredBytes = r.StoredBytes
+		}
+	}
+
+	sort.Strings(users)
+	report := make([]UsageSummary, 0, len(users))
+	for _, user := range users {
+		report = append(report, *summaries[user])
+	}
+	return report
+}
+
+// WriteUsageCSV writes the report as CSV with a header line.
+func WriteUsageCSV(w io.Writer, report []UsageSummary) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"user", "from", "to", "requests", "bytesIn", "bytesOut", "storedBytes", "storedFiles", "peakStoredBytes"})
+	for _, s := range report {
+		cw.Write([]string{
+			s.User,
+			s.From,
+			s.To,
+			strconv.FormatInt(s.Requests, 10),
+			strconv.FormatInt(s.BytesIn, 10),
+			strconv.FormatInt(s.BytesOut, 10),
+			strconv.FormatInt(s.StoredBytes, 10),
+			strconv.FormatInt(s.StoredFiles, 10),
+			strconv.FormatInt(s.PeakStoredBytes, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ParseUsageRange validates the date range of a report. Missing dates default to the first
+// day of the current month and today.
+func ParseUsageRange(from, to string, now time.Time) (string, string, error) {
+	if from == "" {
+		from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).Format(usageDateLayout)
+	}
+	if to == "" {
+		to = now.Format(usageDateLayout)
+	}
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse(usageDateLayout, date); err != nil {
+			return "", "", fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	if from > to {
+		return "", "", fmt.Errorf("date range from %s to %s is empty", from, to)
+	}
+	return from, to, nil
+}
+
+func sortUsage(records []UsageRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Date != records[j].Date {
+			return records[i].Date < records[j].Date
+		}
+		return records[i].User < records[j].User
+	})
+}
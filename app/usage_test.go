@@ -0,0 +1,121 @@
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUsageReport(t *testing.T) {
+	records := []UsageRecord{
+		{Date: "2026-02-01", User: "foo", Requests: 99, BytesIn: 99},
+		{Date: "2026-03-02", User: "foo", Requests: 2, BytesIn: 20, BytesOut: 200, StoredBytes: 500, StoredFiles: 5},
+		{Date: "2026-03-01", User: "foo", Requests: 1, BytesIn: 10, BytesOut: 100, StoredBytes: 800, StoredFiles: 8},
+		{Date: "2026-03-03", User: "foo", Requests: 3},
+		{Date: "2026-03-01", User: "bar", Requests: 4, BytesOut: 40},
+	}
+
+	want := []UsageSummary{
+		{User: "bar", From: "2026-03-01", To: "2026-03-31", Requests: 4, BytesOut: 40},
+		{User: "foo", From: "2026-03-01", To: "2026-03-31", Requests: 6, BytesIn: 30, BytesOut: 300,
+			StoredBytes: 500, StoredFiles: 5, PeakStoredBytes: 800},
+	}
+	if got := UsageReport(records, "2026-03-01", "2026-03-31"); !reflect.DeepEqual(got, want) {
+		t.Errorf("UsageReport() = %v, want %v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteUsageCSV(&buf, want); err != nil {
+		t.Fatalf("WriteUsageCSV() error = %v", err)
+	}
+	wantCSV := "user,from,to,requests,bytesIn,bytesOut,storedBytes,storedFiles,peakStoredBytes\n" +
+		"bar,2026-03-01,2026-03-31,4,0,40,0,0,0\n" +
+		"foo,2026-03-01,2026-03-31,6,30,300,500,5,800\n"
+	if got := buf.String(); got != wantCSV {
+		t.Errorf("WriteUsageCSV() = %q, want %q", got, wantCSV)
+	}
+}
+
+func TestParseUsageRange(t *testing.T) {
+	now := time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		from, to string
+		wantFrom string
+		wantTo   string
+		wantErr  bool
+	}{
+		{"defaults", "", "", "2026-03-01", "2026-03-15", false},
+		{"explicit", "2026-01-01", "2026-01-31", "2026-01-01", "2026-01-31", false},
+		{"invalid date", "2026-1-1", "", "", "", true},
+		{"empty range", "2026-03-02", "2026-03-01", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := ParseUsageRange(tt.from, tt.to, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseUsageRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if from != tt.wantFrom || to != tt.wantTo {
+				t.Errorf("ParseUsageRange() = %v, %v, want %v, %v", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestUsageRecorder(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "foo"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "foo", "a"), make([]byte, 100), 0600)
+
+	subdir := "foo"
+	cfg := &Config{
+		Dir:   filepath.Join(tmpDir, "data"),
+		Users: map[string]*UserInfo{"foo": {Subdir: &subdir}, "bar": {}},
+		Usage: &Usage{File: filepath.Join(tmpDir, "usage.json")},
+	}
+	u, err := NewUsageRecorder(cfg)
+	if err != nil {
+		t.Fatalf("NewUsageRecorder() error = %v", err)
+	}
+
+	now := time.Now()
+	today := now.Format(usageDateLayout)
+	u.snapshotStorage(now)
+	u.record(&Transfer{User: "foo", BytesIn: 10, BytesOut: 20})
+	u.record(&Transfer{User: "foo", BytesIn: 1})
+	u.record(&Transfer{User: "bar", BytesOut: 5})
+	if err := u.flush(); err != nil {
+		t.Fatalf("UsageRecorder.flush() error = %v", err)
+	}
+
+	want := []UsageRecord{
+		{Date: today, User: "bar", Requests: 1, BytesOut: 5},
+		{Date: today, User: "foo", Requests: 2, BytesIn: 11, BytesOut: 20, StoredBytes: 100, StoredFiles: 1},
+	}
+	if got := u.Records(); !reflect.DeepEqual(got, want) {
+		t.Errorf("UsageRecorder.Records() = %v, want %v", got, want)
+	}
+
+	// a restarted server continues the records of the file
+	u, err = NewUsageRecorder(cfg)
+	if err != nil {
+		t.Fatalf("NewUsageRecorder() error = %v", err)
+	}
+	u.record(&Transfer{User: "bar", BytesOut: 5})
+	want[0].Requests, want[0].BytesOut = 2, 10
+	if got := u.Records(); !reflect.DeepEqual(got, want) {
+		t.Errorf("UsageRecorder.Records() after restart = %v, want %v", got, want)
+	}
+
+	if u, err := NewUsageRecorder(&Config{}); u != nil || err != nil {
+		t.Errorf("NewUsageRecorder() without usage file = %v, %v, want nil", u, err)
+	}
+}
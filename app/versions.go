@@ -0,0 +1,321 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the versioning
+const (
+	defaultVersionsName      = ".versions"
+	defaultVersionsKeep      = 10
+	defaultVersionsRetention = 30 * 24 * time.Hour
+	defaultVersionsInterval  = time.Hour
+
+	// versionTimeFormat is the time of a version in its name, which sorts like the times.
+	versionTimeFormat = "20060102T150405.000000000Z"
+)
+
+var errVersionsReadOnly = errors.New("versions are read-only")
+
+// Versions keeps the previous content of overwritten and deleted files in Dir, which has to be on the file
+// system of the base dir, but outside of it. The versions of a file are named like the file
+// with the time they were replaced, e.g. report.txt@20240102T150405.000000000Z. Up to Keep
+// versions, 10 by default, are kept per file for Retention, 30 days by default, the others are
+// purged every Interval, 1h by default. The versions of the files of a user are mapped as
+// read-only collection Name, .versions by default, into the root of the user, so they can be
+// listed, downloaded and restored by copying them back.
+type Versions struct {
+	Dir       string
+	Name      string
+	Keep      int
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+// VersionStore keeps the versions of the overwritten and deleted files. A nil VersionStore is valid and
+// keeps nothing.
+type VersionStore struct {
+	settings *Versions
+	config   *Config
+	dir      string
+
+	// mu serializes keeping and purging versions, so purging doesn't remove the directory a
+	// version is moved into.
+	mu     sync.Mutex
+	kept   int64
+	purged int64
+}
+
+// NewVersionStore creates the version store of the configuration. It returns nil, if no
+// versioning is configured.
+func NewVersionStore(cfg *Config) (*VersionStore, error) {
+	if cfg.Versions == nil {
+		return nil, nil
+	}
+	v := cfg.Versions
+	switch {
+	case v.Dir == "":
+		return nil, fmt.Errorf("versioning requires a directory")
+	case v.Keep < 0 || v.Retention < 0:
+		return nil, fmt.Errorf("number and retention of the versions must not be negative")
+	case strings.ContainsAny(v.name(), `/\`) || v.name() == "." || v.name() == "..":
+		return nil, fmt.Errorf("invalid name %q of the versions", v.name())
+	}
+	base, err := filepath.Abs(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(v.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if withinDir(dir, base) || withinDir(base, dir) {
+		return nil, fmt.Errorf("versions %s must be outside of the base dir %s", v.Dir, cfg.Dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// the files of the object store are transferred to the versions anyway
+	if !cfg.dryRun() && cfg.ObjectStore == nil {
+		if err := checkSameFileSystem(base, dir); err != nil {
+			return nil, err
+		}
+	}
+	return &VersionStore{settings: v, config: cfg, dir: dir}, nil
+}
+
+// name returns the name of the versions within the root of the users.
+func (v *Versions) name() string {
+	if v.Name == "" {
+		return defaultVersionsName
+	}
+	return v.Name
+}
+
+// Start purges the expired versions right away and then every interval.
+func (s *VersionStore) Start() {
+	if s == nil {
+		return
+	}
+
+	interval := s.settings.Interval
+	if interval <= 0 {
+		interval = defaultVersionsInterval
+	}
+	go func() {
+		s.purgeExpired(time.Now())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.purgeExpired(now)
+		}
+	}()
+}
+
+// resolve returns the physical path of the name within the versions of a user with the subdir,
+// if the name is within the versions.
+func (s *VersionStore) resolve(subdir, name string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	clean := path.Clean("/" + name)
+	prefix := "/" + s.settings.name()
+	if clean != prefix && !strings.HasPrefix(clean, prefix+"/") {
+		return "", false
+	}
+	root := filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+subdir)))
+	if clean == prefix {
+		// the versions of a user exist, before the first file of the user is overwritten
+		os.MkdirAll(root, 0700)
+	}
+	return filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(clean, prefix))), true
+}
+
+// contains returns whether the physical path is within the versions.
+func (s *VersionStore) contains(name string) bool {
+	return s != nil && withinDir(name, s.dir)
+}
+
+// keeps reports, whether opening the physical path with the flags overwrites a file, whose
+// content is kept as version then. Nothing is kept for directories, missing files and opens
+// without truncation.
+func (s *VersionStore) keeps(name string, flag int) bool {
+	if s == nil || flag&os.O_TRUNC == 0 || flag&os.O_CREATE == 0 {
+		return false
+	}
+	fi, err := s.config.storage().Lstat(name)
+	return err == nil && fi.Mode().IsRegular() && withinDir(name, filepath.Clean(s.config.Dir))
+}
+
+// keep moves the physical file, which is about to be overwritten, into the versions. The
+// returned function moves it back, if the file can't be written then.
+func (s *VersionStore) keep(ctx context.Context, name string) (func(), error) {
+	rel, err := filepath.Rel(filepath.Clean(s.config.Dir), name)
+	if err != nil {
+		return nil, err
+	}
+	version := filepath.Join(s.dir, rel) + "@" + time.Now().UTC().Format(versionTimeFormat)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(version), 0700); err != nil {
+		return nil, err
+	}
+	if err := s.config.storage().Rename(name, version); err != nil {
+		return nil, err
+	}
+	traceStep(ctx, "kept the previous content of %s as %s", name, version)
+	atomic.AddInt64(&s.kept, 1)
+	s.purgeFile(filepath.Dir(version), filepath.Base(name), time.Now())
+	return func() {
+		if _, err := s.config.storage().Lstat(name); os.IsNotExist(err) {
+			s.config.storage().Rename(version, name)
+		}
+	}, nil
+}
+
+// remove keeps the files of the physical path as versions, before it's removed.
+func (s *VersionStore) remove(ctx context.Context, name string) error {
+	err := s.config.storage().Walk(name, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		_, err = s.keep(ctx, p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.config.storage().RemoveAll(name)
+}
+
+// fileVersion is a kept version of a file.
+type fileVersion struct {
+	path string
+	kept time.Time
+}
+
+// versionsOf returns the versions of the file with the name in the directory of the versions,
+// latest first.
+func versionsOf(dir, name string) []fileVersion {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var versions []fileVersion
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), name+"@") {
+			continue
+		}
+		kept, err := time.Parse(versionTimeFormat, strings.TrimPrefix(e.Name(), name+"@"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, fileVersion{path: filepath.Join(dir, e.Name()), kept: kept})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].kept.After(versions[j].kept) })
+	return versions
+}
+
+// purgeFile removes the versions of the file beyond the number to keep and the expired ones.
+// s.mu must be held.
+func (s *VersionStore) purgeFile(dir, name string, now time.Time) {
+	keep := s.settings.Keep
+	if keep == 0 {
+		keep = defaultVersionsKeep
+	}
+	retention := s.settings.Retention
+	if retention == 0 {
+		retention = defaultVersionsRetention
+	}
+	for i, version := range versionsOf(dir, name) {
+		if i < keep && now.Sub(version.kept) < retention {
+			continue
+		}
+		if err := os.Remove(version.path); err != nil {
+			log.WithField("path", version.path).WithError(err).Warn("Error purging version")
+			continue
+		}
+		atomic.AddInt64(&s.purged, 1)
+	}
+}
+
+// purgeExpired removes the expired versions of all files and the directories left empty.
+// Nothing is purged in the read-only mode.
+func (s *VersionStore) purgeExpired(now time.Time) {
+	if s.config.ReadOnly() {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dirs []string
+	purged := map[string]bool{}
+	filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if fi.IsDir() {
+			if p != s.dir {
+				dirs = append(dirs, p)
+			}
+			return nil
+		}
+		if i := strings.LastIndex(fi.Name(), "@"); i > 0 {
+			if file := filepath.Join(filepath.Dir(p), fi.Name()[:i]); !purged[file] {
+				purged[file] = true
+				s.purgeFile(filepath.Dir(p), fi.Name()[:i], now)
+			}
+		}
+		return nil
+	})
+	// the deepest directories are removed first, so their parents may become empty
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
+
+// checkVersions returns errVersionsReadOnly for writes within the versions.
+func (d Dir) checkVersions(ctx context.Context, name string) error {
+	if !d.Versions.contains(name) {
+		return nil
+	}
+	traceStep(ctx, "rejected write of %s within the versions", name)
+	rejectionFromContext(ctx).reject(http.StatusForbidden)
+	return errVersionsReadOnly
+}
+
+// openVersionsRoot wraps the versions of the user, so they have their name within the root.
+func (d Dir) openVersionsRoot(f webdav.File, name string) webdav.File {
+	if d.Versions == nil || path.Clean("/"+name) != "/"+d.Versions.settings.name() {
+		return f
+	}
+	return &sharedDir{File: f, name: d.Versions.settings.name()}
+}
+
+// RegisterMetrics exposes the number of kept and purged versions.
+func (s *VersionStore) RegisterMetrics(m *Metrics) {
+	if s == nil {
+		return
+	}
+
+	m.Counter("dave_versions_kept_total", "Previous contents of overwritten files kept as versions.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&s.kept))}}
+	})
+	m.Counter("dave_versions_purged_total", "Versions purged after their retention or beyond the number to keep.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&s.purged))}}
+	})
+}
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func newVersionsApp(t *testing.T, tmpDir string, versions *Versions) *App {
+	subdir := "/alice"
+	cfg := &Config{
+		Dir:      filepath.Join(tmpDir, "data"),
+		Realm:    "dave",
+		Versions: versions,
+		Quota:    &Quota{Limit: 1000},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	store, err := NewVersionStore(cfg)
+	if err != nil {
+		t.Fatalf("NewVersionStore() error = %v", err)
+	}
+	quotas, err := NewQuotas(cfg)
+	if err != nil {
+		t.Fatalf("NewQuotas() error = %v", err)
+	}
+	return &App{
+		Config:   cfg,
+		Quotas:   quotas,
+		Versions: store,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg, Quotas: quotas, Versions: store},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+}
+
+func TestNewVersionStore(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name     string
+		versions *Versions
+		wantErr  bool
+	}{
+		{"disabled", nil, false},
+		{"missing dir", &Versions{}, true},
+		{"within base dir", &Versions{Dir: filepath.Join(tmpDir, "data", "versions")}, true},
+		{"negative number", &Versions{Dir: filepath.Join(tmpDir, "versions"), Keep: -1}, true},
+		{"invalid name", &Versions{Dir: filepath.Join(tmpDir, "versions"), Name: "a/b"}, true},
+		{"valid", &Versions{Dir: filepath.Join(tmpDir, "versions")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewVersionStore(&Config{Dir: filepath.Join(tmpDir, "data"), Versions: tt.versions})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewVersionStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.versions == nil && s != nil {
+				t.Errorf("NewVersionStore() = %v, want nil", s)
+			}
+		})
+	}
+}
+
+func TestVersionsOverwriteAndRestore(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "alice", "docs"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	a := newVersionsApp(t, tmpDir, &Versions{Dir: filepath.Join(tmpDir, "versions"), Keep: 2})
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("alice", "password")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	for _, content := range []string{"one", "two", "three", "four"} {
+		if w := do("PUT", "/docs/a.txt", content); w.Code >= 300 {
+			t.Fatalf("PUT of %s = %v", content, w.Code)
+		}
+	}
+	if used := quotaUsed(a); used != 4 {
+		t.Errorf("used quota = %d, want 4", used)
+	}
+	versions := versionsOf(filepath.Join(tmpDir, "versions", "alice", "docs"), "a.txt")
+	if len(versions) != 2 {
+		t.Fatalf("versionsOf() = %+v, want 2 versions", versions)
+	}
+	if data, _ := ioutil.ReadFile(versions[0].path); string(data) != "three" {
+		t.Errorf("latest version = %q, want three", data)
+	}
+
+	w := do("PROPFIND", "/.versions/docs", "", "Depth", "1")
+	name := filepath.Base(versions[1].path)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), name) {
+		t.Fatalf("PROPFIND of the versions = %v %s", w.Code, w.Body)
+	}
+	if w := do("PROPFIND", "/.versions", "", "Depth", "0"); w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "<D:displayname>.versions</D:displayname>") {
+		t.Errorf("PROPFIND of the root of the versions = %v %s", w.Code, w.Body)
+	}
+	if w := do("GET", "/.versions/docs/"+name, ""); w.Code != http.StatusOK || w.Body.String() != "two" {
+		t.Errorf("GET of a version = %v %q", w.Code, w.Body)
+	}
+	if w := do("PUT", "/.versions/docs/x", "x"); w.Code != http.StatusForbidden {
+		t.Errorf("PUT within the versions = %v, want %v", w.Code, http.StatusForbidden)
+	}
+	if w := do("DELETE", "/.versions/docs/"+name, ""); w.Code != http.StatusForbidden {
+		t.Errorf("DELETE within the versions = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	if w := do("COPY", "/.versions/docs/"+name, "", "Destination", "/docs/a.txt", "Overwrite", "T"); w.Code != http.StatusNoContent {
+		t.Fatalf("COPY of a version = %v %s", w.Code, w.Body)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "data", "alice", "docs", "a.txt")); string(data) != "two" {
+		t.Errorf("restored file = %q, want two", data)
+	}
+	versions = versionsOf(filepath.Join(tmpDir, "versions", "alice", "docs"), "a.txt")
+	if len(versions) != 2 {
+		t.Fatalf("versionsOf() after the restore = %+v", versions)
+	}
+	if data, _ := ioutil.ReadFile(versions[0].path); string(data) != "four" {
+		t.Errorf("version kept by the restore = %q, want four", data)
+	}
+
+	if w := do("DELETE", "/docs", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %v", w.Code)
+	}
+	versions = versionsOf(filepath.Join(tmpDir, "versions", "alice", "docs"), "a.txt")
+	if len(versions) != 2 {
+		t.Fatalf("versionsOf() after the deletion = %+v", versions)
+	}
+	if data, _ := ioutil.ReadFile(versions[0].path); string(data) != "two" {
+		t.Errorf("version kept by the deletion = %q, want two", data)
+	}
+
+	a.Versions.purgeExpired(time.Now().Add(31 * 24 * time.Hour))
+	if entries, _ := os.ReadDir(filepath.Join(tmpDir, "versions")); len(entries) != 0 {
+		t.Errorf("versions after the retention = %v", entries)
+	}
+}
@@ -0,0 +1,283 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// webhookTimeout is the time a webhook receiver has to accept an event.
+const webhookTimeout = 5 * time.Second
+
+// Defaults of the event webhooks
+const (
+	defaultWebhookRetries    = 5
+	defaultWebhookBackoff    = time.Second
+	defaultWebhookMaxBackoff = 5 * time.Minute
+	defaultWebhookQueue      = 1000
+)
+
+// Operations of the file events sent to the webhooks
+const (
+	webhookCreate = "create"
+	webhookUpdate = "update"
+	webhookDelete = "delete"
+	webhookRename = "rename"
+)
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the body of an event, keyed by the
+// secret of the endpoint.
+const webhookSignatureHeader = "X-Dave-Signature"
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// postWebhook sends the event as JSON to the URL in the background. Failures are logged, but
+// not retried, so an unavailable receiver doesn't affect the requests.
+func postWebhook(url string, event interface{}) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Error("Error encoding webhook event")
+		return
+	}
+
+	go func() {
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.WithField("url", url).WithError(err).Warn("Error sending webhook event")
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.WithField("url", url).WithField("status", resp.StatusCode).Warn("Webhook receiver rejected event")
+		}
+	}()
+}
+
+// Webhooks posts the files created, updated, deleted and renamed by any frontend as JSON to
+// the Endpoints, so other systems can react to uploads without polling. Failed deliveries are
+// retried up to Retries times, 5 by default, waiting Backoff, 1s by default, doubled after
+// every attempt up to 5m. The events of an endpoint are delivered in order, at most Queue,
+// 1000 by default, are kept while the endpoint is unavailable, further ones are dropped.
+type Webhooks struct {
+	Endpoints []*WebhookEndpoint
+	Retries   int
+	Backoff   time.Duration
+	Queue     int
+}
+
+// WebhookEndpoint is a receiver of the file events. With a Secret, the events are signed by
+// the X-Dave-Signature header, sha256= followed by the hex encoded HMAC-SHA256 of the body.
+// Events limits the operations sent to the endpoint, all of them by default.
+type WebhookEndpoint struct {
+	URL    string
+	Secret string
+	Events []string
+}
+
+// webhookEvent is the payload of a file event. Size is set for created and updated files.
+type webhookEvent struct {
+	Operation   string    `json:"operation"`
+	User        string    `json:"user,omitempty"`
+	Path        string    `json:"path"`
+	Destination string    `json:"destination,omitempty"`
+	Directory   bool      `json:"directory,omitempty"`
+	Size        *int64    `json:"size,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// WebhookDispatcher delivers the file events to the endpoints of the webhooks in the
+// background. A nil WebhookDispatcher is valid and delivers nothing.
+type WebhookDispatcher struct {
+	settings *Webhooks
+	targets  []*webhookTarget
+
+	delivered, failures, dropped int64
+}
+
+// webhookTarget is the queue of the events of an endpoint.
+type webhookTarget struct {
+	endpoint *WebhookEndpoint
+	events   map[string]bool
+	queue    chan *webhookEvent
+}
+
+// NewWebhookDispatcher creates the delivery of the events to the webhooks of the
+// configuration. It returns nil, if no webhooks are configured.
+func NewWebhookDispatcher(cfg *Config) (*WebhookDispatcher, error) {
+	if cfg.Webhooks == nil {
+		return nil, nil
+	}
+	settings := cfg.Webhooks
+	if len(settings.Endpoints) == 0 {
+		return nil, errors.New("webhooks require at least one endpoint")
+	}
+	size := settings.Queue
+	if size <= 0 {
+		size = defaultWebhookQueue
+	}
+
+	d := &WebhookDispatcher{settings: settings}
+	for _, e := range settings.Endpoints {
+		if e == nil || e.URL == "" {
+			return nil, errors.New("webhook endpoints require a URL")
+		}
+		t := &webhookTarget{endpoint: e, queue: make(chan *webhookEvent, size)}
+		if len(e.Events) > 0 {
+			t.events = map[string]bool{}
+			for _, op := range e.Events {
+				switch op {
+				case webhookCreate, webhookUpdate, webhookDelete, webhookRename:
+					t.events[op] = true
+				default:
+					return nil, fmt.Errorf("unknown webhook event %s, use create, update, delete or rename", op)
+				}
+			}
+		}
+		d.targets = append(d.targets, t)
+	}
+	return d, nil
+}
+
+// Start delivers the queued events of every endpoint.
+func (d *WebhookDispatcher) Start() {
+	if d == nil {
+		return
+	}
+
+	for _, t := range d.targets {
+		go func(t *webhookTarget) {
+			for event := range t.queue {
+				d.deliver(t.endpoint, event)
+			}
+		}(t)
+	}
+}
+
+// send queues the event for the endpoints, which receive its operation.
+func (d *WebhookDispatcher) send(event *webhookEvent) {
+	if d == nil {
+		return
+	}
+
+	event.Timestamp = time.Now()
+	for _, t := range d.targets {
+		if t.events != nil && !t.events[event.Operation] {
+			continue
+		}
+		select {
+		case t.queue <- event:
+		default:
+			atomic.AddInt64(&d.dropped, 1)
+			log.WithField("url", t.endpoint.URL).WithField("path", event.Path).Warn("Dropped webhook event, the queue is full")
+		}
+	}
+}
+
+// deliver posts the event to the endpoint, retrying failed attempts with an exponential
+// backoff. Receivers answering with a client error other than 429 Too Many Requests aren't
+// retried.
+func (d *WebhookDispatcher) deliver(e *WebhookEndpoint, event *webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithError(err).Error("Error encoding webhook event")
+		return
+	}
+	retries := d.settings.Retries
+	if retries <= 0 {
+		retries = defaultWebhookRetries
+	}
+	backoff := d.settings.Backoff
+	if backoff <= 0 {
+		backoff = defaultWebhookBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		status, err := postSignedWebhook(e, event.Operation, body)
+		if err == nil && status < 300 {
+			atomic.AddInt64(&d.delivered, 1)
+			return
+		}
+		atomic.AddInt64(&d.failures, 1)
+		entry := log.WithFields(log.Fields{"url": e.URL, "path": event.Path, "attempt": attempt + 1})
+		if err != nil {
+			entry = entry.WithError(err)
+		} else {
+			entry = entry.WithField("status", status)
+		}
+		if attempt >= retries || (err == nil && status < 500 && status != http.StatusTooManyRequests) {
+			entry.Error("Giving up on webhook event")
+			return
+		}
+		entry.Warn("Error sending webhook event, retrying")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > defaultWebhookMaxBackoff {
+			backoff = defaultWebhookMaxBackoff
+		}
+	}
+}
+
+// notify sends the event of a change of a physical file to the webhooks. The paths are the
+// ones of the file system of dave, like the ones of the events of the plugins.
+func (d Dir) notify(ctx context.Context, event *webhookEvent) {
+	if d.Webhooks == nil {
+		return
+	}
+	event.User = d.resolveUser(ctx)
+	event.Path = d.pluginPath(event.Path)
+	if event.Destination != "" {
+		event.Destination = d.pluginPath(event.Destination)
+	}
+	d.Webhooks.send(event)
+}
+
+// postSignedWebhook posts the body to the endpoint and returns the status of the response.
+func postSignedWebhook(e *WebhookEndpoint, operation string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dave-Event", operation)
+	if e.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, webhookSignature(e.Secret, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// webhookSignature returns the value of the signature header of the body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// RegisterMetrics exposes the delivered, failed and dropped events.
+func (d *WebhookDispatcher) RegisterMetrics(m *Metrics) {
+	if d == nil {
+		return
+	}
+
+	m.Counter("dave_webhook_deliveries_total", "File events delivered to the webhooks.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&d.delivered))}}
+	})
+	m.Counter("dave_webhook_failures_total", "Failed attempts to deliver a file event to a webhook.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&d.failures))}}
+	})
+	m.Counter("dave_webhook_dropped_total", "File events dropped, as the queue of a webhook was full.", func() []Sample {
+		return []Sample{{Value: float64(atomic.LoadInt64(&d.dropped))}}
+	})
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookEvents(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	received := make(chan webhookEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if got := r.Header.Get(webhookSignatureHeader); got != webhookSignature("secret", body) {
+			t.Errorf("signature = %s, want the HMAC of the body", got)
+		}
+		var event webhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("invalid event %s: %v", body, err)
+		}
+		if r.Header.Get("X-Dave-Event") != event.Operation {
+			t.Errorf("X-Dave-Event = %s, want %s", r.Header.Get("X-Dave-Event"), event.Operation)
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Dir: tmpDir, Webhooks: &Webhooks{Endpoints: []*WebhookEndpoint{{URL: srv.URL, Secret: "secret"}}}}
+	webhooks, err := NewWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher() error = %v", err)
+	}
+	webhooks.Start()
+	d := Dir{Config: cfg, Webhooks: webhooks}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "alice", Authenticated: true})
+
+	write := func(name, content string) {
+		f, err := d.OpenFile(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatalf("OpenFile(%s) error = %v", name, err)
+		}
+		f.Write([]byte(content))
+		f.Close()
+	}
+	d.Mkdir(ctx, "/docs", 0755)
+	write("/docs/a.txt", "hello")
+	write("/docs/a.txt", "hello world")
+	d.Rename(ctx, "/docs/a.txt", "/docs/b.txt")
+	d.RemoveAll(ctx, "/docs/b.txt")
+
+	size := func(n int64) *int64 { return &n }
+	want := []webhookEvent{
+		{Operation: webhookCreate, Path: "/docs", Directory: true},
+		{Operation: webhookCreate, Path: "/docs/a.txt", Size: size(5)},
+		{Operation: webhookUpdate, Path: "/docs/a.txt", Size: size(11)},
+		{Operation: webhookRename, Path: "/docs/a.txt", Destination: "/docs/b.txt"},
+		{Operation: webhookDelete, Path: "/docs/b.txt"},
+	}
+	for _, w := range want {
+		select {
+		case got := <-received:
+			if got.Operation != w.Operation || got.Path != w.Path || got.Destination != w.Destination || got.Directory != w.Directory ||
+				(got.Size == nil) != (w.Size == nil) || (got.Size != nil && *got.Size != *w.Size) || got.User != "alice" || got.Timestamp.IsZero() {
+				t.Errorf("event = %+v, want %+v", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %+v wasn't delivered", w)
+		}
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+	}{
+		{"delivered", []int{http.StatusOK}, 1},
+		{"retried", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent}, 3},
+		{"rejected", []int{http.StatusBadRequest}, 1},
+		{"given up", []int{500, 500, 500, 500}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[attempts])
+				attempts++
+			}))
+			defer srv.Close()
+
+			d, err := NewWebhookDispatcher(&Config{Webhooks: &Webhooks{
+				Endpoints: []*WebhookEndpoint{{URL: srv.URL}},
+				Retries:   2,
+				Backoff:   time.Millisecond,
+			}})
+			if err != nil {
+				t.Fatalf("NewWebhookDispatcher() error = %v", err)
+			}
+			d.deliver(d.targets[0].endpoint, &webhookEvent{Operation: webhookCreate, Path: "/a.txt"})
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestNewWebhookDispatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		webhooks *Webhooks
+		wantNil  bool
+		wantErr  bool
+	}{
+		{"disabled", nil, true, false},
+		{"without endpoints", &Webhooks{}, true, true},
+		{"without URL", &Webhooks{Endpoints: []*WebhookEndpoint{{Secret: "secret"}}}, true, true},
+		{"unknown event", &Webhooks{Endpoints: []*WebhookEndpoint{{URL: "http://127.0.0.1/", Events: []string{"read"}}}}, true, true},
+		{"events", &Webhooks{Endpoints: []*WebhookEndpoint{{URL: "http://127.0.0.1/", Events: []string{"create", "rename"}}}}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewWebhookDispatcher(&Config{Webhooks: tt.webhooks})
+			if (err != nil) != tt.wantErr || (d == nil) != tt.wantNil {
+				t.Errorf("NewWebhookDispatcher() = %v, %v, want nil %v, error %v", d, err, tt.wantNil, tt.wantErr)
+			}
+		})
+	}
+}
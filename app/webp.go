@@ -0,0 +1,308 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// WebP images are written losslessly (VP8L), as the standard library and golang.org/x/image
+// only decode them. The encoder applies the subtract green transform and codes every pixel as
+// literal with one set of prefix codes, which is simple but compresses photos far less than
+// lossy encoders.
+
+// maxWebPSize is the maximum width and height of a VP8L image.
+const maxWebPSize = 1 << 14
+
+// Limits of the code lengths of the prefix codes and of the code length code
+const (
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 7
+)
+
+// webpCodeLengthOrder is the order in which the lengths of the code length code are written.
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// bitWriter writes values with their least significant bit first, like VP8L reads them.
+type bitWriter struct {
+	buf   bytes.Buffer
+	bits  uint64
+	nBits uint
+}
+
+func (w *bitWriter) write(value uint32, n uint) {
+	w.bits |= uint64(value) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf.WriteByte(byte(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+func (w *bitWriter) flush() []byte {
+	if w.nBits > 0 {
+		w.buf.WriteByte(byte(w.bits))
+		w.bits, w.nBits = 0, 0
+	}
+	return w.buf.Bytes()
+}
+
+// prefixCode is a canonical prefix code, whose codes are stored bit reversed, so they're
+// written as they're read.
+type prefixCode struct {
+	lengths []int
+	codes   []uint32
+	empty   bool // the codes take no bits, as at most one symbol is used
+}
+
+// newPrefixCode returns the prefix code of the histogram with codes of at most limit bits.
+// An alphabet of a single used symbol gets a code of zero bits.
+func newPrefixCode(histogram []int, limit int) *prefixCode {
+	lengths := codeLengths(histogram, limit)
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	if used == 0 {
+		// the decoder requires a symbol, which is never used
+		lengths[0] = 1
+	}
+	c := &prefixCode{lengths: lengths, codes: make([]uint32, len(lengths)), empty: used <= 1}
+	if c.empty {
+		return c
+	}
+
+	var count [maxCodeLength + 2]uint32
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [maxCodeLength + 2]uint32
+	code := uint32(0)
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for symbol, l := range lengths {
+		if l > 0 {
+			c.codes[symbol] = reverseBits(next[l], l)
+			next[l]++
+		}
+	}
+	return c
+}
+
+// write writes the code of the symbol. Codes of single symbol alphabets take no bits.
+func (c *prefixCode) write(w *bitWriter, symbol int) {
+	if !c.empty {
+		w.write(c.codes[symbol], uint(c.lengths[symbol]))
+	}
+}
+
+// single returns the only symbol of the code or -1.
+func (c *prefixCode) single() int {
+	symbol := -1
+	for s, l := range c.lengths {
+		if l > 0 {
+			if symbol >= 0 {
+				return -1
+			}
+			symbol = s
+		}
+	}
+	return symbol
+}
+
+func reverseBits(code uint32, n int) uint32 {
+	var r uint32
+	for i := 0; i < n; i++ {
+		r = r<<1 | code&1
+		code >>= 1
+	}
+	return r
+}
+
+// codeLengths returns the lengths of the Huffman codes of the histogram. The counts are
+// flattened until no code is longer than limit.
+func codeLengths(histogram []int, limit int) []int {
+	counts := append([]int(nil), histogram...)
+	for {
+		lengths := huffmanLengths(counts)
+		max := 0
+		for _, l := range lengths {
+			if l > max {
+				max = l
+			}
+		}
+		if max <= limit {
+			return lengths
+		}
+		for i, c := range counts {
+			if c > 0 {
+				counts[i] = c/2 + 1
+			}
+		}
+	}
+}
+
+// huffmanLengths returns the lengths of the Huffman codes of the counts.
+func huffmanLengths(counts []int) []int {
+	type node struct {
+		count       int
+		symbol      int
+		left, right *node
+	}
+	var nodes []*node
+	for symbol, c := range counts {
+		if c > 0 {
+			nodes = append(nodes, &node{count: c, symbol: symbol})
+		}
+	}
+	lengths := make([]int, len(counts))
+	if len(nodes) == 1 {
+		lengths[nodes[0].symbol] = 1
+	}
+	if len(nodes) <= 1 {
+		return lengths
+	}
+	for len(nodes) > 1 {
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+		merged := &node{count: nodes[0].count + nodes[1].count, symbol: -1, left: nodes[0], right: nodes[1]}
+		nodes = append([]*node{merged}, nodes[2:]...)
+	}
+	var walk func(n *node, depth int)
+	walk = func(n *node, depth int) {
+		if n.symbol >= 0 {
+			lengths[n.symbol] = depth
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk(nodes[0], 0)
+	return lengths
+}
+
+// writePrefixCode writes the code lengths of the code, coded with a code length code.
+func writePrefixCode(w *bitWriter, c *prefixCode) {
+	if symbol := c.single(); c.empty && symbol < 256 {
+		// simple code of one symbol
+		w.write(1, 1)
+		w.write(0, 1)
+		if symbol < 2 {
+			w.write(0, 1)
+			w.write(uint32(symbol), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(symbol), 8)
+		}
+		return
+	}
+
+	w.write(0, 1)
+	histogram := make([]int, len(webpCodeLengthOrder))
+	for _, l := range c.lengths {
+		histogram[l]++
+	}
+	lengthCode := newPrefixCode(histogram, maxCodeLengthCodeLength)
+	n := len(webpCodeLengthOrder)
+	for n > 4 && lengthCode.lengths[webpCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.write(uint32(n-4), 4)
+	for _, symbol := range webpCodeLengthOrder[:n] {
+		w.write(uint32(lengthCode.lengths[symbol]), 3)
+	}
+	// all code lengths are written
+	w.write(0, 1)
+	for _, l := range c.lengths {
+		lengthCode.write(w, l)
+	}
+}
+
+// encodeWebP writes the image as lossless WebP.
+func encodeWebP(out io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > maxWebPSize || height > maxWebPSize {
+		return errors.New("image size not supported by WebP")
+	}
+
+	pixels := make([]color.NRGBA, 0, width*height)
+	opaque := true
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			// subtract green transform
+			c.R -= c.G
+			c.B -= c.G
+			opaque = opaque && c.A == 0xff
+			pixels = append(pixels, c)
+		}
+	}
+	green, red, blue, alpha := make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256)
+	for _, c := range pixels {
+		green[c.G]++
+		red[c.R]++
+		blue[c.B]++
+		alpha[c.A]++
+	}
+	codes := []*prefixCode{
+		newPrefixCode(green, maxCodeLength),
+		newPrefixCode(red, maxCodeLength),
+		newPrefixCode(blue, maxCodeLength),
+		newPrefixCode(alpha, maxCodeLength),
+		newPrefixCode(make([]int, 40), maxCodeLength),
+	}
+
+	w := &bitWriter{}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if opaque {
+		w.write(0, 1)
+	} else {
+		w.write(1, 1)
+	}
+	w.write(0, 3)
+	// subtract green transform and no further ones
+	w.write(1, 1)
+	w.write(2, 2)
+	w.write(0, 1)
+	// no color cache and no meta prefix codes
+	w.write(0, 1)
+	w.write(0, 1)
+	for _, c := range codes {
+		writePrefixCode(w, c)
+	}
+	for _, c := range pixels {
+		codes[0].write(w, int(c.G))
+		codes[1].write(w, int(c.R))
+		codes[2].write(w, int(c.B))
+		codes[3].write(w, int(c.A))
+	}
+	data := w.flush()
+
+	size := len(data)
+	padded := size + size&1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+padded))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(size))
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	if size&1 == 1 {
+		data = append(data, 0)
+	}
+	_, err := out.Write(data)
+	return err
+}
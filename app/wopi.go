@@ -0,0 +1,559 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the WOPI host
+const (
+	defaultWOPITokenTTL   = 10 * time.Hour
+	wopiLockDuration      = 30 * time.Minute
+	wopiDiscoveryInterval = time.Hour
+	wopiTimeout           = 10 * time.Second
+	wopiPrefix            = "/wopi/files/"
+)
+
+var wopiClient = &http.Client{Timeout: wopiTimeout}
+
+// wopiPlaceholder matches the optional parameters of the URLs of the discovery, like
+// <ui=UI_LLCC&>, which are left out.
+var wopiPlaceholder = regexp.MustCompile(`<[^>]*>`)
+
+// WOPI makes dave a WOPI host, so documents can be edited in the browser with a WOPI client
+// like Collabora Online or Office Online. A file is opened in the client with the query
+// ?wopi=edit or ?wopi=view, the client then reaches the files below /wopi/files/ with a
+// signed access token of the user.
+type WOPI struct {
+	// ClientURL is the URL of the WOPI client, whose discovery lists the editors.
+	ClientURL string
+
+	// HostURL is the URL of dave including the prefix as reached by the WOPI client. It
+	// defaults to the URL the browser used.
+	HostURL string
+
+	// Secret signs the access tokens. Without a secret, a random one is used, so tokens
+	// become invalid with a restart.
+	Secret   string
+	TokenTTL time.Duration
+
+	once sync.Once
+	key  []byte
+
+	mu         sync.Mutex
+	locks      map[string]*wopiLock
+	actions    map[string]string
+	discovered time.Time
+}
+
+// wopiLock is a lock of a WOPI client. It's backed by a WebDAV lock, so WebDAV clients can't
+// change the file while it's edited.
+type wopiLock struct {
+	id      string
+	token   string
+	expires time.Time
+}
+
+// wopiToken is the content of an access token, which grants access to a single file.
+type wopiToken struct {
+	User    string `json:"u,omitempty"`
+	Path    string `json:"p"`
+	Write   bool   `json:"w,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+var wopiLaunchPage = template.Must(template.New("wopi").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>body { margin: 0; } iframe { border: 0; width: 100%; height: 100vh; display: block; }</style>
+</head>
+<body>
+<form id="office_form" action="{{.Action}}" method="post" target="office_frame">
+<input name="access_token" value="{{.Token}}" type="hidden">
+<input name="access_token_ttl" value="{{.TTL}}" type="hidden">
+</form>
+<iframe name="office_frame" allowfullscreen></iframe>
+<script>document.getElementById("office_form").submit();</script>
+</body>
+</html>
+`))
+
+// signingKey returns the key of the access tokens.
+func (wp *WOPI) signingKey() []byte {
+	wp.once.Do(func() {
+		if wp.Secret != "" {
+			wp.key = []byte(wp.Secret)
+			return
+		}
+		wp.key = make([]byte, 32)
+		if _, err := rand.Read(wp.key); err != nil {
+			log.WithError(err).Fatal("Error creating the key of the WOPI access tokens")
+		}
+	})
+	return wp.key
+}
+
+func (wp *WOPI) sign(payload string) string {
+	mac := hmac.New(sha256.New, wp.signingKey())
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issueToken returns the signed access token.
+func (wp *WOPI) issueToken(t wopiToken) string {
+	data, _ := json.Marshal(t)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + wp.sign(payload)
+}
+
+// parseToken verifies the signature and the expiry of an access token.
+func (wp *WOPI) parseToken(token string, now time.Time) (*wopiToken, bool) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(wp.sign(token[:i]))) {
+		return nil, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return nil, false
+	}
+	var t wopiToken
+	if err := json.Unmarshal(data, &t); err != nil || now.Unix() > t.Expires {
+		return nil, false
+	}
+	return &t, true
+}
+
+// action returns the URL of the editor of the WOPI client for the action and the file
+// extension. The discovery of the client is cached for an hour. A view falls back to the
+// editor, which is read-only for tokens without write access.
+func (wp *WOPI) action(name, ext string) (string, error) {
+	wp.mu.Lock()
+	actions := wp.actions
+	fresh := time.Since(wp.discovered) < wopiDiscoveryInterval
+	wp.mu.Unlock()
+
+	if !fresh {
+		resp, err := wopiClient.Get(strings.TrimSuffix(wp.ClientURL, "/") + "/hosting/discovery")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("WOPI discovery failed with %s", resp.Status)
+		}
+		if actions, err = parseWOPIDiscovery(resp.Body); err != nil {
+			return "", err
+		}
+		wp.mu.Lock()
+		wp.actions, wp.discovered = actions, time.Now()
+		wp.mu.Unlock()
+	}
+
+	if urlsrc, ok := actions[name+"/"+ext]; ok {
+		return urlsrc, nil
+	}
+	if name == "view" {
+		return actions["edit/"+ext], nil
+	}
+	return "", nil
+}
+
+// parseWOPIDiscovery returns the URLs of the actions of a discovery by action and extension,
+// e.g. edit/docx.
+func parseWOPIDiscovery(r io.Reader) (map[string]string, error) {
+	var discovery struct {
+		Apps []struct {
+			Actions []struct {
+				Name   string `xml:"name,attr"`
+				Ext    string `xml:"ext,attr"`
+				URLSrc string `xml:"urlsrc,attr"`
+			} `xml:"action"`
+		} `xml:"net-zone>app"`
+	}
+	if err := xml.NewDecoder(r).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("invalid WOPI discovery: %s", err)
+	}
+
+	actions := map[string]string{}
+	for _, app := range discovery.Apps {
+		for _, action := range app.Actions {
+			if action.Ext != "" && action.URLSrc != "" {
+				actions[action.Name+"/"+action.Ext] = wopiPlaceholder.ReplaceAllString(action.URLSrc, "")
+			}
+		}
+	}
+	return actions, nil
+}
+
+// wopiFileID returns the id of a file for the WOPI client, the token grants access to it.
+func wopiFileID(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// wopiVersion returns the version of a file, which changes with every write.
+func wopiVersion(fi os.FileInfo) string {
+	return fmt.Sprintf("%x%x", fi.ModTime().UnixNano(), fi.Size())
+}
+
+// serveWOPILaunch answers a GET of a file with the query wopi=edit or wopi=view by a page,
+// which opens the file in the editor of the WOPI client. It returns whether the request has
+// been handled.
+func (a *App) serveWOPILaunch(w http.ResponseWriter, r *http.Request) bool {
+	wp := a.Config.WOPI
+	mode := r.URL.Query().Get("wopi")
+	if wp == nil || r.Method != http.MethodGet || mode == "" {
+		return false
+	}
+	if mode != "edit" && mode != "view" {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return true
+	}
+
+	ctx := r.Context()
+	if !strings.HasPrefix(r.URL.Path, a.Handler.Prefix) {
+		http.NotFound(w, r)
+		return true
+	}
+	name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, a.Handler.Prefix))
+	fi, err := a.Handler.FileSystem.Stat(ctx, name)
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return true
+	}
+	urlsrc, err := wp.action(mode, strings.TrimPrefix(strings.ToLower(path.Ext(name)), "."))
+	if err != nil {
+		log.WithField("url", wp.ClientURL).WithError(err).Error("Error fetching WOPI discovery")
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return true
+	}
+	if urlsrc == "" {
+		http.Error(w, "415 Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return true
+	}
+
+	ttl := wp.TokenTTL
+	if ttl <= 0 {
+		ttl = defaultWOPITokenTTL
+	}
+	expires := time.Now().Add(ttl)
+	var user string
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		user = authInfo.Username
+	}
+	token := wp.issueToken(wopiToken{
+		User:    user,
+		Path:    name,
+		Write:   mode == "edit" && !a.Config.dryRun() && !a.Config.ReadOnly(),
+		Expires: expires.Unix(),
+	})
+
+	host := wp.HostURL
+	if host == "" {
+		host = a.baseURL(r)
+	}
+	if !strings.HasSuffix(urlsrc, "?") && !strings.HasSuffix(urlsrc, "&") {
+		if strings.Contains(urlsrc, "?") {
+			urlsrc += "&"
+		} else {
+			urlsrc += "?"
+		}
+	}
+	traceStep(ctx, "opening %s in WOPI client", name)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = wopiLaunchPage.Execute(w, map[string]interface{}{
+		"Name":   path.Base(name),
+		"Action": urlsrc + "WOPISrc=" + url.QueryEscape(strings.TrimSuffix(host, "/")+wopiPrefix+wopiFileID(name)),
+		"Token":  token,
+		"TTL":    wopiTTL(expires),
+	})
+	if err != nil {
+		log.WithError(err).Error("Error writing WOPI page")
+	}
+	return true
+}
+
+// serveWOPI serves the WOPI endpoints of the files for the WOPI client, which authenticates
+// with the access token instead of the credentials of the user. It returns whether the
+// request has been handled.
+func (a *App) serveWOPI(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	wp := a.Config.WOPI
+	if wp == nil {
+		return false
+	}
+	p, ok := a.relativePath(r)
+	if !ok || !strings.HasPrefix(p, wopiPrefix) {
+		return false
+	}
+
+	id := strings.TrimPrefix(p, wopiPrefix)
+	op := ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, op = id[:i], id[i+1:]
+	}
+	token, ok := wp.parseToken(r.URL.Query().Get("access_token"), time.Now())
+	if !ok || wopiFileID(token.Path) != id {
+		traceStep(ctx, "invalid or expired WOPI access token")
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return true
+	}
+	traceStep(ctx, "authenticated WOPI request of user %s for %s", token.User, token.Path)
+	a.serveAs(ctx, w, r, token.User, func(w http.ResponseWriter, r *http.Request) {
+		a.serveWOPIFile(w, r, token, op)
+	})
+	return true
+}
+
+// serveWOPIFile dispatches the WOPI operations of a file.
+func (a *App) serveWOPIFile(w http.ResponseWriter, r *http.Request, token *wopiToken, op string) {
+	override := r.Header.Get("X-WOPI-Override")
+	switch {
+	case op == "" && r.Method == http.MethodGet:
+		a.checkWOPIFileInfo(w, r, token)
+	case op == "contents" && r.Method == http.MethodGet:
+		a.getWOPIFile(w, r, token)
+	case op == "contents" && r.Method == http.MethodPost && override == "PUT":
+		a.putWOPIFile(w, r, token)
+	case op == "" && r.Method == http.MethodPost:
+		a.lockWOPIFile(w, r, token, override)
+	default:
+		http.Error(w, "501 Not Implemented", http.StatusNotImplemented)
+	}
+}
+
+func (a *App) checkWOPIFileInfo(w http.ResponseWriter, r *http.Request, token *wopiToken) {
+	fi, err := a.Handler.FileSystem.Stat(r.Context(), token.Path)
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := token.User
+	if user == "" {
+		user = "anonymous"
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"BaseFileName":            path.Base(token.Path),
+		"OwnerId":                 user,
+		"UserId":                  user,
+		"UserFriendlyName":        user,
+		"Size":                    fi.Size(),
+		"Version":                 wopiVersion(fi),
+		"LastModifiedTime":        fi.ModTime().UTC().Format(time.RFC3339),
+		"UserCanWrite":            token.Write,
+		"ReadOnly":                !token.Write,
+		"UserCanNotWriteRelative": true,
+		"SupportsLocks":           true,
+		"SupportsGetLock":         true,
+		"SupportsUpdate":          true,
+	})
+}
+
+func (a *App) getWOPIFile(w http.ResponseWriter, r *http.Request, token *wopiToken) {
+	f, err := a.Handler.FileSystem.OpenFile(r.Context(), token.Path, os.O_RDONLY, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-WOPI-ItemVersion", wopiVersion(fi))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// putWOPIFile replaces the content of a file. The file has to be locked with the lock of the
+// request, only empty files can be written without lock.
+func (a *App) putWOPIFile(w http.ResponseWriter, r *http.Request, token *wopiToken) {
+	if !token.Write {
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	fi, err := a.Handler.FileSystem.Stat(ctx, token.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	wp := a.Config.WOPI
+	wp.mu.Lock()
+	l := wp.lockOf(a.wopiLockKey(ctx, token.Path), time.Now())
+	wp.mu.Unlock()
+	if (l != nil && l.id != r.Header.Get("X-WOPI-Lock")) || (l == nil && fi.Size() != 0) {
+		writeWOPIConflict(w, l)
+		return
+	}
+
+	f, err := a.Handler.FileSystem.OpenFile(ctx, token.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err == nil {
+		_, err = io.Copy(f, r.Body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if err == errQuotaExceeded || quotaFromContext(ctx).isExceeded() {
+			http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.WithField("path", token.Path).WithError(err).Error("Error writing WOPI file")
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if fi, err := a.Handler.FileSystem.Stat(ctx, token.Path); err == nil {
+		w.Header().Set("X-WOPI-ItemVersion", wopiVersion(fi))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// lockWOPIFile handles the lock operations of the WOPI client. Each lock holds a WebDAV lock
+// of the file.
+func (a *App) lockWOPIFile(w http.ResponseWriter, r *http.Request, token *wopiToken, override string) {
+	ctx := r.Context()
+	if _, err := a.Handler.FileSystem.Stat(ctx, token.Path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	wp := a.Config.WOPI
+	key := a.wopiLockKey(ctx, token.Path)
+	id := r.Header.Get("X-WOPI-Lock")
+	now := time.Now()
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	l := wp.lockOf(key, now)
+
+	switch override {
+	case "GET_LOCK":
+		if l != nil {
+			w.Header().Set("X-WOPI-Lock", l.id)
+		} else {
+			w.Header().Set("X-WOPI-Lock", "")
+		}
+	case "LOCK":
+		if !token.Write {
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if old := r.Header.Get("X-WOPI-OldLock"); old != "" {
+			// unlock and relock with a new id
+			if l == nil || l.id != old {
+				writeWOPIConflict(w, l)
+				return
+			}
+			l.id = id
+			a.refreshWOPILock(l, now)
+			break
+		}
+		if l == nil {
+			davToken, err := a.Handler.LockSystem.Create(now, webdav.LockDetails{
+				Root:      token.Path,
+				Duration:  wopiLockDuration,
+				OwnerXML:  "<D:href>WOPI</D:href>",
+				ZeroDepth: true,
+			})
+			if err != nil {
+				w.Header().Set("X-WOPI-LockFailureReason", "locked by a WebDAV client")
+				writeWOPIConflict(w, nil)
+				return
+			}
+			if wp.locks == nil {
+				wp.locks = map[string]*wopiLock{}
+			}
+			wp.locks[key] = &wopiLock{id: id, token: davToken, expires: now.Add(wopiLockDuration)}
+			break
+		}
+		if l.id != id {
+			writeWOPIConflict(w, l)
+			return
+		}
+		a.refreshWOPILock(l, now)
+	case "REFRESH_LOCK":
+		if l == nil || l.id != id {
+			writeWOPIConflict(w, l)
+			return
+		}
+		a.refreshWOPILock(l, now)
+	case "UNLOCK":
+		if l == nil || l.id != id {
+			writeWOPIConflict(w, l)
+			return
+		}
+		a.Handler.LockSystem.Unlock(now, l.token)
+		delete(wp.locks, key)
+		if fi, err := a.Handler.FileSystem.Stat(ctx, token.Path); err == nil {
+			w.Header().Set("X-WOPI-ItemVersion", wopiVersion(fi))
+		}
+	default:
+		http.Error(w, "501 Not Implemented", http.StatusNotImplemented)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// wopiLockKey returns the physical path of the file, as the names of the users may refer to
+// different files.
+func (a *App) wopiLockKey(ctx context.Context, name string) string {
+	return Dir{Config: a.Config}.resolve(ctx, name)
+}
+
+// lockOf returns the unexpired lock of a file. wp.mu must be held.
+func (wp *WOPI) lockOf(key string, now time.Time) *wopiLock {
+	l := wp.locks[key]
+	if l != nil && now.After(l.expires) {
+		delete(wp.locks, key)
+		return nil
+	}
+	return l
+}
+
+func (a *App) refreshWOPILock(l *wopiLock, now time.Time) {
+	l.expires = now.Add(wopiLockDuration)
+	if _, err := a.Handler.LockSystem.Refresh(now, l.token, wopiLockDuration); err != nil {
+		log.WithError(err).Warn("Error refreshing WebDAV lock of WOPI lock")
+	}
+}
+
+// writeWOPIConflict answers with the current lock of the file, which is empty for unlocked
+// files or files locked by WebDAV clients.
+func writeWOPIConflict(w http.ResponseWriter, l *wopiLock) {
+	if l != nil {
+		w.Header().Set("X-WOPI-Lock", l.id)
+	} else {
+		w.Header().Set("X-WOPI-Lock", "")
+	}
+	w.WriteHeader(http.StatusConflict)
+}
+
+// wopiTTL formats the expiry of an access token for the WOPI client.
+func wopiTTL(expires time.Time) string {
+	return strconv.FormatInt(expires.UnixNano()/int64(time.Millisecond), 10)
+}
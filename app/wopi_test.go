@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+const testWOPIDiscovery = `<?xml version="1.0" encoding="utf-8"?>
+<wopi-discovery>
+  <net-zone name="external-http">
+    <app name="writer">
+      <action default="true" ext="odt" name="edit" urlsrc="https://office.example.com/browser/cool.html?"/>
+      <action ext="docx" name="edit" urlsrc="https://office.example.com/browser/cool.html?&lt;ui=UI_LLCC&amp;&gt;"/>
+    </app>
+    <app name="Capabilities">
+      <action name="getinfo" urlsrc="https://office.example.com/hosting/capabilities"/>
+    </app>
+  </net-zone>
+</wopi-discovery>`
+
+func TestWOPIToken(t *testing.T) {
+	wp := &WOPI{Secret: "secret"}
+	now := time.Now()
+	token := wp.issueToken(wopiToken{User: "alice", Path: "/a.odt", Write: true, Expires: now.Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  bool
+	}{
+		{"valid", token, now, true},
+		{"expired", token, now.Add(2 * time.Hour), false},
+		{"tampered", "x" + token, now, false},
+		{"other secret", (&WOPI{Secret: "other"}).issueToken(wopiToken{Path: "/a.odt", Expires: now.Add(time.Hour).Unix()}), now, false},
+		{"no signature", "abc", now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := wp.parseToken(tt.token, tt.now)
+			if ok != tt.want {
+				t.Fatalf("parseToken() ok = %v, want %v", ok, tt.want)
+			}
+			if ok && (got.User != "alice" || got.Path != "/a.odt" || !got.Write) {
+				t.Errorf("parseToken() = %+v, want the issued token", got)
+			}
+		})
+	}
+}
+
+func TestParseWOPIDiscovery(t *testing.T) {
+	got, err := parseWOPIDiscovery(strings.NewReader(testWOPIDiscovery))
+	if err != nil {
+		t.Fatalf("parseWOPIDiscovery() error = %v", err)
+	}
+	want := map[string]string{
+		"edit/odt":  "https://office.example.com/browser/cool.html?",
+		"edit/docx": "https://office.example.com/browser/cool.html?",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseWOPIDiscovery() = %v, want %v", got, want)
+	}
+}
+
+func TestWOPIHost(t *testing.T) {
+	discovery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosting/discovery" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testWOPIDiscovery))
+	}))
+	defer discovery.Close()
+
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "alice"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "alice", "report.odt"), []byte("draft"), 0600)
+	defer os.RemoveAll(tmpDir)
+
+	subdir := "alice"
+	cfg := &Config{
+		Dir:   tmpDir,
+		Realm: "dave",
+		WOPI:  &WOPI{ClientURL: discovery.URL, HostURL: "http://dave.example.com"},
+		Users: map[string]*UserInfo{
+			"alice": {Password: GenHash([]byte("password")), Subdir: &subdir},
+		},
+	}
+	a := &App{
+		Config: cfg,
+		Handler: &webdav.Handler{
+			FileSystem: Dir{Config: cfg},
+			LockSystem: webdav.NewMemLS(),
+		},
+	}
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		return w
+	}
+
+	launch := func(mode string) (string, string) {
+		req := httptest.NewRequest("GET", "/report.odt?wopi="+mode, nil)
+		req.SetBasicAuth("alice", "password")
+		w := httptest.NewRecorder()
+		handle(context.Background(), w, req, a)
+		if w.Code != http.StatusOK {
+			t.Fatalf("launch status = %v, want %v", w.Code, http.StatusOK)
+		}
+		action := regexp.MustCompile(`action="([^"]*)"`).FindStringSubmatch(w.Body.String())
+		token := regexp.MustCompile(`name="access_token" value="([^"]*)"`).FindStringSubmatch(w.Body.String())
+		if action == nil || token == nil {
+			t.Fatalf("launch page = %s, want a form with the access token", w.Body.String())
+		}
+		return html.UnescapeString(action[1]), html.UnescapeString(token[1])
+	}
+	action, token := launch("edit")
+	src := "http://dave.example.com/wopi/files/" + wopiFileID("/report.odt")
+	if want := "https://office.example.com/browser/cool.html?WOPISrc=" + url.QueryEscape(src); action != want {
+		t.Errorf("launch action = %v, want %v", action, want)
+	}
+	files := "/wopi/files/" + wopiFileID("/report.odt")
+	query := "?access_token=" + url.QueryEscape(token)
+
+	w := do("GET", files+query, "")
+	var info map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &info)
+	if w.Code != http.StatusOK || info["BaseFileName"] != "report.odt" || info["Size"] != 5.0 || info["UserCanWrite"] != true {
+		t.Errorf("CheckFileInfo = %v %s, want the info of the writable file", w.Code, w.Body.String())
+	}
+	if w := do("GET", files+"/contents"+query, ""); w.Body.String() != "draft" || w.Header().Get("X-WOPI-ItemVersion") == "" {
+		t.Errorf("GetFile = %s, want the content with its version", w.Body.String())
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		body     string
+		header   []string
+		want     int
+		wantLock string
+	}{
+		{"without token", files, "", nil, http.StatusUnauthorized, ""},
+		{"token of other file", "/wopi/files/" + wopiFileID("/other.odt") + query, "", nil, http.StatusUnauthorized, ""},
+		{"put without lock", files + "/contents" + query, "x", []string{"X-WOPI-Override", "PUT"}, http.StatusConflict, ""},
+		{"lock", files + query, "", []string{"X-WOPI-Override", "LOCK", "X-WOPI-Lock", "L1"}, http.StatusOK, ""},
+		{"lock by other client", files + query, "", []string{"X-WOPI-Override", "LOCK", "X-WOPI-Lock", "L2"}, http.StatusConflict, "L1"},
+		{"get lock", files + query, "", []string{"X-WOPI-Override", "GET_LOCK"}, http.StatusOK, "L1"},
+		{"put with other lock", files + "/contents" + query, "x", []string{"X-WOPI-Override", "PUT", "X-WOPI-Lock", "L2"}, http.StatusConflict, "L1"},
+		{"put", files + "/contents" + query, "final", []string{"X-WOPI-Override", "PUT", "X-WOPI-Lock", "L1"}, http.StatusOK, ""},
+		{"relock", files + query, "", []string{"X-WOPI-Override", "LOCK", "X-WOPI-Lock", "L3", "X-WOPI-OldLock", "L1"}, http.StatusOK, ""},
+		{"refresh lock", files + query, "", []string{"X-WOPI-Override", "REFRESH_LOCK", "X-WOPI-Lock", "L3"}, http.StatusOK, ""},
+		{"unlock with other lock", files + query, "", []string{"X-WOPI-Override", "UNLOCK", "X-WOPI-Lock", "L1"}, http.StatusConflict, "L3"},
+		{"unsupported operation", files + query, "", []string{"X-WOPI-Override", "PUT_RELATIVE"}, http.StatusNotImplemented, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := "POST"
+			if tt.header == nil {
+				method = "GET"
+			}
+			w := do(method, tt.target, tt.body, tt.header...)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+			if got := w.Header().Get("X-WOPI-Lock"); got != tt.wantLock {
+				t.Errorf("X-WOPI-Lock = %q, want %q", got, tt.wantLock)
+			}
+		})
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, "alice", "report.odt")); string(data) != "final" {
+		t.Errorf("written file = %q, want final", data)
+	}
+	// WebDAV clients can't write while the document is edited
+	req := httptest.NewRequest("PUT", "/report.odt", strings.NewReader("x"))
+	req.SetBasicAuth("alice", "password")
+	w = httptest.NewRecorder()
+	handle(context.Background(), w, req, a)
+	if w.Code != http.StatusLocked {
+		t.Errorf("WebDAV PUT of locked file status = %v, want %v", w.Code, http.StatusLocked)
+	}
+	if w := do("POST", files+query, "", "X-WOPI-Override", "UNLOCK", "X-WOPI-Lock", "L3"); w.Code != http.StatusOK {
+		t.Errorf("unlock status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	_, viewToken := launch("view")
+	w = do("POST", files+"/contents?access_token="+url.QueryEscape(viewToken), "x", "X-WOPI-Override", "PUT")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("PutFile with view token status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"github.com/quic-go/quic-go/http3"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// http3DrainInterval is the interval in which a draining HTTP/3 server checks whether its
+// requests in progress completed.
+const http3DrainInterval = 10 * time.Millisecond
+
+// http3Server lets an HTTP/3 server complete its requests in progress on Shutdown, which
+// quic-go doesn't implement, before its connections are closed. Requests arriving meanwhile
+// are answered with 503 Service Unavailable, so the clients retry them via another listener.
+type http3Server struct {
+	*http3.Server
+	handler http.Handler
+
+	mu       sync.Mutex
+	active   int
+	draining bool
+}
+
+func newHTTP3Server(server *http3.Server) *http3Server {
+	s := &http3Server{Server: server, handler: server.Handler}
+	server.Handler = http.HandlerFunc(s.serveHTTP)
+	return s
+}
+
+func (s *http3Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	s.active++
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+	s.handler.ServeHTTP(w, r)
+}
+
+// Shutdown waits until the requests in progress completed or the context is done and closes
+// the server.
+func (s *http3Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(http3DrainInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		active := s.active
+		s.mu.Unlock()
+		if active == 0 {
+			return s.Server.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
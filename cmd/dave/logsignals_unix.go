@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/micromata/dave/app"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogSignals reopens the log file and the access log on SIGUSR1 and writes the runtime
+// statistics to the log on SIGUSR2.
+func watchLogSignals(a *app.App, logFile *app.LogFile) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR2 {
+				a.LogStats()
+				continue
+			}
+			if err := a.AccessLog.Reopen(); err != nil {
+				log.WithError(err).Error("Error reopening the access log")
+			}
+			if logFile == nil {
+				log.Info("Received SIGUSR1, but no log file is configured")
+				continue
+			}
+			if err := logFile.Reopen(); err != nil {
+				log.WithError(err).Error("Error reopening the log file")
+				continue
+			}
+			log.WithField("path", a.Config.Log.File).Info("Reopened log file")
+		}
+	}()
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "github.com/micromata/dave/app"
+
+// watchLogSignals does nothing, as there are no user signals on Windows.
+func watchLogSignals(a *app.App, logFile *app.LogFile) {}
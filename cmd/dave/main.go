@@ -1,23 +1,39 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
-	"fmt"
 	"github.com/micromata/dave/app"
+	"github.com/quic-go/quic-go/http3"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"golang.org/x/net/webdav"
 	syslog "log"
+	"net"
 	"net/http"
+	"os"
 )
 
 func main() {
 	var configPath string
+	var trace bool
+	var strict bool
 
 	flag.StringVar(&configPath, "config", "", "Path to configuration file")
+	flag.BoolVar(&trace, "trace", false, "Log headers and authorization decisions of every request")
+	flag.BoolVar(&strict, "strict", false, "Reject configuration files with unknown keys")
 	flag.Parse()
 
+	if strict {
+		viper.Set("Strict", true)
+	}
 	config := app.ParseConfig(configPath)
+	if trace {
+		// takes precedence over the configuration file, also on reloads
+		viper.Set("Log.Trace", true)
+		config.Log.Trace = true
+	}
 
 	// Set formatter for logrus
 	formatter := &log.TextFormatter{}
@@ -26,18 +42,212 @@ func main() {
 	// Set formatter for default log outputs
 	logger := log.New()
 	logger.Formatter = formatter
+	var logFile *app.LogFile
+	if config.Log.File != "" {
+		var err error
+		if logFile, err = app.OpenLogFile(config.Log.File); err != nil {
+			log.Fatal(err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+		logger.Out = logFile
+	}
 	writer := logger.Writer()
 	defer writer.Close()
 	syslog.SetOutput(writer)
+	if err := config.StartEventLog(); err != nil {
+		log.Fatal(err)
+	}
+	defer config.StopEventLog()
 
+	if config.DryRun {
+		log.Warn("Dry run mode is enabled, write operations are logged but not executed")
+	}
+	if config.Maintenance != nil && config.Maintenance.Enabled {
+		config.SetMaintenance(true, 0, "")
+	}
+	if err := config.StartPlugins(); err != nil {
+		config.StopPlugins()
+		log.Fatal(err)
+	}
+	defer config.StopPlugins()
+
+	upgrader, err := app.NewUpgrader()
+	if err != nil {
+		log.Fatal(err)
+	}
+	coordinator, err := app.NewCoordinator(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.RemoveOrphanedUploads()
+	quotas, err := app.NewQuotas(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.OnReload(func() { quotas.UpdateLimits(config) })
+	coordinator.Start(quotas)
+	metrics := app.NewMetrics()
+	coordinator.RegisterMetrics(metrics)
+	config.RegisterMetrics(metrics)
+	if !config.Log.Signals {
+		watchReadOnlySignals(config)
+	}
+	watchReloadSignal(config)
+	quotas.RegisterMetrics(metrics)
+	quotas.StartRecalculation()
+	writeLimiter := app.NewWriteLimiter()
+	writeLimiter.RegisterMetrics(metrics)
+	accessLog, err := app.NewAccessLogger(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer accessLog.Close()
+	usage, err := app.NewUsageRecorder(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	usage.Start()
+	bandwidth, err := app.NewBandwidthLimiter(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bandwidth.RegisterMetrics(metrics)
+	bandwidth.Start()
+	alerts, err := app.NewAlerter(config, quotas)
+	if err != nil {
+		log.Fatal(err)
+	}
+	alerts.RegisterMetrics(metrics)
+	alerts.Start()
+	tripwire, err := app.NewTripwire(config, alerts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tripwire.RegisterMetrics(metrics)
+	loginLimiter, err := app.NewLoginLimiter(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loginLimiter.RegisterMetrics(metrics)
+	syncLog, err := app.NewSyncLog(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shares, err := app.NewShareStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy, err := app.NewPolicyScript(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	images, err := app.NewImageCache(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	images.RegisterMetrics(metrics)
+	janitor, err := app.NewJanitor(config, quotas, syncLog)
+	if err != nil {
+		log.Fatal(err)
+	}
+	janitor.RegisterMetrics(metrics)
+	janitor.Start()
+	resources, err := app.NewResourceMonitor(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resources.RegisterMetrics(metrics)
+	resources.Start()
+	integrity, err := app.NewIntegrityChecker(config, alerts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	integrity.RegisterMetrics(metrics)
+	integrity.Start()
+	search, err := app.NewSearchIndex(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	search.RegisterMetrics(metrics)
+	search.Start()
+
+	lockStore, err := app.NewLockStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var lockSystem webdav.LockSystem = webdav.NewMemLS()
+	if coordinator != nil {
+		lockSystem = coordinator.LockSystem()
+	} else if lockStore != nil {
+		lockSystem = lockStore
+	}
+	locks := app.NewLockSystem(lockSystem)
+	locks.RegisterMetrics(metrics)
+	props, err := app.NewPropertyStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replica, err := app.NewReplicator(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replica.RegisterMetrics(metrics)
+	replica.Start()
+	trash, err := app.NewTrashBin(config, quotas, syncLog, replica)
+	if err != nil {
+		log.Fatal(err)
+	}
+	trash.RegisterMetrics(metrics)
+	trash.Start()
+	versions, err := app.NewVersionStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	versions.RegisterMetrics(metrics)
+	versions.Start()
+	webhooks, err := app.NewWebhookDispatcher(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks.RegisterMetrics(metrics)
+	webhooks.Start()
+	var fs webdav.FileSystem = &app.Dir{
+		Config:    config,
+		Quotas:    quotas,
+		Sync:      syncLog,
+		Props:     props,
+		Trash:     trash,
+		Replica:   replica,
+		Versions:  versions,
+		Webhooks:  webhooks,
+		Checksums: integrity,
+	}
+	if storage := config.PluginStorage(); storage != nil {
+		log.Warn("Files are stored by a plugin, the features of the directory aren't available")
+		fs = storage
+	}
+	content, err := app.NewContentFS(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if content != nil {
+		if config.PluginStorage() != nil {
+			log.Fatal("Files can't be stored by a plugin and the content store at once")
+		}
+		log.Warn("Files are stored by their content, the features of the directory aren't available")
+		content.RegisterMetrics(metrics)
+		fs = content
+	}
+	if config.ObjectStore != nil && config.PluginStorage() != nil {
+		log.Fatal("Files can't be stored in the object store and by a plugin at once")
+	}
 	wdHandler := &webdav.Handler{
-		Prefix: config.Prefix,
-		FileSystem: &app.Dir{
-			Config: config,
-		},
-		LockSystem: webdav.NewMemLS(),
+		Prefix:     config.Prefix,
+		FileSystem: fs,
+		LockSystem: locks,
 		Logger: func(request *http.Request, err error) {
-			if config.Log.Error && err != nil {
+			if config.Logging().Error && err != nil {
 				log.Error(err)
 			}
 		},
@@ -46,26 +256,306 @@ func main() {
 	a := &app.App{
 		Config:  config,
 		Handler: wdHandler,
+		Tracker: app.NewTracker(),
+		Locks:   locks,
+		Quotas:  quotas,
+		Metrics: metrics,
+
+		WriteLimiter: writeLimiter,
+		Usage:        usage,
+		Bandwidth:    bandwidth,
+		Alerts:       alerts,
+		Sync:         syncLog,
+		Shares:       shares,
+		Tripwire:     tripwire,
+		Policy:       policy,
+		Images:       images,
+		Coordinator:  coordinator,
+		Upgrader:     upgrader,
+		Resources:    resources,
+		Integrity:    integrity,
+		Content:      content,
+		Search:       search,
+		Props:        props,
+		Trash:        trash,
+		Replica:      replica,
+		Versions:     versions,
+		AccessLog:    accessLog,
+		LoginLimiter: loginLimiter,
+	}
+
+	if config.Log.Signals {
+		watchLogSignals(a, logFile)
+	}
+	if config.Admin != nil {
+		go serveAdmin(a)
+	}
+	if config.FTP != nil {
+		go serveFTP(a, fs)
+	}
+	if config.SFTP != nil {
+		go serveSFTP(a, fs)
+	}
+	if config.S3 != nil {
+		go serveS3(a, fs)
+	}
+
+	for _, acme := range config.ACMEs() {
+		serveACMEChallenges(a, acme)
+	}
+
+	handler := wrapRecovery(app.NewBasicAuthWebdavHandler(a), config)
+
+	// the listeners are open before the previous process of an upgrade stops accepting
+	shutdown := watchShutdownSignals()
+	errs := make(chan error)
+	for _, l := range config.EffectiveListeners() {
+		ln, tlsConfig, err := listen(l, a)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func(l *app.Listener) {
+			errs <- serve(l, ln, tlsConfig, a, handler)
+		}(l)
+	}
+	if err := upgrader.Ready(); err != nil {
+		log.WithError(err).Warn("Error telling the previous process about the upgrade")
+	}
+
+	select {
+	case err := <-errs:
+		log.Fatal(err)
+	case <-upgrader.Done():
+		upgrader.Shutdown()
+		a.Config.Tailscale.Close()
+		log.Info("Upgraded process took over, exiting")
+	case sig := <-shutdown:
+		log.WithField("signal", sig).Info("Received signal to shut down")
+		go func() {
+			<-shutdown
+			log.Warn("Received another signal, exiting without waiting for the requests in progress")
+			os.Exit(1)
+		}()
+		if !a.Shutdown() {
+			log.Warn("Not all requests completed within the shutdown timeout")
+		}
+		log.Info("Server stopped")
 	}
+}
 
-	http.Handle("/", wrapRecovery(app.NewBasicAuthWebdavHandler(a), config))
-	connAddr := fmt.Sprintf("%s:%s", config.Address, config.Port)
+// listen opens the socket of a single listener.
+func listen(l *app.Listener, a *app.App) (net.Listener, *tls.Config, error) {
+	tlsConfig, err := l.TLSConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	var ln net.Listener
+	if l.Tailscale {
+		ln, err = a.Config.Tailscale.Listen(l)
+	} else {
+		ln, err = l.Listen()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return ln, tlsConfig, nil
+}
+
+// serve accepts the connections of a single listener.
+func serve(l *app.Listener, ln net.Listener, tlsConfig *tls.Config, a *app.App, handler http.Handler) error {
+	if a.Config.HTTP3 && tlsConfig != nil {
+		handler = serveHTTP3(l, tlsConfig, a, handler)
+	}
+	server := &http.Server{Handler: handler, TLSConfig: tlsConfig, ConnContext: l.ConnContext, ConnState: a.Tracker.ConnState}
+	a.Upgrader.Track(server)
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	log.WithFields(log.Fields{
+		"address":  host,
+		"port":     port,
+		"security": l.Security(),
+	}).Info("Server is starting and listening")
+	if tlsConfig != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
+
+// serveHTTP3 starts an HTTP/3 listener on the UDP port of the same address and returns a
+// handler for the TCP listener, which advertises it to the clients via Alt-Svc.
+func serveHTTP3(l *app.Listener, tlsConfig *tls.Config, a *app.App, handler http.Handler) http.Handler {
+	server := newHTTP3Server(&http3.Server{
+		Addr:      l.Addr(),
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+	})
+	a.Upgrader.Track(server)
 
-	if config.TLS != nil {
+	go func() {
+		var conn net.PacketConn
+		var err error
+		if l.Tailscale {
+			conn, err = a.Config.Tailscale.ListenPacket(l)
+		} else {
+			conn, err = l.ListenPacket()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 		log.WithFields(log.Fields{
-			"address":  config.Address,
-			"port":     config.Port,
+			"address":  l.Address,
+			"port":     l.Port,
 			"security": "TLS",
-		}).Info("Server is starting and listening")
-		log.Fatal(http.ListenAndServeTLS(connAddr, config.TLS.CertFile, config.TLS.KeyFile, nil))
+		}).Info("HTTP/3 server is starting and listening")
+		// the server is closed after an upgrade or on shutdown
+		if err := server.Serve(conn); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.SetQuicHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serveACMEChallenges starts the listener answering the HTTP-01 challenges of the CA. The
+// handler is created right away, since the manager only uses the challenge once it exists.
+func serveACMEChallenges(a *app.App, acme *app.ACME) {
+	handler := acme.ChallengeHandler()
+	l := acme.ChallengeListener()
+	ln, err := l.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	a.Upgrader.Track(server)
+
+	log.WithFields(log.Fields{
+		"address": l.Address,
+		"port":    l.Port,
+		"hosts":   acme.Hosts,
+	}).Info("ACME challenge listener is starting and listening")
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
+
+func serveAdmin(a *app.App) {
+	adm := a.Config.Admin
+	if len(adm.Users) == 0 {
+		log.Error("Admin API is configured without users and won't be started")
+		return
+	}
+
+	l := &app.Listener{Address: adm.Address, Port: adm.Port, TLS: adm.TLS}
+	tlsConfig, err := l.TLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := l.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Handler: app.NewAdminHandler(a), TLSConfig: tlsConfig}
+	a.Upgrader.Track(server)
 
+	log.WithFields(log.Fields{
+		"address":  l.Address,
+		"port":     l.Port,
+		"security": l.Security(),
+	}).Info("Admin API is starting and listening")
+	if tlsConfig != nil {
+		err = server.ServeTLS(ln, "", "")
 	} else {
-		log.WithFields(log.Fields{
-			"address":  config.Address,
-			"port":     config.Port,
-			"security": "none",
-		}).Info("Server is starting and listening")
-		log.Fatal(http.ListenAndServe(connAddr, nil))
+		err = server.Serve(ln)
+	}
+	// the server is shut down after an upgrade
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// serveFTP starts the FTP frontend on the same file system as the WebDAV handler.
+func serveFTP(a *app.App, fs webdav.FileSystem) {
+	server, err := app.NewFTPServer(a, fs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l := a.Config.FTP.Listener()
+	ln, err := l.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.Upgrader.Track(server)
+
+	log.WithFields(log.Fields{
+		"address":  l.Address,
+		"port":     l.Port,
+		"security": l.Security(),
+	}).Info("FTP server is starting and listening")
+	// the server is shut down after an upgrade
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// serveSFTP starts the SFTP frontend on the same file system as the WebDAV handler.
+func serveSFTP(a *app.App, fs webdav.FileSystem) {
+	server, err := app.NewSFTPServer(a, fs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l := a.Config.SFTP.Listener()
+	ln, err := l.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.Upgrader.Track(server)
+
+	log.WithFields(log.Fields{
+		"address": l.Address,
+		"port":    l.Port,
+	}).Info("SFTP server is starting and listening")
+	// the server is shut down after an upgrade
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// serveS3 starts the S3 gateway on the same file system as the WebDAV handler.
+func serveS3(a *app.App, fs webdav.FileSystem) {
+	handler, err := app.NewS3Handler(a, fs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l := a.Config.S3.Listener()
+	tlsConfig, err := l.TLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln, err := l.Listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Handler: wrapRecovery(handler, a.Config), TLSConfig: tlsConfig}
+	a.Upgrader.Track(server)
+
+	log.WithFields(log.Fields{
+		"address":  l.Address,
+		"port":     l.Port,
+		"security": l.Security(),
+	}).Info("S3 gateway is starting and listening")
+	if tlsConfig != nil {
+		err = server.ServeTLS(ln, "", "")
+	} else {
+		err = server.Serve(ln)
+	}
+	// the server is shut down after an upgrade
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
 }
 
@@ -82,14 +572,7 @@ func wrapRecovery(handler http.Handler, config *app.Config) http.Handler {
 			}
 		}()
 
-		if len(config.Cors.Origin) > 0 {
-			w.Header().Set("Access-Control-Allow-Origin", config.Cors.Origin)
-			w.Header().Set("Access-Control-Allow-Headers", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "*")
-			if config.Cors.Credentials {
-				w.Header().Set("Access-Control-Allow-Credentials", "true")
-			}
-		}
+		config.Cors.WriteHeaders(w, r)
 
 		handler.ServeHTTP(w, r)
 	})
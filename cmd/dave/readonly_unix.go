@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/micromata/dave/app"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReadOnlySignals enables the read-only mode on SIGUSR1 and disables it on SIGUSR2.
+func watchReadOnlySignals(config *app.Config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			config.SetReadOnly(sig == syscall.SIGUSR1)
+		}
+	}()
+}
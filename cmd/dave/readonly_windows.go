@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "github.com/micromata/dave/app"
+
+// watchReadOnlySignals does nothing, as there are no user signals on Windows. The read-only
+// mode is switched via the admin API.
+func watchReadOnlySignals(config *app.Config) {}
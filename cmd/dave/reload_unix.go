@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/micromata/dave/app"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchReloadSignal reloads the configuration file on SIGHUP.
+func watchReloadSignal(config *app.Config) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			config.Reload()
+		}
+	}()
+}
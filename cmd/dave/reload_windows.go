@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "github.com/micromata/dave/app"
+
+// watchReloadSignal does nothing, as there is no SIGHUP on Windows. The configuration file is
+// reloaded, when it changes.
+func watchReloadSignal(config *app.Config) {}
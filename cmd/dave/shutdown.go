@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchShutdownSignals returns the channel receiving SIGTERM and interrupts, which shut the
+// server down gracefully.
+func watchShutdownSignals() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	return signals
+}
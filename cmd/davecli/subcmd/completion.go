@@ -0,0 +1,82 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+)
+
+var completionCmd = &cobra.Command{
+	Use:   "completion bash|zsh|fish|powershell",
+	Short: "Generates the shell completion script",
+	Long: `Generates the shell completion script for davecli.
+
+The script is generated from the command definitions, so it always covers all
+subcommands and flags. Remote names of the configuration are completed as well.
+
+To load the completions in the current bash session:
+
+  source <(davecli completion bash)
+
+To load them for every new zsh session:
+
+  davecli completion zsh > "${fpath[1]}/_davecli"
+
+To load them for every new fish session:
+
+  davecli completion fish > ~/.config/fish/completions/davecli.fish`,
+	Args:                  cobra.ExactValidArgs(1),
+	ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
+	DisableFlagsInUseLine: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		switch args[0] {
+		case "bash":
+			err = RootCmd.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			err = RootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			err = RootCmd.GenFishCompletion(os.Stdout, true)
+		case "powershell":
+			err = RootCmd.GenPowerShellCompletionWithDesc(os.Stdout)
+		}
+		if err != nil {
+			fmt.Printf("An error occurred generating the completion script: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// completeEndpoints completes the source and destination arguments of the transfer commands
+// with the remote names of the configuration and falls back to local files.
+func completeEndpoints(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) >= 2 || strings.Contains(toComplete, ":") {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var names []string
+	for name := range readRemotes() {
+		if strings.HasPrefix(name, toComplete) {
+			names = append(names, name+":/")
+		}
+	}
+	sort.Strings(names)
+
+	return names, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveDefault
+}
+
+// completeUsers completes the names of the users of the configuration.
+func completeUsers(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	cfg, _, err := readConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return cfg.UserNames(), cobra.ShellCompDirectiveNoFileComp
+}
+
+func init() {
+	RootCmd.CompletionOptions.DisableDefaultCmd = true
+	RootCmd.AddCommand(completionCmd)
+}
@@ -0,0 +1,108 @@
+package subcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var checkStrict bool
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Validates the configuration, describes its format and restores backups",
+}
+
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Prints a JSON Schema of the configuration file",
+	Long: `Prints a JSON Schema of the configuration file.
+
+The schema can be used by editors and CI pipelines to validate configuration
+files before they are deployed. It rejects unknown keys.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(app.Schema()); err != nil {
+			fmt.Printf("An error occurred writing the schema: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks whether the configuration file can be parsed",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		read := app.ReadConfig
+		if checkStrict {
+			read = app.ReadConfigStrict
+		}
+
+		_, path, err := read(configPath)
+		if err != nil {
+			fmt.Printf("Configuration %s is invalid: %s\n", path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Configuration %s is valid\n", path)
+	},
+}
+
+var rollbackList bool
+
+var configRollbackCmd = &cobra.Command{
+	Use:   "rollback [backup]",
+	Short: "Restores a backup of the configuration file",
+	Long: `Restores a backup of the configuration file.
+
+The server keeps a timestamped backup of the configuration file whenever it
+loads it and before the admin API changes it. Without a backup given, the
+latest backup differing from the configuration file is restored. A running
+server reloads the restored configuration. The replaced file is backed up as
+well, so the rollback can be reverted.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, path, _ := app.ReadConfig(configPath)
+		if path == "" {
+			fmt.Println("No configuration file found, please specify it with --config")
+			os.Exit(1)
+		}
+
+		if rollbackList {
+			backups, err := app.ListConfigBackups(path)
+			if err != nil {
+				fmt.Printf("An error occurred listing the backups: %s\n", err)
+				os.Exit(1)
+			}
+			for _, b := range backups {
+				fmt.Printf("%s\t%s\n", b.Name, b.Time.Local().Format(time.RFC3339))
+			}
+			return
+		}
+
+		var name string
+		if len(args) > 0 {
+			name = args[0]
+		}
+		backup, err := app.RollbackConfig(path, name)
+		if err != nil {
+			fmt.Printf("An error occurred rolling back %s: %s\n", path, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %s from the backup of %s\n", path, backup.Time.Local().Format(time.RFC3339))
+	},
+}
+
+func init() {
+	configRollbackCmd.Flags().BoolVar(&rollbackList, "list", false, "List the backups instead of restoring one")
+	configCmd.AddCommand(configRollbackCmd)
+	configCheckCmd.Flags().BoolVar(&checkStrict, "strict", false, "Reject unknown keys")
+	configCmd.AddCommand(configSchemaCmd)
+	configCmd.AddCommand(configCheckCmd)
+	RootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,66 @@
+package subcmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path"
+)
+
+var cpRecursive bool
+
+var cpCmd = &cobra.Command{
+	Use:   "cp <source> <destination>",
+	Short: "Copies files from or to a WebDAV server",
+	Long: `Copies files from or to a WebDAV server.
+
+Source and destination are either local paths, URLs of a WebDAV server
+(http://host/path) or references to a remote of the configuration file in
+the form of "name:/path".`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runCopy(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runCopy(srcArg, dstArg string) error {
+	src, srcPath, err := parseEndpoint(srcArg)
+	if err != nil {
+		return err
+	}
+	dst, dstPath, err := parseEndpoint(dstArg)
+	if err != nil {
+		return err
+	}
+
+	srcInfo, err := src.stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("error reading source %s: %s", srcArg, err)
+	}
+
+	// copying into an existing directory keeps the name of the source
+	if dstInfo, err := dst.stat(dstPath); err == nil && dstInfo.IsDir {
+		dstPath = path.Join(dstPath, path.Base(srcPath))
+	}
+
+	if srcInfo.IsDir {
+		if !cpRecursive {
+			return errors.New("source is a directory, use --recursive to copy it")
+		}
+		return copyTree(src, srcPath, dst, dstPath)
+	}
+
+	fmt.Printf("%s -> %s\n", srcArg, dstPath)
+	return copyFile(src, srcPath, dst, dstPath, srcInfo)
+}
+
+func init() {
+	cpCmd.Flags().BoolVarP(&cpRecursive, "recursive", "r", false, "Copy directories recursively")
+	addRemoteFlags(cpCmd)
+	cpCmd.ValidArgsFunction = completeEndpoints
+	RootCmd.AddCommand(cpCmd)
+}
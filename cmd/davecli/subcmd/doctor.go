@@ -0,0 +1,312 @@
+package subcmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Thresholds of the diagnostics
+const (
+	minFreeBytes     = 1 << 30
+	minFreePercent   = 5
+	certExpiryWarn   = 30 * 24 * time.Hour
+	clockSkewWarn    = 2 * time.Second
+	clockSkewFail    = 30 * time.Second
+	ntpEpochOffset   = 2208988800
+	ntpQueryDeadline = 3 * time.Second
+)
+
+var doctorNTPServer string
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Diagnoses the configuration and the environment of the server",
+	Long: `Diagnoses the configuration and the environment of the server.
+
+Checks the configuration for common mistakes, the permissions and free space
+of the base directory, the validity of TLS certificates, the availability of
+the listening ports and the clock skew against an NTP server. Exits with a
+non-zero status if at least one check failed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := &doctor{}
+		d.run()
+
+		fmt.Printf("\n%d checks passed, %d warnings, %d failures\n", d.ok, d.warnings, d.failures)
+		if d.failures > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+type doctor struct {
+	ok       int
+	warnings int
+	failures int
+}
+
+func (d *doctor) pass(format string, args ...interface{}) {
+	d.ok++
+	fmt.Printf("[ OK ] "+format+"\n", args...)
+}
+
+func (d *doctor) warn(format string, args ...interface{}) {
+	d.warnings++
+	fmt.Printf("[WARN] "+format+"\n", args...)
+}
+
+func (d *doctor) fail(format string, args ...interface{}) {
+	d.failures++
+	fmt.Printf("[FAIL] "+format+"\n", args...)
+}
+
+func (d *doctor) run() {
+	cfg, path, err := readConfig()
+	if err != nil {
+		d.fail("Configuration can't be read: %s. Pass the file via --config or place a config.yaml at one of the default locations.", err)
+		return
+	}
+	d.pass("Configuration %s parsed", path)
+	if _, _, err := app.ReadConfigStrict(path); err != nil {
+		d.warn("Configuration %s contains unknown keys, which are ignored: %s", path, err)
+	}
+
+	d.checkUsers(cfg)
+	d.checkDir(cfg)
+	for _, l := range cfg.EffectiveListeners() {
+		if l.TLS != nil {
+			d.checkCertificate("TLS", l.TLS)
+		}
+		if l.Tailscale && l.Address == "" {
+			addr, err := cfg.Tailscale.Address()
+			if err != nil {
+				d.fail("Tailscale address can't be determined: %s. Is tailscaled running and the node logged in?", err)
+				continue
+			}
+			d.pass("Tailscale node address is %s", addr)
+			l.Address = addr
+		}
+		d.checkPort("Server", l)
+	}
+	if cfg.Admin != nil {
+		if len(cfg.Admin.Users) == 0 {
+			d.fail("Admin API is configured without users and won't be started. Add at least one user to admin.users.")
+		}
+		if cfg.Admin.TLS != nil {
+			d.checkCertificate("Admin TLS", cfg.Admin.TLS)
+		}
+		d.checkPort("Admin API", &app.Listener{Address: cfg.Admin.Address, Port: cfg.Admin.Port})
+	}
+	d.checkClock()
+}
+
+func (d *doctor) checkUsers(cfg *app.Config) {
+	if len(cfg.Users) == 0 {
+		d.warn("No users are configured, everybody has full access to %s. Add users if that's not intended.", cfg.Dir)
+		return
+	}
+
+	valid := true
+	for name, user := range cfg.Users {
+		if user != nil && user.Password == "" && user.Tailscale != "" {
+			continue
+		}
+		if user == nil || !app.ValidHash(user.Password) {
+			valid = false
+			d.fail("User %s has no valid password hash. Generate one with 'davecli passwd --user %s'.", name, name)
+		}
+		if user != nil && user.Subdir != nil && strings.Contains(*user.Subdir, "..") {
+			valid = false
+			d.fail("Subdir of user %s contains '..' and might escape the base directory.", name)
+		}
+	}
+	if valid {
+		d.pass("%d users with valid password hashes", len(cfg.Users))
+	}
+}
+
+func (d *doctor) checkDir(cfg *app.Config) {
+	dir := cfg.Dir
+
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		d.warn("Base directory %s doesn't exist. It will be created on startup if the parent is writable.", dir)
+		return
+	}
+	if err != nil {
+		d.fail("Base directory %s can't be accessed: %s", dir, err)
+		return
+	}
+	if !fi.IsDir() {
+		d.fail("Base directory %s is not a directory.", dir)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".dave-doctor-*")
+	if err != nil {
+		d.fail("Base directory %s is not writable: %s. Check the ownership and permissions.", dir, err)
+	} else {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		d.pass("Base directory %s is writable", dir)
+	}
+
+	for name, user := range cfg.Users {
+		if user == nil || user.Subdir == nil {
+			continue
+		}
+		p := filepath.Join(dir, *user.Subdir)
+		if _, err := os.Stat(p); err != nil {
+			d.warn("Directory %s of user %s doesn't exist yet. It will be created on startup.", p, name)
+		}
+	}
+
+	free, total, err := app.DiskUsage(dir)
+	switch {
+	case err != nil:
+		d.warn("Free space of %s can't be determined: %s", dir, err)
+	case free < minFreeBytes || free*100 < total*minFreePercent:
+		d.warn("Only %s of %s are free on %s. Free up space before users run into write errors.",
+			formatBytes(free), formatBytes(total), dir)
+	default:
+		d.pass("%s of %s free on %s", formatBytes(free), formatBytes(total), dir)
+	}
+}
+
+func (d *doctor) checkCertificate(name string, cfg *app.TLS) {
+	for _, kp := range cfg.KeyPairs() {
+		d.checkKeyPair(name, kp)
+	}
+
+	if cfg.ClientCAFile != "" {
+		if _, err := (&app.Listener{TLS: cfg}).TLSConfig(); err != nil {
+			d.fail("%s client certificate authentication can't be set up: %s", name, err)
+		} else {
+			d.pass("%s client certificates are verified against %s", name, cfg.ClientCAFile)
+		}
+	}
+}
+
+func (d *doctor) checkKeyPair(name string, kp *app.KeyPair) {
+	pair, err := tls.LoadX509KeyPair(kp.CertFile, kp.KeyFile)
+	if err != nil {
+		d.fail("%s certificate %s and key %s can't be loaded: %s", name, kp.CertFile, kp.KeyFile, err)
+		return
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		d.fail("%s certificate %s can't be parsed: %s", name, kp.CertFile, err)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case now.After(cert.NotAfter):
+		d.fail("%s certificate %s expired on %s. Renew it.", name, kp.CertFile, cert.NotAfter.Format(time.RFC3339))
+	case now.Before(cert.NotBefore):
+		d.fail("%s certificate %s is not valid before %s. Check the clock.", name, kp.CertFile, cert.NotBefore.Format(time.RFC3339))
+	case cert.NotAfter.Sub(now) < certExpiryWarn:
+		d.warn("%s certificate %s expires on %s. Renew it soon.", name, kp.CertFile, cert.NotAfter.Format(time.RFC3339))
+	default:
+		d.pass("%s certificate %s is valid until %s", name, kp.CertFile, cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+func (d *doctor) checkPort(name string, listener *app.Listener) {
+	l, err := listener.Listen()
+	if err != nil {
+		d.warn("%s address %s is not available: %s. Is the server already running or another process using the port?", name, listener, err)
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+	d.pass("%s address %s is available", name, addr)
+}
+
+func (d *doctor) checkClock() {
+	if doctorNTPServer == "" {
+		return
+	}
+
+	skew, err := queryClockSkew(doctorNTPServer)
+	if err != nil {
+		d.warn("Clock skew can't be determined via %s: %s", doctorNTPServer, err)
+		return
+	}
+	if skew < 0 {
+		skew = -skew
+	}
+
+	switch {
+	case skew > clockSkewFail:
+		d.fail("Clock is off by %s. Enable time synchronization, certificates and lock timeouts depend on it.", skew)
+	case skew > clockSkewWarn:
+		d.warn("Clock is off by %s. Enable time synchronization.", skew)
+	default:
+		d.pass("Clock skew is %s", skew)
+	}
+}
+
+// queryClockSkew returns the offset of the local clock to the given NTP server via SNTP.
+func queryClockSkew(server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, ntpQueryDeadline)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ntpQueryDeadline))
+
+	req := make([]byte, 48)
+	req[0] = 0x1B // leap indicator 0, version 3, client mode
+	sent := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	resp := make([]byte, 48)
+	if _, err := conn.Read(resp); err != nil {
+		return 0, err
+	}
+	received := time.Now()
+
+	secs := binary.BigEndian.Uint32(resp[40:44])
+	frac := binary.BigEndian.Uint32(resp[44:48])
+	if secs == 0 {
+		return 0, fmt.Errorf("invalid response")
+	}
+	serverTime := time.Unix(int64(secs)-ntpEpochOffset, int64(frac)*1e9>>32)
+
+	return serverTime.Sub(sent.Add(received.Sub(sent) / 2)), nil
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&doctorNTPServer, "ntp-server", "pool.ntp.org", "NTP server to check the clock skew against, empty to skip")
+	RootCmd.AddCommand(doctorCmd)
+}
@@ -0,0 +1,176 @@
+package subcmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path"
+)
+
+var (
+	migrateVerify bool
+	migrateForce  bool
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [source] <destination>",
+	Short: "Migrates the whole content of the server to another storage",
+	Long: `Migrates the whole content of the server to another storage.
+
+Copies all directories and files from the source to the destination and
+verifies each copied file by reading it back and comparing its SHA-256
+checksum. Without a source, the base directory of the configuration is
+migrated. The destination uses the same notation as the cp command and must
+be empty, unless --force is given.
+
+Currently the storage of dave is a plain directory tree, so there are no
+properties or versions to migrate besides the content.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		srcArg, dstArg := "", args[0]
+		if len(args) == 2 {
+			srcArg, dstArg = args[0], args[1]
+		} else {
+			cfg, _, err := readConfig()
+			if err != nil {
+				fmt.Printf("An error occurred reading the configuration: %s\n", err)
+				os.Exit(1)
+			}
+			srcArg = cfg.Dir
+		}
+
+		m := &migration{verify: migrateVerify}
+		if err := m.run(srcArg, dstArg); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Migrated %d directories and %d files (%s)", m.dirs, m.files, formatBytes(uint64(m.bytes)))
+		if m.verify {
+			fmt.Print(", all verified")
+		}
+		fmt.Println()
+	},
+}
+
+type migration struct {
+	verify bool
+	dirs   int
+	files  int
+	bytes  int64
+}
+
+func (m *migration) run(srcArg, dstArg string) error {
+	src, srcPath, err := parseEndpoint(srcArg)
+	if err != nil {
+		return err
+	}
+	dst, dstPath, err := parseEndpoint(dstArg)
+	if err != nil {
+		return err
+	}
+
+	srcInfo, err := src.stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("error reading source %s: %s", srcArg, err)
+	}
+	if !srcInfo.IsDir {
+		return fmt.Errorf("source %s is not a directory", srcArg)
+	}
+
+	if !migrateForce {
+		members, err := dst.readDir(dstPath)
+		if err != nil && !dst.isNotExist(err) {
+			return fmt.Errorf("error reading destination %s: %s", dstArg, err)
+		}
+		if len(members) > 0 {
+			return fmt.Errorf("destination %s is not empty, use --force to migrate anyway", dstArg)
+		}
+	}
+
+	return m.migrateDir(src, srcPath, dst, dstPath)
+}
+
+func (m *migration) migrateDir(src endpoint, srcPath string, dst endpoint, dstPath string) error {
+	if err := dst.mkdir(dstPath); err != nil {
+		return fmt.Errorf("error creating directory %s: %s", dstPath, err)
+	}
+	m.dirs++
+
+	members, err := src.readDir(srcPath)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		target := path.Join(dstPath, path.Base(member.Path))
+		if member.IsDir {
+			if err := m.migrateDir(src, member.Path, dst, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Printf("%s -> %s\n", member.Path, target)
+		sum, err := migrateFile(src, member.Path, dst, target, member)
+		if err != nil {
+			return err
+		}
+		if m.verify {
+			if err := verifyFile(dst, target, member.Size, sum); err != nil {
+				return err
+			}
+		}
+		m.files++
+		m.bytes += member.Size
+	}
+
+	return nil
+}
+
+// migrateFile copies a single file and returns the SHA-256 checksum of the read content.
+func migrateFile(src endpoint, srcPath string, dst endpoint, dstPath string, info *app.RemoteFile) ([]byte, error) {
+	rd, err := src.open(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	h := sha256.New()
+	if err := dst.create(dstPath, io.TeeReader(rd, h), info.Size, info.ModTime); err != nil {
+		return nil, fmt.Errorf("error writing %s: %s", dstPath, err)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// verifyFile reads a migrated file back and compares it with the checksum of the source.
+func verifyFile(dst endpoint, p string, size int64, sum []byte) error {
+	rd, err := dst.open(p)
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %s", p, err)
+	}
+	defer rd.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, rd)
+	if err != nil {
+		return fmt.Errorf("error verifying %s: %s", p, err)
+	}
+	if n != size || !bytes.Equal(h.Sum(nil), sum) {
+		return fmt.Errorf("verification of %s failed: content differs from the source", p)
+	}
+
+	return nil
+}
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateVerify, "verify", true, "Verify the checksum of each migrated file")
+	migrateCmd.Flags().BoolVar(&migrateForce, "force", false, "Migrate into a destination which is not empty")
+	addRemoteFlags(migrateCmd)
+	migrateCmd.ValidArgsFunction = completeEndpoints
+	RootCmd.AddCommand(migrateCmd)
+}
@@ -0,0 +1,95 @@
+package subcmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	mountCacheDir string
+	mountCacheTTL time.Duration
+	mountReadOnly bool
+)
+
+var mountCmd = &cobra.Command{
+	Use:   "mount <source> <mountpoint>",
+	Short: "Mounts a WebDAV share as a local file system",
+	Long: `Mounts a directory of a WebDAV server as a local file system via FUSE.
+
+The source is either the URL of a WebDAV server (http://host/path) or a
+reference to a remote of the configuration file in the form of "name:/path".
+Listings and attributes are cached for --cache-ttl. Opened files are kept in
+the cache directory and are only downloaded again, if they changed on the
+server. Modified files are uploaded when they are closed.
+
+The mount is served until it's unmounted with "fusermount -u <mountpoint>" or
+the command is interrupted. Mounting without root privileges requires the
+fusermount helper of libfuse. Only Linux is supported.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runMount(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runMount(srcArg, mountpoint string) error {
+	src, root, err := parseEndpoint(srcArg)
+	if err != nil {
+		return err
+	}
+	remote, ok := src.(*remoteEndpoint)
+	if !ok {
+		return fmt.Errorf("%s is neither a URL nor a remote", srcArg)
+	}
+
+	cacheDir := mountCacheDir
+	if cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256([]byte(remote.url + root))
+		cacheDir = filepath.Join(userCache, "dave", "mount", hex.EncodeToString(sum[:8]))
+	}
+
+	m, err := app.Mount(remote.client, mountpoint, app.MountOptions{
+		Root:     root,
+		CacheDir: cacheDir,
+		CacheTTL: mountCacheTTL,
+		ReadOnly: mountReadOnly,
+	})
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		if err := m.Unmount(); err != nil {
+			fmt.Printf("Error unmounting %s: %s\n", mountpoint, err)
+		}
+	}()
+
+	fmt.Printf("Mounted %s at %s\n", srcArg, mountpoint)
+	return m.Serve()
+}
+
+func init() {
+	mountCmd.Flags().StringVar(&mountCacheDir, "cache-dir", "", "Directory of the cached files (default within the user cache directory)")
+	mountCmd.Flags().DurationVar(&mountCacheTTL, "cache-ttl", time.Second, "How long listings and attributes are cached")
+	mountCmd.Flags().BoolVar(&mountReadOnly, "read-only", false, "Mount the share read-only")
+	addRemoteFlags(mountCmd)
+	mountCmd.ValidArgsFunction = completeEndpoints
+	RootCmd.AddCommand(mountCmd)
+}
@@ -6,13 +6,32 @@ import (
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh/terminal"
 	"os"
+	"strings"
 	"syscall"
 )
 
+var (
+	passwdAlgorithm string
+	passwdCost      int
+	passwdUser      string
+)
+
 var passwdCmd = &cobra.Command{
 	Use:   "passwd",
-	Short: "Generates a BCrypt hash of a given input string",
+	Short: "Generates a BCrypt or Argon2id hash of a given input string",
+	Long: `Generates a BCrypt or Argon2id hash of a given input string.
+
+With --user, the hash is written to the given user of the configuration file
+instead of being printed. A missing user is created.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if passwdAlgorithm != app.HashBcrypt && passwdAlgorithm != app.HashArgon2id {
+			fmt.Printf("Unsupported algorithm %s. Use %s or %s.\n", passwdAlgorithm, app.HashBcrypt, app.HashArgon2id)
+			os.Exit(1)
+		}
+		if !cmd.Flags().Changed("cost") {
+			passwdCost = app.DefaultCost(passwdAlgorithm)
+		}
+
 		pw1 := readPassword()
 		pw2 := readPassword()
 
@@ -24,10 +43,46 @@ var passwdCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		fmt.Printf("Hashed Password: %s\n", app.GenHash(pw1))
+		hash, err := app.GenHashWith(passwdAlgorithm, pw1, passwdCost)
+		if err != nil {
+			fmt.Printf("An error occurred hashing the password: %s\n", err)
+			os.Exit(1)
+		}
+
+		if passwdUser == "" {
+			fmt.Printf("Hashed Password: %s\n", hash)
+			return
+		}
+
+		if err := updateUserPassword(strings.ToLower(passwdUser), hash); err != nil {
+			fmt.Printf("An error occurred updating the user: %s\n", err)
+			os.Exit(1)
+		}
 	},
 }
 
+// updateUserPassword sets the password hash of the user in the configuration file.
+func updateUserPassword(username, hash string) error {
+	cfg, path, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	users := cfg.Users
+	if users == nil {
+		users = map[string]*app.UserInfo{}
+	}
+	if user := users[username]; user != nil {
+		user.Password = hash
+		fmt.Printf("Updated password of user %s in %s\n", username, path)
+	} else {
+		users[username] = &app.UserInfo{Password: hash}
+		fmt.Printf("Added user %s to %s\n", username, path)
+	}
+
+	return app.SaveUsers(path, users)
+}
+
 func readPassword() []byte {
 	fmt.Print("Enter password: ")
 	pw, err := terminal.ReadPassword(int(syscall.Stdin))
@@ -41,5 +96,11 @@ func readPassword() []byte {
 }
 
 func init() {
+	passwdCmd.Flags().StringVarP(&passwdAlgorithm, "algorithm", "a", app.HashBcrypt, "Hashing algorithm, either bcrypt or argon2id")
+	passwdCmd.Flags().IntVar(&passwdCost, "cost", 0, "Cost of the hash: the work factor for bcrypt (default 10), the iterations for argon2id (default 3)")
+	passwdCmd.Flags().StringVar(&passwdUser, "user", "", "Update the password of this user in the configuration file")
+	passwdCmd.RegisterFlagCompletionFunc("algorithm", cobra.FixedCompletions(
+		[]string{app.HashBcrypt, app.HashArgon2id}, cobra.ShellCompDirectiveNoFileComp))
+	passwdCmd.RegisterFlagCompletionFunc("user", completeUsers)
 	RootCmd.AddCommand(passwdCmd)
 }
@@ -2,10 +2,13 @@ package subcmd
 
 import (
 	"fmt"
+	"github.com/micromata/dave/app"
 	"github.com/spf13/cobra"
 	"os"
 )
 
+var configPath string
+
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "davecli",
@@ -20,3 +23,14 @@ func Execute() {
 		os.Exit(1)
 	}
 }
+
+// readConfig reads the configuration file given via --config or found at the default
+// locations of the server. It returns the parsed configuration and the path of the file.
+func readConfig() (*app.Config, string, error) {
+	return app.ReadConfig(configPath)
+}
+
+func init() {
+	RootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Path to configuration file")
+	RootCmd.MarkPersistentFlagFilename("config", "yaml", "yml", "json", "toml")
+}
@@ -0,0 +1,144 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"os"
+	"path"
+)
+
+var (
+	syncDelete bool
+	syncDryRun bool
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <source> <destination>",
+	Short: "Synchronizes a directory one-way from source to destination",
+	Long: `Synchronizes the content of the source directory into the destination directory.
+
+A file is transferred if it is missing at the destination, if the sizes differ
+or if the source file is newer. With --delete, files and directories which
+don't exist at the source are removed from the destination.
+
+Source and destination use the same notation as the cp command.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runSync(args[0], args[1]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runSync(srcArg, dstArg string) error {
+	src, srcPath, err := parseEndpoint(srcArg)
+	if err != nil {
+		return err
+	}
+	dst, dstPath, err := parseEndpoint(dstArg)
+	if err != nil {
+		return err
+	}
+
+	srcInfo, err := src.stat(srcPath)
+	if err != nil {
+		return fmt.Errorf("error reading source %s: %s", srcArg, err)
+	}
+	if !srcInfo.IsDir {
+		return fmt.Errorf("source %s is not a directory", srcArg)
+	}
+
+	return syncDir(src, srcPath, dst, dstPath)
+}
+
+func syncDir(src endpoint, srcPath string, dst endpoint, dstPath string) error {
+	srcMembers, err := src.readDir(srcPath)
+	if err != nil {
+		return err
+	}
+
+	dstMembers := map[string]*app.RemoteFile{}
+	existing, err := dst.readDir(dstPath)
+	switch {
+	case err == nil:
+		for _, m := range existing {
+			dstMembers[path.Base(m.Path)] = m
+		}
+	case dst.isNotExist(err):
+		fmt.Printf("mkdir %s\n", dstPath)
+		if !syncDryRun {
+			if err := dst.mkdir(dstPath); err != nil {
+				return fmt.Errorf("error creating directory %s: %s", dstPath, err)
+			}
+		}
+	default:
+		return err
+	}
+
+	for _, m := range srcMembers {
+		name := path.Base(m.Path)
+		target := path.Join(dstPath, name)
+		d := dstMembers[name]
+		delete(dstMembers, name)
+
+		if d != nil && d.IsDir != m.IsDir {
+			fmt.Printf("remove %s\n", target)
+			if !syncDryRun {
+				if err := dst.remove(target); err != nil {
+					return err
+				}
+			}
+			d = nil
+		}
+
+		if m.IsDir {
+			if err := syncDir(src, m.Path, dst, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !needsSync(m, d) {
+			continue
+		}
+
+		fmt.Printf("%s -> %s\n", m.Path, target)
+		if !syncDryRun {
+			if err := copyFile(src, m.Path, dst, target, m); err != nil {
+				return err
+			}
+		}
+	}
+
+	if syncDelete {
+		for _, d := range dstMembers {
+			fmt.Printf("remove %s\n", d.Path)
+			if !syncDryRun {
+				if err := dst.remove(d.Path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// needsSync decides whether the source file has to be transferred to the destination.
+func needsSync(src, dst *app.RemoteFile) bool {
+	if dst == nil {
+		return true
+	}
+
+	return src.Size != dst.Size || src.ModTime.After(dst.ModTime)
+}
+
+func init() {
+	syncCmd.Flags().BoolVar(&syncDelete, "delete", false, "Delete files at the destination which don't exist at the source")
+	syncCmd.Flags().BoolVarP(&syncDryRun, "dry-run", "n", false, "Only print what would be transferred")
+	addRemoteFlags(syncCmd)
+	syncCmd.ValidArgsFunction = completeEndpoints
+	RootCmd.AddCommand(syncCmd)
+}
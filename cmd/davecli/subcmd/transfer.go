@@ -0,0 +1,252 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	remoteUser     string
+	remotePassword string
+)
+
+// endpoint is one side of a transfer, either a local directory tree or a remote WebDAV server.
+// All paths are slash separated and relative to the root of the endpoint.
+type endpoint interface {
+	stat(p string) (*app.RemoteFile, error)
+	readDir(p string) ([]*app.RemoteFile, error)
+	open(p string) (io.ReadCloser, error)
+	create(p string, r io.Reader, size int64, modTime time.Time) error
+	mkdir(p string) error
+	remove(p string) error
+	isNotExist(err error) bool
+	String() string
+}
+
+// parseEndpoint parses a transfer argument. Arguments of the form "name:/path" refer to a
+// remote defined in the configuration, "http(s)://..." to an arbitrary WebDAV server and
+// everything else to a local path.
+func parseEndpoint(arg string) (endpoint, string, error) {
+	if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		return newRemoteEndpoint(&app.Remote{URL: arg})
+	}
+
+	if i := strings.Index(arg, ":"); i > 1 {
+		remotes := readRemotes()
+		if r, ok := remotes[strings.ToLower(arg[:i])]; ok {
+			ep, root, err := newRemoteEndpoint(r)
+			if err != nil {
+				return nil, "", err
+			}
+			return ep, path.Join(root, arg[i+1:]), nil
+		}
+	}
+
+	return &localEndpoint{}, filepath.ToSlash(arg), nil
+}
+
+func newRemoteEndpoint(r *app.Remote) (endpoint, string, error) {
+	username := r.Username
+	if remoteUser != "" {
+		username = remoteUser
+	}
+	password := r.Password
+	if remotePassword != "" {
+		password = remotePassword
+	} else if env := os.Getenv("DAVE_PASSWORD"); env != "" {
+		password = env
+	}
+
+	client, err := app.NewClient(r.URL, username, password)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &remoteEndpoint{client: client, url: r.URL}, "/", nil
+}
+
+// readRemotes reads the remote definitions of the configuration file, if there is one.
+func readRemotes() map[string]*app.Remote {
+	cfg, _, err := readConfig()
+	if err != nil {
+		return nil
+	}
+
+	return cfg.Remotes
+}
+
+type localEndpoint struct{}
+
+func (l *localEndpoint) stat(p string) (*app.RemoteFile, error) {
+	fi, err := os.Stat(filepath.FromSlash(p))
+	if err != nil {
+		return nil, err
+	}
+
+	return &app.RemoteFile{Path: p, Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()}, nil
+}
+
+func (l *localEndpoint) readDir(p string) ([]*app.RemoteFile, error) {
+	entries, err := os.ReadDir(filepath.FromSlash(p))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*app.RemoteFile
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &app.RemoteFile{
+			Path:    path.Join(p, e.Name()),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+		})
+	}
+
+	return files, nil
+}
+
+func (l *localEndpoint) open(p string) (io.ReadCloser, error) {
+	return os.Open(filepath.FromSlash(p))
+}
+
+func (l *localEndpoint) create(p string, r io.Reader, size int64, modTime time.Time) error {
+	name := filepath.FromSlash(p)
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		return os.Chtimes(name, modTime, modTime)
+	}
+
+	return nil
+}
+
+func (l *localEndpoint) mkdir(p string) error {
+	return os.MkdirAll(filepath.FromSlash(p), os.ModePerm)
+}
+
+func (l *localEndpoint) remove(p string) error {
+	return os.RemoveAll(filepath.FromSlash(p))
+}
+
+func (l *localEndpoint) isNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+func (l *localEndpoint) String() string {
+	return "local"
+}
+
+type remoteEndpoint struct {
+	client *app.Client
+	url    string
+}
+
+func (r *remoteEndpoint) stat(p string) (*app.RemoteFile, error) {
+	return r.client.Stat(p)
+}
+
+func (r *remoteEndpoint) readDir(p string) ([]*app.RemoteFile, error) {
+	return r.client.ReadDir(p)
+}
+
+func (r *remoteEndpoint) open(p string) (io.ReadCloser, error) {
+	return r.client.Open(p)
+}
+
+func (r *remoteEndpoint) create(p string, rd io.Reader, size int64, modTime time.Time) error {
+	return r.client.Upload(p, rd, size)
+}
+
+func (r *remoteEndpoint) mkdir(p string) error {
+	err := r.client.Mkdir(p)
+	if err == nil {
+		return nil
+	}
+	// the collection might already exist
+	if fi, statErr := r.client.Stat(p); statErr == nil && fi.IsDir {
+		return nil
+	}
+
+	return err
+}
+
+func (r *remoteEndpoint) remove(p string) error {
+	return r.client.Remove(p)
+}
+
+func (r *remoteEndpoint) isNotExist(err error) bool {
+	return app.IsNotFound(err)
+}
+
+func (r *remoteEndpoint) String() string {
+	return r.url
+}
+
+// copyFile copies a single file from src to dst.
+func copyFile(src endpoint, srcPath string, dst endpoint, dstPath string, info *app.RemoteFile) error {
+	rd, err := src.open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	if err := dst.create(dstPath, rd, info.Size, info.ModTime); err != nil {
+		return fmt.Errorf("error writing %s: %s", dstPath, err)
+	}
+
+	return nil
+}
+
+// copyTree copies the directory srcPath recursively to dstPath.
+func copyTree(src endpoint, srcPath string, dst endpoint, dstPath string) error {
+	if err := dst.mkdir(dstPath); err != nil {
+		return fmt.Errorf("error creating directory %s: %s", dstPath, err)
+	}
+
+	members, err := src.readDir(srcPath)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		target := path.Join(dstPath, path.Base(m.Path))
+		if m.IsDir {
+			if err := copyTree(src, m.Path, dst, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Printf("%s -> %s\n", m.Path, target)
+		if err := copyFile(src, m.Path, dst, target, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addRemoteFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&remoteUser, "user", "u", "", "Username for the remote server")
+	cmd.Flags().StringVarP(&remotePassword, "password", "p", "", "Password for the remote server (or use DAVE_PASSWORD)")
+}
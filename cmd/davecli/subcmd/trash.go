@@ -0,0 +1,180 @@
+package subcmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	trashAdminURL string
+	trashAdmin    string
+	trashUser     string
+	trashAllUsers bool
+	trashTo       string
+)
+
+var trashCmd = &cobra.Command{
+	Use:   "trash",
+	Short: "Lists, purges and restores the deleted files of a running instance",
+	Long: `Lists, purges and restores the deleted files of a running instance.
+
+The trash is managed via the admin API given by --admin-url, the password of
+the admin user is read from DAVE_ADMIN_PASSWORD or prompted for.`,
+}
+
+var trashListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the items of the trash, latest first",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		if cmd.Flags().Changed("user") {
+			query.Set("user", trashUser)
+		}
+		var items []app.TrashItem
+		if err := trashRequest(http.MethodGet, "trash", query, nil, &items); err != nil {
+			fmt.Printf("An error occurred listing the trash: %s\n", err)
+			os.Exit(1)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSER\tDELETED\tSIZE\tPATH")
+		for _, item := range items {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", item.ID, item.User, item.Deleted.Local().Format(time.RFC3339), item.Size, item.Path)
+		}
+		w.Flush()
+	},
+}
+
+var trashPurgeCmd = &cobra.Command{
+	Use:   "purge [id]",
+	Short: "Purges an item of the trash, the items of a user or, with --all, the whole trash",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := purgeTrash(cmd, args)
+		if err != nil {
+			fmt.Printf("An error occurred purging the trash: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var trashRestoreCmd = &cobra.Command{
+	Use:   "restore <id>",
+	Short: "Restores an item of the trash to its original path or the one given by --to",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var body io.Reader
+		if trashTo != "" {
+			data, err := json.Marshal(map[string]string{"path": trashTo})
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			body = bytes.NewReader(data)
+		}
+		var item app.TrashItem
+		if err := trashRequest(http.MethodPost, "trash/"+url.PathEscape(args[0]), nil, body, &item); err != nil {
+			fmt.Printf("An error occurred restoring the item: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Restored %s to %s\n", item.Path, item.Origin)
+	},
+}
+
+func purgeTrash(cmd *cobra.Command, args []string) error {
+	if len(args) == 1 {
+		if err := trashRequest(http.MethodDelete, "trash/"+url.PathEscape(args[0]), nil, nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Purged %s\n", args[0])
+		return nil
+	}
+
+	query := url.Values{}
+	switch {
+	case cmd.Flags().Changed("user"):
+		query.Set("user", trashUser)
+	case !trashAllUsers:
+		return errors.New("give an id, --user or --all")
+	}
+	var res struct {
+		Purged int `json:"purged"`
+	}
+	if err := trashRequest(http.MethodDelete, "trash", query, nil, &res); err != nil {
+		return err
+	}
+	fmt.Printf("Purged %d items\n", res.Purged)
+	return nil
+}
+
+// trashRequest sends a request to the trash resources of the admin API and decodes the
+// response into result, if it's set.
+func trashRequest(method, resource string, query url.Values, body io.Reader, result interface{}) error {
+	if trashAdminURL == "" {
+		return errors.New("--admin-url is required")
+	}
+	password := os.Getenv("DAVE_ADMIN_PASSWORD")
+	if password == "" {
+		password = string(readPassword())
+	}
+
+	target := strings.TrimSuffix(trashAdminURL, "/") + "/api/v1/" + resource
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.SetBasicAuth(trashAdmin, password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var res struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&res) == nil && res.Error != "" {
+			return fmt.Errorf("admin API responded with %s: %s", resp.Status, res.Error)
+		}
+		return fmt.Errorf("admin API responded with %s", resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func init() {
+	trashCmd.PersistentFlags().StringVar(&trashAdminURL, "admin-url", "", "Admin API of the instance, e.g. http://127.0.0.1:8001")
+	trashCmd.PersistentFlags().StringVar(&trashAdmin, "admin-user", "", "Username for the admin API (password via DAVE_ADMIN_PASSWORD or prompt)")
+	trashListCmd.Flags().StringVar(&trashUser, "user", "", "List only the items deleted by this user")
+	trashPurgeCmd.Flags().StringVar(&trashUser, "user", "", "Purge the items deleted by this user")
+	trashPurgeCmd.Flags().BoolVar(&trashAllUsers, "all", false, "Purge the items of all users")
+	trashRestoreCmd.Flags().StringVar(&trashTo, "to", "", "Restore to this path relative to the base directory instead")
+	trashListCmd.RegisterFlagCompletionFunc("user", completeUsers)
+	trashPurgeCmd.RegisterFlagCompletionFunc("user", completeUsers)
+
+	trashCmd.AddCommand(trashListCmd)
+	trashCmd.AddCommand(trashPurgeCmd)
+	trashCmd.AddCommand(trashRestoreCmd)
+	RootCmd.AddCommand(trashCmd)
+}
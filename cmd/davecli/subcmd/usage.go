@@ -0,0 +1,86 @@
+package subcmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	usageFrom   string
+	usageTo     string
+	usageFormat string
+	usageOutput string
+)
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Exports the storage and transfer usage per user",
+	Long: `Exports the storage and transfer usage per user over a date range.
+
+The usage is read from the usage file of the configuration, which the server
+keeps up to date. The range defaults to the current month, the dates are given
+like 2006-01-02 and are inclusive.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := exportUsage(); err != nil {
+			fmt.Printf("An error occurred exporting the usage: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func exportUsage() error {
+	if usageFormat != "json" && usageFormat != "csv" {
+		return fmt.Errorf("unsupported format %s, use json or csv", usageFormat)
+	}
+	from, to, err := app.ParseUsageRange(usageFrom, usageTo, time.Now())
+	if err != nil {
+		return err
+	}
+
+	cfg, _, err := readConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Usage == nil || cfg.Usage.File == "" {
+		return errors.New("no usage file configured")
+	}
+	records, err := app.ReadUsage(cfg.Usage.File)
+	if err != nil {
+		return err
+	}
+	report := app.UsageReport(records, from, to)
+
+	var out io.Writer = os.Stdout
+	if usageOutput != "" && usageOutput != "-" {
+		f, err := os.OpenFile(usageOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if usageFormat == "csv" {
+		return app.WriteUsageCSV(out, report)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func init() {
+	usageCmd.Flags().StringVar(&usageFrom, "from", "", "First day of the range, defaults to the first day of the month")
+	usageCmd.Flags().StringVar(&usageTo, "to", "", "Last day of the range, defaults to today")
+	usageCmd.Flags().StringVar(&usageFormat, "format", "json", "Format of the export, json or csv")
+	usageCmd.Flags().StringVarP(&usageOutput, "output", "o", "", "Write the export to this file instead of stdout")
+	usageCmd.RegisterFlagCompletionFunc("format", cobra.FixedCompletions([]string{"json", "csv"}, cobra.ShellCompDirectiveNoFileComp))
+
+	RootCmd.AddCommand(usageCmd)
+}
@@ -0,0 +1,169 @@
+package subcmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	exportOutput   string
+	importReplace  bool
+	importAdminURL string
+	importAdmin    string
+)
+
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Exports and imports the users of a configuration",
+}
+
+var usersExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports all users including their password hashes to a portable JSON file",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, _, err := readConfig()
+		if err != nil {
+			fmt.Printf("An error occurred reading the configuration: %s\n", err)
+			os.Exit(1)
+		}
+
+		var out io.Writer = os.Stdout
+		if exportOutput != "" && exportOutput != "-" {
+			f, err := os.OpenFile(exportOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				fmt.Printf("An error occurred creating the export file: %s\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if err := app.ExportUsers(out, cfg.Users); err != nil {
+			fmt.Printf("An error occurred exporting the users: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var usersImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Imports users of an export file into a configuration file or a running instance",
+	Long: `Imports users of an export file into a configuration file or a running instance.
+
+Per default, the users are merged into the users section of the configuration
+file. With --replace, users which aren't part of the export are removed. With
+--admin-url, the users are created or updated via the admin API of a running
+instance instead.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Printf("An error occurred opening the export file: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		users, err := app.ImportUsers(f)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if importAdminURL != "" {
+			err = importViaAdminAPI(users)
+		} else {
+			err = importIntoConfig(users)
+		}
+		if err != nil {
+			fmt.Printf("An error occurred importing the users: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func importIntoConfig(users map[string]*app.UserInfo) error {
+	cfg, path, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	merged := cfg.Users
+	if merged == nil || importReplace {
+		merged = map[string]*app.UserInfo{}
+	}
+	for _, name := range sortedNames(users) {
+		merged[name] = users[name]
+		fmt.Printf("Imported user %s\n", name)
+	}
+
+	return app.SaveUsers(path, merged)
+}
+
+func importViaAdminAPI(users map[string]*app.UserInfo) error {
+	username := importAdmin
+	password := os.Getenv("DAVE_ADMIN_PASSWORD")
+	if password == "" {
+		password = string(readPassword())
+	}
+
+	for _, name := range sortedNames(users) {
+		user := users[name]
+		body, err := json.Marshal(map[string]interface{}{
+			"passwordHash": user.Password,
+			"subdir":       user.Subdir,
+		})
+		if err != nil {
+			return err
+		}
+
+		target := strings.TrimSuffix(importAdminURL, "/") + "/api/v1/users/" + url.PathEscape(name)
+		req, err := http.NewRequest(http.MethodPut, target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(username, password)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("user %s: admin API responded with %s", name, resp.Status)
+		}
+		fmt.Printf("Imported user %s\n", name)
+	}
+
+	return nil
+}
+
+func sortedNames(users map[string]*app.UserInfo) []string {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	usersExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Write the export to this file instead of stdout")
+	usersImportCmd.Flags().BoolVar(&importReplace, "replace", false, "Remove users which aren't part of the export")
+	usersImportCmd.Flags().StringVar(&importAdminURL, "admin-url", "", "Import via the admin API of this instance, e.g. http://127.0.0.1:8001")
+	usersImportCmd.Flags().StringVar(&importAdmin, "admin-user", "", "Username for the admin API (password via DAVE_ADMIN_PASSWORD or prompt)")
+
+	usersCmd.AddCommand(usersExportCmd)
+	usersCmd.AddCommand(usersImportCmd)
+	RootCmd.AddCommand(usersCmd)
+}
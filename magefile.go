@@ -145,7 +145,7 @@ func buildSpecific(t target) (string, string, error) {
 		env = append(env, fmt.Sprintf("GOARCH=%s", t.goarch))
 	}
 
-	daveSource := filepath.Join("cmd", "dave", "main.go")
+	daveSource := "./cmd/dave"
 	daveExe := filepath.Join(DIST, "dave")
 	if t.goos == "windows" {
 		daveExe += ".exe"
@@ -157,7 +157,7 @@ func buildSpecific(t target) (string, string, error) {
 		return "", "", err
 	}
 
-	daveCliSource := filepath.Join("cmd", "davecli", "main.go")
+	daveCliSource := "./cmd/davecli"
 	daveCliExe := filepath.Join(DIST, "davecli")
 	if t.goos == "windows" {
 		daveCliExe += ".exe"
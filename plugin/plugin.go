@@ -0,0 +1,154 @@
+// Package plugin defines the interfaces of the plugins of dave. Plugins are external binaries,
+// which are started by dave and talk to it via RPC, so sites can extend dave without
+// maintaining a fork. A plugin implements one or more of the interfaces and passes them to
+// Serve in its main function:
+//
+//	func main() {
+//		plugin.Serve(&plugin.Plugins{Authenticator: &ldapAuthenticator{}})
+//	}
+package plugin
+
+import (
+	goplugin "github.com/hashicorp/go-plugin"
+	"os"
+	"time"
+)
+
+// Kinds of plugins, under which the implementations are dispensed
+const (
+	KindAuthenticator = "authenticator"
+	KindAuthorizer    = "authorizer"
+	KindEvents        = "events"
+	KindStorage       = "storage"
+)
+
+// Handshake is the handshake between dave and its plugins. The protocol version is increased
+// with incompatible changes of the interfaces.
+var Handshake = goplugin.HandshakeConfig{
+	ProtocolVersion:  1,
+	MagicCookieKey:   "DAVE_PLUGIN",
+	MagicCookieValue: "d5b3f2c4-6e1a-4f0b-9c87-2a1e3b7d9f60",
+}
+
+// Authenticator checks the passwords of the users, e.g. against a directory service. The
+// users still have to be configured in dave, so their subdir and limits apply.
+type Authenticator interface {
+	Authenticate(username, password string) (bool, error)
+}
+
+// Operations of the file system, which are authorized
+const (
+	OpRead   = "read"
+	OpWrite  = "write"
+	OpMkdir  = "mkdir"
+	OpDelete = "delete"
+	OpRename = "rename"
+)
+
+// Access is an operation of a user on the file system, which is authorized. The paths are
+// the ones of the file system of dave, with the subdir of the user.
+type Access struct {
+	User        string
+	Op          string
+	Path        string
+	Destination string
+}
+
+// Authorizer decides whether a user may perform an operation on the file system.
+type Authorizer interface {
+	Authorize(access Access) (bool, error)
+}
+
+// Types of the events
+const (
+	EventMkdir  = "mkdir"
+	EventWrite  = "write"
+	EventDelete = "delete"
+	EventRename = "rename"
+)
+
+// Event is a change of the file system. The paths are the ones of the file system of dave,
+// with the subdir of the user.
+type Event struct {
+	Type        string
+	User        string
+	Path        string
+	Destination string
+	Time        time.Time
+}
+
+// EventHandler is notified of the changes of the file system. The events are delivered in
+// the background, so a slow handler doesn't delay the requests.
+type EventHandler interface {
+	HandleEvent(event Event) error
+}
+
+// FileInfo describes a file of a storage backend.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// Storage is a storage backend replacing the directory of dave. Files are addressed by
+// handles returned by Open. The errors of the os package, like os.ErrNotExist, and io.EOF
+// are passed on to dave.
+type Storage interface {
+	Mkdir(name string, perm os.FileMode) error
+	Open(name string, flag int, perm os.FileMode) (handle uint64, err error)
+	Read(handle uint64, n int) ([]byte, error)
+	Write(handle uint64, p []byte) (int, error)
+	Seek(handle uint64, offset int64, whence int) (int64, error)
+	Readdir(handle uint64, count int) ([]FileInfo, error)
+	StatHandle(handle uint64) (FileInfo, error)
+	Close(handle uint64) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Stat(name string) (FileInfo, error)
+}
+
+// Plugins are the implementations served by a plugin binary. Unused kinds are nil.
+type Plugins struct {
+	Authenticator Authenticator
+	Authorizer    Authorizer
+	EventHandler  EventHandler
+	Storage       Storage
+}
+
+// Serve serves the implementations to dave. It's called by the main function of a plugin
+// binary and doesn't return.
+func Serve(p *Plugins) {
+	goplugin.Serve(&goplugin.ServeConfig{
+		HandshakeConfig: Handshake,
+		Plugins:         p.pluginSet(),
+	})
+}
+
+// PluginSet returns the kinds of plugins dispensed by dave.
+func PluginSet() goplugin.PluginSet {
+	return goplugin.PluginSet{
+		KindAuthenticator: &authenticatorPlugin{},
+		KindAuthorizer:    &authorizerPlugin{},
+		KindEvents:        &eventsPlugin{},
+		KindStorage:       &storagePlugin{},
+	}
+}
+
+// pluginSet returns the implemented kinds, so dave fails to dispense the other ones.
+func (p *Plugins) pluginSet() goplugin.PluginSet {
+	set := goplugin.PluginSet{}
+	if p.Authenticator != nil {
+		set[KindAuthenticator] = &authenticatorPlugin{impl: p.Authenticator}
+	}
+	if p.Authorizer != nil {
+		set[KindAuthorizer] = &authorizerPlugin{impl: p.Authorizer}
+	}
+	if p.EventHandler != nil {
+		set[KindEvents] = &eventsPlugin{impl: p.EventHandler}
+	}
+	if p.Storage != nil {
+		set[KindStorage] = &storagePlugin{impl: p.Storage}
+	}
+	return set
+}
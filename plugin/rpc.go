@@ -0,0 +1,323 @@
+package plugin
+
+import (
+	"errors"
+	goplugin "github.com/hashicorp/go-plugin"
+	"io"
+	"net/rpc"
+	"os"
+	"strings"
+)
+
+// Codes of the errors passed on by RPC, so dave recognizes the errors of the os package
+var errorCodes = []struct {
+	code string
+	err  error
+}{
+	{"EOF", io.EOF},
+	{"ENOENT", os.ErrNotExist},
+	{"EEXIST", os.ErrExist},
+	{"EACCES", os.ErrPermission},
+	{"EINVAL", os.ErrInvalid},
+}
+
+// encodeError prefixes the error of a plugin by the code of its kind.
+func encodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return errors.New(c.code + " " + err.Error())
+		}
+	}
+	return errors.New("- " + err.Error())
+}
+
+// decodeError returns the error of a plugin with the error of the os package of its code, so
+// os.IsNotExist and the like work. The message of the plugin is only kept for other errors.
+func decodeError(err error, name string) error {
+	se, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	code, msg, _ := strings.Cut(string(se), " ")
+	for _, c := range errorCodes {
+		if c.code != code {
+			continue
+		}
+		if c.err == io.EOF {
+			return io.EOF
+		}
+		return &os.PathError{Op: "plugin", Path: name, Err: c.err}
+	}
+	return errors.New(msg)
+}
+
+// authenticatorPlugin dispenses an Authenticator.
+type authenticatorPlugin struct {
+	impl Authenticator
+}
+
+func (p *authenticatorPlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &authenticatorServer{impl: p.impl}, nil
+}
+
+func (p *authenticatorPlugin) Client(_ *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &authenticatorClient{client: c}, nil
+}
+
+type authenticatorServer struct {
+	impl Authenticator
+}
+
+// Credentials are the arguments of Authenticate.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+func (s *authenticatorServer) Authenticate(args Credentials, ok *bool) error {
+	var err error
+	*ok, err = s.impl.Authenticate(args.Username, args.Password)
+	return encodeError(err)
+}
+
+type authenticatorClient struct {
+	client *rpc.Client
+}
+
+func (c *authenticatorClient) Authenticate(username, password string) (bool, error) {
+	var ok bool
+	err := c.client.Call("Plugin.Authenticate", Credentials{username, password}, &ok)
+	return ok, decodeError(err, "")
+}
+
+// authorizerPlugin dispenses an Authorizer.
+type authorizerPlugin struct {
+	impl Authorizer
+}
+
+func (p *authorizerPlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &authorizerServer{impl: p.impl}, nil
+}
+
+func (p *authorizerPlugin) Client(_ *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &authorizerClient{client: c}, nil
+}
+
+type authorizerServer struct {
+	impl Authorizer
+}
+
+func (s *authorizerServer) Authorize(access Access, ok *bool) error {
+	var err error
+	*ok, err = s.impl.Authorize(access)
+	return encodeError(err)
+}
+
+type authorizerClient struct {
+	client *rpc.Client
+}
+
+func (c *authorizerClient) Authorize(access Access) (bool, error) {
+	var ok bool
+	err := c.client.Call("Plugin.Authorize", access, &ok)
+	return ok, decodeError(err, access.Path)
+}
+
+// eventsPlugin dispenses an EventHandler.
+type eventsPlugin struct {
+	impl EventHandler
+}
+
+func (p *eventsPlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &eventsServer{impl: p.impl}, nil
+}
+
+func (p *eventsPlugin) Client(_ *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &eventsClient{client: c}, nil
+}
+
+type eventsServer struct {
+	impl EventHandler
+}
+
+func (s *eventsServer) HandleEvent(event Event, _ *struct{}) error {
+	return encodeError(s.impl.HandleEvent(event))
+}
+
+type eventsClient struct {
+	client *rpc.Client
+}
+
+func (c *eventsClient) HandleEvent(event Event) error {
+	return decodeError(c.client.Call("Plugin.HandleEvent", event, &struct{}{}), event.Path)
+}
+
+// storagePlugin dispenses a Storage.
+type storagePlugin struct {
+	impl Storage
+}
+
+func (p *storagePlugin) Server(*goplugin.MuxBroker) (interface{}, error) {
+	return &storageServer{impl: p.impl}, nil
+}
+
+func (p *storagePlugin) Client(_ *goplugin.MuxBroker, c *rpc.Client) (interface{}, error) {
+	return &storageClient{client: c}, nil
+}
+
+// StorageArgs are the arguments of the calls of a Storage.
+type StorageArgs struct {
+	Name    string
+	NewName string
+	Flag    int
+	Perm    os.FileMode
+	Handle  uint64
+	N       int
+	Data    []byte
+	Offset  int64
+	Whence  int
+}
+
+// StorageReply is the result of the calls of a Storage.
+type StorageReply struct {
+	Handle uint64
+	Data   []byte
+	N      int
+	Offset int64
+	Info   FileInfo
+	Infos  []FileInfo
+}
+
+type storageServer struct {
+	impl Storage
+}
+
+func (s *storageServer) Mkdir(args StorageArgs, _ *StorageReply) error {
+	return encodeError(s.impl.Mkdir(args.Name, args.Perm))
+}
+
+func (s *storageServer) Open(args StorageArgs, reply *StorageReply) error {
+	var err error
+	reply.Handle, err = s.impl.Open(args.Name, args.Flag, args.Perm)
+	return encodeError(err)
+}
+
+func (s *storageServer) Read(args StorageArgs, reply *StorageReply) error {
+	var err error
+	reply.Data, err = s.impl.Read(args.Handle, args.N)
+	if err == io.EOF && len(reply.Data) > 0 {
+		// the data is passed on, the end of the file is reported with the next read
+		err = nil
+	}
+	return encodeError(err)
+}
+
+func (s *storageServer) Write(args StorageArgs, reply *StorageReply) error {
+	var err error
+	reply.N, err = s.impl.Write(args.Handle, args.Data)
+	return encodeError(err)
+}
+
+func (s *storageServer) Seek(args StorageArgs, reply *StorageReply) error {
+	var err error
+	reply.Offset, err = s.impl.Seek(args.Handle, args.Offset, args.Whence)
+	return encodeError(err)
+}
+
+func (s *storageServer) Readdir(args StorageArgs, reply *StorageReply) error {
+	var err error
+	reply.Infos, err = s.impl.Readdir(args.Handle, args.N)
+	return encodeError(err)
+}
+
+func (s *storageServer) StatHandle(args StorageArgs, reply *StorageReply) error {
+	var err error
+	reply.Info, err = s.impl.StatHandle(args.Handle)
+	return encodeError(err)
+}
+
+func (s *storageServer) Close(args StorageArgs, _ *StorageReply) error {
+	return encodeError(s.impl.Close(args.Handle))
+}
+
+func (s *storageServer) RemoveAll(args StorageArgs, _ *StorageReply) error {
+	return encodeError(s.impl.RemoveAll(args.Name))
+}
+
+func (s *storageServer) Rename(args StorageArgs, _ *StorageReply) error {
+	return encodeError(s.impl.Rename(args.Name, args.NewName))
+}
+
+func (s *storageServer) Stat(args StorageArgs, reply *StorageReply) error {
+	var err error
+	reply.Info, err = s.impl.Stat(args.Name)
+	return encodeError(err)
+}
+
+type storageClient struct {
+	client *rpc.Client
+}
+
+func (c *storageClient) call(method string, args StorageArgs) (*StorageReply, error) {
+	var reply StorageReply
+	err := c.client.Call("Plugin."+method, args, &reply)
+	return &reply, decodeError(err, args.Name)
+}
+
+func (c *storageClient) Mkdir(name string, perm os.FileMode) error {
+	_, err := c.call("Mkdir", StorageArgs{Name: name, Perm: perm})
+	return err
+}
+
+func (c *storageClient) Open(name string, flag int, perm os.FileMode) (uint64, error) {
+	reply, err := c.call("Open", StorageArgs{Name: name, Flag: flag, Perm: perm})
+	return reply.Handle, err
+}
+
+func (c *storageClient) Read(handle uint64, n int) ([]byte, error) {
+	reply, err := c.call("Read", StorageArgs{Handle: handle, N: n})
+	return reply.Data, err
+}
+
+func (c *storageClient) Write(handle uint64, p []byte) (int, error) {
+	reply, err := c.call("Write", StorageArgs{Handle: handle, Data: p})
+	return reply.N, err
+}
+
+func (c *storageClient) Seek(handle uint64, offset int64, whence int) (int64, error) {
+	reply, err := c.call("Seek", StorageArgs{Handle: handle, Offset: offset, Whence: whence})
+	return reply.Offset, err
+}
+
+func (c *storageClient) Readdir(handle uint64, count int) ([]FileInfo, error) {
+	reply, err := c.call("Readdir", StorageArgs{Handle: handle, N: count})
+	return reply.Infos, err
+}
+
+func (c *storageClient) StatHandle(handle uint64) (FileInfo, error) {
+	reply, err := c.call("StatHandle", StorageArgs{Handle: handle})
+	return reply.Info, err
+}
+
+func (c *storageClient) Close(handle uint64) error {
+	_, err := c.call("Close", StorageArgs{Handle: handle})
+	return err
+}
+
+func (c *storageClient) RemoveAll(name string) error {
+	_, err := c.call("RemoveAll", StorageArgs{Name: name})
+	return err
+}
+
+func (c *storageClient) Rename(oldName, newName string) error {
+	_, err := c.call("Rename", StorageArgs{Name: oldName, NewName: newName})
+	return err
+}
+
+func (c *storageClient) Stat(name string) (FileInfo, error) {
+	reply, err := c.call("Stat", StorageArgs{Name: name})
+	return reply.Info, err
+}